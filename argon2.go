@@ -0,0 +1,307 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/argon2"
+)
+
+var (
+	argon2Mu   sync.Mutex
+	argon2Impl Argon2KDF = InProcessArgon2KDF
+
+	runtimeNumCPU = runtime.NumCPU
+	unixSysinfo   = unix.Sysinfo
+)
+
+const (
+	// defaultArgon2TargetDuration is the default target duration for Argon2
+	// key derivation when benchmarking.
+	defaultArgon2TargetDuration = 2 * time.Second
+
+	// defaultArgon2MaxMemoryCostKiB is the default maximum memory cost for
+	// Argon2 key derivation when benchmarking. This is reduced to half of the
+	// total system RAM on systems with less memory.
+	defaultArgon2MaxMemoryCostKiB = 1024 * 1024
+
+	// defaultArgon2MaxThreads is the default maximum number of threads used
+	// for Argon2 key derivation.
+	defaultArgon2MaxThreads = 4
+)
+
+// Argon2Mode describes the Argon2 variant.
+type Argon2Mode string
+
+const (
+	// Argon2i is the Argon2i variant, which is resistant to side-channel attacks.
+	Argon2i Argon2Mode = "argon2i"
+
+	// Argon2id is the Argon2id variant, which is a hybrid of Argon2i and Argon2d
+	// and is the recommended variant for passphrase hashing.
+	Argon2id Argon2Mode = "argon2id"
+)
+
+func (m Argon2Mode) internalMode() (argon2.Mode, error) {
+	switch m {
+	case Argon2i:
+		return argon2.ModeI, nil
+	case Argon2id:
+		return argon2.ModeID, nil
+	default:
+		return 0, errors.New("invalid argon2 mode")
+	}
+}
+
+// Argon2CostParams defines the cost parameters for key derivation using Argon2.
+type Argon2CostParams struct {
+	// Time corresponds to the number of passes over the memory.
+	Time uint32
+
+	// MemoryKiB is the amount of memory to use in KiB.
+	MemoryKiB uint32
+
+	// Threads is the number of parallel threads to use.
+	Threads uint8
+}
+
+func (p *Argon2CostParams) internalParams() *argon2.CostParams {
+	return &argon2.CostParams{
+		Time:      p.Time,
+		MemoryKiB: p.MemoryKiB,
+		Threads:   p.Threads}
+}
+
+// Argon2KDF is an interface to abstract use of the Argon2 KDF, so that execution
+// can be delegated to a short-lived helper process where required.
+type Argon2KDF interface {
+	// Derive derives a key of the specified length from the supplied passphrase
+	// and salt, using the specified Argon2 variant and cost parameters.
+	Derive(passphrase string, salt []byte, mode Argon2Mode, params *Argon2CostParams, keyLen uint32) ([]byte, error)
+
+	// Time measures the time taken to derive a key using the specified Argon2
+	// variant and cost parameters. This is used for benchmarking.
+	Time(mode Argon2Mode, params *Argon2CostParams) (time.Duration, error)
+}
+
+// Argon2KDFWithContext is an optional interface that can be implemented by an
+// Argon2KDF that supports cancelling a key derivation, such as an implementation
+// that runs the KDF in another process. When a context-aware function in this
+// package is cancelled and the current implementation doesn't implement this
+// interface, the function returns straight away but the derivation continues in
+// the background until it completes, using CPU time and memory.
+type Argon2KDFWithContext interface {
+	Argon2KDF
+
+	// DeriveContext is the same as Derive, but aborts the derivation and returns
+	// the context's error if the supplied context is cancelled or its deadline
+	// expires before it completes.
+	DeriveContext(ctx context.Context, passphrase string, salt []byte, mode Argon2Mode, params *Argon2CostParams, keyLen uint32) ([]byte, error)
+}
+
+// deriveArgon2Context derives a key using the supplied Argon2KDF, returning early
+// if the supplied context is done. If the implementation doesn't implement
+// Argon2KDFWithContext, the derivation runs to completion in the background and its
+// result is discarded.
+func deriveArgon2Context(ctx context.Context, kdf Argon2KDF, passphrase string, salt []byte, mode Argon2Mode, params *Argon2CostParams, keyLen uint32) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if k, ok := kdf.(Argon2KDFWithContext); ok {
+		return k.DeriveContext(ctx, passphrase, salt, mode, params, keyLen)
+	}
+
+	type result struct {
+		key []byte
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		key, err := kdf.Derive(passphrase, salt, mode, params, keyLen)
+		done <- result{key, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.key, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type inProcessArgon2KDFImpl struct{}
+
+func (inProcessArgon2KDFImpl) Derive(passphrase string, salt []byte, mode Argon2Mode, params *Argon2CostParams, keyLen uint32) ([]byte, error) {
+	m, err := mode.internalMode()
+	if err != nil {
+		return nil, err
+	}
+	return argon2.Key(m, passphrase, salt, params.internalParams(), keyLen)
+}
+
+func (inProcessArgon2KDFImpl) Time(mode Argon2Mode, params *Argon2CostParams) (time.Duration, error) {
+	m, err := mode.internalMode()
+	if err != nil {
+		return 0, err
+	}
+	return argon2.KeyDuration(m, params.internalParams())
+}
+
+// InProcessArgon2KDF is the in-process implementation of the Argon2 KDF. This
+// is the default implementation. Because Argon2 is memory-hard, each key
+// derivation results in a large allocation that the Go runtime may not return
+// to the operating system promptly, so long-lived processes should consider
+// using NewOutOfProcessArgon2KDF instead. It doesn't implement
+// Argon2KDFWithContext, so a derivation can't be stopped once it has started.
+var InProcessArgon2KDF Argon2KDF = inProcessArgon2KDFImpl{}
+
+// SetArgon2KDF sets the Argon2 KDF implementation used by this package,
+// returning the previous implementation. Supplying nil restores the default
+// in-process implementation.
+func SetArgon2KDF(kdf Argon2KDF) Argon2KDF {
+	argon2Mu.Lock()
+	defer argon2Mu.Unlock()
+
+	orig := argon2Impl
+	if kdf == nil {
+		kdf = InProcessArgon2KDF
+	}
+	argon2Impl = kdf
+	return orig
+}
+
+func argon2KDF() Argon2KDF {
+	argon2Mu.Lock()
+	defer argon2Mu.Unlock()
+	return argon2Impl
+}
+
+// Argon2Options specifies the parameters for the Argon2 KDF when protecting a
+// key with a passphrase.
+type Argon2Options struct {
+	// Mode specifies the Argon2 variant. If empty, Argon2id is used.
+	Mode Argon2Mode
+
+	// MemoryKiB specifies the maximum memory cost in KiB when benchmarking,
+	// or the exact memory cost if ForceIterations is not zero. If zero, the
+	// default is 1GiB or half of the total system RAM, whichever is smaller.
+	MemoryKiB uint32
+
+	// ForceIterations specifies the time cost and disables benchmarking if
+	// not zero.
+	ForceIterations uint32
+
+	// TargetDuration specifies the target time for key derivation when
+	// benchmarking. If zero, the default is 2 seconds.
+	TargetDuration time.Duration
+
+	// Parallel specifies the number of parallel threads. If zero, the
+	// default is the number of CPUs or 4, whichever is smaller.
+	Parallel uint8
+}
+
+func (o *Argon2Options) mode() Argon2Mode {
+	if o.Mode == "" {
+		return Argon2id
+	}
+	return o.Mode
+}
+
+func (o *Argon2Options) threads() uint8 {
+	if o.Parallel != 0 {
+		return o.Parallel
+	}
+	n := runtimeNumCPU()
+	if n > defaultArgon2MaxThreads {
+		n = defaultArgon2MaxThreads
+	}
+	return uint8(n)
+}
+
+func (o *Argon2Options) maxMemoryCostKiB() uint32 {
+	if o.MemoryKiB != 0 {
+		return o.MemoryKiB
+	}
+
+	max := uint32(defaultArgon2MaxMemoryCostKiB)
+
+	var info unix.Sysinfo_t
+	if err := unixSysinfo(&info); err != nil {
+		return max
+	}
+	halfRAMKiB := (uint64(info.Totalram) * uint64(info.Unit)) / 2048
+	if halfRAMKiB < uint64(max) {
+		max = uint32(halfRAMKiB)
+	}
+	return max
+}
+
+// costParams returns the Argon2 variant and cost parameters for these options,
+// benchmarking the KDF with the current implementation if required.
+func (o *Argon2Options) costParams() (Argon2Mode, *Argon2CostParams, error) {
+	mode := o.mode()
+	if _, err := mode.internalMode(); err != nil {
+		return "", nil, err
+	}
+
+	if o.ForceIterations != 0 {
+		memoryKiB := o.MemoryKiB
+		if memoryKiB == 0 {
+			memoryKiB = o.maxMemoryCostKiB()
+		}
+		return mode, &Argon2CostParams{
+			Time:      o.ForceIterations,
+			MemoryKiB: memoryKiB,
+			Threads:   o.threads()}, nil
+	}
+
+	targetDuration := o.TargetDuration
+	if targetDuration == 0 {
+		targetDuration = defaultArgon2TargetDuration
+	}
+
+	kdf := argon2KDF()
+	params, err := argon2.Benchmark(&argon2.BenchmarkParams{
+		MaxMemoryCostKiB: o.maxMemoryCostKiB(),
+		TargetDuration:   targetDuration,
+		Threads:          o.threads()},
+		func(params *argon2.CostParams) (time.Duration, error) {
+			return kdf.Time(mode, &Argon2CostParams{
+				Time:      params.Time,
+				MemoryKiB: params.MemoryKiB,
+				Threads:   params.Threads})
+		})
+	if err != nil {
+		return "", nil, xerrors.Errorf("cannot benchmark KDF: %w", err)
+	}
+
+	return mode, &Argon2CostParams{
+		Time:      params.Time,
+		MemoryKiB: params.MemoryKiB,
+		Threads:   params.Threads}, nil
+}
@@ -0,0 +1,240 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// Argon2OutOfProcessCommand is a command for an Argon2 helper process.
+type Argon2OutOfProcessCommand string
+
+const (
+	// Argon2OutOfProcessCommandDerive requests that a key is derived.
+	Argon2OutOfProcessCommandDerive Argon2OutOfProcessCommand = "derive"
+
+	// Argon2OutOfProcessCommandTime requests that the time taken to derive
+	// a key is measured.
+	Argon2OutOfProcessCommandTime Argon2OutOfProcessCommand = "time"
+)
+
+// Argon2OutOfProcessRequest is a request sent to an Argon2 helper process.
+type Argon2OutOfProcessRequest struct {
+	Command    Argon2OutOfProcessCommand `json:"command"`
+	Passphrase string                    `json:"passphrase,omitempty"`
+	Salt       []byte                    `json:"salt,omitempty"`
+	Keylen     uint32                    `json:"keylen,omitempty"`
+	Mode       Argon2Mode                `json:"mode"`
+	Time       uint32                    `json:"time"`
+	MemoryKiB  uint32                    `json:"memory"`
+	Threads    uint8                     `json:"threads"`
+}
+
+func (r *Argon2OutOfProcessRequest) costParams() *Argon2CostParams {
+	return &Argon2CostParams{
+		Time:      r.Time,
+		MemoryKiB: r.MemoryKiB,
+		Threads:   r.Threads}
+}
+
+// Argon2OutOfProcessResponse is the response from an Argon2 helper process.
+type Argon2OutOfProcessResponse struct {
+	Command  Argon2OutOfProcessCommand `json:"command"`
+	Key      []byte                    `json:"key,omitempty"`
+	Duration time.Duration             `json:"duration,omitempty"`
+	Error    string                    `json:"error,omitempty"`
+}
+
+// Err returns an error if the request failed.
+func (r *Argon2OutOfProcessResponse) Err() error {
+	if r.Error == "" {
+		return nil
+	}
+	return errors.New(r.Error)
+}
+
+// RunArgon2OutOfProcessRequest runs the supplied request using the in-process
+// Argon2 KDF implementation and returns the response. It is intended to be
+// called from a dedicated helper process, which should exit once it returns so
+// that the memory used for key derivation is released.
+func RunArgon2OutOfProcessRequest(request *Argon2OutOfProcessRequest) *Argon2OutOfProcessResponse {
+	response := &Argon2OutOfProcessResponse{Command: request.Command}
+
+	switch request.Command {
+	case Argon2OutOfProcessCommandDerive:
+		key, err := InProcessArgon2KDF.Derive(request.Passphrase, request.Salt, request.Mode, request.costParams(), request.Keylen)
+		if err != nil {
+			response.Error = fmt.Sprintf("cannot derive key: %v", err)
+			break
+		}
+		response.Key = key
+	case Argon2OutOfProcessCommandTime:
+		d, err := InProcessArgon2KDF.Time(request.Mode, request.costParams())
+		if err != nil {
+			response.Error = fmt.Sprintf("cannot measure key derivation time: %v", err)
+			break
+		}
+		response.Duration = d
+	default:
+		response.Error = fmt.Sprintf("invalid command: \"%s\"", request.Command)
+	}
+
+	return response
+}
+
+// WaitForAndRunArgon2OutOfProcessRequest reads a single JSON encoded request
+// from in, runs it with RunArgon2OutOfProcessRequest and writes the JSON encoded
+// response to out. This is the entry point for an Argon2 helper process, and is
+// used by the implementation returned from NewOutOfProcessArgon2KDF.
+func WaitForAndRunArgon2OutOfProcessRequest(in io.Reader, out io.Writer) error {
+	var request Argon2OutOfProcessRequest
+	if err := json.NewDecoder(in).Decode(&request); err != nil {
+		return xerrors.Errorf("cannot decode request: %w", err)
+	}
+
+	response := RunArgon2OutOfProcessRequest(&request)
+
+	if err := json.NewEncoder(out).Encode(response); err != nil {
+		return xerrors.Errorf("cannot encode response: %w", err)
+	}
+
+	return nil
+}
+
+type outOfProcessArgon2KDFImpl struct {
+	newHandlerCmd func() (*exec.Cmd, error)
+}
+
+func (k *outOfProcessArgon2KDFImpl) sendRequest(ctx context.Context, request *Argon2OutOfProcessRequest) (*Argon2OutOfProcessResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	cmd, err := k.newHandlerCmd()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create command: %w", err)
+	}
+
+	reqJSON, err := json.Marshal(request)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot encode request: %w", err)
+	}
+
+	var stdout bytes.Buffer
+	cmd.Stdin = bytes.NewReader(reqJSON)
+	cmd.Stdout = &stdout
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, xerrors.Errorf("cannot run helper process: %w", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, xerrors.Errorf("cannot run helper process: %w", err)
+		}
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		<-done
+		return nil, ctx.Err()
+	}
+
+	var response Argon2OutOfProcessResponse
+	if err := json.NewDecoder(&stdout).Decode(&response); err != nil {
+		return nil, xerrors.Errorf("cannot decode response: %w", err)
+	}
+	if response.Command != request.Command {
+		return nil, fmt.Errorf("unexpected response command \"%s\"", response.Command)
+	}
+	if err := response.Err(); err != nil {
+		return nil, xerrors.Errorf("helper process returned an error: %w", err)
+	}
+
+	return &response, nil
+}
+
+func (k *outOfProcessArgon2KDFImpl) Derive(passphrase string, salt []byte, mode Argon2Mode, params *Argon2CostParams, keyLen uint32) ([]byte, error) {
+	return k.DeriveContext(context.Background(), passphrase, salt, mode, params, keyLen)
+}
+
+func (k *outOfProcessArgon2KDFImpl) DeriveContext(ctx context.Context, passphrase string, salt []byte, mode Argon2Mode, params *Argon2CostParams, keyLen uint32) ([]byte, error) {
+	response, err := k.sendRequest(ctx, &Argon2OutOfProcessRequest{
+		Command:    Argon2OutOfProcessCommandDerive,
+		Passphrase: passphrase,
+		Salt:       salt,
+		Keylen:     keyLen,
+		Mode:       mode,
+		Time:       params.Time,
+		MemoryKiB:  params.MemoryKiB,
+		Threads:    params.Threads})
+	if err != nil {
+		return nil, err
+	}
+	return response.Key, nil
+}
+
+func (k *outOfProcessArgon2KDFImpl) Time(mode Argon2Mode, params *Argon2CostParams) (time.Duration, error) {
+	response, err := k.sendRequest(context.Background(), &Argon2OutOfProcessRequest{
+		Command:   Argon2OutOfProcessCommandTime,
+		Mode:      mode,
+		Time:      params.Time,
+		MemoryKiB: params.MemoryKiB,
+		Threads:   params.Threads})
+	if err != nil {
+		return 0, err
+	}
+	return response.Duration, nil
+}
+
+// NewOutOfProcessArgon2KDF returns an Argon2KDF implementation that runs each
+// key derivation in a short-lived helper process, so that the memory required
+// by the KDF is released to the operating system as soon as it completes. This
+// avoids large memory spikes in long-lived processes, which could otherwise
+// result in them being killed because of memory pressure in early boot.
+//
+// The supplied function is called to create the command for each request. The
+// helper process should call WaitForAndRunArgon2OutOfProcessRequest with its
+// standard input and output and then exit. The implementation is enabled by
+// passing it to SetArgon2KDF. The returned implementation also implements
+// Argon2KDFWithContext, and kills the helper process if a derivation is cancelled.
+func NewOutOfProcessArgon2KDF(newHandlerCmd func() (*exec.Cmd, error)) Argon2KDF {
+	if newHandlerCmd == nil {
+		panic("newHandlerCmd cannot be nil")
+	}
+	return &outOfProcessArgon2KDFImpl{newHandlerCmd: newHandlerCmd}
+}
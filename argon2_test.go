@@ -0,0 +1,192 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"context"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+)
+
+// TestArgon2OutOfProcessHelper is the entry point for the helper process used
+// by the out-of-process Argon2 tests. It does nothing unless the test binary
+// is executed by newArgon2HelperCmd.
+func TestArgon2OutOfProcessHelper(t *testing.T) {
+	if os.Getenv("SECBOOT_TEST_ARGON2_HELPER") != "1" {
+		return
+	}
+	if err := WaitForAndRunArgon2OutOfProcessRequest(os.Stdin, os.Stdout); err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func newArgon2HelperCmd() (*exec.Cmd, error) {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestArgon2OutOfProcessHelper$")
+	cmd.Env = append(os.Environ(), "SECBOOT_TEST_ARGON2_HELPER=1")
+	return cmd, nil
+}
+
+type mockArgon2KDF struct {
+	timeCalls []Argon2CostParams
+}
+
+func (k *mockArgon2KDF) Derive(passphrase string, salt []byte, mode Argon2Mode, params *Argon2CostParams, keyLen uint32) ([]byte, error) {
+	return InProcessArgon2KDF.Derive(passphrase, salt, mode, params, keyLen)
+}
+
+func (k *mockArgon2KDF) Time(mode Argon2Mode, params *Argon2CostParams) (time.Duration, error) {
+	k.timeCalls = append(k.timeCalls, *params)
+	return time.Duration(params.Time) * time.Duration(params.MemoryKiB) * time.Microsecond, nil
+}
+
+type argon2Suite struct {
+	kdf *mockArgon2KDF
+}
+
+var _ = Suite(&argon2Suite{})
+
+func (s *argon2Suite) SetUpTest(c *C) {
+	s.kdf = new(mockArgon2KDF)
+	SetArgon2KDF(s.kdf)
+}
+
+func (s *argon2Suite) TearDownTest(c *C) {
+	SetArgon2KDF(nil)
+}
+
+func (s *argon2Suite) TestSetArgon2KDF(c *C) {
+	c.Check(SetArgon2KDF(nil), Equals, s.kdf)
+	c.Check(SetArgon2KDF(s.kdf), Equals, InProcessArgon2KDF)
+}
+
+func (s *argon2Suite) TestInProcessDerive(c *C) {
+	// Test vector from golang.org/x/crypto/argon2.
+	key, err := InProcessArgon2KDF.Derive("password", []byte("somesalt"), Argon2id, &Argon2CostParams{Time: 1, MemoryKiB: 64, Threads: 1}, 24)
+	c.Check(err, IsNil)
+	c.Check(hex.EncodeToString(key), Equals, "655ad15eac652dc59f7170a7332bf49b8469be1fdb9c28bb")
+}
+
+func (s *argon2Suite) TestInProcessDeriveInvalidMode(c *C) {
+	_, err := InProcessArgon2KDF.Derive("password", []byte("somesalt"), "foo", &Argon2CostParams{Time: 1, MemoryKiB: 64, Threads: 1}, 24)
+	c.Check(err, ErrorMatches, "invalid argon2 mode")
+}
+
+func (s *argon2Suite) TestCostParamsForceIterations(c *C) {
+	restore := MockRuntimeNumCPU(2)
+	defer restore()
+
+	opts := &Argon2Options{MemoryKiB: 32 * 1024, ForceIterations: 6}
+	mode, params, err := opts.CostParams()
+	c.Check(err, IsNil)
+	c.Check(mode, Equals, Argon2id)
+	c.Check(params, DeepEquals, &Argon2CostParams{Time: 6, MemoryKiB: 32 * 1024, Threads: 2})
+	c.Check(s.kdf.timeCalls, HasLen, 0)
+}
+
+func (s *argon2Suite) TestCostParamsBenchmark(c *C) {
+	restore := MockRuntimeNumCPU(8)
+	defer restore()
+
+	opts := &Argon2Options{Mode: Argon2i, MemoryKiB: 1024 * 1024, TargetDuration: 2 * time.Second}
+	mode, params, err := opts.CostParams()
+	c.Check(err, IsNil)
+	c.Check(mode, Equals, Argon2i)
+	c.Check(params, DeepEquals, &Argon2CostParams{Time: 4, MemoryKiB: 500000, Threads: 4})
+	c.Check(s.kdf.timeCalls, Not(HasLen), 0)
+}
+
+func (s *argon2Suite) TestCostParamsInvalidMode(c *C) {
+	opts := &Argon2Options{Mode: "foo"}
+	_, _, err := opts.CostParams()
+	c.Check(err, ErrorMatches, "invalid argon2 mode")
+}
+
+type argon2OutOfProcessSuite struct{}
+
+var _ = Suite(&argon2OutOfProcessSuite{})
+
+func (s *argon2OutOfProcessSuite) TestRunRequestDerive(c *C) {
+	response := RunArgon2OutOfProcessRequest(&Argon2OutOfProcessRequest{
+		Command:    Argon2OutOfProcessCommandDerive,
+		Passphrase: "password",
+		Salt:       []byte("somesalt"),
+		Keylen:     24,
+		Mode:       Argon2id,
+		Time:       1,
+		MemoryKiB:  64,
+		Threads:    1})
+	c.Check(response.Err(), IsNil)
+	c.Check(response.Command, Equals, Argon2OutOfProcessCommandDerive)
+	c.Check(hex.EncodeToString(response.Key), Equals, "655ad15eac652dc59f7170a7332bf49b8469be1fdb9c28bb")
+}
+
+func (s *argon2OutOfProcessSuite) TestRunRequestInvalidCommand(c *C) {
+	response := RunArgon2OutOfProcessRequest(&Argon2OutOfProcessRequest{Command: "foo"})
+	c.Check(response.Err(), ErrorMatches, "invalid command: \"foo\"")
+}
+
+func (s *argon2OutOfProcessSuite) TestDerive(c *C) {
+	kdf := NewOutOfProcessArgon2KDF(newArgon2HelperCmd)
+	key, err := kdf.Derive("password", []byte("somesalt"), Argon2id, &Argon2CostParams{Time: 1, MemoryKiB: 64, Threads: 1}, 24)
+	c.Check(err, IsNil)
+	c.Check(hex.EncodeToString(key), Equals, "655ad15eac652dc59f7170a7332bf49b8469be1fdb9c28bb")
+}
+
+func (s *argon2OutOfProcessSuite) TestTime(c *C) {
+	kdf := NewOutOfProcessArgon2KDF(newArgon2HelperCmd)
+	d, err := kdf.Time(Argon2id, &Argon2CostParams{Time: 1, MemoryKiB: 64, Threads: 1})
+	c.Check(err, IsNil)
+	c.Check(d > 0, Equals, true)
+}
+
+func (s *argon2OutOfProcessSuite) TestDeriveError(c *C) {
+	kdf := NewOutOfProcessArgon2KDF(newArgon2HelperCmd)
+	_, err := kdf.Derive("password", []byte("somesalt"), Argon2id, &Argon2CostParams{Time: 0, MemoryKiB: 64, Threads: 1}, 24)
+	c.Check(err, ErrorMatches, "helper process returned an error: cannot derive key: invalid time cost")
+}
+
+func (s *argon2OutOfProcessSuite) TestDeriveContextCancelled(c *C) {
+	kdf := NewOutOfProcessArgon2KDF(newArgon2HelperCmd).(Argon2KDFWithContext)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := kdf.DeriveContext(ctx, "password", []byte("somesalt"), Argon2id, &Argon2CostParams{Time: 1, MemoryKiB: 64, Threads: 1}, 24)
+	c.Check(err, Equals, context.Canceled)
+}
+
+func (s *argon2OutOfProcessSuite) TestDeriveContextTimeout(c *C) {
+	kdf := NewOutOfProcessArgon2KDF(newArgon2HelperCmd).(Argon2KDFWithContext)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := kdf.DeriveContext(ctx, "password", []byte("somesalt"), Argon2id, &Argon2CostParams{Time: 100, MemoryKiB: 256 * 1024, Threads: 1}, 24)
+	c.Check(err, Equals, context.DeadlineExceeded)
+}
@@ -0,0 +1,37 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+//go:build secboot_static
+// +build secboot_static
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+)
+
+// ErrPasswordPromptUnavailable is returned from askPassword in static builds,
+// which must not depend on being able to execute systemd-ask-password. In these
+// builds, passphrases and recovery keys can only be supplied via the io.Reader
+// argument of the activation functions.
+var ErrPasswordPromptUnavailable = errors.New("cannot prompt for password: not supported in this build")
+
+func askPassword(sourceDevicePath, msg string) (string, error) {
+	return "", ErrPasswordPromptUnavailable
+}
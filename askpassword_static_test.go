@@ -0,0 +1,43 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+//go:build secboot_static
+// +build secboot_static
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"golang.org/x/xerrors"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+)
+
+type askPasswordStaticSuite struct{}
+
+var _ = Suite(&askPasswordStaticSuite{})
+
+func (s *askPasswordStaticSuite) TestActivateVolumeWithRecoveryKeyNoPrompt(c *C) {
+	// Interactive prompting isn't available in static builds, so the
+	// recovery key must be supplied via the io.Reader argument.
+	err := ActivateVolumeWithRecoveryKey("data", "/dev/sda1", nil, &ActivateVolumeOptions{RecoveryKeyTries: 1})
+	c.Check(err, ErrorMatches, "cannot obtain recovery key: cannot prompt for password: not supported in this build")
+	c.Check(xerrors.Is(err, ErrPasswordPromptUnavailable), Equals, true)
+}
@@ -0,0 +1,194 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/pcrprofile"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+const (
+	keyslotName         = "default"
+	recoveryKeyslotName = "default-fallback"
+)
+
+var (
+	devicePath             string
+	format                 bool
+	label                  string
+	existingKeyFile        string
+	sealedKeyFile          string
+	recoveryKeyFile        string
+	preset                 string
+	pcrAlgorithm           string
+	pcrPolicyCounterHandle string
+	provision              bool
+	quiet                  bool
+
+	bootAssets pcrprofile.Params
+)
+
+func init() {
+	flag.StringVar(&devicePath, "device", "", "The block device or file containing the LUKS2 volume")
+	flag.BoolVar(&format, "format", false, "Format the device as a new LUKS2 volume. WARNING: this destroys any existing data on the device")
+	flag.StringVar(&label, "label", "", "The label of the new LUKS2 volume when -format is specified")
+	flag.StringVar(&existingKeyFile, "existing-key-file", "", "The file containing an existing key or passphrase for the LUKS2 volume when adopting it")
+	flag.StringVar(&sealedKeyFile, "sealed-key-file", "", "The path to write the sealed key file to")
+	flag.StringVar(&recoveryKeyFile, "recovery-key-file", "", "The path to write the recovery key to. If not specified, the recovery key is printed to stdout")
+	flag.StringVar(&preset, "profile", "pcr7", "The PCR profile preset to seal the key with ("+strings.Join(pcrprofile.PresetNames(), ", ")+")")
+	flag.StringVar(&pcrAlgorithm, "pcr-algorithm", "sha256", "The PCR bank to use for the PCR profile (sha1, sha256, sha384 or sha512)")
+	flag.StringVar(&pcrPolicyCounterHandle, "pcr-policy-counter-handle", "0x01880001", "The handle of the NV index used to revoke old PCR policies, \"auto\" to select an unused handle, or \"none\"")
+	flag.BoolVar(&provision, "provision", false, "Provision the TPM without using the lockout hierarchy before sealing the key")
+	flag.BoolVar(&quiet, "quiet", false, "Don't print progress")
+
+	bootAssets.AddFlags(flag.CommandLine)
+}
+
+func parsePCRPolicyCounterHandle(s string) (tpm2.Handle, error) {
+	switch s {
+	case "none":
+		return secboot_tpm2.NoPCRPolicyCounterHandle, nil
+	case "auto":
+		return secboot_tpm2.AutoPCRPolicyCounterHandle, nil
+	}
+	h, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, err
+	}
+	return tpm2.Handle(h), nil
+}
+
+func enroll() error {
+	switch {
+	case devicePath == "":
+		return errors.New("no device specified")
+	case sealedKeyFile == "":
+		return errors.New("no sealed key file specified")
+	case !format && existingKeyFile == "":
+		return errors.New("either -format or -existing-key-file must be specified")
+	case format && existingKeyFile != "":
+		return errors.New("-format and -existing-key-file cannot both be specified")
+	}
+
+	alg, err := pcrprofile.ParsePCRAlgorithm(pcrAlgorithm)
+	if err != nil {
+		return err
+	}
+	bootAssets.PCRAlgorithm = alg
+
+	handle, err := parsePCRPolicyCounterHandle(pcrPolicyCounterHandle)
+	if err != nil {
+		return xerrors.Errorf("invalid PCR policy counter handle: %w", err)
+	}
+
+	var existingKey []byte
+	if existingKeyFile != "" {
+		existingKey, err = ioutil.ReadFile(existingKeyFile)
+		if err != nil {
+			return xerrors.Errorf("cannot read existing key: %w", err)
+		}
+	}
+
+	// Compute the profile before making any changes, so that a mistake in the boot assets
+	// doesn't leave a partially enrolled volume.
+	profile, err := pcrprofile.Compute(preset, &bootAssets)
+	if err != nil {
+		return xerrors.Errorf("cannot compute PCR profile: %w", err)
+	}
+
+	tpm, err := secboot_tpm2.ConnectToDefaultTPM()
+	if err != nil {
+		return xerrors.Errorf("cannot connect to TPM: %w", err)
+	}
+	defer tpm.Close()
+
+	if provision {
+		if err := tpm.EnsureProvisioned(secboot_tpm2.ProvisionModeWithoutLockout, nil); err != nil && err != secboot_tpm2.ErrTPMProvisioningRequiresLockout {
+			return xerrors.Errorf("cannot provision TPM: %w", err)
+		}
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return xerrors.Errorf("cannot obtain new key: %w", err)
+	}
+
+	var recoveryKey secboot.RecoveryKey
+	if _, err := rand.Read(recoveryKey[:]); err != nil {
+		return xerrors.Errorf("cannot obtain recovery key: %w", err)
+	}
+
+	var e secboot.Enrollment
+	e.AddStep(secboot_tpm2.NewSealKeyToTPMMultipleStep(tpm,
+		[]*secboot_tpm2.SealKeyRequest{{Key: key, Path: sealedKeyFile}},
+		&secboot_tpm2.KeyCreationParams{PCRProfile: profile, PCRPolicyCounterHandle: handle}, nil))
+	if format {
+		e.AddStep(secboot.NewInitializeLUKS2ContainerStep(devicePath, label, key,
+			&secboot.InitializeLUKS2ContainerOptions{InitialKeyslotName: keyslotName}))
+	} else {
+		e.AddStep(secboot.NewAddLUKS2ContainerUnlockKeyStep(devicePath, keyslotName, existingKey, key))
+	}
+	e.AddStep(secboot.NewAddLUKS2ContainerRecoveryKeyStep(devicePath, recoveryKeyslotName, key, recoveryKey))
+
+	var progress secboot.EnrollmentProgressFunc
+	if !quiet {
+		progress = func(description string, percent int) {
+			fmt.Fprintf(os.Stderr, "\r[%3d%%] %-70s", percent, description)
+		}
+	}
+	err = e.Run(progress)
+	if !quiet {
+		fmt.Fprintln(os.Stderr)
+	}
+	if err != nil {
+		return err
+	}
+
+	if recoveryKeyFile == "" {
+		fmt.Printf("Recovery key: %s\n", recoveryKey)
+		return nil
+	}
+	if err := ioutil.WriteFile(recoveryKeyFile, []byte(recoveryKey.String()+"\n"), 0600); err != nil {
+		return xerrors.Errorf("cannot write recovery key: %w", err)
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	if err := enroll(); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot enroll %s: %v\n", devicePath, err)
+		os.Exit(1)
+	}
+}
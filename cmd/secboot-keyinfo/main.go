@@ -0,0 +1,287 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+var (
+	jsonOutput bool
+	luks2      bool
+	checkPCRs  bool
+)
+
+func init() {
+	flag.BoolVar(&jsonOutput, "json", false, "Print the metadata in JSON format")
+	flag.BoolVar(&luks2, "luks2", false, "Treat the arguments as LUKS2 containers and print the metadata of the key data in their tokens")
+	flag.BoolVar(&checkPCRs, "check", false, "Check whether the current PCR values of the host TPM are consistent with the PCR policy of each sealed key")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] <path>...\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+}
+
+// pcrPolicyCheckResult is the result of a dry-run check of the PCR policy of a sealed key against the host TPM.
+type pcrPolicyCheckResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// keyInfo is the metadata printed for a single sealed key file or LUKS2 token.
+type keyInfo struct {
+	Source string `json:"source"`
+
+	// Protector is the type of the mechanism protecting the key, which is "tpm2-sealed-key" for a sealed key
+	// file or the platform name of a KeyData.
+	Protector string `json:"protector"`
+	Error     string `json:"error,omitempty"`
+
+	Version  *uint32 `json:"version,omitempty"`
+	AuthMode string  `json:"auth-mode,omitempty"`
+	Priority *int    `json:"priority,omitempty"`
+
+	PCRSelection           map[string][]int `json:"pcr-selection,omitempty"`
+	PCRPolicyCount         *uint64          `json:"pcr-policy-count,omitempty"`
+	PCRPolicyDigest        string           `json:"pcr-policy-digest,omitempty"`
+	PolicyDigest           string           `json:"policy-digest,omitempty"`
+	PCRPolicyCounterHandle string           `json:"pcr-policy-counter-handle,omitempty"`
+	PINIndexHandle         string           `json:"pin-index-handle,omitempty"`
+
+	// Created is the modification time of a sealed key file. The creation time isn't recorded in the
+	// key data, and the file is only modified when it is created or when its PCR policy is updated.
+	Created *time.Time `json:"created,omitempty"`
+
+	PCRPolicyCheck *pcrPolicyCheckResult `json:"pcr-policy-check,omitempty"`
+}
+
+func formatAuthMode(mode secboot.AuthMode) string {
+	if mode&secboot.AuthModePassphrase > 0 {
+		return "passphrase"
+	}
+	return "none"
+}
+
+func formatHandle(handle tpm2.Handle) string {
+	if handle == tpm2.HandleNull {
+		return ""
+	}
+	return fmt.Sprintf("0x%08x", uint32(handle))
+}
+
+func sealedKeyInfo(tpm *secboot_tpm2.Connection, path string) *keyInfo {
+	info := &keyInfo{Source: path, Protector: "tpm2-sealed-key"}
+
+	k, err := secboot_tpm2.ReadSealedKeyObject(path)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+
+	version := k.Version()
+	count := k.PCRPolicyCount()
+	info.Version = &version
+	info.AuthMode = formatAuthMode(k.AuthMode2F())
+	info.PCRSelection = make(map[string][]int)
+	for _, s := range k.PCRSelection() {
+		info.PCRSelection[s.Hash.String()] = append(info.PCRSelection[s.Hash.String()], s.Select...)
+	}
+	info.PCRPolicyCount = &count
+	info.PCRPolicyDigest = fmt.Sprintf("%x", k.PCRPolicyDigest())
+	info.PolicyDigest = fmt.Sprintf("%x", k.PolicyDigest())
+	info.PCRPolicyCounterHandle = formatHandle(k.PCRPolicyCounterHandle())
+	info.PINIndexHandle = formatHandle(k.PINIndexHandle())
+
+	if fi, err := os.Stat(path); err == nil {
+		t := fi.ModTime()
+		info.Created = &t
+	}
+
+	if tpm != nil {
+		info.PCRPolicyCheck = new(pcrPolicyCheckResult)
+		if err := k.CheckPCRPolicy(tpm); err != nil {
+			info.PCRPolicyCheck.Error = err.Error()
+		} else {
+			info.PCRPolicyCheck.OK = true
+		}
+	}
+
+	return info
+}
+
+func keyDataInfo(r secboot.KeyDataReader) *keyInfo {
+	info := &keyInfo{Source: r.ReadableName()}
+
+	d, err := secboot.ReadKeyData(r)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+
+	priority := d.Priority()
+	info.Protector = d.PlatformName()
+	info.AuthMode = formatAuthMode(d.AuthMode())
+	info.Priority = &priority
+	return info
+}
+
+func luks2KeyInfo(devicePath string) ([]*keyInfo, error) {
+	names, err := secboot.ListLUKS2ContainerKeyDataNames(devicePath)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot list key data for %s: %w", devicePath, err)
+	}
+
+	var out []*keyInfo
+	for _, name := range names {
+		r, err := secboot.NewLUKS2KeyDataReader(devicePath, name)
+		if err != nil {
+			out = append(out, &keyInfo{Source: devicePath + ":" + name, Error: err.Error()})
+			continue
+		}
+		out = append(out, keyDataInfo(r))
+	}
+	return out, nil
+}
+
+func printKeyInfo(infos []*keyInfo) error {
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		return enc.Encode(infos)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	for i, info := range infos {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "Source:\t%s\n", info.Source)
+		fmt.Fprintf(w, "Protector:\t%s\n", info.Protector)
+		if info.Error != "" {
+			fmt.Fprintf(w, "Error:\t%s\n", info.Error)
+			continue
+		}
+		if info.Version != nil {
+			fmt.Fprintf(w, "Version:\t%d\n", *info.Version)
+		}
+		fmt.Fprintf(w, "Auth mode:\t%s\n", info.AuthMode)
+		if info.Priority != nil {
+			fmt.Fprintf(w, "Priority:\t%d\n", *info.Priority)
+		}
+		if info.PCRSelection != nil {
+			var banks []string
+			for alg, pcrs := range info.PCRSelection {
+				banks = append(banks, fmt.Sprintf("%s:%v", alg, pcrs))
+			}
+			sort.Strings(banks)
+			fmt.Fprintf(w, "PCR selection:\t%s\n", strings.Join(banks, " "))
+		}
+		if info.PCRPolicyCount != nil {
+			fmt.Fprintf(w, "PCR policy count:\t%d\n", *info.PCRPolicyCount)
+		}
+		if info.PCRPolicyDigest != "" {
+			fmt.Fprintf(w, "PCR policy digest:\t%s\n", info.PCRPolicyDigest)
+		}
+		if info.PolicyDigest != "" {
+			fmt.Fprintf(w, "Policy digest:\t%s\n", info.PolicyDigest)
+		}
+		if info.PCRPolicyCounterHandle != "" {
+			fmt.Fprintf(w, "PCR policy counter:\t%s\n", info.PCRPolicyCounterHandle)
+		}
+		if info.PINIndexHandle != "" {
+			fmt.Fprintf(w, "PIN index:\t%s\n", info.PINIndexHandle)
+		}
+		if info.Created != nil {
+			fmt.Fprintf(w, "Created:\t%s\n", info.Created.Format(time.RFC3339))
+		}
+		if info.PCRPolicyCheck != nil {
+			result := "satisfied"
+			if !info.PCRPolicyCheck.OK {
+				result = "not satisfied (" + info.PCRPolicyCheck.Error + ")"
+			}
+			fmt.Fprintf(w, "PCR policy:\t%s\n", result)
+		}
+	}
+	return w.Flush()
+}
+
+func run() int {
+	if flag.NArg() == 0 {
+		flag.Usage()
+		return 2
+	}
+
+	var tpm *secboot_tpm2.Connection
+	if checkPCRs && !luks2 {
+		var err error
+		tpm, err = secboot_tpm2.ConnectToDefaultTPM()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot connect to TPM: %v\n", err)
+			return 1
+		}
+		defer tpm.Close()
+	}
+
+	var infos []*keyInfo
+	for _, path := range flag.Args() {
+		if !luks2 {
+			infos = append(infos, sealedKeyInfo(tpm, path))
+			continue
+		}
+
+		luks2Infos, err := luks2KeyInfo(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		infos = append(infos, luks2Infos...)
+	}
+
+	if err := printKeyInfo(infos); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot print key metadata: %v\n", err)
+		return 1
+	}
+
+	for _, info := range infos {
+		if info.Error != "" || (info.PCRPolicyCheck != nil && !info.PCRPolicyCheck.OK) {
+			return 1
+		}
+	}
+	return 0
+}
+
+func main() {
+	flag.Parse()
+	os.Exit(run())
+}
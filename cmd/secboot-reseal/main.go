@@ -0,0 +1,182 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/pcrprofile"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+var (
+	keys          keyList
+	preset        string
+	pcrAlgorithm  string
+	keyringPrefix string
+	revoke        bool
+	scrub         bool
+
+	bootAssets pcrprofile.Params
+)
+
+// keyRef associates a sealed key file with the encrypted device that it unlocks.
+type keyRef struct {
+	devicePath string
+	keyPath    string
+}
+
+// keyList is a flag.Value that accumulates DEVICE=KEYFILE pairs.
+type keyList []keyRef
+
+func (l *keyList) String() string {
+	var s []string
+	for _, k := range *l {
+		s = append(s, k.devicePath+"="+k.keyPath)
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *keyList) Set(value string) error {
+	i := strings.IndexByte(value, '=')
+	if i < 1 || i == len(value)-1 {
+		return fmt.Errorf("expected DEVICE=KEYFILE, got %q", value)
+	}
+	*l = append(*l, keyRef{devicePath: value[:i], keyPath: value[i+1:]})
+	return nil
+}
+
+func init() {
+	flag.Var(&keys, "key", "An encrypted device and the path of its sealed key file in the form DEVICE=KEYFILE (can be repeated)")
+	flag.StringVar(&preset, "profile", "pcr7", "The PCR profile preset to compute the new PCR policy from ("+strings.Join(pcrprofile.PresetNames(), ", ")+")")
+	flag.StringVar(&pcrAlgorithm, "pcr-algorithm", "sha256", "The PCR bank to use for the PCR profile (sha1, sha256, sha384 or sha512)")
+	flag.StringVar(&keyringPrefix, "keyring-prefix", "", "The prefix of the keys in the kernel keyring, as supplied when the devices were activated")
+	flag.BoolVar(&revoke, "revoke", false, "Revoke the previous PCR policies. Only use this once the system has booted successfully with the new boot assets")
+	flag.BoolVar(&scrub, "scrub", false, "Remove the PCR policy update keys from the kernel keyring once the PCR policies have been updated")
+
+	bootAssets.AddFlags(flag.CommandLine)
+}
+
+// keyGroup is a set of sealed key objects that share the same key for authorizing PCR policy
+// updates, eg, because they were created with the same call to SealKeyToTPMMultiple. Keys in the
+// same group share a PCR policy counter, so they must be updated together.
+type keyGroup struct {
+	authKey secboot_tpm2.PolicyAuthKey
+	refs    []keyRef
+	keys    []*secboot_tpm2.SealedKeyObject
+}
+
+func groupKeys(refs []keyRef) ([]*keyGroup, error) {
+	var groups []*keyGroup
+
+Outer:
+	for _, ref := range refs {
+		k, err := secboot_tpm2.ReadSealedKeyObject(ref.keyPath)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read sealed key file %s: %w", ref.keyPath, err)
+		}
+
+		authKey, err := secboot_tpm2.GetAuthKeyFromKernel(keyringPrefix, ref.devicePath, false)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot obtain PCR policy update key for %s: %w", ref.devicePath, err)
+		}
+
+		for _, g := range groups {
+			if bytes.Equal(g.authKey, authKey) {
+				g.refs = append(g.refs, ref)
+				g.keys = append(g.keys, k)
+				continue Outer
+			}
+		}
+		groups = append(groups, &keyGroup{
+			authKey: authKey,
+			refs:    []keyRef{ref},
+			keys:    []*secboot_tpm2.SealedKeyObject{k}})
+	}
+
+	return groups, nil
+}
+
+func reseal() error {
+	if len(keys) == 0 {
+		return errors.New("no keys specified")
+	}
+
+	alg, err := pcrprofile.ParsePCRAlgorithm(pcrAlgorithm)
+	if err != nil {
+		return err
+	}
+	bootAssets.PCRAlgorithm = alg
+
+	profile, err := pcrprofile.Compute(preset, &bootAssets)
+	if err != nil {
+		return xerrors.Errorf("cannot compute PCR profile: %w", err)
+	}
+
+	groups, err := groupKeys(keys)
+	if err != nil {
+		return err
+	}
+
+	tpm, err := secboot_tpm2.ConnectToDefaultTPM()
+	if err != nil {
+		return xerrors.Errorf("cannot connect to TPM: %w", err)
+	}
+	defer tpm.Close()
+
+	for _, g := range groups {
+		update := secboot_tpm2.UpdateKeyPCRProtectionPolicyMultipleNoRevoke
+		if revoke {
+			update = secboot_tpm2.UpdateKeyPCRProtectionPolicyMultiple
+		}
+		if err := update(tpm, g.keys, g.authKey, profile); err != nil {
+			var paths []string
+			for _, ref := range g.refs {
+				paths = append(paths, ref.keyPath)
+			}
+			return xerrors.Errorf("cannot update PCR policy for %s: %w", strings.Join(paths, ", "), err)
+		}
+	}
+
+	if !scrub {
+		return nil
+	}
+	for _, ref := range keys {
+		if err := secboot_tpm2.ScrubAuthKeyFromKernel(keyringPrefix, ref.devicePath); err != nil {
+			return xerrors.Errorf("cannot remove PCR policy update key for %s from the kernel keyring: %w", ref.devicePath, err)
+		}
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	if err := reseal(); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot update PCR policies: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -22,26 +22,31 @@ package secboot
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
-	"path/filepath"
+	"sort"
 	"strconv"
-	"strings"
-	"time"
 
 	"golang.org/x/xerrors"
 
 	"github.com/snapcore/secboot/internal/keyring"
+	"github.com/snapcore/secboot/internal/logger"
 	"github.com/snapcore/secboot/internal/luks2"
+	"github.com/snapcore/secboot/internal/secmem"
 )
 
 var (
-	luks2Activate   = luks2.Activate
-	luks2Deactivate = luks2.Deactivate
+	luks2Activate        = luks2.Activate
+	luks2ActivatePlain   = luks2.ActivatePlain
+	luks2Deactivate      = luks2.Deactivate
+	luks2GetVolumeStatus = luks2.GetVolumeStatus
+	secmemNewFromBytes   = secmem.NewFromBytes
 )
 
 // RecoveryKey corresponds to a 16-byte recovery key in its binary form.
@@ -88,43 +93,27 @@ func ParseRecoveryKey(s string) (out RecoveryKey, err error) {
 	return
 }
 
-type execError struct {
-	path string
-	err  error
+// NewRecoveryKey creates a new recovery key from a cryptographically secure source of
+// randomness.
+func NewRecoveryKey() (RecoveryKey, error) {
+	return NewRecoveryKeyFromReader(rand.Reader)
 }
 
-func (e *execError) Error() string {
-	return fmt.Sprintf("%s failed: %s", e.path, e.err)
-}
-
-func (e *execError) Unwrap() error {
-	return e.err
-}
-
-func wrapExecError(cmd *exec.Cmd, err error) error {
-	if err == nil {
-		return nil
+// NewRecoveryKeyFromReader creates a new recovery key using the supplied source of
+// randomness. This is intended for tests that need reproducible output - production
+// code should use NewRecoveryKey.
+func NewRecoveryKeyFromReader(rand io.Reader) (out RecoveryKey, err error) {
+	if _, err := io.ReadFull(rand, out[:]); err != nil {
+		return RecoveryKey{}, xerrors.Errorf("cannot obtain random bytes: %w", err)
 	}
-	return &execError{path: cmd.Path, err: err}
+	return out, nil
 }
 
-func askPassword(sourceDevicePath, msg string) (string, error) {
-	cmd := exec.Command(
-		"systemd-ask-password",
-		"--icon", "drive-harddisk",
-		"--id", filepath.Base(os.Args[0])+":"+sourceDevicePath,
-		msg)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stdin = os.Stdin
-	if err := cmd.Run(); err != nil {
-		return "", wrapExecError(cmd, err)
-	}
-	result, err := out.ReadString('\n')
-	if err != nil {
-		return "", xerrors.Errorf("cannot read result from systemd-ask-password: %w", err)
-	}
-	return strings.TrimRight(result, "\n"), nil
+// Equal indicates whether this recovery key is the same as other. The comparison is
+// performed in constant time, so that it doesn't leak information about the contents
+// of either key.
+func (k RecoveryKey) Equal(other RecoveryKey) bool {
+	return subtle.ConstantTimeCompare(k[:], other[:]) == 1
 }
 
 func getPassword(sourceDevicePath, description string, reader io.Reader) (string, error) {
@@ -185,15 +174,50 @@ type keyDataAndError struct {
 	err error
 }
 
+// activationCache holds credentials supplied by the user during a call to
+// ActivateVolumes, so that they can be reused for subsequent volumes without
+// prompting again. The recovery key is held outside of the Go heap so that it
+// can be wiped when it is replaced or when ActivateVolumes returns.
+type activationCache struct {
+	passphrase  string
+	recoveryKey *secmem.Buffer
+}
+
+// setRecoveryKey takes ownership of the supplied buffer, wiping any
+// previously cached recovery key.
+func (c *activationCache) setRecoveryKey(key *secmem.Buffer) {
+	if c.recoveryKey != nil {
+		c.recoveryKey.Destroy()
+	}
+	c.recoveryKey = key
+}
+
+// wipe clears the cached credentials. Go strings can't be zeroed, so the
+// passphrase is only dropped.
+func (c *activationCache) wipe() {
+	c.passphrase = ""
+	c.setRecoveryKey(nil)
+}
+
 type activateWithKeyDataState struct {
-	volumeName       string
-	sourceDevicePath string
-	keyringPrefix    string
+	ctx                 context.Context
+	volumeName          string
+	sourceDevicePath    string
+	keyringPrefix       string
+	passphraseTries     int
+	requireLockedMemory bool
+	errorHandler        func(string, error)
+	cache               *activationCache
 
 	keys []*keyDataAndError
 
 	keyData *KeyData
 	auxKey  AuxiliaryKey
+
+	// lockErr is set if a recovered key couldn't be held in locked
+	// memory when this is required, in which case activation must not
+	// continue.
+	lockErr error
 }
 
 func (s *activateWithKeyDataState) errors() (out []*activateWithKeyDataError) {
@@ -210,7 +234,19 @@ func (s *activateWithKeyDataState) snapModelChecker() *snapModelCheckerImpl {
 	return &snapModelCheckerImpl{s.volumeName, s.keyData, s.auxKey}
 }
 
-func (s *activateWithKeyDataState) tryActivateWithRecoveredKey(keyData *KeyData, key DiskUnlockKey, auxKey AuxiliaryKey) error {
+func (s *activateWithKeyDataState) tryActivateWithRecoveredKey(keyData *KeyData, recoveredKey DiskUnlockKey, auxKey AuxiliaryKey) error {
+	// Move the recovered key out of the Go heap for the rest of its lifetime.
+	buf, err := secmemNewFromBytes(recoveredKey, s.requireLockedMemory)
+	if err != nil {
+		err = xerrors.Errorf("cannot protect recovered key: %w", err)
+		if isLockUnavailableError(err) {
+			s.lockErr = err
+		}
+		return err
+	}
+	defer buf.Destroy()
+	key := buf.Bytes()
+
 	if err := luks2Activate(s.volumeName, s.sourceDevicePath, key); err != nil {
 		return xerrors.Errorf("cannot activate volume: %w", err)
 	}
@@ -218,6 +254,8 @@ func (s *activateWithKeyDataState) tryActivateWithRecoveredKey(keyData *KeyData,
 	s.keyData = keyData
 	s.auxKey = auxKey
 
+	keyring.AddActivationProtectorToUserKeyring(keyData.ReadableName(), s.volumeName, s.keyringPrefix)
+
 	if err := keyring.AddKeyToUserKeyring(key, s.sourceDevicePath, keyringPurposeDiskUnlock, s.keyringPrefix); err != nil {
 		fmt.Fprintf(os.Stderr, "secboot: Cannot add key to user keyring: %v\n", err)
 	}
@@ -229,7 +267,27 @@ func (s *activateWithKeyDataState) tryActivateWithRecoveredKey(keyData *KeyData,
 	return nil
 }
 
-func (s *activateWithKeyDataState) tryKeyDataAuthModeNone(k *KeyData) error {
+func (s *activateWithKeyDataState) recordAttempt(k *KeyData, authMode AuthMode, err error) {
+	logger.Debug("activate-with-key-data",
+		logger.F("volume", s.volumeName),
+		logger.F("device", s.sourceDevicePath),
+		logger.F("key", k.ReadableName()),
+		logger.F("platform", k.data.PlatformName),
+		logger.F("auth-mode", authMode),
+		logger.Err(err))
+
+	if err != nil && s.errorHandler != nil {
+		s.errorHandler(k.ReadableName(), err)
+	}
+}
+
+func (s *activateWithKeyDataState) tryKeyDataAuthModeNone(k *KeyData) (err error) {
+	defer func() { s.recordAttempt(k, AuthModeNone, err) }()
+
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+
 	key, auxKey, err := k.RecoverKeys()
 	if err != nil {
 		return xerrors.Errorf("cannot recover key: %w", err)
@@ -238,39 +296,196 @@ func (s *activateWithKeyDataState) tryKeyDataAuthModeNone(k *KeyData) error {
 	return s.tryActivateWithRecoveredKey(k, key, auxKey)
 }
 
+func (s *activateWithKeyDataState) tryKeyDataWithPassphrase(k *KeyData, passphrase string) (err error) {
+	defer func() { s.recordAttempt(k, AuthModePassphrase, err) }()
+
+	key, auxKey, err := k.RecoverKeysWithPassphraseContext(s.ctx, passphrase)
+	if err != nil {
+		return xerrors.Errorf("cannot recover key with passphrase: %w", err)
+	}
+
+	return s.tryActivateWithRecoveredKey(k, key, auxKey)
+}
+
+// isPlatformUnavailableError indicates whether the supplied error means that
+// no keys protected by the same platform can be recovered.
+func isPlatformUnavailableError(err error) bool {
+	var e *PlatformDeviceUnavailableError
+	return xerrors.Is(err, ErrNoPlatformHandlerRegistered) || xerrors.As(err, &e)
+}
+
+// isLockUnavailableError indicates whether the supplied error means that a key
+// couldn't be held in locked memory when this is required.
+func isLockUnavailableError(err error) bool {
+	var e *secmem.LockUnavailableError
+	return xerrors.As(err, &e)
+}
+
 func (s *activateWithKeyDataState) run() (success bool) {
+	// Keep track of platforms that are unavailable, so that we don't try
+	// other keys protected by them.
+	unavailable := make(map[string]error)
+
 	// Try keys that don't require any additional authentication first
 	for _, k := range s.keys {
 		if k.AuthMode() != AuthModeNone {
 			continue
 		}
 
+		if err, skip := unavailable[k.data.PlatformName]; skip {
+			k.err = err
+			continue
+		}
+
 		if err := s.tryKeyDataAuthModeNone(k.KeyData); err != nil {
 			k.err = err
+			if s.lockErr != nil {
+				return false
+			}
+			if isPlatformUnavailableError(err) {
+				unavailable[k.data.PlatformName] = err
+			}
 			continue
 		}
 
 		return true
 	}
 
-	// TODO: Passphrase support
+	// Then try keys that are protected by a passphrase.
+	var passphraseKeys []*keyDataAndError
+	for _, k := range s.keys {
+		if k.AuthMode()&AuthModePassphrase == 0 {
+			continue
+		}
+		if err, skip := unavailable[k.data.PlatformName]; skip {
+			k.err = err
+			continue
+		}
+		passphraseKeys = append(passphraseKeys, k)
+	}
+	if len(passphraseKeys) == 0 {
+		return false
+	}
+
+	tryPassphrase := func(passphrase string) bool {
+		for _, k := range passphraseKeys {
+			if err, skip := unavailable[k.data.PlatformName]; skip {
+				k.err = err
+				continue
+			}
+
+			if err := s.tryKeyDataWithPassphrase(k.KeyData, passphrase); err != nil {
+				k.err = err
+				if s.lockErr != nil {
+					return false
+				}
+				if isPlatformUnavailableError(err) {
+					unavailable[k.data.PlatformName] = err
+				}
+				continue
+			}
+
+			return true
+		}
+		return false
+	}
+
+	if s.cache != nil {
+		// Try a passphrase that unlocked a previous volume first. This
+		// doesn't count as one of the permitted tries.
+		if s.cache.passphrase != "" && tryPassphrase(s.cache.passphrase) {
+			return true
+		}
+		if s.lockErr != nil {
+			return false
+		}
+		if s.cache.recoveryKey != nil {
+			// The user has already had to fall back to the recovery key
+			// for a previous volume, so don't prompt for a passphrase again.
+			for _, k := range passphraseKeys {
+				if k.err == nil {
+					k.err = errors.New("not tried because the recovery key was used for another volume")
+				}
+			}
+			return false
+		}
+	}
+
+	if s.passphraseTries == 0 {
+		for _, k := range passphraseKeys {
+			k.err = errors.New("no passphrase tries permitted")
+		}
+		return false
+	}
+
+	for tries := s.passphraseTries; tries > 0; tries-- {
+		if err := s.ctx.Err(); err != nil {
+			for _, k := range passphraseKeys {
+				k.err = err
+			}
+			return false
+		}
+
+		passphrase, err := getPassword(s.sourceDevicePath, "passphrase", nil)
+		if err != nil {
+			for _, k := range passphraseKeys {
+				k.err = xerrors.Errorf("cannot obtain passphrase: %w", err)
+			}
+			return false
+		}
+
+		if tryPassphrase(passphrase) {
+			if s.cache != nil {
+				s.cache.passphrase = passphrase
+			}
+			return true
+		}
+		if s.lockErr != nil {
+			return false
+		}
+	}
 
 	// We've failed at this point
 	return false
 }
 
-func newActivateWithKeyDataState(volumeName, sourceDevicePath string, keyringPrefix string, keys []*KeyData) *activateWithKeyDataState {
+func newActivateWithKeyDataState(ctx context.Context, volumeName, sourceDevicePath string, keyringPrefix string, passphraseTries int, keys []*KeyData, cache *activationCache) *activateWithKeyDataState {
 	s := &activateWithKeyDataState{
+		ctx:              ctx,
 		volumeName:       volumeName,
 		sourceDevicePath: sourceDevicePath,
-		keyringPrefix:    keyringPrefixOrDefault(keyringPrefix)}
+		keyringPrefix:    keyringPrefixOrDefault(keyringPrefix),
+		passphraseTries:  passphraseTries,
+		cache:            cache}
 	for _, k := range keys {
 		s.keys = append(s.keys, &keyDataAndError{KeyData: k})
 	}
+	sort.SliceStable(s.keys, func(i, j int) bool {
+		return s.keys[i].Priority() > s.keys[j].Priority()
+	})
 	return s
 }
 
-func activateWithRecoveryKey(volumeName, sourceDevicePath string, keyReader io.Reader, tries int, keyringPrefix string) error {
+func activateWithRecoveryKey(volumeName, sourceDevicePath string, keyReader io.Reader, tries int, keyringPrefix string, requireLockedMemory bool, cache *activationCache) error {
+	if cache != nil && cache.recoveryKey != nil {
+		// Try the recovery key that unlocked a previous volume first.
+		key := cache.recoveryKey.Bytes()
+
+		err := luks2Activate(volumeName, sourceDevicePath, key)
+		logger.Debug("activate-with-recovery-key",
+			logger.F("volume", volumeName),
+			logger.F("device", sourceDevicePath),
+			logger.F("cached", true),
+			logger.Err(err))
+		if err == nil {
+			if err := keyring.AddKeyToUserKeyring(key, sourceDevicePath, keyringPurposeDiskUnlock, keyringPrefixOrDefault(keyringPrefix)); err != nil {
+				fmt.Fprintf(os.Stderr, "secboot: Cannot add key to user keyring: %v\n", err)
+			}
+			keyring.AddActivationProtectorToUserKeyring(RecoveryKeyProtectorName, volumeName, keyringPrefixOrDefault(keyringPrefix))
+			return nil
+		}
+	}
+
 	if tries == 0 {
 		return errors.New("no recovery key tries permitted")
 	}
@@ -288,21 +503,42 @@ func activateWithRecoveryKey(volumeName, sourceDevicePath string, keyReader io.R
 			return xerrors.Errorf("cannot obtain recovery key: %w", err)
 		}
 
-		key, err := ParseRecoveryKey(passphrase)
+		parsed, err := ParseRecoveryKey(passphrase)
 		if err != nil {
 			lastErr = xerrors.Errorf("cannot decode recovery key: %w", err)
 			continue
 		}
 
-		if err := luks2Activate(volumeName, sourceDevicePath, key[:]); err != nil {
+		// Move the recovery key out of the Go heap for the rest of its lifetime.
+		buf, err := secmemNewFromBytes(parsed[:], requireLockedMemory)
+		if err != nil {
+			return xerrors.Errorf("cannot protect recovery key: %w", err)
+		}
+		key := buf.Bytes()
+
+		err = luks2Activate(volumeName, sourceDevicePath, key)
+		logger.Debug("activate-with-recovery-key",
+			logger.F("volume", volumeName),
+			logger.F("device", sourceDevicePath),
+			logger.F("cached", false),
+			logger.Err(err))
+		if err != nil {
+			buf.Destroy()
 			lastErr = xerrors.Errorf("cannot activate volume: %w", err)
 			continue
 		}
 
-		if err := keyring.AddKeyToUserKeyring(key[:], sourceDevicePath, keyringPurposeDiskUnlock, keyringPrefixOrDefault(keyringPrefix)); err != nil {
+		if err := keyring.AddKeyToUserKeyring(key, sourceDevicePath, keyringPurposeDiskUnlock, keyringPrefixOrDefault(keyringPrefix)); err != nil {
 			fmt.Fprintf(os.Stderr, "secboot: Cannot add key to user keyring: %v\n", err)
 		}
 
+		keyring.AddActivationProtectorToUserKeyring(RecoveryKeyProtectorName, volumeName, keyringPrefixOrDefault(keyringPrefix))
+
+		if cache != nil {
+			cache.setRecoveryKey(buf)
+		} else {
+			buf.Destroy()
+		}
 		break
 	}
 
@@ -338,8 +574,62 @@ type ActivateVolumeOptions struct {
 	// KeyringPrefix is the prefix used for the description of any
 	// kernel keys created during activation.
 	KeyringPrefix string
+
+	// DisableRecoveryKeyFallback specifies that activation should
+	// fail rather than falling back to requesting the recovery key
+	// when activation with a TPM sealed key or KeyData fails.
+	DisableRecoveryKeyFallback bool
+
+	// LockoutBehavior specifies what should happen when unsealing
+	// a TPM sealed key fails because the TPM is in dictionary
+	// attack lockout mode. This is only supported by the
+	// activation functions in the tpm2 package - other functions
+	// return an error if it is set to anything other than the
+	// default.
+	LockoutBehavior LockoutBehavior
+
+	// UnsealErrorHandler is called with the path of a TPM sealed
+	// key object and the error returned from it each time that
+	// activating with it fails, before any further attempts are
+	// made. This allows a boot UI to present a meaningful message
+	// for each failure rather than a generic one. When activating
+	// with KeyData objects, it is called with the readable name
+	// of the KeyData in place of a path.
+	UnsealErrorHandler func(keyPath string, err error)
+
+	// AuthKeyKeyringOptions customizes how the key used for
+	// authorizing PCR policy updates is stored in the kernel
+	// keyring after unsealing a TPM sealed key object. If nil,
+	// the key is stored with the default permissions and no
+	// timeout.
+	AuthKeyKeyringOptions *KeyringKeyOptions
+
+	// RequireLockedMemory specifies that activation should fail if
+	// a key recovered from a platform's secure device, unsealed from
+	// the TPM, derived from a passphrase or supplied as a recovery
+	// key cannot be held in memory that is locked with mlock, rather
+	// than continuing with memory that might be written to swap. If
+	// this happens, no other keys are tried and activation does not
+	// fall back to the recovery key.
+	RequireLockedMemory bool
 }
 
+// LockoutBehavior specifies how activation with a TPM sealed key
+// proceeds if the TPM is in dictionary attack lockout mode.
+type LockoutBehavior int
+
+const (
+	// LockoutFallbackToRecoveryKey indicates that activation should
+	// stop trying TPM sealed keys and fall back to requesting the
+	// recovery key, unless this is disabled with
+	// DisableRecoveryKeyFallback. This is the default.
+	LockoutFallbackToRecoveryKey LockoutBehavior = iota
+
+	// LockoutFail indicates that activation should fail without
+	// requesting the recovery key.
+	LockoutFail
+)
+
 type activateVolumeWithKeyDataError struct {
 	keyDataErrs         []error
 	recoveryKeyUsageErr error
@@ -355,55 +645,111 @@ func (e *activateVolumeWithKeyDataError) Error() string {
 	return s.String()
 }
 
+func (e *activateVolumeWithKeyDataError) Unwrap() error {
+	return e.recoveryKeyUsageErr
+}
+
 // ErrRecoveryKeyUsed is returned from ActivateVolumeWithKeyData and
 // ActivateVolumeWithMultipleKeyData if the volume could not be activated with
 // any platform protected keys but activation with the recovery key was
 // successful.
 var ErrRecoveryKeyUsed = errors.New("cannot activate with platform protected keys but activation with the recovery key was successful")
 
+var errRecoveryKeyFallbackDisabled = errors.New("fallback to the recovery key is disabled")
+
+var errRecoveryKeyFallbackLockUnavailable = errors.New("not falling back to the recovery key because keys cannot be held in locked memory")
+
+// checkKeyDataActivateVolumeOptions checks that the supplied options are
+// valid for activating a volume with KeyData objects.
+func checkKeyDataActivateVolumeOptions(options *ActivateVolumeOptions) error {
+	switch {
+	case options.PassphraseTries < 0:
+		return errors.New("invalid PassphraseTries")
+	case options.RecoveryKeyTries < 0:
+		return errors.New("invalid RecoveryKeyTries")
+	case options.LockoutBehavior != LockoutFallbackToRecoveryKey:
+		return errors.New("LockoutBehavior is not supported when activating with KeyData")
+	}
+	return nil
+}
+
 // ActivateVolumeWithKeyData attempts to activate the LUKS encrypted container at sourceDevicePath and create a
 // mapping with the name volumeName, using the supplied KeyData objects to recover the disk unlock key from the
 // platform's secure device. This makes use of systemd-cryptsetup.
 //
+// The supplied KeyData objects are tried in order of descending priority (see KeyData.Priority), and keys with the
+// same priority are tried in the order in which they are supplied. If a platform's secure device is unavailable, any
+// remaining keys protected by the same platform are skipped. Keys that are protected by a passphrase are tried after
+// all other keys. The passphrase will be requested using systemd-ask-password, and the PassphraseTries field of
+// options specifies how many attempts should be made to obtain a passphrase that unlocks one of these keys.
+//
 // If activation with the supplied KeyData objects fails, this function will attempt to activate it with the fallback
 // recovery key instead. The fallback recovery key will be requested using systemd-ask-password. The RecoveryKeyTries
 // field of options specifies how many attempts should be made to activate the volume with the recovery key before
 // failing. If this is set to 0, then no attempts will be made to activate the encrypted volume with the fallback
-// recovery key.
+// recovery key. The fallback recovery key is not requested if the DisableRecoveryKeyFallback field of options is set.
 //
-// If either the PassphraseTries or RecoveryKeyTries fields of options are less than zero, an error will be returned.
+// If the UnsealErrorHandler field of options is set, it will be called with the readable name of each KeyData
+// object and the error each time that activation with it fails.
+//
+// If either the PassphraseTries or RecoveryKeyTries fields of options are less than zero, or the LockoutBehavior
+// field is not the default, an error will be returned.
 //
 // If activation with one of the supplied KeyData objects succeeds, a SnapModelChecker will be returned so that the
 // caller can check whether a particular Snap device model has previously been authorized to access the data on this
 // volume. If the fallback recovery key is used for successfully for activation, no SnapModelChecker will be
-// returned and a ErrRecoveryKeyUsed error will be returned.
+// returned and a ErrRecoveryKeyUsed error will be returned. In this case, the errors encountered with the supplied
+// KeyData objects can be retrieved later on with GetActivationError.
 //
 // If activation fails, an error will be returned.
 func ActivateVolumeWithMultipleKeyData(volumeName, sourceDevicePath string, keys []*KeyData, options *ActivateVolumeOptions) (SnapModelChecker, error) {
+	return ActivateVolumeWithMultipleKeyDataContext(context.Background(), volumeName, sourceDevicePath, keys, options)
+}
+
+// ActivateVolumeWithMultipleKeyDataContext is the same as ActivateVolumeWithMultipleKeyData, but activation is
+// aborted if the supplied context is cancelled or its deadline expires. This is checked before each KeyData is tried
+// and before each passphrase is requested, and this function doesn't wait for the derivation of a key from a passphrase
+// to complete. The derivation itself is only stopped if the Argon2 KDF implementation supports it, see
+// Argon2KDFWithContext. An operation that is already in progress with the platform's secure device runs to completion.
+// If activation is aborted, the fallback recovery key isn't requested and the returned error wraps the context's error.
+func ActivateVolumeWithMultipleKeyDataContext(ctx context.Context, volumeName, sourceDevicePath string, keys []*KeyData, options *ActivateVolumeOptions) (SnapModelChecker, error) {
 	if len(keys) == 0 {
 		return nil, errors.New("no keys provided")
 	}
-	if options.PassphraseTries < 0 {
-		return nil, errors.New("invalid PassphraseTries")
-	}
-	if options.RecoveryKeyTries < 0 {
-		return nil, errors.New("invalid RecoveryKeyTries")
+	if err := checkKeyDataActivateVolumeOptions(options); err != nil {
+		return nil, err
 	}
 
-	s := newActivateWithKeyDataState(volumeName, sourceDevicePath, options.KeyringPrefix, keys)
+	return activateVolumeWithMultipleKeyData(ctx, volumeName, sourceDevicePath, keys, options, nil)
+}
+
+func activateVolumeWithMultipleKeyData(ctx context.Context, volumeName, sourceDevicePath string, keys []*KeyData, options *ActivateVolumeOptions, cache *activationCache) (SnapModelChecker, error) {
+	s := newActivateWithKeyDataState(ctx, volumeName, sourceDevicePath, options.KeyringPrefix, options.PassphraseTries, keys, cache)
+	s.requireLockedMemory = options.RequireLockedMemory
+	s.errorHandler = options.UnsealErrorHandler
 	switch s.run() {
 	case true: // success!
 		return s.snapModelChecker(), nil
 	default: // failed - try recovery key
-		if rErr := activateWithRecoveryKey(volumeName, sourceDevicePath, nil, options.RecoveryKeyTries, options.KeyringPrefix); rErr != nil {
+		var kdErrs []error
+		for _, e := range s.errors() {
+			kdErrs = append(kdErrs, e)
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, &activateVolumeWithKeyDataError{kdErrs, err}
+		}
+		if options.DisableRecoveryKeyFallback {
+			return nil, &activateVolumeWithKeyDataError{kdErrs, errRecoveryKeyFallbackDisabled}
+		}
+		if s.lockErr != nil {
+			return nil, &activateVolumeWithKeyDataError{kdErrs, errRecoveryKeyFallbackLockUnavailable}
+		}
+		if rErr := activateWithRecoveryKey(volumeName, sourceDevicePath, nil, options.RecoveryKeyTries, options.KeyringPrefix, options.RequireLockedMemory, cache); rErr != nil {
 			// failed with recovery key - return errors
-			var kdErrs []error
-			for _, e := range s.errors() {
-				kdErrs = append(kdErrs, e)
-			}
 			return nil, &activateVolumeWithKeyDataError{kdErrs, rErr}
 		}
 		// succeeded with recovery key
+		keyring.AddActivationErrorToUserKeyring(kdErrs, volumeName, keyringPrefixOrDefault(options.KeyringPrefix))
 		return nil, ErrRecoveryKeyUsed
 	}
 }
@@ -429,6 +775,107 @@ func ActivateVolumeWithKeyData(volumeName, sourceDevicePath string, key *KeyData
 	return ActivateVolumeWithMultipleKeyData(volumeName, sourceDevicePath, []*KeyData{key}, options)
 }
 
+// ActivateVolumeWithKeyDataContext is the same as ActivateVolumeWithKeyData, but activation is aborted if the
+// supplied context is cancelled or its deadline expires. See ActivateVolumeWithMultipleKeyDataContext.
+func ActivateVolumeWithKeyDataContext(ctx context.Context, volumeName, sourceDevicePath string, key *KeyData, options *ActivateVolumeOptions) (SnapModelChecker, error) {
+	return ActivateVolumeWithMultipleKeyDataContext(ctx, volumeName, sourceDevicePath, []*KeyData{key}, options)
+}
+
+// VolumeActivationRequest describes a single volume to be activated by
+// ActivateVolumes.
+type VolumeActivationRequest struct {
+	// VolumeName is the name of the device mapper volume to create.
+	VolumeName string
+
+	// SourceDevicePath is the path of the LUKS encrypted container.
+	SourceDevicePath string
+
+	// Keys are the KeyData objects to try, as described for
+	// ActivateVolumeWithMultipleKeyData.
+	Keys []*KeyData
+}
+
+// ActivateVolumesOptions provides options to ActivateVolumes.
+type ActivateVolumesOptions struct {
+	ActivateVolumeOptions
+
+	// RollbackOnFailure specifies that volumes that were already
+	// activated should be deactivated again if activation of a
+	// subsequent volume fails.
+	RollbackOnFailure bool
+}
+
+// ActivateVolumes attempts to activate each of the supplied volumes in order, in the same way as
+// ActivateVolumeWithMultipleKeyData. A passphrase or recovery key that is successfully used for one volume is cached
+// for the duration of this call and tried first for subsequent volumes, so that the user is only prompted once when
+// the volumes share the same credentials. The PassphraseTries and RecoveryKeyTries fields of options apply to each
+// volume individually. Once the recovery key has been used for one volume, no passphrase is requested for
+// subsequent volumes. Disk unlock keys are added to the kernel keyring for each volume as they would be when
+// activating them individually, but the passphrase itself is never added to the kernel keyring. The cached
+// credentials are only held in memory for the duration of this call - the recovery key is wiped when this function
+// returns. The kernel keyring is not used as an additional cache, because the disk unlock key of a volume that was
+// activated with the recovery key is already the recovery key itself.
+//
+// On success, a slice containing a SnapModelChecker for each volume is returned in the order in which the volumes
+// were supplied. If the recovery key was used for a volume, its entry will be nil and a ErrRecoveryKeyUsed error
+// will be returned once all volumes have been activated.
+//
+// If activation of a volume fails, no further volumes are tried and an error is returned. If the RollbackOnFailure
+// field of options is set, volumes that were already activated are deactivated again and no SnapModelCheckers are
+// returned. Otherwise, the returned slice contains an entry for each volume that remains activated.
+func ActivateVolumes(requests []*VolumeActivationRequest, options *ActivateVolumesOptions) ([]SnapModelChecker, error) {
+	if len(requests) == 0 {
+		return nil, errors.New("no volumes provided")
+	}
+	for _, r := range requests {
+		if len(r.Keys) == 0 {
+			return nil, fmt.Errorf("no keys provided for volume %s", r.VolumeName)
+		}
+	}
+	if err := checkKeyDataActivateVolumeOptions(&options.ActivateVolumeOptions); err != nil {
+		return nil, err
+	}
+
+	var cache activationCache
+	defer cache.wipe()
+
+	var checkers []SnapModelChecker
+	recoveryKeyUsed := false
+
+	for i, r := range requests {
+		checker, err := activateVolumeWithMultipleKeyData(context.Background(), r.VolumeName, r.SourceDevicePath, r.Keys, &options.ActivateVolumeOptions, &cache)
+		switch {
+		case err == ErrRecoveryKeyUsed:
+			recoveryKeyUsed = true
+		case err != nil:
+			if options.RollbackOnFailure {
+				for j := i - 1; j >= 0; j-- {
+					deactivateForRollback(requests[j], options.KeyringPrefix)
+				}
+				checkers = nil
+			}
+			return checkers, xerrors.Errorf("cannot activate volume %s: %w", r.VolumeName, err)
+		}
+		checkers = append(checkers, checker)
+	}
+
+	if recoveryKeyUsed {
+		return checkers, ErrRecoveryKeyUsed
+	}
+	return checkers, nil
+}
+
+func deactivateForRollback(r *VolumeActivationRequest, keyringPrefix string) {
+	if err := luks2Deactivate(r.VolumeName); err != nil {
+		fmt.Fprintf(os.Stderr, "secboot: Cannot deactivate volume %s: %v\n", r.VolumeName, err)
+	}
+
+	// Remove any keys added to the keyring during activation. Not all of these will exist.
+	keyring.RemoveKeyFromUserKeyring(r.SourceDevicePath, keyringPurposeDiskUnlock, keyringPrefixOrDefault(keyringPrefix))
+	keyring.RemoveKeyFromUserKeyring(r.SourceDevicePath, keyringPurposeAuxiliary, keyringPrefixOrDefault(keyringPrefix))
+	keyring.RemoveActivationStateFromUserKeyring(r.VolumeName, keyringPrefixOrDefault(keyringPrefix))
+}
+
 // ActivateVolumeWithRecoveryKey attempts to activate the LUKS encrypted volume at sourceDevicePath and create a mapping with the
 // name volumeName, using the fallback recovery key. This makes use of systemd-cryptsetup.
 //
@@ -442,20 +889,140 @@ func ActivateVolumeWithRecoveryKey(volumeName, sourceDevicePath string, keyReade
 		return errors.New("invalid RecoveryKeyTries")
 	}
 
-	return activateWithRecoveryKey(volumeName, sourceDevicePath, keyReader, options.RecoveryKeyTries, options.KeyringPrefix)
+	return activateWithRecoveryKey(volumeName, sourceDevicePath, keyReader, options.RecoveryKeyTries, options.KeyringPrefix, options.RequireLockedMemory, nil)
 }
 
 // ActivateVolumeWithKey attempts to activate the LUKS encrypted volume at
 // sourceDevicePath and create a mapping with the name volumeName, using the
 // provided key. This makes use of systemd-cryptsetup.
+//
+// If the RequireLockedMemory field of options is set, an error will be
+// returned if a copy of the key cannot be held in locked memory. The supplied
+// key is not modified.
 func ActivateVolumeWithKey(volumeName, sourceDevicePath string, key []byte, options *ActivateVolumeOptions) error {
-	return luks2Activate(volumeName, sourceDevicePath, key)
+	buf, err := secmem.New(len(key), options.RequireLockedMemory)
+	if err != nil {
+		return xerrors.Errorf("cannot protect key: %w", err)
+	}
+	defer buf.Destroy()
+	copy(buf.Bytes(), key)
+
+	return luks2Activate(volumeName, sourceDevicePath, buf.Bytes())
+}
+
+// PlainVolumeOptions provides the parameters for a plain dm-crypt volume. As plain
+// volumes have no header, these must match the values used when the volume was
+// first written.
+type PlainVolumeOptions struct {
+	// Cipher is the dm-crypt cipher specification. If empty, aes-xts-plain64
+	// is used.
+	Cipher string
+
+	// Offset is the offset of the encrypted data from the start of the source
+	// device, in 512-byte sectors.
+	Offset uint64
+
+	// SectorSize is the encryption sector size in bytes. If zero, 512 is used.
+	SectorSize int
+}
+
+// ActivatePlainVolumeWithKey creates a plain dm-crypt mapping with the name volumeName
+// for the device at sourceDevicePath, using the provided key as the volume key. The key
+// size is determined by the length of the key.
+//
+// Plain volumes have no header, so there is no way to verify the key. Supplying an
+// incorrect key or options will result in a volume that appears to contain random data.
+func ActivatePlainVolumeWithKey(volumeName, sourceDevicePath string, key []byte, options *PlainVolumeOptions) error {
+	if len(key) == 0 {
+		return errors.New("no key supplied")
+	}
+
+	var opts luks2.PlainOptions
+	if options != nil {
+		opts.Cipher = options.Cipher
+		opts.Offset = options.Offset
+		opts.SectorSize = options.SectorSize
+	}
+	return luks2ActivatePlain(volumeName, sourceDevicePath, key, &opts)
 }
 
 // DeactivateVolume attempts to deactivate the LUKS encrypted volumeName.
-// This makes use of systemd-cryptsetup.
+// This makes use of systemd-cryptsetup. The state recorded in the kernel
+// keyring during activation with the default keyring prefix is removed. Use
+// DeactivateVolumeWithKeyringPrefix for volumes that were activated with a
+// different prefix.
 func DeactivateVolume(volumeName string) error {
-	return luks2Deactivate(volumeName)
+	return DeactivateVolumeWithKeyringPrefix("", volumeName)
+}
+
+// DeactivateVolumeWithKeyringPrefix is the same as DeactivateVolume, except
+// that the value of prefix must match the prefix that was supplied via
+// ActivateVolumeOptions during unlocking in order for the state recorded in
+// the kernel keyring to be removed, so that GetActivationState and
+// GetActivationError don't report stale information if another volume with
+// the same name is activated later on.
+func DeactivateVolumeWithKeyringPrefix(prefix, volumeName string) error {
+	if err := luks2Deactivate(volumeName); err != nil {
+		return err
+	}
+	keyring.RemoveActivationStateFromUserKeyring(volumeName, keyringPrefixOrDefault(prefix))
+	return nil
+}
+
+// RecoveryKeyProtectorName is the value of ActivationState.Protector for
+// volumes that were activated with the recovery key.
+const RecoveryKeyProtectorName = "recovery-key"
+
+// ActivationState describes whether a volume is active and how it was
+// activated.
+type ActivationState struct {
+	// Active indicates whether the volume is active. The other fields
+	// are not set if it isn't.
+	Active bool
+
+	// DevicePath is the path of the device node of the active volume.
+	DevicePath string
+
+	// SourceDevicePath is the path of the underlying encrypted device.
+	SourceDevicePath string
+
+	// Protector identifies what was used to activate the volume. For
+	// volumes activated with a KeyData, this is the name returned from
+	// KeyData.ReadableName. For volumes activated with a TPM sealed key
+	// object, this is the path of the sealed key object. For volumes
+	// activated with the recovery key, this is RecoveryKeyProtectorName.
+	// It is empty if the volume wasn't activated by this package during
+	// the current boot, or if the name wasn't known.
+	Protector string
+}
+
+// GetActivationState returns the state of the volume with the specified name, so
+// that callers can inspect volumes without having to use dmsetup or cryptsetup
+// directly. The state is obtained from device-mapper via sysfs. The value of prefix
+// must match the prefix that was supplied via ActivateVolumeOptions during unlocking
+// in order for the Protector field of the returned state to be populated.
+func GetActivationState(prefix, volumeName string) (*ActivationState, error) {
+	status, err := luks2GetVolumeStatus(volumeName)
+	switch {
+	case err == luks2.ErrVolumeNotActive:
+		return &ActivationState{}, nil
+	case err != nil:
+		return nil, xerrors.Errorf("cannot obtain volume status: %w", err)
+	}
+
+	state := &ActivationState{
+		Active:     true,
+		DevicePath: status.DevicePath}
+	if len(status.SourceDevicePaths) == 1 {
+		state.SourceDevicePath = status.SourceDevicePaths[0]
+	}
+
+	protector, err := keyring.GetKeyFromUserKeyring(volumeName, keyring.PurposeActivationProtector, keyringPrefixOrDefault(prefix))
+	if err == nil {
+		state.Protector = string(protector)
+	}
+
+	return state, nil
 }
 
 // InitializeLUKS2ContainerOptions carries options for initializing LUKS2
@@ -471,6 +1038,71 @@ type InitializeLUKS2ContainerOptions struct {
 	// expressed in multiples of 1024 bytes. The value must be aligned to
 	// 4096 bytes, with the maximum size of 128MB.
 	KeyslotsAreaKiBSize int
+	// SectorSize sets the encryption sector size in bytes. The value must
+	// be one of 512, 1024, 2048 or 4096. If set to zero, the cryptsetup
+	// default is used.
+	SectorSize int
+	// InitialKeyslotName sets the name of the initial keyslot, so that it
+	// can be managed with functions such as RenameLUKS2ContainerKey and
+	// DeleteLUKS2ContainerKey. If empty, the initial keyslot is not named.
+	InitialKeyslotName string
+	// Integrity enables integrity protection of the encrypted data using
+	// dm-integrity. Note that this requires the entire device to be wiped
+	// when the container is initialized, which can take a long time.
+	Integrity LUKS2Integrity
+}
+
+// LUKS2Integrity describes the integrity protection for a LUKS2 container.
+type LUKS2Integrity int
+
+const (
+	// LUKS2IntegrityNone disables integrity protection. Data is encrypted
+	// with AES-256 in XTS mode.
+	LUKS2IntegrityNone LUKS2Integrity = iota
+
+	// LUKS2IntegrityHMACSHA256 encrypts data with AES-256 in XTS mode and
+	// protects it with a HMAC-SHA256 stored by dm-integrity.
+	LUKS2IntegrityHMACSHA256
+
+	// LUKS2IntegrityAESGCM uses AES-256 in GCM mode, which is an
+	// authenticated cipher, with random IVs.
+	LUKS2IntegrityAESGCM
+
+	// LUKS2IntegrityAEGIS128 uses the AEGIS-128 authenticated cipher with
+	// random IVs. This requires kernel support for AEGIS.
+	LUKS2IntegrityAEGIS128
+)
+
+// formatOptions returns the cipher, key size and integrity algorithm for this
+// integrity mode, in the form expected by luks2.FormatOptions.
+func (i LUKS2Integrity) formatOptions() (cipher string, keyBits int, integrity string, err error) {
+	switch i {
+	case LUKS2IntegrityNone:
+		return "", 0, "", nil
+	case LUKS2IntegrityHMACSHA256:
+		return "aes-xts-plain64", 512, "hmac-sha256", nil
+	case LUKS2IntegrityAESGCM:
+		return "aes-gcm-random", 256, "aead", nil
+	case LUKS2IntegrityAEGIS128:
+		return "aegis128-random", 128, "aead", nil
+	default:
+		return "", 0, "", errors.New("invalid integrity mode")
+	}
+}
+
+// highEntropyKeyKDFOptions returns the KDF options used for keyslots with keys
+// that have an entropy of at least 32 bytes. Benchmarking is disabled and the
+// KDF is configured with the minimum cost. Increased cost doesn't provide a
+// security benefit for these keys because they are already more secure than the
+// 16-byte recovery key, and it would only slow down unlocking.
+func highEntropyKeyKDFOptions() luks2.KDFOptions {
+	return luks2KDFOptions(luks2.KDFOptions{MemoryKiB: 32, ForceIterations: 4})
+}
+
+// recoveryKeyKDFOptions returns the KDF options used for keyslots with a recovery
+// key, which are benchmarked.
+func recoveryKeyKDFOptions() luks2.KDFOptions {
+	return luks2KDFOptions(luks2.KDFOptions{TargetDuration: recoveryKeyKDFDuration})
 }
 
 func validateInitializeLUKS2Options(options *InitializeLUKS2ContainerOptions) error {
@@ -503,6 +1135,14 @@ func validateInitializeLUKS2Options(options *InitializeLUKS2ContainerOptions) er
 				options.KeyslotsAreaKiBSize)
 		}
 	}
+	switch options.SectorSize {
+	case 0, 512, 1024, 2048, 4096:
+	default:
+		return fmt.Errorf("cannot set sector size to %v bytes", options.SectorSize)
+	}
+	if _, _, _, err := options.Integrity.formatOptions(); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -512,7 +1152,8 @@ func validateInitializeLUKS2Options(options *InitializeLUKS2ContainerOptions) er
 // The initial key used for unlocking the container is provided via the key argument, and must be a cryptographically secure
 // random number of at least 32-bytes. The key should be encrypted by using SealKeyToTPM.
 //
-// The container will be configured to encrypt data with AES-256 and XTS block cipher mode.
+// The container will be configured to encrypt data with AES-256 and XTS block cipher mode, unless
+// integrity protection is enabled with the Integrity field of options.
 //
 // On failure, this will return an error containing the output of the cryptsetup command.
 //
@@ -526,15 +1167,12 @@ func InitializeLUKS2Container(devicePath, label string, key []byte, options *Ini
 		return err
 	}
 
-	// Configure the KDF with reduced cost. This is done because the supplied input key has an
-	// entropy of at least 32 bytes, and increased cost doesn't provide a security benefit because
-	// this key and these settings are already more secure than the 16-byte recovery key. Increased
-	// cost here only slows down unlocking.
-	opts := luks2.FormatOptions{
-		KDFOptions: luks2.KDFOptions{TargetDuration: 100 * time.Millisecond}}
+	opts := luks2.FormatOptions{KDFOptions: highEntropyKeyKDFOptions()}
 	if options != nil {
 		opts.MetadataKiBSize = options.MetadataKiBSize
 		opts.KeyslotsAreaKiBSize = options.KeyslotsAreaKiBSize
+		opts.SectorSize = options.SectorSize
+		opts.Cipher, opts.KeyBits, opts.Integrity, _ = options.Integrity.formatOptions()
 	}
 
 	if err := luks2.Format(devicePath, label, key, &opts); err != nil {
@@ -545,6 +1183,12 @@ func InitializeLUKS2Container(devicePath, label string, key []byte, options *Ini
 		return xerrors.Errorf("cannot change keyslot priority: %w", err)
 	}
 
+	if options != nil && options.InitialKeyslotName != "" {
+		if err := luks2.ImportToken(devicePath, newLUKS2KeyslotNameToken(0, options.InitialKeyslotName)); err != nil {
+			return xerrors.Errorf("cannot import token: %w", err)
+		}
+	}
+
 	return nil
 }
 
@@ -557,7 +1201,7 @@ func InitializeLUKS2Container(devicePath, label string, key []byte, options *Ini
 // The recovery key is provided via the recoveryKey argument and must be a cryptographically secure 16-byte number.
 func AddRecoveryKeyToLUKS2Container(devicePath string, key []byte, recoveryKey RecoveryKey) error {
 	options := luks2.AddKeyOptions{
-		KDFOptions: luks2.KDFOptions{TargetDuration: 5 * time.Second},
+		KDFOptions: recoveryKeyKDFOptions(),
 		Slot:       luks2.AnySlot}
 	return luks2.AddKey(devicePath, key, recoveryKey[:], &options)
 }
@@ -581,12 +1225,8 @@ func ChangeLUKS2KeyUsingRecoveryKey(devicePath string, recoveryKey RecoveryKey,
 		return xerrors.Errorf("cannot kill existing slot: %w", err)
 	}
 
-	// Configure the KDF with reduced cost. This is done because the supplied input key has an
-	// entropy of at least 32 bytes, and increased cost doesn't provide a security benefit because
-	// this key and these settings are already more secure than the 16-byte recovery key. Increased
-	// cost here only slows down unlocking.
 	options := luks2.AddKeyOptions{
-		KDFOptions: luks2.KDFOptions{TargetDuration: 100 * time.Millisecond},
+		KDFOptions: highEntropyKeyKDFOptions(),
 		Slot:       0}
 	if err := luks2.AddKey(devicePath, recoveryKey[:], key, &options); err != nil {
 		return xerrors.Errorf("cannot add key: %w", err)
@@ -21,6 +21,7 @@ package secboot_test
 
 import (
 	"bytes"
+	"context"
 	"crypto"
 	"errors"
 	"fmt"
@@ -33,6 +34,8 @@ import (
 
 	snapd_testutil "github.com/snapcore/snapd/testutil"
 
+	"golang.org/x/xerrors"
+
 	. "gopkg.in/check.v1"
 
 	. "github.com/snapcore/secboot"
@@ -107,28 +110,8 @@ func (s *cryptSuite) SetUpTest(c *C) {
 			sourceDevicePath string
 		}{volumeName, sourceDevicePath})
 
-		f, err := os.Open(s.mockKeyslotsDir)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-
-		slots, err := f.Readdir(0)
-		if err != nil {
-			return err
-		}
-
-		for _, slot := range slots {
-			k, err := ioutil.ReadFile(filepath.Join(s.mockKeyslotsDir, slot.Name()))
-			if err != nil {
-				return err
-			}
-			if bytes.Equal(k, key) {
-				return nil
-			}
-		}
-
-		return errors.New("systemd-cryptsetup failed with: exit status 1")
+		_, err := s.findMockKeyslot(key)
+		return err
 	}))
 
 	s.mockLUKS2DeactivateCalls = 0
@@ -207,6 +190,20 @@ sed -i -e '1,1d' %[1]s
 	s.AddCleanup(s.mockSdAskPassword.Restore)
 }
 
+func (s *cryptSuite) findMockKeyslot(key []byte) (int, error) {
+	for i := 0; i < s.mockKeyslotsCount; i++ {
+		k, err := ioutil.ReadFile(filepath.Join(s.mockKeyslotsDir, fmt.Sprintf("%d", i)))
+		if err != nil {
+			return -1, err
+		}
+		if bytes.Equal(k, key) {
+			return i, nil
+		}
+	}
+
+	return -1, errors.New("systemd-cryptsetup failed with: exit status 1")
+}
+
 func (s *cryptSuite) addMockKeyslot(c *C, key []byte) {
 	c.Assert(ioutil.WriteFile(filepath.Join(s.mockKeyslotsDir, fmt.Sprintf("%d", s.mockKeyslotsCount)), key, 0644), IsNil)
 	s.mockKeyslotsCount++
@@ -324,6 +321,55 @@ func (s *cryptSuite) TestActivateVolumeWithRecoveryKey1(c *C) {
 	})
 }
 
+type testLogEvent struct {
+	name   string
+	fields map[string]interface{}
+}
+
+type testLogger struct {
+	events []testLogEvent
+}
+
+func (l *testLogger) Debug(name string, fields ...LogField) {
+	m := make(map[string]interface{})
+	for _, f := range fields {
+		m[f.Key] = f.Value
+	}
+	l.events = append(l.events, testLogEvent{name, m})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyLogging(c *C) {
+	l := new(testLogger)
+	SetLogger(l)
+	defer SetLogger(nil)
+
+	recoveryKey := s.newRecoveryKey()
+	s.testActivateVolumeWithRecoveryKey(c, &testActivateVolumeWithRecoveryKeyData{
+		recoveryKey:      recoveryKey,
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		tries:            2,
+		recoveryPassphrases: []string{
+			"00000-00000-00000-00000-00000-00000-00000-00000",
+			recoveryKey.String(),
+		},
+		activateTries: 2,
+	})
+
+	c.Assert(l.events, HasLen, 2)
+	for i, ev := range l.events {
+		c.Check(ev.name, Equals, "activate-with-recovery-key")
+		c.Check(ev.fields["volume"], Equals, "data")
+		c.Check(ev.fields["device"], Equals, "/dev/sda1")
+		c.Check(ev.fields["cached"], Equals, false)
+		if i == 0 {
+			c.Check(ev.fields["error"], NotNil)
+		} else {
+			c.Check(ev.fields["error"], IsNil)
+		}
+	}
+}
+
 func (s *cryptSuite) TestActivateVolumeWithRecoveryKey2(c *C) {
 	// Test with a recovery key which is entered without a hyphen between each group of 5 digits.
 	recoveryKey := s.newRecoveryKey()
@@ -587,6 +633,41 @@ func (s *cryptSuite) TestParseRecoveryKeyErrorHandling5(c *C) {
 	})
 }
 
+func (s *cryptSuite) TestNewRecoveryKey(c *C) {
+	k1, err := NewRecoveryKey()
+	c.Check(err, IsNil)
+	k2, err := NewRecoveryKey()
+	c.Check(err, IsNil)
+	c.Check(k1, Not(DeepEquals), k2)
+	c.Check(k1, Not(DeepEquals), RecoveryKey{})
+}
+
+func (s *cryptSuite) TestNewRecoveryKeyFromReader(c *C) {
+	k1, err := NewRecoveryKeyFromReader(bytes.NewReader(testutil.DecodeHexString(c, "7ea7a7d3f7a4d1ef7bda0937218e2c86")))
+	c.Check(err, IsNil)
+	c.Check(k1[:], DeepEquals, testutil.DecodeHexString(c, "7ea7a7d3f7a4d1ef7bda0937218e2c86"))
+
+	_, err = NewRecoveryKeyFromReader(bytes.NewReader(nil))
+	c.Check(err, ErrorMatches, "cannot obtain random bytes: EOF")
+}
+
+func (s *cryptSuite) TestRecoveryKeyEqual(c *C) {
+	k1 := s.newRecoveryKey()
+	k2 := k1
+	c.Check(k1.Equal(k2), Equals, true)
+
+	k2[15] ^= 0xff
+	c.Check(k1.Equal(k2), Equals, false)
+}
+
+func (s *cryptSuite) TestRecoveryKeyStringRoundTrip(c *C) {
+	k1, err := NewRecoveryKey()
+	c.Assert(err, IsNil)
+	k2, err := ParseRecoveryKey(k1.String())
+	c.Check(err, IsNil)
+	c.Check(k1.Equal(k2), Equals, true)
+}
+
 type testRecoveryKeyStringifyData struct {
 	key      []byte
 	expected string
@@ -744,6 +825,26 @@ func (s *cryptSuite) testActivateVolumeWithKeyData(c *C, data *testActivateVolum
 	s.checkKeyDataKeysInKeyring(c, data.keyringPrefix, data.sourceDevicePath, key, auxKey)
 }
 
+func (s *cryptSuite) TestActivateVolumeWithKeyDataContextCancelled(c *C) {
+	keyData, key, _ := s.newNamedKeyData(c, "")
+	s.addMockKeyslot(c, key)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	options := &ActivateVolumeOptions{RecoveryKeyTries: 1}
+	modelChecker, err := ActivateVolumeWithKeyDataContext(ctx, "data", "/dev/sda1", keyData, options)
+	c.Check(modelChecker, IsNil)
+	c.Check(err, ErrorMatches, "(?s)cannot activate with platform protected keys:\n"+
+		"- .*: context canceled\n"+
+		"and activation with recovery key failed: context canceled")
+	c.Check(xerrors.Is(err, context.Canceled), testutil.IsTrue)
+
+	// Neither the platform key nor the recovery key should have been tried.
+	c.Check(s.mockSdAskPassword.Calls(), HasLen, 0)
+	c.Check(s.mockLUKS2ActivateCalls, HasLen, 0)
+}
+
 func (s *cryptSuite) TestActivateVolumeWithKeyData1(c *C) {
 	models := []SnapModel{
 		testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
@@ -1139,6 +1240,62 @@ func (s *cryptSuite) TestActivateVolumeWithMultipleKeyData3(c *C) {
 		auxKey:           auxKeys[1]})
 }
 
+func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataPriority(c *C) {
+	// The key with the highest priority should be tried first.
+	keyData, keys, auxKeys := s.newMultipleNamedKeyData(c, "foo", "bar", "baz")
+	keyData[2].SetPriority(1)
+
+	models := []SnapModel{
+		testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+			"authority-id": "fake-brand",
+			"series":       "16",
+			"brand-id":     "fake-brand",
+			"model":        "fake-model",
+			"grade":        "secured",
+		}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")}
+	c.Check(keyData[2].SetAuthorizedSnapModels(auxKeys[2], models...), IsNil)
+
+	s.testActivateVolumeWithMultipleKeyData(c, &testActivateVolumeWithMultipleKeyDataData{
+		keys:             keys,
+		keyData:          keyData,
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		model:            models[0],
+		authorized:       true,
+		activateTries:    1,
+		key:              keys[2],
+		auxKey:           auxKeys[2]})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataPriorityStable(c *C) {
+	// Keys with the same priority should be tried in the order supplied.
+	keyData, keys, auxKeys := s.newMultipleNamedKeyData(c, "foo", "bar", "baz")
+	keyData[0].SetPriority(-1)
+	keyData[1].SetPriority(-1)
+
+	models := []SnapModel{
+		testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+			"authority-id": "fake-brand",
+			"series":       "16",
+			"brand-id":     "fake-brand",
+			"model":        "fake-model",
+			"grade":        "secured",
+		}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")}
+	c.Check(keyData[0].SetAuthorizedSnapModels(auxKeys[0], models...), IsNil)
+
+	// Only the first two keys are valid for the volume.
+	s.testActivateVolumeWithMultipleKeyData(c, &testActivateVolumeWithMultipleKeyDataData{
+		keys:             keys[:2],
+		keyData:          keyData,
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		model:            models[0],
+		authorized:       true,
+		activateTries:    2,
+		key:              keys[0],
+		auxKey:           auxKeys[0]})
+}
+
 type testActivateVolumeWithMultipleKeyDataErrorHandlingData struct {
 	keys        []DiskUnlockKey
 	recoveryKey RecoveryKey
@@ -1332,6 +1489,279 @@ func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataErrorHandling8(c *C) {
 		activateTries:    1})
 }
 
+func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataErrorHandling9(c *C) {
+	// Test that the remaining keys are skipped once the platform is found to be unavailable
+	keyData, keys, _ := s.newMultipleNamedKeyData(c, "foo", "bar")
+	recoveryKey := s.newRecoveryKey()
+
+	s.handler.state = mockPlatformDeviceStateUnavailable
+
+	s.testActivateVolumeWithMultipleKeyDataErrorHandling(c, &testActivateVolumeWithMultipleKeyDataErrorHandlingData{
+		keys:             keys,
+		recoveryKey:      recoveryKey,
+		keyData:          keyData,
+		passphrases:      []string{recoveryKey.String()},
+		recoveryKeyTries: 1,
+		activateTries:    1})
+	c.Check(s.handler.recoverKeysCalls, Equals, 1)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataDisableRecoveryKeyFallback(c *C) {
+	// Test that the recovery key isn't requested when DisableRecoveryKeyFallback is set, and
+	// that UnsealErrorHandler is called for each key that was tried.
+	keyData, keys, _ := s.newMultipleNamedKeyData(c, "foo", "bar")
+	for _, key := range keys {
+		s.addMockKeyslot(c, key)
+	}
+
+	s.handler.state = mockPlatformDeviceStateUnavailable
+
+	var names []string
+	options := &ActivateVolumeOptions{
+		RecoveryKeyTries:           1,
+		DisableRecoveryKeyFallback: true,
+		UnsealErrorHandler: func(name string, err error) {
+			c.Check(err, ErrorMatches, "cannot recover key: the platform's secure device is unavailable: the platform device is unavailable")
+			names = append(names, name)
+		}}
+	modelChecker, err := ActivateVolumeWithMultipleKeyData("data", "/dev/sda1", keyData, options)
+	c.Check(modelChecker, IsNil)
+	c.Check(err, ErrorMatches, "(?s)cannot activate with platform protected keys:\n.*"+
+		"and activation with recovery key failed: fallback to the recovery key is disabled")
+	c.Check(names, DeepEquals, []string{"foo"})
+
+	c.Check(s.mockSdAskPassword.Calls(), HasLen, 0)
+	c.Check(s.mockLUKS2ActivateCalls, HasLen, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataRequireLockedMemory(c *C) {
+	// Test that activation stops without trying any other keys or the recovery key if a
+	// recovered key can't be held in locked memory when RequireLockedMemory is set.
+	restore := MockLockedMemoryUnavailable()
+	defer restore()
+
+	keyData, keys, _ := s.newMultipleNamedKeyData(c, "foo", "bar")
+	for _, key := range keys {
+		s.addMockKeyslot(c, key)
+	}
+
+	var names []string
+	options := &ActivateVolumeOptions{
+		RecoveryKeyTries:    1,
+		RequireLockedMemory: true,
+		UnsealErrorHandler: func(name string, err error) {
+			c.Check(err, ErrorMatches, "cannot protect recovered key: cannot lock buffer in to memory: cannot allocate memory")
+			names = append(names, name)
+		}}
+	modelChecker, err := ActivateVolumeWithMultipleKeyData("data", "/dev/sda1", keyData, options)
+	c.Check(modelChecker, IsNil)
+	c.Check(err, ErrorMatches, "(?s)cannot activate with platform protected keys:\n.*"+
+		"and activation with recovery key failed: not falling back to the recovery key because keys cannot be held in locked memory")
+	c.Check(names, DeepEquals, []string{"foo"})
+
+	c.Check(s.mockSdAskPassword.Calls(), HasLen, 0)
+	c.Check(s.mockLUKS2ActivateCalls, HasLen, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyRequireLockedMemory(c *C) {
+	restore := MockLockedMemoryUnavailable()
+	defer restore()
+
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot(c, recoveryKey[:])
+	s.addTryPassphrases(c, []string{recoveryKey.String(), recoveryKey.String()})
+
+	options := ActivateVolumeOptions{RecoveryKeyTries: 2, RequireLockedMemory: true}
+	err := ActivateVolumeWithRecoveryKey("data", "/dev/sda1", nil, &options)
+	c.Check(err, ErrorMatches, "cannot protect recovery key: cannot lock buffer in to memory: cannot allocate memory")
+
+	c.Check(s.mockSdAskPassword.Calls(), HasLen, 1)
+	c.Check(s.mockLUKS2ActivateCalls, HasLen, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataLockoutBehaviorUnsupported(c *C) {
+	keyData, _, _ := s.newMultipleNamedKeyData(c, "foo", "bar")
+
+	_, err := ActivateVolumeWithMultipleKeyData("data", "/dev/sda1", keyData, &ActivateVolumeOptions{LockoutBehavior: LockoutFail})
+	c.Check(err, ErrorMatches, "LockoutBehavior is not supported when activating with KeyData")
+	c.Check(s.mockLUKS2ActivateCalls, HasLen, 0)
+}
+
+func (s *cryptSuite) newPassphraseKeyData(c *C, passphrase string) (*KeyData, DiskUnlockKey, AuxiliaryKey) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyDataWithPassphrase(protected, passphrase, &PBKDF2Options{ForceIterations: 1000})
+	c.Assert(err, IsNil)
+	return keyData, key, auxKey
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataPassphrase(c *C) {
+	keyData, key, auxKey := s.newPassphraseKeyData(c, "passphrase")
+	s.addMockKeyslot(c, key)
+	s.addTryPassphrases(c, []string{"foo", "passphrase"})
+
+	options := &ActivateVolumeOptions{PassphraseTries: 3}
+	_, err := ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, options)
+	c.Assert(err, IsNil)
+
+	c.Check(s.mockSdAskPassword.Calls(), HasLen, 2)
+	for _, call := range s.mockSdAskPassword.Calls() {
+		c.Check(call, DeepEquals, []string{"systemd-ask-password", "--icon", "drive-harddisk", "--id",
+			filepath.Base(os.Args[0]) + ":/dev/sda1", "Please enter the passphrase for disk /dev/sda1:"})
+	}
+
+	c.Assert(s.mockLUKS2ActivateCalls, HasLen, 1)
+	c.Check(s.mockLUKS2ActivateCalls[0].volumeName, Equals, "data")
+	c.Check(s.mockLUKS2ActivateCalls[0].sourceDevicePath, Equals, "/dev/sda1")
+
+	// This should be done last because it may fail in some circumstances.
+	s.checkKeyDataKeysInKeyring(c, "", "/dev/sda1", key, auxKey)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataPassphraseAfterAuthModeNone(c *C) {
+	// Test that keys which don't require a passphrase are tried first.
+	keyData, keys, auxKeys := s.newMultipleNamedKeyData(c, "foo")
+	passphraseKeyData, passphraseKey, _ := s.newPassphraseKeyData(c, "passphrase")
+	s.addMockKeyslot(c, passphraseKey)
+	s.addMockKeyslot(c, keys[0])
+
+	options := &ActivateVolumeOptions{PassphraseTries: 1}
+	_, err := ActivateVolumeWithMultipleKeyData("data", "/dev/sda1", []*KeyData{passphraseKeyData, keyData[0]}, options)
+	c.Assert(err, IsNil)
+
+	c.Check(s.mockSdAskPassword.Calls(), HasLen, 0)
+	c.Assert(s.mockLUKS2ActivateCalls, HasLen, 1)
+
+	// This should be done last because it may fail in some circumstances.
+	s.checkKeyDataKeysInKeyring(c, "", "/dev/sda1", keys[0], auxKeys[0])
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataPassphraseFallbackToRecoveryKey(c *C) {
+	// Test that the recovery key is requested once the passphrase tries are exhausted.
+	keyData, _, _ := s.newPassphraseKeyData(c, "passphrase")
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot(c, recoveryKey[:])
+	s.addTryPassphrases(c, []string{"foo", "bar", recoveryKey.String()})
+
+	options := &ActivateVolumeOptions{PassphraseTries: 2, RecoveryKeyTries: 1}
+	_, err := ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, options)
+	c.Check(err, Equals, ErrRecoveryKeyUsed)
+
+	c.Check(s.mockSdAskPassword.Calls(), HasLen, 3)
+	c.Check(s.handler.recoverKeysCalls, Equals, 0)
+	c.Assert(s.mockLUKS2ActivateCalls, HasLen, 1)
+}
+
+func (s *cryptSuite) TestActivateVolumesSharedPassphrase(c *C) {
+	// Test that the user is only asked for the passphrase once when it is shared by each volume.
+	keyData1, key1, _ := s.newPassphraseKeyData(c, "passphrase")
+	keyData2, key2, _ := s.newPassphraseKeyData(c, "passphrase")
+	s.addMockKeyslot(c, key1)
+	s.addMockKeyslot(c, key2)
+	s.addTryPassphrases(c, []string{"passphrase"})
+
+	options := &ActivateVolumesOptions{ActivateVolumeOptions: ActivateVolumeOptions{PassphraseTries: 1}}
+	checkers, err := ActivateVolumes([]*VolumeActivationRequest{
+		{VolumeName: "data", SourceDevicePath: "/dev/sda1", Keys: []*KeyData{keyData1}},
+		{VolumeName: "save", SourceDevicePath: "/dev/sda2", Keys: []*KeyData{keyData2}}}, options)
+	c.Check(err, IsNil)
+	c.Assert(checkers, HasLen, 2)
+	c.Check(checkers[0].VolumeName(), Equals, "data")
+	c.Check(checkers[1].VolumeName(), Equals, "save")
+
+	c.Check(s.mockSdAskPassword.Calls(), HasLen, 1)
+	c.Assert(s.mockLUKS2ActivateCalls, HasLen, 2)
+	c.Check(s.mockLUKS2ActivateCalls[0].volumeName, Equals, "data")
+	c.Check(s.mockLUKS2ActivateCalls[1].volumeName, Equals, "save")
+}
+
+func (s *cryptSuite) TestActivateVolumesSharedRecoveryKey(c *C) {
+	// Test that the user is only asked for the recovery key once when it is shared by each volume, and that
+	// they aren't asked for a passphrase again once the recovery key has been used.
+	keyData1, _, _ := s.newPassphraseKeyData(c, "passphrase")
+	keyData2, _, _ := s.newPassphraseKeyData(c, "passphrase")
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot(c, recoveryKey[:])
+	s.addTryPassphrases(c, []string{"foo", recoveryKey.String()})
+
+	options := &ActivateVolumesOptions{ActivateVolumeOptions: ActivateVolumeOptions{PassphraseTries: 1, RecoveryKeyTries: 1}}
+	checkers, err := ActivateVolumes([]*VolumeActivationRequest{
+		{VolumeName: "data", SourceDevicePath: "/dev/sda1", Keys: []*KeyData{keyData1}},
+		{VolumeName: "save", SourceDevicePath: "/dev/sda2", Keys: []*KeyData{keyData2}}}, options)
+	c.Check(err, Equals, ErrRecoveryKeyUsed)
+	c.Check(checkers, DeepEquals, []SnapModelChecker{nil, nil})
+
+	c.Check(s.mockSdAskPassword.Calls(), HasLen, 2)
+	c.Assert(s.mockLUKS2ActivateCalls, HasLen, 2)
+	c.Check(s.mockLUKS2ActivateCalls[0].volumeName, Equals, "data")
+	c.Check(s.mockLUKS2ActivateCalls[1].volumeName, Equals, "save")
+
+	// The cached recovery key must still be intact when it is used for the second volume.
+	s.checkRecoveryKeyInKeyring(c, "", "/dev/sda1", recoveryKey)
+	s.checkRecoveryKeyInKeyring(c, "", "/dev/sda2", recoveryKey)
+}
+
+func (s *cryptSuite) testActivateVolumesPartialFailure(c *C, rollback bool) []SnapModelChecker {
+	keyData1, key1, _ := s.newPassphraseKeyData(c, "passphrase")
+	keyData2, _, _ := s.newPassphraseKeyData(c, "other")
+	s.addMockKeyslot(c, key1)
+	s.addTryPassphrases(c, []string{"passphrase", "foo"})
+
+	options := &ActivateVolumesOptions{
+		ActivateVolumeOptions: ActivateVolumeOptions{PassphraseTries: 1},
+		RollbackOnFailure:     rollback}
+	checkers, err := ActivateVolumes([]*VolumeActivationRequest{
+		{VolumeName: "data", SourceDevicePath: "/dev/sda1", Keys: []*KeyData{keyData1}},
+		{VolumeName: "save", SourceDevicePath: "/dev/sda2", Keys: []*KeyData{keyData2}}}, options)
+	c.Check(err, ErrorMatches, "cannot activate volume save: cannot activate with platform protected keys:\n"+
+		"- .*: cannot recover key with passphrase: the supplied passphrase is incorrect\n"+
+		"and activation with recovery key failed: no recovery key tries permitted")
+
+	c.Check(s.mockSdAskPassword.Calls(), HasLen, 2)
+	c.Check(s.mockLUKS2ActivateCalls, HasLen, 1)
+	return checkers
+}
+
+func (s *cryptSuite) TestActivateVolumesPartialFailure(c *C) {
+	checkers := s.testActivateVolumesPartialFailure(c, false)
+	c.Assert(checkers, HasLen, 1)
+	c.Check(checkers[0].VolumeName(), Equals, "data")
+	c.Check(s.mockLUKS2DeactivateCalls, Equals, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumesPartialFailureWithRollback(c *C) {
+	checkers := s.testActivateVolumesPartialFailure(c, true)
+	c.Check(checkers, HasLen, 0)
+	c.Check(s.mockLUKS2DeactivateCalls, Equals, 1)
+}
+
+func (s *cryptSuite) TestActivateVolumesNoKeys(c *C) {
+	_, err := ActivateVolumes([]*VolumeActivationRequest{{VolumeName: "data", SourceDevicePath: "/dev/sda1"}}, &ActivateVolumesOptions{})
+	c.Check(err, ErrorMatches, "no keys provided for volume data")
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataRecordsActivationError(c *C) {
+	// Test that the reason for falling back to the recovery key is recorded.
+	keyData, _, _ := s.newPassphraseKeyData(c, "passphrase")
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot(c, recoveryKey[:])
+	s.addTryPassphrases(c, []string{"foo", recoveryKey.String()})
+
+	options := &ActivateVolumeOptions{PassphraseTries: 1, RecoveryKeyTries: 1}
+	_, err := ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, options)
+	c.Check(err, Equals, ErrRecoveryKeyUsed)
+
+	// This should be done last because it may fail in some circumstances.
+	if !s.ProcessPossessesUserKeyringKeys && !c.Failed() {
+		c.ExpectFailure("Cannot possess user keys because the user keyring isn't reachable from the session keyring")
+	}
+
+	msg, err := GetActivationError("", "data", false)
+	c.Check(err, IsNil)
+	c.Check(msg, Matches, ".*: cannot recover key with passphrase: the supplied passphrase is incorrect")
+}
+
 type testActivateVolumeWithKeyData struct {
 	keyData         []byte
 	expectedKeyData []byte
@@ -1396,22 +1826,63 @@ func (s *cryptSuite) TestDeactivateVolumeErr(c *C) {
 	c.Check(s.mockLUKS2DeactivateCalls, Equals, 1)
 }
 
+func (s *cryptSuite) TestActivatePlainVolumeWithKey(c *C) {
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	var calls int
+	restore := MockLUKS2ActivatePlain(func(volumeName, sourceDevicePath string, k []byte, options *luks2.PlainOptions) error {
+		calls++
+		c.Check(volumeName, Equals, "data")
+		c.Check(sourceDevicePath, Equals, "/dev/sda1")
+		c.Check(k, DeepEquals, key)
+		c.Check(options, DeepEquals, &luks2.PlainOptions{Cipher: "aes-cbc-essiv:sha256", Offset: 2048, SectorSize: 4096})
+		return nil
+	})
+	defer restore()
+
+	c.Check(ActivatePlainVolumeWithKey("data", "/dev/sda1", key, &PlainVolumeOptions{
+		Cipher:     "aes-cbc-essiv:sha256",
+		Offset:     2048,
+		SectorSize: 4096}), IsNil)
+	c.Check(calls, Equals, 1)
+}
+
+func (s *cryptSuite) TestActivatePlainVolumeWithKeyNilOptions(c *C) {
+	restore := MockLUKS2ActivatePlain(func(_, _ string, _ []byte, options *luks2.PlainOptions) error {
+		c.Check(options, DeepEquals, &luks2.PlainOptions{})
+		return errors.New("some error")
+	})
+	defer restore()
+
+	c.Check(ActivatePlainVolumeWithKey("data", "/dev/sda1", make([]byte, 32), nil), ErrorMatches, "some error")
+}
+
+func (s *cryptSuite) TestActivatePlainVolumeWithKeyNoKey(c *C) {
+	c.Check(ActivatePlainVolumeWithKey("data", "/dev/sda1", nil, nil), ErrorMatches, "no key supplied")
+}
+
 type testInitializeLUKS2ContainerData struct {
 	devicePath      string
 	label           string
 	key             []byte
 	opts            *InitializeLUKS2ContainerOptions
+	cipherArgs      []string
 	extraFormatArgs []string
 }
 
 func (s *cryptSuite) testInitializeLUKS2Container(c *C, data *testInitializeLUKS2ContainerData) {
 	c.Check(InitializeLUKS2Container(data.devicePath, data.label, data.key, data.opts), IsNil)
+	cipherArgs := data.cipherArgs
+	if cipherArgs == nil {
+		cipherArgs = []string{"--cipher", "aes-xts-plain64", "--key-size", "512"}
+	}
 	formatArgs := []string{"cryptsetup",
 		"-q", "luksFormat", "--type", "luks2",
-		"--key-file", "-", "--cipher", "aes-xts-plain64",
-		"--key-size", "512", "--label", data.label,
-		"--pbkdf", "argon2i", "--iter-time", "100",
-	}
+		"--key-file", "-"}
+	formatArgs = append(formatArgs, cipherArgs...)
+	formatArgs = append(formatArgs, "--label", data.label,
+		"--pbkdf", "argon2i", "--pbkdf-force-iterations", "4", "--pbkdf-memory", "32")
 	formatArgs = append(formatArgs, data.extraFormatArgs...)
 	formatArgs = append(formatArgs, data.devicePath)
 
@@ -1467,6 +1938,73 @@ func (s *cryptSuite) TestInitializeLUKS2ContainerWithOptions(c *C) {
 	})
 }
 
+func (s *cryptSuite) TestInitializeLUKS2ContainerWithSectorSize(c *C) {
+	s.testInitializeLUKS2Container(c, &testInitializeLUKS2ContainerData{
+		devicePath: "/dev/vdc2",
+		label:      "test",
+		key:        s.newPrimaryKey(),
+		opts: &InitializeLUKS2ContainerOptions{
+			SectorSize: 4096,
+		},
+		extraFormatArgs: []string{
+			"--sector-size", "4096",
+		},
+	})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerWithHMACIntegrity(c *C) {
+	s.testInitializeLUKS2Container(c, &testInitializeLUKS2ContainerData{
+		devicePath: "/dev/sda1",
+		label:      "data",
+		key:        s.newPrimaryKey(),
+		opts: &InitializeLUKS2ContainerOptions{
+			Integrity: LUKS2IntegrityHMACSHA256,
+		},
+		cipherArgs: []string{"--cipher", "aes-xts-plain64", "--key-size", "512", "--integrity", "hmac-sha256"},
+	})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerWithAESGCMIntegrity(c *C) {
+	s.testInitializeLUKS2Container(c, &testInitializeLUKS2ContainerData{
+		devicePath: "/dev/sda1",
+		label:      "data",
+		key:        s.newPrimaryKey(),
+		opts: &InitializeLUKS2ContainerOptions{
+			Integrity: LUKS2IntegrityAESGCM,
+		},
+		cipherArgs: []string{"--cipher", "aes-gcm-random", "--key-size", "256", "--integrity", "aead"},
+	})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerWithAEGISIntegrity(c *C) {
+	s.testInitializeLUKS2Container(c, &testInitializeLUKS2ContainerData{
+		devicePath: "/dev/vdc2",
+		label:      "test",
+		key:        s.newPrimaryKey(),
+		opts: &InitializeLUKS2ContainerOptions{
+			Integrity: LUKS2IntegrityAEGIS128,
+		},
+		cipherArgs: []string{"--cipher", "aegis128-random", "--key-size", "128", "--integrity", "aead"},
+	})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerInvalidIntegrity(c *C) {
+	opts := InitializeLUKS2ContainerOptions{Integrity: 10}
+	c.Check(InitializeLUKS2Container("/dev/sda1", "data", s.newPrimaryKey(), &opts), ErrorMatches, "invalid integrity mode")
+	c.Check(s.mockCryptsetup.Calls(), HasLen, 0)
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerInvalidSectorSize(c *C) {
+	key := make([]byte, 32)
+	for _, invalidSz := range []int{1, 256, 768, 8192} {
+		opts := InitializeLUKS2ContainerOptions{
+			SectorSize: invalidSz,
+		}
+		c.Check(InitializeLUKS2Container("/dev/sda1", "data", key, &opts), ErrorMatches,
+			fmt.Sprintf("cannot set sector size to %v bytes", invalidSz))
+	}
+}
+
 func (s *cryptSuite) TestInitializeLUKS2ContainerInvalidKeySize(c *C) {
 	c.Check(InitializeLUKS2Container("/dev/sda1", "data", s.newPrimaryKey()[0:16], nil), ErrorMatches, "expected a key length of at least 256-bits \\(got 128\\)")
 }
@@ -1519,6 +2057,27 @@ func (s *cryptSuite) TestInitializeLUKS2ContainerKeyslotsSize(c *C) {
 	}
 }
 
+func (s *cryptSuite) TestInitializeLUKS2ContainerInFIPSMode(c *C) {
+	restore := MockFIPSMode(true)
+	defer restore()
+
+	c.Check(InitializeLUKS2Container("/dev/sda1", "data", s.newPrimaryKey(), nil), IsNil)
+	c.Check(s.mockCryptsetup.Calls(), DeepEquals, [][]string{
+		{"cryptsetup", "-q", "luksFormat", "--type", "luks2", "--key-file", "-",
+			"--cipher", "aes-xts-plain64", "--key-size", "512", "--label", "data",
+			"--pbkdf", "pbkdf2", "--pbkdf-force-iterations", "1000", "/dev/sda1"},
+		{"cryptsetup", "config", "--priority", "prefer", "--key-slot", "0", "/dev/sda1"}})
+}
+
+func (s *cryptSuite) TestAddRecoveryKeyToLUKS2ContainerInFIPSMode(c *C) {
+	restore := MockFIPSMode(true)
+	defer restore()
+
+	c.Check(AddRecoveryKeyToLUKS2Container("/dev/sda1", s.newPrimaryKey(), s.newRecoveryKey()), IsNil)
+	c.Assert(s.mockCryptsetup.Calls(), HasLen, 1)
+	c.Check(s.mockCryptsetup.Calls()[0][6:], DeepEquals, []string{"--pbkdf", "pbkdf2", "--iter-time", "5000", "/dev/sda1", "-"})
+}
+
 type testAddRecoveryKeyToLUKS2ContainerData struct {
 	devicePath  string
 	key         []byte
@@ -1590,10 +2149,10 @@ func (s *cryptSuite) testChangeLUKS2KeyUsingRecoveryKey(c *C, data *testChangeLU
 	c.Check(s.mockCryptsetup.Calls()[0], DeepEquals, []string{"cryptsetup", "luksKillSlot", "--type", "luks2", "--key-file", "-", data.devicePath, "0"})
 
 	call := s.mockCryptsetup.Calls()[1]
-	c.Assert(len(call), Equals, 14)
+	c.Assert(len(call), Equals, 16)
 	c.Check(call[0:5], DeepEquals, []string{"cryptsetup", "luksAddKey", "--type", "luks2", "--key-file"})
 	c.Check(call[5], Matches, filepath.Join(paths.RunDir, filepath.Base(os.Args[0]))+"\\.[0-9]+/fifo")
-	c.Check(call[6:14], DeepEquals, []string{"--pbkdf", "argon2i", "--iter-time", "100", "--key-slot", "0", data.devicePath, "-"})
+	c.Check(call[6:16], DeepEquals, []string{"--pbkdf", "argon2i", "--pbkdf-force-iterations", "4", "--pbkdf-memory", "32", "--key-slot", "0", data.devicePath, "-"})
 
 	c.Check(s.mockCryptsetup.Calls()[2], DeepEquals, []string{"cryptsetup", "config", "--priority", "prefer", "--key-slot", "0", data.devicePath})
 
@@ -1693,15 +2252,11 @@ func (s *cryptSuiteExpensive) testInitializeLUKS2Container(c *C, options *Initia
 	c.Check(info.Metadata.Config.JSONSize, Equals, expectedMetadataSize-uint64(4*1024))
 	c.Check(info.Metadata.Config.KeyslotsSize, Equals, expectedKeyslotsSize)
 
-	expectedKDFTime := 100 * time.Millisecond
+	c.Assert(keyslot.KDF, NotNil)
+	c.Check(keyslot.KDF.Time, Equals, 4)
+	c.Check(keyslot.KDF.Memory, Equals, 32)
 
-	start := time.Now()
 	luks2test.CheckLUKS2Passphrase(c, path, key)
-	elapsed := time.Now().Sub(start)
-
-	// Check KDF time here with +/-20% tolerance and additional 500ms for cryptsetup exec and other activities
-	c.Check(int(elapsed/time.Millisecond), snapd_testutil.IntGreaterThan, int(float64(expectedKDFTime/time.Millisecond)*0.8))
-	c.Check(int(elapsed/time.Millisecond), snapd_testutil.IntLessThan, int(float64(expectedKDFTime/time.Millisecond)*1.2)+500)
 }
 
 func (s *cryptSuiteExpensive) TestInitializeLUKS2Container(c *C) {
@@ -1777,3 +2332,80 @@ func (s *cryptSuiteExpensive) ChangeLUKS2KeyUsingRecoveryKey(c *C) {
 	c.Check(int(elapsed/time.Millisecond), snapd_testutil.IntGreaterThan, int(float64(expectedKDFTime/time.Millisecond)*0.8))
 	c.Check(int(elapsed/time.Millisecond), snapd_testutil.IntLessThan, int(float64(expectedKDFTime/time.Millisecond)*1.2)+500)
 }
+
+func (s *cryptSuite) mockVolumeStatus(c *C, volumeName string, status *luks2.VolumeStatus) {
+	s.AddCleanup(MockLUKS2GetVolumeStatus(func(name string) (*luks2.VolumeStatus, error) {
+		if name != volumeName {
+			return nil, luks2.ErrVolumeNotActive
+		}
+		return status, nil
+	}))
+}
+
+func (s *cryptSuite) TestGetActivationStateNotActive(c *C) {
+	s.mockVolumeStatus(c, "save", &luks2.VolumeStatus{DevicePath: "/dev/dm-0", SourceDevicePaths: []string{"/dev/sda2"}})
+
+	state, err := GetActivationState("", "data")
+	c.Check(err, IsNil)
+	c.Check(state, DeepEquals, &ActivationState{})
+}
+
+func (s *cryptSuite) testGetActivationState(c *C, activate func(), expectedProtector string) {
+	s.mockVolumeStatus(c, "data", &luks2.VolumeStatus{DevicePath: "/dev/dm-0", SourceDevicePaths: []string{"/dev/sda1"}})
+
+	activate()
+
+	// This should be done last because it may fail in some circumstances.
+	if !s.ProcessPossessesUserKeyringKeys && !c.Failed() {
+		c.ExpectFailure("Cannot possess user keys because the user keyring isn't reachable from the session keyring")
+	}
+
+	state, err := GetActivationState("", "data")
+	c.Check(err, IsNil)
+	c.Check(state, DeepEquals, &ActivationState{
+		Active:           true,
+		DevicePath:       "/dev/dm-0",
+		SourceDevicePath: "/dev/sda1",
+		Protector:        expectedProtector})
+}
+
+func (s *cryptSuite) TestGetActivationStateKeyData(c *C) {
+	keyData, key, _ := s.newNamedKeyData(c, "foo")
+	s.addMockKeyslot(c, key)
+
+	s.testGetActivationState(c, func() {
+		_, err := ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, &ActivateVolumeOptions{})
+		c.Check(err, IsNil)
+	}, "foo")
+}
+
+func (s *cryptSuite) TestGetActivationStateRecoveryKey(c *C) {
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot(c, recoveryKey[:])
+	s.addTryPassphrases(c, []string{recoveryKey.String()})
+
+	s.testGetActivationState(c, func() {
+		c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", nil, &ActivateVolumeOptions{RecoveryKeyTries: 1}), IsNil)
+	}, RecoveryKeyProtectorName)
+}
+
+func (s *cryptSuite) TestDeactivateVolumeWithKeyringPrefix(c *C) {
+	keyData, key, _ := s.newNamedKeyData(c, "foo")
+	s.addMockKeyslot(c, key)
+	s.mockVolumeStatus(c, "data", &luks2.VolumeStatus{DevicePath: "/dev/dm-0", SourceDevicePaths: []string{"/dev/sda1"}})
+
+	_, err := ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, &ActivateVolumeOptions{KeyringPrefix: "test"})
+	c.Check(err, IsNil)
+
+	c.Check(DeactivateVolumeWithKeyringPrefix("test", "data"), IsNil)
+	c.Check(s.mockLUKS2DeactivateCalls, Equals, 1)
+
+	// The mock volume status still reports the volume as active, but the
+	// state recorded in the keyring during activation should be gone.
+	state, err := GetActivationState("test", "data")
+	c.Check(err, IsNil)
+	c.Check(state, DeepEquals, &ActivationState{
+		Active:           true,
+		DevicePath:       "/dev/dm-0",
+		SourceDevicePath: "/dev/sda1"})
+}
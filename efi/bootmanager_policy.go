@@ -28,6 +28,7 @@ import (
 
 	"golang.org/x/xerrors"
 
+	"github.com/snapcore/secboot/internal/parallel"
 	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
 )
 
@@ -44,6 +45,45 @@ func computePeImageDigest(alg tpm2.HashAlgorithmId, image Image) (tpm2.Digest, e
 	return efi.ComputePeImageDigest(alg.GetHash(), r, r.Size())
 }
 
+// computeLoadSequenceDigests computes the digests of the images of every event in the supplied load sequences, keyed by
+// event. Events are identified by pointer rather than by the string representation of their image, because distinct images
+// are not required to have distinct string representations. Digests are computed concurrently, as hashing large bootloader
+// and kernel images dominates the time taken to generate a profile for trees with many branches.
+func computeLoadSequenceDigests(alg tpm2.HashAlgorithmId, sequences []*ImageLoadEvent, cache *ImageDigestCache) (map[*ImageLoadEvent]tpm2.Digest, error) {
+	var events []*ImageLoadEvent
+	seen := make(map[*ImageLoadEvent]bool)
+
+	var walk func([]*ImageLoadEvent)
+	walk = func(evs []*ImageLoadEvent) {
+		for _, e := range evs {
+			if !seen[e] {
+				seen[e] = true
+				events = append(events, e)
+			}
+			walk(e.Next)
+		}
+	}
+	walk(sequences)
+
+	digests := make([]tpm2.Digest, len(events))
+	if err := parallel.ForEach(len(events), 0, func(i int) error {
+		digest, err := cache.computePeImageDigest(alg, events[i].Image)
+		if err != nil {
+			return xerrors.Errorf("cannot compute digest of %s: %w", events[i].Image, err)
+		}
+		digests[i] = digest
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	out := make(map[*ImageLoadEvent]tpm2.Digest)
+	for i, e := range events {
+		out[e] = digests[i]
+	}
+	return out, nil
+}
+
 type bootManagerCodePolicyGenBranch struct {
 	profile  *secboot_tpm2.PCRProtectionProfile
 	branches []*secboot_tpm2.PCRProtectionProfile
@@ -75,6 +115,10 @@ type BootManagerProfileParams struct {
 	// a custom EFI environment. If not set, the host's normal environment will
 	// be used
 	Environment HostEnvironment
+
+	// DigestCache is an optional cache of image digests, which avoids recomputing
+	// the digests of images that have already been hashed.
+	DigestCache *ImageDigestCache
 }
 
 // AddBootManagerProfile adds the UEFI boot manager code and boot attempts profile to the provided PCR protection profile, in order
@@ -114,7 +158,7 @@ func AddBootManagerProfile(profile *secboot_tpm2.PCRProtectionProfile, params *B
 	}
 
 	if !log.Algorithms.Contains(params.PCRAlgorithm) {
-		return errors.New("cannot compute secure boot policy digests: the TCG event log does not have the requested algorithm")
+		return errors.New("cannot compute boot manager code policy digests: the TCG event log does not have the requested algorithm")
 	}
 
 	profile.AddPCRValue(params.PCRAlgorithm, bootManagerCodePCR, make(tpm2.Digest, params.PCRAlgorithm.Size()))
@@ -133,6 +177,11 @@ func AddBootManagerProfile(profile *secboot_tpm2.PCRProtectionProfile, params *B
 		}
 	}
 
+	digests, err := computeLoadSequenceDigests(params.PCRAlgorithm, params.LoadSequences, params.DigestCache)
+	if err != nil {
+		return err
+	}
+
 	root := bootManagerCodePolicyGenBranch{profile: profile}
 	allBranches := []*bootManagerCodePolicyGenBranch{&root}
 
@@ -153,11 +202,7 @@ func AddBootManagerProfile(profile *secboot_tpm2.PCRProtectionProfile, params *B
 		e := loadEvents[0]
 		loadEvents = loadEvents[1:]
 
-		digest, err := computePeImageDigest(params.PCRAlgorithm, e.event.Image)
-		if err != nil {
-			return err
-		}
-		e.branch.profile.ExtendPCR(params.PCRAlgorithm, bootManagerCodePCR, digest)
+		e.branch.profile.ExtendPCR(params.PCRAlgorithm, bootManagerCodePCR, digests[e.event])
 
 		if len(e.event.Next) == 1 {
 			nextLoadEvents = append(nextLoadEvents, &bmLoadEventAndBranch{event: e.event.Next[0], branch: e.branch})
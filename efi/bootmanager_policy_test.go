@@ -20,6 +20,8 @@
 package efi_test
 
 import (
+	"bytes"
+	"io/ioutil"
 	"path/filepath"
 	"runtime"
 
@@ -350,3 +352,109 @@ func (s *bootManagerPolicySuite) TestAddBootManagerProfileWithCustomEFIEnv(c *C)
 		},
 	})
 }
+
+func (s *bootManagerPolicySuite) TestAddBootManagerProfileUnsupportedAlgorithm(c *C) {
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	err := AddBootManagerProfile(profile, &BootManagerProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA384,
+		LoadSequences: []*ImageLoadEvent{
+			{Image: FileImage(filepath.Join("testdata", runtime.GOARCH, "mockshim_sbat.efi.signed.1.1.1"))},
+		},
+		Environment: &mockEFIEnvironment{"", "testdata/eventlog_sb.bin"}})
+	c.Check(err, ErrorMatches, "cannot compute boot manager code policy digests: the TCG event log does not have the requested algorithm")
+}
+
+func (s *bootManagerPolicySuite) TestAddBootManagerProfileWithReaderImages(c *C) {
+	// Test with the classic style configuration, but with the kernels supplied from memory.
+	var kernels []Image
+	for _, name := range []string{"mockkernel1.efi.signed.shim.1", "mockkernel2.efi.signed.shim.1"} {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", runtime.GOARCH, name))
+		c.Assert(err, IsNil)
+		kernels = append(kernels, ReaderImage(bytes.NewReader(data), int64(len(data))))
+	}
+
+	s.testAddBootManagerProfile(c, &testAddBootManagerProfileData{
+		eventLogPath: "testdata/eventlog_sb.bin",
+		params: &BootManagerProfileParams{
+			PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+			LoadSequences: []*ImageLoadEvent{
+				{
+					Image: FileImage(filepath.Join("testdata", runtime.GOARCH, "mockshim_sbat.efi.signed.1.1.1")),
+					Next: []*ImageLoadEvent{
+						{
+							Image: FileImage(filepath.Join("testdata", runtime.GOARCH, "mockgrub1.efi.signed.shim.1")),
+							Next: []*ImageLoadEvent{
+								{Image: kernels[0]},
+								{Image: kernels[1]},
+							},
+						},
+					},
+				},
+			},
+		},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					4: testutil.DecodeHexString(c, "2f64bfe7796724c68c54b14bc8690012f9e29c907dc900831dd12f912f20b2b3"),
+				},
+			},
+			{
+				tpm2.HashAlgorithmSHA256: {
+					4: testutil.DecodeHexString(c, "27c1fcc75127e47454e4b7d2de4d31796d1300ce67c7ea39a4459d64412e0347"),
+				},
+			},
+		},
+	})
+}
+
+// sameNameImage is an Image with a string representation that is not unique.
+type sameNameImage struct {
+	Image
+}
+
+func (sameNameImage) String() string {
+	return "kernel"
+}
+
+func (s *bootManagerPolicySuite) TestAddBootManagerProfileWithNonUniqueImageNames(c *C) {
+	// Test that distinct images with the same string representation are not confused.
+	var kernels []Image
+	for _, name := range []string{"mockkernel1.efi.signed.shim.1", "mockkernel2.efi.signed.shim.1"} {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", runtime.GOARCH, name))
+		c.Assert(err, IsNil)
+		kernels = append(kernels, sameNameImage{ReaderImage(bytes.NewReader(data), int64(len(data)))})
+	}
+
+	s.testAddBootManagerProfile(c, &testAddBootManagerProfileData{
+		eventLogPath: "testdata/eventlog_sb.bin",
+		params: &BootManagerProfileParams{
+			PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+			LoadSequences: []*ImageLoadEvent{
+				{
+					Image: FileImage(filepath.Join("testdata", runtime.GOARCH, "mockshim_sbat.efi.signed.1.1.1")),
+					Next: []*ImageLoadEvent{
+						{
+							Image: FileImage(filepath.Join("testdata", runtime.GOARCH, "mockgrub1.efi.signed.shim.1")),
+							Next: []*ImageLoadEvent{
+								{Image: kernels[0]},
+								{Image: kernels[1]},
+							},
+						},
+					},
+				},
+			},
+		},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					4: testutil.DecodeHexString(c, "2f64bfe7796724c68c54b14bc8690012f9e29c907dc900831dd12f912f20b2b3"),
+				},
+			},
+			{
+				tpm2.HashAlgorithmSHA256: {
+					4: testutil.DecodeHexString(c, "27c1fcc75127e47454e4b7d2de4d31796d1300ce67c7ea39a4459d64412e0347"),
+				},
+			},
+		},
+	})
+}
@@ -0,0 +1,473 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// expandGrubVariable expands the variable reference at the start of s, which begins with '$'. It
+// returns the value of the variable and the number of bytes consumed from s.
+func expandGrubVariable(s string, env map[string]string) (string, int) {
+	if len(s) > 1 && s[1] == '{' {
+		end := strings.IndexByte(s, '}')
+		if end < 0 {
+			return "$", 1
+		}
+		return env[s[2:end]], end + 1
+	}
+
+	n := 1
+	for n < len(s) {
+		c := s[n]
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')) {
+			break
+		}
+		n++
+	}
+	if n == 1 {
+		return "$", 1
+	}
+	return env[s[1:n]], n
+}
+
+// splitGrubWords splits the supplied line from a GRUB script in to words, handling quoting and
+// expanding variable references using the supplied environment. Like GRUB, unquoted variable
+// expansions are subject to field splitting. Unquoted semicolons are returned as separate words.
+func splitGrubWords(line string, env map[string]string) ([]string, error) {
+	var words []string
+	var cur strings.Builder
+	inWord := false
+
+	flush := func() {
+		if inWord {
+			words = append(words, cur.String())
+			cur.Reset()
+			inWord = false
+		}
+	}
+
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t':
+			flush()
+			i++
+		case c == ';':
+			flush()
+			words = append(words, ";")
+			i++
+		case c == '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated single quote")
+			}
+			cur.WriteString(line[i+1 : i+1+end])
+			inWord = true
+			i += end + 2
+		case c == '"':
+			inWord = true
+			i++
+			for ; i < len(line) && line[i] != '"'; i++ {
+				switch line[i] {
+				case '\\':
+					if i+1 < len(line) {
+						i++
+						cur.WriteByte(line[i])
+					}
+				case '$':
+					v, n := expandGrubVariable(line[i:], env)
+					cur.WriteString(v)
+					i += n - 1
+				default:
+					cur.WriteByte(line[i])
+				}
+			}
+			if i >= len(line) {
+				return nil, errors.New("unterminated double quote")
+			}
+			i++
+		case c == '\\':
+			if i+1 < len(line) {
+				cur.WriteByte(line[i+1])
+				inWord = true
+			}
+			i += 2
+		case c == '$':
+			v, n := expandGrubVariable(line[i:], env)
+			i += n
+			fields := strings.Fields(v)
+			if len(fields) == 0 {
+				continue
+			}
+			if strings.TrimLeft(v, " \t") != v {
+				flush()
+			}
+			for j, f := range fields {
+				if j > 0 {
+					flush()
+				}
+				cur.WriteString(f)
+				inWord = true
+			}
+			if strings.TrimRight(v, " \t") != v {
+				flush()
+			}
+		default:
+			cur.WriteByte(c)
+			inWord = true
+			i++
+		}
+	}
+	flush()
+
+	return words, nil
+}
+
+// grubCondition is a tri-state result of evaluating a condition in a GRUB script, for
+// which the result may be unknown.
+type grubCondition int
+
+const (
+	grubConditionFalse grubCondition = iota
+	grubConditionTrue
+	grubConditionUnknown
+)
+
+func (c grubCondition) or(other grubCondition) grubCondition {
+	switch {
+	case c == grubConditionTrue || other == grubConditionTrue:
+		return grubConditionTrue
+	case c == grubConditionFalse && other == grubConditionFalse:
+		return grubConditionFalse
+	default:
+		return grubConditionUnknown
+	}
+}
+
+func (c grubCondition) not() grubCondition {
+	switch c {
+	case grubConditionTrue:
+		return grubConditionFalse
+	case grubConditionFalse:
+		return grubConditionTrue
+	default:
+		return grubConditionUnknown
+	}
+}
+
+func makeGrubCondition(b bool) grubCondition {
+	if b {
+		return grubConditionTrue
+	}
+	return grubConditionFalse
+}
+
+// evalGrubCondition evaluates the supplied condition from an if or elif statement. Only simple
+// string tests are supported, and the result of any other condition is unknown.
+func evalGrubCondition(words []string) grubCondition {
+	if len(words) < 2 || words[0] != "[" || words[len(words)-1] != "]" {
+		return grubConditionUnknown
+	}
+	words = words[1 : len(words)-1]
+
+	switch {
+	case len(words) == 2 && words[0] == "-n":
+		return makeGrubCondition(words[1] != "")
+	case len(words) == 2 && words[0] == "-z":
+		return makeGrubCondition(words[1] == "")
+	case len(words) == 3 && (words[1] == "=" || words[1] == "=="):
+		return makeGrubCondition(words[0] == words[2])
+	case len(words) == 3 && words[1] == "!=":
+		return makeGrubCondition(words[0] != words[2])
+	default:
+		return grubConditionUnknown
+	}
+}
+
+// grubConditionalBlock tracks the state of an if statement in a GRUB script.
+type grubConditionalBlock struct {
+	active grubCondition // Whether the current branch is executed
+	taken  grubCondition // Whether any previous branch was executed
+}
+
+// readGrubCfgKernelCmdlines evaluates the supplied GRUB configuration file with the supplied
+// variables and returns the kernel commandlines passed by each linux, linuxefi or chainloader
+// command. Simple string tests in if statements are evaluated, but commands in branches where
+// the condition can't be evaluated are included. Variables supplied by the caller take precedence
+// over assignments in the file.
+func readGrubCfgKernelCmdlines(path string, vars map[string]string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	env := make(map[string]string)
+	for k, v := range vars {
+		env[k] = v
+	}
+
+	var cmdlines []string
+	var blocks []*grubConditionalBlock
+
+	enabled := func() bool {
+		for _, b := range blocks {
+			if b.active == grubConditionFalse {
+				return false
+			}
+		}
+		return true
+	}
+
+	var runStatement func(words []string) error
+	runStatement = func(words []string) error {
+		for len(words) > 0 && (words[0] == "then" || words[0] == "do") {
+			words = words[1:]
+		}
+		if len(words) == 0 {
+			return nil
+		}
+
+		switch words[0] {
+		case "if":
+			c := evalGrubCondition(words[1:])
+			blocks = append(blocks, &grubConditionalBlock{active: c, taken: c})
+		case "elif":
+			if len(blocks) == 0 {
+				return errors.New("elif without if")
+			}
+			b := blocks[len(blocks)-1]
+			c := evalGrubCondition(words[1:])
+			switch b.taken {
+			case grubConditionTrue:
+				b.active = grubConditionFalse
+			case grubConditionFalse:
+				b.active = c
+			default:
+				if c != grubConditionFalse {
+					c = grubConditionUnknown
+				}
+				b.active = c
+			}
+			b.taken = b.taken.or(c)
+		case "else":
+			if len(blocks) == 0 {
+				return errors.New("else without if")
+			}
+			b := blocks[len(blocks)-1]
+			b.active = b.taken.not()
+			b.taken = grubConditionTrue
+			if len(words) > 1 {
+				return runStatement(words[1:])
+			}
+		case "fi":
+			if len(blocks) == 0 {
+				return errors.New("fi without if")
+			}
+			blocks = blocks[:len(blocks)-1]
+		case "set":
+			if !enabled() {
+				break
+			}
+			for _, w := range words[1:] {
+				kv := strings.SplitN(w, "=", 2)
+				if len(kv) != 2 {
+					continue
+				}
+				if _, ok := vars[kv[0]]; ok {
+					continue
+				}
+				env[kv[0]] = kv[1]
+			}
+		case "linux", "linuxefi", "chainloader":
+			if !enabled() {
+				break
+			}
+			args := words[1:]
+			for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+				args = args[1:]
+			}
+			if len(args) == 0 {
+				break
+			}
+			// The first argument is the path of the image, which isn't
+			// part of the commandline.
+			cmdlines = append(cmdlines, strings.Join(args[1:], " "))
+		}
+		return nil
+	}
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		words, err := splitGrubWords(line, env)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot parse line %d: %w", n, err)
+		}
+
+		for len(words) > 0 {
+			i := 0
+			for i < len(words) && words[i] != ";" {
+				i++
+			}
+			if err := runStatement(words[:i]); err != nil {
+				return nil, xerrors.Errorf("cannot parse line %d: %w", n, err)
+			}
+			if i < len(words) {
+				i++
+			}
+			words = words[i:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return cmdlines, nil
+}
+
+// readLoaderEntryKernelCmdline returns the kernel commandline from the supplied boot loader
+// specification entry, which is the concatenation of its options lines.
+func readLoaderEntryKernelCmdline(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var options []string
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] != "options" {
+			continue
+		}
+		options = append(options, fields[1:]...)
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return strings.Join(options, " "), nil
+}
+
+// expandGrubVariableCombinations returns every combination of the supplied variable values.
+func expandGrubVariableCombinations(vars map[string][]string) []map[string]string {
+	var names []string
+	for k := range vars {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	combinations := []map[string]string{make(map[string]string)}
+	for _, name := range names {
+		values := vars[name]
+		if len(values) == 0 {
+			continue
+		}
+		var next []map[string]string
+		for _, c := range combinations {
+			for _, v := range values {
+				n := make(map[string]string)
+				for k, x := range c {
+					n[k] = x
+				}
+				n[name] = v
+				next = append(next, n)
+			}
+		}
+		combinations = next
+	}
+
+	return combinations
+}
+
+// ReadKernelCmdlinesFromBootAssets returns the candidate kernel commandlines from the boot assets in the
+// supplied directory, for use with AddSystemdStubProfile. These are obtained from every grub.cfg in the
+// root of the directory or in any directory under EFI/, and from any boot loader specification entries
+// in loader/entries/.
+//
+// Commandlines in GRUB configuration files are computed by expanding variables, and every linux,
+// linuxefi or chainloader command is treated as a candidate unless it is in a branch of an if
+// statement with a simple string test that evaluates to false.
+// Values for variables that aren't set by the configuration itself, such as snapd_recovery_mode,
+// snapd_recovery_system or snapd_extra_cmdline_args, should be supplied via vars. Each variable may
+// have more than one value, in which case candidates are returned for each combination of values.
+// Duplicates are omitted.
+func ReadKernelCmdlinesFromBootAssets(dir string, vars map[string][]string) ([]string, error) {
+	var grubCfgs []string
+	for _, pattern := range []string{"grub.cfg", "EFI/*/grub.cfg"} {
+		m, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		grubCfgs = append(grubCfgs, m...)
+	}
+
+	entries, err := filepath.Glob(filepath.Join(dir, "loader/entries/*.conf"))
+	if err != nil {
+		return nil, err
+	}
+
+	var cmdlines []string
+	seen := make(map[string]bool)
+	add := func(cmdline string) {
+		if seen[cmdline] {
+			return
+		}
+		seen[cmdline] = true
+		cmdlines = append(cmdlines, cmdline)
+	}
+
+	for _, path := range grubCfgs {
+		for _, env := range expandGrubVariableCombinations(vars) {
+			c, err := readGrubCfgKernelCmdlines(path, env)
+			if err != nil {
+				return nil, xerrors.Errorf("cannot read %s: %w", path, err)
+			}
+			for _, cmdline := range c {
+				add(cmdline)
+			}
+		}
+	}
+
+	for _, path := range entries {
+		cmdline, err := readLoaderEntryKernelCmdline(path)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read %s: %w", path, err)
+		}
+		add(cmdline)
+	}
+
+	return cmdlines, nil
+}
@@ -0,0 +1,120 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/efi"
+)
+
+type cmdlineSuite struct{}
+
+var _ = Suite(&cmdlineSuite{})
+
+const testUC20GrubCfg = `# Mock UC20 grub.cfg
+set default=0
+set timeout=3
+
+set snapd_static_cmdline_args='console=ttyS0 console=tty1 panic=-1 systemd.gpt_auto=0'
+set cmdline_args="$snapd_static_cmdline_args $snapd_extra_cmdline_args"
+if [ -n "$snapd_full_cmdline_args" ]; then
+    set cmdline_args="$snapd_full_cmdline_args"
+fi
+
+menuentry "Run Ubuntu Core 20" {
+    chainloader "${prefix}/kernel.efi" $cmdline_args snapd_recovery_mode=$snapd_recovery_mode
+}
+`
+
+func writeBootAssetFile(c *C, path, content string) {
+	c.Assert(os.MkdirAll(filepath.Dir(path), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path, []byte(content), 0644), IsNil)
+}
+
+func (s *cmdlineSuite) TestReadKernelCmdlinesFromBootAssetsGrub(c *C) {
+	dir := c.MkDir()
+	writeBootAssetFile(c, filepath.Join(dir, "EFI/ubuntu/grub.cfg"), testUC20GrubCfg)
+
+	cmdlines, err := ReadKernelCmdlinesFromBootAssets(dir, map[string][]string{"snapd_recovery_mode": {"run", "recover"}})
+	c.Check(err, IsNil)
+	c.Check(cmdlines, DeepEquals, []string{
+		"console=ttyS0 console=tty1 panic=-1 systemd.gpt_auto=0 snapd_recovery_mode=run",
+		"console=ttyS0 console=tty1 panic=-1 systemd.gpt_auto=0 snapd_recovery_mode=recover",
+	})
+}
+
+func (s *cmdlineSuite) TestReadKernelCmdlinesFromBootAssetsGrubFullCmdline(c *C) {
+	dir := c.MkDir()
+	writeBootAssetFile(c, filepath.Join(dir, "grub.cfg"), testUC20GrubCfg)
+
+	cmdlines, err := ReadKernelCmdlinesFromBootAssets(dir, map[string][]string{
+		"snapd_recovery_mode":     {"run"},
+		"snapd_full_cmdline_args": {"", "console=ttyS0 quiet"}})
+	c.Check(err, IsNil)
+	c.Check(cmdlines, DeepEquals, []string{
+		"console=ttyS0 console=tty1 panic=-1 systemd.gpt_auto=0 snapd_recovery_mode=run",
+		"console=ttyS0 quiet snapd_recovery_mode=run",
+	})
+}
+
+func (s *cmdlineSuite) TestReadKernelCmdlinesFromBootAssetsConditionals(c *C) {
+	dir := c.MkDir()
+	writeBootAssetFile(c, filepath.Join(dir, "grub.cfg"), `set a=1
+if [ "$a" = 1 ]; then linux /vmlinuz one; elif [ -n "$b" ]; then linux /vmlinuz two; else linux /vmlinuz three; fi
+if [ -z "$a" ]; then
+    linux /vmlinuz four
+elif [ "$a" != 2 ]; then
+    linux /vmlinuz five
+else
+    linux /vmlinuz six
+fi
+if foo; then linux /vmlinuz seven; else linux /vmlinuz eight; fi
+`)
+
+	cmdlines, err := ReadKernelCmdlinesFromBootAssets(dir, nil)
+	c.Check(err, IsNil)
+	c.Check(cmdlines, DeepEquals, []string{"one", "five", "seven", "eight"})
+}
+
+func (s *cmdlineSuite) TestReadKernelCmdlinesFromBootAssetsLoaderEntries(c *C) {
+	dir := c.MkDir()
+	writeBootAssetFile(c, filepath.Join(dir, "loader/entries/ubuntu.conf"), `title Ubuntu
+linux /vmlinuz
+options root=/dev/sda1 ro
+options quiet
+`)
+
+	cmdlines, err := ReadKernelCmdlinesFromBootAssets(dir, nil)
+	c.Check(err, IsNil)
+	c.Check(cmdlines, DeepEquals, []string{"root=/dev/sda1 ro quiet"})
+}
+
+func (s *cmdlineSuite) TestReadKernelCmdlinesFromBootAssetsInvalid(c *C) {
+	dir := c.MkDir()
+	writeBootAssetFile(c, filepath.Join(dir, "grub.cfg"), "set a=1\nlinux /vmlinuz 'foo\n")
+
+	_, err := ReadKernelCmdlinesFromBootAssets(dir, nil)
+	c.Check(err, ErrorMatches, `cannot read .*/grub.cfg: cannot parse line 2: unterminated single quote`)
+}
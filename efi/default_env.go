@@ -45,3 +45,69 @@ func (e defaultEnvImpl) ReadEventLog() (*tcglog.Log, error) {
 }
 
 var defaultEnv = defaultEnvImpl{}
+
+// DefaultEnvironment returns the HostEnvironment for the current host. EFI variables are read
+// from efivarfs and the TCG event log is read from
+// /sys/kernel/security/tpm0/binary_bios_measurements. This is the environment that is used by
+// functions in this package when one isn't supplied.
+func DefaultEnvironment() HostEnvironment {
+	return defaultEnv
+}
+
+// VariableOverride corresponds to an EFI variable that is overridden by an OverridingEnvironment.
+type VariableOverride struct {
+	Name  string
+	GUID  efi.GUID
+	Attrs efi.VariableAttributes
+
+	// Data is the value of the variable. If this is nil, the variable
+	// will appear to not exist.
+	Data []byte
+}
+
+// OverridingEnvironment is a HostEnvironment that returns the supplied EFI variables and
+// TCG event log, and delegates everything else to another HostEnvironment. This can be
+// used to compute PCR profiles for a configuration that differs from the current one, such
+// as after the contents of a variable have been changed.
+type OverridingEnvironment struct {
+	// Env is the environment to which everything that isn't overridden is
+	// delegated. If not set, the default environment is used.
+	Env HostEnvironment
+
+	// Vars is a list of EFI variables that should be returned in place of
+	// the ones from Env.
+	Vars []*VariableOverride
+
+	// EventLog is the TCG event log that should be returned in place of the
+	// one from Env. If not set, the log from Env is returned.
+	EventLog *tcglog.Log
+}
+
+func (e *OverridingEnvironment) env() HostEnvironment {
+	if e.Env == nil {
+		return defaultEnv
+	}
+	return e.Env
+}
+
+// ReadVar implements HostEnvironment.ReadVar.
+func (e *OverridingEnvironment) ReadVar(name string, guid efi.GUID) ([]byte, efi.VariableAttributes, error) {
+	for _, v := range e.Vars {
+		if v.Name != name || v.GUID != guid {
+			continue
+		}
+		if v.Data == nil {
+			return nil, 0, efi.ErrVariableNotFound
+		}
+		return v.Data, v.Attrs, nil
+	}
+	return e.env().ReadVar(name, guid)
+}
+
+// ReadEventLog implements HostEnvironment.ReadEventLog.
+func (e *OverridingEnvironment) ReadEventLog() (*tcglog.Log, error) {
+	if e.EventLog != nil {
+		return e.EventLog, nil
+	}
+	return e.env().ReadEventLog()
+}
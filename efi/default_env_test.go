@@ -95,3 +95,62 @@ func (s *defaultEnvSuite) TestReadEventLog1(c *C) {
 func (s *defaultEnvSuite) TestReadEventLog2(c *C) {
 	s.testReadEventLog(c, "testdata/eventlog_no_sb.bin")
 }
+
+func (s *defaultEnvSuite) TestDefaultEnvironment(c *C) {
+	c.Check(DefaultEnvironment(), Equals, DefaultEnv)
+}
+
+func (s *defaultEnvSuite) TestOverridingEnvironmentReadVar(c *C) {
+	env := &OverridingEnvironment{
+		Env: &mockEFIEnvironment{efivars: "testdata/efivars_ms"},
+		Vars: []*VariableOverride{
+			{Name: "db", GUID: efi.ImageSecurityDatabaseGuid, Attrs: efi.AttributeBootserviceAccess, Data: []byte("foo")},
+			{Name: "PK", GUID: efi.GlobalVariable}}}
+
+	data, attrs, err := env.ReadVar("db", efi.ImageSecurityDatabaseGuid)
+	c.Check(err, IsNil)
+	c.Check(attrs, Equals, efi.AttributeBootserviceAccess)
+	c.Check(data, DeepEquals, []byte("foo"))
+
+	_, _, err = env.ReadVar("PK", efi.GlobalVariable)
+	c.Check(err, Equals, efi.ErrVariableNotFound)
+
+	data, attrs, err = env.ReadVar("dbx", efi.ImageSecurityDatabaseGuid)
+	c.Check(err, IsNil)
+	expectedData, expectedAttrs, err := testutil.EFIReadVar("testdata/efivars_ms", "dbx", efi.ImageSecurityDatabaseGuid)
+	c.Check(err, IsNil)
+	c.Check(attrs, Equals, expectedAttrs)
+	c.Check(data, DeepEquals, expectedData)
+}
+
+func (s *defaultEnvSuite) TestOverridingEnvironmentReadVarDefault(c *C) {
+	restore := MockReadVar("testdata/efivars_ms")
+	defer restore()
+
+	env := &OverridingEnvironment{}
+	data, attrs, err := env.ReadVar("SecureBoot", efi.GlobalVariable)
+	c.Check(err, IsNil)
+
+	expectedData, expectedAttrs, err := testutil.EFIReadVar("testdata/efivars_ms", "SecureBoot", efi.GlobalVariable)
+	c.Check(err, IsNil)
+	c.Check(attrs, Equals, expectedAttrs)
+	c.Check(data, DeepEquals, expectedData)
+}
+
+func (s *defaultEnvSuite) TestOverridingEnvironmentReadEventLog(c *C) {
+	env := &OverridingEnvironment{Env: &mockEFIEnvironment{log: "testdata/eventlog_sb.bin"}}
+	log, err := env.ReadEventLog()
+	c.Assert(err, IsNil)
+
+	f, err := os.Open("testdata/eventlog_sb.bin")
+	c.Assert(err, IsNil)
+	defer f.Close()
+	expectedLog, err := tcglog.ReadLog(f, &tcglog.LogOptions{})
+	c.Assert(err, IsNil)
+	c.Check(log, DeepEquals, expectedLog)
+
+	env.EventLog = &tcglog.Log{}
+	log, err = env.ReadEventLog()
+	c.Check(err, IsNil)
+	c.Check(log, Equals, env.EventLog)
+}
@@ -0,0 +1,192 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/osutil/sys"
+
+	"golang.org/x/xerrors"
+)
+
+type fileImageDigestKey struct {
+	Path    string
+	ModTime int64
+	Size    int64
+	Alg     tpm2.HashAlgorithmId
+}
+
+type readerImageDigestKey struct {
+	image *readerImage
+	alg   tpm2.HashAlgorithmId
+}
+
+type persistedImageDigest struct {
+	fileImageDigestKey
+	Digest tpm2.Digest
+}
+
+// ImageDigestCache caches the Authenticode digests of images, so that they aren't recomputed
+// when the same image appears in more than one load sequence or when generating more than one
+// profile. It can be supplied to AddBootManagerProfile and AddBootManagerProfileFromEventLog.
+//
+// Digests of FileImage images are keyed by path, modification time and size, and can be
+// persisted with Save. Digests of images created with ReaderImage are keyed by the returned
+// Image and are only cached in memory. Digests of other images are not cached.
+//
+// ImageDigestCache is safe to use from multiple goroutines.
+type ImageDigestCache struct {
+	mu      sync.Mutex
+	files   map[fileImageDigestKey]tpm2.Digest
+	readers map[readerImageDigestKey]tpm2.Digest
+}
+
+// NewImageDigestCache returns a new empty ImageDigestCache.
+func NewImageDigestCache() *ImageDigestCache {
+	return &ImageDigestCache{
+		files:   make(map[fileImageDigestKey]tpm2.Digest),
+		readers: make(map[readerImageDigestKey]tpm2.Digest)}
+}
+
+// LoadImageDigestCache returns a ImageDigestCache populated with the digests previously saved
+// to the specified file with Save. If the file doesn't exist or its contents can't be decoded,
+// an empty cache is returned, as the digests can always be recomputed.
+func LoadImageDigestCache(path string) (*ImageDigestCache, error) {
+	c := NewImageDigestCache()
+
+	f, err := os.Open(path)
+	switch {
+	case os.IsNotExist(err):
+		return c, nil
+	case err != nil:
+		return nil, xerrors.Errorf("cannot open file: %w", err)
+	}
+	defer f.Close()
+
+	var entries []*persistedImageDigest
+	if err := json.NewDecoder(f).Decode(&entries); err != nil {
+		// A corrupt cache shouldn't prevent profiles from being generated.
+		return c, nil
+	}
+
+	for _, e := range entries {
+		c.files[e.fileImageDigestKey] = e.Digest
+	}
+	return c, nil
+}
+
+// Save persists the digests of FileImage images in this cache to the specified file, so that
+// they can be loaded with LoadImageDigestCache. The file is replaced atomically.
+func (c *ImageDigestCache) Save(path string) error {
+	c.mu.Lock()
+	var entries []*persistedImageDigest
+	for k, v := range c.files {
+		entries = append(entries, &persistedImageDigest{fileImageDigestKey: k, Digest: v})
+	}
+	c.mu.Unlock()
+
+	f, err := osutil.NewAtomicFile(path, 0644, 0, sys.UserID(osutil.NoChown), sys.GroupID(osutil.NoChown))
+	if err != nil {
+		return xerrors.Errorf("cannot create new atomic file: %w", err)
+	}
+	defer f.Cancel()
+
+	if err := json.NewEncoder(f).Encode(entries); err != nil {
+		return xerrors.Errorf("cannot encode cache: %w", err)
+	}
+
+	if err := f.Commit(); err != nil {
+		return xerrors.Errorf("cannot atomically replace file: %w", err)
+	}
+	return nil
+}
+
+func (c *ImageDigestCache) fileKey(alg tpm2.HashAlgorithmId, image FileImage) (*fileImageDigestKey, error) {
+	path, err := filepath.Abs(string(image))
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &fileImageDigestKey{Path: path, ModTime: fi.ModTime().UnixNano(), Size: fi.Size(), Alg: alg}, nil
+}
+
+// computePeImageDigest returns the Authenticode digest of the supplied image, using a cached
+// value if there is one. This can be called on a nil cache, in which case the digest is
+// always computed.
+func (c *ImageDigestCache) computePeImageDigest(alg tpm2.HashAlgorithmId, image Image) (tpm2.Digest, error) {
+	if c == nil {
+		return computePeImageDigest(alg, image)
+	}
+
+	var lookup func() (tpm2.Digest, bool)
+	var store func(tpm2.Digest)
+
+	switch i := image.(type) {
+	case FileImage:
+		key, err := c.fileKey(alg, i)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot open image: %w", err)
+		}
+		lookup = func() (tpm2.Digest, bool) {
+			d, ok := c.files[*key]
+			return d, ok
+		}
+		store = func(d tpm2.Digest) {
+			c.files[*key] = d
+		}
+	case *readerImage:
+		key := readerImageDigestKey{image: i, alg: alg}
+		lookup = func() (tpm2.Digest, bool) {
+			d, ok := c.readers[key]
+			return d, ok
+		}
+		store = func(d tpm2.Digest) {
+			c.readers[key] = d
+		}
+	default:
+		return computePeImageDigest(alg, image)
+	}
+
+	c.mu.Lock()
+	digest, ok := lookup()
+	c.mu.Unlock()
+	if ok {
+		return digest, nil
+	}
+
+	digest, err := computePeImageDigest(alg, image)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	store(digest)
+	c.mu.Unlock()
+	return digest, nil
+}
@@ -0,0 +1,155 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi_test
+
+import (
+	"bytes"
+	"crypto"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/canonical/go-efilib"
+	"github.com/canonical/go-tpm2"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/efi"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+type digestCacheSuite struct{}
+
+var _ = Suite(&digestCacheSuite{})
+
+func (s *digestCacheSuite) computeExpectedDigest(c *C, path string) tpm2.Digest {
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	digest, err := efi.ComputePeImageDigest(crypto.SHA256, bytes.NewReader(data), int64(len(data)))
+	c.Assert(err, IsNil)
+	return digest
+}
+
+func (s *digestCacheSuite) TestFileImage(c *C) {
+	path := filepath.Join(c.MkDir(), "kernel.efi")
+	c.Assert(testutil.CopyFile(path, filepath.Join("testdata", runtime.GOARCH, "mockkernel1.efi.signed.shim.1"), 0644), IsNil)
+	expected := s.computeExpectedDigest(c, path)
+
+	cache := NewImageDigestCache()
+	for i := 0; i < 2; i++ {
+		digest, err := cache.ComputePeImageDigest(tpm2.HashAlgorithmSHA256, FileImage(path))
+		c.Check(err, IsNil)
+		c.Check(digest, DeepEquals, expected)
+	}
+	c.Check(cache.NumEntries(), Equals, 1)
+
+	// Replacing the file should result in a new digest being computed.
+	c.Assert(testutil.CopyFile(path, filepath.Join("testdata", runtime.GOARCH, "mockkernel2.efi.signed.shim.1"), 0644), IsNil)
+	future := time.Now().Add(time.Minute)
+	c.Assert(os.Chtimes(path, future, future), IsNil)
+	expected = s.computeExpectedDigest(c, path)
+
+	digest, err := cache.ComputePeImageDigest(tpm2.HashAlgorithmSHA256, FileImage(path))
+	c.Check(err, IsNil)
+	c.Check(digest, DeepEquals, expected)
+	c.Check(cache.NumEntries(), Equals, 2)
+}
+
+func (s *digestCacheSuite) TestReaderImage(c *C) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", runtime.GOARCH, "mockkernel1.efi.signed.shim.1"))
+	c.Assert(err, IsNil)
+	expected := s.computeExpectedDigest(c, filepath.Join("testdata", runtime.GOARCH, "mockkernel1.efi.signed.shim.1"))
+
+	image := ReaderImage(bytes.NewReader(data), int64(len(data)))
+
+	cache := NewImageDigestCache()
+	digest, err := cache.ComputePeImageDigest(tpm2.HashAlgorithmSHA256, image)
+	c.Check(err, IsNil)
+	c.Check(digest, DeepEquals, expected)
+
+	// The digest is cached for the lifetime of the image, so modifying the underlying
+	// data isn't detected.
+	data[0] ^= 0xff
+	digest, err = cache.ComputePeImageDigest(tpm2.HashAlgorithmSHA256, image)
+	c.Check(err, IsNil)
+	c.Check(digest, DeepEquals, expected)
+	c.Check(cache.NumEntries(), Equals, 1)
+}
+
+func (s *digestCacheSuite) TestNilCache(c *C) {
+	path := filepath.Join("testdata", runtime.GOARCH, "mockkernel1.efi.signed.shim.1")
+
+	var cache *ImageDigestCache
+	digest, err := cache.ComputePeImageDigest(tpm2.HashAlgorithmSHA256, FileImage(path))
+	c.Check(err, IsNil)
+	c.Check(digest, DeepEquals, s.computeExpectedDigest(c, path))
+}
+
+func (s *digestCacheSuite) TestSaveAndLoad(c *C) {
+	dir := c.MkDir()
+	cachePath := filepath.Join(dir, "cache")
+
+	cache, err := LoadImageDigestCache(cachePath)
+	c.Assert(err, IsNil)
+	c.Check(cache.NumEntries(), Equals, 0)
+
+	data, err := ioutil.ReadFile(filepath.Join("testdata", runtime.GOARCH, "mockkernel2.efi.signed.shim.1"))
+	c.Assert(err, IsNil)
+
+	path := filepath.Join("testdata", runtime.GOARCH, "mockkernel1.efi.signed.shim.1")
+	expected, err := cache.ComputePeImageDigest(tpm2.HashAlgorithmSHA256, FileImage(path))
+	c.Assert(err, IsNil)
+	_, err = cache.ComputePeImageDigest(tpm2.HashAlgorithmSHA256, ReaderImage(bytes.NewReader(data), int64(len(data))))
+	c.Assert(err, IsNil)
+	c.Check(cache.NumEntries(), Equals, 2)
+
+	c.Check(cache.Save(cachePath), IsNil)
+
+	// Only file images are persisted.
+	cache, err = LoadImageDigestCache(cachePath)
+	c.Assert(err, IsNil)
+	c.Check(cache.NumEntries(), Equals, 1)
+
+	digest, err := cache.ComputePeImageDigest(tpm2.HashAlgorithmSHA256, FileImage(path))
+	c.Check(err, IsNil)
+	c.Check(digest, DeepEquals, expected)
+	c.Check(cache.NumEntries(), Equals, 1)
+}
+
+func (s *digestCacheSuite) TestLoadCorrupt(c *C) {
+	cachePath := filepath.Join(c.MkDir(), "cache")
+	c.Assert(ioutil.WriteFile(cachePath, []byte("[{\"Path\":"), 0644), IsNil)
+
+	cache, err := LoadImageDigestCache(cachePath)
+	c.Assert(err, IsNil)
+	c.Check(cache.NumEntries(), Equals, 0)
+
+	// Saving should replace the corrupt file.
+	path := filepath.Join("testdata", runtime.GOARCH, "mockkernel1.efi.signed.shim.1")
+	_, err = cache.ComputePeImageDigest(tpm2.HashAlgorithmSHA256, FileImage(path))
+	c.Assert(err, IsNil)
+	c.Check(cache.Save(cachePath), IsNil)
+
+	cache, err = LoadImageDigestCache(cachePath)
+	c.Assert(err, IsNil)
+	c.Check(cache.NumEntries(), Equals, 1)
+}
@@ -31,8 +31,6 @@ import (
 
 const (
 	bootManagerCodePCR = 4 // Boot Manager Code and Boot Attempts PCR
-
-	certTableIndex = 4 // Index of the Certificate Table entry in the Data Directory of a PE image optional header
 )
 
 var (
@@ -109,6 +107,44 @@ func (p FileImage) Open() (interface {
 	return &fileImageHandle{File: f, size: fi.Size()}, nil
 }
 
+type readerImageHandle struct {
+	io.ReaderAt
+	size int64
+}
+
+func (h *readerImageHandle) Close() error {
+	return nil
+}
+
+func (h *readerImageHandle) Size() int64 {
+	return h.size
+}
+
+type readerImage struct {
+	r    io.ReaderAt
+	size int64
+}
+
+func (i *readerImage) String() string {
+	return fmt.Sprintf("reader image %p", i)
+}
+
+func (i *readerImage) Open() (interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+}, error) {
+	return &readerImageHandle{ReaderAt: i.r, size: i.size}, nil
+}
+
+// ReaderImage returns an Image that is read from the supplied io.ReaderAt, which can be used
+// for binaries that are already in memory or that are read from some other source. The size
+// argument is the size of the binary in bytes. Closing a handle returned from the Open method
+// of the returned Image does not close r.
+func ReaderImage(r io.ReaderAt, size int64) Image {
+	return &readerImage{r: r, size: size}
+}
+
 // ImageLoadEventSource corresponds to the source of a ImageLoadEvent.
 type ImageLoadEventSource int
 
@@ -120,7 +156,9 @@ const (
 
 	// Shim indicates that the source of a ImageLoadEvent was shim, without relying on EFI boot services for loading, verifying
 	// and executing the subsequently executed image. The image is verified by shim against the signatures in the EFI authorized
-	// signature database, the MOK database or shim's built-in vendor certificate before being executed directly.
+	// signature database, the MOK database or shim's built-in vendor certificate before being executed directly. This is also
+	// used for images loaded by other bootloaders that verify images themselves, if they are supported by an ImageLoadHandler
+	// that provides a verification database (see RegisterImageLoadHandler).
 	Shim
 )
 
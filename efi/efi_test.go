@@ -20,6 +20,8 @@
 package efi_test
 
 import (
+	"flag"
+	"fmt"
 	"os"
 	"testing"
 
@@ -32,6 +34,22 @@ import (
 
 func Test(t *testing.T) { TestingT(t) }
 
+func TestMain(m *testing.M) {
+	flag.Parse()
+	os.Exit(func() int {
+		if testutil.UseMssim {
+			simulatorCleanup, err := testutil.LaunchTPMSimulator(nil)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Cannot launch TPM simulator: %v\n", err)
+				return 1
+			}
+			defer simulatorCleanup()
+		}
+
+		return m.Run()
+	}())
+}
+
 type mockEFIEnvironment struct {
 	efivars string
 	log     string
@@ -0,0 +1,164 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/tcglog-parser"
+
+	"golang.org/x/xerrors"
+
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+// PCRInconsistency describes a PCR for which the value computed by replaying the TCG event log
+// doesn't match the value read from the TPM.
+type PCRInconsistency struct {
+	PCR       int
+	Algorithm tpm2.HashAlgorithmId
+
+	Expected tpm2.Digest // The value computed by replaying the TCG event log
+	Actual   tpm2.Digest // The value read from the TPM
+
+	// DivergentEvent is the index in the TCG event log of the first event for this
+	// PCR that doesn't appear to have been measured, if the value read from the TPM
+	// corresponds to a partial replay of the log. It is -1 if the value read from the
+	// TPM can't be produced from the log at all, which is the case when a measurement
+	// was made without being recorded in the log.
+	DivergentEvent int
+}
+
+func (i *PCRInconsistency) String() string {
+	s := fmt.Sprintf("PCR %d, bank %v: log value %x, TPM value %x", i.PCR, i.Algorithm, i.Expected, i.Actual)
+	if i.DivergentEvent < 0 {
+		return s + " (TPM value cannot be produced from log)"
+	}
+	return s + fmt.Sprintf(" (log diverges at event %d)", i.DivergentEvent)
+}
+
+// EventLogConsistencyReport is returned from CheckEventLogConsistency.
+type EventLogConsistencyReport struct {
+	// Inconsistencies contains an entry for each combination of PCR and
+	// PCR bank for which the TCG event log is inconsistent with the TPM.
+	Inconsistencies []*PCRInconsistency
+}
+
+// Consistent indicates whether the TCG event log is consistent with the TPM.
+func (r *EventLogConsistencyReport) Consistent() bool {
+	return len(r.Inconsistencies) == 0
+}
+
+// CheckEventLogConsistency replays the TCG event log obtained from the supplied environment and
+// compares the computed PCR values with the current values read from the TPM. If env is nil, the
+// host's normal environment is used. This is useful for diagnosing why a key sealed with a PCR
+// profile generated from the event log can no longer be unsealed.
+//
+// PCRs 0-7 are always checked, as are any of PCRs 8-15 that have events recorded in the log. Each
+// PCR bank that the log contains digests for is checked, with the exception of banks that aren't
+// enabled on the TPM. Note that measurements made after ExitBootServices, such as those made by
+// the OS, are not recorded in the TCG event log and so will result in an inconsistency being
+// reported for the affected PCR.
+func CheckEventLogConsistency(env HostEnvironment, tpm *secboot_tpm2.Connection) (*EventLogConsistencyReport, error) {
+	if tpm == nil {
+		return nil, errors.New("no TPM connection")
+	}
+	if env == nil {
+		env = defaultEnv
+	}
+
+	log, err := env.ReadEventLog()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot parse TCG event log: %w", err)
+	}
+
+	pcrs := map[int]bool{0: true, 1: true, 2: true, 3: true, 4: true, 5: true, 6: true, 7: true}
+	for _, event := range log.Events {
+		if event.PCRIndex < 16 {
+			pcrs[int(event.PCRIndex)] = true
+		}
+	}
+	var pcrList []int
+	for pcr := range pcrs {
+		pcrList = append(pcrList, pcr)
+	}
+	sort.Ints(pcrList)
+
+	var selection tpm2.PCRSelectionList
+	for _, alg := range log.Algorithms {
+		selection = append(selection, tpm2.PCRSelection{Hash: alg, Select: pcrList})
+	}
+
+	_, values, err := tpm.PCRRead(selection)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read PCR values: %w", err)
+	}
+
+	report := new(EventLogConsistencyReport)
+	for _, alg := range log.Algorithms {
+		for _, pcr := range pcrList {
+			actual, ok := values[alg][pcr]
+			if !ok {
+				// This PCR bank isn't enabled.
+				continue
+			}
+
+			// Replay the log, keeping the value after each event.
+			value := initialPCRValue(log, alg, pcr)
+			expected := []tpm2.Digest{value}
+			var indices []int
+			for i, event := range log.Events {
+				if int(event.PCRIndex) != pcr || event.EventType == tcglog.EventTypeNoAction {
+					continue
+				}
+				h := alg.NewHash()
+				h.Write(value)
+				h.Write(event.Digests[alg])
+				value = h.Sum(nil)
+				expected = append(expected, value)
+				indices = append(indices, i)
+			}
+
+			if bytes.Equal(value, actual) {
+				continue
+			}
+
+			inconsistency := &PCRInconsistency{
+				PCR:            pcr,
+				Algorithm:      alg,
+				Expected:       value,
+				Actual:         actual,
+				DivergentEvent: -1}
+			for i := len(expected) - 2; i >= 0; i-- {
+				if bytes.Equal(expected[i], actual) {
+					inconsistency.DivergentEvent = indices[i]
+					break
+				}
+			}
+			report.Inconsistencies = append(report.Inconsistencies, inconsistency)
+		}
+	}
+
+	return report, nil
+}
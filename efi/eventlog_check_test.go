@@ -0,0 +1,131 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi_test
+
+import (
+	"os"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/tcglog-parser"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/efi"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+type eventLogCheckSuite struct {
+	testutil.TPMSimulatorTestBase
+}
+
+var _ = Suite(&eventLogCheckSuite{})
+
+func (s *eventLogCheckSuite) SetUpTest(c *C) {
+	s.TPMSimulatorTestBase.SetUpTest(c)
+	// Make sure that the PCRs are in their initial state.
+	s.ResetTPMSimulator(c)
+}
+
+func (s *eventLogCheckSuite) readLog(c *C, path string) *tcglog.Log {
+	f, err := os.Open(path)
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	log, err := tcglog.ReadLog(f, &tcglog.LogOptions{})
+	c.Assert(err, IsNil)
+	return log
+}
+
+// replayLog extends the events in the supplied log to the TPM, omitting the event with the
+// specified index.
+func (s *eventLogCheckSuite) replayLog(c *C, log *tcglog.Log, omit int) {
+	for i, event := range log.Events {
+		if i == omit || event.PCRIndex >= 16 || event.EventType == tcglog.EventTypeNoAction {
+			continue
+		}
+		var digests tpm2.TaggedHashList
+		for _, alg := range log.Algorithms {
+			digests = append(digests, tpm2.TaggedHash{HashAlg: alg, Digest: tpm2.Digest(event.Digests[alg])})
+		}
+		c.Assert(s.TPM.PCRExtend(s.TPM.PCRHandleContext(int(event.PCRIndex)), digests, nil), IsNil)
+	}
+}
+
+func (s *eventLogCheckSuite) TestConsistent(c *C) {
+	log := s.readLog(c, "testdata/eventlog_sb.bin")
+	s.replayLog(c, log, -1)
+
+	report, err := CheckEventLogConsistency(&mockEFIEnvironment{log: "testdata/eventlog_sb.bin"}, s.TPM)
+	c.Assert(err, IsNil)
+	c.Check(report.Consistent(), testutil.IsTrue)
+	c.Check(report.Inconsistencies, HasLen, 0)
+}
+
+func (s *eventLogCheckSuite) TestMissingMeasurement(c *C) {
+	log := s.readLog(c, "testdata/eventlog_sb.bin")
+
+	// Omit the last event measured to PCR 7.
+	omit := -1
+	for i, event := range log.Events {
+		if event.PCRIndex == 7 {
+			omit = i
+		}
+	}
+	c.Assert(omit, Not(Equals), -1)
+	s.replayLog(c, log, omit)
+
+	report, err := CheckEventLogConsistency(&mockEFIEnvironment{log: "testdata/eventlog_sb.bin"}, s.TPM)
+	c.Assert(err, IsNil)
+	c.Check(report.Consistent(), Equals, false)
+	c.Assert(report.Inconsistencies, HasLen, 2)
+	for i, alg := range []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA1, tpm2.HashAlgorithmSHA256} {
+		_, values, err := s.TPM.PCRRead(tpm2.PCRSelectionList{{Hash: alg, Select: []int{7}}})
+		c.Assert(err, IsNil)
+
+		inconsistency := report.Inconsistencies[i]
+		c.Check(inconsistency.PCR, Equals, 7)
+		c.Check(inconsistency.Algorithm, Equals, alg)
+		c.Check(inconsistency.Actual, DeepEquals, values[alg][7])
+		c.Check(inconsistency.Expected, Not(DeepEquals), values[alg][7])
+		c.Check(inconsistency.DivergentEvent, Equals, omit)
+	}
+}
+
+func (s *eventLogCheckSuite) TestUnloggedMeasurement(c *C) {
+	log := s.readLog(c, "testdata/eventlog_sb.bin")
+	s.replayLog(c, log, -1)
+
+	_, err := s.TPM.PCREvent(s.TPM.PCRHandleContext(4), []byte("foo"), nil)
+	c.Check(err, IsNil)
+
+	report, err := CheckEventLogConsistency(&mockEFIEnvironment{log: "testdata/eventlog_sb.bin"}, s.TPM)
+	c.Assert(err, IsNil)
+	c.Check(report.Consistent(), Equals, false)
+	c.Assert(report.Inconsistencies, HasLen, 2)
+	for _, inconsistency := range report.Inconsistencies {
+		c.Check(inconsistency.PCR, Equals, 4)
+		c.Check(inconsistency.DivergentEvent, Equals, -1)
+	}
+}
+
+func (s *eventLogCheckSuite) TestNoTPM(c *C) {
+	_, err := CheckEventLogConsistency(&mockEFIEnvironment{log: "testdata/eventlog_sb.bin"}, nil)
+	c.Check(err, ErrorMatches, "no TPM connection")
+}
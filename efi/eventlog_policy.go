@@ -0,0 +1,242 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/tcglog-parser"
+
+	"golang.org/x/xerrors"
+
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+// ImageSubstitution describes an image that was measured during the current boot and
+// the images that may be measured in its place on subsequent boots.
+type ImageSubstitution struct {
+	// Current is the image that was measured during the current boot.
+	Current Image
+
+	// Replacements is the list of images that may be measured in place of Current.
+	// A branch is generated for each of these. If Current should continue to be
+	// permitted, it must also be included in this list.
+	Replacements []Image
+}
+
+// EventLogProfileParams provide the arguments to AddBootManagerProfileFromEventLog and
+// AddSecureBootPolicyProfileFromEventLog.
+type EventLogProfileParams struct {
+	// PCRAlgorithm is the algorithm for which to compute PCR digests for. TPMs compliant with the "TCG PC Client Platform TPM Profile
+	// (PTP) Specification" Level 00, Revision 01.03 v22, May 22 2017 are required to support tpm2.HashAlgorithmSHA1 and
+	// tpm2.HashAlgorithmSHA256. Support for other digest algorithms is optional.
+	PCRAlgorithm tpm2.HashAlgorithmId
+
+	// Substitutions is a list of images measured during the current boot that will be
+	// replaced. This is only used by AddBootManagerProfileFromEventLog.
+	Substitutions []*ImageSubstitution
+
+	// Environment is an optional parameter that allows the caller to provide
+	// a custom EFI environment. If not set, the host's normal environment will
+	// be used
+	Environment HostEnvironment
+
+	// DigestCache is an optional cache of image digests. This is only used by
+	// AddBootManagerProfileFromEventLog.
+	DigestCache *ImageDigestCache
+}
+
+// initialPCRValue returns the value of the specified PCR after the TPM was started, before
+// any events were measured to it.
+func initialPCRValue(log *tcglog.Log, alg tpm2.HashAlgorithmId, pcr int) tpm2.Digest {
+	initial := make(tpm2.Digest, alg.Size())
+	for _, event := range log.Events {
+		if int(event.PCRIndex) != pcr || event.EventType != tcglog.EventTypeNoAction {
+			continue
+		}
+		// PCR 0 is initialized with the locality from which the
+		// TPM2_Startup command was issued.
+		if data, ok := event.Data.(*tcglog.StartupLocalityEventData); ok {
+			initial[alg.Size()-1] = data.StartupLocality
+		}
+	}
+	return initial
+}
+
+// eventLogSubstituteFn returns the digests that should be used in place of the digest
+// recorded for the supplied event. If it returns no digests, the recorded digest is used.
+type eventLogSubstituteFn func(event *tcglog.Event) tpm2.DigestList
+
+// addEventLogProfile adds a profile for the specified PCR to the supplied profile by
+// replaying the events recorded for it in the supplied log, calling subst for each event
+// in order to substitute the digests of components that will change. A branch is created
+// for each digest returned from subst. EV_NO_ACTION events aren't measured and are not
+// passed to subst.
+func addEventLogProfile(profile *secboot_tpm2.PCRProtectionProfile, log *tcglog.Log, alg tpm2.HashAlgorithmId, pcr int, subst eventLogSubstituteFn) {
+	profile.AddPCRValue(alg, pcr, initialPCRValue(log, alg, pcr))
+
+	root := &bootManagerCodePolicyGenBranch{profile: profile}
+	allBranches := []*bootManagerCodePolicyGenBranch{root}
+	leaves := []*bootManagerCodePolicyGenBranch{root}
+
+	for _, event := range log.Events {
+		if int(event.PCRIndex) != pcr || event.EventType == tcglog.EventTypeNoAction {
+			continue
+		}
+
+		digests := subst(event)
+		switch len(digests) {
+		case 0:
+			digests = tpm2.DigestList{tpm2.Digest(event.Digests[alg])}
+			fallthrough
+		case 1:
+			for _, l := range leaves {
+				l.profile.ExtendPCR(alg, pcr, digests[0])
+			}
+		default:
+			var newLeaves []*bootManagerCodePolicyGenBranch
+			for _, l := range leaves {
+				for _, d := range digests {
+					b := l.branch()
+					b.profile.ExtendPCR(alg, pcr, d)
+					newLeaves = append(newLeaves, b)
+					allBranches = append(allBranches, b)
+				}
+			}
+			leaves = newLeaves
+		}
+	}
+
+	for _, b := range allBranches {
+		if len(b.branches) == 0 {
+			continue
+		}
+		b.profile.AddProfileOR(b.branches...)
+	}
+}
+
+// AddBootManagerProfileFromEventLog adds the UEFI boot manager code and boot attempts profile to the provided PCR protection
+// profile, in order to generate a PCR policy that restricts access to a sealed key to the binaries that were measured to PCR 4
+// during the current boot. Rather than requiring the caller to supply every image in each load sequence as AddBootManagerProfile
+// does, this replays every event recorded to PCR 4 in the TCG event log and only substitutes the digests of the images that will
+// change, which are supplied via the Substitutions field of params. This includes any events that are specific to the platform
+// firmware, such as those measured by OEM applications.
+//
+// Each image supplied via the Current field of a substitution must have been measured to PCR 4 during the current boot, else
+// an error will be returned. A branch is generated for each replacement image, and these are combined with the branches for
+// any other substitutions.
+func AddBootManagerProfileFromEventLog(profile *secboot_tpm2.PCRProtectionProfile, params *EventLogProfileParams) error {
+	env := params.Environment
+	if env == nil {
+		env = defaultEnv
+	}
+
+	log, err := env.ReadEventLog()
+	if err != nil {
+		return xerrors.Errorf("cannot parse TCG event log: %w", err)
+	}
+
+	if !log.Algorithms.Contains(params.PCRAlgorithm) {
+		return errors.New("cannot compute boot manager code policy digests: the TCG event log does not have the requested algorithm")
+	}
+
+	type substitution struct {
+		image        Image
+		digest       tpm2.Digest
+		replacements tpm2.DigestList
+		found        bool
+	}
+
+	var substitutions []*substitution
+	for _, s := range params.Substitutions {
+		digest, err := params.DigestCache.computePeImageDigest(params.PCRAlgorithm, s.Current)
+		if err != nil {
+			return xerrors.Errorf("cannot compute digest of %s: %w", s.Current, err)
+		}
+
+		var replacements tpm2.DigestList
+		for _, r := range s.Replacements {
+			d, err := params.DigestCache.computePeImageDigest(params.PCRAlgorithm, r)
+			if err != nil {
+				return xerrors.Errorf("cannot compute digest of %s: %w", r, err)
+			}
+			replacements = append(replacements, d)
+		}
+		if len(replacements) == 0 {
+			return fmt.Errorf("no replacements for %s", s.Current)
+		}
+
+		substitutions = append(substitutions, &substitution{image: s.Current, digest: digest, replacements: replacements})
+	}
+
+	addEventLogProfile(profile, log, params.PCRAlgorithm, bootManagerCodePCR, func(event *tcglog.Event) tpm2.DigestList {
+		if event.EventType != tcglog.EventTypeEFIBootServicesApplication {
+			return nil
+		}
+		for _, s := range substitutions {
+			if bytes.Equal(s.digest, event.Digests[params.PCRAlgorithm]) {
+				s.found = true
+				return s.replacements
+			}
+		}
+		return nil
+	})
+
+	for _, s := range substitutions {
+		if !s.found {
+			return fmt.Errorf("%s was not measured during the current boot", s.image)
+		}
+	}
+
+	return nil
+}
+
+// AddSecureBootPolicyProfileFromEventLog adds the UEFI secure boot policy profile to the provided PCR protection profile, by
+// replaying every event recorded to PCR 7 in the TCG event log. This includes the secure boot configuration and the
+// authorities used to verify each image during the current boot, and any events that are specific to the platform firmware.
+//
+// The generated PCR policy is only valid as long as the secure boot configuration does not change and the same set of
+// authorities is used to verify images on subsequent boots, which is the case when replacement images supplied to
+// AddBootManagerProfileFromEventLog are signed by the same authorities as the images they replace. AddSecureBootPolicyProfile
+// should be used where this isn't the case. The Substitutions field of params is not used.
+func AddSecureBootPolicyProfileFromEventLog(profile *secboot_tpm2.PCRProtectionProfile, params *EventLogProfileParams) error {
+	env := params.Environment
+	if env == nil {
+		env = defaultEnv
+	}
+
+	log, err := env.ReadEventLog()
+	if err != nil {
+		return xerrors.Errorf("cannot parse TCG event log: %w", err)
+	}
+
+	if !log.Algorithms.Contains(params.PCRAlgorithm) {
+		return errors.New("cannot compute secure boot policy digests: the TCG event log does not have the requested algorithm")
+	}
+
+	addEventLogProfile(profile, log, params.PCRAlgorithm, secureBootPCR, func(*tcglog.Event) tpm2.DigestList {
+		return nil
+	})
+
+	return nil
+}
@@ -0,0 +1,258 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi_test
+
+import (
+	"path/filepath"
+	"runtime"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/tcglog-parser"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/efi"
+	"github.com/snapcore/secboot/internal/testutil"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+// mockEFIEnvironmentWithAppDigests replaces the SHA-256 digests of the
+// EV_EFI_BOOT_SERVICES_APPLICATION events measured to PCR 4 with the
+// supplied digests, so that the log appears to contain measurements of
+// the mock images in testdata.
+type mockEFIEnvironmentWithAppDigests struct {
+	mockEFIEnvironment
+	digests tpm2.DigestList
+}
+
+func (e *mockEFIEnvironmentWithAppDigests) ReadEventLog() (*tcglog.Log, error) {
+	log, err := e.mockEFIEnvironment.ReadEventLog()
+	if err != nil {
+		return nil, err
+	}
+
+	i := 0
+	for _, event := range log.Events {
+		if event.PCRIndex != 4 || event.EventType != tcglog.EventTypeEFIBootServicesApplication {
+			continue
+		}
+		copy(event.Digests[tpm2.HashAlgorithmSHA256], e.digests[i])
+		i++
+	}
+
+	return log, nil
+}
+
+type eventLogPolicySuite struct{}
+
+var _ = Suite(&eventLogPolicySuite{})
+
+type testEventLogProfileData struct {
+	pcr    int
+	fn     func(*secboot_tpm2.PCRProtectionProfile, *EventLogProfileParams) error
+	params *EventLogProfileParams
+	values []tpm2.PCRValues
+}
+
+func (s *eventLogPolicySuite) testEventLogProfile(c *C, data *testEventLogProfileData) {
+	if runtime.GOARCH != "amd64" {
+		c.Skip("unsupported architecture")
+	}
+
+	expectedPcrs := tpm2.PCRSelectionList{{Hash: data.params.PCRAlgorithm, Select: []int{data.pcr}}}
+	var expectedDigests tpm2.DigestList
+	for _, v := range data.values {
+		d, _ := tpm2.ComputePCRDigest(tpm2.HashAlgorithmSHA256, expectedPcrs, v)
+		expectedDigests = append(expectedDigests, d)
+	}
+
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	c.Assert(data.fn(profile, data.params), IsNil)
+	pcrs, digests, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	c.Assert(err, IsNil)
+	c.Check(pcrs.Equal(expectedPcrs), Equals, true)
+	c.Check(digests, DeepEquals, expectedDigests)
+	if c.Failed() {
+		c.Logf("Profile:\n%s", profile)
+		c.Logf("Values:\n%s", testutil.FormatPCRValuesFromPCRProtectionProfile(profile, nil))
+	}
+}
+
+func (s *eventLogPolicySuite) newMockEnvironmentWithMockImages(c *C) HostEnvironment {
+	return &mockEFIEnvironmentWithAppDigests{
+		mockEFIEnvironment: mockEFIEnvironment{"", "testdata/eventlog_sb.bin"},
+		digests: tpm2.DigestList{
+			// mockshim_sbat.efi.signed.1.1.1
+			testutil.DecodeHexString(c, "2d437a5ced101a7013d89abe2200513941455c1fae2340fb0eb95bf9308d689b"),
+			// mockgrub1.efi.signed.shim.1
+			testutil.DecodeHexString(c, "fe5bb3a8f714aa9719487988c9f1583f38225e9138eedeb28c3fc3cfa3e93675"),
+			// mockkernel1.efi.signed.shim.1
+			testutil.DecodeHexString(c, "274955b58d974ae1df86c5180377e6f66e16ae44b470b8a87dfb1660284c0e04")}}
+}
+
+func (s *eventLogPolicySuite) TestAddBootManagerProfileFromEventLogNoSubstitutions(c *C) {
+	// Without any substitutions, the profile should match the current boot.
+	s.testEventLogProfile(c, &testEventLogProfileData{
+		pcr: 4,
+		fn:  AddBootManagerProfileFromEventLog,
+		params: &EventLogProfileParams{
+			PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+			Environment:  &mockEFIEnvironment{"", "testdata/eventlog_sb.bin"}},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					4: testutil.DecodeHexString(c, "4bc74f3ffe49b4dd275c9f475887b68193e2db8348d72e1c3c9099c2dcfa85b0"),
+				},
+			},
+		},
+	})
+}
+
+func (s *eventLogPolicySuite) TestAddBootManagerProfileFromEventLogSubstituteKernel(c *C) {
+	// Test that substituting the kernel produces the same values as
+	// AddBootManagerProfile does for the full load sequence.
+	s.testEventLogProfile(c, &testEventLogProfileData{
+		pcr: 4,
+		fn:  AddBootManagerProfileFromEventLog,
+		params: &EventLogProfileParams{
+			PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+			Substitutions: []*ImageSubstitution{
+				{
+					Current: FileImage(filepath.Join("testdata", runtime.GOARCH, "mockkernel1.efi.signed.shim.1")),
+					Replacements: []Image{
+						FileImage(filepath.Join("testdata", runtime.GOARCH, "mockkernel1.efi.signed.shim.1")),
+						FileImage(filepath.Join("testdata", runtime.GOARCH, "mockkernel2.efi.signed.shim.1")),
+					},
+				},
+			},
+			Environment: s.newMockEnvironmentWithMockImages(c)},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					4: testutil.DecodeHexString(c, "2f64bfe7796724c68c54b14bc8690012f9e29c907dc900831dd12f912f20b2b3"),
+				},
+			},
+			{
+				tpm2.HashAlgorithmSHA256: {
+					4: testutil.DecodeHexString(c, "27c1fcc75127e47454e4b7d2de4d31796d1300ce67c7ea39a4459d64412e0347"),
+				},
+			},
+		},
+	})
+}
+
+func (s *eventLogPolicySuite) TestAddBootManagerProfileFromEventLogSubstituteShimAndKernel(c *C) {
+	// Test that a branch is created for each combination of replacements.
+	s.testEventLogProfile(c, &testEventLogProfileData{
+		pcr: 4,
+		fn:  AddBootManagerProfileFromEventLog,
+		params: &EventLogProfileParams{
+			PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+			Substitutions: []*ImageSubstitution{
+				{
+					Current: FileImage(filepath.Join("testdata", runtime.GOARCH, "mockshim_sbat.efi.signed.1.1.1")),
+					Replacements: []Image{
+						FileImage(filepath.Join("testdata", runtime.GOARCH, "mockshim_sbat.efi.signed.1.1.1")),
+						FileImage(filepath.Join("testdata", runtime.GOARCH, "mockshim_no_sbat.efi.signed.1.1.1")),
+					},
+				},
+				{
+					Current: FileImage(filepath.Join("testdata", runtime.GOARCH, "mockkernel1.efi.signed.shim.1")),
+					Replacements: []Image{
+						FileImage(filepath.Join("testdata", runtime.GOARCH, "mockkernel1.efi.signed.shim.1")),
+						FileImage(filepath.Join("testdata", runtime.GOARCH, "mockkernel2.efi.signed.shim.1")),
+					},
+				},
+			},
+			Environment: s.newMockEnvironmentWithMockImages(c)},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					4: testutil.DecodeHexString(c, "2f64bfe7796724c68c54b14bc8690012f9e29c907dc900831dd12f912f20b2b3"),
+				},
+			},
+			{
+				tpm2.HashAlgorithmSHA256: {
+					4: testutil.DecodeHexString(c, "27c1fcc75127e47454e4b7d2de4d31796d1300ce67c7ea39a4459d64412e0347"),
+				},
+			},
+			{
+				tpm2.HashAlgorithmSHA256: {
+					4: testutil.DecodeHexString(c, "e1685b380e513c8ce4affb6ac0f84b4833f170ac8fb3868cec7f4638d852652e"),
+				},
+			},
+			{
+				tpm2.HashAlgorithmSHA256: {
+					4: testutil.DecodeHexString(c, "209b74ae6c7a16f0e08575cffc73021f19d46c885b81e1448acd5f18d8358391"),
+				},
+			},
+		},
+	})
+}
+
+func (s *eventLogPolicySuite) TestAddBootManagerProfileFromEventLogImageNotMeasured(c *C) {
+	if runtime.GOARCH != "amd64" {
+		c.Skip("unsupported architecture")
+	}
+
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	err := AddBootManagerProfileFromEventLog(profile, &EventLogProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		Substitutions: []*ImageSubstitution{
+			{
+				Current:      FileImage(filepath.Join("testdata", runtime.GOARCH, "mockkernel2.efi.signed.shim.1")),
+				Replacements: []Image{FileImage(filepath.Join("testdata", runtime.GOARCH, "mockkernel1.efi.signed.shim.1"))},
+			},
+		},
+		Environment: s.newMockEnvironmentWithMockImages(c)})
+	c.Check(err, ErrorMatches, "testdata/amd64/mockkernel2.efi.signed.shim.1 was not measured during the current boot")
+}
+
+func (s *eventLogPolicySuite) TestAddBootManagerProfileFromEventLogNoReplacements(c *C) {
+	if runtime.GOARCH != "amd64" {
+		c.Skip("unsupported architecture")
+	}
+
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	err := AddBootManagerProfileFromEventLog(profile, &EventLogProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		Substitutions: []*ImageSubstitution{
+			{Current: FileImage(filepath.Join("testdata", runtime.GOARCH, "mockkernel1.efi.signed.shim.1"))},
+		},
+		Environment: s.newMockEnvironmentWithMockImages(c)})
+	c.Check(err, ErrorMatches, "no replacements for testdata/amd64/mockkernel1.efi.signed.shim.1")
+}
+
+func (s *eventLogPolicySuite) TestAddSecureBootPolicyProfileFromEventLog(c *C) {
+	s.testEventLogProfile(c, &testEventLogProfileData{
+		pcr: 7,
+		fn:  AddSecureBootPolicyProfileFromEventLog,
+		params: &EventLogProfileParams{
+			PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+			Environment:  &mockEFIEnvironment{"", "testdata/eventlog_sb.bin"}},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					7: testutil.DecodeHexString(c, "afc99bd8b298ea9b70d2796cb0ca22fe2b70d784691a1cae2aa3ba55edc365dc"),
+				},
+			},
+		},
+	})
+}
@@ -21,6 +21,7 @@ package efi
 
 import (
 	"github.com/canonical/go-efilib"
+	"github.com/canonical/go-tpm2"
 	"github.com/snapcore/secboot/internal/testutil"
 )
 
@@ -35,6 +36,9 @@ var (
 	ComputeDbUpdate    = computeDbUpdate
 	DefaultEnv         = defaultEnv
 	NewShimImageHandle = newShimImageHandle
+
+	ReadShimSbatLevelSection = readShimSbatLevelSection
+	SbatLevelDatestamp       = sbatLevelDatestamp
 )
 
 // Alias some unexported types for testing. These are required in order to pass these between functions in tests, or to access
@@ -45,8 +49,22 @@ func (s *ShimImageHandle) ReadVendorCert() ([]byte, error) {
 	return s.readVendorCert()
 }
 
+func (s *ShimImageHandle) ReadSbatLevel() (previous, latest []byte, err error) {
+	return s.readSbatLevel()
+}
+
 type SigDbUpdateQuirkMode = sigDbUpdateQuirkMode
 
+func (c *ImageDigestCache) ComputePeImageDigest(alg tpm2.HashAlgorithmId, image Image) (tpm2.Digest, error) {
+	return c.computePeImageDigest(alg, image)
+}
+
+func (c *ImageDigestCache) NumEntries() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.files) + len(c.readers)
+}
+
 // Helper functions
 func MockEFIVarsPath(path string) (restore func()) {
 	origPath := efiVarsPath
@@ -64,6 +82,18 @@ func MockEventLogPath(path string) (restore func()) {
 	}
 }
 
+func MockImageLoadHandlers(handlers ...ImageLoadHandlerConstructor) (restore func()) {
+	imageLoadHandlersMu.Lock()
+	defer imageLoadHandlersMu.Unlock()
+	orig := imageLoadHandlers
+	imageLoadHandlers = handlers
+	return func() {
+		imageLoadHandlersMu.Lock()
+		defer imageLoadHandlersMu.Unlock()
+		imageLoadHandlers = orig
+	}
+}
+
 func MockReadVar(dir string) (restore func()) {
 	origReadVar := readVar
 	readVar = func(name string, guid efi.GUID) ([]byte, efi.VariableAttributes, error) {
@@ -0,0 +1,135 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/tcglog-parser"
+
+	"golang.org/x/xerrors"
+
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+const (
+	platformFirmwarePCR = 0 // SRTM, BIOS, Host Platform Extensions, Embedded Option ROMs and PI Drivers
+	driversAndAppsPCR   = 2 // UEFI driver and application Code
+)
+
+// FirmwareProfileParams provide the arguments to AddPlatformFirmwareProfile and
+// AddDriversAndAppsProfile.
+type FirmwareProfileParams struct {
+	// PCRAlgorithm is the algorithm for which to compute PCR digests for. TPMs compliant with the "TCG PC Client Platform TPM Profile
+	// (PTP) Specification" Level 00, Revision 01.03 v22, May 22 2017 are required to support tpm2.HashAlgorithmSHA1 and
+	// tpm2.HashAlgorithmSHA256. Support for other digest algorithms is optional.
+	PCRAlgorithm tpm2.HashAlgorithmId
+
+	// AlternativeDigests allows specific events measured during the current boot to float
+	// between a set of values rather than being pinned to the value recorded in the TCG
+	// event log, eg, to permit a pending firmware update. It is keyed by the index of the
+	// event amongst the events measured to the PCR, starting from zero and excluding
+	// EV_NO_ACTION events. A branch is generated for the recorded digest and for each of
+	// the supplied digests. Events without an entry are pinned to their recorded digest.
+	AlternativeDigests map[int]tpm2.DigestList
+
+	// Environment is an optional parameter that allows the caller to provide
+	// a custom EFI environment. If not set, the host's normal environment will
+	// be used
+	Environment HostEnvironment
+}
+
+func addFirmwareProfile(profile *secboot_tpm2.PCRProtectionProfile, params *FirmwareProfileParams, pcr int, name string) error {
+	env := params.Environment
+	if env == nil {
+		env = defaultEnv
+	}
+
+	log, err := env.ReadEventLog()
+	if err != nil {
+		return xerrors.Errorf("cannot parse TCG event log: %w", err)
+	}
+
+	if !log.Algorithms.Contains(params.PCRAlgorithm) {
+		return fmt.Errorf("cannot compute %s policy digests: the TCG event log does not have the requested algorithm", name)
+	}
+
+	n := 0
+	for _, event := range log.Events {
+		if int(event.PCRIndex) == pcr && event.EventType != tcglog.EventTypeNoAction {
+			n++
+		}
+	}
+
+	var indices []int
+	for i := range params.AlternativeDigests {
+		indices = append(indices, i)
+	}
+	sort.Ints(indices)
+	for _, i := range indices {
+		if i < 0 || i >= n {
+			return fmt.Errorf("cannot compute %s policy digests: no event with index %d was measured to PCR %d", name, i, pcr)
+		}
+		for _, d := range params.AlternativeDigests[i] {
+			if len(d) != params.PCRAlgorithm.Size() {
+				return fmt.Errorf("cannot compute %s policy digests: invalid alternative digest length for event %d", name, i)
+			}
+		}
+	}
+
+	i := 0
+	addEventLogProfile(profile, log, params.PCRAlgorithm, pcr, func(event *tcglog.Event) tpm2.DigestList {
+		defer func() { i++ }()
+
+		alternatives, ok := params.AlternativeDigests[i]
+		if !ok || len(alternatives) == 0 {
+			return nil
+		}
+		return append(tpm2.DigestList{tpm2.Digest(event.Digests[params.PCRAlgorithm])}, alternatives...)
+	})
+
+	return nil
+}
+
+// AddPlatformFirmwareProfile adds the platform firmware profile to the provided PCR protection profile, in order to generate a PCR
+// policy that restricts access to a sealed key to the platform firmware that was executed during the current boot. Events that
+// are measured to PCR 0 are detailed in section 3.3.4.1 of the "TCG PC Client Platform Firmware Profile Specification", and include
+// the S-CRTM version, the platform firmware blobs and embedded option ROMs.
+//
+// The profile is computed by replaying the events recorded to PCR 0 in the TCG event log, which means that the generated PCR policy
+// will not be satisfied after a firmware update unless the digests of the events affected by the update are supplied via the
+// AlternativeDigests field of params.
+func AddPlatformFirmwareProfile(profile *secboot_tpm2.PCRProtectionProfile, params *FirmwareProfileParams) error {
+	return addFirmwareProfile(profile, params, platformFirmwarePCR, "platform firmware")
+}
+
+// AddDriversAndAppsProfile adds the UEFI drivers and applications profile to the provided PCR protection profile, in order to
+// generate a PCR policy that restricts access to a sealed key to the set of drivers and option ROMs that were loaded from add-in
+// devices during the current boot. Events that are measured to PCR 2 are detailed in section 3.3.4.3 of the "TCG PC Client
+// Platform Firmware Profile Specification".
+//
+// The profile is computed by replaying the events recorded to PCR 2 in the TCG event log, which means that the generated PCR policy
+// will not be satisfied if add-in devices are added, removed or updated unless the digests of the affected events are supplied
+// via the AlternativeDigests field of params.
+func AddDriversAndAppsProfile(profile *secboot_tpm2.PCRProtectionProfile, params *FirmwareProfileParams) error {
+	return addFirmwareProfile(profile, params, driversAndAppsPCR, "drivers and apps")
+}
@@ -0,0 +1,158 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi_test
+
+import (
+	"github.com/canonical/go-tpm2"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/efi"
+	"github.com/snapcore/secboot/internal/testutil"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+type firmwarePolicySuite struct{}
+
+var _ = Suite(&firmwarePolicySuite{})
+
+type testFirmwareProfileData struct {
+	pcr    int
+	fn     func(*secboot_tpm2.PCRProtectionProfile, *FirmwareProfileParams) error
+	params *FirmwareProfileParams
+	values []tpm2.PCRValues
+}
+
+func (s *firmwarePolicySuite) testFirmwareProfile(c *C, data *testFirmwareProfileData) {
+	expectedPcrs := tpm2.PCRSelectionList{{Hash: data.params.PCRAlgorithm, Select: []int{data.pcr}}}
+	var expectedDigests tpm2.DigestList
+	for _, v := range data.values {
+		d, _ := tpm2.ComputePCRDigest(tpm2.HashAlgorithmSHA256, expectedPcrs, v)
+		expectedDigests = append(expectedDigests, d)
+	}
+
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	c.Assert(data.fn(profile, data.params), IsNil)
+	pcrs, digests, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	c.Assert(err, IsNil)
+	c.Check(pcrs.Equal(expectedPcrs), Equals, true)
+	c.Check(digests, DeepEquals, expectedDigests)
+	if c.Failed() {
+		c.Logf("Profile:\n%s", profile)
+		c.Logf("Values:\n%s", testutil.FormatPCRValuesFromPCRProtectionProfile(profile, nil))
+	}
+}
+
+func (s *firmwarePolicySuite) TestAddPlatformFirmwareProfile(c *C) {
+	s.testFirmwareProfile(c, &testFirmwareProfileData{
+		pcr: 0,
+		fn:  AddPlatformFirmwareProfile,
+		params: &FirmwareProfileParams{
+			PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+			Environment:  &mockEFIEnvironment{"", "testdata/eventlog_sb.bin"}},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					0: testutil.DecodeHexString(c, "3d2b11b4c5cb623acbde6d14205217e47ebd368eab861e4fed782bb99be4598a"),
+				},
+			},
+		},
+	})
+}
+
+func (s *firmwarePolicySuite) TestAddPlatformFirmwareProfileWithAlternativeDigests(c *C) {
+	// Float the S-CRTM version and the first platform firmware blob.
+	s.testFirmwareProfile(c, &testFirmwareProfileData{
+		pcr: 0,
+		fn:  AddPlatformFirmwareProfile,
+		params: &FirmwareProfileParams{
+			PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+			AlternativeDigests: map[int]tpm2.DigestList{
+				0: {testutil.DecodeHexString(c, "b05e244762b1e472be89a93800cc3ee326743cecb55984bf12813addb8de66d0")},
+				3: {testutil.DecodeHexString(c, "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae")},
+			},
+			Environment: &mockEFIEnvironment{"", "testdata/eventlog_sb.bin"}},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					0: testutil.DecodeHexString(c, "3d2b11b4c5cb623acbde6d14205217e47ebd368eab861e4fed782bb99be4598a"),
+				},
+			},
+			{
+				tpm2.HashAlgorithmSHA256: {
+					0: testutil.DecodeHexString(c, "9d5ba6280ab7315a49b35cdf7ebb7fa2b6b8ec4c5a04e53c491eff909f2976af"),
+				},
+			},
+			{
+				tpm2.HashAlgorithmSHA256: {
+					0: testutil.DecodeHexString(c, "80272d0ad1b1e7ad291b05cb699e7793924092f354b1a16af847231912a590e3"),
+				},
+			},
+			{
+				tpm2.HashAlgorithmSHA256: {
+					0: testutil.DecodeHexString(c, "acc9644597058881939fcaec644bca5694e60922a0809e4ccb55e0bc5fbd679d"),
+				},
+			},
+		},
+	})
+}
+
+func (s *firmwarePolicySuite) TestAddPlatformFirmwareProfileInvalidIndex(c *C) {
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	err := AddPlatformFirmwareProfile(profile, &FirmwareProfileParams{
+		PCRAlgorithm:       tpm2.HashAlgorithmSHA256,
+		AlternativeDigests: map[int]tpm2.DigestList{4: {make(tpm2.Digest, 32)}},
+		Environment:        &mockEFIEnvironment{"", "testdata/eventlog_sb.bin"}})
+	c.Check(err, ErrorMatches, "cannot compute platform firmware policy digests: no event with index 4 was measured to PCR 0")
+}
+
+func (s *firmwarePolicySuite) TestAddPlatformFirmwareProfileInvalidDigest(c *C) {
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	err := AddPlatformFirmwareProfile(profile, &FirmwareProfileParams{
+		PCRAlgorithm:       tpm2.HashAlgorithmSHA256,
+		AlternativeDigests: map[int]tpm2.DigestList{1: {make(tpm2.Digest, 20)}},
+		Environment:        &mockEFIEnvironment{"", "testdata/eventlog_sb.bin"}})
+	c.Check(err, ErrorMatches, "cannot compute platform firmware policy digests: invalid alternative digest length for event 1")
+}
+
+func (s *firmwarePolicySuite) TestAddDriversAndAppsProfile(c *C) {
+	s.testFirmwareProfile(c, &testFirmwareProfileData{
+		pcr: 2,
+		fn:  AddDriversAndAppsProfile,
+		params: &FirmwareProfileParams{
+			PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+			Environment:  &mockEFIEnvironment{"", "testdata/eventlog_sb.bin"}},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					2: testutil.DecodeHexString(c, "3d458cfe55cc03ea1f443f1562beec8df51c75e14a9fcf9a7234a13f198e7969"),
+				},
+			},
+		},
+	})
+}
+
+func (s *firmwarePolicySuite) TestAddDriversAndAppsProfileUnsupportedAlgorithm(c *C) {
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	err := AddDriversAndAppsProfile(profile, &FirmwareProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA384,
+		Environment:  &mockEFIEnvironment{"", "testdata/eventlog_sb.bin"}})
+	c.Check(err, ErrorMatches, "cannot compute drivers and apps policy digests: the TCG event log does not have the requested algorithm")
+}
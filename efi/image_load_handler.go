@@ -0,0 +1,122 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi
+
+import (
+	"io"
+	"sync"
+
+	"github.com/canonical/go-efilib"
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// ImageLoadContext provides an ImageLoadHandler with access to a branch of the secure boot policy profile
+// being computed by AddSecureBootPolicyProfile.
+type ImageLoadContext interface {
+	// PCRAlgorithm returns the algorithm for which PCR digests are being computed.
+	PCRAlgorithm() tpm2.HashAlgorithmId
+
+	// MeasureVariable extends a measurement of the supplied EFI variable data to PCR 7, in the
+	// same way as an EV_EFI_VARIABLE_AUTHORITY event.
+	MeasureVariable(guid efi.GUID, name string, data []byte)
+
+	// SetVerificationDb sets the signature database that the launched image uses to authenticate
+	// images that it loads without the use of EFI boot services, in addition to the EFI authorized
+	// signature database. Subsequent ImageLoadEvents with a Source of Shim are authenticated against
+	// these databases. Verification events are recorded with the supplied GUID and name, and contain
+	// the entire EFI_SIGNATURE_DATA structure.
+	SetVerificationDb(guid efi.GUID, name string, db efi.SignatureDatabase)
+}
+
+// ImageLoadHandler is used by AddSecureBootPolicyProfile to compute the measurements made by a specific
+// type of image, such as a bootloader that verifies subsequent images itself.
+type ImageLoadHandler interface {
+	// MeasureImageStart is called for each branch of the profile when the image is launched,
+	// after its verification event has been computed.
+	MeasureImageStart(ctx ImageLoadContext) error
+}
+
+// ImageLoadHandlerConstructor returns an ImageLoadHandler for the image read from r, or nil if
+// the image is not recognized.
+type ImageLoadHandlerConstructor func(r io.ReaderAt) (ImageLoadHandler, error)
+
+var (
+	imageLoadHandlersMu sync.Mutex
+	imageLoadHandlers   []ImageLoadHandlerConstructor
+)
+
+// RegisterImageLoadHandler registers a constructor for an ImageLoadHandler, which allows
+// AddSecureBootPolicyProfile to support bootloaders that this package has no built-in
+// knowledge of. Constructors are tried in the order in which they are registered, and
+// before the built-in support for shim. The first one to recognize an image is used.
+// Images that aren't recognized by any constructor are assumed to make no measurements
+// to PCR 7 other than those associated with their own verification.
+func RegisterImageLoadHandler(fn ImageLoadHandlerConstructor) {
+	imageLoadHandlersMu.Lock()
+	defer imageLoadHandlersMu.Unlock()
+	imageLoadHandlers = append(imageLoadHandlers, fn)
+}
+
+// newImageLoadHandler returns an ImageLoadHandler for the image read from r, or nil if there
+// isn't one.
+func newImageLoadHandler(r io.ReaderAt) (ImageLoadHandler, error) {
+	imageLoadHandlersMu.Lock()
+	constructors := make([]ImageLoadHandlerConstructor, len(imageLoadHandlers))
+	copy(constructors, imageLoadHandlers)
+	imageLoadHandlersMu.Unlock()
+
+	constructors = append(constructors, newShimImageLoadHandler)
+
+	for _, fn := range constructors {
+		handler, err := fn(r)
+		if err != nil {
+			return nil, err
+		}
+		if handler != nil {
+			return handler, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// newShimImageLoadHandler returns an ImageLoadHandler for the supplied image if it is shim.
+func newShimImageLoadHandler(r io.ReaderAt) (ImageLoadHandler, error) {
+	isShim, err := isShimExecutable(r)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot determine image type: %w", err)
+	}
+	if !isShim {
+		return nil, nil
+	}
+
+	shim, err := newShimImageHandle(r)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create handle for shim image: %w", err)
+	}
+
+	handler, err := newShimImageLoadHandlerFromHandle(shim)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot process shim executable: %w", err)
+	}
+	return handler, nil
+}
@@ -0,0 +1,160 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi_test
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/canonical/go-tpm2"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/efi"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+type mockImageLoadHandler struct {
+	fn func(ctx ImageLoadContext) error
+}
+
+func (h *mockImageLoadHandler) MeasureImageStart(ctx ImageLoadContext) error {
+	return h.fn(ctx)
+}
+
+// newMockImageLoadHandlerConstructor returns a constructor that recognizes images with
+// the specified filename.
+func newMockImageLoadHandlerConstructor(name string, fn func(ctx ImageLoadContext) error) ImageLoadHandlerConstructor {
+	return func(r io.ReaderAt) (ImageLoadHandler, error) {
+		f, ok := r.(interface{ Name() string })
+		if !ok || !strings.HasSuffix(f.Name(), name) {
+			return nil, nil
+		}
+		return &mockImageLoadHandler{fn: fn}, nil
+	}
+}
+
+func imageLoadHandlerTestLoadSequences() []*ImageLoadEvent {
+	return []*ImageLoadEvent{
+		{
+			Source: Firmware,
+			Image:  FileImage(filepath.Join("testdata", runtime.GOARCH, "mockshim_sbat.efi.signed.1.1.1")),
+			Next: []*ImageLoadEvent{
+				{
+					Source: Shim,
+					Image:  FileImage(filepath.Join("testdata", runtime.GOARCH, "mockgrub1.efi.signed.shim.1")),
+					Next: []*ImageLoadEvent{
+						{
+							Source: Shim,
+							Image:  FileImage(filepath.Join("testdata", runtime.GOARCH, "mockkernel1.efi.signed.shim.1")),
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func (s *securebootPolicySuite) TestImageLoadHandlerCalled(c *C) {
+	// Test that a registered handler is called for each branch when the image it
+	// recognizes is launched, and that a handler that doesn't make any measurements
+	// doesn't change the computed digests.
+	var algs []tpm2.HashAlgorithmId
+	restore := MockImageLoadHandlers(newMockImageLoadHandlerConstructor("mockgrub1.efi.signed.shim.1", func(ctx ImageLoadContext) error {
+		algs = append(algs, ctx.PCRAlgorithm())
+		return nil
+	}))
+	defer restore()
+
+	s.testAddSecureBootPolicyProfile(c, &testAddSecureBootPolicyProfileData{
+		eventLogPath: "testdata/eventlog_sb.bin",
+		efivars:      "testdata/efivars_mock1",
+		params: SecureBootPolicyProfileParams{
+			PCRAlgorithm:  tpm2.HashAlgorithmSHA256,
+			LoadSequences: imageLoadHandlerTestLoadSequences(),
+		},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					7: testutil.DecodeHexString(c, "84c3cf3c3ca91234fda780141b06af2e32bb4c6fc809216f2c33d25b84155796"),
+				},
+			},
+		},
+	})
+	// The profile is computed twice, once for each signature database update quirk mode.
+	c.Check(algs, DeepEquals, []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256, tpm2.HashAlgorithmSHA256})
+}
+
+func (s *securebootPolicySuite) TestImageLoadHandlerTakesPrecedenceOverShim(c *C) {
+	// Test that a registered handler replaces the built-in support for shim. This
+	// handler doesn't provide a verification database, so the subsequent images
+	// can't be authenticated by shim.
+	restore := MockImageLoadHandlers(newMockImageLoadHandlerConstructor("mockshim_sbat.efi.signed.1.1.1", func(ImageLoadContext) error {
+		return nil
+	}))
+	defer restore()
+
+	s.testAddSecureBootPolicyProfile(c, &testAddSecureBootPolicyProfileData{
+		eventLogPath: "testdata/eventlog_sb.bin",
+		efivars:      "testdata/efivars_mock1",
+		params: SecureBootPolicyProfileParams{
+			PCRAlgorithm:  tpm2.HashAlgorithmSHA256,
+			LoadSequences: imageLoadHandlerTestLoadSequences(),
+		},
+		errMatch: ".*shim specified as event source without a shim executable appearing in preceding events",
+	})
+}
+
+func (s *securebootPolicySuite) TestImageLoadHandlerError(c *C) {
+	restore := MockImageLoadHandlers(newMockImageLoadHandlerConstructor("mockgrub1.efi.signed.shim.1", func(ImageLoadContext) error {
+		return errors.New("some error")
+	}))
+	defer restore()
+
+	s.testAddSecureBootPolicyProfile(c, &testAddSecureBootPolicyProfileData{
+		eventLogPath: "testdata/eventlog_sb.bin",
+		efivars:      "testdata/efivars_mock1",
+		params: SecureBootPolicyProfileParams{
+			PCRAlgorithm:  tpm2.HashAlgorithmSHA256,
+			LoadSequences: imageLoadHandlerTestLoadSequences(),
+		},
+		errMatch: ".*cannot process launch of testdata/amd64/mockgrub1.efi.signed.shim.1: some error",
+	})
+}
+
+func (s *securebootPolicySuite) TestImageLoadHandlerConstructorError(c *C) {
+	restore := MockImageLoadHandlers(func(io.ReaderAt) (ImageLoadHandler, error) {
+		return nil, errors.New("some error")
+	})
+	defer restore()
+
+	s.testAddSecureBootPolicyProfile(c, &testAddSecureBootPolicyProfileData{
+		eventLogPath: "testdata/eventlog_sb.bin",
+		efivars:      "testdata/efivars_mock1",
+		params: SecureBootPolicyProfileParams{
+			PCRAlgorithm:  tpm2.HashAlgorithmSHA256,
+			LoadSequences: imageLoadHandlerTestLoadSequences(),
+		},
+		errMatch: ".*cannot create image load handler: some error",
+	})
+}
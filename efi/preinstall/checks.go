@@ -0,0 +1,189 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preinstall
+
+import (
+	"bytes"
+
+	"github.com/canonical/go-efilib"
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/tcglog-parser"
+
+	"golang.org/x/xerrors"
+
+	secboot_efi "github.com/snapcore/secboot/efi"
+	"github.com/snapcore/secboot/internal/tcg"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+const (
+	sbStateName = "SecureBoot" // Unicode variable name for the EFI secure boot configuration (enabled/disabled)
+
+	firmwareDebuggerEvent      = "UEFI Debug Mode"         // EV_EFI_ACTION event measured to PCR 7 when a firmware debugger is enabled
+	dmaProtectionDisabledEvent = "DMA Protection Disabled" // EV_EFI_ACTION event measured to PCR 7 when DMA protection is disabled
+
+	maxFirmwarePCR = 7 // The last PCR that contains measurements made exclusively by the platform firmware
+)
+
+var (
+	connectToDefaultTPM = secboot_tpm2.ConnectToDefaultTPM
+	hostEnv             = secboot_efi.DefaultEnvironment()
+)
+
+// CheckFlags customize the behaviour of RunChecks.
+type CheckFlags int
+
+const (
+	// PermitNoEKCertificate permits a TPM without an endorsement key certificate,
+	// such as a software TPM provided by a hypervisor.
+	PermitNoEKCertificate CheckFlags = 1 << iota
+
+	// PermitFirmwareDebugging permits a platform firmware with a debugger enabled.
+	PermitFirmwareDebugging
+
+	// PermitNoDMAProtection permits a platform firmware that has disabled DMA
+	// protection.
+	PermitNoDMAProtection
+)
+
+// runChecks performs the checks for RunChecks, using the supplied TPM connection and environment.
+// If tpm is nil, checks that require a TPM are skipped.
+func runChecks(tpm *secboot_tpm2.Connection, env secboot_efi.HostEnvironment, flags CheckFlags) (errs []*WithActionsError, err error) {
+	tpmEnabled := false
+	if tpm != nil {
+		tpmEnabled = tpm.IsEnabled()
+		if !tpmEnabled {
+			errs = append(errs, newWithActionsError(ErrTPMDisabled, ActionRebootToFWSettings))
+		}
+	}
+
+	if tpmEnabled {
+		props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot fetch permanent properties: %w", err)
+		}
+		if len(props) > 0 && tpm2.PermanentAttributes(props[0].Value)&tpm2.AttrInLockout > 0 {
+			errs = append(errs, newWithActionsError(secboot_tpm2.ErrTPMLockout, ActionClearTPMViaFirmware))
+		}
+
+		_, err = tpm.CreateResourceContextFromTPM(tcg.EKCertHandle)
+		switch {
+		case tpm2.IsResourceUnavailableError(err, tcg.EKCertHandle):
+			if flags&PermitNoEKCertificate == 0 {
+				errs = append(errs, newWithActionsError(ErrNoEKCertificate, ActionContactOEM))
+			}
+		case err != nil:
+			return nil, xerrors.Errorf("cannot create context for EK certificate index: %w", err)
+		}
+	}
+
+	log, err := env.ReadEventLog()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot parse TCG event log: %w", err)
+	}
+
+	if !log.Algorithms.Contains(tpm2.HashAlgorithmSHA256) {
+		errs = append(errs, newWithActionsError(ErrNoSHA256PCRBank, ActionRebootToFWSettings, ActionContactOEM))
+	}
+
+	if tpmEnabled {
+		report, err := secboot_efi.CheckEventLogConsistency(env, tpm)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot check TCG event log consistency: %w", err)
+		}
+		// Only the firmware PCRs are expected to be consistent with
+		// the log - the OS may have made measurements to other PCRs
+		// after ExitBootServices.
+		var inconsistencies []*secboot_efi.PCRInconsistency
+		for _, i := range report.Inconsistencies {
+			if i.PCR <= maxFirmwarePCR {
+				inconsistencies = append(inconsistencies, i)
+			}
+		}
+		if len(inconsistencies) > 0 {
+			errs = append(errs, newWithActionsError(&PCRInconsistencyError{Inconsistencies: inconsistencies}, ActionContactOEM))
+		}
+	}
+
+	sbState, _, err := env.ReadVar(sbStateName, efi.GlobalVariable)
+	switch {
+	case err == efi.ErrVariableNotFound || (err == nil && !bytes.Equal(sbState, []byte{1})):
+		errs = append(errs, newWithActionsError(ErrSecureBootDisabled, ActionRebootToFWSettings))
+	case err != nil:
+		return nil, xerrors.Errorf("cannot read secure boot configuration: %w", err)
+	}
+
+	for _, event := range log.Events {
+		if event.PCRIndex != 7 || event.EventType != tcglog.EventTypeEFIAction {
+			continue
+		}
+		switch string(event.Data.Bytes()) {
+		case firmwareDebuggerEvent:
+			if flags&PermitFirmwareDebugging == 0 {
+				errs = append(errs, newWithActionsError(ErrFirmwareDebuggingEnabled, ActionRebootToFWSettings, ActionContactOEM))
+			}
+		case dmaProtectionDisabledEvent:
+			if flags&PermitNoDMAProtection == 0 {
+				errs = append(errs, newWithActionsError(ErrNoDMAProtection, ActionRebootToFWSettings, ActionContactOEM))
+			}
+		}
+	}
+
+	return errs, nil
+}
+
+// RunChecks evaluates whether the host is suitable for full disk encryption that uses
+// the TPM for key protection. It checks that:
+//  - a TPM2 device is present and enabled, and not in dictionary attack lockout mode.
+//  - the TPM has an endorsement key certificate.
+//  - the TCG event log has a SHA-256 PCR bank and is consistent with the PCR values
+//    read from the TPM for the PCRs used by the platform firmware.
+//  - the current boot was performed with UEFI secure boot enabled.
+//  - the platform firmware doesn't have a debugger enabled or DMA protection
+//    disabled.
+//
+// Some of these checks can be relaxed with the flags argument.
+//
+// If there is no TPM2 device, a *RunChecksErrors error that only contains
+// secboot_tpm2.ErrNoTPM2Device is returned without performing any of the other checks.
+//
+// If any of the checks fail, a *RunChecksErrors error is returned, which contains an error
+// for each failed check along with a list of actions that may resolve it. Other errors are
+// returned if a check could not be performed.
+func RunChecks(flags CheckFlags) error {
+	tpm, err := connectToDefaultTPM()
+	switch {
+	case err == secboot_tpm2.ErrNoTPM2Device:
+		return &RunChecksErrors{Errs: []*WithActionsError{newWithActionsError(err, ActionRebootToFWSettings)}}
+	case err != nil:
+		return xerrors.Errorf("cannot connect to TPM: %w", err)
+	}
+	defer tpm.Close()
+
+	errs, err := runChecks(tpm, hostEnv, flags)
+	if err != nil {
+		return err
+	}
+
+	if len(errs) > 0 {
+		return &RunChecksErrors{Errs: errs}
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preinstall_test
+
+import (
+	"errors"
+	"os"
+
+	"github.com/canonical/go-efilib"
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/tcglog-parser"
+
+	"golang.org/x/xerrors"
+
+	. "gopkg.in/check.v1"
+
+	secboot_efi "github.com/snapcore/secboot/efi"
+	. "github.com/snapcore/secboot/efi/preinstall"
+	"github.com/snapcore/secboot/internal/testutil"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+func readLog(c *C, path string) *tcglog.Log {
+	f, err := os.Open(path)
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	log, err := tcglog.ReadLog(f, &tcglog.LogOptions{})
+	c.Assert(err, IsNil)
+	return log
+}
+
+func appendPCR7EFIActionEvent(log *tcglog.Log, action string) {
+	log.Events = append(log.Events, &tcglog.Event{
+		PCRIndex:  7,
+		EventType: tcglog.EventTypeEFIAction,
+		Digests:   make(tcglog.DigestMap),
+		Data:      tcglog.StringEventData(action)})
+}
+
+type checksSuite struct{}
+
+var _ = Suite(&checksSuite{})
+
+func (s *checksSuite) TestRunChecksNoTPMGood(c *C) {
+	env := &mockEFIEnvironment{efivars: "../testdata/efivars_mock1", log: "../testdata/eventlog_sb.bin"}
+	errs, err := RunChecksInternal(nil, env, 0)
+	c.Check(err, IsNil)
+	c.Check(errs, HasLen, 0)
+}
+
+func (s *checksSuite) TestRunChecksSecureBootDisabled(c *C) {
+	env := &secboot_efi.OverridingEnvironment{
+		Env:  &mockEFIEnvironment{efivars: "../testdata/efivars_mock1", log: "../testdata/eventlog_sb.bin"},
+		Vars: []*secboot_efi.VariableOverride{{Name: "SecureBoot", GUID: efi.GlobalVariable, Data: []byte{0}}}}
+	errs, err := RunChecksInternal(nil, env, 0)
+	c.Check(err, IsNil)
+	c.Assert(errs, HasLen, 1)
+	c.Check(errs[0], ErrorMatches, `secure boot is disabled \(possible actions: reboot-to-fw-settings\)`)
+	c.Check(xerrors.Is(errs[0], ErrSecureBootDisabled), testutil.IsTrue)
+	c.Check(errs[0].Actions, DeepEquals, []Action{ActionRebootToFWSettings})
+}
+
+func (s *checksSuite) TestRunChecksNoSecureBootVariable(c *C) {
+	env := &secboot_efi.OverridingEnvironment{
+		Env:  &mockEFIEnvironment{efivars: "../testdata/efivars_mock1", log: "../testdata/eventlog_sb.bin"},
+		Vars: []*secboot_efi.VariableOverride{{Name: "SecureBoot", GUID: efi.GlobalVariable}}}
+	errs, err := RunChecksInternal(nil, env, 0)
+	c.Check(err, IsNil)
+	c.Assert(errs, HasLen, 1)
+	c.Check(xerrors.Is(errs[0], ErrSecureBootDisabled), testutil.IsTrue)
+}
+
+func (s *checksSuite) TestRunChecksFirmwareDebugging(c *C) {
+	log := readLog(c, "../testdata/eventlog_sb.bin")
+	appendPCR7EFIActionEvent(log, "UEFI Debug Mode")
+
+	env := &secboot_efi.OverridingEnvironment{
+		Env:      &mockEFIEnvironment{efivars: "../testdata/efivars_mock1"},
+		EventLog: log}
+	errs, err := RunChecksInternal(nil, env, 0)
+	c.Check(err, IsNil)
+	c.Assert(errs, HasLen, 1)
+	c.Check(xerrors.Is(errs[0], ErrFirmwareDebuggingEnabled), testutil.IsTrue)
+	c.Check(errs[0].Actions, DeepEquals, []Action{ActionRebootToFWSettings, ActionContactOEM})
+
+	errs, err = RunChecksInternal(nil, env, PermitFirmwareDebugging)
+	c.Check(err, IsNil)
+	c.Check(errs, HasLen, 0)
+}
+
+func (s *checksSuite) TestRunChecksNoDMAProtection(c *C) {
+	log := readLog(c, "../testdata/eventlog_sb.bin")
+	appendPCR7EFIActionEvent(log, "DMA Protection Disabled")
+
+	env := &secboot_efi.OverridingEnvironment{
+		Env:      &mockEFIEnvironment{efivars: "../testdata/efivars_mock1"},
+		EventLog: log}
+	errs, err := RunChecksInternal(nil, env, 0)
+	c.Check(err, IsNil)
+	c.Assert(errs, HasLen, 1)
+	c.Check(xerrors.Is(errs[0], ErrNoDMAProtection), testutil.IsTrue)
+
+	errs, err = RunChecksInternal(nil, env, PermitNoDMAProtection)
+	c.Check(err, IsNil)
+	c.Check(errs, HasLen, 0)
+}
+
+func (s *checksSuite) TestRunChecksMultipleErrors(c *C) {
+	log := readLog(c, "../testdata/eventlog_sb.bin")
+	appendPCR7EFIActionEvent(log, "UEFI Debug Mode")
+
+	env := &secboot_efi.OverridingEnvironment{
+		Env:      &mockEFIEnvironment{efivars: "../testdata/efivars_mock1"},
+		Vars:     []*secboot_efi.VariableOverride{{Name: "SecureBoot", GUID: efi.GlobalVariable, Data: []byte{0}}},
+		EventLog: log}
+	errs, err := RunChecksInternal(nil, env, 0)
+	c.Check(err, IsNil)
+	c.Assert(errs, HasLen, 2)
+	c.Check(xerrors.Is(errs[0], ErrSecureBootDisabled), testutil.IsTrue)
+	c.Check(xerrors.Is(errs[1], ErrFirmwareDebuggingEnabled), testutil.IsTrue)
+}
+
+func (s *checksSuite) TestRunChecksNoTPM2Device(c *C) {
+	restore := MockConnectToDefaultTPM(func() (*secboot_tpm2.Connection, error) {
+		return nil, secboot_tpm2.ErrNoTPM2Device
+	})
+	defer restore()
+	// The other checks shouldn't be performed without a TPM, so the
+	// environment has no TCG event log.
+	restore = MockHostEnvironment(&mockEFIEnvironment{efivars: "../testdata/efivars_mock1"})
+	defer restore()
+
+	err := RunChecks(0)
+	c.Assert(err, FitsTypeOf, &RunChecksErrors{})
+	c.Check(err, ErrorMatches, `one or more errors detected:
+- no TPM2 device is available \(possible actions: reboot-to-fw-settings\)`)
+	errs := err.(*RunChecksErrors).Errs
+	c.Assert(errs, HasLen, 1)
+	c.Check(xerrors.Is(errs[0], secboot_tpm2.ErrNoTPM2Device), testutil.IsTrue)
+}
+
+func (s *checksSuite) TestRunChecksConnectError(c *C) {
+	restore := MockConnectToDefaultTPM(func() (*secboot_tpm2.Connection, error) {
+		return nil, errors.New("some error")
+	})
+	defer restore()
+
+	c.Check(RunChecks(0), ErrorMatches, `cannot connect to TPM: some error`)
+}
+
+type checksTPMSuite struct {
+	testutil.TPMSimulatorTestBase
+}
+
+var _ = Suite(&checksTPMSuite{})
+
+func (s *checksTPMSuite) SetUpTest(c *C) {
+	s.TPMSimulatorTestBase.SetUpTest(c)
+	// Make sure that the PCRs are in their initial state.
+	s.ResetTPMSimulator(c)
+}
+
+// replayLog extends the events in the supplied log to the TPM.
+func (s *checksTPMSuite) replayLog(c *C, log *tcglog.Log) {
+	for _, event := range log.Events {
+		if event.PCRIndex >= 16 || event.EventType == tcglog.EventTypeNoAction {
+			continue
+		}
+		var digests tpm2.TaggedHashList
+		for _, alg := range log.Algorithms {
+			digests = append(digests, tpm2.TaggedHash{HashAlg: alg, Digest: tpm2.Digest(event.Digests[alg])})
+		}
+		c.Assert(s.TPM.PCRExtend(s.TPM.PCRHandleContext(int(event.PCRIndex)), digests, nil), IsNil)
+	}
+}
+
+func (s *checksTPMSuite) TestRunChecksGood(c *C) {
+	s.replayLog(c, readLog(c, "../testdata/eventlog_sb.bin"))
+
+	env := &mockEFIEnvironment{efivars: "../testdata/efivars_mock1", log: "../testdata/eventlog_sb.bin"}
+	errs, err := RunChecksInternal(s.TPM, env, 0)
+	c.Check(err, IsNil)
+	c.Check(errs, HasLen, 0)
+}
+
+func (s *checksTPMSuite) TestRunChecksPCRInconsistency(c *C) {
+	env := &mockEFIEnvironment{efivars: "../testdata/efivars_mock1", log: "../testdata/eventlog_sb.bin"}
+	errs, err := RunChecksInternal(s.TPM, env, 0)
+	c.Check(err, IsNil)
+	c.Assert(errs, HasLen, 1)
+	c.Check(errs[0].Actions, DeepEquals, []Action{ActionContactOEM})
+
+	var e *PCRInconsistencyError
+	c.Assert(xerrors.As(errs[0], &e), testutil.IsTrue)
+	c.Check(e.Inconsistencies, Not(HasLen), 0)
+	for _, i := range e.Inconsistencies {
+		c.Check(i.PCR <= 7, testutil.IsTrue)
+	}
+}
@@ -0,0 +1,126 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preinstall
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	secboot_efi "github.com/snapcore/secboot/efi"
+)
+
+// Action describes an action that may resolve an error detected by RunChecks.
+type Action string
+
+const (
+	// ActionRebootToFWSettings indicates that the problem may be resolved by
+	// rebooting to the firmware settings and changing the platform's
+	// configuration, eg, to enable the TPM or secure boot.
+	ActionRebootToFWSettings Action = "reboot-to-fw-settings"
+
+	// ActionClearTPMViaFirmware indicates that the problem may be resolved by
+	// clearing the TPM using the physical presence interface.
+	ActionClearTPMViaFirmware Action = "clear-tpm-via-firmware"
+
+	// ActionContactOEM indicates that the problem is with the platform and
+	// can only be resolved by the platform manufacturer, eg, with a firmware
+	// update.
+	ActionContactOEM Action = "contact-oem"
+)
+
+var (
+	// ErrTPMDisabled indicates that a TPM2 device is present but it has been
+	// disabled by the platform firmware.
+	ErrTPMDisabled = errors.New("the TPM is disabled by the platform firmware")
+
+	// ErrNoEKCertificate indicates that the TPM doesn't have a manufacturer
+	// issued endorsement key certificate.
+	ErrNoEKCertificate = errors.New("the TPM does not have an endorsement key certificate")
+
+	// ErrNoSHA256PCRBank indicates that the TCG event log does not contain
+	// SHA-256 digests, which are required to generate PCR profiles.
+	ErrNoSHA256PCRBank = errors.New("the TCG event log does not have a SHA-256 PCR bank")
+
+	// ErrSecureBootDisabled indicates that the current boot was performed
+	// with UEFI secure boot disabled.
+	ErrSecureBootDisabled = errors.New("secure boot is disabled")
+
+	// ErrFirmwareDebuggingEnabled indicates that the platform firmware has
+	// a debugger enabled.
+	ErrFirmwareDebuggingEnabled = errors.New("the platform firmware has a debugger enabled")
+
+	// ErrNoDMAProtection indicates that the platform firmware has disabled
+	// DMA protection.
+	ErrNoDMAProtection = errors.New("the platform firmware has disabled DMA protection")
+)
+
+// PCRInconsistencyError indicates that the TCG event log is inconsistent with the PCR
+// values read from the TPM.
+type PCRInconsistencyError struct {
+	Inconsistencies []*secboot_efi.PCRInconsistency
+}
+
+func (e *PCRInconsistencyError) Error() string {
+	var s []string
+	for _, i := range e.Inconsistencies {
+		s = append(s, i.String())
+	}
+	return "the TCG event log is inconsistent with the TPM: " + strings.Join(s, ", ")
+}
+
+// WithActionsError is an error detected by RunChecks along with a list of actions that
+// may resolve it.
+type WithActionsError struct {
+	Actions []Action
+	err     error
+}
+
+func newWithActionsError(err error, actions ...Action) *WithActionsError {
+	return &WithActionsError{Actions: actions, err: err}
+}
+
+func (e *WithActionsError) Error() string {
+	if len(e.Actions) == 0 {
+		return e.err.Error()
+	}
+	var actions []string
+	for _, a := range e.Actions {
+		actions = append(actions, string(a))
+	}
+	return fmt.Sprintf("%v (possible actions: %s)", e.err, strings.Join(actions, ", "))
+}
+
+func (e *WithActionsError) Unwrap() error {
+	return e.err
+}
+
+// RunChecksErrors is returned from RunChecks when one or more checks fail.
+type RunChecksErrors struct {
+	Errs []*WithActionsError
+}
+
+func (e *RunChecksErrors) Error() string {
+	var s []string
+	for _, err := range e.Errs {
+		s = append(s, "- "+err.Error())
+	}
+	return "one or more errors detected:\n" + strings.Join(s, "\n")
+}
@@ -0,0 +1,43 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preinstall
+
+import (
+	secboot_efi "github.com/snapcore/secboot/efi"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+var RunChecksInternal = runChecks
+
+func MockConnectToDefaultTPM(fn func() (*secboot_tpm2.Connection, error)) (restore func()) {
+	orig := connectToDefaultTPM
+	connectToDefaultTPM = fn
+	return func() {
+		connectToDefaultTPM = orig
+	}
+}
+
+func MockHostEnvironment(env secboot_efi.HostEnvironment) (restore func()) {
+	orig := hostEnv
+	hostEnv = env
+	return func() {
+		hostEnv = orig
+	}
+}
@@ -0,0 +1,96 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package preinstall_test
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/canonical/go-efilib"
+	"github.com/canonical/tcglog-parser"
+
+	"golang.org/x/xerrors"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	os.Exit(func() int {
+		if testutil.UseMssim {
+			simulatorCleanup, err := testutil.LaunchTPMSimulator(nil)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Cannot launch TPM simulator: %v\n", err)
+				return 1
+			}
+			defer simulatorCleanup()
+
+			caCert, caKey, err := testutil.CreateTestCA()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Cannot create test TPM CA certificate and private key: %v\n", err)
+				return 1
+			}
+
+			if err := func() error {
+				tpm, _, err := testutil.OpenTPMSimulatorForTesting()
+				if err != nil {
+					return xerrors.Errorf("cannot open connection: %w", err)
+				}
+				defer tpm.Close()
+
+				ekCert, err := testutil.CreateTestEKCert(tpm.TPMContext, caCert, caKey)
+				if err != nil {
+					return xerrors.Errorf("cannot create test EK certificate: %w", err)
+				}
+				return testutil.CertifyTPM(tpm.TPMContext, ekCert)
+			}(); err != nil {
+				fmt.Fprintf(os.Stderr, "Cannot certify TPM simulator: %v\n", err)
+				return 1
+			}
+		}
+
+		return m.Run()
+	}())
+}
+
+type mockEFIEnvironment struct {
+	efivars string
+	log     string
+}
+
+func (e *mockEFIEnvironment) ReadVar(name string, guid efi.GUID) ([]byte, efi.VariableAttributes, error) {
+	return testutil.EFIReadVar(e.efivars, name, guid)
+}
+
+func (e *mockEFIEnvironment) ReadEventLog() (*tcglog.Log, error) {
+	f, err := os.Open(e.log)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return tcglog.ReadLog(f, &tcglog.LogOptions{})
+}
@@ -0,0 +1,289 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package presets provides ready-made PCR protection profiles for common boot configurations,
+// so that integrators don't need to work out which combination of the profile functions in
+// the efi package is appropriate for their platform.
+package presets
+
+import (
+	"errors"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
+	secboot_efi "github.com/snapcore/secboot/efi"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+// kernelCmdlinePCR is the PCR that the systemd EFI stub measures the kernel commandline to.
+const kernelCmdlinePCR = 12
+
+// snapModelPCR is the PCR that snap-bootstrap measures the system epoch and model to.
+const snapModelPCR = 12
+
+// PreventReuseMeasurement describes an event measured with
+// secboot_tpm2.ExtendMeasurementToPreventReuse.
+type PreventReuseMeasurement struct {
+	PCR       int    // The PCR that the event is measured to
+	EventData []byte // The event data that is measured
+}
+
+// Params provide the arguments to the preset profile functions. Each function documents which
+// fields it requires.
+type Params struct {
+	// PCRAlgorithm is the algorithm for which to compute PCR digests for.
+	PCRAlgorithm tpm2.HashAlgorithmId
+
+	// LoadSequences describes the boot chains to include in the profile, starting with the
+	// image loaded by the firmware.
+	LoadSequences []*secboot_efi.ImageLoadEvent
+
+	// KernelCmdlines is the set of permitted kernel commandlines for presets that include
+	// PCR 12.
+	KernelCmdlines []string
+
+	// Models is the set of permitted device models for presets that include the measurements
+	// made by snap-bootstrap.
+	Models []secboot.SnapModel
+
+	// Environment is an optional parameter that allows the caller to provide a custom EFI
+	// environment. If not set, the host's normal environment will be used.
+	Environment secboot_efi.HostEnvironment
+
+	// DigestCache is an optional cache of image digests, which can be shared between calls
+	// to the preset functions to avoid hashing the same images more than once.
+	DigestCache *secboot_efi.ImageDigestCache
+
+	// PreventReuseMeasurements is an optional list of events that are measured with
+	// secboot_tpm2.ExtendMeasurementToPreventReuse before a key protected by the returned
+	// profile is unsealed, in the order that they are measured. These are appended to the
+	// profile generated by every preset. A PCR that isn't otherwise part of the preset is
+	// assumed to have been reset to zero at the start of the boot.
+	PreventReuseMeasurements []PreventReuseMeasurement
+}
+
+func (p *Params) checkLoadSequences() error {
+	if len(p.LoadSequences) == 0 {
+		return errors.New("no load sequences specified")
+	}
+	return nil
+}
+
+func (p *Params) checkKernelCmdlines() error {
+	if len(p.KernelCmdlines) == 0 {
+		return errors.New("no kernel commandlines specified")
+	}
+	return nil
+}
+
+func (p *Params) checkModels() error {
+	if len(p.Models) == 0 {
+		return errors.New("no models specified")
+	}
+	return nil
+}
+
+// leafImages returns the images at the end of each of the supplied load sequences, which
+// are the images that execute the OS.
+func leafImages(sequences []*secboot_efi.ImageLoadEvent) (images []secboot_efi.Image) {
+	seen := make(map[string]bool)
+
+	var walk func([]*secboot_efi.ImageLoadEvent)
+	walk = func(events []*secboot_efi.ImageLoadEvent) {
+		for _, e := range events {
+			if len(e.Next) > 0 {
+				walk(e.Next)
+				continue
+			}
+			if seen[e.Image.String()] {
+				continue
+			}
+			seen[e.Image.String()] = true
+			images = append(images, e.Image)
+		}
+	}
+	walk(sequences)
+
+	return images
+}
+
+func addSecureBootPolicyProfile(profile *secboot_tpm2.PCRProtectionProfile, params *Params) error {
+	sbpParams := secboot_efi.SecureBootPolicyProfileParams{
+		PCRAlgorithm:  params.PCRAlgorithm,
+		LoadSequences: params.LoadSequences,
+		Environment:   params.Environment}
+	if err := secboot_efi.AddSecureBootPolicyProfile(profile, &sbpParams); err != nil {
+		return xerrors.Errorf("cannot add secure boot policy profile: %w", err)
+	}
+	return nil
+}
+
+func addBootManagerProfile(profile *secboot_tpm2.PCRProtectionProfile, params *Params) error {
+	bmParams := secboot_efi.BootManagerProfileParams{
+		PCRAlgorithm:  params.PCRAlgorithm,
+		LoadSequences: params.LoadSequences,
+		Environment:   params.Environment,
+		DigestCache:   params.DigestCache}
+	if err := secboot_efi.AddBootManagerProfile(profile, &bmParams); err != nil {
+		return xerrors.Errorf("cannot add boot manager profile: %w", err)
+	}
+	return nil
+}
+
+func addKernelCmdlineProfile(profile *secboot_tpm2.PCRProtectionProfile, params *Params) error {
+	sdstubParams := secboot_efi.SystemdStubProfileParams{
+		PCRAlgorithm:   params.PCRAlgorithm,
+		PCRIndex:       kernelCmdlinePCR,
+		KernelCmdlines: params.KernelCmdlines}
+	if err := secboot_efi.AddSystemdStubProfile(profile, &sdstubParams); err != nil {
+		return xerrors.Errorf("cannot add systemd EFI stub profile: %w", err)
+	}
+	return nil
+}
+
+func addSnapModelProfile(profile *secboot_tpm2.PCRProtectionProfile, params *Params) error {
+	smParams := secboot_tpm2.SnapModelProfileParams{
+		PCRAlgorithm: params.PCRAlgorithm,
+		PCRIndex:     snapModelPCR,
+		Models:       params.Models}
+	if err := secboot_tpm2.AddSnapModelProfile(profile, &smParams); err != nil {
+		return xerrors.Errorf("cannot add snap model profile: %w", err)
+	}
+	return nil
+}
+
+func addPreventReuseProfile(profile *secboot_tpm2.PCRProtectionProfile, params *Params) {
+	for _, m := range params.PreventReuseMeasurements {
+		secboot_tpm2.AddMeasurementToPreventReuseProfile(profile, params.PCRAlgorithm, m.PCR, m.EventData)
+	}
+}
+
+// UC20Default returns the profile used by Ubuntu Core 20 and later, which protects a key with
+// the secure boot policy (PCR 7), and the kernel commandline measured by the systemd EFI stub
+// followed by the system epoch and model measured by snap-bootstrap (PCR 12). The
+// LoadSequences, KernelCmdlines and Models fields of params are required.
+func UC20Default(params *Params) (*secboot_tpm2.PCRProtectionProfile, error) {
+	if err := params.checkLoadSequences(); err != nil {
+		return nil, err
+	}
+	if err := params.checkKernelCmdlines(); err != nil {
+		return nil, err
+	}
+	if err := params.checkModels(); err != nil {
+		return nil, err
+	}
+
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	if err := addSecureBootPolicyProfile(profile, params); err != nil {
+		return nil, err
+	}
+	if err := addKernelCmdlineProfile(profile, params); err != nil {
+		return nil, err
+	}
+	if err := addSnapModelProfile(profile, params); err != nil {
+		return nil, err
+	}
+	addPreventReuseProfile(profile, params)
+	return profile, nil
+}
+
+// ClassicShimGrub returns a profile for a classic shim -> GRUB -> kernel boot chain, which
+// protects a key with the boot manager code (PCR 4), the secure boot policy (PCR 7) and the
+// kernel commandline (PCR 12). Binding to PCR 4 means that the key can only be recovered by
+// the exact set of boot components described by params, rather than any that are signed by
+// a trusted authority. The LoadSequences and KernelCmdlines fields of params are required.
+func ClassicShimGrub(params *Params) (*secboot_tpm2.PCRProtectionProfile, error) {
+	if err := params.checkLoadSequences(); err != nil {
+		return nil, err
+	}
+	if err := params.checkKernelCmdlines(); err != nil {
+		return nil, err
+	}
+
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	if err := addBootManagerProfile(profile, params); err != nil {
+		return nil, err
+	}
+	if err := addSecureBootPolicyProfile(profile, params); err != nil {
+		return nil, err
+	}
+	if err := addKernelCmdlineProfile(profile, params); err != nil {
+		return nil, err
+	}
+	addPreventReuseProfile(profile, params)
+	return profile, nil
+}
+
+// UKI returns a profile for booting unified kernel images with systemd-stub, which protects a
+// key with the secure boot policy (PCR 7) and the sections of the unified kernel image that
+// systemd-stub measures (PCR 11). The unified kernel images are the last image in each of the
+// load sequences supplied via the LoadSequences field of params, which is required.
+func UKI(params *Params) (*secboot_tpm2.PCRProtectionProfile, error) {
+	if err := params.checkLoadSequences(); err != nil {
+		return nil, err
+	}
+
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	if err := addSecureBootPolicyProfile(profile, params); err != nil {
+		return nil, err
+	}
+
+	ukiParams := secboot_efi.UKIProfileParams{
+		PCRAlgorithm: params.PCRAlgorithm,
+		Images:       leafImages(params.LoadSequences)}
+	if err := secboot_efi.AddUKIProfile(profile, &ukiParams); err != nil {
+		return nil, xerrors.Errorf("cannot add unified kernel image profile: %w", err)
+	}
+	addPreventReuseProfile(profile, params)
+	return profile, nil
+}
+
+// FirmwareStrict returns a profile that protects a key with the platform firmware (PCR 0), the
+// UEFI drivers and applications loaded from add-in devices (PCR 2), the boot manager code (PCR 4)
+// and the secure boot policy (PCR 7). The PCR 0 and PCR 2 values are taken from the current
+// boot, so the key cannot be recovered after a firmware update or a change of add-in devices
+// without updating the PCR policy first. The LoadSequences field of params is required.
+func FirmwareStrict(params *Params) (*secboot_tpm2.PCRProtectionProfile, error) {
+	if err := params.checkLoadSequences(); err != nil {
+		return nil, err
+	}
+
+	fwParams := secboot_efi.FirmwareProfileParams{
+		PCRAlgorithm: params.PCRAlgorithm,
+		Environment:  params.Environment}
+
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	if err := secboot_efi.AddPlatformFirmwareProfile(profile, &fwParams); err != nil {
+		return nil, xerrors.Errorf("cannot add platform firmware profile: %w", err)
+	}
+	if err := secboot_efi.AddDriversAndAppsProfile(profile, &fwParams); err != nil {
+		return nil, xerrors.Errorf("cannot add drivers and apps profile: %w", err)
+	}
+	if err := addBootManagerProfile(profile, params); err != nil {
+		return nil, err
+	}
+	if err := addSecureBootPolicyProfile(profile, params); err != nil {
+		return nil, err
+	}
+	addPreventReuseProfile(profile, params)
+	return profile, nil
+}
@@ -0,0 +1,137 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package presets_test
+
+import (
+	"crypto"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	secboot_efi "github.com/snapcore/secboot/efi"
+	. "github.com/snapcore/secboot/efi/presets"
+	"github.com/snapcore/secboot/internal/testutil"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type presetsSuite struct{}
+
+var _ = Suite(&presetsSuite{})
+
+func (s *presetsSuite) makeModel(c *C) secboot.SnapModel {
+	return testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+		"authority-id": "fake-brand",
+		"series":       "16",
+		"brand-id":     "fake-brand",
+		"model":        "fake-model",
+		"grade":        "secured",
+	}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")
+}
+
+func (s *presetsSuite) TestLeafImages(c *C) {
+	kernel1 := &secboot_efi.ImageLoadEvent{Source: secboot_efi.Shim, Image: secboot_efi.FileImage("kernel1.efi")}
+	kernel2 := &secboot_efi.ImageLoadEvent{Source: secboot_efi.Shim, Image: secboot_efi.FileImage("kernel2.efi")}
+	sequences := []*secboot_efi.ImageLoadEvent{
+		{
+			Source: secboot_efi.Firmware,
+			Image:  secboot_efi.FileImage("shim.efi"),
+			Next: []*secboot_efi.ImageLoadEvent{
+				{
+					Source: secboot_efi.Shim,
+					Image:  secboot_efi.FileImage("grub1.efi"),
+					Next:   []*secboot_efi.ImageLoadEvent{kernel1, kernel2}},
+				{
+					Source: secboot_efi.Shim,
+					Image:  secboot_efi.FileImage("grub2.efi"),
+					Next:   []*secboot_efi.ImageLoadEvent{kernel1}}}},
+		{
+			Source: secboot_efi.Firmware,
+			Image:  secboot_efi.FileImage("uki.efi")}}
+
+	c.Check(LeafImages(sequences), DeepEquals, []secboot_efi.Image{
+		secboot_efi.FileImage("kernel1.efi"),
+		secboot_efi.FileImage("kernel2.efi"),
+		secboot_efi.FileImage("uki.efi")})
+}
+
+func (s *presetsSuite) TestMissingParams(c *C) {
+	sequences := []*secboot_efi.ImageLoadEvent{{Source: secboot_efi.Firmware, Image: secboot_efi.FileImage("shim.efi")}}
+	models := []secboot.SnapModel{s.makeModel(c)}
+
+	for _, t := range []struct {
+		fn     func(*Params) (*secboot_tpm2.PCRProtectionProfile, error)
+		params *Params
+		err    string
+	}{
+		{fn: UC20Default, params: &Params{PCRAlgorithm: tpm2.HashAlgorithmSHA256, KernelCmdlines: []string{"foo"}, Models: models}, err: "no load sequences specified"},
+		{fn: UC20Default, params: &Params{PCRAlgorithm: tpm2.HashAlgorithmSHA256, LoadSequences: sequences, Models: models}, err: "no kernel commandlines specified"},
+		{fn: UC20Default, params: &Params{PCRAlgorithm: tpm2.HashAlgorithmSHA256, LoadSequences: sequences, KernelCmdlines: []string{"foo"}}, err: "no models specified"},
+		{fn: ClassicShimGrub, params: &Params{PCRAlgorithm: tpm2.HashAlgorithmSHA256, KernelCmdlines: []string{"foo"}}, err: "no load sequences specified"},
+		{fn: ClassicShimGrub, params: &Params{PCRAlgorithm: tpm2.HashAlgorithmSHA256, LoadSequences: sequences}, err: "no kernel commandlines specified"},
+		{fn: UKI, params: &Params{PCRAlgorithm: tpm2.HashAlgorithmSHA256}, err: "no load sequences specified"},
+		{fn: FirmwareStrict, params: &Params{PCRAlgorithm: tpm2.HashAlgorithmSHA256}, err: "no load sequences specified"},
+	} {
+		_, err := t.fn(t.params)
+		c.Check(err, ErrorMatches, t.err)
+	}
+}
+
+func (s *presetsSuite) TestAddPreventReuseProfile(c *C) {
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	AddPreventReuseProfile(profile, &Params{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		PreventReuseMeasurements: []PreventReuseMeasurement{
+			{PCR: 12, EventData: []byte("run-key-unsealed")},
+			{PCR: 12, EventData: []byte("save-key-unsealed")}}})
+
+	expected := make(tpm2.Digest, 32)
+	for _, e := range []string{"run-key-unsealed", "save-key-unsealed"} {
+		h := crypto.SHA256.New()
+		h.Write([]byte(e))
+		digest := h.Sum(nil)
+
+		h = crypto.SHA256.New()
+		h.Write(expected)
+		h.Write(digest)
+		expected = h.Sum(nil)
+	}
+
+	values, err := profile.ComputePCRValues(nil)
+	c.Assert(err, IsNil)
+	c.Check(values, DeepEquals, []tpm2.PCRValues{{tpm2.HashAlgorithmSHA256: {12: expected}}})
+}
+
+func (s *presetsSuite) TestAddSnapModelProfile(c *C) {
+	// Test that the snap-bootstrap measurements are added to PCR 12.
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	c.Check(AddSnapModelProfile(profile, &Params{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		Models:       []secboot.SnapModel{s.makeModel(c)}}), IsNil)
+
+	values, err := profile.ComputePCRValues(nil)
+	c.Assert(err, IsNil)
+	c.Check(values, DeepEquals, []tpm2.PCRValues{{tpm2.HashAlgorithmSHA256: {
+		12: testutil.DecodeHexString(c, "bd7851fd994a7f899364dbc96a95dffeaa250cd7ea33b4b6c313866169e779bc")}}})
+}
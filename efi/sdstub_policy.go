@@ -25,6 +25,8 @@ import (
 	"github.com/canonical/go-tpm2"
 	"github.com/canonical/tcglog-parser"
 
+	"golang.org/x/xerrors"
+
 	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
 )
 
@@ -40,6 +42,15 @@ type SystemdStubProfileParams struct {
 
 	// KernelCmdlines is the set of kernel commandlines to add to the PCR profile.
 	KernelCmdlines []string
+
+	// BootAssetsDir is an optional directory containing boot assets from which to obtain
+	// additional kernel commandlines to add to the PCR profile. See
+	// ReadKernelCmdlinesFromBootAssets.
+	BootAssetsDir string
+
+	// BootAssetsVariables contains the values of variables to use when obtaining kernel
+	// commandlines from BootAssetsDir.
+	BootAssetsVariables map[string][]string
 }
 
 // AddSystemdStubProfile adds the systemd EFI linux loader stub profile to the PCR protection profile, in order to generate a
@@ -48,17 +59,36 @@ type SystemdStubProfileParams struct {
 //
 // The PCR index that the EFI stub measures the kernel commandline too can be specified via the PCRIndex field of params.
 //
-// The set of kernel commandlines to add to the PCRProtectionProfile is specified via the KernelCmdlines field of params.
+// The set of kernel commandlines to add to the PCRProtectionProfile is specified via the KernelCmdlines field of params. Additional
+// commandlines can be obtained automatically from the boot assets in the directory specified via the BootAssetsDir field of
+// params.
 func AddSystemdStubProfile(profile *secboot_tpm2.PCRProtectionProfile, params *SystemdStubProfileParams) error {
 	if params.PCRIndex < 0 {
 		return errors.New("invalid PCR index")
 	}
-	if len(params.KernelCmdlines) == 0 {
+
+	cmdlines := append([]string(nil), params.KernelCmdlines...)
+	if params.BootAssetsDir != "" {
+		c, err := ReadKernelCmdlinesFromBootAssets(params.BootAssetsDir, params.BootAssetsVariables)
+		if err != nil {
+			return xerrors.Errorf("cannot obtain kernel commandlines from boot assets: %w", err)
+		}
+	Loop:
+		for _, cmdline := range c {
+			for _, existing := range cmdlines {
+				if cmdline == existing {
+					continue Loop
+				}
+			}
+			cmdlines = append(cmdlines, cmdline)
+		}
+	}
+	if len(cmdlines) == 0 {
 		return errors.New("no kernel commandlines specified")
 	}
 
 	var subProfiles []*secboot_tpm2.PCRProtectionProfile
-	for _, cmdline := range params.KernelCmdlines {
+	for _, cmdline := range cmdlines {
 		digest := tcglog.ComputeSystemdEFIStubCommandlineDigest(params.PCRAlgorithm.GetHash(), cmdline)
 		subProfiles = append(subProfiles, secboot_tpm2.NewPCRProtectionProfile().ExtendPCR(params.PCRAlgorithm, params.PCRIndex, digest))
 	}
@@ -20,6 +20,8 @@
 package efi_test
 
 import (
+	"path/filepath"
+
 	"github.com/canonical/go-tpm2"
 
 	. "gopkg.in/check.v1"
@@ -154,3 +156,31 @@ func (s *sdstubPolicySuite) TestAddSystemdStubProfileWithInitialProfile(c *C) {
 			},
 		}})
 }
+
+func (s *sdstubPolicySuite) TestAddSystemdStubProfileFromBootAssets(c *C) {
+	// Test that AddSystemdStubProfile produces the same digests as
+	// TestAddSystemdStubProfileUC20 when the commandlines are obtained
+	// from the boot assets.
+	dir := c.MkDir()
+	writeBootAssetFile(c, filepath.Join(dir, "EFI/ubuntu/grub.cfg"), testUC20GrubCfg)
+
+	s.testAddSystemdStubProfile(c, &testAddSystemdStubProfileData{
+		params: SystemdStubProfileParams{
+			PCRAlgorithm:        tpm2.HashAlgorithmSHA256,
+			PCRIndex:            12,
+			BootAssetsDir:       dir,
+			BootAssetsVariables: map[string][]string{"snapd_recovery_mode": {"run", "recover"}},
+		},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					12: testutil.DecodeHexString(c, "fc433eaf039c6261f496a2a5bf2addfd8ff1104b0fc98af3fe951517e3bde824"),
+				},
+			},
+			{
+				tpm2.HashAlgorithmSHA256: {
+					12: testutil.DecodeHexString(c, "b3a29076eeeae197ae721c254da40480b76673038045305cfa78ec87421c4eea"),
+				},
+			},
+		}})
+}
@@ -23,7 +23,6 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/x509"
-	"encoding/asn1"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -41,8 +40,7 @@ import (
 
 	"golang.org/x/xerrors"
 
-	"go.mozilla.org/pkcs7"
-
+	"github.com/snapcore/secboot/efi/signature"
 	"github.com/snapcore/secboot/internal/pe1.14"
 	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
 )
@@ -55,9 +53,15 @@ const (
 	sbStateName = "SecureBoot" // Unicode variable name for the EFI secure boot configuration (enabled/disabled)
 
 	mokListName    = "MokList"    // Unicode variable name for the shim MOK database
+	mokListRTName  = "MokListRT"  // Unicode variable name for the runtime copy of the shim MOK database
+	mokListXRTName = "MokListXRT" // Unicode variable name for the runtime copy of the shim MOK forbidden database
 	mokSbStateName = "MokSBState" // Unicode variable name for the shim secure boot configuration (validation enabled/disabled)
 	sbatName       = "SbatLevel"  // Unicode variable name for the SBAT variable
 	shimName       = "Shim"       // Unicode variable name used for recording events when shim's vendor certificate is used for verification
+	vendorDbName   = "vendor_db"  // Unicode variable name used for recording events when shim's vendor database is used for verification
+
+	// shimLegacySbatLevel is the SBAT level payload applied by SBAT capable shims that predate the .sbatlevel section.
+	shimLegacySbatLevel = "sbat,1,2021030218\n"
 
 	secureBootPCR = 7 // Secure Boot Policy Measurements PCR
 
@@ -67,8 +71,6 @@ const (
 var (
 	shimGuid = efi.MakeGUID(0x605dab50, 0xe046, 0x4300, 0xabb6, [...]uint8{0x3d, 0xd8, 0x10, 0xdd, 0x8b, 0x23}) // SHIM_LOCK_GUID
 
-	oidSha256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
-
 	efiVarsPath = "/sys/firmware/efi/efivars" // Default mount point for efivarfs
 )
 
@@ -150,6 +152,63 @@ func (s *shimImageHandle) hasSbatSection() bool {
 	return s.openSection(".sbat") != nil
 }
 
+// readSbatLevel obtains the "previous" and "latest" SBAT level payloads from the .sbatlevel section of this shim image,
+// which exists in shim 15.7 and later. If the section doesn't exist, nil payloads are returned.
+func (s *shimImageHandle) readSbatLevel() (previous, latest []byte, err error) {
+	section := s.openSection(".sbatlevel")
+	if section == nil {
+		return nil, nil, nil
+	}
+	return readShimSbatLevelSection(section)
+}
+
+// readShimSbatLevelSection decodes the contents of shim's .sbatlevel section. This starts with a
+// format version, followed by the offsets of the "previous" and "latest" payloads, which are NULL
+// terminated strings. The offsets are relative to the end of the format version field.
+func readShimSbatLevelSection(r io.ReaderAt) (previous, latest []byte, err error) {
+	var hdr struct {
+		Version        uint32
+		PreviousOffset uint32
+		LatestOffset   uint32
+	}
+	if err := binary.Read(io.NewSectionReader(r, 0, 12), binary.LittleEndian, &hdr); err != nil {
+		return nil, nil, xerrors.Errorf("cannot read header: %w", err)
+	}
+	if hdr.Version != 0 {
+		return nil, nil, fmt.Errorf("unexpected version %d", hdr.Version)
+	}
+
+	readPayload := func(offset uint32) ([]byte, error) {
+		payload, err := bufio.NewReader(io.NewSectionReader(r, 4+int64(offset), 1<<32)).ReadBytes(0)
+		if err != nil {
+			return nil, err
+		}
+		return payload[:len(payload)-1], nil
+	}
+
+	previous, err = readPayload(hdr.PreviousOffset)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot read previous payload: %w", err)
+	}
+	latest, err = readPayload(hdr.LatestOffset)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot read latest payload: %w", err)
+	}
+
+	return previous, latest, nil
+}
+
+// sbatLevelDatestamp returns the datestamp from the header line of the supplied SBAT level payload,
+// which has the form "sbat,1,<datestamp>". Datestamps can be compared lexically.
+func sbatLevelDatestamp(level []byte) string {
+	line := strings.SplitN(string(level), "\n", 2)[0]
+	fields := strings.Split(line, ",")
+	if len(fields) < 3 || fields[0] != "sbat" {
+		return ""
+	}
+	return fields[2]
+}
+
 type sigDbUpdateQuirkMode int
 
 const (
@@ -231,10 +290,26 @@ func computeDbUpdate(base, update io.Reader, quirkMode sigDbUpdateQuirkMode) ([]
 	return buf.Bytes(), nil
 }
 
-// secureBootDbUpdate corresponds to an on-disk EFI signature database update.
+// secureBootDbUpdate corresponds to an EFI signature database update, either on-disk or
+// supplied directly via SecureBootPolicyProfileParams.
 type secureBootDbUpdate struct {
 	db   string
 	path string
+	data []byte
+}
+
+func (u *secureBootDbUpdate) String() string {
+	if u.data != nil {
+		return "supplied " + u.db + " update"
+	}
+	return u.path
+}
+
+func (u *secureBootDbUpdate) open() (io.ReadCloser, error) {
+	if u.data != nil {
+		return ioutil.NopCloser(bytes.NewReader(u.data)), nil
+	}
+	return os.Open(u.path)
 }
 
 // buildSignatureDbUpdateList builds a list of EFI signature database updates that will be applied by sbkeysync when executed with
@@ -348,6 +423,17 @@ func isShimExecutable(r io.ReaderAt) (bool, error) {
 	return pefile.Section(".vendor_cert") != nil, nil
 }
 
+// SignatureDbUpdate corresponds to a pending update to one of the EFI signature databases.
+type SignatureDbUpdate struct {
+	// Name is the unicode name of the signature database that the update applies to.
+	// This must be one of "PK", "KEK", "db" or "dbx".
+	Name string
+
+	// Data is the update payload, which is an authenticated EFI_SIGNATURE_LIST as
+	// passed to SetVariable with the EFI_VARIABLE_APPEND_WRITE attribute. It must not be empty.
+	Data []byte
+}
+
 // SecureBootPolicyProfileParams provide the arguments to AddSecureBootPolicyProfile.
 type SecureBootPolicyProfileParams struct {
 	// PCRAlgorithm is the algorithm for which to compute PCR digests for. TPMs compliant with the "TCG PC Client Platform TPM Profile
@@ -362,6 +448,14 @@ type SecureBootPolicyProfileParams struct {
 	// for. These directories are passed to sbkeysync using the --keystore option.
 	SignatureDbUpdateKeystores []string
 
+	// SignatureDbUpdates is a list of pending EFI signature database updates for which to compute PCR digests for, such as
+	// those obtained from fwupd. These are applied in order after any updates found in SignatureDbUpdateKeystores.
+	SignatureDbUpdates []*SignatureDbUpdate
+
+	// MokList is an optional machine owner key (MOK) database to use in place of the one read from the MokListRT variable
+	// in the host environment. Images that are loaded by shim can be authenticated by certificates in this database.
+	MokList efi.SignatureDatabase
+
 	// Environment is an optional parameter that allows the caller to provide
 	// a custom EFI environment. If not set, the host's normal environment will
 	// be used
@@ -375,6 +469,15 @@ type secureBootDb struct {
 	db           efi.SignatureDatabase
 }
 
+// isVendorCert determines whether this database corresponds to shim's built-in vendor certificate and
+// that certificate is the supplied one.
+func (d *secureBootDb) isVendorCert(cert *x509.Certificate) bool {
+	if d == nil || d.unicodeName != shimName || len(d.db) == 0 || len(d.db[0].Signatures) == 0 {
+		return false
+	}
+	return bytes.Equal(d.db[0].Signatures[0].Data, cert.Raw)
+}
+
 // secureBootDbSet corresponds to a set of EFI signature databases.
 type secureBootDbSet struct {
 	uefiDb *secureBootDb
@@ -387,11 +490,6 @@ type secureBootAuthority struct {
 	source    *secureBootDb
 }
 
-type authenticodeSignerAndIntermediates struct {
-	signer        *x509.Certificate
-	intermediates *x509.CertPool
-}
-
 // secureBootPolicyGen is the main structure involved with computing secure boot policy PCR digests. It is essentially just
 // a container for SecureBootPolicyProfileParams - per-branch context is maintained in secureBootPolicyGenBranch instead.
 type secureBootPolicyGen struct {
@@ -401,6 +499,9 @@ type secureBootPolicyGen struct {
 
 	events       []*tcglog.Event
 	sigDbUpdates []*secureBootDbUpdate
+
+	mokDb     *secureBootDb         // The MOK database, used for images authenticated by shim
+	mokDenyDb efi.SignatureDatabase // The MOK forbidden database, used for images authenticated by shim
 }
 
 // secureBootPolicyGenBranch represents a branch of a PCRProtectionProfile. It contains its own PCRProtectionProfile in to which
@@ -471,6 +572,31 @@ func (b *secureBootPolicyGenBranch) computeAndExtendVariableMeasurement(varName
 	b.extendMeasurement(tcglog.ComputeEFIVariableDataDigest(b.gen.pcrAlgorithm.GetHash(), unicodeName, varName, varData))
 }
 
+// PCRAlgorithm implements ImageLoadContext.PCRAlgorithm.
+func (b *secureBootPolicyGenBranch) PCRAlgorithm() tpm2.HashAlgorithmId {
+	return b.gen.pcrAlgorithm
+}
+
+// MeasureVariable implements ImageLoadContext.MeasureVariable.
+func (b *secureBootPolicyGenBranch) MeasureVariable(guid efi.GUID, name string, data []byte) {
+	if b.profile == nil {
+		// This branch is going to be excluded because it is unbootable.
+		return
+	}
+	b.computeAndExtendVariableMeasurement(guid, name, data)
+}
+
+// SetVerificationDb implements ImageLoadContext.SetVerificationDb.
+func (b *secureBootPolicyGenBranch) SetVerificationDb(guid efi.GUID, name string, db efi.SignatureDatabase) {
+	if b.profile == nil {
+		// This branch is going to be excluded because it is unbootable.
+		return
+	}
+	b.dbSet.shimDb = &secureBootDb{variableName: guid, unicodeName: name, db: db}
+	b.shimVerificationEvents = nil
+	b.shimFlags = shimVariableAuthorityEventsMatchSpec
+}
+
 // processSignatureDbMeasurementEvent computes a EFI signature database measurement for the specified database and with the supplied
 // updates, and then extends that in to this branch.
 func (b *secureBootPolicyGenBranch) processSignatureDbMeasurementEvent(guid efi.GUID, name string, updates []*secureBootDbUpdate, updateQuirkMode sigDbUpdateQuirkMode) ([]byte, error) {
@@ -483,13 +609,16 @@ func (b *secureBootPolicyGenBranch) processSignatureDbMeasurementEvent(guid efi.
 		if u.db != name {
 			continue
 		}
-		if f, err := os.Open(u.path); err != nil {
+		r, err := u.open()
+		if err != nil {
 			return nil, xerrors.Errorf("cannot open signature DB update: %w", err)
-		} else if d, err := computeDbUpdate(bytes.NewReader(db), f, updateQuirkMode); err != nil {
-			return nil, xerrors.Errorf("cannot compute signature DB update for %s: %w", u.path, err)
-		} else {
-			db = d
 		}
+		d, err := computeDbUpdate(bytes.NewReader(db), r, updateQuirkMode)
+		r.Close()
+		if err != nil {
+			return nil, xerrors.Errorf("cannot compute signature DB update for %s: %w", u, err)
+		}
+		db = d
 	}
 
 	b.computeAndExtendVariableMeasurement(guid, name, db)
@@ -575,51 +704,33 @@ func (b *secureBootPolicyGenBranch) processPreOSEvents(events []*tcglog.Event, s
 	return nil
 }
 
-// processShimExecutableLaunch updates the context in this branch with the supplied shim vendor certificate so that it can be used
-// later on when computing verification events in secureBootPolicyGenBranch.computeAndExtendVerificationMeasurement.
-func (b *secureBootPolicyGenBranch) processShimExecutableLaunch(vendorCert []byte, flags shimFlags) {
+// processShimExecutableLaunch updates the context in this branch with the supplied shim vendor database so that it can be used
+// later on when computing verification events in secureBootPolicyGenBranch.computeAndExtendVerificationMeasurement. If the
+// shim performs SBAT verification, a measurement of the supplied SBAT level is also extended in to this branch.
+func (b *secureBootPolicyGenBranch) processShimExecutableLaunch(vendorDb *secureBootDb, sbatLevel []byte, flags shimFlags) {
 	if b.profile == nil {
 		// This branch is going to be excluded because it is unbootable.
 		return
 	}
 
 	if flags&shimHasSbatVerification > 0 {
-		// XXX: This is a bit of a hack, just so that we are compatible with
-		// the latest shim. Some things to note:
-		// - SBAT-capable shim will initialize the SBAT variable to a known
-		//   (compiled in) payload if the variable doesn't exist, has an older
-		//   payload or doesn't have the correct attributes. "Older" right now
-		//   is determined by checking a timestamp in the payload whilst the
-		//   variable is BS+NV and not-authenticated, but would be determined by
-		//   the signature timestamp for an authenticated variable in the future.
-		// - The variable is initialized as BS+NV and then mirrored to a RT
-		//   variable by a SBAT-capable shim, which means we don't know what
-		//   the current variable value is if we are pre-computing a PCR policy
-		//   on a system that was booted with a pre-SBAT shim. This isn't a
-		//   problem right now because there is only one payload, but will be
-		//   a problem in the future as updates are published if the variable
-		//   remains a non-authenticated BS+NV variable as opposed to a RT+BS+NV
-		//   authenticated variable.
-		// - In the future and in order to do this properly, we need an authoritative
-		//   source for the current variable value (eg, event log for BS+NV variable
-		//   or current variable value for RT+BS+NV, like we do for other
-		//   configuration).
-		// - Shim doesn't provide a way to audit the compiled-in SBAT payload, so
-		//   we don't have a way to introspect what it will set it to, although
-		//   we know what it is right now.
-		// - Future PCR value computation will be a bit more complicated than it
-		//   is now - imagine if you have 2 shim's with different built-in SBAT
-		//   payloads, and those are both different to the current SBAT value.
-		//   Because shim will overwrite the SBAT variable if its built-in
-		//   payload is newer, booting with one shim may affect the PCR values
-		//   associated with a branch that has a different shim.
-		b.computeAndExtendVariableMeasurement(shimGuid, sbatName, []byte("sbat,1,2021030218\n"))
-	}
-
-	b.dbSet.shimDb = &secureBootDb{variableName: shimGuid, unicodeName: shimName}
-	if vendorCert != nil {
-		b.dbSet.shimDb.db = efi.SignatureDatabase{&efi.SignatureList{Type: efi.CertX509Guid, Signatures: []*efi.SignatureData{{Data: vendorCert}}}}
-	}
+		// SBAT-capable shim will initialize the SBAT variable to a known
+		// (compiled in) payload if the variable doesn't exist, has an older
+		// payload or doesn't have the correct attributes, and then measures
+		// it. The payload to measure is determined by the caller, from the
+		// shim's .sbatlevel section and the value measured during the current
+		// boot if possible.
+		//
+		// XXX: Shim can be configured via the SbatPolicy variable to apply
+		// its "latest" payload rather than its "previous" one. This isn't
+		// supported here. Also note that because shim will overwrite the SBAT
+		// variable if its built-in payload is newer, booting with one shim may
+		// affect the PCR values associated with a branch that has a different
+		// shim.
+		b.computeAndExtendVariableMeasurement(shimGuid, sbatName, sbatLevel)
+	}
+
+	b.dbSet.shimDb = vendorDb
 	b.shimVerificationEvents = nil
 	b.shimFlags = flags
 }
@@ -650,7 +761,7 @@ func (b *secureBootPolicyGenBranch) hasVerificationEventBeenMeasuredBy(digest tp
 // and the source of that certificate, needs to be determined. If the image is not signed with an authority that is trusted by a CA
 // certificate that exists in this branch, then this branch will be marked as unbootable and it will be omitted from the final PCR
 // profile.
-func (b *secureBootPolicyGenBranch) computeAndExtendVerificationMeasurement(sigs []*authenticodeSignerAndIntermediates, source ImageLoadEventSource) error {
+func (b *secureBootPolicyGenBranch) computeAndExtendVerificationMeasurement(signers []*signature.ImageSigner, source ImageLoadEventSource) error {
 	if b.profile == nil {
 		// This branch is going to be excluded because it is unbootable.
 		return nil
@@ -661,7 +772,18 @@ func (b *secureBootPolicyGenBranch) computeAndExtendVerificationMeasurement(sigs
 		if b.dbSet.shimDb == nil {
 			return errors.New("shim specified as event source without a shim executable appearing in preceding events")
 		}
-		dbs = append(dbs, b.dbSet.mokDb, b.dbSet.shimDb)
+		if b.gen.isDeniedByMok(signers) {
+			// Shim will refuse to load this image, so mark this branch as unbootable.
+			b.profile = nil
+			return nil
+		}
+		// Shim tries its built-in vendor_db before the MOK database, and its built-in
+		// vendor certificate after the MOK database.
+		if b.dbSet.shimDb.unicodeName == vendorDbName {
+			dbs = append(dbs, b.dbSet.shimDb, b.dbSet.mokDb)
+		} else {
+			dbs = append(dbs, b.dbSet.mokDb, b.dbSet.shimDb)
+		}
 	}
 
 	var authority *secureBootAuthority
@@ -671,41 +793,22 @@ func (b *secureBootPolicyGenBranch) computeAndExtendVerificationMeasurement(sigs
 	// in the UEFI specification but it matches EDK2 and the firmware on the Intel NUC. If an implementation iterates over the CA
 	// certificates in an outer loop and the signatures in an inner loop, then this may produce the wrong result.
 Outer:
-	for _, sig := range sigs {
+	for _, signer := range signers {
 		for _, db := range dbs {
 			if db == nil {
 				continue
 			}
 
-			// Iterate over ESLs
-			for _, l := range db.db {
-				// Ignore ESLs that aren't X509 certificates
-				if l.Type != efi.CertX509Guid {
+			// Only the first entry of each X.509 signature list is considered.
+			for _, ca := range signature.PrimaryCertificates(db.db) {
+				if db == b.dbSet.mokDb && b.dbSet.shimDb.isVendorCert(ca.Certificate) {
+					// Newer shims mirror their vendor certificate to MokListRT, but
+					// images authenticated by it are recorded with the Shim authority.
 					continue
 				}
 
-				// Shouldn't happen, but just in case...
-				if len(l.Signatures) == 0 {
-					continue
-				}
-
-				ca, err := x509.ParseCertificate(l.Signatures[0].Data)
-				if err != nil {
-					continue
-				}
-
-				// XXX: This only works if the CA certificate is also the code signing
-				// certificate, or it directly signs the code signing certificate. Ideally
-				// we would use x509.Certificate.Verify here, but there is no way to turn
-				// off time checking and UEFI doesn't consider expired certificates invalid.
-				if bytes.Equal(ca.Raw, sig.signer.Raw) {
-					// The signer certificate is the CA
-					authority = &secureBootAuthority{signature: l.Signatures[0], source: db}
-					break Outer
-				}
-				if err := sig.signer.CheckSignatureFrom(ca); err == nil {
-					// The signer certificate is signed by the CA
-					authority = &secureBootAuthority{signature: l.Signatures[0], source: db}
+				if ca.Authenticates(signer) {
+					authority = &secureBootAuthority{signature: ca.Data, source: db}
 					break Outer
 				}
 			}
@@ -721,9 +824,11 @@ Outer:
 	// Serialize authority certificate for measurement
 	var varData *bytes.Buffer
 	switch {
-	case source == Shim && (b.shimFlags&shimVariableAuthorityEventsMatchSpec == 0 || authority.source == b.dbSet.shimDb):
+	case source == Shim && (b.shimFlags&shimVariableAuthorityEventsMatchSpec == 0 || authority.source.unicodeName == shimName):
 		// Shim measures the certificate data rather than the entire EFI_SIGNATURE_DATA
-		// in some circumstances.
+		// in some circumstances, such as when the image is authenticated by a built-in
+		// vendor certificate. Images authenticated by a built-in vendor_db are measured
+		// in the same way as images authenticated by db.
 		varData = bytes.NewBuffer(authority.signature.Data)
 	default:
 		// Firmware always measures the entire EFI_SIGNATURE_DATA including the SignatureOwner,
@@ -775,105 +880,86 @@ func (e *sbLoadEventAndBranches) branch(event *ImageLoadEvent) *sbLoadEventAndBr
 // certificate for a particular branch, then that branch will be marked as unbootable and it will be omitted from the final PCR
 // profile.
 func (g *secureBootPolicyGen) computeAndExtendVerificationMeasurement(branches []*secureBootPolicyGenBranch, r io.ReaderAt, source ImageLoadEventSource) error {
-	pefile, err := pe.NewFile(r)
+	signers, err := signature.ReadImageSigners(r)
 	if err != nil {
-		return xerrors.Errorf("cannot decode PE binary: %w", err)
-	}
-
-	// Obtain security directory entry from optional header
-	var dd []pe.DataDirectory
-	switch oh := pefile.OptionalHeader.(type) {
-	case *pe.OptionalHeader32:
-		dd = oh.DataDirectory[0:oh.NumberOfRvaAndSizes]
-	case *pe.OptionalHeader64:
-		dd = oh.DataDirectory[0:oh.NumberOfRvaAndSizes]
-	default:
-		return errors.New("cannot obtain security directory entry from PE binary: no optional header")
+		return err
 	}
 
-	if len(dd) <= certTableIndex {
-		return errors.New("cannot obtain security directory entry from PE binary: invalid number of data directories")
+	if len(signers) == 0 {
+		return errors.New("no Authenticode signatures")
 	}
 
-	// Create a reader for the security directory entry, which points to a WIN_CERTIFICATE struct
-	certReader := io.NewSectionReader(r, int64(dd[certTableIndex].VirtualAddress), int64(dd[certTableIndex].Size))
-
-	// Binaries can have multiple signers - this is achieved using multiple single-signed Authenticode signatures - see section 32.5.3.3
-	// ("Secure Boot and Driver Signing - UEFI Image Validation - Signature Database Update - Authorization Process") of the UEFI
-	// Specification, version 2.8.
-	var sigs []*authenticodeSignerAndIntermediates
-
-Outer:
-	for {
-		// Signatures in this section are 8-byte aligned - see the PE spec:
-		// https://docs.microsoft.com/en-us/windows/win32/debug/pe-format#the-attribute-certificate-table-image-only
-		off, _ := certReader.Seek(0, io.SeekCurrent)
-		alignSize := (8 - (off & 7)) % 8
-		certReader.Seek(alignSize, io.SeekCurrent)
-
-		c, err := efi.ReadWinCertificate(certReader)
-		switch {
-		case xerrors.Is(err, io.EOF):
-			break Outer
-		case err != nil:
-			return xerrors.Errorf("cannot decode WIN_CERTIFICATE from security directory entry of PE binary: %w", err)
+	for _, b := range branches {
+		if err := b.computeAndExtendVerificationMeasurement(signers, source); err != nil {
+			return err
 		}
+	}
 
-		if _, ok := c.(efi.WinCertificateAuthenticode); !ok {
-			return errors.New("unexpected WIN_CERTIFICATE type: not an Authenticode signature")
-		}
+	return nil
+}
 
-		// Decode the signature
-		p7, err := pkcs7.Parse(c.(efi.WinCertificateAuthenticode))
-		if err != nil {
-			return xerrors.Errorf("cannot decode signature: %w", err)
+// isDeniedByMok determines whether an image with the supplied signatures will be rejected by shim because
+// one of the signing certificates is, or is directly signed by, a certificate in the MOK forbidden database.
+func (g *secureBootPolicyGen) isDeniedByMok(signers []*signature.ImageSigner) bool {
+	for _, cert := range signature.Certificates(g.mokDenyDb) {
+		for _, signer := range signers {
+			if cert.Authenticates(signer) {
+				return true
+			}
 		}
+	}
+	return false
+}
 
-		// Grab the certificate of the signer
-		signer := p7.GetOnlySigner()
-		if signer == nil {
-			return errors.New("cannot obtain signer certificate from signature")
+// currentSbatLevel returns the SBAT level that was measured by shim during the current boot, or nil if
+// there isn't one.
+func (g *secureBootPolicyGen) currentSbatLevel() []byte {
+	for _, e := range g.events {
+		if e.PCRIndex != secureBootPCR || e.EventType != tcglog.EventTypeEFIVariableAuthority {
+			continue
 		}
-
-		// Reject any signature with a digest algorithm other than SHA256, as that's the only algorithm used for binaries we're
-		// expected to support, and therefore required by the UEFI implementation.
-		if !p7.Signers[0].DigestAlgorithm.Algorithm.Equal(oidSha256) {
-			return errors.New("signature has unexpected digest algorithm")
+		data, ok := e.Data.(*tcglog.EFIVariableData)
+		if !ok {
+			continue
 		}
-
-		// Grab all of the certificates in the signature and populate an intermediates pool
-		intermediates := x509.NewCertPool()
-		for _, c := range p7.Certificates {
-			intermediates.AddCert(c)
+		if data.VariableName == shimGuid && data.UnicodeName == sbatName {
+			return data.VariableData
 		}
-
-		sigs = append(sigs, &authenticodeSignerAndIntermediates{signer: p7.GetOnlySigner(), intermediates: intermediates})
-	}
-
-	if len(sigs) == 0 {
-		return errors.New("no Authenticode signatures")
 	}
+	return nil
+}
 
-	for _, b := range branches {
-		if err := b.computeAndExtendVerificationMeasurement(sigs, source); err != nil {
-			return err
-		}
-	}
+// shimImageLoadHandler is the built-in ImageLoadHandler for shim.
+type shimImageLoadHandler struct {
+	vendorDb *secureBootDb
+	flags    shimFlags
 
-	return nil
+	// sbatLevel is the "previous" payload from the .sbatlevel section, or nil
+	// if the shim predates this section.
+	sbatLevel []byte
 }
 
-// processShimExecutableLaunch extracts the vendor certificate from the shim executable read from r, and then updates the specified
-// branches to contain a reference to the vendor certificate so that it can be used later on when computing verification events in
-// secureBootPolicyGen.computeAndExtendVerificationMeasurement for images that are authenticated by shim.
-func (g *secureBootPolicyGen) processShimExecutableLaunch(branches []*secureBootPolicyGenBranch, shim *shimImageHandle) error {
+// newShimImageLoadHandlerFromHandle extracts the vendor certificate or vendor database and the SBAT level from the supplied shim
+// executable so that they can be applied to each branch when the shim is launched.
+func newShimImageLoadHandlerFromHandle(shim *shimImageHandle) (*shimImageLoadHandler, error) {
 	// Extract this shim's vendor cert
 	vendorCert, err := shim.readVendorCert()
 	if err != nil {
-		return xerrors.Errorf("cannot extract vendor certificate: %w", err)
+		return nil, xerrors.Errorf("cannot extract vendor certificate: %w", err)
 	}
 
-	var flags shimFlags
+	vendorDb := &secureBootDb{variableName: shimGuid, unicodeName: shimName}
+	if vendorCert != nil {
+		// Newer shims can be built with a vendor_db, which is a list of
+		// EFI_SIGNATURE_LISTs, in place of the vendor_cert.
+		if db, err := efi.ReadSignatureDatabase(bytes.NewReader(vendorCert)); err == nil && len(db) > 0 {
+			vendorDb = &secureBootDb{variableName: efi.ImageSecurityDatabaseGuid, unicodeName: vendorDbName, db: db}
+		} else {
+			vendorDb.db = efi.SignatureDatabase{&efi.SignatureList{Type: efi.CertX509Guid, Signatures: []*efi.SignatureData{{Data: vendorCert}}}}
+		}
+	}
+
+	h := &shimImageLoadHandler{vendorDb: vendorDb}
 
 	// Check if this shim has a .sbat section. We use this to make some assumptions
 	// about shim's behaviour below.
@@ -883,26 +969,58 @@ func (g *secureBootPolicyGen) processShimExecutableLaunch(branches []*secureBoot
 		// If this shim has a .sbat section, assume it also does SBAT verification.
 		// This isn't a perfect heuristic, but nobody is adding a .sbat section to a
 		// pre-SBAT version of shim and then signing it, so it doesn't matter.
-		flags |= shimHasSbatVerification
+		h.flags |= shimHasSbatVerification
 
 		// There isn't a good heuristic for this, but at least none of Canonical's
 		// pre-SBAT shim's had the fix for this, and all SBAT capable shims do
 		// have this fix.
 		// XXX: It's possible that this is broken for shims that weren't signed
 		//  for Canonical.
-		flags |= shimVariableAuthorityEventsMatchSpec
+		h.flags |= shimVariableAuthorityEventsMatchSpec
+
+		previous, _, err := shim.readSbatLevel()
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read SBAT level: %w", err)
+		}
+		h.sbatLevel = previous
 	}
 
-	for _, b := range branches {
-		b.processShimExecutableLaunch(vendorCert, flags)
+	return h, nil
+}
+
+// MeasureImageStart updates the supplied branch to contain a reference to this shim's vendor certificate or vendor database so
+// that it can be used later on when computing verification events in secureBootPolicyGen.computeAndExtendVerificationMeasurement
+// for images that are authenticated by shim.
+func (h *shimImageLoadHandler) MeasureImageStart(ctx ImageLoadContext) error {
+	b, ok := ctx.(*secureBootPolicyGenBranch)
+	if !ok {
+		return errors.New("unexpected context type")
+	}
+
+	var sbatLevel []byte
+	if h.flags&shimHasSbatVerification > 0 {
+		if h.sbatLevel == nil {
+			// This shim predates the .sbatlevel section and has a single
+			// built-in payload.
+			sbatLevel = []byte(shimLegacySbatLevel)
+		} else {
+			// Shim won't replace the current SBAT level with an older one,
+			// so use whichever of the current level and this shim's
+			// "previous" payload is newer.
+			sbatLevel = h.sbatLevel
+			if current := b.gen.currentSbatLevel(); current != nil && sbatLevelDatestamp(current) > sbatLevelDatestamp(h.sbatLevel) {
+				sbatLevel = current
+			}
+		}
 	}
 
+	b.processShimExecutableLaunch(h.vendorDb, sbatLevel, h.flags)
 	return nil
 }
 
 // processOSLoadEvent computes a measurement associated with the supplied image load event and extends this to the specified branches.
-// If the image load corresponds to shim, then some additional processing is performed to extract the included vendor certificate
-// (see secureBootPolicyGen.processShimExecutableLaunch).
+// If there is an ImageLoadHandler for the image, such as the built-in one for shim, then the handler is called for each branch to
+// perform any additional processing associated with the launch of the image (see shimImageLoadHandler.MeasureImageStart).
 func (g *secureBootPolicyGen) processOSLoadEvent(branches []*secureBootPolicyGenBranch, event *ImageLoadEvent) error {
 	r, err := event.Image.Open()
 	if err != nil {
@@ -910,26 +1028,27 @@ func (g *secureBootPolicyGen) processOSLoadEvent(branches []*secureBootPolicyGen
 	}
 	defer r.Close()
 
-	isShim, err := isShimExecutable(r)
+	handler, err := newImageLoadHandler(r)
 	if err != nil {
-		return xerrors.Errorf("cannot determine image type: %w", err)
+		return xerrors.Errorf("cannot create image load handler: %w", err)
 	}
 
 	if err := g.computeAndExtendVerificationMeasurement(branches, r, event.Source); err != nil {
 		return xerrors.Errorf("cannot compute load verification event: %w", err)
 	}
 
-	if !isShim {
+	if handler == nil {
 		return nil
 	}
 
-	shim, err := newShimImageHandle(r)
-	if err != nil {
-		return xerrors.Errorf("cannot create handle for shim image: %w", err)
-	}
-
-	if err := g.processShimExecutableLaunch(branches, shim); err != nil {
-		return xerrors.Errorf("cannot process shim executable: %w", err)
+	for _, b := range branches {
+		if b.profile == nil {
+			// This branch is going to be excluded because it is unbootable.
+			continue
+		}
+		if err := handler.MeasureImageStart(b); err != nil {
+			return xerrors.Errorf("cannot process launch of %s: %w", event.Image, err)
+		}
 	}
 
 	return nil
@@ -942,6 +1061,7 @@ func (g *secureBootPolicyGen) run(profile *secboot_tpm2.PCRProtectionProfile, si
 	var roots []*secureBootPolicyGenBranch
 	for i := 0; i <= len(g.sigDbUpdates); i++ {
 		branch := &secureBootPolicyGenBranch{gen: g, profile: secboot_tpm2.NewPCRProtectionProfile(), dbUpdateLevel: i}
+		branch.dbSet.mokDb = g.mokDb
 		if err := branch.processPreOSEvents(g.events, g.sigDbUpdates[0:i], sigDbUpdateQuirkMode); err != nil {
 			return xerrors.Errorf("cannot process pre-OS events from event log: %w", err)
 		}
@@ -1039,6 +1159,19 @@ func (g *secureBootPolicyGen) run(profile *secboot_tpm2.PCRProtectionProfile, si
 	return nil
 }
 
+// readShimSignatureDb reads the shim signature database with the specified name from the supplied environment. If the
+// variable doesn't exist, an empty database is returned.
+func readShimSignatureDb(env HostEnvironment, name string) (efi.SignatureDatabase, error) {
+	data, _, err := env.ReadVar(name, shimGuid)
+	switch {
+	case err == efi.ErrVariableNotFound:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	return efi.ReadSignatureDatabase(bytes.NewReader(data))
+}
+
 // AddSecureBootPolicyProfile adds the UEFI secure boot policy profile to the provided PCR protection profile, in order to generate
 // a PCR policy that restricts access to a sealed key to a set of UEFI secure boot policies measured to PCR 7. The secure boot policy
 // information that is measured to PCR 7 is defined in section 2.3.4.8 of the "TCG PC Client Platform Firmware Profile Specification".
@@ -1093,7 +1226,11 @@ func (g *secureBootPolicyGen) run(profile *secboot_tpm2.PCRProtectionProfile, si
 // than one signature where the signing certificate have chains of trust to different CA certificate, but the first signature's chain
 // involves intermediate certificates, then this function will generate a PCR profile that is incorrect.
 //
-// This function does not support computing measurements for images that are authenticated by shim using a machine owner key (MOK).
+// Images that are loaded by shim can be authenticated using a machine owner key (MOK). The MOK database is read from the MokListRT
+// variable in the host environment, unless one is supplied via the MokList field of the params argument. Shim checks the MOK database
+// after the authorized signature database and its built-in vendor_db, but before its built-in vendor certificate. Images that are
+// signed with a certificate that is, or is directly signed by, a certificate in the MOK forbidden database (read from the MokListXRT
+// variable) are assumed to be rejected by shim. Image digests in the MOK databases are not considered.
 //
 // The secure boot policy measurements include the secure boot configuration, which includes the contents of the UEFI signature
 // databases. In order to support atomic updates of these databases with the sbkeysync tool, it is possible to generate a PCR policy
@@ -1104,6 +1241,10 @@ func (g *secureBootPolicyGen) run(profile *secboot_tpm2.PCRProtectionProfile, si
 // Note that sbkeysync ignores errors when applying updates - if any of the pending updates don't apply for some reason, the generated
 // PCR profile will be invalid.
 //
+// Pending signature database updates that are applied by other means, such as dbx updates distributed by fwupd, can be supplied
+// directly via the SignatureDbUpdates field of the params argument. These are treated in the same way as updates from the
+// keystore directories, which allows a key to be resealed before the update is applied without risking being locked out.
+//
 // For the most common case where there are no signature database updates pending in the specified keystore directories and each image
 // load event sequence corresponds to loads of images that are all verified with the same chain of trust, this is a complicated way of
 // adding a single PCR digest to the provided secboot.PCRProtectionProfile.
@@ -1175,8 +1316,42 @@ func AddSecureBootPolicyProfile(profile *secboot_tpm2.PCRProtectionProfile, para
 	if err != nil {
 		return xerrors.Errorf("cannot build list of UEFI signature DB updates: %w", err)
 	}
+	for i, u := range params.SignatureDbUpdates {
+		if u == nil {
+			return fmt.Errorf("cannot build list of UEFI signature DB updates: update %d is nil", i)
+		}
+		if len(u.Data) == 0 {
+			return fmt.Errorf("cannot build list of UEFI signature DB updates: no data for update %d", i)
+		}
+		switch u.Name {
+		case pkName, kekName, dbName, dbxName:
+		default:
+			return fmt.Errorf("cannot build list of UEFI signature DB updates: invalid database name for update %d: %q", i, u.Name)
+		}
+		sigDbUpdates = append(sigDbUpdates, &secureBootDbUpdate{db: u.Name, data: u.Data})
+	}
+
+	gen := &secureBootPolicyGen{
+		pcrAlgorithm:  params.PCRAlgorithm,
+		env:           env,
+		loadSequences: params.LoadSequences,
+		events:        log.Events,
+		sigDbUpdates:  sigDbUpdates}
 
-	gen := &secureBootPolicyGen{params.PCRAlgorithm, env, params.LoadSequences, log.Events, sigDbUpdates}
+	mokDb := params.MokList
+	if mokDb == nil {
+		mokDb, err = readShimSignatureDb(env, mokListRTName)
+		if err != nil {
+			return xerrors.Errorf("cannot read MOK database: %w", err)
+		}
+	}
+	if len(mokDb) > 0 {
+		gen.mokDb = &secureBootDb{variableName: shimGuid, unicodeName: mokListRTName, db: mokDb}
+	}
+	gen.mokDenyDb, err = readShimSignatureDb(env, mokListXRTName)
+	if err != nil {
+		return xerrors.Errorf("cannot read MOK forbidden database: %w", err)
+	}
 
 	profile1 := secboot_tpm2.NewPCRProtectionProfile()
 	if err := gen.run(profile1, sigDbUpdateQuirkModeNone); err != nil {
@@ -95,6 +95,52 @@ func (s *securebootPolicySuite) TestReadShimVendorCertNotShim(c *C) {
 	})
 }
 
+func (s *securebootPolicySuite) TestReadShimSbatLevelNoSection(c *C) {
+	if runtime.GOARCH != "amd64" {
+		c.Skip("unsupported architecture")
+	}
+
+	f, err := os.Open(filepath.Join("testdata", runtime.GOARCH, "mockshim_sbat.efi.signed.1.1.1"))
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	shim, err := NewShimImageHandle(f)
+	c.Assert(err, IsNil)
+
+	previous, latest, err := shim.ReadSbatLevel()
+	c.Check(err, IsNil)
+	c.Check(previous, IsNil)
+	c.Check(latest, IsNil)
+}
+
+func (s *securebootPolicySuite) TestReadShimSbatLevelSection(c *C) {
+	section := []byte("\x00\x00\x00\x00\x08\x00\x00\x00\x22\x00\x00\x00" +
+		"sbat,1,2022052400\ngrub,2\n\x00" +
+		"sbat,1,2022111500\nshim,2\ngrub,3\n\x00")
+	previous, latest, err := ReadShimSbatLevelSection(bytes.NewReader(section))
+	c.Check(err, IsNil)
+	c.Check(previous, DeepEquals, []byte("sbat,1,2022052400\ngrub,2\n"))
+	c.Check(latest, DeepEquals, []byte("sbat,1,2022111500\nshim,2\ngrub,3\n"))
+}
+
+func (s *securebootPolicySuite) TestReadShimSbatLevelSectionInvalidVersion(c *C) {
+	section := []byte("\x01\x00\x00\x00\x08\x00\x00\x00\x09\x00\x00\x00\x00\x00")
+	_, _, err := ReadShimSbatLevelSection(bytes.NewReader(section))
+	c.Check(err, ErrorMatches, "unexpected version 1")
+}
+
+func (s *securebootPolicySuite) TestReadShimSbatLevelSectionTruncated(c *C) {
+	section := []byte("\x00\x00\x00\x00\x08\x00\x00\x00\x10\x00\x00\x00sbat,1,2022052400\n")
+	_, _, err := ReadShimSbatLevelSection(bytes.NewReader(section))
+	c.Check(err, ErrorMatches, "cannot read previous payload: EOF")
+}
+
+func (s *securebootPolicySuite) TestSbatLevelDatestamp(c *C) {
+	c.Check(SbatLevelDatestamp([]byte("sbat,1,2021030218\n")), Equals, "2021030218")
+	c.Check(SbatLevelDatestamp([]byte("sbat,1,2022111500\nshim,2\ngrub,3\n")), Equals, "2022111500")
+	c.Check(SbatLevelDatestamp([]byte("foo,1\n")), Equals, "")
+}
+
 type testComputeDbUpdateData struct {
 	dir           string
 	name          string
@@ -745,6 +791,154 @@ func (s *securebootPolicySuite) TestAddSecureBootPolicyProfileAuthenticateWithDb
 	})
 }
 
+func (s *securebootPolicySuite) TestAddSecureBootPolicyProfileAuthenticateWithMok(c *C) {
+	// Test with a shim that has no vendor certificate, and grub and the kernel
+	// authenticated by a MOK from the MokListRT variable.
+	s.testAddSecureBootPolicyProfile(c, &testAddSecureBootPolicyProfileData{
+		eventLogPath: "testdata/eventlog_sb.bin",
+		efivars:      "testdata/efivars_mock1_plus_mok",
+		params: SecureBootPolicyProfileParams{
+			PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+			LoadSequences: []*ImageLoadEvent{
+				{
+					Source: Firmware,
+					Image:  FileImage(filepath.Join("testdata", runtime.GOARCH, "mockshim_sbat_no_vendor_cert.efi.signed.1.1.1")),
+					Next: []*ImageLoadEvent{
+						{
+							Source: Shim,
+							Image:  FileImage(filepath.Join("testdata", runtime.GOARCH, "mockgrub1.efi.signed.shim.1")),
+							Next: []*ImageLoadEvent{
+								{
+									Source: Shim,
+									Image:  FileImage(filepath.Join("testdata", runtime.GOARCH, "mockkernel1.efi.signed.shim.1")),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					7: testutil.DecodeHexString(c, "4fbd88084c3ae284604d13ad32da0c886be5e961d8b16cae35708b6eaa62b628"),
+				},
+			},
+		},
+	})
+}
+
+func (s *securebootPolicySuite) TestAddSecureBootPolicyProfileAuthenticateWithSuppliedMokList(c *C) {
+	// Test that a MOK database supplied by the caller gives the same result as
+	// TestAddSecureBootPolicyProfileAuthenticateWithMok.
+	mokList, _, err := testutil.EFIReadVar("testdata/efivars_mock1_plus_mok", "MokListRT", efi.MakeGUID(0x605dab50, 0xe046, 0x4300, 0xabb6, [...]uint8{0x3d, 0xd8, 0x10, 0xdd, 0x8b, 0x23}))
+	c.Assert(err, IsNil)
+	mokDb, err := efi.ReadSignatureDatabase(bytes.NewReader(mokList))
+	c.Assert(err, IsNil)
+
+	s.testAddSecureBootPolicyProfile(c, &testAddSecureBootPolicyProfileData{
+		eventLogPath: "testdata/eventlog_sb.bin",
+		efivars:      "testdata/efivars_mock1",
+		params: SecureBootPolicyProfileParams{
+			PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+			LoadSequences: []*ImageLoadEvent{
+				{
+					Source: Firmware,
+					Image:  FileImage(filepath.Join("testdata", runtime.GOARCH, "mockshim_sbat_no_vendor_cert.efi.signed.1.1.1")),
+					Next: []*ImageLoadEvent{
+						{
+							Source: Shim,
+							Image:  FileImage(filepath.Join("testdata", runtime.GOARCH, "mockgrub1.efi.signed.shim.1")),
+							Next: []*ImageLoadEvent{
+								{
+									Source: Shim,
+									Image:  FileImage(filepath.Join("testdata", runtime.GOARCH, "mockkernel1.efi.signed.shim.1")),
+								},
+							},
+						},
+					},
+				},
+			},
+			MokList: mokDb,
+		},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					7: testutil.DecodeHexString(c, "4fbd88084c3ae284604d13ad32da0c886be5e961d8b16cae35708b6eaa62b628"),
+				},
+			},
+		},
+	})
+}
+
+func (s *securebootPolicySuite) TestAddSecureBootPolicyProfileMokListContainsVendorCert(c *C) {
+	// Newer shims mirror their vendor certificate to MokListRT. Test that images
+	// authenticated by the vendor certificate are still recorded with the Shim
+	// authority, giving the same result as TestAddSecureBootPolicyProfileClassic.
+	s.testAddSecureBootPolicyProfile(c, &testAddSecureBootPolicyProfileData{
+		eventLogPath: "testdata/eventlog_sb.bin",
+		efivars:      "testdata/efivars_mock1_plus_mok",
+		params: SecureBootPolicyProfileParams{
+			PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+			LoadSequences: []*ImageLoadEvent{
+				{
+					Source: Firmware,
+					Image:  FileImage(filepath.Join("testdata", runtime.GOARCH, "mockshim_sbat.efi.signed.1.1.1")),
+					Next: []*ImageLoadEvent{
+						{
+							Source: Shim,
+							Image:  FileImage(filepath.Join("testdata", runtime.GOARCH, "mockgrub1.efi.signed.shim.1")),
+							Next: []*ImageLoadEvent{
+								{
+									Source: Shim,
+									Image:  FileImage(filepath.Join("testdata", runtime.GOARCH, "mockkernel1.efi.signed.shim.1")),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					7: testutil.DecodeHexString(c, "84c3cf3c3ca91234fda780141b06af2e32bb4c6fc809216f2c33d25b84155796"),
+				},
+			},
+		},
+	})
+}
+
+func (s *securebootPolicySuite) TestAddSecureBootPolicyProfileDeniedByMokListX(c *C) {
+	// Test that images signed by a certificate in MokListXRT are rejected.
+	s.testAddSecureBootPolicyProfile(c, &testAddSecureBootPolicyProfileData{
+		eventLogPath: "testdata/eventlog_sb.bin",
+		efivars:      "testdata/efivars_mock1_plus_mok_and_moklistx",
+		params: SecureBootPolicyProfileParams{
+			PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+			LoadSequences: []*ImageLoadEvent{
+				{
+					Source: Firmware,
+					Image:  FileImage(filepath.Join("testdata", runtime.GOARCH, "mockshim_sbat.efi.signed.1.1.1")),
+					Next: []*ImageLoadEvent{
+						{
+							Source: Shim,
+							Image:  FileImage(filepath.Join("testdata", runtime.GOARCH, "mockgrub1.efi.signed.shim.1")),
+							Next: []*ImageLoadEvent{
+								{
+									Source: Shim,
+									Image:  FileImage(filepath.Join("testdata", runtime.GOARCH, "mockkernel1.efi.signed.shim.1")),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		errMatch: "cannot compute secure boot policy profile: no bootable paths with current EFI signature database",
+	})
+}
+
 func (s *securebootPolicySuite) TestAddSecureBootPolicyProfileWithMultipleDbCerts(c *C) {
 	// Test that we still compute the correct digest if the UEFI db contains certs
 	// not used for authenticating the supplied binaries.
@@ -825,6 +1019,106 @@ func (s *securebootPolicySuite) TestAddSecureBootPolicyProfileWithDbxUpdate(c *C
 	})
 }
 
+func (s *securebootPolicySuite) TestAddSecureBootPolicyProfileWithSuppliedDbxUpdate(c *C) {
+	// Test that supplying a dbx update directly produces the same digests as
+	// WithDbxUpdate, where the update is supplied via a keystore.
+	update, err := ioutil.ReadFile("testdata/update_uefi.org_2016-08-08/dbx/dbxupdate.bin")
+	c.Assert(err, IsNil)
+
+	s.testAddSecureBootPolicyProfile(c, &testAddSecureBootPolicyProfileData{
+		eventLogPath: "testdata/eventlog_sb.bin",
+		efivars:      "testdata/efivars_ms_plus_mock1",
+		params: SecureBootPolicyProfileParams{
+			PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+			LoadSequences: []*ImageLoadEvent{
+				{
+					Source: Firmware,
+					Image:  FileImage(filepath.Join("testdata", runtime.GOARCH, "mockshim_sbat.efi.signed.1.1.1")),
+					Next: []*ImageLoadEvent{
+						{
+							Source: Shim,
+							Image:  FileImage(filepath.Join("testdata", runtime.GOARCH, "mockgrub1.efi.signed.shim.1")),
+							Next: []*ImageLoadEvent{
+								{
+									Source: Shim,
+									Image:  FileImage(filepath.Join("testdata", runtime.GOARCH, "mockkernel1.efi.signed.shim.1")),
+								},
+							},
+						},
+					},
+				},
+			},
+			SignatureDbUpdates: []*SignatureDbUpdate{{Name: "dbx", Data: update}},
+		},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					7: testutil.DecodeHexString(c, "7172a37992a5623a59c4367d6df5626045d984b1403c419409cd68686acd7173"),
+				},
+			},
+			{
+				tpm2.HashAlgorithmSHA256: {
+					7: testutil.DecodeHexString(c, "fb3338118ad848a711fca6409d6f374759393c4b1cb111b87f916265ba22b38b"),
+				},
+			},
+		},
+	})
+}
+
+func (s *securebootPolicySuite) TestAddSecureBootPolicyProfileWithSuppliedUpdateInvalidName(c *C) {
+	s.testAddSecureBootPolicyProfile(c, &testAddSecureBootPolicyProfileData{
+		eventLogPath: "testdata/eventlog_sb.bin",
+		efivars:      "testdata/efivars_ms_plus_mock1",
+		params: SecureBootPolicyProfileParams{
+			PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+			LoadSequences: []*ImageLoadEvent{
+				{
+					Source: Firmware,
+					Image:  FileImage(filepath.Join("testdata", runtime.GOARCH, "mockshim_sbat.efi.signed.1.1.1")),
+				},
+			},
+			SignatureDbUpdates: []*SignatureDbUpdate{{Name: "MokList", Data: []byte{0}}},
+		},
+		errMatch: "cannot build list of UEFI signature DB updates: invalid database name for update 0: \"MokList\"",
+	})
+}
+
+func (s *securebootPolicySuite) TestAddSecureBootPolicyProfileWithSuppliedUpdateNil(c *C) {
+	s.testAddSecureBootPolicyProfile(c, &testAddSecureBootPolicyProfileData{
+		eventLogPath: "testdata/eventlog_sb.bin",
+		efivars:      "testdata/efivars_ms_plus_mock1",
+		params: SecureBootPolicyProfileParams{
+			PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+			LoadSequences: []*ImageLoadEvent{
+				{
+					Source: Firmware,
+					Image:  FileImage(filepath.Join("testdata", runtime.GOARCH, "mockshim_sbat.efi.signed.1.1.1")),
+				},
+			},
+			SignatureDbUpdates: []*SignatureDbUpdate{nil},
+		},
+		errMatch: "cannot build list of UEFI signature DB updates: update 0 is nil",
+	})
+}
+
+func (s *securebootPolicySuite) TestAddSecureBootPolicyProfileWithSuppliedUpdateNoData(c *C) {
+	s.testAddSecureBootPolicyProfile(c, &testAddSecureBootPolicyProfileData{
+		eventLogPath: "testdata/eventlog_sb.bin",
+		efivars:      "testdata/efivars_ms_plus_mock1",
+		params: SecureBootPolicyProfileParams{
+			PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+			LoadSequences: []*ImageLoadEvent{
+				{
+					Source: Firmware,
+					Image:  FileImage(filepath.Join("testdata", runtime.GOARCH, "mockshim_sbat.efi.signed.1.1.1")),
+				},
+			},
+			SignatureDbUpdates: []*SignatureDbUpdate{{Name: "dbx"}},
+		},
+		errMatch: "cannot build list of UEFI signature DB updates: no data for update 0",
+	})
+}
+
 func (s *securebootPolicySuite) TestAddSecureBootPolicyProfileWithTwoDbxUpdates(c *C) {
 	// Test that we get 3 digests where there are 2 dbx updates. The first two
 	// should match the digests in WithDbxUpdates.
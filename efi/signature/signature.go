@@ -0,0 +1,297 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package signature provides a way to inspect the contents of UEFI signature databases, such as db, dbx and KEK, and to
+// determine how the firmware will use them to authenticate signed images. It is used by the efi package to predict PCR 7
+// measurements, but is also useful on its own for inspecting the secure boot configuration of a platform.
+package signature
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"io"
+
+	"github.com/canonical/go-efilib"
+
+	"golang.org/x/xerrors"
+
+	"go.mozilla.org/pkcs7"
+
+	"github.com/snapcore/secboot/internal/pe1.14"
+)
+
+const (
+	certTableIndex = 4 // Index of the Certificate Table entry in the Data Directory of a PE image optional header
+)
+
+var (
+	oidSha256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+
+	// hashSignatureTypes maps the signature types of signature lists that contain image digests to the corresponding
+	// digest algorithm.
+	hashSignatureTypes = map[efi.GUID]crypto.Hash{
+		efi.CertSHA1Guid:   crypto.SHA1,
+		efi.CertSHA256Guid: crypto.SHA256,
+		efi.CertSHA384Guid: crypto.SHA384,
+		efi.CertSHA512Guid: crypto.SHA512}
+)
+
+// ImageReader provides read access to a PE image.
+type ImageReader interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// Certificate corresponds to a X.509 certificate in a signature database.
+type Certificate struct {
+	Owner       efi.GUID           // The owner of the signature database entry
+	Certificate *x509.Certificate  // The decoded certificate
+	Data        *efi.SignatureData // The signature database entry that the certificate was decoded from
+}
+
+// Authenticates indicates whether the firmware will use this certificate to authenticate an image that is signed by the
+// supplied signer.
+//
+// This only works if the certificate is the signing certificate, or it directly signs the signing certificate. Ideally this
+// would use x509.Certificate.Verify, but there is no way to turn off time checking and UEFI doesn't consider expired
+// certificates invalid.
+func (c *Certificate) Authenticates(signer *ImageSigner) bool {
+	if bytes.Equal(c.Certificate.Raw, signer.Certificate.Raw) {
+		return true
+	}
+	return signer.Certificate.CheckSignatureFrom(c.Certificate) == nil
+}
+
+// Hash corresponds to an image digest in a signature database.
+type Hash struct {
+	Owner     efi.GUID    // The owner of the signature database entry
+	Algorithm crypto.Hash // The digest algorithm
+	Digest    []byte
+}
+
+// ReadDatabase decodes a signature database from r, which should not include the variable attributes that are exposed by
+// efivarfs.
+func ReadDatabase(r io.Reader) (efi.SignatureDatabase, error) {
+	db, err := efi.ReadSignatureDatabase(r)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot decode signature database: %w", err)
+	}
+	return db, nil
+}
+
+// Certificates returns the X.509 certificates contained in the supplied signature database, in the order in which the
+// firmware considers them. Entries that cannot be decoded are ignored, as the firmware will never use them to authenticate an
+// image.
+func Certificates(db efi.SignatureDatabase) []*Certificate {
+	var certs []*Certificate
+	for _, l := range db {
+		if l.Type != efi.CertX509Guid {
+			continue
+		}
+		for _, s := range l.Signatures {
+			cert, err := x509.ParseCertificate(s.Data)
+			if err != nil {
+				continue
+			}
+			certs = append(certs, &Certificate{Owner: s.Owner, Certificate: cert, Data: s})
+		}
+	}
+	return certs
+}
+
+// PrimaryCertificates returns the first X.509 certificate of each signature list in the supplied signature database, in the
+// order in which they appear. X.509 signature lists normally contain a single certificate because the size of each entry must
+// be the same. Signature lists where the first entry cannot be decoded are ignored.
+//
+// This is used to predict the measurements made when an image is authenticated, which only considers the first entry of each
+// signature list.
+func PrimaryCertificates(db efi.SignatureDatabase) []*Certificate {
+	var certs []*Certificate
+	for _, l := range db {
+		if l.Type != efi.CertX509Guid || len(l.Signatures) == 0 {
+			continue
+		}
+		s := l.Signatures[0]
+		cert, err := x509.ParseCertificate(s.Data)
+		if err != nil {
+			continue
+		}
+		certs = append(certs, &Certificate{Owner: s.Owner, Certificate: cert, Data: s})
+	}
+	return certs
+}
+
+// Hashes returns the image digests contained in the supplied signature database. Entries with an unrecognized digest
+// algorithm or an unexpected length are ignored.
+func Hashes(db efi.SignatureDatabase) []*Hash {
+	var hashes []*Hash
+	for _, l := range db {
+		alg, ok := hashSignatureTypes[l.Type]
+		if !ok {
+			continue
+		}
+		for _, s := range l.Signatures {
+			if len(s.Data) != alg.Size() {
+				continue
+			}
+			hashes = append(hashes, &Hash{Owner: s.Owner, Algorithm: alg, Digest: s.Data})
+		}
+	}
+	return hashes
+}
+
+// ImageSigner corresponds to the signer of an Authenticode signature in a PE image.
+type ImageSigner struct {
+	Certificate   *x509.Certificate // The signing certificate
+	Intermediates *x509.CertPool    // Other certificates included in the signature
+}
+
+// ReadImageSigners returns the signers of each of the Authenticode signatures contained in the security directory of the
+// supplied PE image, in the order in which they appear. If the image isn't signed, an empty list is returned.
+func ReadImageSigners(r io.ReaderAt) ([]*ImageSigner, error) {
+	pefile, err := pe.NewFile(r)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot decode PE binary: %w", err)
+	}
+
+	// Obtain security directory entry from optional header
+	var dd []pe.DataDirectory
+	switch oh := pefile.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		dd = oh.DataDirectory[0:oh.NumberOfRvaAndSizes]
+	case *pe.OptionalHeader64:
+		dd = oh.DataDirectory[0:oh.NumberOfRvaAndSizes]
+	default:
+		return nil, errors.New("cannot obtain security directory entry from PE binary: no optional header")
+	}
+
+	if len(dd) <= certTableIndex {
+		return nil, errors.New("cannot obtain security directory entry from PE binary: invalid number of data directories")
+	}
+
+	// Create a reader for the security directory entry, which points to a WIN_CERTIFICATE struct
+	certReader := io.NewSectionReader(r, int64(dd[certTableIndex].VirtualAddress), int64(dd[certTableIndex].Size))
+
+	// Binaries can have multiple signers - this is achieved using multiple single-signed Authenticode signatures - see section 32.5.3.3
+	// ("Secure Boot and Driver Signing - UEFI Image Validation - Signature Database Update - Authorization Process") of the UEFI
+	// Specification, version 2.8.
+	var signers []*ImageSigner
+
+	for {
+		// Signatures in this section are 8-byte aligned - see the PE spec:
+		// https://docs.microsoft.com/en-us/windows/win32/debug/pe-format#the-attribute-certificate-table-image-only
+		off, _ := certReader.Seek(0, io.SeekCurrent)
+		alignSize := (8 - (off & 7)) % 8
+		certReader.Seek(alignSize, io.SeekCurrent)
+
+		c, err := efi.ReadWinCertificate(certReader)
+		switch {
+		case xerrors.Is(err, io.EOF):
+			return signers, nil
+		case err != nil:
+			return nil, xerrors.Errorf("cannot decode WIN_CERTIFICATE from security directory entry of PE binary: %w", err)
+		}
+
+		if _, ok := c.(efi.WinCertificateAuthenticode); !ok {
+			return nil, errors.New("unexpected WIN_CERTIFICATE type: not an Authenticode signature")
+		}
+
+		// Decode the signature
+		p7, err := pkcs7.Parse(c.(efi.WinCertificateAuthenticode))
+		if err != nil {
+			return nil, xerrors.Errorf("cannot decode signature: %w", err)
+		}
+
+		// Grab the certificate of the signer
+		signer := p7.GetOnlySigner()
+		if signer == nil {
+			return nil, errors.New("cannot obtain signer certificate from signature")
+		}
+
+		// Reject any signature with a digest algorithm other than SHA256, as that's the only algorithm used for binaries we're
+		// expected to support, and therefore required by the UEFI implementation.
+		if !p7.Signers[0].DigestAlgorithm.Algorithm.Equal(oidSha256) {
+			return nil, errors.New("signature has unexpected digest algorithm")
+		}
+
+		// Grab all of the certificates in the signature and populate an intermediates pool
+		intermediates := x509.NewCertPool()
+		for _, c := range p7.Certificates {
+			intermediates.AddCert(c)
+		}
+
+		signers = append(signers, &ImageSigner{Certificate: signer, Intermediates: intermediates})
+	}
+}
+
+// FindAuthority returns the certificate in the supplied signature database that the firmware will use to authenticate an
+// image with the supplied signers, or nil if the image isn't trusted by any certificate in the database.
+//
+// The signers are iterated over in the outer loop, in the order in which they appear in the image, and the certificates are
+// iterated over in the inner loop. This behaviour isn't defined in the UEFI specification but it matches EDK2 and the firmware
+// on the Intel NUC.
+func FindAuthority(db efi.SignatureDatabase, signers []*ImageSigner) *Certificate {
+	certs := Certificates(db)
+	for _, signer := range signers {
+		for _, cert := range certs {
+			if cert.Authenticates(signer) {
+				return cert
+			}
+		}
+	}
+	return nil
+}
+
+// IsRevoked indicates whether the firmware will refuse to load the supplied image because of an entry in the supplied forbidden
+// signature database (dbx). This is the case if the database contains the Authenticode digest of the image, or a certificate
+// that is, or directly signs, the signer of any of the image's signatures.
+func IsRevoked(dbx efi.SignatureDatabase, image ImageReader) (bool, error) {
+	digests := make(map[crypto.Hash][]byte)
+	for _, h := range Hashes(dbx) {
+		digest, ok := digests[h.Algorithm]
+		if !ok {
+			var err error
+			digest, err = efi.ComputePeImageDigest(h.Algorithm, image, image.Size())
+			if err != nil {
+				return false, xerrors.Errorf("cannot compute image digest: %w", err)
+			}
+			digests[h.Algorithm] = digest
+		}
+		if bytes.Equal(digest, h.Digest) {
+			return true, nil
+		}
+	}
+
+	signers, err := ReadImageSigners(image)
+	if err != nil {
+		return false, xerrors.Errorf("cannot read image signatures: %w", err)
+	}
+	for _, cert := range Certificates(dbx) {
+		for _, signer := range signers {
+			if cert.Authenticates(signer) {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,179 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package signature_test
+
+import (
+	"bytes"
+	"crypto"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/go-efilib"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/efi/signature"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type signatureSuite struct{}
+
+var _ = Suite(&signatureSuite{})
+
+func (s *signatureSuite) readDatabase(c *C, efivars, name string) efi.SignatureDatabase {
+	data, err := ioutil.ReadFile(filepath.Join("../testdata", efivars, name))
+	c.Assert(err, IsNil)
+	// Skip the variable attributes.
+	db, err := ReadDatabase(bytes.NewReader(data[4:]))
+	c.Assert(err, IsNil)
+	return db
+}
+
+func (s *signatureSuite) readDb(c *C, efivars string) efi.SignatureDatabase {
+	return s.readDatabase(c, efivars, "db-d719b2cb-3d3a-4596-a3bc-dad00e67656f")
+}
+
+func (s *signatureSuite) readDbx(c *C, efivars string) efi.SignatureDatabase {
+	return s.readDatabase(c, efivars, "dbx-d719b2cb-3d3a-4596-a3bc-dad00e67656f")
+}
+
+func (s *signatureSuite) readImage(c *C, name string) *bytes.Reader {
+	data, err := ioutil.ReadFile(filepath.Join("../testdata/amd64", name))
+	c.Assert(err, IsNil)
+	return bytes.NewReader(data)
+}
+
+func (s *signatureSuite) TestCertificates(c *C) {
+	certs := Certificates(s.readDb(c, "efivars_ms_plus_mock1"))
+	c.Assert(certs, HasLen, 3)
+	for _, cert := range certs {
+		c.Check(cert.Certificate.Raw, DeepEquals, cert.Data.Data)
+		c.Check(cert.Owner, Equals, cert.Data.Owner)
+	}
+}
+
+func (s *signatureSuite) TestPrimaryCertificates(c *C) {
+	db := s.readDb(c, "efivars_ms_plus_mock1")
+	c.Check(PrimaryCertificates(db), DeepEquals, Certificates(db))
+}
+
+func (s *signatureSuite) TestPrimaryCertificatesMultipleEntries(c *C) {
+	certs := Certificates(s.readDb(c, "efivars_ms_plus_mock1"))
+	c.Assert(certs, HasLen, 3)
+
+	db := efi.SignatureDatabase{
+		{Type: efi.CertX509Guid, Signatures: []*efi.SignatureData{certs[0].Data, certs[1].Data}},
+		{Type: efi.CertX509Guid, Signatures: []*efi.SignatureData{certs[2].Data}}}
+	c.Check(Certificates(db), HasLen, 3)
+
+	primary := PrimaryCertificates(db)
+	c.Assert(primary, HasLen, 2)
+	c.Check(primary[0].Data, Equals, certs[0].Data)
+	c.Check(primary[1].Data, Equals, certs[2].Data)
+}
+
+func (s *signatureSuite) TestPrimaryCertificatesIgnoresHashes(c *C) {
+	c.Check(PrimaryCertificates(s.readDbx(c, "efivars_mock1")), HasLen, 0)
+}
+
+func (s *signatureSuite) TestCertificatesIgnoresHashes(c *C) {
+	c.Check(Certificates(s.readDbx(c, "efivars_mock1")), HasLen, 0)
+}
+
+func (s *signatureSuite) TestHashes(c *C) {
+	hashes := Hashes(s.readDbx(c, "efivars_ms_plus_2016_dbx_update"))
+	c.Assert(hashes, HasLen, 78)
+	for _, h := range hashes {
+		c.Check(h.Algorithm, Equals, crypto.SHA256)
+		c.Check(h.Digest, HasLen, 32)
+	}
+}
+
+func (s *signatureSuite) TestHashesIgnoresCertificates(c *C) {
+	c.Check(Hashes(s.readDb(c, "efivars_mock1")), HasLen, 0)
+}
+
+func (s *signatureSuite) TestReadImageSigners(c *C) {
+	signers, err := ReadImageSigners(s.readImage(c, "mockshim_sbat.efi.signed.2.1.1+1.1.1"))
+	c.Assert(err, IsNil)
+	c.Check(signers, HasLen, 2)
+}
+
+func (s *signatureSuite) TestReadImageSignersUnsigned(c *C) {
+	signers, err := ReadImageSigners(s.readImage(c, "mockkernel1.efi"))
+	c.Assert(err, IsNil)
+	c.Check(signers, HasLen, 0)
+}
+
+func (s *signatureSuite) TestFindAuthority(c *C) {
+	db := s.readDb(c, "efivars_mock1")
+	signers, err := ReadImageSigners(s.readImage(c, "mockshim_sbat.efi.signed.1.1.1"))
+	c.Assert(err, IsNil)
+
+	authority := FindAuthority(db, signers)
+	c.Assert(authority, NotNil)
+	c.Check(authority.Data, Equals, db[0].Signatures[0])
+}
+
+func (s *signatureSuite) TestFindAuthorityMultipleSigners(c *C) {
+	db := s.readDb(c, "efivars_mock1")
+	signers, err := ReadImageSigners(s.readImage(c, "mockshim_sbat.efi.signed.2.1.1+1.1.1"))
+	c.Assert(err, IsNil)
+
+	authority := FindAuthority(db, signers)
+	c.Assert(authority, NotNil)
+	c.Check(authority.Data, Equals, db[0].Signatures[0])
+}
+
+func (s *signatureSuite) TestFindAuthorityUntrusted(c *C) {
+	signers, err := ReadImageSigners(s.readImage(c, "mockshim_sbat.efi.signed.2.1.1"))
+	c.Assert(err, IsNil)
+	c.Check(FindAuthority(s.readDb(c, "efivars_mock1"), signers), IsNil)
+}
+
+func (s *signatureSuite) TestIsRevokedNotRevoked(c *C) {
+	revoked, err := IsRevoked(s.readDbx(c, "efivars_mock1"), s.readImage(c, "mockshim_sbat.efi.signed.1.1.1"))
+	c.Check(err, IsNil)
+	c.Check(revoked, Equals, false)
+}
+
+func (s *signatureSuite) TestIsRevokedByHash(c *C) {
+	image := s.readImage(c, "mockshim_sbat.efi.signed.1.1.1")
+	digest, err := efi.ComputePeImageDigest(crypto.SHA256, image, image.Size())
+	c.Assert(err, IsNil)
+
+	dbx := append(s.readDbx(c, "efivars_mock1"), &efi.SignatureList{
+		Type:       efi.CertSHA256Guid,
+		Signatures: []*efi.SignatureData{{Data: digest}}})
+
+	revoked, err := IsRevoked(dbx, image)
+	c.Check(err, IsNil)
+	c.Check(revoked, Equals, true)
+}
+
+func (s *signatureSuite) TestIsRevokedByCertificate(c *C) {
+	dbx := append(s.readDbx(c, "efivars_mock1"), s.readDb(c, "efivars_mock1")...)
+
+	revoked, err := IsRevoked(dbx, s.readImage(c, "mockshim_sbat.efi.signed.1.1.1"))
+	c.Check(err, IsNil)
+	c.Check(revoked, Equals, true)
+}
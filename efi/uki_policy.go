@@ -0,0 +1,153 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi
+
+import (
+	"errors"
+	"io"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/pe1.14"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+const (
+	kernelBootPCR = 11 // systemd-stub measures the sections of a unified kernel image to this PCR
+)
+
+// ukiMeasuredSections are the sections of a unified kernel image that are measured by systemd-stub, in
+// the order in which they are measured.
+var ukiMeasuredSections = []string{".linux", ".osrel", ".cmdline", ".initrd", ".ucode", ".splash", ".dtb", ".uname", ".sbat", ".pcrpkey"}
+
+// UKIProfileParams provides the parameters to AddUKIProfile.
+type UKIProfileParams struct {
+	// PCRAlgorithm is the algorithm for which to compute PCR digests for. TPMs compliant with the "TCG PC Client Platform TPM Profile
+	// (PTP) Specification" Level 00, Revision 01.03 v22, May 22 2017 are required to support tpm2.HashAlgorithmSHA1 and
+	// tpm2.HashAlgorithmSHA256. Support for other digest algorithms is optional.
+	PCRAlgorithm tpm2.HashAlgorithmId
+
+	// Images is the set of unified kernel images to add to the PCR profile.
+	Images []Image
+
+	// Phases is an optional list of boot phase sequences that systemd-pcrphase will have
+	// measured to PCR 11 at the point that the key is unsealed, eg, {"enter-initrd"}. A
+	// branch is generated for each sequence. If empty, the generated profile is only valid
+	// before any boot phases have been measured.
+	Phases [][]string
+}
+
+// computeUKISectionDigests computes the digests that systemd-stub measures for the unified kernel
+// image read from r. For each section that is present, the name of the section including the NULL
+// terminator is measured followed by the section contents.
+func computeUKISectionDigests(alg tpm2.HashAlgorithmId, r io.ReaderAt) (tpm2.DigestList, error) {
+	pefile, err := pe.NewFile(r)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot decode PE binary: %w", err)
+	}
+
+	if pefile.Section(".linux") == nil {
+		return nil, errors.New("not a unified kernel image: no .linux section")
+	}
+
+	var digests tpm2.DigestList
+	for _, name := range ukiMeasuredSections {
+		section := pefile.Section(name)
+		if section == nil {
+			continue
+		}
+
+		h := alg.NewHash()
+		io.WriteString(h, name)
+		h.Write([]byte{0})
+		digests = append(digests, h.Sum(nil))
+
+		// systemd-stub measures the section as it is loaded in to memory,
+		// so the data is truncated or zero padded to the virtual size.
+		size := int64(section.VirtualSize)
+		raw := int64(section.Size)
+		if raw > size {
+			raw = size
+		}
+
+		h = alg.NewHash()
+		if _, err := io.Copy(h, io.NewSectionReader(section, 0, raw)); err != nil {
+			return nil, xerrors.Errorf("cannot read %s section: %w", name, err)
+		}
+		h.Write(make([]byte, size-raw))
+		digests = append(digests, h.Sum(nil))
+	}
+
+	return digests, nil
+}
+
+// AddUKIProfile adds the unified kernel image profile to the PCR protection profile, in order to generate a PCR policy that
+// restricts access to a key to a defined set of unified kernel images booted with systemd-stub. The systemd-stub measures
+// the sections of the image that it uses to PCR 11, as described in the "systemd-stub" documentation.
+//
+// The set of images to add to the PCRProtectionProfile is specified via the Images field of params. The boot phases that
+// systemd-pcrphase will have measured to PCR 11 when the key is unsealed can be specified via the Phases field of params.
+//
+// Signed PCR policies generated by systemd-measure and contained in the .pcrsig section of an image are not supported, and
+// the section is ignored. Consuming them would require a sealed key object's authorization policy to delegate PCR 11 to the
+// key in the .pcrpkey section with TPM2_PolicyAuthorize, which the key data format doesn't support. The profile generated
+// here binds the predicted PCR 11 values directly instead.
+func AddUKIProfile(profile *secboot_tpm2.PCRProtectionProfile, params *UKIProfileParams) error {
+	if len(params.Images) == 0 {
+		return errors.New("no images specified")
+	}
+
+	phases := params.Phases
+	if len(phases) == 0 {
+		phases = [][]string{nil}
+	}
+
+	var subProfiles []*secboot_tpm2.PCRProtectionProfile
+	for _, image := range params.Images {
+		r, err := image.Open()
+		if err != nil {
+			return xerrors.Errorf("cannot open image %s: %w", image, err)
+		}
+		digests, err := computeUKISectionDigests(params.PCRAlgorithm, r)
+		r.Close()
+		if err != nil {
+			return xerrors.Errorf("cannot compute digests for %s: %w", image, err)
+		}
+
+		for _, sequence := range phases {
+			p := secboot_tpm2.NewPCRProtectionProfile()
+			for _, d := range digests {
+				p.ExtendPCR(params.PCRAlgorithm, kernelBootPCR, d)
+			}
+			for _, phase := range sequence {
+				h := params.PCRAlgorithm.NewHash()
+				io.WriteString(h, phase)
+				p.ExtendPCR(params.PCRAlgorithm, kernelBootPCR, h.Sum(nil))
+			}
+			subProfiles = append(subProfiles, p)
+		}
+	}
+
+	profile.AddPCRValue(params.PCRAlgorithm, kernelBootPCR, make(tpm2.Digest, params.PCRAlgorithm.Size()))
+	profile.AddProfileOR(subProfiles...)
+	return nil
+}
@@ -0,0 +1,216 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/canonical/go-tpm2"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/efi"
+	"github.com/snapcore/secboot/internal/testutil"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+type ukiPolicySuite struct{}
+
+var _ = Suite(&ukiPolicySuite{})
+
+type mockUKISection struct {
+	name        string
+	data        []byte
+	virtualSize uint32 // defaults to the length of data if zero
+}
+
+// writeMockUKI writes a minimal PE image containing the supplied sections to
+// the specified path.
+func writeMockUKI(c *C, path string, sections []mockUKISection) {
+	var hdrs bytes.Buffer
+	var data bytes.Buffer
+
+	dataStart := 0x40 + 4 + 20 + (40 * len(sections))
+	for _, s := range sections {
+		var hdr struct {
+			Name                 [8]uint8
+			VirtualSize          uint32
+			VirtualAddress       uint32
+			SizeOfRawData        uint32
+			PointerToRawData     uint32
+			PointerToRelocations uint32
+			PointerToLineNumbers uint32
+			NumberOfRelocations  uint16
+			NumberOfLineNumbers  uint16
+			Characteristics      uint32
+		}
+		copy(hdr.Name[:], s.name)
+		hdr.VirtualSize = s.virtualSize
+		if hdr.VirtualSize == 0 {
+			hdr.VirtualSize = uint32(len(s.data))
+		}
+		hdr.VirtualAddress = uint32(0x1000 + data.Len())
+		hdr.SizeOfRawData = uint32(len(s.data))
+		hdr.PointerToRawData = uint32(dataStart + data.Len())
+		c.Assert(binary.Write(&hdrs, binary.LittleEndian, &hdr), IsNil)
+		data.Write(s.data)
+	}
+
+	var dosHdr [0x40]byte
+	copy(dosHdr[:], "MZ")
+	binary.LittleEndian.PutUint32(dosHdr[0x3c:], 0x40)
+
+	fileHdr := struct {
+		Machine              uint16
+		NumberOfSections     uint16
+		TimeDateStamp        uint32
+		PointerToSymbolTable uint32
+		NumberOfSymbols      uint32
+		SizeOfOptionalHeader uint16
+		Characteristics      uint16
+	}{
+		Machine:          0x8664,
+		NumberOfSections: uint16(len(sections))}
+
+	var b bytes.Buffer
+	b.Write(dosHdr[:])
+	b.WriteString("PE\x00\x00")
+	c.Assert(binary.Write(&b, binary.LittleEndian, &fileHdr), IsNil)
+	b.Write(hdrs.Bytes())
+	b.Write(data.Bytes())
+
+	c.Assert(ioutil.WriteFile(path, b.Bytes(), 0644), IsNil)
+}
+
+func (s *ukiPolicySuite) writeMockUKI1(c *C, dir string) Image {
+	path := filepath.Join(dir, "uki1.efi")
+	writeMockUKI(c, path, []mockUKISection{
+		{name: ".osrel", data: []byte("ID=ubuntu\n")},
+		// Sections are measured with their virtual size.
+		{name: ".cmdline", data: []byte("console=ttyS0 foo"), virtualSize: 13},
+		{name: ".linux", data: []byte("kernel"), virtualSize: 16},
+		{name: ".initrd", data: []byte("initrd")},
+	})
+	return FileImage(path)
+}
+
+func (s *ukiPolicySuite) writeMockUKI2(c *C, dir string) Image {
+	path := filepath.Join(dir, "uki2.efi")
+	writeMockUKI(c, path, []mockUKISection{
+		{name: ".linux", data: []byte("kernel2")},
+		{name: ".cmdline", data: []byte("console=ttyS0 bar")},
+		{name: ".initrd", data: []byte("initrd2")},
+	})
+	return FileImage(path)
+}
+
+type testAddUKIProfileData struct {
+	params *UKIProfileParams
+	values []tpm2.PCRValues
+}
+
+func (s *ukiPolicySuite) testAddUKIProfile(c *C, data *testAddUKIProfileData) {
+	expectedPcrs := tpm2.PCRSelectionList{{Hash: data.params.PCRAlgorithm, Select: []int{11}}}
+	var expectedDigests tpm2.DigestList
+	for _, v := range data.values {
+		d, _ := tpm2.ComputePCRDigest(tpm2.HashAlgorithmSHA256, expectedPcrs, v)
+		expectedDigests = append(expectedDigests, d)
+	}
+
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	c.Check(AddUKIProfile(profile, data.params), IsNil)
+
+	pcrs, digests, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	c.Check(err, IsNil)
+	c.Check(pcrs.Equal(expectedPcrs), Equals, true)
+	c.Check(digests, DeepEquals, expectedDigests)
+
+	if c.Failed() {
+		c.Logf("Profile:\n%s", profile)
+		c.Logf("Values:\n%s", testutil.FormatPCRValuesFromPCRProtectionProfile(profile, nil))
+	}
+}
+
+func (s *ukiPolicySuite) TestAddUKIProfile(c *C) {
+	dir := c.MkDir()
+	s.testAddUKIProfile(c, &testAddUKIProfileData{
+		params: &UKIProfileParams{
+			PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+			Images:       []Image{s.writeMockUKI1(c, dir)},
+		},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					11: testutil.DecodeHexString(c, "f627c2d4851c9330747d4d318c809c5b8c8791a3240c0dda06fc930694ae481d"),
+				},
+			},
+		}})
+}
+
+func (s *ukiPolicySuite) TestAddUKIProfileMultipleImagesAndPhases(c *C) {
+	dir := c.MkDir()
+	s.testAddUKIProfile(c, &testAddUKIProfileData{
+		params: &UKIProfileParams{
+			PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+			Images:       []Image{s.writeMockUKI1(c, dir), s.writeMockUKI2(c, dir)},
+			Phases:       [][]string{nil, {"enter-initrd"}},
+		},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					11: testutil.DecodeHexString(c, "f627c2d4851c9330747d4d318c809c5b8c8791a3240c0dda06fc930694ae481d"),
+				},
+			},
+			{
+				tpm2.HashAlgorithmSHA256: {
+					11: testutil.DecodeHexString(c, "f04dcf20d3a498bde24b04b9f8f01c0f4911a6a75d7bb519ec207de389b6f830"),
+				},
+			},
+			{
+				tpm2.HashAlgorithmSHA256: {
+					11: testutil.DecodeHexString(c, "ff9d5214a3426522d97ce23f4726527766ca2ecac384fb28711427e23979c9e1"),
+				},
+			},
+			{
+				tpm2.HashAlgorithmSHA256: {
+					11: testutil.DecodeHexString(c, "44cdef39a75dbca666285b5b0069feb0e186a9ac4bfebc76c19ceedee022b315"),
+				},
+			},
+		}})
+}
+
+func (s *ukiPolicySuite) TestAddUKIProfileNoImages(c *C) {
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	c.Check(AddUKIProfile(profile, &UKIProfileParams{PCRAlgorithm: tpm2.HashAlgorithmSHA256}), ErrorMatches, "no images specified")
+}
+
+func (s *ukiPolicySuite) TestAddUKIProfileNotUKI(c *C) {
+	path := filepath.Join(c.MkDir(), "notuki.efi")
+	writeMockUKI(c, path, []mockUKISection{{name: ".text", data: []byte("foo")}})
+
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	err := AddUKIProfile(profile, &UKIProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		Images:       []Image{FileImage(path)}})
+	c.Check(err, ErrorMatches, "cannot compute digests for .*/notuki.efi: not a unified kernel image: no .linux section")
+}
@@ -0,0 +1,211 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// luks2KeyslotOverhead is an estimate of the time taken by cryptsetup to perform
+	// the work that doesn't depend on the KDF cost when adding a keyslot, such as
+	// benchmarking, wiping the keyslot area and writing the header.
+	luks2KeyslotOverhead = 1 * time.Second
+
+	// luks2FormatOverhead is an estimate of the time taken by cryptsetup to format
+	// a new container, excluding the time taken by the KDF for the initial keyslot.
+	luks2FormatOverhead = 2 * time.Second
+
+	// recoveryKeyKDFDuration is the target KDF duration for recovery keyslots. Keyslots
+	// for high entropy keys use a fixed minimal KDF cost instead.
+	recoveryKeyKDFDuration = 5 * time.Second
+)
+
+// progressUpdateInterval is how often progress is reported whilst a step is running.
+var progressUpdateInterval = 100 * time.Millisecond
+
+// EnrollmentProgressFunc is called to report the progress of an Enrollment. The
+// description argument describes the step that is currently running and the percent
+// argument is the estimated overall progress, in the range 0-100. The percentage
+// never decreases during a single call to Enrollment.Run.
+type EnrollmentProgressFunc func(description string, percent int)
+
+// EnrollmentStep corresponds to a single step of an Enrollment.
+type EnrollmentStep struct {
+	// Description is a human readable description of this step, suitable for displaying
+	// in an installer UI.
+	Description string
+
+	// EstimatedDuration is the estimated time that this step takes to complete. It is
+	// used to weight the step against other steps and to interpolate progress whilst
+	// the step is running.
+	EstimatedDuration time.Duration
+
+	// Run performs the work associated with this step.
+	Run func() error
+}
+
+// Enrollment is a sequence of potentially long running steps, such as formatting a LUKS2
+// container, adding a recovery key with an expensive KDF and sealing keys to a platform's
+// secure device, which reports progress as each step runs. It is intended to allow installers
+// to display an accurate progress bar.
+type Enrollment struct {
+	steps []*EnrollmentStep
+}
+
+// AddStep appends the supplied step to this enrollment.
+func (e *Enrollment) AddStep(step *EnrollmentStep) *Enrollment {
+	e.steps = append(e.steps, step)
+	return e
+}
+
+// EstimatedDuration returns the estimated time that all of the steps in this enrollment
+// take to complete.
+func (e *Enrollment) EstimatedDuration() (d time.Duration) {
+	for _, s := range e.steps {
+		d += s.EstimatedDuration
+	}
+	return d
+}
+
+// Run executes each step in this enrollment in order, calling the supplied progress
+// function periodically whilst each step is running and again when each step completes.
+// Whilst a step is running, its progress is interpolated from the elapsed time and its
+// estimated duration, but it will not be reported as complete until it actually finishes.
+//
+// If any step fails, the remaining steps are not run and an error is returned.
+func (e *Enrollment) Run(progress EnrollmentProgressFunc) error {
+	if progress == nil {
+		progress = func(string, int) {}
+	}
+
+	total := e.EstimatedDuration()
+	var completed time.Duration
+
+	percent := func(d time.Duration) int {
+		if total == 0 {
+			return 100
+		}
+		return int((d * 100) / total)
+	}
+
+	last := 0
+	report := func(description string, p int) {
+		if p < last {
+			p = last
+		}
+		last = p
+		progress(description, p)
+	}
+
+	for i, s := range e.steps {
+		if s.Run == nil {
+			return errors.New("step has no Run function")
+		}
+
+		report(s.Description, percent(completed))
+
+		done := make(chan error, 1)
+		go func() {
+			done <- s.Run()
+		}()
+
+		ticker := time.NewTicker(progressUpdateInterval)
+		start := time.Now()
+
+		var err error
+	Loop:
+		for {
+			select {
+			case err = <-done:
+				break Loop
+			case <-ticker.C:
+				elapsed := time.Since(start)
+				if elapsed >= s.EstimatedDuration {
+					// This step is taking longer than estimated. Don't
+					// report it as complete until it finishes.
+					elapsed = s.EstimatedDuration - 1
+				}
+				if elapsed < 0 {
+					elapsed = 0
+				}
+				report(s.Description, percent(completed+elapsed))
+			}
+		}
+		ticker.Stop()
+
+		if err != nil {
+			return xerrors.Errorf("cannot complete step %d (%s): %w", i, s.Description, err)
+		}
+
+		completed += s.EstimatedDuration
+	}
+
+	report("", 100)
+	return nil
+}
+
+// NewInitializeLUKS2ContainerStep returns an EnrollmentStep that calls InitializeLUKS2Container
+// with the supplied arguments.
+func NewInitializeLUKS2ContainerStep(devicePath, label string, key []byte, options *InitializeLUKS2ContainerOptions) *EnrollmentStep {
+	return &EnrollmentStep{
+		Description:       "Initializing encrypted container " + devicePath,
+		EstimatedDuration: luks2FormatOverhead,
+		Run: func() error {
+			return InitializeLUKS2Container(devicePath, label, key, options)
+		}}
+}
+
+// NewAddRecoveryKeyToLUKS2ContainerStep returns an EnrollmentStep that calls
+// AddRecoveryKeyToLUKS2Container with the supplied arguments. This step is dominated by
+// the cost of the KDF used for the recovery keyslot.
+func NewAddRecoveryKeyToLUKS2ContainerStep(devicePath string, key []byte, recoveryKey RecoveryKey) *EnrollmentStep {
+	return &EnrollmentStep{
+		Description:       "Adding recovery key to encrypted container " + devicePath,
+		EstimatedDuration: luks2KeyslotOverhead + recoveryKeyKDFDuration,
+		Run: func() error {
+			return AddRecoveryKeyToLUKS2Container(devicePath, key, recoveryKey)
+		}}
+}
+
+// NewAddLUKS2ContainerUnlockKeyStep returns an EnrollmentStep that calls AddLUKS2ContainerUnlockKey
+// with the supplied arguments.
+func NewAddLUKS2ContainerUnlockKeyStep(devicePath, keyslotName string, existingKey, newKey []byte) *EnrollmentStep {
+	return &EnrollmentStep{
+		Description:       "Adding key to encrypted container " + devicePath,
+		EstimatedDuration: luks2KeyslotOverhead,
+		Run: func() error {
+			return AddLUKS2ContainerUnlockKey(devicePath, keyslotName, existingKey, newKey)
+		}}
+}
+
+// NewAddLUKS2ContainerRecoveryKeyStep returns an EnrollmentStep that calls
+// AddLUKS2ContainerRecoveryKey with the supplied arguments.
+func NewAddLUKS2ContainerRecoveryKeyStep(devicePath, keyslotName string, existingKey []byte, recoveryKey RecoveryKey) *EnrollmentStep {
+	return &EnrollmentStep{
+		Description:       "Adding recovery key to encrypted container " + devicePath,
+		EstimatedDuration: luks2KeyslotOverhead + recoveryKeyKDFDuration,
+		Run: func() error {
+			return AddLUKS2ContainerRecoveryKey(devicePath, keyslotName, existingKey, recoveryKey)
+		}}
+}
@@ -0,0 +1,149 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"errors"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+)
+
+type enrollmentSuite struct {
+	restoreInterval func()
+}
+
+var _ = Suite(&enrollmentSuite{})
+
+func (s *enrollmentSuite) SetUpTest(c *C) {
+	s.restoreInterval = MockProgressUpdateInterval(time.Millisecond)
+}
+
+func (s *enrollmentSuite) TearDownTest(c *C) {
+	s.restoreInterval()
+}
+
+type progressEvent struct {
+	description string
+	percent     int
+}
+
+func (s *enrollmentSuite) TestEstimatedDuration(c *C) {
+	var e Enrollment
+	e.AddStep(&EnrollmentStep{EstimatedDuration: 2 * time.Second}).
+		AddStep(&EnrollmentStep{EstimatedDuration: 3 * time.Second})
+	c.Check(e.EstimatedDuration(), Equals, 5*time.Second)
+}
+
+func (s *enrollmentSuite) TestRun(c *C) {
+	var ran []string
+
+	var e Enrollment
+	e.AddStep(&EnrollmentStep{
+		Description:       "foo",
+		EstimatedDuration: 10 * time.Millisecond,
+		Run: func() error {
+			ran = append(ran, "foo")
+			time.Sleep(20 * time.Millisecond)
+			return nil
+		}})
+	e.AddStep(&EnrollmentStep{
+		Description:       "bar",
+		EstimatedDuration: 30 * time.Millisecond,
+		Run: func() error {
+			ran = append(ran, "bar")
+			time.Sleep(10 * time.Millisecond)
+			return nil
+		}})
+
+	var events []progressEvent
+	c.Check(e.Run(func(description string, percent int) {
+		events = append(events, progressEvent{description, percent})
+	}), IsNil)
+
+	c.Check(ran, DeepEquals, []string{"foo", "bar"})
+
+	c.Assert(events, Not(HasLen), 0)
+	c.Check(events[0], Equals, progressEvent{"foo", 0})
+	c.Check(events[len(events)-1], Equals, progressEvent{"", 100})
+
+	last := 0
+	for _, ev := range events {
+		c.Check(ev.percent >= last, Equals, true)
+		c.Check(ev.percent <= 100, Equals, true)
+		if ev.description == "foo" {
+			// The first step must not be reported as complete until it finishes,
+			// even though it takes longer than estimated.
+			c.Check(ev.percent < 25, Equals, true)
+		}
+		if ev.description == "bar" {
+			c.Check(ev.percent >= 25, Equals, true)
+		}
+		last = ev.percent
+	}
+}
+
+func (s *enrollmentSuite) TestRunError(c *C) {
+	var ran []string
+
+	var e Enrollment
+	e.AddStep(&EnrollmentStep{
+		Description:       "foo",
+		EstimatedDuration: time.Millisecond,
+		Run: func() error {
+			ran = append(ran, "foo")
+			return errors.New("some error")
+		}})
+	e.AddStep(&EnrollmentStep{
+		Description:       "bar",
+		EstimatedDuration: time.Millisecond,
+		Run: func() error {
+			ran = append(ran, "bar")
+			return nil
+		}})
+
+	c.Check(e.Run(nil), ErrorMatches, `cannot complete step 0 \(foo\): some error`)
+	c.Check(ran, DeepEquals, []string{"foo"})
+}
+
+func (s *enrollmentSuite) TestRunEmpty(c *C) {
+	var events []progressEvent
+	var e Enrollment
+	c.Check(e.Run(func(description string, percent int) {
+		events = append(events, progressEvent{description, percent})
+	}), IsNil)
+	c.Check(events, DeepEquals, []progressEvent{{"", 100}})
+}
+
+func (s *enrollmentSuite) TestNewAddRecoveryKeyToLUKS2ContainerStepEstimate(c *C) {
+	step := NewAddRecoveryKeyToLUKS2ContainerStep("/dev/sda1", nil, RecoveryKey{})
+	c.Check(step.EstimatedDuration > NewInitializeLUKS2ContainerStep("/dev/sda1", "data", nil, nil).EstimatedDuration, Equals, true)
+	c.Check(step.Description, Equals, "Adding recovery key to encrypted container /dev/sda1")
+}
+
+func (s *enrollmentSuite) TestNewAddLUKS2ContainerKeyStepEstimates(c *C) {
+	unlock := NewAddLUKS2ContainerUnlockKeyStep("/dev/sda1", "default", nil, nil)
+	recovery := NewAddLUKS2ContainerRecoveryKeyStep("/dev/sda1", "default-fallback", nil, RecoveryKey{})
+	c.Check(recovery.EstimatedDuration > unlock.EstimatedDuration, Equals, true)
+	c.Check(unlock.Description, Equals, "Adding key to encrypted container /dev/sda1")
+	c.Check(recovery.Description, Equals, "Adding recovery key to encrypted container /dev/sda1")
+}
@@ -0,0 +1,255 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	escrowBlobVersion = 1
+	escrowKeyLen      = 32 // AES-256
+)
+
+// EscrowKeyType describes the type of key contained in an escrow blob.
+type EscrowKeyType string
+
+const (
+	// EscrowKeyTypeUnlockKey indicates that an escrow blob contains a
+	// DiskUnlockKey.
+	EscrowKeyTypeUnlockKey EscrowKeyType = "unlock-key"
+
+	// EscrowKeyTypeRecoveryKey indicates that an escrow blob contains a
+	// RecoveryKey.
+	EscrowKeyTypeRecoveryKey EscrowKeyType = "recovery-key"
+)
+
+// EscrowMetadata contains information about the device and volume that a key in
+// an escrow blob belongs to, so that an organization can find the right key when
+// a device needs to be recovered. It is not encrypted, but it is authenticated
+// along with the key.
+type EscrowMetadata struct {
+	Hostname    string            `json:"hostname,omitempty"`
+	MachineID   string            `json:"machine-id,omitempty"`   // The contents of /etc/machine-id
+	SerialNo    string            `json:"serial-no,omitempty"`    // The device serial number
+	VolumeUUID  string            `json:"volume-uuid,omitempty"`  // The UUID of the LUKS2 container
+	KeyslotName string            `json:"keyslot-name,omitempty"` // The name of the keyslot the key belongs to
+	Created     time.Time         `json:"created"`
+	Extra       map[string]string `json:"extra,omitempty"` // Any other organization specific information
+}
+
+// EscrowBlob contains a volume unlock key or recovery key that has been encrypted to
+// an organization's public key along with the identity of the device it belongs to,
+// so that it can be stored centrally and used to recover the device later on. It is
+// designed to be serialized as JSON.
+//
+// The key is encrypted with AES-256-GCM using a random key, which is itself encrypted
+// to the organization's RSA public key with RSA-OAEP and SHA-256.
+type EscrowBlob struct {
+	Version    int            `json:"version"`
+	KeyType    EscrowKeyType  `json:"key-type"`
+	Metadata   EscrowMetadata `json:"metadata"`
+	Recipient  []byte         `json:"recipient"`   // The SHA-256 digest of the DER encoded public key that the key is encrypted to
+	WrappedKey []byte         `json:"wrapped-key"` // The symmetric key, encrypted to the recipient
+	Nonce      []byte         `json:"nonce"`
+	Ciphertext []byte         `json:"ciphertext"`
+}
+
+// additionalData returns the associated data used to bind the encrypted key to the
+// type and metadata of this escrow blob.
+func (b *EscrowBlob) additionalData() ([]byte, error) {
+	metadata, err := json.Marshal(b.Metadata)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot marshal metadata: %w", err)
+	}
+
+	var ad bytes.Buffer
+	fmt.Fprintf(&ad, "SECBOOT-ESCROW-%d\x00%s\x00", b.Version, b.KeyType)
+	ad.Write(b.Recipient)
+	ad.Write(metadata)
+	return ad.Bytes(), nil
+}
+
+func escrowRecipientId(recipient crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(recipient)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot marshal public key: %w", err)
+	}
+	h := sha256.Sum256(der)
+	return h[:], nil
+}
+
+// NewEscrowBlob encrypts the supplied key to the supplied organization public key,
+// along with the supplied metadata, for central escrow. The key type is recorded in
+// the blob so that the key can be interpreted correctly when it is recovered. The
+// recipient must currently be a *rsa.PublicKey. If the Created field of metadata is
+// not set, the current time is used.
+//
+// The returned blob can be decrypted with EscrowBlob.Open by a holder of the
+// corresponding private key.
+func NewEscrowBlob(rand io.Reader, keyType EscrowKeyType, key []byte, recipient crypto.PublicKey, metadata *EscrowMetadata) (*EscrowBlob, error) {
+	switch keyType {
+	case EscrowKeyTypeUnlockKey, EscrowKeyTypeRecoveryKey:
+	default:
+		return nil, fmt.Errorf("invalid key type %q", keyType)
+	}
+	if len(key) == 0 {
+		return nil, errors.New("no key supplied")
+	}
+
+	rsaRecipient, ok := recipient.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported recipient key type %T", recipient)
+	}
+	recipientId, err := escrowRecipientId(rsaRecipient)
+	if err != nil {
+		return nil, err
+	}
+
+	blob := &EscrowBlob{
+		Version:   escrowBlobVersion,
+		KeyType:   keyType,
+		Recipient: recipientId}
+	if metadata != nil {
+		blob.Metadata = *metadata
+	}
+	if blob.Metadata.Created.IsZero() {
+		blob.Metadata.Created = time.Now()
+	}
+	// Drop the monotonic clock reading and location so that the metadata
+	// serializes the same way after a round trip.
+	blob.Metadata.Created = blob.Metadata.Created.UTC().Round(0)
+
+	symKey := make([]byte, escrowKeyLen)
+	if _, err := io.ReadFull(rand, symKey); err != nil {
+		return nil, xerrors.Errorf("cannot obtain symmetric key: %w", err)
+	}
+
+	c, err := aes.NewCipher(symKey)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(c)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create AEAD: %w", err)
+	}
+	blob.Nonce = make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand, blob.Nonce); err != nil {
+		return nil, xerrors.Errorf("cannot obtain nonce: %w", err)
+	}
+
+	blob.WrappedKey, err = rsa.EncryptOAEP(sha256.New(), rand, rsaRecipient, symKey, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot wrap symmetric key: %w", err)
+	}
+
+	ad, err := blob.additionalData()
+	if err != nil {
+		return nil, err
+	}
+	blob.Ciphertext = aead.Seal(nil, blob.Nonce, key, ad)
+
+	return blob, nil
+}
+
+// NewRecoveryKeyEscrowBlob is a convenience wrapper around NewEscrowBlob for
+// escrowing a recovery key.
+func NewRecoveryKeyEscrowBlob(rand io.Reader, key RecoveryKey, recipient crypto.PublicKey, metadata *EscrowMetadata) (*EscrowBlob, error) {
+	return NewEscrowBlob(rand, EscrowKeyTypeRecoveryKey, key[:], recipient, metadata)
+}
+
+// Open decrypts the key contained in this escrow blob using the supplied private key,
+// which must correspond to the public key that the blob was created for. It is
+// normally a *rsa.PrivateKey, but may be any crypto.Decrypter that supports
+// RSA-OAEP, such as a key held in a HSM. If the blob has been modified, an error is
+// returned.
+func (b *EscrowBlob) Open(key crypto.Decrypter) ([]byte, error) {
+	if b.Version != escrowBlobVersion {
+		return nil, fmt.Errorf("unsupported escrow blob version (%d)", b.Version)
+	}
+
+	recipientId, err := escrowRecipientId(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(recipientId, b.Recipient) {
+		return nil, errors.New("the escrow blob was not encrypted to the supplied key")
+	}
+
+	symKey, err := key.Decrypt(nil, b.WrappedKey, &rsa.OAEPOptions{Hash: crypto.SHA256})
+	if err != nil {
+		return nil, xerrors.Errorf("cannot unwrap symmetric key: %w", err)
+	}
+	if len(symKey) != escrowKeyLen {
+		return nil, errors.New("invalid symmetric key length")
+	}
+
+	c, err := aes.NewCipher(symKey)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(c)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create AEAD: %w", err)
+	}
+	if len(b.Nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce length")
+	}
+
+	ad, err := b.additionalData()
+	if err != nil {
+		return nil, err
+	}
+	out, err := aead.Open(nil, b.Nonce, b.Ciphertext, ad)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot decrypt key: %w", err)
+	}
+	return out, nil
+}
+
+// OpenRecoveryKey decrypts the recovery key contained in this escrow blob using the
+// supplied private key, in the same way as Open.
+func (b *EscrowBlob) OpenRecoveryKey(key crypto.Decrypter) (out RecoveryKey, err error) {
+	if b.KeyType != EscrowKeyTypeRecoveryKey {
+		return RecoveryKey{}, errors.New("escrow blob does not contain a recovery key")
+	}
+	k, err := b.Open(key)
+	if err != nil {
+		return RecoveryKey{}, err
+	}
+	if len(k) != len(out) {
+		return RecoveryKey{}, errors.New("invalid recovery key length")
+	}
+	copy(out[:], k)
+	return out, nil
+}
@@ -0,0 +1,130 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+)
+
+type escrowSuite struct {
+	cryptTestBase
+	key *rsa.PrivateKey
+}
+
+var _ = Suite(&escrowSuite{})
+
+func (s *escrowSuite) SetUpSuite(c *C) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, IsNil)
+	s.key = key
+}
+
+func (s *escrowSuite) TestUnlockKeyRoundTrip(c *C) {
+	key := s.newPrimaryKey()
+	metadata := &EscrowMetadata{
+		Hostname:    "foo",
+		MachineID:   "ea3f0ee1d1a64e4aa5bde79a4c4ea3d5",
+		VolumeUUID:  "b3ef1af2-36e7-4a24-9cfe-5da5ac4ebd28",
+		KeyslotName: "default",
+		Created:     time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC),
+		Extra:       map[string]string{"asset-tag": "1234"}}
+
+	blob, err := NewEscrowBlob(rand.Reader, EscrowKeyTypeUnlockKey, key, &s.key.PublicKey, metadata)
+	c.Assert(err, IsNil)
+	c.Check(blob.KeyType, Equals, EscrowKeyTypeUnlockKey)
+	c.Check(blob.Metadata, DeepEquals, *metadata)
+
+	// Check that the blob survives serialization.
+	b, err := json.Marshal(blob)
+	c.Assert(err, IsNil)
+	var blob2 *EscrowBlob
+	c.Assert(json.Unmarshal(b, &blob2), IsNil)
+
+	recovered, err := blob2.Open(s.key)
+	c.Check(err, IsNil)
+	c.Check(recovered, DeepEquals, key)
+}
+
+func (s *escrowSuite) TestRecoveryKeyRoundTrip(c *C) {
+	key := s.newRecoveryKey()
+
+	blob, err := NewRecoveryKeyEscrowBlob(rand.Reader, key, &s.key.PublicKey, &EscrowMetadata{Hostname: "foo"})
+	c.Assert(err, IsNil)
+	c.Check(blob.KeyType, Equals, EscrowKeyTypeRecoveryKey)
+	c.Check(blob.Metadata.Created.IsZero(), Equals, false)
+
+	b, err := json.Marshal(blob)
+	c.Assert(err, IsNil)
+	var blob2 *EscrowBlob
+	c.Assert(json.Unmarshal(b, &blob2), IsNil)
+
+	recovered, err := blob2.OpenRecoveryKey(s.key)
+	c.Check(err, IsNil)
+	c.Check(recovered, Equals, key)
+}
+
+func (s *escrowSuite) TestOpenModifiedMetadata(c *C) {
+	blob, err := NewEscrowBlob(rand.Reader, EscrowKeyTypeUnlockKey, s.newPrimaryKey(), &s.key.PublicKey, &EscrowMetadata{Hostname: "foo"})
+	c.Assert(err, IsNil)
+
+	blob.Metadata.Hostname = "bar"
+	_, err = blob.Open(s.key)
+	c.Check(err, ErrorMatches, "cannot decrypt key: .*")
+}
+
+func (s *escrowSuite) TestOpenWrongKey(c *C) {
+	blob, err := NewEscrowBlob(rand.Reader, EscrowKeyTypeUnlockKey, s.newPrimaryKey(), &s.key.PublicKey, nil)
+	c.Assert(err, IsNil)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, IsNil)
+	_, err = blob.Open(key)
+	c.Check(err, ErrorMatches, "the escrow blob was not encrypted to the supplied key")
+}
+
+func (s *escrowSuite) TestOpenRecoveryKeyWrongType(c *C) {
+	blob, err := NewEscrowBlob(rand.Reader, EscrowKeyTypeUnlockKey, s.newPrimaryKey(), &s.key.PublicKey, nil)
+	c.Assert(err, IsNil)
+
+	_, err = blob.OpenRecoveryKey(s.key)
+	c.Check(err, ErrorMatches, "escrow blob does not contain a recovery key")
+}
+
+func (s *escrowSuite) TestNewEscrowBlobUnsupportedRecipient(c *C) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+
+	_, err = NewEscrowBlob(rand.Reader, EscrowKeyTypeUnlockKey, s.newPrimaryKey(), &key.PublicKey, nil)
+	c.Check(err, ErrorMatches, "unsupported recipient key type \\*ecdsa.PublicKey")
+}
+
+func (s *escrowSuite) TestNewEscrowBlobInvalidKeyType(c *C) {
+	_, err := NewEscrowBlob(rand.Reader, "foo", s.newPrimaryKey(), &s.key.PublicKey, nil)
+	c.Check(err, ErrorMatches, "invalid key type \"foo\"")
+}
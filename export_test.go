@@ -19,6 +19,18 @@
 
 package secboot
 
+import (
+	"crypto"
+	"errors"
+	"syscall"
+	"time"
+
+	"github.com/canonical/go-efilib"
+
+	"github.com/snapcore/secboot/internal/luks2"
+	"github.com/snapcore/secboot/internal/secmem"
+)
+
 func MockLUKS2Activate(fn func(string, string, []byte) error) (restore func()) {
 	origActivate := luks2Activate
 	luks2Activate = fn
@@ -27,6 +39,14 @@ func MockLUKS2Activate(fn func(string, string, []byte) error) (restore func()) {
 	}
 }
 
+func MockLUKS2ActivatePlain(fn func(string, string, []byte, *luks2.PlainOptions) error) (restore func()) {
+	origActivatePlain := luks2ActivatePlain
+	luks2ActivatePlain = fn
+	return func() {
+		luks2ActivatePlain = origActivatePlain
+	}
+}
+
 func MockLUKS2Deactivate(fn func(string) error) (restore func()) {
 	origDeactivate := luks2Deactivate
 	luks2Deactivate = fn
@@ -34,3 +54,103 @@ func MockLUKS2Deactivate(fn func(string) error) (restore func()) {
 		luks2Deactivate = origDeactivate
 	}
 }
+
+func MockLUKS2GetVolumeStatus(fn func(string) (*luks2.VolumeStatus, error)) (restore func()) {
+	origGetVolumeStatus := luks2GetVolumeStatus
+	luks2GetVolumeStatus = fn
+	return func() {
+		luks2GetVolumeStatus = origGetVolumeStatus
+	}
+}
+
+func MockLockedMemoryUnavailable() (restore func()) {
+	origNewFromBytes := secmemNewFromBytes
+	secmemNewFromBytes = func(src []byte, requireLock bool) (*secmem.Buffer, error) {
+		if !requireLock {
+			return origNewFromBytes(src, requireLock)
+		}
+		secmem.Wipe(src)
+		return nil, &secmem.LockUnavailableError{Err: syscall.ENOMEM}
+	}
+	return func() {
+		secmemNewFromBytes = origNewFromBytes
+	}
+}
+
+func MockProgressUpdateInterval(d time.Duration) (restore func()) {
+	orig := progressUpdateInterval
+	progressUpdateInterval = d
+	return func() {
+		progressUpdateInterval = orig
+	}
+}
+
+func MockFIPSMode(enabled bool) (restore func()) {
+	orig := fipsMode
+	fipsMode = enabled
+	return func() {
+		fipsMode = orig
+	}
+}
+
+func MockSupportedKeyDataFeatures(features KeyDataFeatures) (restore func()) {
+	orig := supportedKeyDataFeatures
+	supportedKeyDataFeatures = features
+	return func() {
+		supportedKeyDataFeatures = orig
+	}
+}
+
+func (d *KeyData) SetFeatures(features KeyDataFeatures, critical bool) {
+	d.setFeatures(features, critical)
+}
+
+func MockRuntimeNumCPU(n int) (restore func()) {
+	orig := runtimeNumCPU
+	runtimeNumCPU = func() int { return n }
+	return func() {
+		runtimeNumCPU = orig
+	}
+}
+
+func (o *Argon2Options) CostParams() (Argon2Mode, *Argon2CostParams, error) {
+	return o.costParams()
+}
+
+func MockPBKDF2Duration(fn func(uint32, crypto.Hash) time.Duration) (restore func()) {
+	orig := pbkdf2Duration
+	pbkdf2Duration = fn
+	return func() {
+		pbkdf2Duration = orig
+	}
+}
+
+func MockEFIVars(vars map[string][]byte) (restore func()) {
+	origReadVar := efiReadVar
+	origWriteVar := efiWriteVar
+	efiReadVar = func(name string, guid efi.GUID) ([]byte, efi.VariableAttributes, error) {
+		data, ok := vars[name]
+		if !ok || guid != KeyDataEFIVariableGuid {
+			return nil, 0, efi.ErrVariableNotFound
+		}
+		return data, efiKeyDataAttrs, nil
+	}
+	efiWriteVar = func(name string, guid efi.GUID, attrs efi.VariableAttributes, data []byte) error {
+		if guid != KeyDataEFIVariableGuid || attrs != efiKeyDataAttrs {
+			return errors.New("unexpected variable")
+		}
+		if len(data) == 0 {
+			delete(vars, name)
+			return nil
+		}
+		if len(data) > efiKeyDataFragmentSize {
+			return errors.New("fragment too large")
+		}
+		vars[name] = append([]byte(nil), data...)
+		return nil
+	}
+	return func() {
+		efiReadVar = origReadVar
+		efiWriteVar = origWriteVar
+	}
+}
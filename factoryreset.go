@@ -0,0 +1,140 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/secmem"
+)
+
+// TransitionKeysParams provides the parameters for TransitionProtectedKeys.
+type TransitionKeysParams struct {
+	// Rand is the source of randomness for the new primary key. If this is
+	// nil, crypto/rand.Reader is used.
+	Rand io.Reader
+
+	// Passphrase is used to recover the keys from the old key data if it is
+	// protected with a passphrase.
+	Passphrase string
+
+	// DevicePath is the path of the LUKS2 container that the old key data
+	// unlocks.
+	DevicePath string
+
+	// KeyslotName is the name of the keyslot that the old key data is
+	// associated with. It is replaced by a keyslot with the same name that
+	// contains the new disk unlock key and the new key data.
+	KeyslotName string
+
+	// Protect is called with the new primary key, and must return key data
+	// that protects it along with a disk unlock key derived from it (see
+	// MakeDiskUnlockKey), using the platform's protector. It must be
+	// supplied.
+	Protect func(primaryKey PrimaryKey) (*KeyData, DiskUnlockKey, error)
+
+	// RevokeOld is called with the old primary key once the new keyslot is
+	// in place, and should revoke the protection policies of the old key data
+	// and any other key data that shares its primary key, eg, by incrementing
+	// the platform's policy counter. If this is nil, nothing is revoked.
+	RevokeOld func(oldPrimaryKey PrimaryKey) error
+}
+
+// TransitionProtectedKeys implements the key transition that is part of a factory
+// reset, for volumes that must be preserved across the reset, such as the save
+// partition on Ubuntu Core. The keys are recovered from the supplied old key data with
+// its protector, a new primary key is created, and it is protected with the new
+// protector by params.Protect. The keyslot associated with the old key data is then
+// replaced with one containing the new disk unlock key and key data, and the old
+// protection policies are revoked by params.RevokeOld.
+//
+// None of the recovered or newly created keys are returned, and they are wiped from
+// memory before this function returns. The new key data is returned, and has already
+// been written to the LUKS2 token of the new keyslot.
+//
+// The old keyslot is only removed once the new keyslot and its key data have been
+// written. If this is interrupted, the volume can still be unlocked with the old key
+// data, and the transition can be completed with CompleteLUKS2KeyRotation using the
+// recovery key. If RevokeOld fails, the keyslot has already been replaced and the error is
+// returned along with the new key data, so that the revocation can be retried.
+func TransitionProtectedKeys(oldKeyData *KeyData, params *TransitionKeysParams) (*KeyData, error) {
+	if params == nil || params.Protect == nil {
+		return nil, errors.New("no Protect function supplied")
+	}
+	if params.DevicePath == "" || params.KeyslotName == "" {
+		return nil, errors.New("no device path or keyslot name supplied")
+	}
+	rng := params.Rand
+	if rng == nil {
+		rng = rand.Reader
+	}
+
+	var (
+		oldKey    DiskUnlockKey
+		oldAuxKey AuxiliaryKey
+		err       error
+	)
+	if oldKeyData.AuthMode()&AuthModePassphrase != 0 {
+		oldKey, oldAuxKey, err = oldKeyData.RecoverKeysWithPassphrase(params.Passphrase)
+	} else {
+		oldKey, oldAuxKey, err = oldKeyData.RecoverKeys()
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("cannot recover keys from old key data: %w", err)
+	}
+	defer secmem.Wipe(oldKey)
+	defer secmem.Wipe(oldAuxKey)
+
+	size := len(oldAuxKey)
+	if size == 0 {
+		size = 32
+	}
+	primaryKey := make(PrimaryKey, size)
+	defer secmem.Wipe(primaryKey)
+	if _, err := io.ReadFull(rng, primaryKey); err != nil {
+		return nil, xerrors.Errorf("cannot create new primary key: %w", err)
+	}
+
+	newKeyData, newKey, err := params.Protect(primaryKey)
+	switch {
+	case err != nil:
+		return nil, xerrors.Errorf("cannot protect new primary key: %w", err)
+	case newKeyData == nil:
+		return nil, errors.New("no key data for new primary key")
+	}
+	defer secmem.Wipe(newKey)
+	newKeyData.SetRole(oldKeyData.Role())
+
+	if err := replaceLUKS2KeyslotKey(params.DevicePath, params.KeyslotName, oldKey, newKey, newKeyData, oldKeyData.Priority()); err != nil {
+		return nil, xerrors.Errorf("cannot replace keyslot: %w", err)
+	}
+
+	if params.RevokeOld != nil {
+		if err := params.RevokeOld(PrimaryKey(oldAuxKey)); err != nil {
+			return newKeyData, xerrors.Errorf("cannot revoke old key data: %w", err)
+		}
+	}
+
+	return newKeyData, nil
+}
@@ -0,0 +1,110 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"crypto"
+	"crypto/rand"
+	"errors"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/luks2/luks2test"
+)
+
+func (s *keyDataLUKS2Suite) newTransitionProtectFunc(c *C, newKey *DiskUnlockKey, newPrimaryKey *PrimaryKey) func(PrimaryKey) (*KeyData, DiskUnlockKey, error) {
+	return func(primaryKey PrimaryKey) (*KeyData, DiskUnlockKey, error) {
+		_, key, err := MakeDiskUnlockKey(rand.Reader, crypto.SHA256, primaryKey)
+		c.Assert(err, IsNil)
+		keyData, err := NewKeyData(s.mockProtectKeys(c, key, AuxiliaryKey(primaryKey), crypto.SHA256))
+		c.Assert(err, IsNil)
+
+		// Keep copies, as the originals are wiped.
+		*newKey = append(DiskUnlockKey(nil), key...)
+		*newPrimaryKey = append(PrimaryKey(nil), primaryKey...)
+		return keyData, key, nil
+	}
+}
+
+func (s *keyDataLUKS2Suite) TestTransitionProtectedKeys(c *C) {
+	keyData, key, auxKey := s.newKeyData(c)
+	keyData.SetRole("save")
+	path := s.newContainer(c, key)
+	c.Assert(keyData.WriteAtomic(NewLUKS2KeyDataWriter(path, "default")), IsNil)
+
+	var newKey DiskUnlockKey
+	var newPrimaryKey PrimaryKey
+	var revoked PrimaryKey
+	newKeyData, err := TransitionProtectedKeys(keyData, &TransitionKeysParams{
+		DevicePath:  path,
+		KeyslotName: "default",
+		Protect:     s.newTransitionProtectFunc(c, &newKey, &newPrimaryKey),
+		RevokeOld: func(oldPrimaryKey PrimaryKey) error {
+			revoked = append(PrimaryKey(nil), oldPrimaryKey...)
+			return nil
+		}})
+	c.Assert(err, IsNil)
+	c.Check(revoked, DeepEquals, PrimaryKey(auxKey))
+	c.Check(newPrimaryKey, Not(DeepEquals), PrimaryKey(auxKey))
+	c.Check(newKeyData.Role(), Equals, "save")
+
+	names, err := ListLUKS2ContainerKeyNames(path)
+	c.Check(err, IsNil)
+	c.Check(names, DeepEquals, []string{"default"})
+
+	r, err := NewLUKS2KeyDataReader(path, "default")
+	c.Assert(err, IsNil)
+	keyData2, err := ReadKeyData(r)
+	c.Assert(err, IsNil)
+
+	recoveredKey, recoveredAuxKey, err := keyData2.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, newKey)
+	c.Check(recoveredAuxKey, DeepEquals, AuxiliaryKey(newPrimaryKey))
+
+	luks2test.CheckLUKS2Passphrase(c, path, newKey)
+}
+
+func (s *keyDataLUKS2Suite) TestTransitionProtectedKeysRevokeError(c *C) {
+	keyData, key, _ := s.newKeyData(c)
+	path := s.newContainer(c, key)
+	c.Assert(keyData.WriteAtomic(NewLUKS2KeyDataWriter(path, "default")), IsNil)
+
+	var newKey DiskUnlockKey
+	var newPrimaryKey PrimaryKey
+	newKeyData, err := TransitionProtectedKeys(keyData, &TransitionKeysParams{
+		DevicePath:  path,
+		KeyslotName: "default",
+		Protect:     s.newTransitionProtectFunc(c, &newKey, &newPrimaryKey),
+		RevokeOld: func(_ PrimaryKey) error {
+			return errors.New("some error")
+		}})
+	c.Check(err, ErrorMatches, "cannot revoke old key data: some error")
+	c.Check(newKeyData, NotNil)
+
+	luks2test.CheckLUKS2Passphrase(c, path, newKey)
+}
+
+func (s *keyDataLUKS2Suite) TestTransitionProtectedKeysNoProtect(c *C) {
+	keyData, _, _ := s.newKeyData(c)
+	_, err := TransitionProtectedKeys(keyData, &TransitionKeysParams{DevicePath: "/dev/sda1", KeyslotName: "default"})
+	c.Check(err, ErrorMatches, "no Protect function supplied")
+}
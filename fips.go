@@ -0,0 +1,120 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"crypto"
+	"errors"
+
+	"github.com/snapcore/secboot/internal/luks2"
+)
+
+// KeyDataFeatureFIPS indicates that key data was created in FIPS mode. It is an
+// ignorable feature. Note that the key data isn't authenticated, so this is only
+// a declaration by whoever wrote the key data - it doesn't prove that the key data
+// was created in FIPS mode.
+const KeyDataFeatureFIPS KeyDataFeatures = 1 << 0
+
+// ErrNotFIPSKeyData is returned from any of the KeyData.RecoverKeys* functions
+// in FIPS mode if the key data was not created in FIPS mode.
+var ErrNotFIPSKeyData = errors.New("cannot recover key because the key data was not created in FIPS mode")
+
+// fipsMode indicates whether FIPS mode is enabled. It defaults to enabled in
+// builds with the secboot_fips tag.
+var fipsMode = fipsModeDefault
+
+// EnableFIPSMode enables FIPS mode for the rest of the lifetime of the process.
+// In FIPS mode, only FIPS-approved algorithms are used for key wrapping, key
+// derivation and hashing:
+//   - Passphrases are protected with PBKDF2-HMAC-SHA256 by default, and Argon2 is
+//     not permitted.
+//   - Only the SHA-2 family of digest algorithms is permitted for PBKDF2 and for
+//     the HMACs of authorized snap models.
+//   - New key data is marked with KeyDataFeatureFIPS, and keys can only be
+//     recovered from key data that has this feature and that only declares the
+//     use of FIPS-approved algorithms for the passphrase KDF and the HMACs of
+//     authorized snap models.
+//   - LUKS2 keyslots created by this package use PBKDF2 rather than Argon2.
+//
+// FIPS mode is always enabled in builds with the secboot_fips tag, and it can't
+// be disabled once it is enabled.
+func EnableFIPSMode() {
+	fipsMode = true
+}
+
+// FIPSMode indicates whether FIPS mode is enabled.
+func FIPSMode() bool {
+	return fipsMode
+}
+
+// isFIPSApprovedHash indicates whether the supplied digest algorithm is
+// permitted in FIPS mode.
+func isFIPSApprovedHash(alg crypto.Hash) bool {
+	switch alg {
+	case crypto.SHA224, crypto.SHA256, crypto.SHA384, crypto.SHA512:
+		return true
+	default:
+		return false
+	}
+}
+
+// CreatedInFIPSMode indicates whether this key data declares that it was created
+// in FIPS mode (see KeyDataFeatureFIPS).
+func (d *KeyData) CreatedInFIPSMode() bool {
+	critical, ignorable := d.Features()
+	return (critical|ignorable)&KeyDataFeatureFIPS != 0
+}
+
+// checkFIPS returns an error if FIPS mode is enabled and this key data doesn't
+// declare that it was created in FIPS mode, or it declares the use of algorithms
+// that are not permitted in FIPS mode.
+func (d *KeyData) checkFIPS() error {
+	if !fipsMode {
+		return nil
+	}
+	if !d.CreatedInFIPSMode() {
+		return ErrNotFIPSKeyData
+	}
+	if p := d.data.PassphraseProtectedPayload; p != nil {
+		if p.KDF.Type != kdfTypePBKDF2 || (p.KDF.Hash != nil && !isFIPSApprovedHash(p.KDF.Hash.Hash)) {
+			return ErrNotFIPSKeyData
+		}
+	}
+	if alg := d.data.AuthorizedSnapModels.Alg.Hash; alg != crypto.Hash(0) && !isFIPSApprovedHash(alg) {
+		return ErrNotFIPSKeyData
+	}
+	return nil
+}
+
+// luks2KDFOptions returns the supplied KDF options for a LUKS2 keyslot, adjusted
+// so that PBKDF2 is used in FIPS mode. Forced costs are replaced with the minimum
+// PBKDF2 iteration count accepted by cryptsetup.
+func luks2KDFOptions(opts luks2.KDFOptions) luks2.KDFOptions {
+	if !fipsMode {
+		return opts
+	}
+	opts.Type = luks2.KDFTypePBKDF2
+	opts.MemoryKiB = 0
+	opts.Parallel = 0
+	if opts.ForceIterations != 0 {
+		opts.ForceIterations = 1000
+	}
+	return opts
+}
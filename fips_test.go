@@ -0,0 +1,124 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"crypto"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+)
+
+type fipsSuite struct {
+	keyDataTestBase
+}
+
+var _ = Suite(&fipsSuite{})
+
+func (s *fipsSuite) TestNewKeyDataInFIPSMode(c *C) {
+	restore := MockFIPSMode(true)
+	defer restore()
+
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+	c.Check(keyData.CreatedInFIPSMode(), Equals, true)
+
+	critical, ignorable := keyData.Features()
+	c.Check(critical, Equals, KeyDataFeatures(0))
+	c.Check(ignorable, Equals, KeyDataFeatureFIPS)
+
+	recoveredKey, recoveredAuxKey, err := keyData.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, key)
+	c.Check(recoveredAuxKey, DeepEquals, auxKey)
+}
+
+func (s *fipsSuite) TestNewKeyDataNotInFIPSMode(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+	c.Check(keyData.CreatedInFIPSMode(), Equals, false)
+}
+
+func (s *fipsSuite) TestNewKeyDataInFIPSModeUnapprovedHash(c *C) {
+	restore := MockFIPSMode(true)
+	defer restore()
+
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA1)
+
+	_, err := NewKeyData(protected)
+	c.Check(err, ErrorMatches, "snap model auth digest algorithm is not permitted in FIPS mode")
+}
+
+func (s *fipsSuite) TestRecoverKeysNonFIPSKeyDataInFIPSMode(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	restore := MockFIPSMode(true)
+	defer restore()
+
+	_, _, err = keyData.RecoverKeys()
+	c.Check(err, Equals, ErrNotFIPSKeyData)
+	c.Check(s.handler.recoverKeysCalls, Equals, 0)
+}
+
+func (s *fipsSuite) TestKeyDataWithPassphraseInFIPSModeDefaultsToPBKDF2(c *C) {
+	restore := MockFIPSMode(true)
+	defer restore()
+	restore = MockPBKDF2Duration(func(iterations uint32, h crypto.Hash) time.Duration {
+		c.Check(h, Equals, crypto.SHA256)
+		return 100 * time.Second
+	})
+	defer restore()
+
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyDataWithPassphrase(protected, "passphrase", nil)
+	c.Assert(err, IsNil)
+	c.Check(keyData.PassphraseParams(), DeepEquals, &PassphraseParams{KDFType: "pbkdf2", Time: 2000})
+
+	recoveredKey, recoveredAuxKey, err := keyData.RecoverKeysWithPassphrase("passphrase")
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, key)
+	c.Check(recoveredAuxKey, DeepEquals, auxKey)
+}
+
+func (s *fipsSuite) TestKeyDataWithPassphraseInFIPSModeRejectsArgon2(c *C) {
+	restore := MockFIPSMode(true)
+	defer restore()
+
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	_, err := NewKeyDataWithPassphrase(protected, "passphrase", &Argon2Options{MemoryKiB: 32, ForceIterations: 4, Parallel: 1})
+	c.Check(err, ErrorMatches, "cannot set passphrase: KDF is not permitted in FIPS mode")
+}
@@ -0,0 +1,198 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package argon2
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	// MinMemoryCostKiB is the minimum permitted memory cost.
+	MinMemoryCostKiB = 32
+
+	// MinTimeCost is the minimum permitted time cost, and is the minimum
+	// number of passes that cryptsetup uses.
+	MinTimeCost = 4
+
+	// maxBenchmarkIterations is the maximum number of times that the KDF is
+	// executed when benchmarking.
+	maxBenchmarkIterations = 10
+
+	// benchmarkTolerance is the fraction of the target duration that a benchmark
+	// result is permitted to deviate by.
+	benchmarkTolerance = 0.1
+)
+
+// Mode describes the Argon2 variant.
+type Mode int
+
+const (
+	// ModeI is the Argon2i variant, which is resistant to side-channel attacks.
+	ModeI Mode = iota
+
+	// ModeID is the Argon2id variant, which is a hybrid of Argon2i and Argon2d.
+	ModeID
+)
+
+// CostParams defines the cost parameters for key derivation using Argon2.
+type CostParams struct {
+	// Time corresponds to the number of passes over the memory.
+	Time uint32
+
+	// MemoryKiB is the amount of memory to use in KiB.
+	MemoryKiB uint32
+
+	// Threads is the number of parallel threads to use.
+	Threads uint8
+}
+
+func (p *CostParams) validate() error {
+	switch {
+	case p.Time < 1:
+		return errors.New("invalid time cost")
+	case p.MemoryKiB < MinMemoryCostKiB:
+		return errors.New("invalid memory cost")
+	case p.Threads < 1:
+		return errors.New("invalid number of threads")
+	}
+	return nil
+}
+
+// Key derives a key of the specified length from the supplied passphrase and salt,
+// using the specified Argon2 variant and cost parameters.
+func Key(mode Mode, passphrase string, salt []byte, params *CostParams, keyLen uint32) ([]byte, error) {
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+
+	switch mode {
+	case ModeI:
+		return argon2.Key([]byte(passphrase), salt, params.Time, params.MemoryKiB, params.Threads, keyLen), nil
+	case ModeID:
+		return argon2.IDKey([]byte(passphrase), salt, params.Time, params.MemoryKiB, params.Threads, keyLen), nil
+	default:
+		return nil, errors.New("invalid mode")
+	}
+}
+
+// KeyDuration returns the time taken to derive a key using the specified Argon2
+// variant and cost parameters.
+func KeyDuration(mode Mode, params *CostParams) (time.Duration, error) {
+	salt := make([]byte, 16)
+	start := time.Now()
+	if _, err := Key(mode, "foo", salt, params, 32); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// KeyDurationFunc returns the time taken to derive a key with the supplied cost
+// parameters.
+type KeyDurationFunc func(params *CostParams) (time.Duration, error)
+
+// BenchmarkParams defines the parameters for Benchmark.
+type BenchmarkParams struct {
+	// MaxMemoryCostKiB is the maximum memory cost in KiB.
+	MaxMemoryCostKiB uint32
+
+	// TargetDuration is the target time for key derivation.
+	TargetDuration time.Duration
+
+	// Threads is the number of parallel threads to use.
+	Threads uint8
+}
+
+func scaleUint32(v uint32, scale float64, min, max uint32) uint32 {
+	n := math.Round(float64(v) * scale)
+	switch {
+	case n < float64(min):
+		return min
+	case n > float64(max):
+		return max
+	default:
+		return uint32(n)
+	}
+}
+
+// Benchmark computes the cost parameters required for key derivation to take
+// approximately the requested target duration, using the supplied function to
+// measure the time taken for a set of cost parameters.
+//
+// The time cost is kept at its minimum and the memory cost is adjusted first,
+// up to the supplied maximum. Once the memory cost reaches the maximum, the
+// time cost is increased. If the target duration cannot be achieved with the
+// minimum memory and time costs, these minimum costs are returned.
+func Benchmark(params *BenchmarkParams, keyFn KeyDurationFunc) (*CostParams, error) {
+	if params.TargetDuration <= 0 {
+		return nil, errors.New("invalid target duration")
+	}
+	if params.Threads < 1 {
+		return nil, errors.New("invalid number of threads")
+	}
+
+	maxMemoryCostKiB := params.MaxMemoryCostKiB
+	if maxMemoryCostKiB < MinMemoryCostKiB {
+		maxMemoryCostKiB = MinMemoryCostKiB
+	}
+
+	cost := &CostParams{
+		Time:      MinTimeCost,
+		MemoryKiB: MinMemoryCostKiB,
+		Threads:   params.Threads}
+
+	for i := 0; i < maxBenchmarkIterations; i++ {
+		d, err := keyFn(cost)
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			d = 1
+		}
+
+		scale := float64(params.TargetDuration) / float64(d)
+		if math.Abs(scale-1) <= benchmarkTolerance {
+			break
+		}
+
+		next := *cost
+		switch {
+		case scale < 1 && cost.Time > MinTimeCost:
+			next.Time = scaleUint32(cost.Time, scale, MinTimeCost, math.MaxUint32)
+		case scale < 1:
+			next.MemoryKiB = scaleUint32(cost.MemoryKiB, scale, MinMemoryCostKiB, maxMemoryCostKiB)
+		case cost.MemoryKiB < maxMemoryCostKiB:
+			next.MemoryKiB = scaleUint32(cost.MemoryKiB, scale, MinMemoryCostKiB, maxMemoryCostKiB)
+		default:
+			next.Time = scaleUint32(cost.Time, scale, MinTimeCost, math.MaxUint32)
+		}
+
+		if next == *cost {
+			// We can't adjust the costs any further.
+			break
+		}
+		cost = &next
+	}
+
+	return cost, nil
+}
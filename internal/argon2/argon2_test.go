@@ -0,0 +1,129 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package argon2_test
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/internal/argon2"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type argon2Suite struct{}
+
+var _ = Suite(&argon2Suite{})
+
+func (s *argon2Suite) TestKeyModeI(c *C) {
+	// Test vector from golang.org/x/crypto/argon2.
+	key, err := Key(ModeI, "password", []byte("somesalt"), &CostParams{Time: 1, MemoryKiB: 64, Threads: 1}, 24)
+	c.Check(err, IsNil)
+	c.Check(hex.EncodeToString(key), Equals, "b9c401d1844a67d50eae3967dc28870b22e508092e861a37")
+}
+
+func (s *argon2Suite) TestKeyModeID(c *C) {
+	// Test vector from golang.org/x/crypto/argon2.
+	key, err := Key(ModeID, "password", []byte("somesalt"), &CostParams{Time: 1, MemoryKiB: 64, Threads: 1}, 24)
+	c.Check(err, IsNil)
+	c.Check(hex.EncodeToString(key), Equals, "655ad15eac652dc59f7170a7332bf49b8469be1fdb9c28bb")
+}
+
+func (s *argon2Suite) TestKeyInvalidParams(c *C) {
+	_, err := Key(ModeID, "password", []byte("somesalt"), &CostParams{Time: 0, MemoryKiB: 64, Threads: 1}, 32)
+	c.Check(err, ErrorMatches, "invalid time cost")
+	_, err = Key(ModeID, "password", []byte("somesalt"), &CostParams{Time: 1, MemoryKiB: 8, Threads: 1}, 32)
+	c.Check(err, ErrorMatches, "invalid memory cost")
+	_, err = Key(ModeID, "password", []byte("somesalt"), &CostParams{Time: 1, MemoryKiB: 64, Threads: 0}, 32)
+	c.Check(err, ErrorMatches, "invalid number of threads")
+	_, err = Key(Mode(5), "password", []byte("somesalt"), &CostParams{Time: 1, MemoryKiB: 64, Threads: 1}, 32)
+	c.Check(err, ErrorMatches, "invalid mode")
+}
+
+// mockKeyDuration returns a KeyDurationFunc that models the time taken as being
+// proportional to the product of the time and memory costs.
+func mockKeyDuration(perKiBPass time.Duration, calls *int) KeyDurationFunc {
+	return func(params *CostParams) (time.Duration, error) {
+		*calls++
+		return time.Duration(params.Time) * time.Duration(params.MemoryKiB) * perKiBPass, nil
+	}
+}
+
+type testBenchmarkData struct {
+	params     *BenchmarkParams
+	perKiBPass time.Duration
+	expected   *CostParams
+}
+
+func (s *argon2Suite) testBenchmark(c *C, data *testBenchmarkData) {
+	var calls int
+	params, err := Benchmark(data.params, mockKeyDuration(data.perKiBPass, &calls))
+	c.Assert(err, IsNil)
+	c.Check(params, DeepEquals, data.expected)
+	c.Check(calls <= 10, Equals, true)
+}
+
+func (s *argon2Suite) TestBenchmarkScalesMemory(c *C) {
+	s.testBenchmark(c, &testBenchmarkData{
+		params: &BenchmarkParams{
+			MaxMemoryCostKiB: 1024 * 1024,
+			TargetDuration:   2 * time.Second,
+			Threads:          4},
+		perKiBPass: time.Microsecond,
+		expected:   &CostParams{Time: 4, MemoryKiB: 500000, Threads: 4}})
+}
+
+func (s *argon2Suite) TestBenchmarkScalesTimeAfterMaxMemory(c *C) {
+	s.testBenchmark(c, &testBenchmarkData{
+		params: &BenchmarkParams{
+			MaxMemoryCostKiB: 64 * 1024,
+			TargetDuration:   2 * time.Second,
+			Threads:          4},
+		perKiBPass: time.Microsecond,
+		expected:   &CostParams{Time: 31, MemoryKiB: 64 * 1024, Threads: 4}})
+}
+
+func (s *argon2Suite) TestBenchmarkMinimumCosts(c *C) {
+	s.testBenchmark(c, &testBenchmarkData{
+		params: &BenchmarkParams{
+			MaxMemoryCostKiB: 1024 * 1024,
+			TargetDuration:   time.Millisecond,
+			Threads:          1},
+		perKiBPass: time.Millisecond,
+		expected:   &CostParams{Time: 4, MemoryKiB: 32, Threads: 1}})
+}
+
+func (s *argon2Suite) TestBenchmarkInvalidParams(c *C) {
+	var calls int
+	_, err := Benchmark(&BenchmarkParams{Threads: 1}, mockKeyDuration(time.Microsecond, &calls))
+	c.Check(err, ErrorMatches, "invalid target duration")
+	_, err = Benchmark(&BenchmarkParams{TargetDuration: time.Second}, mockKeyDuration(time.Microsecond, &calls))
+	c.Check(err, ErrorMatches, "invalid number of threads")
+	c.Check(calls, Equals, 0)
+}
+
+func (s *argon2Suite) TestKeyDuration(c *C) {
+	d, err := KeyDuration(ModeID, &CostParams{Time: 1, MemoryKiB: 64, Threads: 1})
+	c.Check(err, IsNil)
+	c.Check(d > 0, Equals, true)
+}
@@ -0,0 +1,56 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package ecdsautil provides helpers for creating ECDSA keys.
+package ecdsautil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"io"
+	"math/big"
+)
+
+// GenerateKeyFromReader creates a new private key on the specified curve using
+// the method described in FIPS 186-4 appendix B.4.1, with the extra random bits
+// read from the supplied reader. Unlike ecdsa.GenerateKey, the same reader output
+// always produces the same key, which makes this suitable for deriving keys from
+// a KDF.
+func GenerateKeyFromReader(curve elliptic.Curve, r io.Reader) (*ecdsa.PrivateKey, error) {
+	params := curve.Params()
+
+	// FIPS 186-4 B.4.1 requires BitSize+64 random bits, rounded up to a whole
+	// number of bytes. This matters for curves such as P-521 where the bit size
+	// isn't a multiple of 8.
+	b := make([]byte, (params.BitSize+64+7)/8)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+
+	one := big.NewInt(1)
+	n := new(big.Int).Sub(params.N, one)
+	d := new(big.Int).SetBytes(b)
+	d.Mod(d, n)
+	d.Add(d, one)
+
+	key := &ecdsa.PrivateKey{D: d}
+	key.Curve = curve
+	key.X, key.Y = curve.ScalarBaseMult(d.Bytes())
+	return key, nil
+}
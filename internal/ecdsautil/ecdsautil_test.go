@@ -0,0 +1,76 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package ecdsautil_test
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"testing"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/internal/ecdsautil"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ecdsautilSuite struct{}
+
+var _ = Suite(&ecdsautilSuite{})
+
+func (s *ecdsautilSuite) testGenerateKeyFromReader(c *C, curve elliptic.Curve) {
+	seed := bytes.Repeat([]byte{0xa5}, 80)
+
+	key1, err := GenerateKeyFromReader(curve, bytes.NewReader(seed))
+	c.Assert(err, IsNil)
+	key2, err := GenerateKeyFromReader(curve, bytes.NewReader(seed))
+	c.Assert(err, IsNil)
+
+	c.Check(key1.D, DeepEquals, key2.D)
+	c.Check(curve.IsOnCurve(key1.X, key1.Y), Equals, true)
+	c.Check(key1.D.Sign(), Equals, 1)
+	c.Check(key1.D.Cmp(curve.Params().N), Equals, -1)
+}
+
+func (s *ecdsautilSuite) TestGenerateKeyFromReaderP256(c *C) {
+	s.testGenerateKeyFromReader(c, elliptic.P256())
+}
+
+func (s *ecdsautilSuite) TestGenerateKeyFromReaderP384(c *C) {
+	s.testGenerateKeyFromReader(c, elliptic.P384())
+}
+
+func (s *ecdsautilSuite) TestGenerateKeyFromReaderP521(c *C) {
+	s.testGenerateKeyFromReader(c, elliptic.P521())
+}
+
+func (s *ecdsautilSuite) TestGenerateKeyFromReaderP521ReadsEnoughBytes(c *C) {
+	// 521 bits plus 64 extra bits need 74 bytes.
+	_, err := GenerateKeyFromReader(elliptic.P521(), bytes.NewReader(make([]byte, 73)))
+	c.Check(err, ErrorMatches, "unexpected EOF")
+
+	_, err = GenerateKeyFromReader(elliptic.P521(), bytes.NewReader(bytes.Repeat([]byte{0xa5}, 74)))
+	c.Check(err, IsNil)
+}
+
+func (s *ecdsautilSuite) TestGenerateKeyFromReaderShortRead(c *C) {
+	_, err := GenerateKeyFromReader(elliptic.P256(), bytes.NewReader(make([]byte, 8)))
+	c.Check(err, ErrorMatches, "unexpected EOF")
+}
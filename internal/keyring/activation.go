@@ -0,0 +1,77 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package keyring
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
+const (
+	// PurposeActivationError is the purpose of the key that records why activation of a
+	// volume had to fall back to the recovery key.
+	PurposeActivationError = "activation-error"
+
+	// PurposeActivationProtector is the purpose of the key that records the name of the
+	// protector that was used to activate a volume.
+	PurposeActivationProtector = "protector"
+)
+
+// AddActivationErrorToUserKeyring records the errors that caused activation of the volume
+// with the specified name to fall back to the recovery key, one per line. Nothing is
+// recorded if there are no errors. A failure to add the key is logged but not returned,
+// as it shouldn't prevent activation.
+func AddActivationErrorToUserKeyring(errs []error, volumeName, prefix string) {
+	var s bytes.Buffer
+	for i, err := range errs {
+		if i > 0 {
+			s.WriteString("\n")
+		}
+		s.WriteString(err.Error())
+	}
+	if s.Len() == 0 {
+		return
+	}
+	if err := AddKeyToUserKeyring(s.Bytes(), volumeName, PurposeActivationError, prefix); err != nil {
+		fmt.Fprintf(os.Stderr, "secboot: Cannot add activation error to user keyring: %v\n", err)
+	}
+}
+
+// AddActivationProtectorToUserKeyring records the name of the protector that was used to
+// activate the volume with the specified name. Nothing is recorded if the name is empty.
+// A failure to add the key is logged but not returned.
+func AddActivationProtectorToUserKeyring(protector, volumeName, prefix string) {
+	if protector == "" {
+		return
+	}
+	if err := AddKeyToUserKeyring([]byte(protector), volumeName, PurposeActivationProtector, prefix); err != nil {
+		fmt.Fprintf(os.Stderr, "secboot: Cannot add protector name to user keyring: %v\n", err)
+	}
+}
+
+// RemoveActivationStateFromUserKeyring removes the keys that were added during activation
+// of the volume with the specified name to record how it was activated. Not all of these
+// will exist.
+func RemoveActivationStateFromUserKeyring(volumeName, prefix string) {
+	for _, purpose := range []string{PurposeActivationError, PurposeActivationProtector} {
+		RemoveKeyFromUserKeyring(volumeName, purpose, prefix)
+	}
+}
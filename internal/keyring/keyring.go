@@ -20,6 +20,8 @@
 package keyring
 
 import (
+	"time"
+
 	"golang.org/x/sys/unix"
 	"golang.org/x/xerrors"
 )
@@ -38,6 +40,35 @@ func AddKeyToUserKeyring(key []byte, devicePath, purpose, prefix string) error {
 	return err
 }
 
+// AddKeyToUserKeyringWithOptions adds a key to the user keyring in the same way as
+// AddKeyToUserKeyring. If perm is not zero, the permissions of the new key are set to the
+// supplied value. If timeout is not zero, the key expires once the supplied time has
+// elapsed. The timeout is rounded up to the nearest second.
+func AddKeyToUserKeyringWithOptions(key []byte, devicePath, purpose, prefix string, perm uint32, timeout time.Duration) error {
+	id, err := unix.AddKey(userKeyType, formatDesc(devicePath, purpose, prefix), key, userKeyring)
+	if err != nil {
+		return err
+	}
+
+	if timeout > 0 {
+		secs := int((timeout + time.Second - 1) / time.Second)
+		if _, err := unix.KeyctlInt(unix.KEYCTL_SET_TIMEOUT, id, secs, 0, 0); err != nil {
+			unix.KeyctlInt(unix.KEYCTL_INVALIDATE, id, 0, 0, 0)
+			return xerrors.Errorf("cannot set key timeout: %w", err)
+		}
+	}
+
+	// Set the permissions last, as they might not permit this process to modify the key.
+	if perm != 0 {
+		if err := unix.KeyctlSetperm(id, perm); err != nil {
+			unix.KeyctlInt(unix.KEYCTL_INVALIDATE, id, 0, 0, 0)
+			return xerrors.Errorf("cannot set key permissions: %w", err)
+		}
+	}
+
+	return nil
+}
+
 func GetKeyFromUserKeyring(devicePath, purpose, prefix string) ([]byte, error) {
 	id, err := unix.KeyctlSearch(userKeyring, userKeyType, formatDesc(devicePath, purpose, prefix), 0)
 	if err != nil {
@@ -66,3 +97,17 @@ func RemoveKeyFromUserKeyring(devicePath, purpose, prefix string) error {
 	_, err = unix.KeyctlInt(unix.KEYCTL_UNLINK, id, userKeyring, 0, 0)
 	return err
 }
+
+// InvalidateKeyInUserKeyring invalidates the specified key, which causes it to be immediately
+// unavailable to all processes. The kernel clears the key payload when the key is garbage
+// collected, which happens shortly afterwards. This is preferable to unlinking the key from the
+// user keyring when the key is sensitive, as other keyrings might also contain a link to it.
+func InvalidateKeyInUserKeyring(devicePath, purpose, prefix string) error {
+	id, err := unix.KeyctlSearch(userKeyring, userKeyType, formatDesc(devicePath, purpose, prefix), 0)
+	if err != nil {
+		return xerrors.Errorf("cannot find key: %w", err)
+	}
+
+	_, err = unix.KeyctlInt(unix.KEYCTL_INVALIDATE, id, 0, 0, 0)
+	return err
+}
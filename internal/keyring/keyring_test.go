@@ -20,9 +20,11 @@
 package keyring_test
 
 import (
+	"errors"
 	"math/rand"
 	"syscall"
 	"testing"
+	"time"
 
 	. "github.com/snapcore/secboot/internal/keyring"
 	"github.com/snapcore/secboot/internal/testutil"
@@ -183,3 +185,75 @@ func (s *keyringSuite) TestRemoveKeyFromUserKeyringNoKey(c *C) {
 	c.Check(xerrors.As(err, &e), testutil.IsTrue)
 	c.Check(e, Equals, syscall.ENOKEY)
 }
+
+func (s *keyringSuite) TestAddKeyToUserKeyringWithOptions(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	c.Check(AddKeyToUserKeyringWithOptions(key, "/dev/sda1", "foo", "bar", 0x3f030000, time.Hour), IsNil)
+
+	id, err := unix.KeyctlSearch(-4, "user", "bar:/dev/sda1:foo", 0)
+	c.Check(err, IsNil)
+
+	desc, err := unix.KeyctlString(unix.KEYCTL_DESCRIBE, id)
+	c.Check(err, IsNil)
+	c.Check(desc, Matches, "user;[[:digit:]]+;[[:digit:]]+;3f030000;bar:/dev/sda1:foo")
+
+	key2, err := GetKeyFromUserKeyring("/dev/sda1", "foo", "bar")
+	c.Check(err, IsNil)
+	c.Check(key2, DeepEquals, key)
+}
+
+func (s *keyringSuite) TestAddKeyToUserKeyringWithOptionsDefaults(c *C) {
+	c.Check(AddKeyToUserKeyringWithOptions(make([]byte, 32), "/dev/sda1", "foo", "bar", 0, 0), IsNil)
+
+	id, err := unix.KeyctlSearch(-4, "user", "bar:/dev/sda1:foo", 0)
+	c.Check(err, IsNil)
+
+	desc, err := unix.KeyctlString(unix.KEYCTL_DESCRIBE, id)
+	c.Check(err, IsNil)
+	c.Check(desc, Matches, "user;[[:digit:]]+;[[:digit:]]+;3f010000;bar:/dev/sda1:foo")
+}
+
+func (s *keyringSuite) TestInvalidateKeyInUserKeyring(c *C) {
+	c.Check(AddKeyToUserKeyring(make([]byte, 32), "/dev/sda1", "foo", "bar"), IsNil)
+	c.Check(InvalidateKeyInUserKeyring("/dev/sda1", "foo", "bar"), IsNil)
+
+	_, err := GetKeyFromUserKeyring("/dev/sda1", "foo", "bar")
+	c.Check(err, ErrorMatches, "cannot find key: required key not available")
+}
+
+func (s *keyringSuite) TestInvalidateKeyInUserKeyringNoKey(c *C) {
+	err := InvalidateKeyInUserKeyring("/dev/sda1", "foo", "bar")
+	c.Check(err, ErrorMatches, "cannot find key: required key not available")
+}
+
+func (s *keyringSuite) TestAddActivationStateToUserKeyring(c *C) {
+	AddActivationErrorToUserKeyring([]error{errors.New("error 1"), errors.New("error 2")}, "data", "bar")
+	AddActivationProtectorToUserKeyring("foo", "data", "bar")
+
+	msg, err := GetKeyFromUserKeyring("data", PurposeActivationError, "bar")
+	c.Check(err, IsNil)
+	c.Check(string(msg), Equals, "error 1\nerror 2")
+
+	protector, err := GetKeyFromUserKeyring("data", PurposeActivationProtector, "bar")
+	c.Check(err, IsNil)
+	c.Check(string(protector), Equals, "foo")
+
+	RemoveActivationStateFromUserKeyring("data", "bar")
+
+	for _, purpose := range []string{PurposeActivationError, PurposeActivationProtector} {
+		_, err := GetKeyFromUserKeyring("data", purpose, "bar")
+		c.Check(err, ErrorMatches, "cannot find key: required key not available")
+	}
+}
+
+func (s *keyringSuite) TestAddActivationStateToUserKeyringEmpty(c *C) {
+	AddActivationErrorToUserKeyring(nil, "data", "bar")
+	AddActivationProtectorToUserKeyring("", "data", "bar")
+
+	for _, purpose := range []string{PurposeActivationError, PurposeActivationProtector} {
+		_, err := GetKeyFromUserKeyring("data", purpose, "bar")
+		c.Check(err, ErrorMatches, "cannot find key: required key not available")
+	}
+}
@@ -0,0 +1,82 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package logger provides the hook used by secboot to emit structured debug events.
+package logger
+
+import (
+	"sync"
+)
+
+// Field is a key/value pair associated with an event.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Logger is implemented by types that receive structured debug events.
+type Logger interface {
+	// Debug is called for each debug event. The event argument is a short,
+	// stable identifier for the event, such as "tpm2-unseal".
+	Debug(event string, fields ...Field)
+}
+
+var (
+	mu     sync.RWMutex
+	logger Logger
+)
+
+// Set sets the logger that receives debug events. Supplying nil disables logging.
+func Set(l Logger) {
+	mu.Lock()
+	defer mu.Unlock()
+	logger = l
+}
+
+// Enabled indicates whether a logger has been set. It can be used to avoid the cost
+// of computing fields that are only used for logging.
+func Enabled() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return logger != nil
+}
+
+// Debug emits a debug event to the current logger, if one is set.
+func Debug(event string, fields ...Field) {
+	mu.RLock()
+	l := logger
+	mu.RUnlock()
+	if l == nil {
+		return
+	}
+	l.Debug(event, fields...)
+}
+
+// F is a convenience function for creating a Field.
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Err returns a Field for the supplied error, which is nil on success.
+func Err(err error) Field {
+	if err == nil {
+		return Field{Key: "error", Value: nil}
+	}
+	return Field{Key: "error", Value: err.Error()}
+}
@@ -0,0 +1,68 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package logger_test
+
+import (
+	"errors"
+	"testing"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/internal/logger"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type loggerSuite struct{}
+
+var _ = Suite(&loggerSuite{})
+
+type event struct {
+	name   string
+	fields []Field
+}
+
+type mockLogger struct {
+	events []event
+}
+
+func (l *mockLogger) Debug(name string, fields ...Field) {
+	l.events = append(l.events, event{name, fields})
+}
+
+func (s *loggerSuite) TestDebug(c *C) {
+	l := new(mockLogger)
+	Set(l)
+	defer Set(nil)
+
+	c.Check(Enabled(), Equals, true)
+
+	Debug("foo", F("a", 1), Err(errors.New("some error")))
+	Debug("bar")
+	c.Check(l.events, DeepEquals, []event{
+		{"foo", []Field{{"a", 1}, {"error", "some error"}}},
+		{"bar", nil}})
+}
+
+func (s *loggerSuite) TestDebugNoLogger(c *C) {
+	Set(nil)
+	c.Check(Enabled(), Equals, false)
+	Debug("foo", F("a", 1))
+}
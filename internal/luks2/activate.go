@@ -1,5 +1,8 @@
 // -*- Mode: Go; indent-tabs-mode: t -*-
 
+//go:build !secboot_static
+// +build !secboot_static
+
 /*
  * Copyright (C) 2020 Canonical Ltd
  *
@@ -28,10 +31,6 @@ import (
 	"github.com/snapcore/snapd/osutil"
 )
 
-var (
-	systemdCryptsetupPath = "/lib/systemd/systemd-cryptsetup"
-)
-
 // Activate unlocks the LUKS device at sourceDevicePath using systemd-cryptsetup and creates a device
 // mapping with the supplied volumeName. The device is unlocked using the supplied key.
 func Activate(volumeName, sourceDevicePath string, key []byte) error {
@@ -47,6 +46,30 @@ func Activate(volumeName, sourceDevicePath string, key []byte) error {
 	return nil
 }
 
+// ActivatePlain creates a plain dm-crypt mapping with the supplied volumeName for the
+// device at sourceDevicePath using systemd-cryptsetup. The supplied key is used directly
+// as the volume key, and its length determines the key size. As plain volumes have no
+// header, there is no way to detect that the key is incorrect.
+func ActivatePlain(volumeName, sourceDevicePath string, key []byte, options *PlainOptions) error {
+	if options == nil {
+		options = &PlainOptions{}
+	}
+
+	attachOptions := fmt.Sprintf("plain,cipher=%s,size=%d,hash=plain,offset=%d,sector-size=%d,tries=1",
+		options.cipher(), len(key)*8, options.Offset, options.sectorSize())
+
+	cmd := exec.Command(systemdCryptsetupPath, "attach", volumeName, sourceDevicePath, "/dev/stdin", attachOptions)
+	cmd.Env = os.Environ()
+	cmd.Env = append(cmd.Env, "SYSTEMD_LOG_TARGET=console")
+	cmd.Stdin = bytes.NewReader(key)
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("systemd-cryptsetup failed with: %v", osutil.OutputErr(output, err))
+	}
+
+	return nil
+}
+
 // Deactivate detaches the LUKS volume with the supplied name.
 func Deactivate(volumeName string) error {
 	cmd := exec.Command(systemdCryptsetupPath, "detach", volumeName)
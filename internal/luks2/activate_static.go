@@ -0,0 +1,320 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+//go:build secboot_static
+// +build secboot_static
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/xerrors"
+)
+
+// This file provides an in-process implementation of Activate and Deactivate
+// for static builds (the secboot_static build tag), which must not depend on
+// being able to execute systemd-cryptsetup. The volume key is recovered with
+// RecoverVolumeKey and the dm-crypt mapping is created directly with the
+// device-mapper ioctl interface. In comparison with systemd-cryptsetup:
+//  - only keyslots that use aes-xts-plain64 encryption can be unlocked. Other
+//    keyslots are skipped.
+//  - only the aes-xts-plain64 cipher is supported for LUKS2 containers, and
+//    containers with integrity protection are not supported.
+//  - there is no synchronization with udev, so callers must wait for the
+//    device node to appear before using it.
+
+const (
+	dmNameLen     = 128
+	dmUUIDLen     = 129
+	dmMaxTypeName = 16
+
+	dmVersionMajor = 4
+
+	// ioctl numbers from linux/dm-ioctl.h, which are _IOWR(0xfd, nr, struct dm_ioctl).
+	dmDevCreateCmd  = 0xc138fd03
+	dmDevRemoveCmd  = 0xc138fd04
+	dmDevSuspendCmd = 0xc138fd06
+	dmTableLoadCmd  = 0xc138fd09
+
+	dmSecureDataFlag = 1 << 15
+
+	sectorSize = 512
+)
+
+var dmControlPath = "/dev/mapper/control"
+
+// dmIoctlHdr corresponds to struct dm_ioctl.
+type dmIoctlHdr struct {
+	Version     [3]uint32
+	DataSize    uint32
+	DataStart   uint32
+	TargetCount uint32
+	OpenCount   int32
+	Flags       uint32
+	EventNr     uint32
+	Padding     uint32
+	Dev         uint64
+	Name        [dmNameLen]byte
+	UUID        [dmUUIDLen]byte
+	Data        [7]byte
+}
+
+// dmTargetSpec corresponds to struct dm_target_spec.
+type dmTargetSpec struct {
+	SectorStart uint64
+	Length      uint64
+	Status      int32
+	Next        uint32
+	TargetType  [dmMaxTypeName]byte
+}
+
+func nativeEndian() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+func dmIoctl(cmd uintptr, name, uuid string, flags uint32, targetCount uint32, data []byte) error {
+	if len(name) >= dmNameLen {
+		return errors.New("name too long")
+	}
+	if len(uuid) >= dmUUIDLen {
+		return errors.New("uuid too long")
+	}
+
+	f, err := os.OpenFile(dmControlPath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hdr := dmIoctlHdr{
+		Version:     [3]uint32{dmVersionMajor, 0, 0},
+		TargetCount: targetCount,
+		Flags:       flags}
+	hdrSize := uint32(binary.Size(hdr))
+	hdr.DataStart = hdrSize
+	hdr.DataSize = hdrSize + uint32(len(data))
+	copy(hdr.Name[:], name)
+	copy(hdr.UUID[:], uuid)
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, nativeEndian(), &hdr)
+	buf.Write(data)
+	b := buf.Bytes()
+	defer func() {
+		// The buffer may contain the volume key.
+		for i := range b {
+			b[i] = 0
+		}
+	}()
+
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), cmd, uintptr(unsafe.Pointer(&b[0]))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func blockDeviceSize(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if fi.Mode().IsRegular() {
+		return uint64(fi.Size()), nil
+	}
+
+	var sz uint64
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.BLKGETSIZE64, uintptr(unsafe.Pointer(&sz))); errno != 0 {
+		return 0, errno
+	}
+	return sz, nil
+}
+
+// cryptTarget returns the table for the dm-crypt target corresponding to the
+// supplied volume key.
+func cryptTarget(sourceDevicePath string, vk *VolumeKeyInfo) ([]byte, error) {
+	segment := vk.Segment
+	switch {
+	case segment.Type != "crypt":
+		return nil, fmt.Errorf("unsupported segment type %q", segment.Type)
+	case segment.Encryption != "aes-xts-plain64":
+		return nil, fmt.Errorf("unsupported segment encryption %q", segment.Encryption)
+	case segment.Integrity != nil:
+		return nil, errors.New("segments with integrity protection are not supported")
+	case segment.Offset%sectorSize != 0:
+		return nil, errors.New("invalid segment offset")
+	}
+
+	size := segment.Size
+	if segment.DynamicSize {
+		devSize, err := blockDeviceSize(sourceDevicePath)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot determine device size: %w", err)
+		}
+		if devSize < segment.Offset {
+			return nil, errors.New("device is smaller than segment offset")
+		}
+		size = devSize - segment.Offset
+	}
+	if size%sectorSize != 0 || size == 0 {
+		return nil, errors.New("invalid segment size")
+	}
+
+	return cryptTargetTable(segment.Encryption, vk.Key, segment.IVTweak, sourceDevicePath,
+		segment.Offset/sectorSize, segment.SectorSize, size/sectorSize), nil
+}
+
+// plainCryptTarget returns the table for a plain dm-crypt target with the supplied
+// key and options.
+func plainCryptTarget(sourceDevicePath string, key []byte, options *PlainOptions) ([]byte, error) {
+	devSize, err := blockDeviceSize(sourceDevicePath)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot determine device size: %w", err)
+	}
+	if devSize/sectorSize <= options.Offset {
+		return nil, errors.New("device is smaller than offset")
+	}
+
+	length := devSize/sectorSize - options.Offset
+	if options.sectorSize()%sectorSize != 0 || length%uint64(options.sectorSize()/sectorSize) != 0 {
+		return nil, errors.New("invalid sector size")
+	}
+
+	return cryptTargetTable(options.cipher(), key, 0, sourceDevicePath, options.Offset, options.sectorSize(), length), nil
+}
+
+// cryptTargetTable returns a table containing a single dm-crypt target with the
+// supplied parameters. The offset and length are in 512-byte sectors.
+func cryptTargetTable(cipher string, key []byte, ivOffset uint64, sourceDevicePath string, offset uint64, encSectorSize int, length uint64) []byte {
+	params := fmt.Sprintf("%s %s %d %s %d", cipher, hex.EncodeToString(key), ivOffset, sourceDevicePath, offset)
+	if encSectorSize != 0 && encSectorSize != sectorSize {
+		params += fmt.Sprintf(" 1 sector_size:%d", encSectorSize)
+	}
+
+	spec := dmTargetSpec{Length: length}
+	copy(spec.TargetType[:], "crypt")
+
+	// The parameters are a NULL terminated string, padded so that the next
+	// target would be 8-byte aligned.
+	specSize := binary.Size(spec)
+	paramsSize := len(params) + 1
+	paramsSize += (8 - ((specSize + paramsSize) % 8)) % 8
+	spec.Next = uint32(specSize + paramsSize)
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, nativeEndian(), &spec)
+	buf.WriteString(params)
+	buf.Write(make([]byte, paramsSize-len(params)))
+	return buf.Bytes()
+}
+
+// createCryptDevice creates a device mapper device with the supplied name and uuid,
+// and loads and activates the supplied table. The device is removed again on failure.
+func createCryptDevice(fn, volumeName, uuid string, table []byte) error {
+	if err := dmIoctl(dmDevCreateCmd, volumeName, uuid, 0, 0, nil); err != nil {
+		return xerrors.Errorf("cannot create device mapper device: %w", err)
+	}
+
+	if err := func() error {
+		if err := dmIoctl(dmTableLoadCmd, volumeName, "", dmSecureDataFlag, 1, table); err != nil {
+			return xerrors.Errorf("cannot load device mapper table: %w", err)
+		}
+		if err := dmIoctl(dmDevSuspendCmd, volumeName, "", 0, 0, nil); err != nil {
+			return xerrors.Errorf("cannot resume device mapper device: %w", err)
+		}
+		return nil
+	}(); err != nil {
+		if err := dmIoctl(dmDevRemoveCmd, volumeName, "", 0, 0, nil); err != nil {
+			fmt.Fprintf(stderr, "luks2.%s: cannot remove device mapper device %s: %v\n", fn, volumeName, err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Activate unlocks the LUKS device at sourceDevicePath in-process and creates a device
+// mapping with the supplied volumeName. The device is unlocked using the supplied key.
+//
+// This is the implementation used in static builds, which only supports a subset of
+// LUKS2 features. In particular, only keyslots that use PBKDF2 can be unlocked.
+func Activate(volumeName, sourceDevicePath string, key []byte) error {
+	vk, err := RecoverVolumeKey(sourceDevicePath, key)
+	if err != nil {
+		return xerrors.Errorf("cannot recover volume key: %w", err)
+	}
+	defer func() {
+		for i := range vk.Key {
+			vk.Key[i] = 0
+		}
+	}()
+
+	table, err := cryptTarget(sourceDevicePath, vk)
+	if err != nil {
+		return xerrors.Errorf("cannot create dm-crypt table: %w", err)
+	}
+
+	uuid := "CRYPT-LUKS2-" + strings.Replace(vk.UUID, "-", "", -1) + "-" + volumeName
+	return createCryptDevice("Activate", volumeName, uuid, table)
+}
+
+// ActivatePlain creates a plain dm-crypt mapping with the supplied volumeName for the
+// device at sourceDevicePath. The supplied key is used directly as the volume key, and
+// its length determines the key size. As plain volumes have no header, there is no way
+// to detect that the key is incorrect.
+//
+// This is the implementation used in static builds.
+func ActivatePlain(volumeName, sourceDevicePath string, key []byte, options *PlainOptions) error {
+	if options == nil {
+		options = &PlainOptions{}
+	}
+
+	table, err := plainCryptTarget(sourceDevicePath, key, options)
+	if err != nil {
+		return xerrors.Errorf("cannot create dm-crypt table: %w", err)
+	}
+
+	return createCryptDevice("ActivatePlain", volumeName, "CRYPT-PLAIN-"+volumeName, table)
+}
+
+// Deactivate detaches the LUKS volume with the supplied name.
+func Deactivate(volumeName string) error {
+	if err := dmIoctl(dmDevRemoveCmd, volumeName, "", 0, 0, nil); err != nil {
+		return xerrors.Errorf("cannot remove device mapper device: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+//go:build secboot_static
+// +build secboot_static
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks2_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/internal/luks2"
+)
+
+type activateStaticSuite struct{}
+
+var _ = Suite(&activateStaticSuite{})
+
+func (s *activateStaticSuite) checkTarget(c *C, table []byte, expectedLength uint64, expectedParams string) {
+	var spec struct {
+		SectorStart uint64
+		Length      uint64
+		Status      int32
+		Next        uint32
+		TargetType  [16]byte
+	}
+	c.Assert(binary.Read(bytes.NewReader(table), binary.LittleEndian, &spec), IsNil)
+	c.Check(spec.SectorStart, Equals, uint64(0))
+	c.Check(spec.Length, Equals, expectedLength)
+	c.Check(int(spec.Next), Equals, len(table))
+	c.Check(len(table)%8, Equals, 0)
+	c.Check(strings.TrimRight(string(spec.TargetType[:]), "\x00"), Equals, "crypt")
+	c.Check(strings.TrimRight(string(table[40:]), "\x00"), Equals, expectedParams)
+}
+
+func (s *activateStaticSuite) TestCryptTarget(c *C) {
+	table, err := CryptTarget("/dev/sda1", &VolumeKeyInfo{
+		Key: []byte{0x01, 0x02, 0x03, 0x04},
+		Segment: &Segment{
+			Type:       "crypt",
+			Offset:     16777216,
+			Size:       1048576,
+			Encryption: "aes-xts-plain64",
+			SectorSize: 512}})
+	c.Assert(err, IsNil)
+	s.checkTarget(c, table, 2048, "aes-xts-plain64 01020304 0 /dev/sda1 32768")
+}
+
+func (s *activateStaticSuite) TestCryptTargetLargeSectors(c *C) {
+	table, err := CryptTarget("/dev/vda2", &VolumeKeyInfo{
+		Key: []byte{0xaa, 0xbb},
+		Segment: &Segment{
+			Type:       "crypt",
+			Offset:     16777216,
+			Size:       4194304,
+			IVTweak:    8,
+			Encryption: "aes-xts-plain64",
+			SectorSize: 4096}})
+	c.Assert(err, IsNil)
+	s.checkTarget(c, table, 8192, "aes-xts-plain64 aabb 8 /dev/vda2 32768 1 sector_size:4096")
+}
+
+func (s *activateStaticSuite) TestCryptTargetIntegrity(c *C) {
+	_, err := CryptTarget("/dev/sda1", &VolumeKeyInfo{
+		Segment: &Segment{
+			Type:       "crypt",
+			Offset:     16777216,
+			Size:       1048576,
+			Encryption: "aes-xts-plain64",
+			Integrity:  &Integrity{Type: "hmac(sha256)"}}})
+	c.Check(err, ErrorMatches, "segments with integrity protection are not supported")
+}
+
+func (s *activateStaticSuite) TestCryptTargetUnsupportedCipher(c *C) {
+	_, err := CryptTarget("/dev/sda1", &VolumeKeyInfo{
+		Segment: &Segment{
+			Type:       "crypt",
+			Offset:     16777216,
+			Size:       1048576,
+			Encryption: "aes-cbc-essiv:sha256"}})
+	c.Check(err, ErrorMatches, "unsupported segment encryption \"aes-cbc-essiv:sha256\"")
+}
+
+func (s *activateStaticSuite) makeDevice(c *C, size int64) string {
+	path := filepath.Join(c.MkDir(), "disk")
+	f, err := os.Create(path)
+	c.Assert(err, IsNil)
+	defer f.Close()
+	c.Assert(f.Truncate(size), IsNil)
+	return path
+}
+
+func (s *activateStaticSuite) TestPlainCryptTarget(c *C) {
+	path := s.makeDevice(c, 1048576)
+	table, err := PlainCryptTarget(path, []byte{0x01, 0x02, 0x03, 0x04}, &PlainOptions{})
+	c.Assert(err, IsNil)
+	s.checkTarget(c, table, 2048, "aes-xts-plain64 01020304 0 "+path+" 0")
+}
+
+func (s *activateStaticSuite) TestPlainCryptTargetWithOptions(c *C) {
+	path := s.makeDevice(c, 4194304)
+	table, err := PlainCryptTarget(path, []byte{0xaa, 0xbb}, &PlainOptions{Cipher: "aes-cbc-essiv:sha256", Offset: 4096, SectorSize: 4096})
+	c.Assert(err, IsNil)
+	s.checkTarget(c, table, 4096, "aes-cbc-essiv:sha256 aabb 0 "+path+" 4096 1 sector_size:4096")
+}
+
+func (s *activateStaticSuite) TestPlainCryptTargetDeviceTooSmall(c *C) {
+	path := s.makeDevice(c, 1048576)
+	_, err := PlainCryptTarget(path, []byte{0xaa, 0xbb}, &PlainOptions{Offset: 2048})
+	c.Check(err, ErrorMatches, "device is smaller than offset")
+}
@@ -1,5 +1,8 @@
 // -*- Mode: Go; indent-tabs-mode: t -*-
 
+//go:build !secboot_static
+// +build !secboot_static
+
 /*
  * Copyright (C) 2020 Canonical Ltd
  *
@@ -129,6 +132,30 @@ func (s *activateSuite) TestActivateWrongKey(c *C) {
 	c.Check(s.mockSdCryptsetup.Calls()[0], DeepEquals, []string{"systemd-cryptsetup", "attach", "data", "/dev/sda1", "/dev/stdin", "luks,tries=1"})
 }
 
+func (s *activateSuite) TestActivatePlain(c *C) {
+	key := make([]byte, 64)
+	rand.Read(key)
+	s.addMockKeyslot(c, key)
+
+	c.Check(ActivatePlain("data", "/dev/sda1", key, nil), IsNil)
+
+	c.Assert(s.mockSdCryptsetup.Calls(), HasLen, 1)
+	c.Check(s.mockSdCryptsetup.Calls()[0], DeepEquals, []string{"systemd-cryptsetup", "attach", "data", "/dev/sda1", "/dev/stdin",
+		"plain,cipher=aes-xts-plain64,size=512,hash=plain,offset=0,sector-size=512,tries=1"})
+}
+
+func (s *activateSuite) TestActivatePlainWithOptions(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	s.addMockKeyslot(c, key)
+
+	c.Check(ActivatePlain("test", "/dev/vda2", key, &PlainOptions{Cipher: "aes-cbc-essiv:sha256", Offset: 2048, SectorSize: 4096}), IsNil)
+
+	c.Assert(s.mockSdCryptsetup.Calls(), HasLen, 1)
+	c.Check(s.mockSdCryptsetup.Calls()[0], DeepEquals, []string{"systemd-cryptsetup", "attach", "test", "/dev/vda2", "/dev/stdin",
+		"plain,cipher=aes-cbc-essiv:sha256,size=256,hash=plain,offset=2048,sector-size=4096,tries=1"})
+}
+
 func (s *activateSuite) TestDeactivate(c *C) {
 	c.Assert(Deactivate("data"), IsNil)
 	c.Assert(s.mockSdCryptsetup.Calls(), HasLen, 1)
@@ -0,0 +1,121 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks2
+
+import (
+	"errors"
+)
+
+// ErrLibcryptsetupNotSupported is returned from NewLibcryptsetupBackend if this package
+// was built without libcryptsetup support.
+var ErrLibcryptsetupNotSupported = errors.New("libcryptsetup support is not available in this build")
+
+// Backend is implemented by the mechanisms that this package uses to modify LUKS2
+// containers.
+type Backend interface {
+	Format(devicePath, label string, key []byte, opts *FormatOptions) error
+	AddKey(devicePath string, existingKey, key []byte, options *AddKeyOptions) error
+	ImportToken(devicePath string, token *Token) error
+	ReplaceToken(devicePath string, id int, token *Token) error
+	RemoveToken(devicePath string, id int) error
+	KillSlot(devicePath string, slot int, key []byte) error
+	SetSlotPriority(devicePath string, slot int, priority SlotPriority) error
+}
+
+var backend Backend = execBackend{}
+
+// NewExecBackend returns a Backend that runs the cryptsetup binary. This is the
+// default.
+func NewExecBackend() Backend {
+	return execBackend{}
+}
+
+// NewLibcryptsetupBackend returns a Backend that uses libcryptsetup directly, which
+// removes the runtime dependency on the cryptsetup binary and returns errors that
+// wrap the underlying errno. This requires the secboot_libcryptsetup build tag, and
+// ErrLibcryptsetupNotSupported is returned without it.
+func NewLibcryptsetupBackend() (Backend, error) {
+	return newLibcryptsetupBackend()
+}
+
+// SetBackend sets the Backend used by the functions in this package that modify
+// LUKS2 containers. It returns a function that restores the previous Backend.
+func SetBackend(b Backend) (restore func()) {
+	orig := backend
+	backend = b
+	return func() {
+		backend = orig
+	}
+}
+
+// Format will initialize a LUKS2 container with the specified options and set the primary key to the
+// supplied key. The label for the new container will be set to the supplied label. This can only be
+// called on a device that is not mapped.
+//
+// By default, the container will be configured to encrypt data with AES-256 and XTS block cipher mode
+// without integrity protection, although this can be changed with opts. The KDF for the primary keyslot
+// will be configured to use argon2i with the supplied benchmark time.
+//
+// WARNING: This function is destructive. Calling this on an existing LUKS2 container will make the
+// data contained inside of it irretrievable.
+func Format(devicePath, label string, key []byte, opts *FormatOptions) error {
+	return backend.Format(devicePath, label, key, opts)
+}
+
+// AddKey adds the supplied key in to a new keyslot for specified LUKS2 container. In order to do this,
+// an existing key must be provided. The KDF for the new keyslot will be configured to use argon2i with
+// the supplied benchmark time. The key will be added to the supplied slot.
+//
+// If options is not supplied, the default KDF benchmark time is used and the command will
+// automatically choose an appropriate slot.
+func AddKey(devicePath string, existingKey, key []byte, options *AddKeyOptions) error {
+	return backend.AddKey(devicePath, existingKey, key, options)
+}
+
+// ImportToken imports the supplied token in to the JSON metadata area of the specified LUKS2 container.
+func ImportToken(devicePath string, token *Token) error {
+	return backend.ImportToken(devicePath, token)
+}
+
+// ReplaceToken atomically replaces the token with the supplied ID in the JSON metadata area
+// of the specified LUKS2 container with the supplied token. When using the cryptsetup binary,
+// this requires cryptsetup 2.4 or later.
+func ReplaceToken(devicePath string, id int, token *Token) error {
+	return backend.ReplaceToken(devicePath, id, token)
+}
+
+// RemoveToken removes the token with the supplied ID from the JSON metadata area of the specified
+// LUKS2 container.
+func RemoveToken(devicePath string, id int) error {
+	return backend.RemoveToken(devicePath, id)
+}
+
+// KillSlot erases the keyslot with the supplied slot number from the specified LUKS2 container.
+// Note that a valid key for a remaining keyslot must be supplied, in order to prevent the last
+// keyslot from being erased.
+func KillSlot(devicePath string, slot int, key []byte) error {
+	return backend.KillSlot(devicePath, slot, key)
+}
+
+// SetSlotPriority sets the priority of the keyslot with the supplied slot number on
+// the specified LUKS2 container.
+func SetSlotPriority(devicePath string, slot int, priority SlotPriority) error {
+	return backend.SetSlotPriority(devicePath, slot, priority)
+}
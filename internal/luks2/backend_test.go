@@ -0,0 +1,92 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks2_test
+
+import (
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/internal/luks2"
+)
+
+type mockBackend struct {
+	calls []string
+}
+
+func (b *mockBackend) Format(devicePath, label string, key []byte, opts *FormatOptions) error {
+	b.calls = append(b.calls, "Format "+devicePath+" "+label)
+	return nil
+}
+
+func (b *mockBackend) AddKey(devicePath string, existingKey, key []byte, options *AddKeyOptions) error {
+	b.calls = append(b.calls, "AddKey "+devicePath)
+	return nil
+}
+
+func (b *mockBackend) ImportToken(devicePath string, token *Token) error {
+	b.calls = append(b.calls, "ImportToken "+devicePath)
+	return nil
+}
+
+func (b *mockBackend) ReplaceToken(devicePath string, id int, token *Token) error {
+	b.calls = append(b.calls, "ReplaceToken "+devicePath)
+	return nil
+}
+
+func (b *mockBackend) RemoveToken(devicePath string, id int) error {
+	b.calls = append(b.calls, "RemoveToken "+devicePath)
+	return nil
+}
+
+func (b *mockBackend) KillSlot(devicePath string, slot int, key []byte) error {
+	b.calls = append(b.calls, "KillSlot "+devicePath)
+	return nil
+}
+
+func (b *mockBackend) SetSlotPriority(devicePath string, slot int, priority SlotPriority) error {
+	b.calls = append(b.calls, "SetSlotPriority "+devicePath+" "+priority.String())
+	return nil
+}
+
+type backendSuite struct{}
+
+var _ = Suite(&backendSuite{})
+
+func (s *backendSuite) TestSetBackend(c *C) {
+	b := new(mockBackend)
+	restore := SetBackend(b)
+	defer restore()
+
+	c.Check(Format("/dev/sda1", "data", nil, nil), IsNil)
+	c.Check(AddKey("/dev/sda1", nil, nil, nil), IsNil)
+	c.Check(ImportToken("/dev/sda1", nil), IsNil)
+	c.Check(ReplaceToken("/dev/sda1", 0, nil), IsNil)
+	c.Check(RemoveToken("/dev/sda1", 0), IsNil)
+	c.Check(KillSlot("/dev/sda1", 0, nil), IsNil)
+	c.Check(SetSlotPriority("/dev/sda1", 0, SlotPriorityHigh), IsNil)
+
+	c.Check(b.calls, DeepEquals, []string{
+		"Format /dev/sda1 data",
+		"AddKey /dev/sda1",
+		"ImportToken /dev/sda1",
+		"ReplaceToken /dev/sda1",
+		"RemoveToken /dev/sda1",
+		"KillSlot /dev/sda1",
+		"SetSlotPriority /dev/sda1 prefer"})
+}
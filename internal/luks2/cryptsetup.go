@@ -44,6 +44,9 @@ var (
 	keySize = 64
 )
 
+// execBackend is the Backend implementation that runs the cryptsetup binary.
+type execBackend struct{}
+
 // cryptsetupCmd is a helper for running the cryptsetup command. If stdin is supplied, data read
 // from it is supplied to cryptsetup via its stdin. If callback is supplied, it will be invoked
 // after cryptsetup has started.
@@ -76,8 +79,13 @@ func cryptsetupCmd(stdin io.Reader, callback func(cmd *exec.Cmd) error, args ...
 	return nil
 }
 
-// KDFOptions specifies parameters for the Argon2 KDF.
+// KDFOptions specifies parameters for the KDF.
 type KDFOptions struct {
+	// Type specifies the KDF type. If this is empty, argon2i is used.
+	// Keyslots that use PBKDF2 can be unlocked in-process with
+	// RecoverVolumeKey.
+	Type KDFType
+
 	// TargetDuration specifies the target time for benchmarking of the
 	// time and memory cost parameters. If it is zero then the cryptsetup
 	// default is used. If ForceIterations is not zero then this is ignored.
@@ -85,7 +93,8 @@ type KDFOptions struct {
 
 	// MemoryKiB specifies the maximum memory cost in KiB when ForceIterations
 	// is zero, or the actual memory cost in KiB when ForceIterations is not zero.
-	// If this is set to zero, then the cryptsetup default is used.
+	// If this is set to zero, then the cryptsetup default is used. This is
+	// ignored for PBKDF2.
 	MemoryKiB int
 
 	// ForceIterations specifies the time cost. If set to zero, the time
@@ -97,13 +106,17 @@ type KDFOptions struct {
 
 	// Parallel sets the maximum number of parallel threads. Cryptsetup may
 	// choose a lower value based on its own maximum and the number of available
-	// CPU cores.
+	// CPU cores. This is ignored for PBKDF2.
 	Parallel int
 }
 
 func (options *KDFOptions) appendArguments(args []string) []string {
-	// use argon2i as the KDF
-	args = append(args, "--pbkdf", "argon2i")
+	kdfType := options.Type
+	if kdfType == "" {
+		// use argon2i as the KDF by default
+		kdfType = KDFTypeArgon2i
+	}
+	args = append(args, "--pbkdf", string(kdfType))
 
 	switch {
 	case options.ForceIterations != 0:
@@ -115,6 +128,10 @@ func (options *KDFOptions) appendArguments(args []string) []string {
 			"--iter-time", strconv.FormatInt(int64(options.TargetDuration/time.Millisecond), 10))
 	}
 
+	if kdfType == KDFTypePBKDF2 {
+		return args
+	}
+
 	if options.MemoryKiB != 0 {
 		args = append(args, "--pbkdf-memory", strconv.Itoa(options.MemoryKiB))
 	}
@@ -143,18 +160,49 @@ type FormatOptions struct {
 	// KDFOptions describes the KDF options for the initial
 	// key slot.
 	KDFOptions KDFOptions
+
+	// SectorSize sets the encryption sector size in bytes. Set to
+	// zero to use the cryptsetup default. Must be a power of 2
+	// between 512 and 4096.
+	SectorSize int
+
+	// Cipher sets the cipher specification in cryptsetup notation,
+	// eg, "aes-gcm-random". Set to empty to use aes-xts-plain64.
+	Cipher string
+
+	// KeyBits sets the size of the encryption key in bits, excluding
+	// any key used for integrity protection. Set to zero to use
+	// 512 bits when Cipher and Integrity are empty, or the cryptsetup
+	// default for the cipher otherwise.
+	KeyBits int
+
+	// Integrity enables integrity protection with dm-integrity, and
+	// sets the integrity algorithm in cryptsetup notation, eg,
+	// "hmac-sha256", or "aead" for authenticated ciphers such as
+	// aes-gcm-random and aegis128-random. Set to empty to disable
+	// integrity protection. Note that formatting a container with
+	// integrity protection wipes the whole device, which can take a
+	// long time.
+	Integrity string
 }
 
-// Format will initialize a LUKS2 container with the specified options and set the primary key to the
-// supplied key. The label for the new container will be set to the supplied label. This can only be
-// called on a device that is not mapped.
-//
-// The container will be configured to encrypt data with AES-256 and XTS block cipher mode. The
-// KDF for the primary keyslot will be configured to use argon2i with the supplied benchmark time.
-//
-// WARNING: This function is destructive. Calling this on an existing LUKS2 container will make the
-// data contained inside of it irretrievable.
-func Format(devicePath, label string, key []byte, opts *FormatOptions) error {
+// cipherAndKeyBits returns the cipher specification and the size of the encryption
+// key for these options. A key size of zero means that the default should be used.
+func (opts *FormatOptions) cipherAndKeyBits() (cipher string, keyBits int) {
+	cipher = opts.Cipher
+	keyBits = opts.KeyBits
+	if cipher == "" {
+		cipher = "aes-xts-plain64"
+	}
+	if keyBits == 0 && opts.Cipher == "" && opts.Integrity == "" {
+		// use AES-256 with XTS block cipher mode (XTS requires 2 keys)
+		keyBits = keySize * 8
+	}
+	return cipher, keyBits
+}
+
+// Format implements Backend.Format by running "cryptsetup luksFormat".
+func (execBackend) Format(devicePath, label string, key []byte, opts *FormatOptions) error {
 	if opts == nil {
 		var defaultOpts FormatOptions
 		opts = &defaultOpts
@@ -168,11 +216,20 @@ func Format(devicePath, label string, key []byte, opts *FormatOptions) error {
 		// use LUKS2
 		"--type", "luks2",
 		// read the key from stdin
-		"--key-file", "-",
-		// use AES-256 with XTS block cipher mode (XTS requires 2 keys)
-		"--cipher", "aes-xts-plain64", "--key-size", strconv.Itoa(keySize * 8),
-		// set LUKS2 label
-		"--label", label}
+		"--key-file", "-"}
+
+	// set the cipher, which is AES-256 with XTS block cipher mode by default
+	cipher, keyBits := opts.cipherAndKeyBits()
+	args = append(args, "--cipher", cipher)
+	if keyBits != 0 {
+		args = append(args, "--key-size", strconv.Itoa(keyBits))
+	}
+	if opts.Integrity != "" {
+		args = append(args, "--integrity", opts.Integrity)
+	}
+
+	// set LUKS2 label
+	args = append(args, "--label", label)
 
 	// apply KDF options
 	args = opts.KDFOptions.appendArguments(args)
@@ -185,6 +242,10 @@ func Format(devicePath, label string, key []byte, opts *FormatOptions) error {
 		// override the default keyslots area size if specified
 		args = append(args, "--luks2-keyslots-size", fmt.Sprintf("%dk", opts.KeyslotsAreaKiBSize))
 	}
+	if opts.SectorSize != 0 {
+		// override the default sector size if specified
+		args = append(args, "--sector-size", strconv.Itoa(opts.SectorSize))
+	}
 
 	args = append(args,
 		// device to format
@@ -203,13 +264,8 @@ type AddKeyOptions struct {
 	Slot int
 }
 
-// AddKey adds the supplied key in to a new keyslot for specified LUKS2 container. In order to do this,
-// an existing key must be provided. The KDF for the new keyslot will be configured to use argon2i with
-// the supplied benchmark time. The key will be added to the supplied slot.
-//
-// If options is not supplied, the default KDF benchmark time is used and the command will
-// automatically choose an appropriate slot.
-func AddKey(devicePath string, existingKey, key []byte, options *AddKeyOptions) error {
+// AddKey implements Backend.AddKey by running "cryptsetup luksAddKey".
+func (execBackend) AddKey(devicePath string, existingKey, key []byte, options *AddKeyOptions) error {
 	if options == nil {
 		options = &AddKeyOptions{Slot: AnySlot}
 	}
@@ -277,8 +333,8 @@ func AddKey(devicePath string, existingKey, key []byte, options *AddKeyOptions)
 	return cryptsetupCmd(bytes.NewReader(key), writeExistingKeyToFifo, args...)
 }
 
-// ImportToken imports the supplied token in to the JSON metadata area of the specified LUKS2 container.
-func ImportToken(devicePath string, token *Token) error {
+// ImportToken implements Backend.ImportToken by running "cryptsetup token import".
+func (execBackend) ImportToken(devicePath string, token *Token) error {
 	tokenJSON, err := json.Marshal(token)
 	if err != nil {
 		return xerrors.Errorf("cannot serialize token: %w", err)
@@ -287,21 +343,28 @@ func ImportToken(devicePath string, token *Token) error {
 	return cryptsetupCmd(bytes.NewReader(tokenJSON), nil, "token", "import", devicePath)
 }
 
-// RemoveToken removes the token with the supplied ID from the JSON metadata area of the specified
-// LUKS2 container.
-func RemoveToken(devicePath string, id int) error {
+// ReplaceToken implements Backend.ReplaceToken by running "cryptsetup token import
+// --token-replace", which requires cryptsetup 2.4 or later.
+func (execBackend) ReplaceToken(devicePath string, id int, token *Token) error {
+	tokenJSON, err := json.Marshal(token)
+	if err != nil {
+		return xerrors.Errorf("cannot serialize token: %w", err)
+	}
+
+	return cryptsetupCmd(bytes.NewReader(tokenJSON), nil, "token", "import", "--token-id", strconv.Itoa(id), "--token-replace", devicePath)
+}
+
+// RemoveToken implements Backend.RemoveToken by running "cryptsetup token remove".
+func (execBackend) RemoveToken(devicePath string, id int) error {
 	return cryptsetupCmd(nil, nil, "token", "remove", "--token-id", strconv.Itoa(id), devicePath)
 }
 
-// KillSlot erases the keyslot with the supplied slot number from the specified LUKS2 container.
-// Note that a valid key for a remaining keyslot must be supplied, in order to prevent the last
-// keyslot from being erased.
-func KillSlot(devicePath string, slot int, key []byte) error {
+// KillSlot implements Backend.KillSlot by running "cryptsetup luksKillSlot".
+func (execBackend) KillSlot(devicePath string, slot int, key []byte) error {
 	return cryptsetupCmd(bytes.NewReader(key), nil, "luksKillSlot", "--type", "luks2", "--key-file", "-", devicePath, strconv.Itoa(slot))
 }
 
-// SetSlotPriority sets the priority of the keyslot with the supplied slot number on
-// the specified LUKS2 container.
-func SetSlotPriority(devicePath string, slot int, priority SlotPriority) error {
+// SetSlotPriority implements Backend.SetSlotPriority by running "cryptsetup config".
+func (execBackend) SetSlotPriority(devicePath string, slot int, priority SlotPriority) error {
 	return cryptsetupCmd(nil, nil, "config", "--priority", priority.String(), "--key-slot", strconv.Itoa(slot), devicePath)
 }
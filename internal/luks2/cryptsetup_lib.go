@@ -0,0 +1,370 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+//go:build secboot_libcryptsetup
+// +build secboot_libcryptsetup
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks2
+
+/*
+#cgo pkg-config: libcryptsetup
+
+#include <stdlib.h>
+#include <string.h>
+#include <libcryptsetup.h>
+
+static const char *luks2_type(void) {
+	return CRYPT_LUKS2;
+}
+
+static int format_luks2(struct crypt_device *cd, const char *cipher, const char *cipher_mode, const char *integrity,
+			const char *label, size_t key_size, uint32_t sector_size, struct crypt_pbkdf_type *pbkdf) {
+	struct crypt_params_luks2 params;
+	memset(&params, 0, sizeof(params));
+	params.pbkdf = pbkdf;
+	params.integrity = integrity;
+	params.sector_size = sector_size;
+	params.label = label;
+	return crypt_format(cd, CRYPT_LUKS2, cipher, cipher_mode, NULL, NULL, key_size, &params);
+}
+*/
+import "C"
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/xerrors"
+)
+
+// This file provides a Backend implementation that uses libcryptsetup directly,
+// for environments where the cryptsetup binary isn't available, such as minimal
+// initramfs images. It is only built with the secboot_libcryptsetup build tag.
+
+// libcryptsetupBackend is the Backend implementation that uses libcryptsetup.
+type libcryptsetupBackend struct{}
+
+func newLibcryptsetupBackend() (Backend, error) {
+	return libcryptsetupBackend{}, nil
+}
+
+// integrityKeySizes contains the sizes in bytes of the keys used by the supported
+// integrity algorithms that aren't part of an authenticated cipher. The cryptsetup
+// binary appends these to the encryption key, but libcryptsetup expects the
+// combined size.
+var integrityKeySizes = map[string]int{
+	"hmac-sha1":   20,
+	"hmac-sha256": 32,
+	"hmac-sha512": 64}
+
+func libcryptsetupError(fn string, ret C.int) error {
+	return xerrors.Errorf("%s failed: %w", fn, syscall.Errno(-ret))
+}
+
+// sensitiveCBytes copies the supplied data in to C memory, returning a
+// function that clears and frees it.
+func sensitiveCBytes(data []byte) (*C.char, func()) {
+	p := C.malloc(C.size_t(len(data) + 1))
+	C.memset(p, 0, C.size_t(len(data)+1))
+	if len(data) > 0 {
+		C.memcpy(p, unsafe.Pointer(&data[0]), C.size_t(len(data)))
+	}
+	return (*C.char)(p), func() {
+		C.memset(p, 0, C.size_t(len(data)+1))
+		C.free(p)
+	}
+}
+
+// initDevice initializes a libcryptsetup context for the specified device. If
+// load is true, the LUKS2 header is loaded.
+func initDevice(devicePath string, load bool) (*C.struct_crypt_device, error) {
+	path := C.CString(devicePath)
+	defer C.free(unsafe.Pointer(path))
+
+	var cd *C.struct_crypt_device
+	if ret := C.crypt_init(&cd, path); ret < 0 {
+		return nil, libcryptsetupError("crypt_init", ret)
+	}
+
+	if load {
+		if ret := C.crypt_load(cd, C.luks2_type(), nil); ret < 0 {
+			C.crypt_free(cd)
+			return nil, libcryptsetupError("crypt_load", ret)
+		}
+	}
+
+	return cd, nil
+}
+
+// pbkdfType returns the libcryptsetup KDF parameters corresponding to these
+// options. The returned function frees the associated C memory.
+func (options *KDFOptions) pbkdfType() (*C.struct_crypt_pbkdf_type, func()) {
+	var pbkdf C.struct_crypt_pbkdf_type
+	if defaults := C.crypt_get_pbkdf_default(C.luks2_type()); defaults != nil {
+		pbkdf = *defaults
+	}
+
+	kdfType := options.Type
+	if kdfType == "" {
+		// use argon2i as the KDF by default
+		kdfType = KDFTypeArgon2i
+	}
+	typeStr := C.CString(string(kdfType))
+	hashStr := C.CString("sha256")
+	pbkdf._type = typeStr
+	pbkdf.hash = hashStr
+
+	switch {
+	case options.ForceIterations != 0:
+		// Disable benchmarking by forcing the time cost
+		pbkdf.iterations = C.uint32_t(options.ForceIterations)
+		pbkdf.flags |= C.CRYPT_PBKDF_NO_BENCHMARK
+	case options.TargetDuration != 0:
+		pbkdf.time_ms = C.uint32_t(options.TargetDuration / time.Millisecond)
+	}
+
+	if kdfType == KDFTypePBKDF2 {
+		// libcryptsetup rejects memory and parallelism parameters for PBKDF2.
+		pbkdf.max_memory_kb = 0
+		pbkdf.parallel_threads = 0
+	} else {
+		if options.MemoryKiB != 0 {
+			pbkdf.max_memory_kb = C.uint32_t(options.MemoryKiB)
+		}
+		if options.Parallel != 0 {
+			pbkdf.parallel_threads = C.uint32_t(options.Parallel)
+		}
+	}
+
+	return &pbkdf, func() {
+		C.free(unsafe.Pointer(typeStr))
+		C.free(unsafe.Pointer(hashStr))
+	}
+}
+
+// Format implements Backend.Format using crypt_format.
+func (libcryptsetupBackend) Format(devicePath, label string, key []byte, opts *FormatOptions) error {
+	if opts == nil {
+		var defaultOpts FormatOptions
+		opts = &defaultOpts
+	}
+
+	cd, err := initDevice(devicePath, false)
+	if err != nil {
+		return err
+	}
+	defer C.crypt_free(cd)
+
+	if opts.MetadataKiBSize != 0 || opts.KeyslotsAreaKiBSize != 0 {
+		if ret := C.crypt_set_metadata_size(cd, C.uint64_t(opts.MetadataKiBSize*1024), C.uint64_t(opts.KeyslotsAreaKiBSize*1024)); ret < 0 {
+			return libcryptsetupError("crypt_set_metadata_size", ret)
+		}
+	}
+
+	pbkdf, freePbkdf := opts.KDFOptions.pbkdfType()
+	defer freePbkdf()
+
+	cipherSpec, keyBits := opts.cipherAndKeyBits()
+	if keyBits == 0 {
+		return errors.New("KeyBits must be specified when using a custom cipher or integrity protection")
+	}
+	keyBytes := keyBits / 8
+
+	components := strings.SplitN(cipherSpec, "-", 2)
+	if len(components) != 2 {
+		return fmt.Errorf("invalid cipher %q", cipherSpec)
+	}
+	cipher := C.CString(components[0])
+	defer C.free(unsafe.Pointer(cipher))
+	cipherMode := C.CString(components[1])
+	defer C.free(unsafe.Pointer(cipherMode))
+
+	var integrity *C.char
+	if opts.Integrity != "" {
+		integrity = C.CString(opts.Integrity)
+		defer C.free(unsafe.Pointer(integrity))
+		keyBytes += integrityKeySizes[opts.Integrity]
+	}
+
+	labelStr := C.CString(label)
+	defer C.free(unsafe.Pointer(labelStr))
+
+	if ret := C.format_luks2(cd, cipher, cipherMode, integrity, labelStr, C.size_t(keyBytes), C.uint32_t(opts.SectorSize), pbkdf); ret < 0 {
+		return libcryptsetupError("crypt_format", ret)
+	}
+
+	k, freeKey := sensitiveCBytes(key)
+	defer freeKey()
+
+	if ret := C.crypt_keyslot_add_by_volume_key(cd, C.CRYPT_ANY_SLOT, nil, 0, k, C.size_t(len(key))); ret < 0 {
+		return libcryptsetupError("crypt_keyslot_add_by_volume_key", ret)
+	}
+
+	if opts.Integrity != "" {
+		// The integrity tags are uninitialized, so wipe the device through a temporary
+		// mapping in the same way that "cryptsetup luksFormat" does.
+		if err := wipeIntegrityDevice(cd, k, len(key)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// wipeIntegrityDevice initializes the integrity tags of a newly formatted container
+// with integrity protection by activating it with a temporary name and zeroing the
+// whole data segment.
+func wipeIntegrityDevice(cd *C.struct_crypt_device, key *C.char, keyLen int) error {
+	name := C.CString(fmt.Sprintf("temporary-secboot-%d", os.Getpid()))
+	defer C.free(unsafe.Pointer(name))
+
+	flags := C.uint32_t(C.CRYPT_ACTIVATE_PRIVATE | C.CRYPT_ACTIVATE_NO_JOURNAL)
+	if ret := C.crypt_activate_by_passphrase(cd, name, C.CRYPT_ANY_SLOT, key, C.size_t(keyLen), flags); ret < 0 {
+		return libcryptsetupError("crypt_activate_by_passphrase", ret)
+	}
+	defer C.crypt_deactivate(cd, name)
+
+	if ret := C.crypt_wipe(cd, nil, C.CRYPT_WIPE_ZERO, 0, 0, 1024*1024, 0, nil, nil); ret < 0 {
+		return libcryptsetupError("crypt_wipe", ret)
+	}
+
+	return nil
+}
+
+// AddKey implements Backend.AddKey using crypt_keyslot_add_by_passphrase.
+func (libcryptsetupBackend) AddKey(devicePath string, existingKey, key []byte, options *AddKeyOptions) error {
+	if options == nil {
+		options = &AddKeyOptions{Slot: AnySlot}
+	}
+
+	cd, err := initDevice(devicePath, true)
+	if err != nil {
+		return err
+	}
+	defer C.crypt_free(cd)
+
+	pbkdf, freePbkdf := options.KDFOptions.pbkdfType()
+	defer freePbkdf()
+
+	if ret := C.crypt_set_pbkdf_type(cd, pbkdf); ret < 0 {
+		return libcryptsetupError("crypt_set_pbkdf_type", ret)
+	}
+
+	existing, freeExisting := sensitiveCBytes(existingKey)
+	defer freeExisting()
+	k, freeKey := sensitiveCBytes(key)
+	defer freeKey()
+
+	slot := C.int(C.CRYPT_ANY_SLOT)
+	if options.Slot != AnySlot {
+		slot = C.int(options.Slot)
+	}
+
+	if ret := C.crypt_keyslot_add_by_passphrase(cd, slot, existing, C.size_t(len(existingKey)), k, C.size_t(len(key))); ret < 0 {
+		return libcryptsetupError("crypt_keyslot_add_by_passphrase", ret)
+	}
+
+	return nil
+}
+
+func setTokenJSON(devicePath string, id C.int, token *Token) error {
+	var tokenJSON *C.char
+	if token != nil {
+		data, err := json.Marshal(token)
+		if err != nil {
+			return xerrors.Errorf("cannot serialize token: %w", err)
+		}
+		tokenJSON = C.CString(string(data))
+		defer C.free(unsafe.Pointer(tokenJSON))
+	}
+
+	cd, err := initDevice(devicePath, true)
+	if err != nil {
+		return err
+	}
+	defer C.crypt_free(cd)
+
+	if ret := C.crypt_token_json_set(cd, id, tokenJSON); ret < 0 {
+		return libcryptsetupError("crypt_token_json_set", ret)
+	}
+
+	return nil
+}
+
+// ImportToken implements Backend.ImportToken using crypt_token_json_set.
+func (libcryptsetupBackend) ImportToken(devicePath string, token *Token) error {
+	return setTokenJSON(devicePath, C.CRYPT_ANY_TOKEN, token)
+}
+
+// ReplaceToken implements Backend.ReplaceToken using crypt_token_json_set, which
+// replaces an existing token with the same ID in a single metadata update.
+func (libcryptsetupBackend) ReplaceToken(devicePath string, id int, token *Token) error {
+	return setTokenJSON(devicePath, C.int(id), token)
+}
+
+// RemoveToken implements Backend.RemoveToken using crypt_token_json_set.
+func (libcryptsetupBackend) RemoveToken(devicePath string, id int) error {
+	return setTokenJSON(devicePath, C.int(id), nil)
+}
+
+// KillSlot implements Backend.KillSlot using crypt_keyslot_destroy, after
+// checking that the supplied key is valid.
+func (libcryptsetupBackend) KillSlot(devicePath string, slot int, key []byte) error {
+	cd, err := initDevice(devicePath, true)
+	if err != nil {
+		return err
+	}
+	defer C.crypt_free(cd)
+
+	k, freeKey := sensitiveCBytes(key)
+	defer freeKey()
+
+	// Passing a NULL name only checks the passphrase.
+	if ret := C.crypt_activate_by_passphrase(cd, nil, C.CRYPT_ANY_SLOT, k, C.size_t(len(key)), 0); ret < 0 {
+		return libcryptsetupError("crypt_activate_by_passphrase", ret)
+	}
+
+	if ret := C.crypt_keyslot_destroy(cd, C.int(slot)); ret < 0 {
+		return libcryptsetupError("crypt_keyslot_destroy", ret)
+	}
+
+	return nil
+}
+
+// SetSlotPriority implements Backend.SetSlotPriority using crypt_keyslot_set_priority.
+func (libcryptsetupBackend) SetSlotPriority(devicePath string, slot int, priority SlotPriority) error {
+	cd, err := initDevice(devicePath, true)
+	if err != nil {
+		return err
+	}
+	defer C.crypt_free(cd)
+
+	// The values of SlotPriority match crypt_keyslot_priority.
+	if ret := C.crypt_keyslot_set_priority(cd, C.int(slot), C.crypt_keyslot_priority(priority)); ret < 0 {
+		return libcryptsetupError("crypt_keyslot_set_priority", ret)
+	}
+
+	return nil
+}
@@ -96,6 +96,12 @@ func (s *cryptsetupSuite) testFormat(c *C, data *testFormatData) {
 	c.Assert(ok, Equals, true)
 	c.Check(segment.Encryption, Equals, "aes-xts-plain64")
 
+	expectedSectorSize := 512
+	if options.SectorSize > 0 {
+		expectedSectorSize = options.SectorSize
+	}
+	c.Check(segment.SectorSize, Equals, expectedSectorSize)
+
 	c.Check(info.Metadata.Tokens, HasLen, 0)
 
 	expectedMetadataSize := uint64(16 * 1024)
@@ -210,6 +216,17 @@ func (s *cryptsetupSuite) TestFormatWithCustomKeyslotsAreaSize(c *C) {
 			KeyslotsAreaKiBSize: 2 * 1024}})
 }
 
+func (s *cryptsetupSuite) TestFormatWithCustomSectorSize(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	s.testFormat(c, &testFormatData{
+		label: "test",
+		key:   key,
+		options: &FormatOptions{
+			KDFOptions: KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4},
+			SectorSize: 4096}})
+}
+
 type testAddKeyData struct {
 	key     []byte
 	options *AddKeyOptions
@@ -484,6 +501,38 @@ func (s *cryptsetupSuite) TestRemoveNonExistantToken(c *C) {
 	c.Check(ok, Equals, true)
 }
 
+func (s *cryptsetupSuite) testReplaceToken(c *C, tokenId int) {
+	devicePath := luks2test.CreateEmptyDiskImage(c, 20)
+
+	kdfOptions := KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4}
+	c.Assert(Format(devicePath, "", make([]byte, 32), &FormatOptions{KDFOptions: kdfOptions}), IsNil)
+	c.Assert(AddKey(devicePath, make([]byte, 32), make([]byte, 32), &AddKeyOptions{KDFOptions: kdfOptions, Slot: AnySlot}), IsNil)
+	c.Assert(ImportToken(devicePath, &Token{Type: "secboot-foo", Keyslots: []int{0}}), IsNil)
+	c.Assert(ImportToken(devicePath, &Token{Type: "secboot-bar", Keyslots: []int{1}}), IsNil)
+
+	c.Check(ReplaceToken(devicePath, tokenId, &Token{
+		Type:     "secboot-baz",
+		Keyslots: []int{tokenId},
+		Params:   map[string]interface{}{"secboot-a": "foo"}}), IsNil)
+
+	info, err := ReadHeader(devicePath, LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(info.Metadata.Tokens, HasLen, 2)
+	token, ok := info.Metadata.Tokens[tokenId]
+	c.Assert(ok, Equals, true)
+	c.Check(token.Type, Equals, "secboot-baz")
+	c.Check(token.Keyslots, DeepEquals, []int{tokenId})
+	c.Check(token.Params, DeepEquals, map[string]interface{}{"secboot-a": "foo"})
+}
+
+func (s *cryptsetupSuite) TestReplaceToken1(c *C) {
+	s.testReplaceToken(c, 0)
+}
+
+func (s *cryptsetupSuite) TestReplaceToken2(c *C) {
+	s.testReplaceToken(c, 1)
+}
+
 type testKillSlotData struct {
 	key1    []byte
 	key2    []byte
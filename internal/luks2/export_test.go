@@ -27,7 +27,8 @@ import (
 )
 
 var (
-	AcquireSharedLock = acquireSharedLock
+	AcquireSharedLock    = acquireSharedLock
+	DecryptAESXTSPlain64 = decryptAESXTSPlain64
 )
 
 func MockDataDeviceInfo(stMock *unix.Stat_t) (restore func()) {
@@ -80,3 +81,11 @@ func MockStderr(w io.Writer) (restore func()) {
 		stderr = origStderr
 	}
 }
+
+func MockSysfsPath(path string) (restore func()) {
+	origSysfsPath := sysfsPath
+	sysfsPath = path
+	return func() {
+		sysfsPath = origSysfsPath
+	}
+}
@@ -0,0 +1,270 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks2
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"sort"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/xts"
+	"golang.org/x/xerrors"
+
+	"maze.io/x/crypto/afis"
+)
+
+const (
+	// keyslotAreaSectorSize is the sector size used for encrypting
+	// keyslot areas, which is independent of the sector size of the
+	// data segment.
+	keyslotAreaSectorSize = 512
+)
+
+// ErrUnsupportedKeyslot is returned when recovering a volume key in-process
+// if a keyslot uses a feature that isn't implemented by this package.
+var ErrUnsupportedKeyslot = errors.New("unsupported keyslot parameters")
+
+// decryptAESXTSPlain64 decrypts the supplied data in place using AES in XTS mode
+// with the plain64 IV generator, where the data consists of consecutive sectors
+// of the specified size starting at sector 0. This is the "aes-xts-plain64"
+// cipher specification in dm-crypt notation.
+func decryptAESXTSPlain64(key, data []byte, sectorSize int) error {
+	if len(key) != 32 && len(key) != 64 {
+		return errors.New("invalid key size")
+	}
+	if len(data)%sectorSize != 0 || sectorSize%xts.BlockSize != 0 {
+		return errors.New("data is not a multiple of the sector size")
+	}
+
+	c, err := xts.NewCipher(aes.NewCipher, key)
+	if err != nil {
+		return err
+	}
+
+	for sector := uint64(0); len(data) > 0; sector++ {
+		c.Decrypt(data[:sectorSize], data[:sectorSize], sector)
+		data = data[sectorSize:]
+	}
+
+	return nil
+}
+
+func hashConstructor(h Hash) (func() hash.Hash, error) {
+	alg := h.GetHash()
+	if alg == crypto.Hash(0) || !alg.Available() {
+		return nil, fmt.Errorf("unsupported hash algorithm %q", h)
+	}
+	return alg.New, nil
+}
+
+// decryptVolumeKey attempts to recover the volume key protected by this keyslot
+// using the supplied passphrase, with the keyslot area read from r. Only keyslots
+// that use aes-xts-plain64 encryption are supported - an error that
+// wraps ErrUnsupportedKeyslot is returned for any other keyslot. The returned key
+// should be verified with the associated digest before use.
+func (s *Keyslot) decryptVolumeKey(r io.ReaderAt, passphrase []byte) ([]byte, error) {
+	switch {
+	case s.Type != KeyslotTypeLUKS2:
+		return nil, xerrors.Errorf("%w: keyslot type %q", ErrUnsupportedKeyslot, s.Type)
+	case s.Area == nil || s.KDF == nil || s.AF == nil:
+		return nil, errors.New("incomplete keyslot")
+	case s.Area.Type != AreaTypeRaw:
+		return nil, xerrors.Errorf("%w: area type %q", ErrUnsupportedKeyslot, s.Area.Type)
+	case s.Area.Encryption != "aes-xts-plain64":
+		return nil, xerrors.Errorf("%w: area encryption %q", ErrUnsupportedKeyslot, s.Area.Encryption)
+	case s.AF.Type != AFTypeLUKS1:
+		return nil, xerrors.Errorf("%w: AF type %q", ErrUnsupportedKeyslot, s.AF.Type)
+	case s.KeySize <= 0 || s.AF.Stripes <= 0:
+		return nil, errors.New("invalid keyslot parameters")
+	}
+
+	afHash, err := hashConstructor(s.AF.Hash)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot use AF: %w", err)
+	}
+
+	splitSize := s.KeySize * s.AF.Stripes
+	areaSize := ((splitSize + keyslotAreaSectorSize - 1) / keyslotAreaSectorSize) * keyslotAreaSectorSize
+	if uint64(areaSize) > s.Area.Size {
+		return nil, errors.New("keyslot area is too small")
+	}
+
+	data := make([]byte, areaSize)
+	if _, err := r.ReadAt(data, int64(s.Area.Offset)); err != nil {
+		return nil, xerrors.Errorf("cannot read keyslot area: %w", err)
+	}
+
+	areaKey, err := s.KDF.deriveKey(passphrase, s.Area.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	if err := decryptAESXTSPlain64(areaKey, data, keyslotAreaSectorSize); err != nil {
+		return nil, xerrors.Errorf("cannot decrypt keyslot area: %w", err)
+	}
+
+	return afis.MergeHash(data[:splitSize], s.AF.Stripes, afHash)
+}
+
+// deriveKey derives a key of the specified length from the supplied passphrase
+// using this KDF. An error that wraps ErrUnsupportedKeyslot is returned if the
+// KDF type is not supported.
+func (k *KDF) deriveKey(passphrase []byte, keyLen int) ([]byte, error) {
+	switch k.Type {
+	case KDFTypePBKDF2:
+		h, err := hashConstructor(k.Hash)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot use KDF: %w", err)
+		}
+		if k.Iterations <= 0 {
+			return nil, errors.New("invalid KDF parameters")
+		}
+		return pbkdf2.Key(passphrase, k.Salt, k.Iterations, keyLen, h), nil
+	case KDFTypeArgon2i, KDFTypeArgon2id:
+		if k.Time <= 0 || k.Memory <= 0 || k.CPUs <= 0 || k.CPUs > math.MaxUint8 || k.Memory < 8*k.CPUs {
+			return nil, errors.New("invalid KDF parameters")
+		}
+		if k.Type == KDFTypeArgon2i {
+			return argon2.Key(passphrase, k.Salt, uint32(k.Time), uint32(k.Memory), uint8(k.CPUs), uint32(keyLen)), nil
+		}
+		return argon2.IDKey(passphrase, k.Salt, uint32(k.Time), uint32(k.Memory), uint8(k.CPUs), uint32(keyLen)), nil
+	default:
+		return nil, xerrors.Errorf("%w: KDF type %q", ErrUnsupportedKeyslot, k.Type)
+	}
+}
+
+// verify determines whether the supplied volume key matches this digest.
+func (d *Digest) verify(key []byte) (bool, error) {
+	if d.Type != KDFTypePBKDF2 {
+		return false, xerrors.Errorf("%w: digest type %q", ErrUnsupportedKeyslot, d.Type)
+	}
+	h, err := hashConstructor(d.Hash)
+	if err != nil {
+		return false, err
+	}
+	digest := pbkdf2.Key(key, d.Salt, d.Iterations, len(d.Digest), h)
+	return subtle.ConstantTimeCompare(digest, d.Digest) == 1, nil
+}
+
+// VolumeKeyInfo contains a volume key recovered from a LUKS2 container along
+// with the parameters required to map the associated segment.
+type VolumeKeyInfo struct {
+	UUID    string   // The UUID of the container
+	Key     []byte   // The volume key
+	Segment *Segment // The data segment that the volume key is associated with
+}
+
+// RecoverVolumeKey recovers the volume key for the data segment of the LUKS2
+// container at the specified path in-process using the supplied key, without
+// invoking cryptsetup. Keyslots are tried in order of priority, and keyslots with
+// a priority of SlotPriorityIgnore are skipped.
+//
+// This only supports a subset of LUKS2 features - keyslots that don't use
+// aes-xts-plain64 encryption are skipped. If none of the keyslots can be used with the supplied key, an error is
+// returned which will wrap ErrUnsupportedKeyslot if any keyslots were skipped
+// because they are unsupported.
+func RecoverVolumeKey(path string, key []byte) (*VolumeKeyInfo, error) {
+	hdr, err := ReadHeader(path, LockModeBlocking)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read header: %w", err)
+	}
+
+	segment, ok := hdr.Metadata.Segments[0]
+	if !ok {
+		return nil, errors.New("no data segment")
+	}
+
+	var slots []int
+	for id, slot := range hdr.Metadata.Keyslots {
+		if slot.Priority == SlotPriorityIgnore {
+			continue
+		}
+		slots = append(slots, id)
+	}
+	sort.Slice(slots, func(i, j int) bool {
+		pi := hdr.Metadata.Keyslots[slots[i]].Priority
+		pj := hdr.Metadata.Keyslots[slots[j]].Priority
+		if pi != pj {
+			return pi > pj
+		}
+		return slots[i] < slots[j]
+	})
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var unsupportedErr error
+	for _, id := range slots {
+		var digest *Digest
+		for _, d := range hdr.Metadata.Digests {
+			if containsInt(d.Keyslots, id) && containsInt(d.Segments, 0) {
+				digest = d
+				break
+			}
+		}
+		if digest == nil {
+			continue
+		}
+
+		vk, err := hdr.Metadata.Keyslots[id].decryptVolumeKey(f, key)
+		if err != nil {
+			if xerrors.Is(err, ErrUnsupportedKeyslot) {
+				unsupportedErr = xerrors.Errorf("cannot use keyslot %d: %w", id, err)
+				continue
+			}
+			return nil, xerrors.Errorf("cannot decrypt keyslot %d: %w", id, err)
+		}
+
+		ok, err := digest.verify(vk)
+		switch {
+		case err != nil:
+			return nil, xerrors.Errorf("cannot verify key from keyslot %d: %w", id, err)
+		case !ok:
+			continue
+		}
+
+		return &VolumeKeyInfo{UUID: hdr.UUID, Key: vk, Segment: segment}, nil
+	}
+
+	if unsupportedErr != nil {
+		return nil, xerrors.Errorf("no usable keyslot: %w", unsupportedErr)
+	}
+	return nil, errors.New("no keyslot can be unlocked with the supplied key")
+}
+
+func containsInt(s []int, v int) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks2_test
+
+import (
+	"encoding/hex"
+	"math/rand"
+	"os"
+
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/internal/luks2"
+	"github.com/snapcore/secboot/internal/luks2/luks2test"
+	"github.com/snapcore/secboot/internal/paths/pathstest"
+)
+
+type keyslotSuite struct{}
+
+var _ = Suite(&keyslotSuite{})
+
+func decodeHexString(c *C, s string) []byte {
+	b, err := hex.DecodeString(s)
+	c.Assert(err, IsNil)
+	return b
+}
+
+func (s *keyslotSuite) TestDecryptAESXTSPlain64(c *C) {
+	// Test vector 1 from IEEE 1619-2007
+	data := decodeHexString(c, "917cf69ebd68b2ec9b9fe9a3eadda692cd43d2f59598ed858c02c2652fbf922e")
+	c.Check(DecryptAESXTSPlain64(make([]byte, 32), data, 32), IsNil)
+	c.Check(data, DeepEquals, make([]byte, 32))
+}
+
+func (s *keyslotSuite) TestDecryptAESXTSPlain64InvalidSize(c *C) {
+	c.Check(DecryptAESXTSPlain64(make([]byte, 32), make([]byte, 48), 32), ErrorMatches, "data is not a multiple of the sector size")
+	c.Check(DecryptAESXTSPlain64(make([]byte, 16), make([]byte, 32), 32), ErrorMatches, "invalid key size")
+}
+
+type keyslotCryptsetupSuite struct {
+	snapd_testutil.BaseTest
+}
+
+var _ = Suite(&keyslotCryptsetupSuite{})
+
+func (s *keyslotCryptsetupSuite) SetUpSuite(c *C) {
+	if _, exists := os.LookupEnv("NO_EXPENSIVE_CRYPTSETUP_TESTS"); exists {
+		c.Skip("skipping expensive cryptsetup tests")
+	}
+}
+
+func (s *keyslotCryptsetupSuite) SetUpTest(c *C) {
+	s.BaseTest.SetUpTest(c)
+	s.AddCleanup(pathstest.MockRunDir(c.MkDir()))
+	s.AddCleanup(luks2test.WrapCryptsetup(c))
+}
+
+func (s *keyslotCryptsetupSuite) formatPBKDF2(c *C, key []byte) string {
+	devicePath := luks2test.CreateEmptyDiskImage(c, 20)
+	c.Assert(Format(devicePath, "data", key, &FormatOptions{KDFOptions: KDFOptions{Type: KDFTypePBKDF2, ForceIterations: 1000}}), IsNil)
+	return devicePath
+}
+
+func (s *keyslotCryptsetupSuite) TestRecoverVolumeKey(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	devicePath := s.formatPBKDF2(c, key)
+
+	hdr, err := ReadHeader(devicePath, LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(hdr.Metadata.Keyslots[0].KDF.Type, Equals, KDFTypePBKDF2)
+
+	vk, err := RecoverVolumeKey(devicePath, key)
+	c.Assert(err, IsNil)
+	c.Check(vk.Key, HasLen, 64)
+	c.Check(vk.UUID, Equals, hdr.UUID)
+	c.Check(vk.UUID, Not(Equals), "")
+	c.Check(vk.Segment, DeepEquals, hdr.Metadata.Segments[0])
+}
+
+func (s *keyslotCryptsetupSuite) TestRecoverVolumeKeyFromSecondKeyslot(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	devicePath := s.formatPBKDF2(c, key)
+
+	key2 := make([]byte, 32)
+	rand.Read(key2)
+	c.Assert(AddKey(devicePath, key, key2, &AddKeyOptions{KDFOptions: KDFOptions{Type: KDFTypePBKDF2, ForceIterations: 1000}, Slot: AnySlot}), IsNil)
+
+	vk1, err := RecoverVolumeKey(devicePath, key)
+	c.Assert(err, IsNil)
+	vk2, err := RecoverVolumeKey(devicePath, key2)
+	c.Assert(err, IsNil)
+	c.Check(vk2.Key, DeepEquals, vk1.Key)
+}
+
+func (s *keyslotCryptsetupSuite) TestRecoverVolumeKeyWrongKey(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	devicePath := s.formatPBKDF2(c, key)
+
+	_, err := RecoverVolumeKey(devicePath, make([]byte, 32))
+	c.Check(err, ErrorMatches, "no keyslot can be unlocked with the supplied key")
+}
+
+func (s *keyslotCryptsetupSuite) testRecoverVolumeKeyArgon2(c *C, kdfType KDFType) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	devicePath := s.formatPBKDF2(c, key)
+
+	key2 := make([]byte, 32)
+	rand.Read(key2)
+	c.Assert(AddKey(devicePath, key, key2, &AddKeyOptions{KDFOptions: KDFOptions{Type: kdfType, MemoryKiB: 32, ForceIterations: 4}, Slot: AnySlot}), IsNil)
+
+	hdr, err := ReadHeader(devicePath, LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(hdr.Metadata.Keyslots[1].KDF.Type, Equals, kdfType)
+
+	vk1, err := RecoverVolumeKey(devicePath, key)
+	c.Assert(err, IsNil)
+	vk2, err := RecoverVolumeKey(devicePath, key2)
+	c.Assert(err, IsNil)
+	c.Check(vk2.Key, DeepEquals, vk1.Key)
+}
+
+func (s *keyslotCryptsetupSuite) TestRecoverVolumeKeyArgon2i(c *C) {
+	s.testRecoverVolumeKeyArgon2(c, KDFTypeArgon2i)
+}
+
+func (s *keyslotCryptsetupSuite) TestRecoverVolumeKeyArgon2id(c *C) {
+	s.testRecoverVolumeKeyArgon2(c, KDFTypeArgon2id)
+}
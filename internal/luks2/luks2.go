@@ -26,6 +26,8 @@ import (
 
 var (
 	stderr io.Writer = os.Stderr
+
+	systemdCryptsetupPath = "/lib/systemd/systemd-cryptsetup"
 )
 
 // SlotPriority represents the priority of a keyslot.
@@ -738,6 +738,7 @@ func (m *Metadata) UnmarshalJSON(data []byte) error {
 type HeaderInfo struct {
 	HeaderSize uint64   // The total size of the binary header and JSON metadata in bytes
 	Label      string   // The label
+	UUID       string   // The UUID
 	Metadata   Metadata // JSON metadata
 }
 
@@ -908,5 +909,6 @@ func ReadHeader(path string, lockMode LockMode) (*HeaderInfo, error) {
 	return &HeaderInfo{
 		HeaderSize: hdr.HdrSize,
 		Label:      hdr.Label.String(),
+		UUID:       strings.TrimRight(string(hdr.Uuid[:]), "\x00"),
 		Metadata:   *metadata}, nil
 }
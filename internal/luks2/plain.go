@@ -0,0 +1,51 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks2
+
+// PlainOptions provides the parameters for a plain dm-crypt volume. Plain volumes
+// have no on-disk metadata, so these must be supplied every time the volume is
+// activated and must be identical to the values used when the data was first
+// written.
+type PlainOptions struct {
+	// Cipher is the cipher specification, in the format used by dm-crypt. If empty,
+	// aes-xts-plain64 is used.
+	Cipher string
+
+	// Offset is the offset of the encrypted data from the start of the source
+	// device, in 512-byte sectors.
+	Offset uint64
+
+	// SectorSize is the encryption sector size in bytes. If zero, 512 is used.
+	SectorSize int
+}
+
+func (o *PlainOptions) cipher() string {
+	if o.Cipher == "" {
+		return "aes-xts-plain64"
+	}
+	return o.Cipher
+}
+
+func (o *PlainOptions) sectorSize() int {
+	if o.SectorSize == 0 {
+		return 512
+	}
+	return o.SectorSize
+}
@@ -0,0 +1,103 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks2
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+var sysfsPath = "/sys"
+
+// ErrVolumeNotActive is returned from GetVolumeStatus if there is no device mapper
+// volume with the supplied name.
+var ErrVolumeNotActive = errors.New("volume is not active")
+
+// VolumeStatus describes an active device mapper volume.
+type VolumeStatus struct {
+	// DevicePath is the path of the device mapper device node.
+	DevicePath string
+
+	// UUID is the device mapper UUID of the volume. For volumes created by
+	// cryptsetup and by Activate, this has the form
+	// CRYPT-LUKS2-<container UUID>-<volume name>.
+	UUID string
+
+	// SourceDevicePaths are the paths of the devices that the volume maps.
+	SourceDevicePaths []string
+}
+
+func readSysfsString(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// GetVolumeStatus returns the status of the device mapper volume with the supplied
+// name. This is obtained from sysfs and doesn't depend on cryptsetup.
+//
+// If there is no volume with the supplied name, ErrVolumeNotActive is returned.
+func GetVolumeStatus(volumeName string) (*VolumeStatus, error) {
+	devs, err := filepath.Glob(filepath.Join(sysfsPath, "block", "dm-*"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dev := range devs {
+		name, err := readSysfsString(filepath.Join(dev, "dm", "name"))
+		switch {
+		case os.IsNotExist(err):
+			// The device was removed.
+			continue
+		case err != nil:
+			return nil, xerrors.Errorf("cannot read name of %s: %w", filepath.Base(dev), err)
+		}
+		if name != volumeName {
+			continue
+		}
+
+		uuid, err := readSysfsString(filepath.Join(dev, "dm", "uuid"))
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read UUID: %w", err)
+		}
+
+		slaves, err := ioutil.ReadDir(filepath.Join(dev, "slaves"))
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read source devices: %w", err)
+		}
+
+		status := &VolumeStatus{
+			DevicePath: filepath.Join("/dev", filepath.Base(dev)),
+			UUID:       uuid}
+		for _, slave := range slaves {
+			status.SourceDevicePaths = append(status.SourceDevicePaths, filepath.Join("/dev", slave.Name()))
+		}
+		return status, nil
+	}
+
+	return nil, ErrVolumeNotActive
+}
@@ -0,0 +1,77 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package luks2_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/internal/luks2"
+)
+
+type statusSuite struct {
+	snapd_testutil.BaseTest
+
+	sysfs string
+}
+
+var _ = Suite(&statusSuite{})
+
+func (s *statusSuite) SetUpTest(c *C) {
+	s.BaseTest.SetUpTest(c)
+
+	s.sysfs = c.MkDir()
+	s.AddCleanup(MockSysfsPath(s.sysfs))
+}
+
+func (s *statusSuite) addMockDMDevice(c *C, dev, name, uuid string, slaves ...string) {
+	dir := filepath.Join(s.sysfs, "block", dev)
+	c.Assert(os.MkdirAll(filepath.Join(dir, "dm"), 0755), IsNil)
+	c.Assert(os.MkdirAll(filepath.Join(dir, "slaves"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "dm", "name"), []byte(name+"\n"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "dm", "uuid"), []byte(uuid+"\n"), 0644), IsNil)
+	for _, slave := range slaves {
+		c.Assert(os.Mkdir(filepath.Join(dir, "slaves", slave), 0755), IsNil)
+	}
+}
+
+func (s *statusSuite) TestGetVolumeStatus(c *C) {
+	s.addMockDMDevice(c, "dm-0", "ubuntu-save", "CRYPT-LUKS2-a7aa0b8b0f6d4b6c9d4a8f5f0ae2a8b1-ubuntu-save", "sda4")
+	s.addMockDMDevice(c, "dm-1", "ubuntu-data", "CRYPT-LUKS2-3d5e31a1b59d4c9ca1f1e0b1c7a5b9e2-ubuntu-data", "nvme0n1p5")
+
+	status, err := GetVolumeStatus("ubuntu-data")
+	c.Assert(err, IsNil)
+	c.Check(status, DeepEquals, &VolumeStatus{
+		DevicePath:        "/dev/dm-1",
+		UUID:              "CRYPT-LUKS2-3d5e31a1b59d4c9ca1f1e0b1c7a5b9e2-ubuntu-data",
+		SourceDevicePaths: []string{"/dev/nvme0n1p5"}})
+}
+
+func (s *statusSuite) TestGetVolumeStatusNotActive(c *C) {
+	s.addMockDMDevice(c, "dm-0", "ubuntu-save", "CRYPT-LUKS2-a7aa0b8b0f6d4b6c9d4a8f5f0ae2a8b1-ubuntu-save", "sda4")
+
+	_, err := GetVolumeStatus("ubuntu-data")
+	c.Check(err, Equals, ErrVolumeNotActive)
+}
@@ -0,0 +1,83 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package parallel provides a simple worker pool for performing independent
+// computations concurrently.
+package parallel
+
+import (
+	"runtime"
+	"sync"
+)
+
+// ForEach calls fn for each index in the range [0, n) using a pool of workers. If
+// workers is zero or negative, the number of workers is the number of CPUs available
+// to this process. The order in which fn is called for each index is undefined, and
+// fn must be safe to call from multiple goroutines.
+//
+// If any call to fn returns an error, no further calls are started and the error
+// from the call with the lowest index is returned once all running calls complete.
+func ForEach(n, workers int, fn func(i int) error) error {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > n {
+		workers = n
+	}
+
+	var (
+		mu     sync.Mutex
+		next   int
+		errIdx = -1
+		err    error
+	)
+
+	// take returns the next index to process, or -1 if there is no more work.
+	take := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		if next >= n || err != nil {
+			return -1
+		}
+		i := next
+		next++
+		return i
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := take(); i >= 0; i = take() {
+				if e := fn(i); e != nil {
+					mu.Lock()
+					if errIdx < 0 || i < errIdx {
+						errIdx = i
+						err = e
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return err
+}
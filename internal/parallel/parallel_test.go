@@ -0,0 +1,80 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package parallel_test
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/internal/parallel"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type parallelSuite struct{}
+
+var _ = Suite(&parallelSuite{})
+
+func (s *parallelSuite) testForEach(c *C, n, workers int) {
+	results := make([]int, n)
+	c.Check(ForEach(n, workers, func(i int) error {
+		results[i] = i * 2
+		return nil
+	}), IsNil)
+	for i, r := range results {
+		c.Check(r, Equals, i*2)
+	}
+}
+
+func (s *parallelSuite) TestForEach(c *C) {
+	s.testForEach(c, 100, 4)
+}
+
+func (s *parallelSuite) TestForEachDefaultWorkers(c *C) {
+	s.testForEach(c, 100, 0)
+}
+
+func (s *parallelSuite) TestForEachMoreWorkersThanItems(c *C) {
+	s.testForEach(c, 3, 16)
+}
+
+func (s *parallelSuite) TestForEachNoItems(c *C) {
+	c.Check(ForEach(0, 4, func(i int) error {
+		c.Error("unexpected call")
+		return nil
+	}), IsNil)
+}
+
+func (s *parallelSuite) TestForEachError(c *C) {
+	var calls int32
+	err := ForEach(100, 1, func(i int) error {
+		atomic.AddInt32(&calls, 1)
+		if i == 10 {
+			return errors.New("some error")
+		}
+		return nil
+	})
+	c.Check(err, ErrorMatches, "some error")
+	// With a single worker, no further calls are made after the error.
+	c.Check(atomic.LoadInt32(&calls), Equals, int32(11))
+}
@@ -0,0 +1,263 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package pcrprofile computes PCR protection profiles from a set of presets that
+// are shared by the command-line tools.
+package pcrprofile
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/snapcore/snapd/asserts"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
+	secboot_efi "github.com/snapcore/secboot/efi"
+	efi_presets "github.com/snapcore/secboot/efi/presets"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+// Params contains the boot assets used to compute a PCR profile from a preset.
+type Params struct {
+	PCRAlgorithm tpm2.HashAlgorithmId
+
+	Shim           string   // Path of shim, loaded by the firmware
+	Bootloaders    []string // Paths of the bootloaders loaded by shim
+	Kernels        []string // Paths of the kernels loaded by the bootloaders
+	KernelCmdlines []string // Kernel commandlines, measured to PCR 12 by systemd-stub
+	UKIs           []string // Paths of unified kernel images
+	Models         []string // Paths of model assertions, measured to PCR 12 by snap-bootstrap
+}
+
+// stringList is a flag.Value that accumulates the values of a flag that is specified more than once.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// AddFlags registers command-line flags for specifying the boot assets in params with the supplied flag set.
+func (p *Params) AddFlags(fs *flag.FlagSet) {
+	fs.StringVar(&p.Shim, "shim", "", "The path of shim")
+	fs.Var((*stringList)(&p.Bootloaders), "bootloader", "The path of a bootloader loaded by shim (can be repeated)")
+	fs.Var((*stringList)(&p.Kernels), "kernel", "The path of a kernel loaded by the bootloader (can be repeated)")
+	fs.Var((*stringList)(&p.KernelCmdlines), "kernel-cmdline", "A kernel commandline for the profiles that include PCR 12 (can be repeated)")
+	fs.Var((*stringList)(&p.UKIs), "uki", "The path of a unified kernel image for the pcr7+11 and pcr11-uki profiles (can be repeated)")
+	fs.Var((*stringList)(&p.Models), "model", "The path of a model assertion for the pcr7+12 profile (can be repeated)")
+}
+
+// readModels decodes the model assertions at the supplied paths.
+func readModels(paths []string) (models []secboot.SnapModel, err error) {
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read model assertion: %w", err)
+		}
+		a, err := asserts.Decode(data)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot decode model assertion %s: %w", path, err)
+		}
+		model, ok := a.(*asserts.Model)
+		if !ok {
+			return nil, fmt.Errorf("%s is not a model assertion", path)
+		}
+		models = append(models, model)
+	}
+	return models, nil
+}
+
+var pcrAlgorithms = map[string]tpm2.HashAlgorithmId{
+	"sha1":   tpm2.HashAlgorithmSHA1,
+	"sha256": tpm2.HashAlgorithmSHA256,
+	"sha384": tpm2.HashAlgorithmSHA384,
+	"sha512": tpm2.HashAlgorithmSHA512,
+}
+
+// ParsePCRAlgorithm returns the digest algorithm for the PCR bank with the supplied name, eg, "sha256".
+func ParsePCRAlgorithm(name string) (tpm2.HashAlgorithmId, error) {
+	alg, ok := pcrAlgorithms[name]
+	if !ok {
+		return tpm2.HashAlgorithmNull, fmt.Errorf("unrecognized PCR algorithm %q", name)
+	}
+	return alg, nil
+}
+
+// preset computes the PCR profile for a preset.
+type preset func(params *Params) (*secboot_tpm2.PCRProtectionProfile, error)
+
+var presets = map[string]preset{
+	"pcr7":       secureBootPolicyProfile,
+	"pcr7+12":    shimBootPreset(efi_presets.UC20Default),
+	"pcr4+7+12":  shimBootPreset(efi_presets.ClassicShimGrub),
+	"pcr0+2+4+7": shimBootPreset(efi_presets.FirmwareStrict),
+	"pcr7+11":    ukiBootPreset,
+	"pcr11-uki":  ukiProfile,
+}
+
+// PresetNames returns the names of the supported presets in sorted order.
+func PresetNames() (names []string) {
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Compute computes a PCR protection profile for the named preset from the supplied boot assets.
+func Compute(name string, params *Params) (*secboot_tpm2.PCRProtectionProfile, error) {
+	fn, ok := presets[name]
+	if !ok {
+		return nil, fmt.Errorf("unrecognized profile preset %q", name)
+	}
+	return fn(params)
+}
+
+// bootLoadSequence returns the image load sequence for a shim -> bootloader -> kernel boot chain.
+func bootLoadSequence(params *Params) ([]*secboot_efi.ImageLoadEvent, error) {
+	if params.Shim == "" {
+		return nil, errors.New("no shim specified")
+	}
+	if len(params.Bootloaders) == 0 {
+		return nil, errors.New("no bootloaders specified")
+	}
+	if len(params.Kernels) == 0 {
+		return nil, errors.New("no kernels specified")
+	}
+
+	var kernels []*secboot_efi.ImageLoadEvent
+	for _, k := range params.Kernels {
+		kernels = append(kernels, &secboot_efi.ImageLoadEvent{
+			Source: secboot_efi.Shim,
+			Image:  secboot_efi.FileImage(k)})
+	}
+
+	var bootloaders []*secboot_efi.ImageLoadEvent
+	for _, b := range params.Bootloaders {
+		bootloaders = append(bootloaders, &secboot_efi.ImageLoadEvent{
+			Source: secboot_efi.Shim,
+			Image:  secboot_efi.FileImage(b),
+			Next:   kernels})
+	}
+
+	return []*secboot_efi.ImageLoadEvent{
+		{
+			Source: secboot_efi.Firmware,
+			Image:  secboot_efi.FileImage(params.Shim),
+			Next:   bootloaders,
+		},
+	}, nil
+}
+
+func secureBootPolicyProfile(params *Params) (*secboot_tpm2.PCRProtectionProfile, error) {
+	loadSequences, err := bootLoadSequence(params)
+	if err != nil {
+		return nil, err
+	}
+
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	sbpParams := secboot_efi.SecureBootPolicyProfileParams{
+		PCRAlgorithm:  params.PCRAlgorithm,
+		LoadSequences: loadSequences}
+	if err := secboot_efi.AddSecureBootPolicyProfile(profile, &sbpParams); err != nil {
+		return nil, xerrors.Errorf("cannot add secure boot policy profile: %w", err)
+	}
+	return profile, nil
+}
+
+// shimBootPreset adapts a preset from the efi/presets package for a shim -> bootloader -> kernel
+// boot chain.
+func shimBootPreset(fn func(*efi_presets.Params) (*secboot_tpm2.PCRProtectionProfile, error)) preset {
+	return func(params *Params) (*secboot_tpm2.PCRProtectionProfile, error) {
+		loadSequences, err := bootLoadSequence(params)
+		if err != nil {
+			return nil, err
+		}
+		models, err := readModels(params.Models)
+		if err != nil {
+			return nil, err
+		}
+		return fn(&efi_presets.Params{
+			PCRAlgorithm:   params.PCRAlgorithm,
+			LoadSequences:  loadSequences,
+			KernelCmdlines: params.KernelCmdlines,
+			Models:         models})
+	}
+}
+
+func ukiBootPreset(params *Params) (*secboot_tpm2.PCRProtectionProfile, error) {
+	if len(params.UKIs) == 0 {
+		return nil, errors.New("no unified kernel images specified")
+	}
+
+	// Unified kernel images are either loaded directly by the firmware,
+	// or by shim if it is specified.
+	var ukis []*secboot_efi.ImageLoadEvent
+	source := secboot_efi.Firmware
+	if params.Shim != "" {
+		source = secboot_efi.Shim
+	}
+	for _, path := range params.UKIs {
+		ukis = append(ukis, &secboot_efi.ImageLoadEvent{
+			Source: source,
+			Image:  secboot_efi.FileImage(path)})
+	}
+
+	loadSequences := ukis
+	if params.Shim != "" {
+		loadSequences = []*secboot_efi.ImageLoadEvent{
+			{
+				Source: secboot_efi.Firmware,
+				Image:  secboot_efi.FileImage(params.Shim),
+				Next:   ukis,
+			},
+		}
+	}
+
+	return efi_presets.UKI(&efi_presets.Params{
+		PCRAlgorithm:  params.PCRAlgorithm,
+		LoadSequences: loadSequences})
+}
+
+func ukiProfile(params *Params) (*secboot_tpm2.PCRProtectionProfile, error) {
+	var images []secboot_efi.Image
+	for _, path := range params.UKIs {
+		images = append(images, secboot_efi.FileImage(path))
+	}
+
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	ukiParams := secboot_efi.UKIProfileParams{
+		PCRAlgorithm: params.PCRAlgorithm,
+		Images:       images}
+	if err := secboot_efi.AddUKIProfile(profile, &ukiParams); err != nil {
+		return nil, xerrors.Errorf("cannot add unified kernel image profile: %w", err)
+	}
+	return profile, nil
+}
@@ -0,0 +1,104 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package pcrprofile_test
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/internal/pcrprofile"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type pcrprofileSuite struct{}
+
+var _ = Suite(&pcrprofileSuite{})
+
+func (s *pcrprofileSuite) TestPresetNames(c *C) {
+	c.Check(PresetNames(), DeepEquals, []string{"pcr0+2+4+7", "pcr11-uki", "pcr4+7+12", "pcr7", "pcr7+11", "pcr7+12"})
+}
+
+func (s *pcrprofileSuite) TestParsePCRAlgorithm(c *C) {
+	alg, err := ParsePCRAlgorithm("sha256")
+	c.Check(err, IsNil)
+	c.Check(alg, Equals, tpm2.HashAlgorithmSHA256)
+
+	_, err = ParsePCRAlgorithm("md5")
+	c.Check(err, ErrorMatches, `unrecognized PCR algorithm "md5"`)
+}
+
+func (s *pcrprofileSuite) TestAddFlags(c *C) {
+	var params Params
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	params.AddFlags(fs)
+
+	c.Check(fs.Parse([]string{
+		"-shim", "shim.efi",
+		"-bootloader", "grub.efi",
+		"-kernel", "kernel1.efi",
+		"-kernel", "kernel2.efi",
+		"-kernel-cmdline", "console=ttyS0",
+		"-uki", "uki.efi",
+		"-model", "model"}), IsNil)
+	c.Check(params, DeepEquals, Params{
+		Shim:           "shim.efi",
+		Bootloaders:    []string{"grub.efi"},
+		Kernels:        []string{"kernel1.efi", "kernel2.efi"},
+		KernelCmdlines: []string{"console=ttyS0"},
+		UKIs:           []string{"uki.efi"},
+		Models:         []string{"model"}})
+}
+
+func (s *pcrprofileSuite) TestComputeUnrecognizedPreset(c *C) {
+	_, err := Compute("pcr0", &Params{PCRAlgorithm: tpm2.HashAlgorithmSHA256})
+	c.Check(err, ErrorMatches, `unrecognized profile preset "pcr0"`)
+}
+
+func (s *pcrprofileSuite) TestComputeMissingAssets(c *C) {
+	params := Params{PCRAlgorithm: tpm2.HashAlgorithmSHA256}
+	_, err := Compute("pcr7", &params)
+	c.Check(err, ErrorMatches, "no shim specified")
+
+	params.Shim = "shim.efi"
+	_, err = Compute("pcr7", &params)
+	c.Check(err, ErrorMatches, "no bootloaders specified")
+
+	params.Bootloaders = []string{"grub.efi"}
+	_, err = Compute("pcr7", &params)
+	c.Check(err, ErrorMatches, "no kernels specified")
+
+	params.Kernels = []string{"kernel.efi"}
+	_, err = Compute("pcr7+12", &params)
+	c.Check(err, ErrorMatches, "no kernel commandlines specified")
+
+	_, err = Compute("pcr4+7+12", &params)
+	c.Check(err, ErrorMatches, "no kernel commandlines specified")
+
+	_, err = Compute("pcr7+11", &params)
+	c.Check(err, ErrorMatches, "no unified kernel images specified")
+
+	_, err = Compute("pcr11-uki", &params)
+	c.Check(err, ErrorMatches, "cannot add unified kernel image profile: no images specified")
+}
@@ -0,0 +1,144 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package secmem provides buffers for holding sensitive data such as unsealed
+// disk unlock keys.
+package secmem
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/xerrors"
+)
+
+// LockUnavailableError is returned from New and NewFromBytes if a buffer is
+// required to be locked in to memory but this isn't possible, eg, because
+// RLIMIT_MEMLOCK is too low.
+type LockUnavailableError struct {
+	Err error
+}
+
+func (e *LockUnavailableError) Error() string {
+	return "cannot lock buffer in to memory: " + e.Err.Error()
+}
+
+func (e *LockUnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// Buffer is a fixed size buffer for sensitive data. Its memory is allocated
+// outside of the Go heap so that it is never copied by the garbage collector,
+// it is excluded from core dumps and, where possible, it is locked in to memory
+// so that it is never written to swap. Its contents are zeroed when it is
+// destroyed.
+//
+// A Buffer never prints its contents with the fmt package.
+type Buffer struct {
+	data   []byte
+	locked bool
+}
+
+// New allocates a new zeroed buffer of the specified size. If the buffer
+// cannot be locked in to memory, a *LockUnavailableError error is returned if
+// requireLock is true. Otherwise, an unlocked buffer is returned.
+func New(size int, requireLock bool) (*Buffer, error) {
+	if size == 0 {
+		return &Buffer{locked: true}, nil
+	}
+
+	data, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot allocate buffer: %w", err)
+	}
+
+	// This is best effort.
+	unix.Madvise(data, unix.MADV_DONTDUMP)
+
+	b := &Buffer{data: data}
+	switch err := unix.Mlock(data); {
+	case err == nil:
+		b.locked = true
+	case requireLock:
+		unix.Munmap(data)
+		return nil, &LockUnavailableError{err}
+	}
+
+	return b, nil
+}
+
+// NewFromBytes allocates a new buffer in the same way as New and copies the
+// supplied data in to it. The supplied slice is always wiped, including when
+// an error is returned.
+func NewFromBytes(src []byte, requireLock bool) (*Buffer, error) {
+	b, err := New(len(src), requireLock)
+	if err != nil {
+		Wipe(src)
+		return nil, err
+	}
+	copy(b.data, src)
+	Wipe(src)
+	return b, nil
+}
+
+// Bytes returns the contents of this buffer. The returned slice must not be
+// retained after Destroy is called.
+func (b *Buffer) Bytes() []byte {
+	return b.data
+}
+
+// Locked indicates whether this buffer is locked in to memory.
+func (b *Buffer) Locked() bool {
+	return b.locked
+}
+
+// Destroy zeroes and frees this buffer. It is safe to call more than once.
+func (b *Buffer) Destroy() {
+	if b.data == nil {
+		return
+	}
+
+	Wipe(b.data)
+	if b.locked {
+		unix.Munlock(b.data)
+	}
+	unix.Munmap(b.data)
+	b.data = nil
+}
+
+// String implements fmt.Stringer so that the contents are never printed.
+func (b *Buffer) String() string {
+	return "<redacted>"
+}
+
+// Format implements fmt.Formatter so that the contents are never printed,
+// regardless of the verb.
+func (b *Buffer) Format(s fmt.State, verb rune) {
+	io.WriteString(s, b.String())
+}
+
+// Wipe zeroes the supplied slice.
+func Wipe(data []byte) {
+	for i := range data {
+		data[i] = 0
+	}
+	runtime.KeepAlive(data)
+}
@@ -0,0 +1,88 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secmem_test
+
+import (
+	"fmt"
+	"testing"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/internal/secmem"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type secmemSuite struct{}
+
+var _ = Suite(&secmemSuite{})
+
+func (s *secmemSuite) TestNew(c *C) {
+	b, err := New(32, false)
+	c.Assert(err, IsNil)
+	defer b.Destroy()
+
+	c.Check(b.Bytes(), DeepEquals, make([]byte, 32))
+}
+
+func (s *secmemSuite) TestNewZeroSize(c *C) {
+	b, err := New(0, true)
+	c.Assert(err, IsNil)
+	c.Check(b.Bytes(), HasLen, 0)
+	b.Destroy()
+}
+
+func (s *secmemSuite) TestNewFromBytes(c *C) {
+	src := []byte("1234567890abcdef")
+
+	b, err := NewFromBytes(src, false)
+	c.Assert(err, IsNil)
+	defer b.Destroy()
+
+	c.Check(b.Bytes(), DeepEquals, []byte("1234567890abcdef"))
+	c.Check(src, DeepEquals, make([]byte, 16))
+}
+
+func (s *secmemSuite) TestDestroy(c *C) {
+	b, err := NewFromBytes([]byte("foo"), false)
+	c.Assert(err, IsNil)
+
+	b.Destroy()
+	c.Check(b.Bytes(), IsNil)
+
+	// Calling Destroy again should be harmless.
+	b.Destroy()
+}
+
+func (s *secmemSuite) TestNoFmtLeakage(c *C) {
+	b, err := NewFromBytes([]byte("secret"), false)
+	c.Assert(err, IsNil)
+	defer b.Destroy()
+
+	for _, verb := range []string{"%v", "%+v", "%#v", "%s", "%x", "%q"} {
+		c.Check(fmt.Sprintf(verb, b), Equals, "<redacted>", Commentf("verb %s", verb))
+	}
+}
+
+func (s *secmemSuite) TestWipe(c *C) {
+	data := []byte("secret")
+	Wipe(data)
+	c.Check(data, DeepEquals, make([]byte, 6))
+}
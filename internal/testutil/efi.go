@@ -20,35 +20,11 @@
 package testutil
 
 import (
-	"encoding/binary"
-	"fmt"
-	"io/ioutil"
-	"os"
-	"path/filepath"
-
 	"github.com/canonical/go-efilib"
+
+	tpm2test "github.com/snapcore/secboot/tpm2/test"
 )
 
 func EFIReadVar(dir, name string, guid efi.GUID) ([]byte, efi.VariableAttributes, error) {
-	path := filepath.Join(dir, fmt.Sprintf("%s-%s", name, guid))
-	f, err := os.Open(path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, 0, efi.ErrVariableNotFound
-		}
-		return nil, 0, err
-	}
-	defer f.Close()
-
-	var attrs efi.VariableAttributes
-	if err := binary.Read(f, binary.LittleEndian, &attrs); err != nil {
-		return nil, 0, err
-	}
-
-	val, err := ioutil.ReadAll(f)
-	if err != nil {
-		return nil, 0, err
-	}
-
-	return val, attrs, nil
+	return tpm2test.ReadEFIVar(dir, name, guid)
 }
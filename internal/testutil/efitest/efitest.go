@@ -0,0 +1,290 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package efitest provides a way to construct mock EFI host environments for tests from
+// in-memory variables and synthesized TCG event logs, so that tests for new firmware
+// behaviours don't depend on binary fixtures in testdata.
+package efitest
+
+import (
+	"io"
+
+	"github.com/canonical/go-efilib"
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/tcglog-parser"
+)
+
+// ShimGuid is the GUID used by shim for its variables.
+var ShimGuid = efi.MakeGUID(0x605dab50, 0xe046, 0x4300, 0xabb6, [...]uint8{0x3d, 0xd8, 0x10, 0xdd, 0x8b, 0x23})
+
+// VarKey identifies an EFI variable.
+type VarKey struct {
+	Name string
+	GUID efi.GUID
+}
+
+// VarEntry is the value of an EFI variable.
+type VarEntry struct {
+	Attrs   efi.VariableAttributes
+	Payload []byte
+}
+
+// MockVars is a set of EFI variables.
+type MockVars map[VarKey]*VarEntry
+
+// Set adds the variable with the specified name and GUID, replacing any existing variable.
+func (v MockVars) Set(name string, guid efi.GUID, attrs efi.VariableAttributes, data []byte) MockVars {
+	v[VarKey{Name: name, GUID: guid}] = &VarEntry{Attrs: attrs, Payload: data}
+	return v
+}
+
+// SetSecureBoot sets the SecureBoot variable.
+func (v MockVars) SetSecureBoot(enabled bool) MockVars {
+	data := []byte{0x00}
+	if enabled {
+		data = []byte{0x01}
+	}
+	return v.Set("SecureBoot", efi.GlobalVariable, efi.AttributeBootserviceAccess|efi.AttributeRuntimeAccess, data)
+}
+
+// SetSecureBootDatabase sets one of the authenticated secure boot configuration variables,
+// such as PK, KEK, db or dbx.
+func (v MockVars) SetSecureBootDatabase(name string, guid efi.GUID, data []byte) MockVars {
+	return v.Set(name, guid, efi.AttributeNonVolatile|efi.AttributeBootserviceAccess|efi.AttributeRuntimeAccess|efi.AttributeTimeBasedAuthenticatedWriteAccess, data)
+}
+
+func (v MockVars) payload(name string, guid efi.GUID) []byte {
+	e, ok := v[VarKey{Name: name, GUID: guid}]
+	if !ok {
+		return nil
+	}
+	return e.Payload
+}
+
+// MockHostEnvironment is a mock EFI environment that implements the HostEnvironment interface
+// from github.com/snapcore/secboot/efi.
+type MockHostEnvironment struct {
+	Vars MockVars
+	Log  *tcglog.Log
+}
+
+// NewMockHostEnvironment returns a new MockHostEnvironment with the supplied variables and an
+// event log synthesized from them and the supplied options.
+func NewMockHostEnvironment(vars MockVars, opts *LogOptions) *MockHostEnvironment {
+	return &MockHostEnvironment{Vars: vars, Log: NewLog(vars, opts)}
+}
+
+// ReadVar implements HostEnvironment.ReadVar.
+func (e *MockHostEnvironment) ReadVar(name string, guid efi.GUID) ([]byte, efi.VariableAttributes, error) {
+	entry, ok := e.Vars[VarKey{Name: name, GUID: guid}]
+	if !ok {
+		return nil, 0, efi.ErrVariableNotFound
+	}
+	return entry.Payload, entry.Attrs, nil
+}
+
+// ReadEventLog implements HostEnvironment.ReadEventLog.
+func (e *MockHostEnvironment) ReadEventLog() (*tcglog.Log, error) {
+	return e.Log, nil
+}
+
+// LogAuthority describes an EV_EFI_VARIABLE_AUTHORITY event that is measured to PCR 7 when an
+// image is verified.
+type LogAuthority struct {
+	// Source is the variable that contains the authority, eg, db or shim's vendor certificate.
+	Source VarKey
+
+	// Data is the measured EFI_SIGNATURE_DATA (for authorities from db) or certificate
+	// (for shim's vendor certificate).
+	Data []byte
+}
+
+// LogImage describes an image in the boot chain.
+type LogImage struct {
+	// Path is the device path of the image.
+	Path efi.DevicePath
+
+	// Digest is the measured digest of the image for each algorithm. Algorithms that are
+	// missing are computed from Contents.
+	Digests tcglog.DigestMap
+
+	// Contents is used to compute missing digests. Note that real firmware measures the
+	// Authenticode digest of a PE image rather than the digest of its contents.
+	Contents []byte
+
+	// Authority describes the EV_EFI_VARIABLE_AUTHORITY event measured when verifying this
+	// image. This is ignored if secure boot is disabled. If it is nil, no authority event is
+	// measured, which is what happens when an authority has already been measured.
+	Authority *LogAuthority
+}
+
+// LogOptions provides options to NewLog.
+type LogOptions struct {
+	// Algorithms are the digest algorithms in the log. Defaults to SHA-256.
+	Algorithms []tpm2.HashAlgorithmId
+
+	// BootChain is the sequence of EFI applications loaded by the firmware and by each
+	// other, starting with the one loaded from the boot manager.
+	BootChain []*LogImage
+
+	// OmitEFIActionEvents omits the EV_EFI_ACTION events measured to PCRs 4 and 5.
+	OmitEFIActionEvents bool
+
+	// IncludeSbatLevel adds a measurement of shim's SbatLevel variable after the first image
+	// in the boot chain, as done by shim 15.3 and later.
+	IncludeSbatLevel bool
+}
+
+type eventData interface {
+	Write(w io.Writer) error
+}
+
+type bytesData []byte
+
+func (d bytesData) Write(w io.Writer) error {
+	_, err := w.Write(d)
+	return err
+}
+
+type logBuilder struct {
+	algs   []tpm2.HashAlgorithmId
+	events []*tcglog.Event
+}
+
+func (b *logBuilder) hashLogExtendEvent(pcr tcglog.PCRIndex, eventType tcglog.EventType, measured eventData, data tcglog.EventData, digests tcglog.DigestMap) {
+	ev := &tcglog.Event{
+		PCRIndex:  pcr,
+		EventType: eventType,
+		Digests:   make(tcglog.DigestMap),
+		Data:      data}
+
+	for _, alg := range b.algs {
+		if d, ok := digests[alg]; ok {
+			ev.Digests[alg] = d
+			continue
+		}
+		h := alg.NewHash()
+		if err := measured.Write(h); err != nil {
+			panic(err)
+		}
+		ev.Digests[alg] = h.Sum(nil)
+	}
+
+	b.events = append(b.events, ev)
+}
+
+func (b *logBuilder) measureVariable(pcr tcglog.PCRIndex, eventType tcglog.EventType, name string, guid efi.GUID, payload []byte) {
+	data := &tcglog.EFIVariableData{
+		VariableName: guid,
+		UnicodeName:  name,
+		VariableData: payload}
+	b.hashLogExtendEvent(pcr, eventType, data, data, nil)
+}
+
+// NewLog synthesizes a TCG event log for a boot on a platform with the supplied EFI variables.
+// The log contains measurements of the secure boot configuration from vars, separators and the
+// images in the supplied boot chain, in the order that a typical UEFI firmware and shim would
+// measure them. Secure boot is considered to be enabled if the SecureBoot variable is 1.
+func NewLog(vars MockVars, opts *LogOptions) *tcglog.Log {
+	if opts == nil {
+		opts = &LogOptions{}
+	}
+	algs := opts.Algorithms
+	if len(algs) == 0 {
+		algs = []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256}
+	}
+
+	b := &logBuilder{algs: algs}
+
+	// Spec ID event
+	{
+		var sizes []tcglog.EFISpecIdEventAlgorithmSize
+		for _, alg := range algs {
+			sizes = append(sizes, tcglog.EFISpecIdEventAlgorithmSize{AlgorithmId: alg, DigestSize: uint16(alg.Size())})
+		}
+		b.events = append(b.events, &tcglog.Event{
+			PCRIndex:  0,
+			EventType: tcglog.EventTypeNoAction,
+			Digests:   tcglog.DigestMap{tpm2.HashAlgorithmSHA1: make(tcglog.Digest, tpm2.HashAlgorithmSHA1.Size())},
+			Data: &tcglog.SpecIdEvent03{
+				SpecVersionMajor: 2,
+				UintnSize:        2,
+				DigestSizes:      sizes}})
+	}
+
+	// S-CRTM
+	{
+		data := tcglog.StringEventData("1.0")
+		b.hashLogExtendEvent(0, tcglog.EventTypeSCRTMVersion, data, data, nil)
+	}
+
+	// Secure boot configuration
+	sbEnabled := false
+	if sb := vars.payload("SecureBoot", efi.GlobalVariable); len(sb) == 1 && sb[0] == 1 {
+		sbEnabled = true
+	}
+	for _, v := range []VarKey{
+		{Name: "SecureBoot", GUID: efi.GlobalVariable},
+		{Name: "PK", GUID: efi.GlobalVariable},
+		{Name: "KEK", GUID: efi.GlobalVariable},
+		{Name: "db", GUID: efi.ImageSecurityDatabaseGuid},
+		{Name: "dbx", GUID: efi.ImageSecurityDatabaseGuid},
+	} {
+		b.measureVariable(7, tcglog.EventTypeEFIVariableDriverConfig, v.Name, v.GUID, vars.payload(v.Name, v.GUID))
+	}
+	{
+		data := &tcglog.SeparatorEventData{Value: tcglog.SeparatorEventNormalValue}
+		b.hashLogExtendEvent(7, tcglog.EventTypeSeparator, data, data, nil)
+	}
+
+	// Boundary between pre-OS and OS-present
+	if !opts.OmitEFIActionEvents {
+		data := tcglog.EFICallingEFIApplicationEvent
+		b.hashLogExtendEvent(4, tcglog.EventTypeEFIAction, data, data, nil)
+	}
+	for _, pcr := range []tcglog.PCRIndex{0, 1, 2, 3, 4, 5, 6} {
+		data := &tcglog.SeparatorEventData{Value: tcglog.SeparatorEventNormalValue}
+		b.hashLogExtendEvent(pcr, tcglog.EventTypeSeparator, data, data, nil)
+	}
+
+	// Boot chain
+	for i, image := range opts.BootChain {
+		if sbEnabled && image.Authority != nil {
+			b.measureVariable(7, tcglog.EventTypeEFIVariableAuthority, image.Authority.Source.Name, image.Authority.Source.GUID, image.Authority.Data)
+		}
+		data := &tcglog.EFIImageLoadEvent{DevicePath: image.Path}
+		b.hashLogExtendEvent(4, tcglog.EventTypeEFIBootServicesApplication, bytesData(image.Contents), data, image.Digests)
+
+		if i == 0 && opts.IncludeSbatLevel {
+			b.measureVariable(7, tcglog.EventTypeEFIVariableAuthority, "SbatLevel", ShimGuid, vars.payload("SbatLevel", ShimGuid))
+		}
+	}
+
+	// ExitBootServices
+	if !opts.OmitEFIActionEvents {
+		for _, action := range []tcglog.StringEventData{tcglog.EFIExitBootServicesInvocationEvent, tcglog.EFIExitBootServicesSucceededEvent} {
+			b.hashLogExtendEvent(5, tcglog.EventTypeEFIAction, action, action, nil)
+		}
+	}
+
+	return &tcglog.Log{
+		Spec:       tcglog.SpecEFI_2,
+		Algorithms: tcglog.AlgorithmIdList(algs),
+		Events:     b.events}
+}
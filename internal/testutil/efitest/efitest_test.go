@@ -0,0 +1,124 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efitest_test
+
+import (
+	"crypto"
+	_ "crypto/sha256"
+	"testing"
+
+	"github.com/canonical/go-efilib"
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/tcglog-parser"
+
+	. "gopkg.in/check.v1"
+
+	secboot_efi "github.com/snapcore/secboot/efi"
+	. "github.com/snapcore/secboot/internal/testutil/efitest"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type efitestSuite struct{}
+
+var _ = Suite(&efitestSuite{})
+
+var _ secboot_efi.HostEnvironment = (*MockHostEnvironment)(nil)
+
+func (s *efitestSuite) TestReadVar(c *C) {
+	env := NewMockHostEnvironment(MockVars{}.SetSecureBoot(true), nil)
+
+	data, attrs, err := env.ReadVar("SecureBoot", efi.GlobalVariable)
+	c.Check(err, IsNil)
+	c.Check(data, DeepEquals, []byte{1})
+	c.Check(attrs, Equals, efi.AttributeBootserviceAccess|efi.AttributeRuntimeAccess)
+
+	_, _, err = env.ReadVar("MokListRT", ShimGuid)
+	c.Check(err, Equals, efi.ErrVariableNotFound)
+}
+
+func (s *efitestSuite) TestNewLog(c *C) {
+	vars := MockVars{}.
+		SetSecureBoot(true).
+		SetSecureBootDatabase("db", efi.ImageSecurityDatabaseGuid, []byte("mock db"))
+
+	log := NewLog(vars, &LogOptions{
+		Algorithms: []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA1, tpm2.HashAlgorithmSHA256},
+		BootChain: []*LogImage{
+			{
+				Contents: []byte("mock shim"),
+				Authority: &LogAuthority{
+					Source: VarKey{Name: "db", GUID: efi.ImageSecurityDatabaseGuid},
+					Data:   []byte("mock CA")}},
+			{
+				Digests:  tcglog.DigestMap{tpm2.HashAlgorithmSHA256: make(tcglog.Digest, 32)},
+				Contents: []byte("mock grub")}},
+		IncludeSbatLevel: true})
+
+	c.Check(log.Algorithms.Contains(tpm2.HashAlgorithmSHA1), Equals, true)
+	c.Check(log.Algorithms.Contains(tpm2.HashAlgorithmSHA256), Equals, true)
+
+	var types []tcglog.EventType
+	var images []*tcglog.Event
+	for _, ev := range log.Events[1:] {
+		c.Check(ev.Digests, HasLen, 2)
+		if ev.PCRIndex == 7 || ev.PCRIndex == 4 {
+			types = append(types, ev.EventType)
+		}
+		if ev.EventType == tcglog.EventTypeEFIBootServicesApplication {
+			images = append(images, ev)
+		}
+	}
+	c.Check(types, DeepEquals, []tcglog.EventType{
+		tcglog.EventTypeEFIVariableDriverConfig,
+		tcglog.EventTypeEFIVariableDriverConfig,
+		tcglog.EventTypeEFIVariableDriverConfig,
+		tcglog.EventTypeEFIVariableDriverConfig,
+		tcglog.EventTypeEFIVariableDriverConfig,
+		tcglog.EventTypeSeparator,
+		tcglog.EventTypeEFIAction,
+		tcglog.EventTypeSeparator,
+		tcglog.EventTypeEFIVariableAuthority,
+		tcglog.EventTypeEFIBootServicesApplication,
+		tcglog.EventTypeEFIVariableAuthority,
+		tcglog.EventTypeEFIBootServicesApplication})
+
+	c.Assert(images, HasLen, 2)
+	h := crypto.SHA256.New()
+	h.Write([]byte("mock shim"))
+	c.Check(images[0].Digests[tpm2.HashAlgorithmSHA256], DeepEquals, tcglog.Digest(h.Sum(nil)))
+	c.Check(images[1].Digests[tpm2.HashAlgorithmSHA256], DeepEquals, make(tcglog.Digest, 32))
+}
+
+func (s *efitestSuite) TestNewLogSecureBootDisabled(c *C) {
+	log := NewLog(MockVars{}.SetSecureBoot(false), &LogOptions{
+		BootChain: []*LogImage{
+			{
+				Contents: []byte("mock shim"),
+				Authority: &LogAuthority{
+					Source: VarKey{Name: "db", GUID: efi.ImageSecurityDatabaseGuid},
+					Data:   []byte("mock CA")}}},
+		OmitEFIActionEvents: true})
+
+	for _, ev := range log.Events {
+		c.Check(ev.EventType, Not(Equals), tcglog.EventTypeEFIVariableAuthority)
+		c.Check(ev.EventType, Not(Equals), tcglog.EventTypeEFIAction)
+	}
+}
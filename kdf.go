@@ -0,0 +1,161 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"context"
+	"crypto"
+	_ "crypto/sha256"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/xerrors"
+)
+
+const (
+	kdfTypeArgon2i  = "argon2i"
+	kdfTypeArgon2id = "argon2id"
+	kdfTypePBKDF2   = "pbkdf2"
+
+	// defaultPBKDF2TargetDuration is the default target duration for PBKDF2
+	// key derivation when benchmarking.
+	defaultPBKDF2TargetDuration = 2 * time.Second
+
+	// pbkdf2BenchmarkIterations is the number of iterations used to measure
+	// the speed of PBKDF2.
+	pbkdf2BenchmarkIterations = 100000
+
+	// minPBKDF2Iterations is the minimum number of iterations permitted for
+	// PBKDF2, as recommended by NIST SP800-132.
+	minPBKDF2Iterations = 1000
+)
+
+var pbkdf2Duration = func(iterations uint32, h crypto.Hash) time.Duration {
+	start := time.Now()
+	pbkdf2.Key([]byte("foo"), make([]byte, 16), int(iterations), 32, h.New)
+	return time.Since(start)
+}
+
+// KDFOptions is implemented by the types that specify how a key is derived
+// from a passphrase. These are Argon2Options and PBKDF2Options.
+type KDFOptions interface {
+	kdfParams(keyLen uint32) (*kdfData, error)
+}
+
+func (o *Argon2Options) kdfParams(keyLen uint32) (*kdfData, error) {
+	mode, params, err := o.costParams()
+	if err != nil {
+		return nil, err
+	}
+
+	return &kdfData{
+		Type:   string(mode),
+		Time:   int(params.Time),
+		Memory: int(params.MemoryKiB),
+		CPUs:   int(params.Threads)}, nil
+}
+
+// PBKDF2Options specifies the parameters for PBKDF2 when protecting a key with a
+// passphrase. PBKDF2 is not memory-hard, and should only be used where Argon2 is
+// not suitable, such as on devices with very little memory.
+type PBKDF2Options struct {
+	// TargetDuration specifies the target time for key derivation when
+	// benchmarking. If zero, the default is 2 seconds.
+	TargetDuration time.Duration
+
+	// ForceIterations specifies the number of iterations and disables
+	// benchmarking if not zero.
+	ForceIterations uint32
+
+	// HashAlg specifies the digest algorithm used for HMAC. If zero,
+	// SHA-256 is used.
+	HashAlg crypto.Hash
+}
+
+func (o *PBKDF2Options) kdfParams(keyLen uint32) (*kdfData, error) {
+	h := o.HashAlg
+	if h == crypto.Hash(0) {
+		h = crypto.SHA256
+	}
+	if !h.Available() {
+		return nil, errors.New("digest algorithm unavailable")
+	}
+
+	iterations := o.ForceIterations
+	if iterations == 0 {
+		targetDuration := o.TargetDuration
+		if targetDuration == 0 {
+			targetDuration = defaultPBKDF2TargetDuration
+		}
+
+		d := pbkdf2Duration(pbkdf2BenchmarkIterations, h)
+		if d <= 0 {
+			d = 1
+		}
+		n := (uint64(targetDuration) * pbkdf2BenchmarkIterations) / uint64(d)
+		switch {
+		case n < minPBKDF2Iterations:
+			n = minPBKDF2Iterations
+		case n > uint64(^uint32(0)>>1):
+			n = uint64(^uint32(0) >> 1)
+		}
+		iterations = uint32(n)
+	}
+	if iterations < minPBKDF2Iterations {
+		return nil, fmt.Errorf("too few iterations (%d)", iterations)
+	}
+
+	return &kdfData{
+		Type: kdfTypePBKDF2,
+		Time: int(iterations),
+		Hash: &hashAlg{h}}, nil
+}
+
+// deriveKeyFromPassphrase derives a key of the specified length from the supplied
+// passphrase using the KDF and parameters described by params. An Argon2 derivation
+// is aborted if the supplied context is done.
+func deriveKeyFromPassphrase(ctx context.Context, passphrase string, params *kdfData, keyLen uint32) ([]byte, error) {
+	switch params.Type {
+	case kdfTypeArgon2i, kdfTypeArgon2id:
+		if params.Time < 1 || params.Memory < 1 || params.CPUs < 1 || params.CPUs > 255 {
+			return nil, errors.New("invalid argon2 cost parameters")
+		}
+		key, err := deriveArgon2Context(ctx, argon2KDF(), passphrase, params.Salt, Argon2Mode(params.Type), &Argon2CostParams{
+			Time:      uint32(params.Time),
+			MemoryKiB: uint32(params.Memory),
+			Threads:   uint8(params.CPUs)}, keyLen)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot derive key with argon2: %w", err)
+		}
+		return key, nil
+	case kdfTypePBKDF2:
+		if params.Time < minPBKDF2Iterations {
+			return nil, errors.New("invalid pbkdf2 iterations")
+		}
+		if params.Hash == nil || !params.Hash.Available() {
+			return nil, errors.New("invalid pbkdf2 digest algorithm")
+		}
+		return pbkdf2.Key([]byte(passphrase), params.Salt, params.Time, int(keyLen), params.Hash.New), nil
+	default:
+		return nil, fmt.Errorf("unsupported KDF type \"%s\"", params.Type)
+	}
+}
@@ -21,7 +21,11 @@ package secboot
 
 import (
 	"bytes"
+	"context"
 	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -31,6 +35,8 @@ import (
 	"github.com/canonical/go-sp800.90a-drbg"
 
 	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/secmem"
 )
 
 // ErrNoPlatformHandlerRegistered is returned from any of the KeyData.RecoverKeys*
@@ -38,6 +44,10 @@ import (
 // appropriate platform handler registered.
 var ErrNoPlatformHandlerRegistered = errors.New("cannot recover key because there isn't a platform handler registered for it")
 
+// ErrInvalidPassphrase is returned from KeyData.RecoverKeysWithPassphrase and
+// KeyData.ChangePassphrase if the supplied passphrase is incorrect.
+var ErrInvalidPassphrase = errors.New("the supplied passphrase is incorrect")
+
 // InvalidKeyDataError is returned from any of the KeyData.RecoverKeys* functions
 // if the keys cannot be successfully recovered because the key data is invalid in
 // some way.
@@ -139,7 +149,8 @@ const (
 // It should be produced by a platform implementation.
 type KeyCreationData struct {
 	PlatformKeyData
-	PlatformName string // Name of the platform that produced this data
+	PlatformName    string // Name of the platform that produced this data
+	PlatformVersion int    // Version of the platform's key data format
 
 	// AuxiliaryKey is a key used to authorize changes to the key data.
 	// It must match the key protected inside PlatformKeyData.EncryptedPayload.
@@ -149,6 +160,12 @@ type KeyCreationData struct {
 	// device models, and also the digest algorithm used to produce the
 	// key digest.
 	SnapModelAuthHash crypto.Hash
+
+	// Role describes the purpose of the key, eg, "run", "recover" or
+	// "factory-reset". It is optional and is stored unprotected in the
+	// key data so that higher layers can determine which keys exist for
+	// which boot modes without recovering them.
+	Role string
 }
 
 // KeyID is the unique ID for a KeyData object. It is used to facilitate the
@@ -169,6 +186,15 @@ type KeyDataReader interface {
 	ReadableName() string
 }
 
+// KeyDataPriorityReader is an optional interface that can be implemented by a
+// KeyDataReader that stores an activation priority alongside the key data. If
+// implemented, ReadKeyData uses it to initialize the priority of the returned
+// KeyData.
+type KeyDataPriorityReader interface {
+	KeyDataReader
+	Priority() int
+}
+
 type hashAlg struct {
 	crypto.Hash
 }
@@ -238,11 +264,12 @@ type authorizedSnapModels struct {
 }
 
 type kdfData struct {
-	Type   string `json:"type"`
-	Salt   []byte `json:"salt"`
-	Time   int    `json:"time"`
-	Memory int    `json:"memory"`
-	CPUs   int    `json:"cpus"`
+	Type   string   `json:"type"`
+	Salt   []byte   `json:"salt"`
+	Time   int      `json:"time"`
+	Memory int      `json:"memory"`
+	CPUs   int      `json:"cpus"`
+	Hash   *hashAlg `json:"hash,omitempty"`
 }
 
 type passphraseData struct {
@@ -250,9 +277,86 @@ type passphraseData struct {
 	EncryptedPayload []byte  `json:"encrypted_payload"`
 }
 
+const (
+	// passphraseKeyLen is the length of the AES-256 key derived from a passphrase.
+	passphraseKeyLen = 32
+
+	// passphraseNonceLen is the length of the AES-GCM nonce derived from a
+	// passphrase. The nonce can be derived because the key changes with every
+	// new salt.
+	passphraseNonceLen = 12
+)
+
+// PassphraseParams describes the KDF used to derive a key from the passphrase
+// for key data that is protected by a passphrase.
+type PassphraseParams struct {
+	// KDFType is one of "argon2i", "argon2id" or "pbkdf2".
+	KDFType string
+
+	// Time is the number of passes for Argon2 or the number of
+	// iterations for PBKDF2.
+	Time int
+
+	// MemoryKiB is the memory cost for Argon2 in KiB.
+	MemoryKiB int
+
+	// Threads is the number of parallel threads for Argon2.
+	Threads int
+}
+
+func newPassphraseAEAD(ctx context.Context, passphrase string, params *kdfData) (aead cipher.AEAD, nonce []byte, err error) {
+	key, err := deriveKeyFromPassphrase(ctx, passphrase, params, passphraseKeyLen+passphraseNonceLen)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b, err := aes.NewCipher(key[:passphraseKeyLen])
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot create cipher: %w", err)
+	}
+	aead, err = cipher.NewGCM(b)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot create AEAD: %w", err)
+	}
+
+	return aead, key[passphraseKeyLen:], nil
+}
+
+// KeyDataFeatures is a bitmap of format features used by key data. Features are
+// recorded either as critical or ignorable. A reader that encounters a critical
+// feature that it does not understand must refuse to use the key data, because
+// ignoring it could result in a constraint being silently dropped. A reader can
+// safely ignore ignorable features that it does not understand, and these are
+// preserved if the key data is written back.
+type KeyDataFeatures uint64
+
+// supportedKeyDataFeatures is the set of features understood by this package.
+var supportedKeyDataFeatures KeyDataFeatures = KeyDataFeatureFIPS
+
+// keyDataFeatures is the on-disk representation of the features used by key data.
+type keyDataFeatures struct {
+	Critical  KeyDataFeatures `json:"critical,omitempty"`
+	Ignorable KeyDataFeatures `json:"ignorable,omitempty"`
+}
+
+func (f *keyDataFeatures) checkSupported() error {
+	if f == nil {
+		return nil
+	}
+	if unsupported := f.Critical &^ supportedKeyDataFeatures; unsupported != 0 {
+		return fmt.Errorf("unsupported critical features (%#x)", uint64(unsupported))
+	}
+	return nil
+}
+
 type keyData struct {
-	PlatformName   string          `json:"platform_name"`
-	PlatformHandle json.RawMessage `json:"platform_handle"`
+	Features *keyDataFeatures `json:"features,omitempty"`
+
+	PlatformName    string          `json:"platform_name"`
+	PlatformVersion int             `json:"platform_version,omitempty"`
+	PlatformHandle  json.RawMessage `json:"platform_handle"`
+
+	Role string `json:"role,omitempty"`
 
 	EncryptedPayload           []byte          `json:"encrypted_payload,omitempty"`
 	PassphraseProtectedPayload *passphraseData `json:"passphrase_protected_payload,omitempty"`
@@ -280,6 +384,7 @@ func processPlatformKeyRecoveryError(err error) error {
 // secure device.
 type KeyData struct {
 	readableName string
+	priority     int
 	data         keyData
 }
 
@@ -308,6 +413,67 @@ func (d *KeyData) ReadableName() string {
 	return d.readableName
 }
 
+// PlatformName returns the name of the platform that protects this key data.
+func (d *KeyData) PlatformName() string {
+	return d.data.PlatformName
+}
+
+// PlatformVersion returns the version of the format of the platform specific
+// part of this key data. When recovering keys, it is used to select the newest
+// registered platform handler that supports this version.
+func (d *KeyData) PlatformVersion() int {
+	return d.data.PlatformVersion
+}
+
+// Role returns the role of this key data, as supplied by KeyCreationData.Role
+// or SetRole. This is empty if no role was set.
+func (d *KeyData) Role() string {
+	return d.data.Role
+}
+
+// SetRole changes the role of this key data. The change must be persisted
+// with WriteAtomic.
+func (d *KeyData) SetRole(role string) {
+	d.data.Role = role
+}
+
+// Priority returns the activation priority of this key data. When activating a
+// volume with multiple keys, keys with a higher priority are tried first. The
+// priority is not part of the serialized key data.
+func (d *KeyData) Priority() int {
+	return d.priority
+}
+
+// SetPriority overrides the activation priority of this key data.
+func (d *KeyData) SetPriority(priority int) {
+	d.priority = priority
+}
+
+// Features returns the critical and ignorable features used by this key data.
+func (d *KeyData) Features() (critical, ignorable KeyDataFeatures) {
+	if d.data.Features == nil {
+		return 0, 0
+	}
+	return d.data.Features.Critical, d.data.Features.Ignorable
+}
+
+// setFeatures marks the supplied features as used by this key data. Critical
+// features must be understood by every reader of the key data.
+func (d *KeyData) setFeatures(features KeyDataFeatures, critical bool) {
+	if features == 0 {
+		return
+	}
+	if d.data.Features == nil {
+		d.data.Features = new(keyDataFeatures)
+	}
+	if critical {
+		d.data.Features.Critical |= features
+		d.data.Features.Ignorable &^= features
+	} else {
+		d.data.Features.Ignorable |= features
+	}
+}
+
 // UniqueID returns the unique ID for this key data.
 func (d *KeyData) UniqueID() (KeyID, error) {
 	h := crypto.SHA256.New()
@@ -338,7 +504,9 @@ func (d *KeyData) AuthMode() (out AuthMode) {
 // If AuthMode returns anything other than AuthModeNone, then this will return an error.
 //
 // If no platform handler has been registered for this key data, an
-// ErrNoPlatformHandlerRegistered error will be returned.
+// ErrNoPlatformHandlerRegistered error will be returned. If none of the registered
+// handlers support the platform version of this key data, an
+// ErrPlatformVersionUnsupported error will be returned.
 //
 // If the keys cannot be recovered because the key data is invalid, a *InvalidKeyDataError
 // error will be returned.
@@ -352,18 +520,23 @@ func (d *KeyData) RecoverKeys() (DiskUnlockKey, AuxiliaryKey, error) {
 	if d.AuthMode() != AuthModeNone {
 		return nil, nil, errors.New("cannot recover key without authorization")
 	}
+	if err := d.checkFIPS(); err != nil {
+		return nil, nil, err
+	}
 
-	handler := handlers[d.data.PlatformName]
-	if handler == nil {
-		return nil, nil, ErrNoPlatformHandlerRegistered
+	handler, err := selectPlatformKeyDataHandler(d.data.PlatformName, d.data.PlatformVersion)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	c, err := handler.RecoverKeys(&PlatformKeyData{
 		Handle:           d.data.PlatformHandle,
+		Version:          d.data.PlatformVersion,
 		EncryptedPayload: d.data.EncryptedPayload})
 	if err != nil {
 		return nil, nil, processPlatformKeyRecoveryError(err)
 	}
+	defer secmem.Wipe(c)
 
 	key, auxKey, err := c.Unmarshal()
 	if err != nil {
@@ -373,8 +546,130 @@ func (d *KeyData) RecoverKeys() (DiskUnlockKey, AuxiliaryKey, error) {
 	return key, auxKey, nil
 }
 
-//func (d *KeyData) RecoverKeysWithPassphrase(passphrase string) (DiskUnlockKey, AuxiliaryKey, error) {
-//}
+// setPassphrase protects the supplied platform encrypted payload with a key derived
+// from the supplied passphrase.
+func (d *KeyData) setPassphrase(passphrase string, kdfOptions KDFOptions, payload []byte) error {
+	switch {
+	case kdfOptions == nil && fipsMode:
+		kdfOptions = &PBKDF2Options{}
+	case kdfOptions == nil:
+		kdfOptions = &Argon2Options{}
+	}
+
+	params, err := kdfOptions.kdfParams(passphraseKeyLen + passphraseNonceLen)
+	if err != nil {
+		return xerrors.Errorf("cannot compute KDF parameters: %w", err)
+	}
+	if fipsMode && (params.Type != kdfTypePBKDF2 || !isFIPSApprovedHash(params.Hash.Hash)) {
+		return errors.New("KDF is not permitted in FIPS mode")
+	}
+
+	params.Salt = make([]byte, 16)
+	if _, err := rand.Read(params.Salt); err != nil {
+		return xerrors.Errorf("cannot obtain salt: %w", err)
+	}
+
+	aead, nonce, err := newPassphraseAEAD(context.Background(), passphrase, params)
+	if err != nil {
+		return err
+	}
+
+	d.data.EncryptedPayload = nil
+	d.data.PassphraseProtectedPayload = &passphraseData{
+		KDF:              *params,
+		EncryptedPayload: aead.Seal(nil, nonce, payload, nil)}
+	return nil
+}
+
+// openPassphraseProtectedPayload returns the platform encrypted payload that is
+// protected by the supplied passphrase.
+func (d *KeyData) openPassphraseProtectedPayload(ctx context.Context, passphrase string) ([]byte, error) {
+	if d.data.PassphraseProtectedPayload == nil {
+		return nil, errors.New("key data is not protected by a passphrase")
+	}
+
+	aead, nonce, err := newPassphraseAEAD(ctx, passphrase, &d.data.PassphraseProtectedPayload.KDF)
+	switch {
+	case ctx.Err() != nil:
+		return nil, ctx.Err()
+	case err != nil:
+		return nil, &InvalidKeyDataError{xerrors.Errorf("cannot derive key from passphrase: %w", err)}
+	}
+
+	payload, err := aead.Open(nil, nonce, d.data.PassphraseProtectedPayload.EncryptedPayload, nil)
+	if err != nil {
+		return nil, ErrInvalidPassphrase
+	}
+	return payload, nil
+}
+
+// PassphraseParams returns the parameters of the KDF used to derive a key from the
+// passphrase, or nil if this key data isn't protected by a passphrase. These can be
+// used to decide whether the parameters should be upgraded with ChangePassphrase.
+func (d *KeyData) PassphraseParams() *PassphraseParams {
+	if d.data.PassphraseProtectedPayload == nil {
+		return nil
+	}
+	kdf := d.data.PassphraseProtectedPayload.KDF
+	return &PassphraseParams{
+		KDFType:   kdf.Type,
+		Time:      kdf.Time,
+		MemoryKiB: kdf.Memory,
+		Threads:   kdf.CPUs}
+}
+
+// RecoverKeysWithPassphrase recovers the disk unlock key and auxiliary key associated
+// with this key data from the platform's secure device, for key data that is protected
+// by a passphrase (AuthMode returns AuthModePassphrase). The key used to protect the
+// payload is derived from the supplied passphrase using the KDF and parameters recorded
+// in the key data.
+//
+// If the supplied passphrase is incorrect, ErrInvalidPassphrase will be returned.
+//
+// The other errors are the same as those returned from RecoverKeys.
+func (d *KeyData) RecoverKeysWithPassphrase(passphrase string) (DiskUnlockKey, AuxiliaryKey, error) {
+	return d.RecoverKeysWithPassphraseContext(context.Background(), passphrase)
+}
+
+// RecoverKeysWithPassphraseContext is the same as RecoverKeysWithPassphrase, but the
+// context's error is returned without waiting for the derivation of the key from the
+// passphrase to complete if the supplied context is cancelled or its deadline expires
+// first. The derivation itself is only stopped if the Argon2 KDF implementation
+// supports it, see Argon2KDFWithContext.
+func (d *KeyData) RecoverKeysWithPassphraseContext(ctx context.Context, passphrase string) (DiskUnlockKey, AuxiliaryKey, error) {
+	if d.AuthMode()&AuthModePassphrase == 0 {
+		return nil, nil, errors.New("cannot recover key with passphrase because none is set")
+	}
+	if err := d.checkFIPS(); err != nil {
+		return nil, nil, err
+	}
+
+	handler, err := selectPlatformKeyDataHandler(d.data.PlatformName, d.data.PlatformVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	payload, err := d.openPassphraseProtectedPayload(ctx, passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c, err := handler.RecoverKeys(&PlatformKeyData{
+		Handle:           d.data.PlatformHandle,
+		Version:          d.data.PlatformVersion,
+		EncryptedPayload: payload})
+	if err != nil {
+		return nil, nil, processPlatformKeyRecoveryError(err)
+	}
+	defer secmem.Wipe(c)
+
+	key, auxKey, err := c.Unmarshal()
+	if err != nil {
+		return nil, nil, &InvalidKeyDataError{xerrors.Errorf("cannot unmarshal cleartext key payload: %w", err)}
+	}
+
+	return key, auxKey, nil
+}
 
 // IsSnapModelAuthorized indicates whether the supplied Snap device model is trusted to
 // access the data on the encrypted volume protected by this key data.
@@ -440,8 +735,23 @@ func (d *KeyData) SetAuthorizedSnapModels(auxKey AuxiliaryKey, models ...SnapMod
 	return nil
 }
 
-//func (d *KeyData) ChangePasshprase(old, new string) error {
-//}
+// ChangePassphrase changes the passphrase used to protect this key data. The KDF
+// and its parameters are recomputed from the supplied options, which provides a
+// way to upgrade weak KDF parameters. If kdfOptions is nil, Argon2id is used with
+// benchmarked parameters.
+//
+// This makes changes to the key data, which will need to persisted afterwards using
+// WriteAtomic.
+//
+// If the supplied old passphrase is incorrect, ErrInvalidPassphrase will be returned.
+func (d *KeyData) ChangePassphrase(oldPassphrase, newPassphrase string, kdfOptions KDFOptions) error {
+	payload, err := d.openPassphraseProtectedPayload(context.Background(), oldPassphrase)
+	if err != nil {
+		return err
+	}
+
+	return d.setPassphrase(newPassphrase, kdfOptions, payload)
+}
 
 // WriteAtomic saves this key data to the supplied KeyDataWriter.
 func (d *KeyData) WriteAtomic(w KeyDataWriter) error {
@@ -459,6 +769,13 @@ func (d *KeyData) WriteAtomic(w KeyDataWriter) error {
 
 // ReadKeyData reads the key data from the supplied KeyDataReader, returning a
 // new KeyData object.
+//
+// If r implements KeyDataPriorityReader, the priority of the returned KeyData is
+// initialized from it.
+//
+// If the key data uses a critical feature that is not supported by this package,
+// a *InvalidKeyDataError error will be returned. Unsupported ignorable features are
+// ignored.
 func ReadKeyData(r KeyDataReader) (*KeyData, error) {
 	d := &KeyData{readableName: r.ReadableName()}
 	dec := json.NewDecoder(r)
@@ -466,6 +783,17 @@ func ReadKeyData(r KeyDataReader) (*KeyData, error) {
 		return nil, xerrors.Errorf("cannot decode key data: %w", err)
 	}
 
+	if err := d.data.Features.checkSupported(); err != nil {
+		return nil, &InvalidKeyDataError{err}
+	}
+	if d.data.PlatformVersion < 0 {
+		return nil, &InvalidKeyDataError{errors.New("invalid platform version")}
+	}
+
+	if pr, ok := r.(KeyDataPriorityReader); ok {
+		d.priority = pr.Priority()
+	}
+
 	return d, nil
 }
 
@@ -477,6 +805,12 @@ func NewKeyData(creationData *KeyCreationData) (*KeyData, error) {
 	if !json.Valid(creationData.Handle) {
 		return nil, errors.New("handle is not valid JSON")
 	}
+	if creationData.PlatformVersion < 0 {
+		return nil, errors.New("invalid platform version")
+	}
+	if fipsMode && !isFIPSApprovedHash(creationData.SnapModelAuthHash) {
+		return nil, errors.New("snap model auth digest algorithm is not permitted in FIPS mode")
+	}
 
 	rng, err := drbg.NewCTRWithExternalEntropy(32, creationData.AuxiliaryKey, nil, []byte("SNAP-MODEL-HMAC"), nil)
 	if err != nil {
@@ -488,14 +822,43 @@ func NewKeyData(creationData *KeyCreationData) (*KeyData, error) {
 		return nil, xerrors.Errorf("cannot create hash of snap model auth key: %w", err)
 	}
 
-	return &KeyData{
+	d := &KeyData{
 		data: keyData{
 			PlatformName:     creationData.PlatformName,
+			PlatformVersion:  creationData.PlatformVersion,
 			PlatformHandle:   json.RawMessage(creationData.Handle),
+			Role:             creationData.Role,
 			EncryptedPayload: creationData.EncryptedPayload,
 			AuthorizedSnapModels: authorizedSnapModels{
 				Alg:       hashAlg{creationData.SnapModelAuthHash},
-				KeyDigest: h.Sum(nil)}}}, nil
+				KeyDigest: h.Sum(nil)}}}
+	if fipsMode {
+		d.setFeatures(KeyDataFeatureFIPS, false)
+	}
+	return d, nil
+}
+
+// NewKeyDataWithPassphrase creates a new KeyData object using the supplied
+// KeyCreationData, in the same way as NewKeyData, and additionally protects it
+// with the supplied passphrase. The key used to protect the platform encrypted
+// payload is derived from the passphrase using the KDF specified by kdfOptions,
+// which can be *Argon2Options or *PBKDF2Options. If kdfOptions is nil, Argon2id
+// is used with benchmarked parameters, or PBKDF2-HMAC-SHA256 in FIPS mode (see
+// EnableFIPSMode).
+//
+// Recovering the keys requires both the passphrase and the platform's secure
+// device.
+func NewKeyDataWithPassphrase(creationData *KeyCreationData, passphrase string, kdfOptions KDFOptions) (*KeyData, error) {
+	d, err := NewKeyData(creationData)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.setPassphrase(passphrase, kdfOptions, creationData.EncryptedPayload); err != nil {
+		return nil, xerrors.Errorf("cannot set passphrase: %w", err)
+	}
+
+	return d, nil
 }
 
 // MarshalKeys serializes the supplied disk unlock key and auxiliary key in
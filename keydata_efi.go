@@ -0,0 +1,262 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/canonical/go-efilib"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// efiKeyDataFragmentSize is the maximum size of each of the EFI variables that a key data is
+	// split in to. Firmware implementations commonly limit the size of individual variables, so
+	// this is kept small.
+	efiKeyDataFragmentSize = 1024
+
+	// efiKeyDataMaxFragments limits the number of EFI variables used for a single key data in
+	// order to avoid exhausting the firmware's variable storage.
+	efiKeyDataMaxFragments = 16
+
+	// efiKeyDataAttrs are the attributes of the EFI variables used to store key data. They are
+	// visible to boot services so that they can be consumed by code running before the OS, and
+	// visible at runtime so that they can be read and updated from the OS.
+	efiKeyDataAttrs = efi.AttributeNonVolatile | efi.AttributeBootserviceAccess | efi.AttributeRuntimeAccess
+)
+
+// KeyDataEFIVariableGuid is the vendor GUID of the EFI variables used to store key data.
+var KeyDataEFIVariableGuid = efi.MakeGUID(0x2a8d1c5e, 0x6f3b, 0x4e79, 0x9d42, [...]uint8{0x8c, 0x1b, 0x5f, 0x07, 0xa3, 0xe6})
+
+var (
+	efiReadVar  = efi.ReadVar
+	efiWriteVar = efi.WriteVar
+)
+
+// efiKeyDataSlots is the number of copies of a key data that can exist in EFI variables. A
+// key data is written to the slot that doesn't contain the current copy, and the current copy
+// is only deleted once the new one is complete, so that an interrupted update doesn't leave
+// behind a key data that can't be read.
+const efiKeyDataSlots = 2
+
+// efiKeyDataHeader is stored at the start of the first fragment of a key data stored in EFI
+// variables. It is used to detect a key data that was only partially written, and to select
+// the most recent copy if more than one slot contains a complete key data.
+type efiKeyDataHeader struct {
+	Generation uint64
+	Size       uint32
+	Digest     [sha256.Size]byte
+}
+
+func efiKeyDataFragmentName(name string, slot, n int) string {
+	return fmt.Sprintf("%s-%d-%d", name, slot, n)
+}
+
+// readEFIKeyDataSlot reads the fragments of the key data with the specified name from the
+// specified slot, and reassembles and verifies them.
+func readEFIKeyDataSlot(name string, slot int) (*efiKeyDataHeader, []byte, error) {
+	var data []byte
+	for i := 0; i < efiKeyDataMaxFragments; i++ {
+		fragment, _, err := efiReadVar(efiKeyDataFragmentName(name, slot, i), KeyDataEFIVariableGuid)
+		if err == efi.ErrVariableNotFound && i > 0 {
+			break
+		}
+		if err != nil {
+			return nil, nil, xerrors.Errorf("cannot read fragment %d: %w", i, err)
+		}
+		data = append(data, fragment...)
+	}
+
+	r := bytes.NewReader(data)
+	var hdr efiKeyDataHeader
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return nil, nil, xerrors.Errorf("cannot decode header: %w", err)
+	}
+	if int64(hdr.Size) != int64(r.Len()) {
+		return nil, nil, fmt.Errorf("unexpected size (got %d bytes, expected %d bytes)", r.Len(), hdr.Size)
+	}
+	payload, _ := ioutil.ReadAll(r)
+	if sha256.Sum256(payload) != hdr.Digest {
+		return nil, nil, errors.New("invalid digest")
+	}
+
+	return &hdr, payload, nil
+}
+
+// readEFIKeyDataCurrent returns the index and header of the slot that contains the most recent
+// complete copy of the key data with the specified name, and its payload. If no slot contains a
+// complete copy, an error is returned. This is a wrapped efi.ErrVariableNotFound error if none of
+// the slots contain any fragments.
+func readEFIKeyDataCurrent(name string) (slot int, hdr *efiKeyDataHeader, payload []byte, err error) {
+	slot = -1
+	for i := 0; i < efiKeyDataSlots; i++ {
+		h, p, e := readEFIKeyDataSlot(name, i)
+		switch {
+		case e != nil:
+			if err == nil || xerrors.Is(err, efi.ErrVariableNotFound) {
+				err = e
+			}
+		case hdr == nil || h.Generation > hdr.Generation:
+			slot, hdr, payload = i, h, p
+		}
+	}
+	if hdr == nil {
+		return -1, nil, nil, err
+	}
+	return slot, hdr, payload, nil
+}
+
+// readEFIKeyData reads the most recent complete copy of the key data with the specified name
+// from EFI variables.
+func readEFIKeyData(name string) ([]byte, error) {
+	_, _, payload, err := readEFIKeyDataCurrent(name)
+	return payload, err
+}
+
+// writeEFIKeyData splits the supplied key data in to fragments and writes them to EFI variables
+// with the specified name. The fragments are written to the slot that doesn't contain the
+// current copy of the key data, and the current copy is deleted once this is complete.
+func writeEFIKeyData(name string, payload []byte) error {
+	// If neither slot contains a complete copy, current is -1 and it doesn't matter which
+	// slot is written.
+	current, currentHdr, _, err := readEFIKeyDataCurrent(name)
+	var generation uint64
+	if err == nil {
+		generation = currentHdr.Generation + 1
+	}
+
+	data := new(bytes.Buffer)
+	hdr := efiKeyDataHeader{Generation: generation, Size: uint32(len(payload)), Digest: sha256.Sum256(payload)}
+	binary.Write(data, binary.LittleEndian, &hdr)
+	data.Write(payload)
+
+	n := (data.Len() + efiKeyDataFragmentSize - 1) / efiKeyDataFragmentSize
+	if n > efiKeyDataMaxFragments {
+		return fmt.Errorf("key data is too large (%d bytes)", len(payload))
+	}
+
+	target := 0
+	if current == 0 {
+		target = 1
+	}
+
+	// Delete stale fragments from the target slot first, so that it contains a complete copy
+	// as soon as the last fragment is written.
+	if err := deleteEFIKeyDataFragments(name, target, n); err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		if err := efiWriteVar(efiKeyDataFragmentName(name, target, i), KeyDataEFIVariableGuid, efiKeyDataAttrs, data.Next(efiKeyDataFragmentSize)); err != nil {
+			return xerrors.Errorf("cannot write fragment %d: %w", i, err)
+		}
+	}
+
+	for i := 0; i < efiKeyDataSlots; i++ {
+		if i == target {
+			continue
+		}
+		if err := deleteEFIKeyDataFragments(name, i, 0); err != nil {
+			return xerrors.Errorf("cannot delete previous copy: %w", err)
+		}
+	}
+	return nil
+}
+
+// deleteEFIKeyDataFragments deletes the fragments of the key data with the specified name in
+// the specified slot, starting from the fragment with the specified index. Fragments are
+// deleted from the last one so that an interrupted delete doesn't leave a gap, which would
+// hide the remaining fragments from subsequent reads and deletes.
+func deleteEFIKeyDataFragments(name string, slot, first int) error {
+	for i := efiKeyDataMaxFragments - 1; i >= first; i-- {
+		fragmentName := efiKeyDataFragmentName(name, slot, i)
+		if _, _, err := efiReadVar(fragmentName, KeyDataEFIVariableGuid); err == efi.ErrVariableNotFound {
+			continue
+		}
+		if err := efiWriteVar(fragmentName, KeyDataEFIVariableGuid, efiKeyDataAttrs, nil); err != nil {
+			return xerrors.Errorf("cannot delete fragment %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// EFIVariableKeyDataReader provides a mechanism to read a KeyData from EFI variables.
+type EFIVariableKeyDataReader struct {
+	readableName string
+	*bytes.Reader
+}
+
+func (r *EFIVariableKeyDataReader) ReadableName() string {
+	return r.readableName
+}
+
+// NewEFIVariableKeyDataReader is used to read a key data that was stored in EFI variables with the
+// specified name by EFIVariableKeyDataWriter. If the key data doesn't exist, a wrapped
+// efi.ErrVariableNotFound error is returned.
+func NewEFIVariableKeyDataReader(name string) (*EFIVariableKeyDataReader, error) {
+	data, err := readEFIKeyData(name)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read key data from EFI variables: %w", err)
+	}
+
+	return &EFIVariableKeyDataReader{"efivar:" + name, bytes.NewReader(data)}, nil
+}
+
+// EFIVariableKeyDataWriter provides a mechanism to write a KeyData to EFI variables. This is
+// intended for small key data on systems where there is no other suitable storage available
+// at enrolment time, such as an image based install where the LUKS2 header cannot be written.
+//
+// The key data is split across multiple non-volatile variables with the vendor GUID
+// KeyDataEFIVariableGuid, which are accessible to boot services and at runtime. A new copy is
+// written alongside the existing one, which is only deleted once the new copy is complete, so
+// an interrupted update leaves the previous key data in place.
+type EFIVariableKeyDataWriter struct {
+	name string
+	*bytes.Buffer
+}
+
+func (w *EFIVariableKeyDataWriter) Commit() error {
+	if err := writeEFIKeyData(w.name, w.Bytes()); err != nil {
+		return xerrors.Errorf("cannot write key data to EFI variables: %w", err)
+	}
+	return nil
+}
+
+// NewEFIVariableKeyDataWriter creates a new EFIVariableKeyDataWriter for writing a KeyData to
+// EFI variables with the specified name.
+func NewEFIVariableKeyDataWriter(name string) *EFIVariableKeyDataWriter {
+	return &EFIVariableKeyDataWriter{name, new(bytes.Buffer)}
+}
+
+// DeleteEFIVariableKeyData deletes the key data that was stored in EFI variables with the
+// specified name.
+func DeleteEFIVariableKeyData(name string) error {
+	for i := 0; i < efiKeyDataSlots; i++ {
+		if err := deleteEFIKeyDataFragments(name, i, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
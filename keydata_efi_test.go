@@ -0,0 +1,233 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"crypto"
+	"io/ioutil"
+	"math/rand"
+
+	"github.com/canonical/go-efilib"
+
+	"golang.org/x/xerrors"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+type keyDataEFISuite struct {
+	keyDataTestBase
+	vars           map[string][]byte
+	restoreEFIVars func()
+}
+
+func (s *keyDataEFISuite) SetUpTest(c *C) {
+	s.keyDataTestBase.SetUpTest(c)
+	s.vars = make(map[string][]byte)
+	s.restoreEFIVars = MockEFIVars(s.vars)
+}
+
+func (s *keyDataEFISuite) TearDownTest(c *C) {
+	s.restoreEFIVars()
+}
+
+var _ = Suite(&keyDataEFISuite{})
+
+func (s *keyDataEFISuite) TestWriteAndRead(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	expectedId, err := keyData.UniqueID()
+	c.Check(err, IsNil)
+
+	w := NewEFIVariableKeyDataWriter("foo")
+	c.Check(keyData.WriteAtomic(w), IsNil)
+	c.Check(s.vars, HasLen, 1)
+
+	r, err := NewEFIVariableKeyDataReader("foo")
+	c.Assert(err, IsNil)
+	c.Check(r.ReadableName(), Equals, "efivar:foo")
+
+	keyData, err = ReadKeyData(r)
+	c.Assert(err, IsNil)
+
+	id, err := keyData.UniqueID()
+	c.Check(err, IsNil)
+	c.Check(id, DeepEquals, expectedId)
+
+	recoveredKey, recoveredAuxKey, err := keyData.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, key)
+	c.Check(recoveredAuxKey, DeepEquals, auxKey)
+}
+
+func (s *keyDataEFISuite) TestFragmentation(c *C) {
+	data := make([]byte, 3000)
+	rand.Read(data)
+
+	w := NewEFIVariableKeyDataWriter("foo")
+	w.Write(data)
+	c.Check(w.Commit(), IsNil)
+	c.Check(s.vars, HasLen, 3)
+
+	r, err := NewEFIVariableKeyDataReader("foo")
+	c.Assert(err, IsNil)
+	read, err := ioutil.ReadAll(r)
+	c.Check(err, IsNil)
+	c.Check(read, DeepEquals, data)
+
+	// Check that stale fragments are removed when the key data shrinks.
+	w = NewEFIVariableKeyDataWriter("foo")
+	w.Write(data[:100])
+	c.Check(w.Commit(), IsNil)
+	c.Check(s.vars, HasLen, 1)
+
+	r, err = NewEFIVariableKeyDataReader("foo")
+	c.Assert(err, IsNil)
+	read, err = ioutil.ReadAll(r)
+	c.Check(err, IsNil)
+	c.Check(read, DeepEquals, data[:100])
+}
+
+func (s *keyDataEFISuite) TestReadPartiallyWritten(c *C) {
+	data := make([]byte, 3000)
+	rand.Read(data)
+
+	w := NewEFIVariableKeyDataWriter("foo")
+	w.Write(data)
+	c.Check(w.Commit(), IsNil)
+
+	delete(s.vars, "foo-0-2")
+
+	_, err := NewEFIVariableKeyDataReader("foo")
+	c.Check(err, ErrorMatches, `cannot read key data from EFI variables: unexpected size \(got 2004 bytes, expected 3000 bytes\)`)
+}
+
+func (s *keyDataEFISuite) TestReadCorrupted(c *C) {
+	data := make([]byte, 100)
+	rand.Read(data)
+
+	w := NewEFIVariableKeyDataWriter("foo")
+	w.Write(data)
+	c.Check(w.Commit(), IsNil)
+
+	s.vars["foo-0-0"][50] ^= 0xff
+
+	_, err := NewEFIVariableKeyDataReader("foo")
+	c.Check(err, ErrorMatches, `cannot read key data from EFI variables: invalid digest`)
+}
+
+func (s *keyDataEFISuite) TestUpdate(c *C) {
+	data := make([]byte, 100)
+	rand.Read(data)
+
+	w := NewEFIVariableKeyDataWriter("foo")
+	w.Write(data[:50])
+	c.Check(w.Commit(), IsNil)
+	c.Check(s.vars, HasLen, 1)
+	c.Check(s.vars, testutil.HasKey, "foo-0-0")
+	orig := s.vars["foo-0-0"]
+
+	w = NewEFIVariableKeyDataWriter("foo")
+	w.Write(data)
+	c.Check(w.Commit(), IsNil)
+	c.Check(s.vars, HasLen, 1)
+	c.Check(s.vars, testutil.HasKey, "foo-1-0")
+
+	// Simulate an update that was interrupted before the previous copy was deleted. The most
+	// recent copy should be used.
+	s.vars["foo-0-0"] = orig
+
+	r, err := NewEFIVariableKeyDataReader("foo")
+	c.Assert(err, IsNil)
+	read, err := ioutil.ReadAll(r)
+	c.Check(err, IsNil)
+	c.Check(read, DeepEquals, data)
+}
+
+func (s *keyDataEFISuite) TestReadInterruptedUpdate(c *C) {
+	data := make([]byte, 100)
+	rand.Read(data)
+
+	w := NewEFIVariableKeyDataWriter("foo")
+	w.Write(data)
+	c.Check(w.Commit(), IsNil)
+
+	// Simulate an update that was interrupted whilst writing the new copy. The previous copy
+	// should still be used.
+	s.vars["foo-1-0"] = make([]byte, 50)
+
+	r, err := NewEFIVariableKeyDataReader("foo")
+	c.Assert(err, IsNil)
+	read, err := ioutil.ReadAll(r)
+	c.Check(err, IsNil)
+	c.Check(read, DeepEquals, data)
+
+	// The next update should overwrite the incomplete copy.
+	w = NewEFIVariableKeyDataWriter("foo")
+	w.Write(data[:50])
+	c.Check(w.Commit(), IsNil)
+	c.Check(s.vars, HasLen, 1)
+	c.Check(s.vars, testutil.HasKey, "foo-1-0")
+
+	r, err = NewEFIVariableKeyDataReader("foo")
+	c.Assert(err, IsNil)
+	read, err = ioutil.ReadAll(r)
+	c.Check(err, IsNil)
+	c.Check(read, DeepEquals, data[:50])
+}
+
+func (s *keyDataEFISuite) TestReadNotFound(c *C) {
+	_, err := NewEFIVariableKeyDataReader("foo")
+	c.Check(err, ErrorMatches, `cannot read key data from EFI variables: cannot read fragment 0: .*`)
+	c.Check(xerrors.Is(err, efi.ErrVariableNotFound), Equals, true)
+}
+
+func (s *keyDataEFISuite) TestWriteTooLarge(c *C) {
+	w := NewEFIVariableKeyDataWriter("foo")
+	w.Write(make([]byte, 16*1024))
+	c.Check(w.Commit(), ErrorMatches, `cannot write key data to EFI variables: key data is too large \(16384 bytes\)`)
+	c.Check(s.vars, HasLen, 0)
+}
+
+func (s *keyDataEFISuite) TestDelete(c *C) {
+	data := make([]byte, 3000)
+	rand.Read(data)
+
+	w := NewEFIVariableKeyDataWriter("foo")
+	w.Write(data)
+	c.Check(w.Commit(), IsNil)
+
+	w = NewEFIVariableKeyDataWriter("bar")
+	w.Write(data)
+	c.Check(w.Commit(), IsNil)
+	c.Check(s.vars, HasLen, 6)
+
+	c.Check(DeleteEFIVariableKeyData("foo"), IsNil)
+	c.Check(s.vars, HasLen, 3)
+	for name := range s.vars {
+		c.Check(name, Matches, `bar-0-[0-2]`)
+	}
+}
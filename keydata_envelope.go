@@ -0,0 +1,151 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/xerrors"
+)
+
+const (
+	payloadEnvelopeVersion = 1
+	payloadEnvelopeSaltLen = 32
+	payloadEnvelopeKeyLen  = 32 // AES-256
+)
+
+// payloadEnvelopeAdditionalData returns the associated data used to bind an
+// encrypted payload envelope to the metadata of the key data it belongs to, so
+// that the payload can't be transplanted to key data with a different platform
+// name, platform version or handle.
+func payloadEnvelopeAdditionalData(platformName string, data *PlatformKeyData) []byte {
+	h := sha256.Sum256(data.Handle)
+
+	var b bytes.Buffer
+	b.WriteString("SECBOOT-PAYLOAD-ENVELOPE")
+	binary.Write(&b, binary.BigEndian, uint32(len(platformName)))
+	b.WriteString(platformName)
+	binary.Write(&b, binary.BigEndian, int64(data.Version))
+	b.Write(h[:])
+	return b.Bytes()
+}
+
+// newPayloadEnvelopeAEAD derives the AES-256-GCM key and nonce for an encrypted
+// payload envelope from the supplied protector key and salt. As a new salt is
+// generated every time a payload is sealed, a nonce is never reused with the
+// same key.
+func newPayloadEnvelopeAEAD(key, salt []byte) (aead cipher.AEAD, nonce []byte, err error) {
+	r := hkdf.New(sha256.New, key, salt, []byte("SECBOOT-PAYLOAD-ENVELOPE-KEY"))
+	symKey := make([]byte, payloadEnvelopeKeyLen)
+	if _, err := io.ReadFull(r, symKey); err != nil {
+		return nil, nil, xerrors.Errorf("cannot derive symmetric key: %w", err)
+	}
+
+	b, err := aes.NewCipher(symKey)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot create cipher: %w", err)
+	}
+	aead, err = cipher.NewGCM(b)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot create AEAD: %w", err)
+	}
+
+	nonce = make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(r, nonce); err != nil {
+		return nil, nil, xerrors.Errorf("cannot derive nonce: %w", err)
+	}
+
+	return aead, nonce, nil
+}
+
+// SealPlatformKeyPayload encrypts the supplied cleartext payload using a standard
+// AES-256-GCM envelope, for use by platform implementations whose secure device
+// can only provide a secret (eg, a hook, a PKCS#11 token or a FIDO2 authenticator)
+// rather than encrypting the payload itself. The symmetric key and nonce are derived
+// from the supplied key and a random salt, and the ciphertext is bound to the
+// supplied platform name and to the Handle and Version fields of data.
+//
+// The returned envelope should be used as the EncryptedPayload field of data. The
+// payload can be recovered by the platform's handler with OpenPlatformKeyPayload.
+func SealPlatformKeyPayload(rand io.Reader, key []byte, platformName string, data *PlatformKeyData, payload KeyPayload) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, errors.New("no key supplied")
+	}
+
+	salt := make([]byte, payloadEnvelopeSaltLen)
+	if _, err := io.ReadFull(rand, salt); err != nil {
+		return nil, xerrors.Errorf("cannot create salt: %w", err)
+	}
+
+	aead, nonce, err := newPayloadEnvelopeAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, 1+len(salt)+len(payload)+aead.Overhead())
+	out = append(out, payloadEnvelopeVersion)
+	out = append(out, salt...)
+	return aead.Seal(out, nonce, payload, payloadEnvelopeAdditionalData(platformName, data)), nil
+}
+
+// OpenPlatformKeyPayload decrypts the EncryptedPayload field of the supplied data,
+// which must have been created by SealPlatformKeyPayload with the same key and
+// platform name. It is intended to be called from PlatformKeyDataHandler.RecoverKeys.
+//
+// If the envelope is malformed, or if it cannot be authenticated because the key is
+// wrong or the metadata has been modified, a *PlatformKeyRecoveryError error with a
+// type of PlatformKeyRecoveryErrorInvalidData is returned, which can be returned
+// directly from the handler.
+func OpenPlatformKeyPayload(key []byte, platformName string, data *PlatformKeyData) (KeyPayload, error) {
+	envelope := data.EncryptedPayload
+	if len(envelope) < 1+payloadEnvelopeSaltLen {
+		return nil, &PlatformKeyRecoveryError{Type: PlatformKeyRecoveryErrorInvalidData, Err: errors.New("encrypted payload envelope is too short")}
+	}
+	if envelope[0] != payloadEnvelopeVersion {
+		return nil, &PlatformKeyRecoveryError{
+			Type: PlatformKeyRecoveryErrorInvalidData,
+			Err:  fmt.Errorf("unsupported encrypted payload envelope version (%d)", envelope[0])}
+	}
+
+	salt := envelope[1 : 1+payloadEnvelopeSaltLen]
+	ciphertext := envelope[1+payloadEnvelopeSaltLen:]
+
+	aead, nonce, err := newPayloadEnvelopeAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := aead.Open(nil, nonce, ciphertext, payloadEnvelopeAdditionalData(platformName, data))
+	if err != nil {
+		return nil, &PlatformKeyRecoveryError{
+			Type: PlatformKeyRecoveryErrorInvalidData,
+			Err:  xerrors.Errorf("cannot open encrypted payload envelope: %w", err)}
+	}
+
+	return payload, nil
+}
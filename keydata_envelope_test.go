@@ -0,0 +1,117 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"crypto/rand"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+)
+
+type keyDataEnvelopeSuite struct{}
+
+var _ = Suite(&keyDataEnvelopeSuite{})
+
+func (s *keyDataEnvelopeSuite) newKey(c *C) []byte {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	c.Assert(err, IsNil)
+	return key
+}
+
+func (s *keyDataEnvelopeSuite) seal(c *C, key []byte, data *PlatformKeyData, payload KeyPayload) {
+	var err error
+	data.EncryptedPayload, err = SealPlatformKeyPayload(rand.Reader, key, "mock", data, payload)
+	c.Assert(err, IsNil)
+}
+
+func (s *keyDataEnvelopeSuite) TestRoundTrip(c *C) {
+	key := s.newKey(c)
+	payload := KeyPayload("secret payload")
+
+	data := &PlatformKeyData{Handle: []byte(`{"foo":"bar"}`), Version: 2}
+	s.seal(c, key, data, payload)
+	c.Check(data.EncryptedPayload, Not(DeepEquals), []byte(payload))
+
+	recovered, err := OpenPlatformKeyPayload(key, "mock", data)
+	c.Check(err, IsNil)
+	c.Check(recovered, DeepEquals, payload)
+}
+
+func (s *keyDataEnvelopeSuite) TestSealUsesUniqueSalt(c *C) {
+	key := s.newKey(c)
+	payload := KeyPayload("secret payload")
+
+	data1 := &PlatformKeyData{Handle: []byte(`"foo"`)}
+	s.seal(c, key, data1, payload)
+	data2 := &PlatformKeyData{Handle: []byte(`"foo"`)}
+	s.seal(c, key, data2, payload)
+
+	c.Check(data1.EncryptedPayload, Not(DeepEquals), data2.EncryptedPayload)
+}
+
+func (s *keyDataEnvelopeSuite) TestSealNoKey(c *C) {
+	_, err := SealPlatformKeyPayload(rand.Reader, nil, "mock", &PlatformKeyData{}, KeyPayload("foo"))
+	c.Check(err, ErrorMatches, "no key supplied")
+}
+
+func (s *keyDataEnvelopeSuite) testOpenInvalid(c *C, key []byte, platformName string, data *PlatformKeyData, expected string) {
+	_, err := OpenPlatformKeyPayload(key, platformName, data)
+	c.Check(err, ErrorMatches, expected)
+	c.Assert(err, FitsTypeOf, &PlatformKeyRecoveryError{})
+	c.Check(err.(*PlatformKeyRecoveryError).Type, Equals, PlatformKeyRecoveryErrorInvalidData)
+}
+
+func (s *keyDataEnvelopeSuite) TestOpenWrongKey(c *C) {
+	data := &PlatformKeyData{Handle: []byte(`"foo"`)}
+	s.seal(c, s.newKey(c), data, KeyPayload("secret payload"))
+
+	s.testOpenInvalid(c, s.newKey(c), "mock", data, "cannot open encrypted payload envelope: cipher: message authentication failed")
+}
+
+func (s *keyDataEnvelopeSuite) TestOpenModifiedMetadata(c *C) {
+	key := s.newKey(c)
+	data := &PlatformKeyData{Handle: []byte(`"foo"`), Version: 1}
+	s.seal(c, key, data, KeyPayload("secret payload"))
+
+	// Changing the platform name, version or handle must prevent the payload from being opened.
+	s.testOpenInvalid(c, key, "other", data,
+		"cannot open encrypted payload envelope: cipher: message authentication failed")
+	s.testOpenInvalid(c, key, "mock", &PlatformKeyData{Handle: data.Handle, Version: 0, EncryptedPayload: data.EncryptedPayload},
+		"cannot open encrypted payload envelope: cipher: message authentication failed")
+	s.testOpenInvalid(c, key, "mock", &PlatformKeyData{Handle: []byte(`"bar"`), Version: 1, EncryptedPayload: data.EncryptedPayload},
+		"cannot open encrypted payload envelope: cipher: message authentication failed")
+}
+
+func (s *keyDataEnvelopeSuite) TestOpenTooShort(c *C) {
+	s.testOpenInvalid(c, s.newKey(c), "mock", &PlatformKeyData{EncryptedPayload: []byte{1, 2, 3}},
+		"encrypted payload envelope is too short")
+}
+
+func (s *keyDataEnvelopeSuite) TestOpenUnsupportedVersion(c *C) {
+	key := s.newKey(c)
+	data := &PlatformKeyData{Handle: []byte(`"foo"`)}
+	s.seal(c, key, data, KeyPayload("secret payload"))
+	data.EncryptedPayload[0] = 2
+
+	s.testOpenInvalid(c, key, "mock", data, "unsupported encrypted payload envelope version \\(2\\)")
+}
@@ -0,0 +1,173 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"sort"
+
+	"golang.org/x/xerrors"
+)
+
+// luks2TokenKeyDataKey is the key of the token parameter containing the key
+// data associated with a named keyslot.
+const luks2TokenKeyDataKey = "secboot_keydata"
+
+// ErrNoLUKS2KeyData is returned from NewLUKS2KeyDataReader if the named keyslot
+// does not have any key data associated with it.
+var ErrNoLUKS2KeyData = errors.New("no key data associated with the specified keyslot")
+
+// LUKS2KeyDataReader provides a mechanism to read a KeyData from a LUKS2 token.
+type LUKS2KeyDataReader struct {
+	readableName string
+	priority     int
+	*bytes.Reader
+}
+
+func (r *LUKS2KeyDataReader) ReadableName() string {
+	return r.readableName
+}
+
+// Priority returns the activation priority stored in the token, set with
+// SetLUKS2ContainerKeyPriority. The default priority is zero.
+func (r *LUKS2KeyDataReader) Priority() int {
+	return r.priority
+}
+
+// NewLUKS2KeyDataReader is used to read the key data stored in the token associated
+// with the keyslot with the supplied name, for the LUKS2 container at the specified
+// path.
+//
+// If there is no keyslot with the supplied name, ErrLUKS2KeyslotNotFound is returned.
+// If the keyslot has no key data associated with it, ErrNoLUKS2KeyData is returned.
+func NewLUKS2KeyDataReader(devicePath, keyslotName string) (*LUKS2KeyDataReader, error) {
+	hdr, names, err := readLUKS2KeyslotNames(devicePath)
+	if err != nil {
+		return nil, err
+	}
+	keyslot, ok := names[keyslotName]
+	if !ok {
+		return nil, ErrLUKS2KeyslotNotFound
+	}
+
+	params := hdr.Metadata.Tokens[keyslot.tokenId].Params
+
+	var priority int
+	if p, ok := params[luks2TokenPriorityKey]; ok {
+		n, ok := p.(float64)
+		if !ok {
+			return nil, errors.New("invalid priority token parameter type")
+		}
+		priority = int(n)
+	}
+
+	data, ok := params[luks2TokenKeyDataKey]
+	if !ok {
+		return nil, ErrNoLUKS2KeyData
+	}
+	str, ok := data.(string)
+	if !ok {
+		return nil, errors.New("invalid key data token parameter type")
+	}
+	b, err := base64.StdEncoding.DecodeString(str)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot decode key data token parameter: %w", err)
+	}
+
+	return &LUKS2KeyDataReader{
+		readableName: devicePath + ":" + keyslotName,
+		priority:     priority,
+		Reader:       bytes.NewReader(b)}, nil
+}
+
+// LUKS2KeyDataWriter provides a mechanism to write a KeyData to a LUKS2 token.
+type LUKS2KeyDataWriter struct {
+	devicePath  string
+	keyslotName string
+	*bytes.Buffer
+}
+
+// Commit atomically replaces the token associated with the keyslot with the name
+// supplied to NewLUKS2KeyDataWriter with one containing the new key data. Any
+// other parameters in the existing token are preserved.
+func (w *LUKS2KeyDataWriter) Commit() error {
+	return setLUKS2KeyslotTokenParam(w.devicePath, w.keyslotName, luks2TokenKeyDataKey, w.Bytes())
+}
+
+// NewLUKS2KeyDataWriter creates a new LUKS2KeyDataWriter for atomically writing a
+// KeyData to the token associated with the keyslot with the supplied name, for the
+// LUKS2 container at the specified path. The keyslot must already exist, and can be
+// created with AddLUKS2ContainerUnlockKey.
+func NewLUKS2KeyDataWriter(devicePath, keyslotName string) *LUKS2KeyDataWriter {
+	return &LUKS2KeyDataWriter{
+		devicePath:  devicePath,
+		keyslotName: keyslotName,
+		Buffer:      new(bytes.Buffer)}
+}
+
+// ListLUKS2ContainerKeyDataNames returns the names of the keyslots for the LUKS2
+// container at the specified path that have key data associated with them, in
+// keyslot order. The key data for each keyslot can be read with NewLUKS2KeyDataReader.
+func ListLUKS2ContainerKeyDataNames(devicePath string) ([]string, error) {
+	hdr, names, err := readLUKS2KeyslotNames(devicePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+	for name, keyslot := range names {
+		if _, ok := hdr.Metadata.Tokens[keyslot.tokenId].Params[luks2TokenKeyDataKey]; !ok {
+			continue
+		}
+		out = append(out, name)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return names[out[i]].slot < names[out[j]].slot
+	})
+	return out, nil
+}
+
+// ListSealedKeys reads and returns the key data associated with each of the keyslots
+// of the LUKS2 container at the specified path, in keyslot order. Keyslots without
+// key data are omitted. The role of each key can be obtained with KeyData.Role, so
+// that callers can determine which keys exist for which boot modes.
+func ListSealedKeys(devicePath string) ([]*KeyData, error) {
+	names, err := ListLUKS2ContainerKeyDataNames(devicePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*KeyData
+	for _, name := range names {
+		r, err := NewLUKS2KeyDataReader(devicePath, name)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read key data for keyslot %s: %w", name, err)
+		}
+		keyData, err := ReadKeyData(r)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot decode key data for keyslot %s: %w", name, err)
+		}
+		out = append(out, keyData)
+	}
+
+	return out, nil
+}
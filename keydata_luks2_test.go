@@ -0,0 +1,234 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"crypto"
+	"os"
+
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/luks2"
+	"github.com/snapcore/secboot/internal/luks2/luks2test"
+	"github.com/snapcore/secboot/internal/paths/pathstest"
+)
+
+type keyDataLUKS2Suite struct {
+	snapd_testutil.BaseTest
+	cryptTestBase
+	keyDataTestBase
+}
+
+var _ = Suite(&keyDataLUKS2Suite{})
+
+func (s *keyDataLUKS2Suite) SetUpSuite(c *C) {
+	if _, exists := os.LookupEnv("NO_EXPENSIVE_CRYPTSETUP_TESTS"); exists {
+		c.Skip("skipping expensive cryptsetup tests")
+	}
+	s.keyDataTestBase.SetUpSuite(c)
+}
+
+func (s *keyDataLUKS2Suite) SetUpTest(c *C) {
+	s.BaseTest.SetUpTest(c)
+	s.keyDataTestBase.SetUpTest(c)
+
+	s.AddCleanup(pathstest.MockRunDir(c.MkDir()))
+	s.AddCleanup(luks2test.WrapCryptsetup(c))
+}
+
+func (s *keyDataLUKS2Suite) newContainer(c *C, key []byte) string {
+	path := luks2test.CreateEmptyDiskImage(c, 20)
+	c.Assert(InitializeLUKS2Container(path, "data", key, &InitializeLUKS2ContainerOptions{InitialKeyslotName: "default"}), IsNil)
+	return path
+}
+
+func (s *keyDataLUKS2Suite) newKeyData(c *C) (*KeyData, DiskUnlockKey, AuxiliaryKey) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	keyData, err := NewKeyData(s.mockProtectKeys(c, key, auxKey, crypto.SHA256))
+	c.Assert(err, IsNil)
+	return keyData, key, auxKey
+}
+
+func (s *keyDataLUKS2Suite) TestWriteAndReadKeyData(c *C) {
+	keyData, key, auxKey := s.newKeyData(c)
+
+	path := s.newContainer(c, key)
+	c.Check(keyData.WriteAtomic(NewLUKS2KeyDataWriter(path, "default")), IsNil)
+
+	names, err := ListLUKS2ContainerKeyDataNames(path)
+	c.Check(err, IsNil)
+	c.Check(names, DeepEquals, []string{"default"})
+
+	r, err := NewLUKS2KeyDataReader(path, "default")
+	c.Assert(err, IsNil)
+	c.Check(r.ReadableName(), Equals, path+":default")
+
+	keyData2, err := ReadKeyData(r)
+	c.Assert(err, IsNil)
+
+	expectedId, err := keyData.UniqueID()
+	c.Check(err, IsNil)
+	id, err := keyData2.UniqueID()
+	c.Check(err, IsNil)
+	c.Check(id, DeepEquals, expectedId)
+
+	recoveredKey, recoveredAuxKey, err := keyData2.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, key)
+	c.Check(recoveredAuxKey, DeepEquals, auxKey)
+}
+
+func (s *keyDataLUKS2Suite) TestUpdateKeyData(c *C) {
+	keyData, key, _ := s.newKeyData(c)
+
+	path := s.newContainer(c, key)
+	c.Check(keyData.WriteAtomic(NewLUKS2KeyDataWriter(path, "default")), IsNil)
+
+	info, err := luks2.ReadHeader(path, luks2.LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(info.Metadata.Tokens, HasLen, 1)
+
+	keyData2, _, _ := s.newKeyData(c)
+	c.Check(keyData2.WriteAtomic(NewLUKS2KeyDataWriter(path, "default")), IsNil)
+
+	// The token should be replaced rather than a new one added.
+	info, err = luks2.ReadHeader(path, luks2.LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(info.Metadata.Tokens, HasLen, 1)
+
+	r, err := NewLUKS2KeyDataReader(path, "default")
+	c.Assert(err, IsNil)
+	keyData3, err := ReadKeyData(r)
+	c.Assert(err, IsNil)
+
+	expectedId, err := keyData2.UniqueID()
+	c.Check(err, IsNil)
+	id, err := keyData3.UniqueID()
+	c.Check(err, IsNil)
+	c.Check(id, DeepEquals, expectedId)
+}
+
+func (s *keyDataLUKS2Suite) TestListKeyDataNamesOmitsKeyslotsWithoutKeyData(c *C) {
+	keyData, key, _ := s.newKeyData(c)
+
+	path := s.newContainer(c, key)
+	c.Check(AddLUKS2ContainerRecoveryKey(path, "recovery", key, s.newRecoveryKey()), IsNil)
+	c.Check(AddLUKS2ContainerUnlockKey(path, "foo", key, s.newPrimaryKey()), IsNil)
+	c.Check(keyData.WriteAtomic(NewLUKS2KeyDataWriter(path, "foo")), IsNil)
+
+	names, err := ListLUKS2ContainerKeyDataNames(path)
+	c.Check(err, IsNil)
+	c.Check(names, DeepEquals, []string{"foo"})
+}
+
+func (s *keyDataLUKS2Suite) TestListSealedKeys(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+	protected.Role = "run"
+	runKeyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	protected.Role = "recover"
+	recoverKeyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	path := s.newContainer(c, key)
+	c.Check(AddLUKS2ContainerRecoveryKey(path, "recovery", key, s.newRecoveryKey()), IsNil)
+	c.Check(AddLUKS2ContainerUnlockKey(path, "fallback", key, s.newPrimaryKey()), IsNil)
+	c.Check(runKeyData.WriteAtomic(NewLUKS2KeyDataWriter(path, "default")), IsNil)
+	c.Check(recoverKeyData.WriteAtomic(NewLUKS2KeyDataWriter(path, "fallback")), IsNil)
+
+	keys, err := ListSealedKeys(path)
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 2)
+	c.Check(keys[0].ReadableName(), Equals, path+":default")
+	c.Check(keys[0].Role(), Equals, "run")
+	c.Check(keys[1].ReadableName(), Equals, path+":fallback")
+	c.Check(keys[1].Role(), Equals, "recover")
+}
+
+func (s *keyDataLUKS2Suite) TestRenamePreservesKeyData(c *C) {
+	keyData, key, _ := s.newKeyData(c)
+
+	path := s.newContainer(c, key)
+	c.Check(keyData.WriteAtomic(NewLUKS2KeyDataWriter(path, "default")), IsNil)
+	c.Check(RenameLUKS2ContainerKey(path, "default", "bar"), IsNil)
+
+	names, err := ListLUKS2ContainerKeyDataNames(path)
+	c.Check(err, IsNil)
+	c.Check(names, DeepEquals, []string{"bar"})
+
+	r, err := NewLUKS2KeyDataReader(path, "bar")
+	c.Assert(err, IsNil)
+	_, err = ReadKeyData(r)
+	c.Check(err, IsNil)
+}
+
+func (s *keyDataLUKS2Suite) TestReadKeyDataNoKeyData(c *C) {
+	path := s.newContainer(c, s.newPrimaryKey())
+
+	_, err := NewLUKS2KeyDataReader(path, "default")
+	c.Check(err, Equals, ErrNoLUKS2KeyData)
+}
+
+func (s *keyDataLUKS2Suite) TestReadKeyDataKeyslotNotFound(c *C) {
+	path := s.newContainer(c, s.newPrimaryKey())
+
+	_, err := NewLUKS2KeyDataReader(path, "foo")
+	c.Check(err, Equals, ErrLUKS2KeyslotNotFound)
+}
+
+func (s *keyDataLUKS2Suite) TestWriteKeyDataKeyslotNotFound(c *C) {
+	keyData, key, _ := s.newKeyData(c)
+
+	path := s.newContainer(c, key)
+	c.Check(keyData.WriteAtomic(NewLUKS2KeyDataWriter(path, "foo")), ErrorMatches,
+		"cannot commit keydata: no keyslot with the specified name")
+}
+
+func (s *keyDataLUKS2Suite) TestSetKeyPriority(c *C) {
+	keyData, key, _ := s.newKeyData(c)
+
+	path := s.newContainer(c, key)
+	c.Check(keyData.WriteAtomic(NewLUKS2KeyDataWriter(path, "default")), IsNil)
+	c.Check(SetLUKS2ContainerKeyPriority(path, "default", 5), IsNil)
+
+	r, err := NewLUKS2KeyDataReader(path, "default")
+	c.Assert(err, IsNil)
+	c.Check(r.Priority(), Equals, 5)
+
+	keyData, err = ReadKeyData(r)
+	c.Assert(err, IsNil)
+	c.Check(keyData.Priority(), Equals, 5)
+
+	// Updating the key data should preserve the priority.
+	c.Check(keyData.WriteAtomic(NewLUKS2KeyDataWriter(path, "default")), IsNil)
+	r, err = NewLUKS2KeyDataReader(path, "default")
+	c.Assert(err, IsNil)
+	c.Check(r.Priority(), Equals, 5)
+}
+
+func (s *keyDataLUKS2Suite) TestSetKeyPriorityKeyslotNotFound(c *C) {
+	path := s.newContainer(c, s.newPrimaryKey())
+	c.Check(SetLUKS2ContainerKeyPriority(path, "foo", 5), Equals, ErrLUKS2KeyslotNotFound)
+}
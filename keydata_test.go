@@ -32,6 +32,7 @@ import (
 	"hash"
 	"io"
 	"math/rand"
+	"time"
 
 	. "github.com/snapcore/secboot"
 	"github.com/snapcore/secboot/internal/testutil"
@@ -50,10 +51,13 @@ const (
 )
 
 type mockPlatformKeyDataHandler struct {
-	state int
+	state            int
+	recoverKeysCalls int
 }
 
 func (h *mockPlatformKeyDataHandler) RecoverKeys(data *PlatformKeyData) (KeyPayload, error) {
+	h.recoverKeysCalls++
+
 	switch h.state {
 	case mockPlatformDeviceStateUnavailable:
 		return nil, &PlatformKeyRecoveryError{Type: PlatformKeyRecoveryErrorUnavailable, Err: errors.New("the platform device is unavailable")}
@@ -129,6 +133,15 @@ func (r *mockKeyDataReader) ReadableName() string {
 	return r.readableName
 }
 
+type mockKeyDataPriorityReader struct {
+	*mockKeyDataReader
+	priority int
+}
+
+func (r *mockKeyDataPriorityReader) Priority() int {
+	return r.priority
+}
+
 func toHash(c *C, v interface{}) crypto.Hash {
 	str, ok := v.(string)
 	c.Assert(ok, testutil.IsTrue)
@@ -160,6 +173,7 @@ func (s *keyDataTestBase) SetUpSuite(c *C) {
 
 func (s *keyDataTestBase) SetUpTest(c *C) {
 	s.handler.state = mockPlatformDeviceStateOK
+	s.handler.recoverKeysCalls = 0
 }
 
 func (s *keyDataTestBase) TearDownSuite(c *C) {
@@ -346,6 +360,7 @@ func (s *keyDataSuite) TestNewKeyData(c *C) {
 	keyData, err := NewKeyData(protected)
 	c.Check(keyData, NotNil)
 	c.Check(err, IsNil)
+	c.Check(keyData.PlatformName(), Equals, protected.PlatformName)
 }
 
 func (s *keyDataSuite) TestRecoverKeys(c *C) {
@@ -374,6 +389,74 @@ func (s *keyDataSuite) TestRecoverKeysUnrecognizedPlatform(c *C) {
 	c.Check(recoveredAuxKey, IsNil)
 }
 
+func (s *keyDataSuite) TestRecoverKeysSelectsNewestPlatformVersion(c *C) {
+	handler2 := &mockPlatformKeyDataHandler{}
+	handler5 := &mockPlatformKeyDataHandler{}
+	RegisterPlatformKeyDataHandlerVersion(mockPlatformName, 2, handler2)
+	defer RegisterPlatformKeyDataHandlerVersion(mockPlatformName, 2, nil)
+	RegisterPlatformKeyDataHandlerVersion(mockPlatformName, 5, handler5)
+	defer RegisterPlatformKeyDataHandlerVersion(mockPlatformName, 5, nil)
+
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+	protected.PlatformVersion = 1
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+	c.Check(keyData.PlatformVersion(), Equals, 1)
+
+	recoveredKey, recoveredAuxKey, err := keyData.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, key)
+	c.Check(recoveredAuxKey, DeepEquals, auxKey)
+
+	c.Check(s.handler.recoverKeysCalls, Equals, 0)
+	c.Check(handler2.recoverKeysCalls, Equals, 0)
+	c.Check(handler5.recoverKeysCalls, Equals, 1)
+}
+
+func (s *keyDataSuite) TestRecoverKeysPlatformVersionTooNew(c *C) {
+	RegisterPlatformKeyDataHandlerVersion(mockPlatformName, 2, &mockPlatformKeyDataHandler{})
+	defer RegisterPlatformKeyDataHandlerVersion(mockPlatformName, 2, nil)
+
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+	protected.PlatformVersion = 3
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	// The key data must not be passed to an older handler.
+	_, _, err = keyData.RecoverKeys()
+	c.Check(err, Equals, ErrPlatformVersionUnsupported)
+	c.Check(s.handler.recoverKeysCalls, Equals, 0)
+}
+
+func (s *keyDataSuite) TestReadKeyDataPlatformVersion(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+	protected.PlatformVersion = 3
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	keyData, err = ReadKeyData(&mockKeyDataReader{"foo", w.Reader()})
+	c.Assert(err, IsNil)
+	c.Check(keyData.PlatformVersion(), Equals, 3)
+}
+
+func (s *keyDataSuite) TestNewKeyDataInvalidPlatformVersion(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+	protected.PlatformVersion = -1
+
+	_, err := NewKeyData(protected)
+	c.Check(err, ErrorMatches, "invalid platform version")
+}
+
 func (s *keyDataSuite) TestRecoverKeysInvalidData(c *C) {
 	key, auxKey := s.newKeyDataKeys(c, 32, 32)
 	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
@@ -769,3 +852,295 @@ func (s *keyDataSuite) TestReadKeyData4(c *C) {
 		}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij"),
 		authorized: false})
 }
+
+func (s *keyDataSuite) TestNewKeyDataNoFeatures(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	critical, ignorable := keyData.Features()
+	c.Check(critical, Equals, KeyDataFeatures(0))
+	c.Check(ignorable, Equals, KeyDataFeatures(0))
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	var j map[string]interface{}
+	c.Check(json.NewDecoder(w.Reader()).Decode(&j), IsNil)
+	c.Check(j, Not(testutil.HasKey), "features")
+}
+
+func (s *keyDataSuite) TestReadKeyDataWithSupportedCriticalFeatures(c *C) {
+	restore := MockSupportedKeyDataFeatures(0x3)
+	defer restore()
+
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+	keyData.SetFeatures(0x2, true)
+	keyData.SetFeatures(0x1, false)
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	keyData, err = ReadKeyData(&mockKeyDataReader{"foo", w.Reader()})
+	c.Assert(err, IsNil)
+	critical, ignorable := keyData.Features()
+	c.Check(critical, Equals, KeyDataFeatures(0x2))
+	c.Check(ignorable, Equals, KeyDataFeatures(0x1))
+
+	recoveredKey, recoveredAuxKey, err := keyData.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, key)
+	c.Check(recoveredAuxKey, DeepEquals, auxKey)
+}
+
+func (s *keyDataSuite) TestReadKeyDataWithUnsupportedCriticalFeatures(c *C) {
+	restore := MockSupportedKeyDataFeatures(0x3)
+	defer restore()
+
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+	keyData.SetFeatures(0x5, true)
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	_, err = ReadKeyData(&mockKeyDataReader{"foo", w.Reader()})
+	c.Check(err, ErrorMatches, `invalid key data: unsupported critical features \(0x4\)`)
+	var e *InvalidKeyDataError
+	c.Check(xerrors.As(err, &e), testutil.IsTrue)
+}
+
+func (s *keyDataSuite) TestReadKeyDataWithUnsupportedIgnorableFeatures(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+	keyData.SetFeatures(0x10, false)
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	keyData, err = ReadKeyData(&mockKeyDataReader{"foo", w.Reader()})
+	c.Assert(err, IsNil)
+
+	recoveredKey, recoveredAuxKey, err := keyData.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, key)
+	c.Check(recoveredAuxKey, DeepEquals, auxKey)
+
+	// Unsupported ignorable features are preserved when the key data is written back.
+	w = makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+	keyData, err = ReadKeyData(&mockKeyDataReader{"foo", w.Reader()})
+	c.Assert(err, IsNil)
+	_, ignorable := keyData.Features()
+	c.Check(ignorable, Equals, KeyDataFeatures(0x10))
+}
+
+func (s *keyDataSuite) TestSetFeaturesPromotesToCritical(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+	keyData.SetFeatures(0x3, false)
+	keyData.SetFeatures(0x1, true)
+
+	critical, ignorable := keyData.Features()
+	c.Check(critical, Equals, KeyDataFeatures(0x1))
+	c.Check(ignorable, Equals, KeyDataFeatures(0x2))
+}
+
+func (s *keyDataSuite) TestReadKeyDataPriority(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+	c.Check(keyData.Priority(), Equals, 0)
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	keyData, err = ReadKeyData(&mockKeyDataPriorityReader{&mockKeyDataReader{"foo", w.Reader()}, 10})
+	c.Assert(err, IsNil)
+	c.Check(keyData.Priority(), Equals, 10)
+
+	keyData.SetPriority(-1)
+	c.Check(keyData.Priority(), Equals, -1)
+}
+
+func (s *keyDataSuite) TestKeyDataRole(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+	protected.Role = "run"
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+	c.Check(keyData.Role(), Equals, "run")
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	keyData, err = ReadKeyData(&mockKeyDataReader{"foo", w.Reader()})
+	c.Assert(err, IsNil)
+	c.Check(keyData.Role(), Equals, "run")
+
+	keyData.SetRole("recover")
+	c.Check(keyData.Role(), Equals, "recover")
+}
+
+func (s *keyDataSuite) TestKeyDataNoRole(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+	c.Check(keyData.Role(), Equals, "")
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	var j map[string]interface{}
+	c.Check(json.NewDecoder(w.Reader()).Decode(&j), IsNil)
+	c.Check(j, Not(testutil.HasKey), "role")
+}
+
+type testKeyDataWithPassphraseData struct {
+	kdfOptions KDFOptions
+	params     *PassphraseParams
+}
+
+func (s *keyDataSuite) testKeyDataWithPassphrase(c *C, data *testKeyDataWithPassphraseData) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyDataWithPassphrase(protected, "passphrase", data.kdfOptions)
+	c.Assert(err, IsNil)
+	c.Check(keyData.AuthMode(), Equals, AuthModePassphrase)
+	c.Check(keyData.PassphraseParams(), DeepEquals, data.params)
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	keyData, err = ReadKeyData(&mockKeyDataReader{"foo", w.Reader()})
+	c.Assert(err, IsNil)
+	c.Check(keyData.PassphraseParams(), DeepEquals, data.params)
+
+	recoveredKey, recoveredAuxKey, err := keyData.RecoverKeysWithPassphrase("passphrase")
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, key)
+	c.Check(recoveredAuxKey, DeepEquals, auxKey)
+}
+
+func (s *keyDataSuite) TestKeyDataWithPassphraseArgon2id(c *C) {
+	s.testKeyDataWithPassphrase(c, &testKeyDataWithPassphraseData{
+		kdfOptions: &Argon2Options{MemoryKiB: 32, ForceIterations: 4, Parallel: 1},
+		params:     &PassphraseParams{KDFType: "argon2id", Time: 4, MemoryKiB: 32, Threads: 1}})
+}
+
+func (s *keyDataSuite) TestKeyDataWithPassphraseArgon2i(c *C) {
+	s.testKeyDataWithPassphrase(c, &testKeyDataWithPassphraseData{
+		kdfOptions: &Argon2Options{Mode: Argon2i, MemoryKiB: 64, ForceIterations: 5, Parallel: 2},
+		params:     &PassphraseParams{KDFType: "argon2i", Time: 5, MemoryKiB: 64, Threads: 2}})
+}
+
+func (s *keyDataSuite) TestKeyDataWithPassphrasePBKDF2(c *C) {
+	s.testKeyDataWithPassphrase(c, &testKeyDataWithPassphraseData{
+		kdfOptions: &PBKDF2Options{ForceIterations: 1000},
+		params:     &PassphraseParams{KDFType: "pbkdf2", Time: 1000}})
+}
+
+func (s *keyDataSuite) TestKeyDataWithPassphrasePBKDF2SHA512(c *C) {
+	s.testKeyDataWithPassphrase(c, &testKeyDataWithPassphraseData{
+		kdfOptions: &PBKDF2Options{ForceIterations: 2000, HashAlg: crypto.SHA512},
+		params:     &PassphraseParams{KDFType: "pbkdf2", Time: 2000}})
+}
+
+func (s *keyDataSuite) TestKeyDataWithPassphrasePBKDF2Benchmark(c *C) {
+	restore := MockPBKDF2Duration(func(iterations uint32, h crypto.Hash) time.Duration {
+		c.Check(iterations, Equals, uint32(100000))
+		c.Check(h, Equals, crypto.SHA256)
+		return 100 * time.Millisecond
+	})
+	defer restore()
+
+	s.testKeyDataWithPassphrase(c, &testKeyDataWithPassphraseData{
+		kdfOptions: &PBKDF2Options{TargetDuration: 10 * time.Millisecond},
+		params:     &PassphraseParams{KDFType: "pbkdf2", Time: 10000}})
+}
+
+func (s *keyDataSuite) TestKeyDataWithPassphrasePBKDF2TooFewIterations(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	_, err := NewKeyDataWithPassphrase(protected, "passphrase", &PBKDF2Options{ForceIterations: 999})
+	c.Check(err, ErrorMatches, `cannot set passphrase: cannot compute KDF parameters: too few iterations \(999\)`)
+}
+
+func (s *keyDataSuite) TestRecoverKeysWithPassphraseWrongPassphrase(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyDataWithPassphrase(protected, "passphrase", &PBKDF2Options{ForceIterations: 1000})
+	c.Assert(err, IsNil)
+
+	recoveredKey, recoveredAuxKey, err := keyData.RecoverKeysWithPassphrase("foo")
+	c.Check(err, Equals, ErrInvalidPassphrase)
+	c.Check(recoveredKey, IsNil)
+	c.Check(recoveredAuxKey, IsNil)
+	c.Check(s.handler.recoverKeysCalls, Equals, 0)
+}
+
+func (s *keyDataSuite) TestRecoverKeysWithPassphraseNoPassphrase(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+	c.Check(keyData.PassphraseParams(), IsNil)
+
+	_, _, err = keyData.RecoverKeysWithPassphrase("passphrase")
+	c.Check(err, ErrorMatches, "cannot recover key with passphrase because none is set")
+}
+
+func (s *keyDataSuite) TestChangePassphrase(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyDataWithPassphrase(protected, "passphrase", &PBKDF2Options{ForceIterations: 1000})
+	c.Assert(err, IsNil)
+
+	// Upgrade the KDF whilst changing the passphrase.
+	c.Check(keyData.ChangePassphrase("passphrase", "new passphrase", &Argon2Options{MemoryKiB: 32, ForceIterations: 4, Parallel: 1}), IsNil)
+	c.Check(keyData.PassphraseParams(), DeepEquals, &PassphraseParams{KDFType: "argon2id", Time: 4, MemoryKiB: 32, Threads: 1})
+
+	_, _, err = keyData.RecoverKeysWithPassphrase("passphrase")
+	c.Check(err, Equals, ErrInvalidPassphrase)
+
+	recoveredKey, recoveredAuxKey, err := keyData.RecoverKeysWithPassphrase("new passphrase")
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, key)
+	c.Check(recoveredAuxKey, DeepEquals, auxKey)
+}
+
+func (s *keyDataSuite) TestChangePassphraseWrongPassphrase(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyDataWithPassphrase(protected, "passphrase", &PBKDF2Options{ForceIterations: 1000})
+	c.Assert(err, IsNil)
+
+	c.Check(keyData.ChangePassphrase("foo", "new passphrase", nil), Equals, ErrInvalidPassphrase)
+	c.Check(keyData.PassphraseParams(), DeepEquals, &PassphraseParams{KDFType: "pbkdf2", Time: 1000})
+}
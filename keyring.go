@@ -24,6 +24,7 @@ import (
 	"fmt"
 	"os"
 	"syscall"
+	"time"
 
 	"github.com/snapcore/secboot/internal/keyring"
 
@@ -37,6 +38,19 @@ const (
 
 var ErrKernelKeyNotFound = errors.New("cannot find key in kernel keyring")
 
+// KeyringKeyOptions customizes how a key is stored in the kernel keyring.
+type KeyringKeyOptions struct {
+	// Permissions specifies the permissions of the key, in the format
+	// used by keyctl_setperm(3). If zero, the kernel default is used,
+	// which grants full access to possessors and view access to the
+	// owning user.
+	Permissions uint32
+
+	// Timeout specifies how long the key is available for before it
+	// expires. If zero, the key doesn't expire.
+	Timeout time.Duration
+}
+
 func keyringPrefixOrDefault(prefix string) string {
 	if prefix == "" {
 		return "ubuntu-fde"
@@ -100,3 +114,35 @@ func GetAuxiliaryKeyFromKernel(prefix, devicePath string, remove bool) (Auxiliar
 
 	return key, nil
 }
+
+// GetActivationError retrieves the reason that the volume with the specified
+// name had to be activated with the recovery key, as recorded during activation.
+// This can be used after boot to report why the platform protected keys could not
+// be used, eg, because of an unexpected PCR value, and to decide whether to
+// re-enroll them. If more than one key was tried, there will be one line for each
+// of them. The value of prefix must match the prefix that was supplied via
+// ActivateVolumeOptions during unlocking.
+//
+// If remove is true, the error will be removed from the kernel keyring prior to
+// returning.
+//
+// If the volume was not activated with the recovery key, a ErrKernelKeyNotFound
+// error will be returned.
+func GetActivationError(prefix, volumeName string, remove bool) (string, error) {
+	msg, err := keyring.GetKeyFromUserKeyring(volumeName, keyring.PurposeActivationError, keyringPrefixOrDefault(prefix))
+	if err != nil {
+		var e syscall.Errno
+		if xerrors.As(err, &e) && e == syscall.ENOKEY {
+			return "", ErrKernelKeyNotFound
+		}
+		return "", err
+	}
+
+	if remove {
+		if err := keyring.RemoveKeyFromUserKeyring(volumeName, keyring.PurposeActivationError, keyringPrefixOrDefault(prefix)); err != nil {
+			fmt.Fprintf(os.Stderr, "secboot: cannot remove key from keyring: %v\n", err)
+		}
+	}
+
+	return string(msg), nil
+}
@@ -169,3 +169,27 @@ func (s *keyringSuite) TestGetAuxiliaryKeyFromKernelAndRemove(c *C) {
 	_, err = keyring.GetKeyFromUserKeyring("/dev/sda1", "aux", "ubuntu-fde")
 	c.Check(err, ErrorMatches, "cannot find key: required key not available")
 }
+
+func (s *keyringSuite) TestGetActivationError(c *C) {
+	c.Check(keyring.AddKeyToUserKeyring([]byte("foo: cannot recover key: bar"), "data", "activation-error", "ubuntu-fde"), IsNil)
+
+	msg, err := GetActivationError("", "data", false)
+	c.Check(err, IsNil)
+	c.Check(msg, Equals, "foo: cannot recover key: bar")
+}
+
+func (s *keyringSuite) TestGetActivationErrorNoKey(c *C) {
+	_, err := GetActivationError("", "data", false)
+	c.Check(err, ErrorMatches, "cannot find key in kernel keyring")
+}
+
+func (s *keyringSuite) TestGetActivationErrorAndRemove(c *C) {
+	c.Check(keyring.AddKeyToUserKeyring([]byte("foo: cannot recover key: bar"), "data", "activation-error", "foo"), IsNil)
+
+	msg, err := GetActivationError("foo", "data", true)
+	c.Check(err, IsNil)
+	c.Check(msg, Equals, "foo: cannot recover key: bar")
+
+	_, err = GetActivationError("foo", "data", true)
+	c.Check(err, ErrorMatches, "cannot find key in kernel keyring")
+}
@@ -0,0 +1,44 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"github.com/snapcore/secboot/internal/logger"
+)
+
+// Logger is implemented by types that receive structured debug events from this package
+// and the platform specific packages, such as the TPM commands that are executed, the
+// number of branches in a PCR profile, computed policy digests and each attempt to activate
+// a volume along with its outcome. Each event is identified by a short name and has a set
+// of associated fields. It is intended to help with debugging problems in environments such
+// as the initramfs.
+//
+// Events never contain key material.
+type Logger = logger.Logger
+
+// LogField is a key/value pair associated with an event that is passed to a Logger.
+type LogField = logger.Field
+
+// SetLogger sets the logger that receives debug events. Supplying nil disables logging,
+// which is the default. The logger applies to TPM connections that are already open as
+// well as those opened later.
+func SetLogger(l Logger) {
+	logger.Set(l)
+}
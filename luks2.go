@@ -0,0 +1,327 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/luks2"
+)
+
+const (
+	// luks2TokenType is the type of the LUKS2 tokens created by this package.
+	luks2TokenType = "secboot"
+
+	// luks2TokenNameKey is the key of the token parameter containing the name
+	// of the associated keyslot.
+	luks2TokenNameKey = "secboot_name"
+
+	// luks2TokenPriorityKey is the key of the token parameter containing the
+	// activation priority of the key data associated with a named keyslot.
+	luks2TokenPriorityKey = "secboot_priority"
+
+	// luks2MaxKeyslots is the maximum number of keyslots in a LUKS2 container.
+	luks2MaxKeyslots = 32
+)
+
+// ErrLUKS2KeyslotNotFound is returned from functions that operate on a named keyslot
+// if there is no keyslot with the specified name.
+var ErrLUKS2KeyslotNotFound = errors.New("no keyslot with the specified name")
+
+// LUKS2KeyslotExistsError is returned from functions that create a named keyslot
+// if there is already a keyslot with the specified name.
+type LUKS2KeyslotExistsError struct {
+	Name string
+}
+
+func (e LUKS2KeyslotExistsError) Error() string {
+	return fmt.Sprintf("a keyslot with the name \"%s\" already exists", e.Name)
+}
+
+// CryptsetupBackend selects the mechanism used to modify LUKS2 containers.
+type CryptsetupBackend int
+
+const (
+	// CryptsetupBackendExec runs the cryptsetup binary. This is the default.
+	CryptsetupBackendExec CryptsetupBackend = iota
+
+	// CryptsetupBackendLibcryptsetup uses libcryptsetup directly, which
+	// removes the runtime dependency on the cryptsetup binary. It is only
+	// available when this package is built with the secboot_libcryptsetup
+	// build tag.
+	CryptsetupBackendLibcryptsetup
+)
+
+// SetCryptsetupBackend selects the mechanism used by the functions in this package
+// that create or modify LUKS2 containers. It should be called before any of them
+// are used, and is not safe to call concurrently with them.
+func SetCryptsetupBackend(backend CryptsetupBackend) error {
+	switch backend {
+	case CryptsetupBackendExec:
+		luks2.SetBackend(luks2.NewExecBackend())
+	case CryptsetupBackendLibcryptsetup:
+		b, err := luks2.NewLibcryptsetupBackend()
+		if err != nil {
+			return err
+		}
+		luks2.SetBackend(b)
+	default:
+		return errors.New("invalid backend")
+	}
+	return nil
+}
+
+type luks2NamedKeyslot struct {
+	slot    int
+	tokenId int
+}
+
+// readLUKS2KeyslotNames returns the named keyslots associated with the LUKS2
+// container at the specified path, along with the container header.
+func readLUKS2KeyslotNames(devicePath string) (*luks2.HeaderInfo, map[string]luks2NamedKeyslot, error) {
+	hdr, err := luks2.ReadHeader(devicePath, luks2.LockModeBlocking)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot read LUKS2 header: %w", err)
+	}
+
+	names := make(map[string]luks2NamedKeyslot)
+	for id, token := range hdr.Metadata.Tokens {
+		if token.Type != luks2TokenType || len(token.Keyslots) != 1 {
+			continue
+		}
+		name, ok := token.Params[luks2TokenNameKey].(string)
+		if !ok || name == "" {
+			continue
+		}
+		if _, ok := hdr.Metadata.Keyslots[token.Keyslots[0]]; !ok {
+			continue
+		}
+		names[name] = luks2NamedKeyslot{slot: token.Keyslots[0], tokenId: id}
+	}
+
+	return hdr, names, nil
+}
+
+func newLUKS2KeyslotNameToken(slot int, name string) *luks2.Token {
+	return &luks2.Token{
+		Type:     luks2TokenType,
+		Keyslots: []int{slot},
+		Params:   map[string]interface{}{luks2TokenNameKey: name}}
+}
+
+// setLUKS2KeyslotTokenParam atomically replaces the token associated with the
+// keyslot with the supplied name with a copy that has the parameter with the
+// supplied key set to value.
+func setLUKS2KeyslotTokenParam(devicePath, keyslotName, key string, value interface{}) error {
+	hdr, names, err := readLUKS2KeyslotNames(devicePath)
+	if err != nil {
+		return err
+	}
+	keyslot, ok := names[keyslotName]
+	if !ok {
+		return ErrLUKS2KeyslotNotFound
+	}
+
+	token := newLUKS2KeyslotNameToken(keyslot.slot, keyslotName)
+	for k, v := range hdr.Metadata.Tokens[keyslot.tokenId].Params {
+		if _, exists := token.Params[k]; exists {
+			continue
+		}
+		token.Params[k] = v
+	}
+	token.Params[key] = value
+
+	if err := luks2.ReplaceToken(devicePath, keyslot.tokenId, token); err != nil {
+		return xerrors.Errorf("cannot replace token: %w", err)
+	}
+
+	return nil
+}
+
+func addLUKS2ContainerNamedKey(devicePath, keyslotName string, existingKey, newKey []byte, kdfOptions luks2.KDFOptions) error {
+	if keyslotName == "" {
+		return errors.New("no keyslot name supplied")
+	}
+
+	hdr, names, err := readLUKS2KeyslotNames(devicePath)
+	if err != nil {
+		return err
+	}
+	if _, exists := names[keyslotName]; exists {
+		return LUKS2KeyslotExistsError{keyslotName}
+	}
+
+	slot := -1
+	for i := 0; i < luks2MaxKeyslots; i++ {
+		if _, used := hdr.Metadata.Keyslots[i]; !used {
+			slot = i
+			break
+		}
+	}
+	if slot < 0 {
+		return errors.New("no free keyslots")
+	}
+
+	options := luks2.AddKeyOptions{
+		KDFOptions: kdfOptions,
+		Slot:       slot}
+	if err := luks2.AddKey(devicePath, existingKey, newKey, &options); err != nil {
+		return xerrors.Errorf("cannot add key: %w", err)
+	}
+
+	if err := luks2.ImportToken(devicePath, newLUKS2KeyslotNameToken(slot, keyslotName)); err != nil {
+		return xerrors.Errorf("cannot import token: %w", err)
+	}
+
+	return nil
+}
+
+// AddLUKS2ContainerUnlockKey adds a new key in to a new keyslot with the supplied name
+// for the LUKS2 container at the specified path. An existing key for the container must
+// be supplied via the existingKey argument.
+//
+// The new key must be a cryptographically secure random number of at least 32-bytes.
+// Because of this, the new keyslot is configured with a KDF of minimal cost with
+// benchmarking disabled.
+//
+// If a keyslot with the supplied name already exists, a LUKS2KeyslotExistsError error
+// will be returned.
+func AddLUKS2ContainerUnlockKey(devicePath, keyslotName string, existingKey, newKey []byte) error {
+	if len(newKey) < 32 {
+		return fmt.Errorf("expected a key length of at least 256-bits (got %d)", len(newKey)*8)
+	}
+	return addLUKS2ContainerNamedKey(devicePath, keyslotName, existingKey, newKey, highEntropyKeyKDFOptions())
+}
+
+// AddLUKS2ContainerRecoveryKey adds a fallback recovery key in to a new keyslot with the
+// supplied name for the LUKS2 container at the specified path. An existing key for the
+// container must be supplied via the existingKey argument. The new keyslot is configured
+// with a KDF that is benchmarked to take about 5 seconds.
+//
+// If a keyslot with the supplied name already exists, a LUKS2KeyslotExistsError error
+// will be returned.
+func AddLUKS2ContainerRecoveryKey(devicePath, keyslotName string, existingKey []byte, recoveryKey RecoveryKey) error {
+	return addLUKS2ContainerNamedKey(devicePath, keyslotName, existingKey, recoveryKey[:], recoveryKeyKDFOptions())
+}
+
+// ListLUKS2ContainerKeyNames returns the names of the keyslots for the LUKS2 container
+// at the specified path, in keyslot order. Keyslots that were not created with a name
+// are omitted.
+func ListLUKS2ContainerKeyNames(devicePath string) ([]string, error) {
+	_, names, err := readLUKS2KeyslotNames(devicePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+	for name := range names {
+		out = append(out, name)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return names[out[i]].slot < names[out[j]].slot
+	})
+	return out, nil
+}
+
+// DeleteLUKS2ContainerKey deletes the keyslot with the supplied name from the LUKS2
+// container at the specified path. A key for one of the other keyslots must be supplied
+// via the existingKey argument, which prevents the last keyslot from being deleted.
+//
+// If there is no keyslot with the supplied name, ErrLUKS2KeyslotNotFound is returned.
+func DeleteLUKS2ContainerKey(devicePath, keyslotName string, existingKey []byte) error {
+	_, names, err := readLUKS2KeyslotNames(devicePath)
+	if err != nil {
+		return err
+	}
+	keyslot, ok := names[keyslotName]
+	if !ok {
+		return ErrLUKS2KeyslotNotFound
+	}
+
+	if err := luks2.KillSlot(devicePath, keyslot.slot, existingKey); err != nil {
+		return xerrors.Errorf("cannot kill keyslot: %w", err)
+	}
+
+	if err := luks2.RemoveToken(devicePath, keyslot.tokenId); err != nil {
+		return xerrors.Errorf("cannot remove token: %w", err)
+	}
+
+	return nil
+}
+
+// RenameLUKS2ContainerKey changes the name of the keyslot with the name oldName to
+// newName for the LUKS2 container at the specified path.
+//
+// If there is no keyslot with the name oldName, ErrLUKS2KeyslotNotFound is returned. If
+// a keyslot with the name newName already exists, a LUKS2KeyslotExistsError error is
+// returned.
+func RenameLUKS2ContainerKey(devicePath, oldName, newName string) error {
+	if newName == "" {
+		return errors.New("no keyslot name supplied")
+	}
+
+	hdr, names, err := readLUKS2KeyslotNames(devicePath)
+	if err != nil {
+		return err
+	}
+	keyslot, ok := names[oldName]
+	if !ok {
+		return ErrLUKS2KeyslotNotFound
+	}
+	if _, exists := names[newName]; exists {
+		return LUKS2KeyslotExistsError{newName}
+	}
+
+	// Preserve any other parameters, such as key data.
+	token := newLUKS2KeyslotNameToken(keyslot.slot, newName)
+	for k, v := range hdr.Metadata.Tokens[keyslot.tokenId].Params {
+		if k == luks2TokenNameKey {
+			continue
+		}
+		token.Params[k] = v
+	}
+
+	// Import the new token before removing the old one, so that the keyslot
+	// isn't left without a name if this is interrupted.
+	if err := luks2.ImportToken(devicePath, token); err != nil {
+		return xerrors.Errorf("cannot import token: %w", err)
+	}
+
+	if err := luks2.RemoveToken(devicePath, keyslot.tokenId); err != nil {
+		return xerrors.Errorf("cannot remove old token: %w", err)
+	}
+
+	return nil
+}
+
+// SetLUKS2ContainerKeyPriority sets the activation priority of the key data associated
+// with the keyslot with the supplied name, for the LUKS2 container at the specified path.
+// The priority is returned from KeyData.Priority when the key data is read with
+// NewLUKS2KeyDataReader. When activating a volume with multiple keys, keys with a higher
+// priority are tried first.
+//
+// If there is no keyslot with the supplied name, ErrLUKS2KeyslotNotFound is returned.
+func SetLUKS2ContainerKeyPriority(devicePath, keyslotName string, priority int) error {
+	return setLUKS2KeyslotTokenParam(devicePath, keyslotName, luks2TokenPriorityKey, priority)
+}
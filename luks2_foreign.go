@@ -0,0 +1,251 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/luks2"
+)
+
+const (
+	// clevisTokenType is the type of the LUKS2 tokens created by clevis.
+	clevisTokenType = "clevis"
+
+	// systemdTPM2TokenType is the type of the LUKS2 tokens created by
+	// systemd-cryptenroll for TPM2 enrollments.
+	systemdTPM2TokenType = "systemd-tpm2"
+)
+
+// LUKS2ForeignTPM2BindingType describes the tool that created a TPM2 binding
+// for a LUKS2 container.
+type LUKS2ForeignTPM2BindingType string
+
+const (
+	// LUKS2ForeignTPM2BindingClevis corresponds to a binding created with the
+	// clevis tpm2 pin.
+	LUKS2ForeignTPM2BindingClevis LUKS2ForeignTPM2BindingType = "clevis"
+
+	// LUKS2ForeignTPM2BindingSystemd corresponds to a binding created with
+	// systemd-cryptenroll --tpm2-device.
+	LUKS2ForeignTPM2BindingSystemd LUKS2ForeignTPM2BindingType = "systemd"
+)
+
+// LUKS2ForeignTPM2Binding describes a TPM2 binding for a LUKS2 container that
+// was created by another tool, as recorded in a token in the LUKS2 header.
+type LUKS2ForeignTPM2Binding struct {
+	Type     LUKS2ForeignTPM2BindingType
+	TokenID  int   // The ID of the token that describes this binding
+	Keyslots []int // The keyslots protected by this binding
+
+	PCRBank string // The name of the PCR bank that the binding is sealed to, eg, "sha256"
+	PCRs    []int  // The PCRs that the binding is sealed to
+	PIN     bool   // Whether the binding requires a PIN in addition to the TPM
+}
+
+type clevisJWEHeader struct {
+	Clevis struct {
+		Pin  string `json:"pin"`
+		TPM2 *struct {
+			PCRBank string `json:"pcr_bank"`
+			PCRIds  string `json:"pcr_ids"`
+		} `json:"tpm2"`
+	} `json:"clevis"`
+}
+
+func decodeClevisTPM2Binding(token *luks2.Token) (*LUKS2ForeignTPM2Binding, error) {
+	jwe, ok := token.Params["jwe"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("no JWE")
+	}
+	protected, ok := jwe["protected"].(string)
+	if !ok {
+		return nil, errors.New("no JWE protected header")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(protected, "="))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot decode JWE protected header: %w", err)
+	}
+	var hdr clevisJWEHeader
+	if err := json.Unmarshal(b, &hdr); err != nil {
+		return nil, xerrors.Errorf("cannot unmarshal JWE protected header: %w", err)
+	}
+	if hdr.Clevis.Pin != "tpm2" || hdr.Clevis.TPM2 == nil {
+		// Not a tpm2 pin.
+		return nil, nil
+	}
+
+	binding := &LUKS2ForeignTPM2Binding{
+		Type:    LUKS2ForeignTPM2BindingClevis,
+		PCRBank: hdr.Clevis.TPM2.PCRBank}
+	if hdr.Clevis.TPM2.PCRIds != "" {
+		for _, s := range strings.Split(hdr.Clevis.TPM2.PCRIds, ",") {
+			pcr, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				return nil, xerrors.Errorf("invalid PCR ID %q: %w", s, err)
+			}
+			binding.PCRs = append(binding.PCRs, pcr)
+		}
+	}
+	return binding, nil
+}
+
+func decodeSystemdTPM2Binding(token *luks2.Token) (*LUKS2ForeignTPM2Binding, error) {
+	binding := &LUKS2ForeignTPM2Binding{Type: LUKS2ForeignTPM2BindingSystemd}
+
+	if bank, ok := token.Params["tpm2-pcr-bank"]; ok {
+		s, ok := bank.(string)
+		if !ok {
+			return nil, errors.New("invalid tpm2-pcr-bank parameter type")
+		}
+		binding.PCRBank = s
+	}
+	if pcrs, ok := token.Params["tpm2-pcrs"]; ok {
+		a, ok := pcrs.([]interface{})
+		if !ok {
+			return nil, errors.New("invalid tpm2-pcrs parameter type")
+		}
+		for _, v := range a {
+			n, ok := v.(float64)
+			if !ok {
+				return nil, errors.New("invalid tpm2-pcrs element type")
+			}
+			binding.PCRs = append(binding.PCRs, int(n))
+		}
+	}
+	if pin, ok := token.Params["tpm2-pin"]; ok {
+		b, ok := pin.(bool)
+		if !ok {
+			return nil, errors.New("invalid tpm2-pin parameter type")
+		}
+		binding.PIN = b
+	}
+
+	return binding, nil
+}
+
+func decodeLUKS2ForeignTPM2Binding(token *luks2.Token) (*LUKS2ForeignTPM2Binding, error) {
+	switch token.Type {
+	case clevisTokenType:
+		return decodeClevisTPM2Binding(token)
+	case systemdTPM2TokenType:
+		return decodeSystemdTPM2Binding(token)
+	default:
+		return nil, nil
+	}
+}
+
+// ReadLUKS2ForeignTPM2Bindings returns the TPM2 bindings created by clevis or
+// systemd-cryptenroll for the LUKS2 container at the specified path, in token
+// order. Tokens created by clevis with a pin other than tpm2 are omitted.
+func ReadLUKS2ForeignTPM2Bindings(devicePath string) ([]*LUKS2ForeignTPM2Binding, error) {
+	hdr, err := luks2.ReadHeader(devicePath, luks2.LockModeBlocking)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read LUKS2 header: %w", err)
+	}
+
+	var out []*LUKS2ForeignTPM2Binding
+	for id, token := range hdr.Metadata.Tokens {
+		binding, err := decodeLUKS2ForeignTPM2Binding(token)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot decode %s token %d: %w", token.Type, id, err)
+		}
+		if binding == nil {
+			continue
+		}
+		binding.TokenID = id
+		binding.Keyslots = append([]int(nil), token.Keyslots...)
+		out = append(out, binding)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].TokenID < out[j].TokenID
+	})
+
+	return out, nil
+}
+
+// MigrateLUKS2ForeignTPM2Binding replaces a TPM2 binding created by clevis or
+// systemd-cryptenroll for the LUKS2 container at the specified path with a new
+// keyslot with the supplied name, protected by secboot. This permits a volume to be
+// switched from one of these tools without reformatting it.
+//
+// The existingKey argument must unlock one of the keyslots of the container. This
+// will normally be the passphrase of one of the binding's keyslots, obtained by
+// unlocking it with the tool that created it (eg, with "clevis luks pass"). The
+// newKey argument is added to the new keyslot in the same way as
+// AddLUKS2ContainerUnlockKey, and would normally be a key protected by one of the
+// platforms supported by this package. If keyData is not nil, it is stored in the
+// token associated with the new keyslot.
+//
+// Once the new keyslot has been created, the binding's token and keyslots are
+// removed from the container.
+func MigrateLUKS2ForeignTPM2Binding(devicePath string, binding *LUKS2ForeignTPM2Binding, existingKey []byte, keyslotName string, newKey []byte, keyData *KeyData) error {
+	hdr, err := luks2.ReadHeader(devicePath, luks2.LockModeBlocking)
+	if err != nil {
+		return xerrors.Errorf("cannot read LUKS2 header: %w", err)
+	}
+	token, ok := hdr.Metadata.Tokens[binding.TokenID]
+	if !ok {
+		return fmt.Errorf("no token with ID %d", binding.TokenID)
+	}
+	current, err := decodeLUKS2ForeignTPM2Binding(token)
+	switch {
+	case err != nil:
+		return xerrors.Errorf("cannot decode token %d: %w", binding.TokenID, err)
+	case current == nil || current.Type != binding.Type:
+		return fmt.Errorf("token %d is not a %s TPM2 binding", binding.TokenID, binding.Type)
+	}
+
+	if err := AddLUKS2ContainerUnlockKey(devicePath, keyslotName, existingKey, newKey); err != nil {
+		return xerrors.Errorf("cannot add new keyslot: %w", err)
+	}
+
+	if keyData != nil {
+		if err := keyData.WriteAtomic(NewLUKS2KeyDataWriter(devicePath, keyslotName)); err != nil {
+			return xerrors.Errorf("cannot write key data: %w", err)
+		}
+	}
+
+	if err := luks2.RemoveToken(devicePath, binding.TokenID); err != nil {
+		return xerrors.Errorf("cannot remove token: %w", err)
+	}
+
+	// The new key is used to authorize the removal of the old keyslots,
+	// because cryptsetup won't accept a key that only unlocks the keyslot
+	// being removed.
+	for _, slot := range token.Keyslots {
+		if _, ok := hdr.Metadata.Keyslots[slot]; !ok {
+			continue
+		}
+		if err := luks2.KillSlot(devicePath, slot, newKey); err != nil {
+			return xerrors.Errorf("cannot kill keyslot %d: %w", slot, err)
+		}
+	}
+
+	return nil
+}
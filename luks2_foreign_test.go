@@ -0,0 +1,145 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"encoding/base64"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/luks2"
+	"github.com/snapcore/secboot/internal/luks2/luks2test"
+)
+
+// newContainerWithForeignBinding creates a container with a keyslot named
+// "default" and a second keyslot at slot 1 that is described by the supplied
+// token.
+func (s *luks2Suite) newContainerWithForeignBinding(c *C, key, foreignKey []byte, token *luks2.Token) string {
+	path := s.newContainer(c, key)
+	c.Assert(luks2.AddKey(path, key, foreignKey, &luks2.AddKeyOptions{
+		KDFOptions: luks2.KDFOptions{MemoryKiB: 32, ForceIterations: 4},
+		Slot:       1}), IsNil)
+	c.Assert(luks2.ImportToken(path, token), IsNil)
+	return path
+}
+
+func newClevisTPM2Token(slot int) *luks2.Token {
+	protected := base64.RawURLEncoding.EncodeToString([]byte(
+		`{"alg":"dir","enc":"A256GCM","clevis":{"pin":"tpm2","tpm2":{"hash":"sha256","key":"ecc",` +
+			`"pcr_bank":"sha256","pcr_ids":"0,7","jwk_pub":"AA","jwk_priv":"AA"}}}`))
+	return &luks2.Token{
+		Type:     "clevis",
+		Keyslots: []int{slot},
+		Params: map[string]interface{}{
+			"jwe": map[string]interface{}{
+				"ciphertext":    "",
+				"encrypted_key": "",
+				"iv":            "",
+				"protected":     protected,
+				"tag":           ""}}}
+}
+
+func newSystemdTPM2Token(slot int) *luks2.Token {
+	return &luks2.Token{
+		Type:     "systemd-tpm2",
+		Keyslots: []int{slot},
+		Params: map[string]interface{}{
+			"tpm2-blob":        "AA==",
+			"tpm2-pcrs":        []interface{}{7},
+			"tpm2-pcr-bank":    "sha256",
+			"tpm2-primary-alg": "ecc",
+			"tpm2-policy-hash": "00",
+			"tpm2-pin":         true}}
+}
+
+func (s *luks2Suite) TestReadLUKS2ForeignTPM2BindingsClevis(c *C) {
+	path := s.newContainerWithForeignBinding(c, s.newPrimaryKey(), s.newPrimaryKey(), newClevisTPM2Token(1))
+
+	bindings, err := ReadLUKS2ForeignTPM2Bindings(path)
+	c.Check(err, IsNil)
+	c.Check(bindings, DeepEquals, []*LUKS2ForeignTPM2Binding{
+		{
+			Type:     LUKS2ForeignTPM2BindingClevis,
+			TokenID:  1,
+			Keyslots: []int{1},
+			PCRBank:  "sha256",
+			PCRs:     []int{0, 7}}})
+}
+
+func (s *luks2Suite) TestReadLUKS2ForeignTPM2BindingsSystemd(c *C) {
+	path := s.newContainerWithForeignBinding(c, s.newPrimaryKey(), s.newPrimaryKey(), newSystemdTPM2Token(1))
+
+	bindings, err := ReadLUKS2ForeignTPM2Bindings(path)
+	c.Check(err, IsNil)
+	c.Check(bindings, DeepEquals, []*LUKS2ForeignTPM2Binding{
+		{
+			Type:     LUKS2ForeignTPM2BindingSystemd,
+			TokenID:  1,
+			Keyslots: []int{1},
+			PCRBank:  "sha256",
+			PCRs:     []int{7},
+			PIN:      true}})
+}
+
+func (s *luks2Suite) TestReadLUKS2ForeignTPM2BindingsNone(c *C) {
+	path := s.newContainer(c, s.newPrimaryKey())
+
+	bindings, err := ReadLUKS2ForeignTPM2Bindings(path)
+	c.Check(err, IsNil)
+	c.Check(bindings, HasLen, 0)
+}
+
+func (s *luks2Suite) TestMigrateLUKS2ForeignTPM2Binding(c *C) {
+	key := s.newPrimaryKey()
+	foreignKey := s.newPrimaryKey()
+	path := s.newContainerWithForeignBinding(c, key, foreignKey, newSystemdTPM2Token(1))
+
+	bindings, err := ReadLUKS2ForeignTPM2Bindings(path)
+	c.Assert(err, IsNil)
+	c.Assert(bindings, HasLen, 1)
+
+	newKey := s.newPrimaryKey()
+	c.Check(MigrateLUKS2ForeignTPM2Binding(path, bindings[0], foreignKey, "tpm", newKey, nil), IsNil)
+
+	names, err := ListLUKS2ContainerKeyNames(path)
+	c.Check(err, IsNil)
+	c.Check(names, DeepEquals, []string{"default", "tpm"})
+
+	bindings, err = ReadLUKS2ForeignTPM2Bindings(path)
+	c.Check(err, IsNil)
+	c.Check(bindings, HasLen, 0)
+
+	info, err := luks2.ReadHeader(path, luks2.LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(info.Metadata.Keyslots, HasLen, 2)
+	c.Check(info.Metadata.Keyslots[1], IsNil)
+
+	luks2test.CheckLUKS2Passphrase(c, path, newKey)
+}
+
+func (s *luks2Suite) TestMigrateLUKS2ForeignTPM2BindingWrongType(c *C) {
+	key := s.newPrimaryKey()
+	path := s.newContainerWithForeignBinding(c, key, s.newPrimaryKey(), newSystemdTPM2Token(1))
+
+	binding := &LUKS2ForeignTPM2Binding{Type: LUKS2ForeignTPM2BindingClevis, TokenID: 1, Keyslots: []int{1}}
+	c.Check(MigrateLUKS2ForeignTPM2Binding(path, binding, key, "tpm", s.newPrimaryKey(), nil), ErrorMatches,
+		"token 1 is not a clevis TPM2 binding")
+}
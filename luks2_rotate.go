@@ -0,0 +1,211 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// luks2RotatingKeyslotSuffix is appended to the name of a keyslot to name the
+// keyslot that will replace it during a key rotation.
+const luks2RotatingKeyslotSuffix = ".rotating"
+
+// RotateVolumeKeyOptions provides the options for RotateVolumeKey.
+type RotateVolumeKeyOptions struct {
+	// ExistingKey is a key for a keyslot that isn't being rotated, such as
+	// the recovery key. It is used to add the new keyslots and to complete
+	// an interrupted rotation, and must be supplied.
+	ExistingKey []byte
+
+	// Keyslots contains the names of the keyslots to rotate. If this is
+	// empty, all keyslots that have key data associated with them are
+	// rotated.
+	Keyslots []string
+
+	// NewKey is called for each keyslot being rotated, and must return a
+	// newly generated unlock key along with the key data that protects it,
+	// eg, by calling the platform's protector again. The name of the keyslot
+	// and its existing key data are supplied. It must be supplied.
+	NewKey func(keyslotName string, old *KeyData) (DiskUnlockKey, *KeyData, error)
+}
+
+// completeInterruptedLUKS2KeyRotations finds keyslots that were left behind by a
+// call to RotateVolumeKey that was interrupted, and either completes or rolls back
+// the rotation of each of them. A replacement keyslot that has key data is complete,
+// so the keyslot it replaces is removed and it is renamed. A replacement keyslot
+// without key data is removed.
+func completeInterruptedLUKS2KeyRotations(devicePath string, existingKey []byte) error {
+	hdr, names, err := readLUKS2KeyslotNames(devicePath)
+	if err != nil {
+		return err
+	}
+
+	var rotating []string
+	for name := range names {
+		if strings.HasSuffix(name, luks2RotatingKeyslotSuffix) {
+			rotating = append(rotating, name)
+		}
+	}
+	sort.Strings(rotating)
+
+	for _, name := range rotating {
+		origName := strings.TrimSuffix(name, luks2RotatingKeyslotSuffix)
+
+		if _, complete := hdr.Metadata.Tokens[names[name].tokenId].Params[luks2TokenKeyDataKey]; !complete {
+			if err := DeleteLUKS2ContainerKey(devicePath, name, existingKey); err != nil {
+				return xerrors.Errorf("cannot remove incomplete replacement for keyslot %s: %w", origName, err)
+			}
+			continue
+		}
+
+		if _, exists := names[origName]; exists {
+			if err := DeleteLUKS2ContainerKey(devicePath, origName, existingKey); err != nil {
+				return xerrors.Errorf("cannot remove old keyslot %s: %w", origName, err)
+			}
+		}
+		if err := RenameLUKS2ContainerKey(devicePath, name, origName); err != nil {
+			return xerrors.Errorf("cannot rename replacement for keyslot %s: %w", origName, err)
+		}
+	}
+
+	return nil
+}
+
+func rotateLUKS2Key(devicePath, keyslotName string, options *RotateVolumeKeyOptions) error {
+	r, err := NewLUKS2KeyDataReader(devicePath, keyslotName)
+	if err != nil {
+		return xerrors.Errorf("cannot read key data: %w", err)
+	}
+	oldKeyData, err := ReadKeyData(r)
+	if err != nil {
+		return xerrors.Errorf("cannot decode key data: %w", err)
+	}
+
+	newKey, newKeyData, err := options.NewKey(keyslotName, oldKeyData)
+	switch {
+	case err != nil:
+		return xerrors.Errorf("cannot create new key: %w", err)
+	case newKeyData == nil:
+		return errors.New("no key data for new key")
+	}
+
+	return replaceLUKS2KeyslotKey(devicePath, keyslotName, options.ExistingKey, newKey, newKeyData, r.Priority())
+}
+
+// replaceLUKS2KeyslotKey replaces the keyslot with the supplied name with a new
+// keyslot containing newKey, and associates newKeyData and the supplied priority
+// with it. The existing key is used to add the new keyslot, and the new key is used
+// to remove the old one, so existingKey may be the key for the keyslot being
+// replaced.
+func replaceLUKS2KeyslotKey(devicePath, keyslotName string, existingKey []byte, newKey DiskUnlockKey, newKeyData *KeyData, priority int) error {
+	// The replacement keyslot is only considered complete once its key data
+	// has been written, which is used to recover from an interruption.
+	tmpName := keyslotName + luks2RotatingKeyslotSuffix
+	if err := AddLUKS2ContainerUnlockKey(devicePath, tmpName, existingKey, newKey); err != nil {
+		return xerrors.Errorf("cannot add new keyslot: %w", err)
+	}
+	if priority != 0 {
+		if err := SetLUKS2ContainerKeyPriority(devicePath, tmpName, priority); err != nil {
+			return xerrors.Errorf("cannot set priority of new keyslot: %w", err)
+		}
+	}
+	if err := newKeyData.WriteAtomic(NewLUKS2KeyDataWriter(devicePath, tmpName)); err != nil {
+		return xerrors.Errorf("cannot write key data for new keyslot: %w", err)
+	}
+
+	if err := DeleteLUKS2ContainerKey(devicePath, keyslotName, newKey); err != nil {
+		return xerrors.Errorf("cannot remove old keyslot: %w", err)
+	}
+	if err := RenameLUKS2ContainerKey(devicePath, tmpName, keyslotName); err != nil {
+		return xerrors.Errorf("cannot rename new keyslot: %w", err)
+	}
+
+	return nil
+}
+
+// CompleteLUKS2KeyRotation completes or rolls back a key rotation for the LUKS2
+// container at the specified path that was interrupted, such as a call to
+// RotateVolumeKey or TransitionProtectedKeys. A replacement keyslot whose key data
+// was written replaces the original keyslot, and any other replacement keyslot is
+// removed. The existingKey argument must be a key for a keyslot that isn't being
+// rotated, such as the recovery key.
+func CompleteLUKS2KeyRotation(devicePath string, existingKey []byte) error {
+	return completeInterruptedLUKS2KeyRotations(devicePath, existingKey)
+}
+
+// RotateVolumeKey replaces the unlock keys of the keyslots of the LUKS2 container at
+// the specified path with newly generated keys, so that copies of the old keys and
+// their key data can no longer be used to unlock the volume. For each keyslot, a new
+// key and key data is obtained from options.NewKey, and is added to a new keyslot
+// before the old keyslot is removed and the new keyslot takes its name. Note that this
+// doesn't change the volume key that encrypts the data itself.
+//
+// If this is interrupted, the volume can always be unlocked with the old key or the
+// new key for each keyslot, and the rotation is completed or rolled back the next time
+// that this function is called, before any of the requested keyslots are rotated. It
+// can also be completed or rolled back with CompleteLUKS2KeyRotation. This
+// may also be done by calling this function with an empty list of keyslots to rotate
+// and a NewKey function that is never called, on a container without key data.
+//
+// If any of the requested keyslots do not exist, ErrLUKS2KeyslotNotFound is returned
+// before any are rotated.
+func RotateVolumeKey(devicePath string, options *RotateVolumeKeyOptions) error {
+	if options == nil || len(options.ExistingKey) == 0 {
+		return errors.New("no existing key supplied")
+	}
+	if options.NewKey == nil {
+		return errors.New("no NewKey function supplied")
+	}
+
+	if err := completeInterruptedLUKS2KeyRotations(devicePath, options.ExistingKey); err != nil {
+		return xerrors.Errorf("cannot complete interrupted key rotation: %w", err)
+	}
+
+	keyslots := options.Keyslots
+	if len(keyslots) == 0 {
+		var err error
+		keyslots, err = ListLUKS2ContainerKeyDataNames(devicePath)
+		if err != nil {
+			return err
+		}
+	} else {
+		_, names, err := readLUKS2KeyslotNames(devicePath)
+		if err != nil {
+			return err
+		}
+		for _, name := range keyslots {
+			if _, ok := names[name]; !ok {
+				return ErrLUKS2KeyslotNotFound
+			}
+		}
+	}
+
+	for _, name := range keyslots {
+		if err := rotateLUKS2Key(devicePath, name, options); err != nil {
+			return xerrors.Errorf("cannot rotate keyslot %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
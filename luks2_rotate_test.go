@@ -0,0 +1,162 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/luks2"
+	"github.com/snapcore/secboot/internal/luks2/luks2test"
+)
+
+// newContainerForRotation creates a container with a keyslot named "default" that
+// has key data, and a keyslot named "other" without key data that can be used as
+// the existing key for RotateVolumeKey.
+func (s *keyDataLUKS2Suite) newContainerForRotation(c *C) (path string, otherKey []byte) {
+	keyData, key, _ := s.newKeyData(c)
+	path = s.newContainer(c, key)
+	c.Assert(keyData.WriteAtomic(NewLUKS2KeyDataWriter(path, "default")), IsNil)
+
+	otherKey = s.newPrimaryKey()
+	c.Assert(AddLUKS2ContainerUnlockKey(path, "other", key, otherKey), IsNil)
+	return path, otherKey
+}
+
+func (s *keyDataLUKS2Suite) checkRotatedKeyData(c *C, path string, expected *KeyData) {
+	r, err := NewLUKS2KeyDataReader(path, "default")
+	c.Assert(err, IsNil)
+	keyData, err := ReadKeyData(r)
+	c.Assert(err, IsNil)
+
+	expectedId, err := expected.UniqueID()
+	c.Check(err, IsNil)
+	id, err := keyData.UniqueID()
+	c.Check(err, IsNil)
+	c.Check(id, DeepEquals, expectedId)
+}
+
+func (s *keyDataLUKS2Suite) TestRotateVolumeKey(c *C) {
+	path, otherKey := s.newContainerForRotation(c)
+
+	var newKeyData *KeyData
+	var newKey DiskUnlockKey
+	var names []string
+	c.Check(RotateVolumeKey(path, &RotateVolumeKeyOptions{
+		ExistingKey: otherKey,
+		NewKey: func(name string, old *KeyData) (DiskUnlockKey, *KeyData, error) {
+			names = append(names, name)
+			newKeyData, newKey, _ = s.newKeyData(c)
+			return newKey, newKeyData, nil
+		}}), IsNil)
+	c.Check(names, DeepEquals, []string{"default"})
+
+	keyslots, err := ListLUKS2ContainerKeyNames(path)
+	c.Check(err, IsNil)
+	c.Check(keyslots, DeepEquals, []string{"other", "default"})
+
+	info, err := luks2.ReadHeader(path, luks2.LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(info.Metadata.Keyslots, HasLen, 2)
+	c.Check(info.Metadata.Tokens, HasLen, 2)
+
+	s.checkRotatedKeyData(c, path, newKeyData)
+	luks2test.CheckLUKS2Passphrase(c, path, newKey)
+}
+
+func (s *keyDataLUKS2Suite) TestRotateVolumeKeyPreservesPriority(c *C) {
+	path, otherKey := s.newContainerForRotation(c)
+	c.Assert(SetLUKS2ContainerKeyPriority(path, "default", 10), IsNil)
+
+	c.Check(RotateVolumeKey(path, &RotateVolumeKeyOptions{
+		ExistingKey: otherKey,
+		NewKey: func(name string, old *KeyData) (DiskUnlockKey, *KeyData, error) {
+			keyData, key, _ := s.newKeyData(c)
+			return key, keyData, nil
+		}}), IsNil)
+
+	r, err := NewLUKS2KeyDataReader(path, "default")
+	c.Assert(err, IsNil)
+	c.Check(r.Priority(), Equals, 10)
+}
+
+func (s *keyDataLUKS2Suite) TestRotateVolumeKeyNotFound(c *C) {
+	path, otherKey := s.newContainerForRotation(c)
+
+	c.Check(RotateVolumeKey(path, &RotateVolumeKeyOptions{
+		ExistingKey: otherKey,
+		Keyslots:    []string{"foo"},
+		NewKey: func(name string, old *KeyData) (DiskUnlockKey, *KeyData, error) {
+			c.Error("unexpected call")
+			return nil, nil, nil
+		}}), Equals, ErrLUKS2KeyslotNotFound)
+}
+
+func (s *keyDataLUKS2Suite) TestRotateVolumeKeyCompletesInterruptedRotation(c *C) {
+	path, otherKey := s.newContainerForRotation(c)
+
+	// Simulate an interruption after the replacement keyslot was created
+	// and its key data was written.
+	keyData, key, _ := s.newKeyData(c)
+	c.Assert(AddLUKS2ContainerUnlockKey(path, "default.rotating", otherKey, key), IsNil)
+	c.Assert(keyData.WriteAtomic(NewLUKS2KeyDataWriter(path, "default.rotating")), IsNil)
+
+	c.Check(RotateVolumeKey(path, &RotateVolumeKeyOptions{
+		ExistingKey: otherKey,
+		Keyslots:    []string{"other"},
+		NewKey: func(name string, old *KeyData) (DiskUnlockKey, *KeyData, error) {
+			c.Error("unexpected call")
+			return nil, nil, nil
+		}}), ErrorMatches, "cannot rotate keyslot other: cannot read key data: no key data associated with the specified keyslot")
+
+	keyslots, err := ListLUKS2ContainerKeyNames(path)
+	c.Check(err, IsNil)
+	c.Check(keyslots, DeepEquals, []string{"other", "default"})
+
+	s.checkRotatedKeyData(c, path, keyData)
+	luks2test.CheckLUKS2Passphrase(c, path, key)
+}
+
+func (s *keyDataLUKS2Suite) TestRotateVolumeKeyRollsBackIncompleteRotation(c *C) {
+	path, otherKey := s.newContainerForRotation(c)
+
+	r, err := NewLUKS2KeyDataReader(path, "default")
+	c.Assert(err, IsNil)
+	origKeyData, err := ReadKeyData(r)
+	c.Assert(err, IsNil)
+
+	// Simulate an interruption before the key data for the replacement
+	// keyslot was written.
+	c.Assert(AddLUKS2ContainerUnlockKey(path, "default.rotating", otherKey, s.newPrimaryKey()), IsNil)
+
+	c.Check(RotateVolumeKey(path, &RotateVolumeKeyOptions{
+		ExistingKey: otherKey,
+		Keyslots:    []string{"other"},
+		NewKey: func(name string, old *KeyData) (DiskUnlockKey, *KeyData, error) {
+			c.Error("unexpected call")
+			return nil, nil, nil
+		}}), ErrorMatches, "cannot rotate keyslot other: cannot read key data: no key data associated with the specified keyslot")
+
+	keyslots, err := ListLUKS2ContainerKeyNames(path)
+	c.Check(err, IsNil)
+	c.Check(keyslots, DeepEquals, []string{"default", "other"})
+
+	s.checkRotatedKeyData(c, path, origKeyData)
+}
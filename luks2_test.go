@@ -0,0 +1,179 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"os"
+
+	snapd_testutil "github.com/snapcore/snapd/testutil"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/luks2"
+	"github.com/snapcore/secboot/internal/luks2/luks2test"
+	"github.com/snapcore/secboot/internal/paths/pathstest"
+)
+
+type luks2Suite struct {
+	snapd_testutil.BaseTest
+	cryptTestBase
+}
+
+var _ = Suite(&luks2Suite{})
+
+func (s *luks2Suite) SetUpSuite(c *C) {
+	if _, exists := os.LookupEnv("NO_EXPENSIVE_CRYPTSETUP_TESTS"); exists {
+		c.Skip("skipping expensive cryptsetup tests")
+	}
+}
+
+func (s *luks2Suite) SetUpTest(c *C) {
+	s.BaseTest.SetUpTest(c)
+
+	s.AddCleanup(pathstest.MockRunDir(c.MkDir()))
+	s.AddCleanup(luks2test.WrapCryptsetup(c))
+}
+
+func (s *luks2Suite) newContainer(c *C, key []byte) string {
+	path := luks2test.CreateEmptyDiskImage(c, 20)
+	c.Assert(InitializeLUKS2Container(path, "data", key, &InitializeLUKS2ContainerOptions{InitialKeyslotName: "default"}), IsNil)
+	return path
+}
+
+func (s *luks2Suite) TestInitializeLUKS2ContainerWithKeyslotName(c *C) {
+	path := s.newContainer(c, s.newPrimaryKey())
+
+	names, err := ListLUKS2ContainerKeyNames(path)
+	c.Check(err, IsNil)
+	c.Check(names, DeepEquals, []string{"default"})
+}
+
+func (s *luks2Suite) TestAddLUKS2ContainerUnlockKey(c *C) {
+	key := s.newPrimaryKey()
+	path := s.newContainer(c, key)
+
+	newKey := s.newPrimaryKey()
+	c.Check(AddLUKS2ContainerUnlockKey(path, "foo", key, newKey), IsNil)
+
+	names, err := ListLUKS2ContainerKeyNames(path)
+	c.Check(err, IsNil)
+	c.Check(names, DeepEquals, []string{"default", "foo"})
+
+	info, err := luks2.ReadHeader(path, luks2.LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Assert(info.Metadata.Keyslots, HasLen, 2)
+	keyslot := info.Metadata.Keyslots[1]
+	c.Assert(keyslot, NotNil)
+	c.Assert(keyslot.KDF, NotNil)
+	c.Check(keyslot.KDF.Time, Equals, 4)
+	c.Check(keyslot.KDF.Memory, Equals, 32)
+
+	luks2test.CheckLUKS2Passphrase(c, path, newKey)
+}
+
+func (s *luks2Suite) TestAddLUKS2ContainerUnlockKeyNameExists(c *C) {
+	key := s.newPrimaryKey()
+	path := s.newContainer(c, key)
+
+	err := AddLUKS2ContainerUnlockKey(path, "default", key, s.newPrimaryKey())
+	c.Check(err, ErrorMatches, "a keyslot with the name \"default\" already exists")
+	c.Check(err, FitsTypeOf, LUKS2KeyslotExistsError{})
+}
+
+func (s *luks2Suite) TestAddLUKS2ContainerUnlockKeyInvalidKeySize(c *C) {
+	c.Check(AddLUKS2ContainerUnlockKey("/dev/sda1", "foo", nil, make([]byte, 16)), ErrorMatches,
+		"expected a key length of at least 256-bits \\(got 128\\)")
+}
+
+func (s *luks2Suite) TestAddLUKS2ContainerRecoveryKey(c *C) {
+	key := s.newPrimaryKey()
+	path := s.newContainer(c, key)
+
+	recoveryKey := s.newRecoveryKey()
+	c.Check(AddLUKS2ContainerRecoveryKey(path, "recovery", key, recoveryKey), IsNil)
+
+	names, err := ListLUKS2ContainerKeyNames(path)
+	c.Check(err, IsNil)
+	c.Check(names, DeepEquals, []string{"default", "recovery"})
+
+	luks2test.CheckLUKS2Passphrase(c, path, recoveryKey[:])
+}
+
+func (s *luks2Suite) TestRenameLUKS2ContainerKey(c *C) {
+	key := s.newPrimaryKey()
+	path := s.newContainer(c, key)
+
+	c.Check(RenameLUKS2ContainerKey(path, "default", "bar"), IsNil)
+
+	names, err := ListLUKS2ContainerKeyNames(path)
+	c.Check(err, IsNil)
+	c.Check(names, DeepEquals, []string{"bar"})
+
+	info, err := luks2.ReadHeader(path, luks2.LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(info.Metadata.Tokens, HasLen, 1)
+}
+
+func (s *luks2Suite) TestRenameLUKS2ContainerKeyNotFound(c *C) {
+	path := s.newContainer(c, s.newPrimaryKey())
+	c.Check(RenameLUKS2ContainerKey(path, "foo", "bar"), Equals, ErrLUKS2KeyslotNotFound)
+}
+
+func (s *luks2Suite) TestRenameLUKS2ContainerKeyNameExists(c *C) {
+	key := s.newPrimaryKey()
+	path := s.newContainer(c, key)
+	c.Assert(AddLUKS2ContainerUnlockKey(path, "foo", key, s.newPrimaryKey()), IsNil)
+
+	c.Check(RenameLUKS2ContainerKey(path, "default", "foo"), ErrorMatches, "a keyslot with the name \"foo\" already exists")
+}
+
+func (s *luks2Suite) TestDeleteLUKS2ContainerKey(c *C) {
+	key := s.newPrimaryKey()
+	path := s.newContainer(c, key)
+
+	newKey := s.newPrimaryKey()
+	c.Assert(AddLUKS2ContainerUnlockKey(path, "foo", key, newKey), IsNil)
+
+	c.Check(DeleteLUKS2ContainerKey(path, "default", newKey), IsNil)
+
+	names, err := ListLUKS2ContainerKeyNames(path)
+	c.Check(err, IsNil)
+	c.Check(names, DeepEquals, []string{"foo"})
+
+	info, err := luks2.ReadHeader(path, luks2.LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(info.Metadata.Keyslots, HasLen, 1)
+	c.Check(info.Metadata.Tokens, HasLen, 1)
+}
+
+func (s *luks2Suite) TestDeleteLUKS2ContainerKeyNotFound(c *C) {
+	key := s.newPrimaryKey()
+	path := s.newContainer(c, key)
+	c.Check(DeleteLUKS2ContainerKey(path, "foo", key), Equals, ErrLUKS2KeyslotNotFound)
+}
+
+func (s *luks2Suite) TestSetCryptsetupBackendExec(c *C) {
+	c.Check(SetCryptsetupBackend(CryptsetupBackendExec), IsNil)
+}
+
+func (s *luks2Suite) TestSetCryptsetupBackendInvalid(c *C) {
+	c.Check(SetCryptsetupBackend(CryptsetupBackend(10)), ErrorMatches, "invalid backend")
+}
@@ -0,0 +1,104 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plainkey
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
+)
+
+// NewProtectedKey creates a new key that is protected by this platform with the
+// supplied protector key. The disk unlock key is derived from the supplied primary
+// key (see secboot.MakeDiskUnlockKey), so that volumes protected by this platform
+// can share a primary key with the primary data volume. If no primary key is
+// supplied, a new one is created using the supplied random source. The disk unlock
+// key and the primary key are encrypted with a key derived from the protector key.
+//
+// The protector key is typically the primary key of the primary data volume, so that
+// secondary volumes can be unlocked once the primary data volume has been unlocked
+// (see SetProtectorKeysFromKernel).
+//
+// The returned disk unlock key should be added to the encrypted container with
+// secboot.AddLUKS2ContainerUnlockKey or secboot.InitializeLUKS2Container.
+func NewProtectedKey(rand io.Reader, protectorKey []byte, primaryKey secboot.PrimaryKey) (protectedKey *secboot.KeyData, primaryKeyOut secboot.PrimaryKey, unlockKey secboot.DiskUnlockKey, err error) {
+	if len(protectorKey) == 0 {
+		return nil, nil, nil, errors.New("no protector key supplied")
+	}
+
+	if len(primaryKey) == 0 {
+		primaryKey = make(secboot.PrimaryKey, 32)
+		if _, err := io.ReadFull(rand, primaryKey); err != nil {
+			return nil, nil, nil, xerrors.Errorf("cannot create primary key: %w", err)
+		}
+	}
+
+	_, unlockKey, err = secboot.MakeDiskUnlockKey(rand, crypto.SHA256, primaryKey)
+	if err != nil {
+		return nil, nil, nil, xerrors.Errorf("cannot create unlock key: %w", err)
+	}
+
+	kd := keyData{
+		Version: currentVersion,
+		Salt:    make([]byte, saltLen),
+		Nonce:   make([]byte, nonceLen)}
+	if _, err := io.ReadFull(rand, kd.Salt); err != nil {
+		return nil, nil, nil, xerrors.Errorf("cannot create salt: %w", err)
+	}
+	if _, err := io.ReadFull(rand, kd.Nonce); err != nil {
+		return nil, nil, nil, xerrors.Errorf("cannot create nonce: %w", err)
+	}
+
+	symKey, keyID, err := deriveKeys(protectorKey, kd.Salt)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	kd.ProtectorKeyID = keyID
+
+	aead, err := newAEAD(symKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	handle, err := json.Marshal(&kd)
+	if err != nil {
+		return nil, nil, nil, xerrors.Errorf("cannot encode key data: %w", err)
+	}
+
+	payload := secboot.MarshalKeys(unlockKey, secboot.AuxiliaryKey(primaryKey))
+
+	protectedKey, err = secboot.NewKeyData(&secboot.KeyCreationData{
+		PlatformKeyData: secboot.PlatformKeyData{
+			Handle:           handle,
+			EncryptedPayload: aead.Seal(nil, kd.Nonce, payload, additionalData(kd.Version))},
+		PlatformName:      platformName,
+		AuxiliaryKey:      secboot.AuxiliaryKey(primaryKey),
+		SnapModelAuthHash: crypto.SHA256})
+	if err != nil {
+		return nil, nil, nil, xerrors.Errorf("cannot create key data: %w", err)
+	}
+
+	return protectedKey, primaryKey, unlockKey, nil
+}
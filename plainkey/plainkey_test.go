@@ -0,0 +1,163 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plainkey_test
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/xerrors"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/keyring"
+	"github.com/snapcore/secboot/internal/testutil"
+	. "github.com/snapcore/secboot/plainkey"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type plainkeySuite struct{}
+
+var _ = Suite(&plainkeySuite{})
+
+func (s *plainkeySuite) TearDownTest(c *C) {
+	SetProtectorKeys()
+}
+
+func (s *plainkeySuite) newProtectorKey(c *C) []byte {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	c.Assert(err, IsNil)
+	return key
+}
+
+func (s *plainkeySuite) TestNewProtectedKeyAndRecover(c *C) {
+	protectorKey := s.newProtectorKey(c)
+
+	keyData, primaryKey, unlockKey, err := NewProtectedKey(rand.Reader, protectorKey, nil)
+	c.Assert(err, IsNil)
+	c.Check(primaryKey, HasLen, 32)
+	c.Check(unlockKey, HasLen, 32)
+	c.Check(keyData.AuthMode(), Equals, secboot.AuthModeNone)
+
+	SetProtectorKeys(s.newProtectorKey(c), protectorKey)
+
+	recoveredKey, recoveredAuxKey, err := keyData.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, unlockKey)
+	c.Check(recoveredAuxKey, DeepEquals, secboot.AuxiliaryKey(primaryKey))
+}
+
+func (s *plainkeySuite) TestNewProtectedKeyWithPrimaryKey(c *C) {
+	protectorKey := s.newProtectorKey(c)
+	primaryKey := secboot.PrimaryKey(s.newProtectorKey(c))
+
+	keyData, primaryKeyOut, unlockKey, err := NewProtectedKey(rand.Reader, protectorKey, primaryKey)
+	c.Assert(err, IsNil)
+	c.Check(primaryKeyOut, DeepEquals, primaryKey)
+
+	SetProtectorKeys(protectorKey)
+
+	recoveredKey, recoveredAuxKey, err := keyData.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, unlockKey)
+	c.Check(recoveredAuxKey, DeepEquals, secboot.AuxiliaryKey(primaryKey))
+}
+
+func (s *plainkeySuite) TestNewProtectedKeyDifferentKeys(c *C) {
+	protectorKey := s.newProtectorKey(c)
+
+	keyData1, primaryKey, unlockKey1, err := NewProtectedKey(rand.Reader, protectorKey, nil)
+	c.Assert(err, IsNil)
+	keyData2, _, unlockKey2, err := NewProtectedKey(rand.Reader, protectorKey, primaryKey)
+	c.Assert(err, IsNil)
+	c.Check(unlockKey1, Not(DeepEquals), unlockKey2)
+
+	SetProtectorKeys(protectorKey)
+
+	recoveredKey, _, err := keyData1.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, unlockKey1)
+
+	recoveredKey, _, err = keyData2.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, unlockKey2)
+}
+
+func (s *plainkeySuite) TestNewProtectedKeyNoProtectorKey(c *C) {
+	_, _, _, err := NewProtectedKey(rand.Reader, nil, nil)
+	c.Check(err, ErrorMatches, "no protector key supplied")
+}
+
+func (s *plainkeySuite) TestRecoverKeysNoProtectorKey(c *C) {
+	keyData, _, _, err := NewProtectedKey(rand.Reader, s.newProtectorKey(c), nil)
+	c.Assert(err, IsNil)
+
+	SetProtectorKeys(s.newProtectorKey(c))
+
+	_, _, err = keyData.RecoverKeys()
+	c.Check(err, ErrorMatches, "the platform's secure device is unavailable: "+
+		"no appropriate protector key is available")
+	var e *secboot.PlatformDeviceUnavailableError
+	c.Check(xerrors.As(err, &e), testutil.IsTrue)
+	c.Check(xerrors.Is(err, ErrNoProtectorKey), testutil.IsTrue)
+}
+
+type plainkeyKeyringSuite struct {
+	testutil.KeyringTestBase
+}
+
+var _ = Suite(&plainkeyKeyringSuite{})
+
+func (s *plainkeyKeyringSuite) SetUpSuite(c *C) {
+	s.KeyringTestBase.SetUpSuite(c)
+
+	if !s.ProcessPossessesUserKeyringKeys {
+		c.Skip("Test requires the user keyring to be linked from the process's session keyring")
+	}
+}
+
+func (s *plainkeyKeyringSuite) TearDownTest(c *C) {
+	SetProtectorKeys()
+	s.KeyringTestBase.TearDownTest(c)
+}
+
+func (s *plainkeyKeyringSuite) TestSetProtectorKeysFromKernel(c *C) {
+	protectorKey := make([]byte, 32)
+	_, err := rand.Read(protectorKey)
+	c.Assert(err, IsNil)
+	c.Check(keyring.AddKeyToUserKeyring(protectorKey, "/dev/sda1", "aux", "ubuntu-fde"), IsNil)
+
+	keyData, _, unlockKey, err := NewProtectedKey(rand.Reader, protectorKey, nil)
+	c.Assert(err, IsNil)
+
+	c.Check(SetProtectorKeysFromKernel("", "/dev/sda1"), IsNil)
+
+	recoveredKey, _, err := keyData.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, unlockKey)
+}
+
+func (s *plainkeyKeyringSuite) TestSetProtectorKeysFromKernelNotFound(c *C) {
+	c.Check(SetProtectorKeysFromKernel("foo", "/dev/sda1"), ErrorMatches,
+		"cannot obtain protector key for /dev/sda1: cannot find key in kernel keyring")
+}
@@ -0,0 +1,194 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plainkey
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
+)
+
+const (
+	platformName = "plainkey"
+
+	currentVersion = 1
+
+	// symKeyLen is the length of the AES-256 key derived from a protector key.
+	symKeyLen = 32
+
+	// keyIDLen is the length of the identifier derived from a protector key.
+	keyIDLen = 32
+
+	saltLen  = 32
+	nonceLen = 12
+)
+
+var (
+	// ErrNoProtectorKey is returned from the platform handler when none of the
+	// keys supplied to SetProtectorKeys or SetProtectorKeysFromKernel can be
+	// used to recover a key.
+	ErrNoProtectorKey = errors.New("no appropriate protector key is available")
+
+	protectorKeys [][]byte
+)
+
+// keyData is the platform specific handle for keys protected by this platform.
+type keyData struct {
+	Version        int    `json:"version"`
+	Salt           []byte `json:"salt"`
+	Nonce          []byte `json:"nonce"`
+	ProtectorKeyID []byte `json:"protector-key-id"`
+}
+
+// deriveKeys derives the symmetric key used to protect a payload and the
+// identifier used to select the correct protector key from the supplied
+// protector key and salt.
+func deriveKeys(protectorKey, salt []byte) (symKey, keyID []byte, err error) {
+	r := hkdf.New(sha256.New, protectorKey, salt, []byte("ENCRYPT"))
+	symKey = make([]byte, symKeyLen)
+	if _, err := io.ReadFull(r, symKey); err != nil {
+		return nil, nil, xerrors.Errorf("cannot derive symmetric key: %w", err)
+	}
+
+	r = hkdf.New(sha256.New, protectorKey, salt, []byte("ID"))
+	keyID = make([]byte, keyIDLen)
+	if _, err := io.ReadFull(r, keyID); err != nil {
+		return nil, nil, xerrors.Errorf("cannot derive key ID: %w", err)
+	}
+
+	return symKey, keyID, nil
+}
+
+func newAEAD(symKey []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(symKey)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create cipher: %w", err)
+	}
+	return cipher.NewGCM(b)
+}
+
+func additionalData(version int) []byte {
+	return []byte(fmt.Sprintf("%s-%d", platformName, version))
+}
+
+// SetProtectorKeys sets the keys that will be used to recover keys that are
+// protected by this platform. It replaces any previously set keys.
+func SetProtectorKeys(keys ...[]byte) {
+	protectorKeys = keys
+}
+
+// SetProtectorKeysFromKernel sets the keys that will be used to recover keys
+// that are protected by this platform from the primary keys associated with
+// the encrypted containers at the specified paths, which are stored in the kernel
+// keyring as auxiliary keys (see secboot.GetAuxiliaryKeyFromKernel). These containers must
+// already have been unlocked with one of the secboot.ActivateVolumeWithKeyData
+// functions, and the value of prefix must match the prefix that was supplied
+// via secboot.ActivateVolumeOptions during unlocking.
+//
+// This is used to unlock secondary volumes with keys that are protected by the
+// key that unlocked the primary data volume. It replaces any previously set keys.
+func SetProtectorKeysFromKernel(prefix string, devicePaths ...string) error {
+	var keys [][]byte
+	for _, path := range devicePaths {
+		key, err := secboot.GetAuxiliaryKeyFromKernel(prefix, path, false)
+		if err != nil {
+			return xerrors.Errorf("cannot obtain protector key for %s: %w", path, err)
+		}
+		keys = append(keys, key)
+	}
+
+	SetProtectorKeys(keys...)
+	return nil
+}
+
+func getProtectorKey(salt, keyID []byte) (symKey []byte, err error) {
+	for _, key := range protectorKeys {
+		symKey, id, err := deriveKeys(key, salt)
+		if err != nil {
+			return nil, err
+		}
+		if hmac.Equal(id, keyID) {
+			return symKey, nil
+		}
+	}
+
+	return nil, ErrNoProtectorKey
+}
+
+type platformKeyDataHandler struct{}
+
+func (*platformKeyDataHandler) RecoverKeys(data *secboot.PlatformKeyData) (secboot.KeyPayload, error) {
+	var kd keyData
+	if err := json.NewDecoder(bytes.NewReader(data.Handle)).Decode(&kd); err != nil {
+		return nil, &secboot.PlatformKeyRecoveryError{
+			Type: secboot.PlatformKeyRecoveryErrorInvalidData,
+			Err:  xerrors.Errorf("cannot decode key data: %w", err)}
+	}
+
+	if kd.Version != currentVersion {
+		return nil, &secboot.PlatformKeyRecoveryError{
+			Type: secboot.PlatformKeyRecoveryErrorInvalidData,
+			Err:  fmt.Errorf("invalid version (%d)", kd.Version)}
+	}
+	if len(kd.Nonce) != nonceLen {
+		return nil, &secboot.PlatformKeyRecoveryError{
+			Type: secboot.PlatformKeyRecoveryErrorInvalidData,
+			Err:  fmt.Errorf("invalid nonce length (%d)", len(kd.Nonce))}
+	}
+
+	symKey, err := getProtectorKey(kd.Salt, kd.ProtectorKeyID)
+	switch {
+	case err == ErrNoProtectorKey:
+		return nil, &secboot.PlatformKeyRecoveryError{
+			Type: secboot.PlatformKeyRecoveryErrorUnavailable,
+			Err:  err}
+	case err != nil:
+		return nil, err
+	}
+
+	aead, err := newAEAD(symKey)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := aead.Open(nil, kd.Nonce, data.EncryptedPayload, additionalData(kd.Version))
+	if err != nil {
+		return nil, &secboot.PlatformKeyRecoveryError{
+			Type: secboot.PlatformKeyRecoveryErrorInvalidData,
+			Err:  xerrors.Errorf("cannot open payload: %w", err)}
+	}
+
+	return payload, nil
+}
+
+func init() {
+	secboot.RegisterPlatformKeyDataHandler(platformName, &platformKeyDataHandler{})
+}
@@ -19,6 +19,16 @@
 
 package secboot
 
+import (
+	"errors"
+)
+
+// ErrPlatformVersionUnsupported is returned from any of the KeyData.RecoverKeys*
+// functions if there are handlers registered for the platform associated with the
+// key data, but none of them support the platform version that the key data was
+// created with.
+var ErrPlatformVersionUnsupported = errors.New("cannot recover key because the registered platform handlers are too old for it")
+
 // PlatformKeyRecoveryErrorType describes the type of error returned from one of
 // the PlatformKeyDataHandler.RecoverKeys* functions.
 type PlatformKeyRecoveryErrorType int
@@ -63,6 +73,13 @@ type PlatformKeyData struct {
 	// on the requirements of the implementation.
 	Handle []byte
 
+	// Version is the version of the platform's key data format. When
+	// recovering keys, it is taken from the unprotected key metadata, so
+	// a platform implementation that supports more than one version should
+	// verify that it is consistent with the authenticated contents of Handle
+	// or EncryptedPayload in order to protect against downgrade attacks.
+	Version int
+
 	EncryptedPayload []byte // The encrypted payload
 }
 
@@ -91,9 +108,60 @@ type PlatformKeyDataHandler interface {
 	// ChangeAuthValue(data *PlatformKeyData, oldAuthValue, newAuthValue []byte) (*PlatformKeyData, error)
 }
 
-var handlers = make(map[string]PlatformKeyDataHandler)
+var handlers = make(map[string]map[int]PlatformKeyDataHandler)
 
 // RegisterPlatformKeyDataHandler registers a handler for the specified platform name.
+// This is equivalent to calling RegisterPlatformKeyDataHandlerVersion with a version of
+// zero.
 func RegisterPlatformKeyDataHandler(name string, handler PlatformKeyDataHandler) {
-	handlers[name] = handler
+	RegisterPlatformKeyDataHandlerVersion(name, 0, handler)
+}
+
+// RegisterPlatformKeyDataHandlerVersion registers a handler for the specified platform
+// name and version. A handler is expected to be able to recover keys from key data
+// created with its own version or any earlier version. More than one version of a
+// handler can be registered for the same platform, in which case the newest handler
+// that supports the version of the key data is selected when recovering keys.
+//
+// Passing a nil handler unregisters the handler for the specified platform name and
+// version.
+func RegisterPlatformKeyDataHandlerVersion(name string, version int, handler PlatformKeyDataHandler) {
+	if handler == nil {
+		delete(handlers[name], version)
+		if len(handlers[name]) == 0 {
+			delete(handlers, name)
+		}
+		return
+	}
+
+	if handlers[name] == nil {
+		handlers[name] = make(map[int]PlatformKeyDataHandler)
+	}
+	handlers[name][version] = handler
+}
+
+// selectPlatformKeyDataHandler returns the newest handler registered for the specified
+// platform name that supports key data with the specified version. Handlers older than
+// the key data are never selected, so that key data created by a newer platform version
+// is not misinterpreted by an older one.
+func selectPlatformKeyDataHandler(name string, version int) (PlatformKeyDataHandler, error) {
+	versions := handlers[name]
+	if len(versions) == 0 {
+		return nil, ErrNoPlatformHandlerRegistered
+	}
+
+	var handler PlatformKeyDataHandler
+	selected := -1
+	for v, h := range versions {
+		if v < version || v <= selected {
+			continue
+		}
+		handler = h
+		selected = v
+	}
+	if handler == nil {
+		return nil, ErrPlatformVersionUnsupported
+	}
+
+	return handler, nil
 }
@@ -0,0 +1,117 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/ecdsautil"
+)
+
+// The labels used to derive keys from a PrimaryKey. These form part of the
+// on-disk format and must not be changed.
+const (
+	// unlockKeyLabel is the HKDF info used to derive a DiskUnlockKey from a
+	// PrimaryKey and a per-volume unique value, which is used as the salt.
+	unlockKeyLabel = "UNLOCK"
+
+	// authKeyLabel is the HKDF info used to derive the key that authorizes
+	// updates to a platform's protection policy from a PrimaryKey.
+	authKeyLabel = "POLICY-AUTH"
+)
+
+// PrimaryKey is a per-install key from which the keys for each volume and the
+// key used to authorize updates to a platform's protection policy are derived.
+// It allows multiple volumes and multiple protectors to share a single secret
+// that is created at enrolment time.
+//
+// When a KeyData is created for a key derived from a PrimaryKey, the PrimaryKey
+// should be supplied as the auxiliary key (see KeyCreationData). It is then
+// protected along with the disk unlock key, and can be retrieved with
+// GetAuxiliaryKeyFromKernel once the volume is unlocked.
+type PrimaryKey []byte
+
+// DeriveDiskUnlockKey derives the disk unlock key for a volume from the supplied
+// primary key and the unique value associated with the volume, using HKDF with
+// the supplied digest algorithm. The returned key has the same length as the
+// primary key.
+func DeriveDiskUnlockKey(alg crypto.Hash, primaryKey PrimaryKey, unique []byte) (DiskUnlockKey, error) {
+	if !alg.Available() {
+		return nil, errors.New("digest algorithm unavailable")
+	}
+	if len(primaryKey) == 0 {
+		return nil, errors.New("no primary key supplied")
+	}
+
+	r := hkdf.New(alg.New, primaryKey, unique, []byte(unlockKeyLabel))
+	unlockKey := make(DiskUnlockKey, len(primaryKey))
+	if _, err := io.ReadFull(r, unlockKey); err != nil {
+		return nil, xerrors.Errorf("cannot derive key: %w", err)
+	}
+
+	return unlockKey, nil
+}
+
+// MakeDiskUnlockKey creates a new unique value for a volume using the supplied
+// random source, and derives a disk unlock key for it from the supplied primary
+// key (see DeriveDiskUnlockKey). Each volume should have its own unique value so
+// that each one has a different disk unlock key.
+func MakeDiskUnlockKey(rand io.Reader, alg crypto.Hash, primaryKey PrimaryKey) (unique []byte, unlockKey DiskUnlockKey, err error) {
+	unique = make([]byte, len(primaryKey))
+	if _, err := io.ReadFull(rand, unique); err != nil {
+		return nil, nil, xerrors.Errorf("cannot make unique ID: %w", err)
+	}
+
+	unlockKey, err = DeriveDiskUnlockKey(alg, primaryKey, unique)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot derive disk unlock key: %w", err)
+	}
+
+	return unique, unlockKey, nil
+}
+
+// DeriveAuthKey derives the elliptic P-256 key used to authorize updates to a
+// platform's protection policy from the supplied primary key, using HKDF with
+// the supplied digest algorithm. The same primary key always produces the same
+// key, so protectors for every volume can share it.
+func DeriveAuthKey(alg crypto.Hash, primaryKey PrimaryKey) (*ecdsa.PrivateKey, error) {
+	if !alg.Available() {
+		return nil, errors.New("digest algorithm unavailable")
+	}
+	if len(primaryKey) == 0 {
+		return nil, errors.New("no primary key supplied")
+	}
+
+	// Compute the private scalar using the method described in FIPS 186-4
+	// appendix B.4.1, with the extra random bits obtained from HKDF.
+	r := hkdf.Expand(alg.New, primaryKey, []byte(authKeyLabel))
+	key, err := ecdsautil.GenerateKeyFromReader(elliptic.P256(), r)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot derive key: %w", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,120 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+type primaryKeySuite struct{}
+
+var _ = Suite(&primaryKeySuite{})
+
+func (s *primaryKeySuite) TestDeriveDiskUnlockKey(c *C) {
+	primaryKey := testutil.DecodeHexString(c, "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	unique := testutil.DecodeHexString(c, "202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f")
+
+	unlockKey, err := DeriveDiskUnlockKey(crypto.SHA256, primaryKey, unique)
+	c.Check(err, IsNil)
+	c.Check(unlockKey, DeepEquals, DiskUnlockKey(testutil.DecodeHexString(c, "6bf966e55db5c56e78ca8ee044cf1239f404fec8af462ce8caba76b482b64da3")))
+}
+
+func (s *primaryKeySuite) TestDeriveDiskUnlockKeyNoPrimaryKey(c *C) {
+	_, err := DeriveDiskUnlockKey(crypto.SHA256, nil, []byte("foo"))
+	c.Check(err, ErrorMatches, "no primary key supplied")
+}
+
+func (s *primaryKeySuite) TestMakeDiskUnlockKey(c *C) {
+	primaryKey := make(PrimaryKey, 32)
+	_, err := rand.Read(primaryKey)
+	c.Assert(err, IsNil)
+
+	unique1, unlockKey1, err := MakeDiskUnlockKey(rand.Reader, crypto.SHA256, primaryKey)
+	c.Assert(err, IsNil)
+	c.Check(unique1, HasLen, 32)
+	c.Check(unlockKey1, HasLen, 32)
+
+	unique2, unlockKey2, err := MakeDiskUnlockKey(rand.Reader, crypto.SHA256, primaryKey)
+	c.Assert(err, IsNil)
+
+	// Each volume gets a different key from the same primary key.
+	c.Check(unique1, Not(DeepEquals), unique2)
+	c.Check(unlockKey1, Not(DeepEquals), unlockKey2)
+
+	unlockKey, err := DeriveDiskUnlockKey(crypto.SHA256, primaryKey, unique1)
+	c.Check(err, IsNil)
+	c.Check(unlockKey, DeepEquals, unlockKey1)
+}
+
+func (s *primaryKeySuite) TestMakeDiskUnlockKeyDeterministic(c *C) {
+	primaryKey := testutil.DecodeHexString(c, "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	unique := testutil.DecodeHexString(c, "202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f")
+
+	uniqueOut, unlockKey, err := MakeDiskUnlockKey(bytes.NewReader(unique), crypto.SHA256, primaryKey)
+	c.Check(err, IsNil)
+	c.Check(uniqueOut, DeepEquals, unique)
+	c.Check(unlockKey, DeepEquals, DiskUnlockKey(testutil.DecodeHexString(c, "6bf966e55db5c56e78ca8ee044cf1239f404fec8af462ce8caba76b482b64da3")))
+}
+
+func (s *primaryKeySuite) TestDeriveAuthKey(c *C) {
+	primaryKey := make(PrimaryKey, 32)
+	_, err := rand.Read(primaryKey)
+	c.Assert(err, IsNil)
+
+	key1, err := DeriveAuthKey(crypto.SHA256, primaryKey)
+	c.Assert(err, IsNil)
+	c.Check(key1.Curve, Equals, elliptic.P256())
+	c.Check(key1.Curve.IsOnCurve(key1.X, key1.Y), Equals, true)
+
+	// The same primary key produces the same auth key.
+	key2, err := DeriveAuthKey(crypto.SHA256, primaryKey)
+	c.Assert(err, IsNil)
+	c.Check(key2.D, DeepEquals, key1.D)
+
+	digest := sha256.Sum256([]byte("foo"))
+	r, s2, err := ecdsa.Sign(rand.Reader, key1, digest[:])
+	c.Assert(err, IsNil)
+	c.Check(ecdsa.Verify(&key2.PublicKey, digest[:], r, s2), Equals, true)
+}
+
+func (s *primaryKeySuite) TestDeriveAuthKeyDifferentPrimaryKeys(c *C) {
+	primaryKey1 := make(PrimaryKey, 32)
+	_, err := rand.Read(primaryKey1)
+	c.Assert(err, IsNil)
+	primaryKey2 := make(PrimaryKey, 32)
+	_, err = rand.Read(primaryKey2)
+	c.Assert(err, IsNil)
+
+	key1, err := DeriveAuthKey(crypto.SHA256, primaryKey1)
+	c.Assert(err, IsNil)
+	key2, err := DeriveAuthKey(crypto.SHA256, primaryKey2)
+	c.Assert(err, IsNil)
+	c.Check(key1.D, Not(DeepEquals), key2.D)
+}
@@ -0,0 +1,178 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// recoveryKeyURIPrefix is the prefix of the URI encoding of a recovery key. It is
+	// upper case so that QR code encoders can use the alphanumeric mode for the whole
+	// payload.
+	recoveryKeyURIPrefix = "SECBOOT:RK1:"
+
+	// recoveryKeyWordPrefixLen is the number of characters that uniquely identifies
+	// each word in recoveryKeyWords.
+	recoveryKeyWordPrefixLen = 4
+)
+
+var recoveryKeyURIEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// recoveryKeyWordIndices maps the unique prefix of each word in recoveryKeyWords to
+// its index.
+var recoveryKeyWordIndices = func() map[string]byte {
+	m := make(map[string]byte)
+	for i, w := range recoveryKeyWords {
+		m[w[:recoveryKeyWordPrefixLen]] = byte(i)
+	}
+	return m
+}()
+
+// checksum returns a single byte checksum of this recovery key, used to detect
+// transcription errors in its encoded forms.
+func (k RecoveryKey) checksum() byte {
+	h := sha256.Sum256(k[:])
+	return h[0]
+}
+
+// URI returns a compact encoding of this recovery key that is suitable for rendering
+// as a QR code. It consists of the prefix "SECBOOT:RK1:" followed by the base32
+// encoding of the key and a checksum byte, and only uses characters from the QR code
+// alphanumeric character set. It can be decoded with ParseRecoveryKeyURI.
+func (k RecoveryKey) URI() string {
+	payload := make([]byte, 0, len(k)+1)
+	payload = append(payload, k[:]...)
+	payload = append(payload, k.checksum())
+	return recoveryKeyURIPrefix + recoveryKeyURIEncoding.EncodeToString(payload)
+}
+
+// ParseRecoveryKeyURI decodes a recovery key from the encoding returned by
+// RecoveryKey.URI. The comparison of the prefix and the decoding of the payload are
+// case insensitive.
+func ParseRecoveryKeyURI(s string) (out RecoveryKey, err error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if !strings.HasPrefix(s, recoveryKeyURIPrefix) {
+		return RecoveryKey{}, errors.New("incorrectly formatted: invalid prefix")
+	}
+
+	payload, err := recoveryKeyURIEncoding.DecodeString(s[len(recoveryKeyURIPrefix):])
+	if err != nil {
+		return RecoveryKey{}, xerrors.Errorf("incorrectly formatted: %w", err)
+	}
+	if len(payload) != len(out)+1 {
+		return RecoveryKey{}, fmt.Errorf("incorrectly formatted: invalid payload length (%d bytes)", len(payload))
+	}
+
+	copy(out[:], payload)
+	if out.checksum() != payload[len(out)] {
+		return RecoveryKey{}, errors.New("invalid checksum")
+	}
+	return out, nil
+}
+
+// Mnemonic returns an encoding of this recovery key as a list of 17 words separated
+// by spaces, which is intended to be easier to write down and re-enter correctly than
+// the numeric form. Each word encodes one byte of the key, and the final word encodes
+// a checksum. It can be decoded with ParseRecoveryKeyMnemonic.
+func (k RecoveryKey) Mnemonic() string {
+	words := make([]string, 0, len(k)+1)
+	for _, b := range k {
+		words = append(words, recoveryKeyWords[b])
+	}
+	words = append(words, recoveryKeyWords[k.checksum()])
+	return strings.Join(words, " ")
+}
+
+// ParseRecoveryKeyMnemonic decodes a recovery key from the encoding returned by
+// RecoveryKey.Mnemonic. The words may be separated by any combination of whitespace
+// and '-' characters, and are case insensitive. As the first 4 letters of each word
+// are unique, words may be abbreviated to these.
+func ParseRecoveryKeyMnemonic(s string) (out RecoveryKey, err error) {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return unicode.IsSpace(r) || r == '-'
+	})
+	if len(words) != len(out)+1 {
+		return RecoveryKey{}, fmt.Errorf("incorrectly formatted: expected %d words (got %d)", len(out)+1, len(words))
+	}
+
+	decoded := make([]byte, 0, len(words))
+	for _, w := range words {
+		if len(w) < recoveryKeyWordPrefixLen {
+			return RecoveryKey{}, fmt.Errorf("incorrectly formatted: invalid word %q", w)
+		}
+		b, ok := recoveryKeyWordIndices[w[:recoveryKeyWordPrefixLen]]
+		if !ok || !strings.HasPrefix(recoveryKeyWords[b], w) {
+			return RecoveryKey{}, fmt.Errorf("incorrectly formatted: invalid word %q", w)
+		}
+		decoded = append(decoded, b)
+	}
+
+	copy(out[:], decoded)
+	if out.checksum() != decoded[len(out)] {
+		return RecoveryKey{}, errors.New("invalid checksum")
+	}
+	return out, nil
+}
+
+// recoveryKeyWords is the list of words used by RecoveryKey.Mnemonic. Each word
+// encodes a single byte, and the first 4 letters of each word are unique. This list
+// must not be changed, as that would prevent existing mnemonics from being decoded.
+var recoveryKeyWords = [256]string{
+	"acorn", "actor", "album", "alley", "amber", "angle", "ankle", "apple",
+	"apron", "arena", "armor", "arrow", "atlas", "audio", "autumn", "award",
+	"bacon", "badge", "bagel", "baker", "bamboo", "banana", "banjo", "barrel",
+	"basket", "beach", "beaver", "bench", "berry", "boat", "bottle", "bounce",
+	"bread", "brick", "bridge", "broom", "bubble", "bucket", "bundle", "butter",
+	"cabin", "cactus", "camel", "canal", "candle", "canoe", "canvas", "carbon",
+	"carpet", "castle", "cattle", "cedar", "cellar", "cement", "chair", "chalk",
+	"cherry", "chess", "citrus", "cliff", "clock", "cloud", "coast", "coffee",
+	"comet", "copper", "coral", "cotton", "couch", "cousin", "coyote", "crab",
+	"crane", "crayon", "crown", "daisy", "dance", "deer", "denim", "desert",
+	"dinner", "doctor", "domino", "donkey", "dragon", "drum", "duck", "dune",
+	"eagle", "earth", "echo", "ember", "engine", "eraser", "fabric", "falcon",
+	"family", "farmer", "fence", "ferry", "field", "finger", "flame", "flask",
+	"flower", "flute", "forest", "fossil", "frog", "frost", "fruit", "galaxy",
+	"garden", "garlic", "gate", "gecko", "giant", "ginger", "glove", "goat",
+	"gold", "grape", "guitar", "hammer", "harbor", "hazel", "helmet", "hill",
+	"hockey", "honey", "hotel", "husky", "igloo", "insect", "island", "ivory",
+	"jacket", "jaguar", "jelly", "jewel", "jigsaw", "juice", "jungle", "kayak",
+	"kettle", "kitten", "koala", "ladder", "lagoon", "lamp", "laptop", "lemon",
+	"letter", "lilac", "lime", "lizard", "lumber", "magnet", "mango", "maple",
+	"marble", "meadow", "melon", "mirror", "monkey", "moose", "mosaic", "muffin",
+	"museum", "napkin", "nectar", "needle", "nest", "noodle", "novel", "oasis",
+	"ocean", "olive", "onion", "orange", "orbit", "orchid", "otter", "oven",
+	"oyster", "paddle", "palace", "panda", "paper", "parrot", "pasta", "peach",
+	"pencil", "pepper", "piano", "pickle", "pigeon", "pillow", "pilot", "planet",
+	"plum", "pocket", "polar", "pony", "potato", "puzzle", "quartz", "quilt",
+	"rabbit", "radar", "radio", "raven", "ribbon", "river", "robot", "rocket",
+	"rubber", "saddle", "salmon", "sandal", "saturn", "scarf", "shadow", "shark",
+	"shovel", "silver", "skate", "sketch", "snail", "socket", "sofa", "spider",
+	"spoon", "squid", "stamp", "statue", "summer", "sunset", "swan", "table",
+	"tiger", "toast", "tomato", "tunnel", "turtle", "valley", "velvet", "violin",
+	"wagon", "walnut", "whale", "window", "winter", "wizard", "yacht", "zebra",
+}
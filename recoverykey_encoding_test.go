@@ -0,0 +1,113 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+)
+
+type recoveryKeyEncodingSuite struct {
+	cryptTestBase
+}
+
+var _ = Suite(&recoveryKeyEncodingSuite{})
+
+func (s *recoveryKeyEncodingSuite) TestURI(c *C) {
+	var k RecoveryKey
+	copy(k[:], testutil.DecodeHexString(c, "e1f01302c5d43726a9b85b4a8d9c7f6b"))
+	c.Check(k.URI(), Equals, "SECBOOT:RK1:4HYBGAWF2Q3SNKNYLNFI3HD7NPNA")
+}
+
+func (s *recoveryKeyEncodingSuite) TestParseRecoveryKeyURI(c *C) {
+	k, err := ParseRecoveryKeyURI("SECBOOT:RK1:4HYBGAWF2Q3SNKNYLNFI3HD7NPNA")
+	c.Check(err, IsNil)
+	c.Check(k[:], DeepEquals, testutil.DecodeHexString(c, "e1f01302c5d43726a9b85b4a8d9c7f6b"))
+}
+
+func (s *recoveryKeyEncodingSuite) TestParseRecoveryKeyURILowerCase(c *C) {
+	k, err := ParseRecoveryKeyURI("secboot:rk1:4hybgawf2q3snknylnfi3hd7npna\n")
+	c.Check(err, IsNil)
+	c.Check(k[:], DeepEquals, testutil.DecodeHexString(c, "e1f01302c5d43726a9b85b4a8d9c7f6b"))
+}
+
+func (s *recoveryKeyEncodingSuite) TestURIRoundTrip(c *C) {
+	k := s.newRecoveryKey()
+	k2, err := ParseRecoveryKeyURI(k.URI())
+	c.Check(err, IsNil)
+	c.Check(k2, Equals, k)
+}
+
+func (s *recoveryKeyEncodingSuite) TestParseRecoveryKeyURIInvalidPrefix(c *C) {
+	_, err := ParseRecoveryKeyURI("SECBOOT:RK2:4HYBGAWF2Q3SNKNYLNFI3HD7NPNA")
+	c.Check(err, ErrorMatches, "incorrectly formatted: invalid prefix")
+}
+
+func (s *recoveryKeyEncodingSuite) TestParseRecoveryKeyURIInvalidLength(c *C) {
+	_, err := ParseRecoveryKeyURI("SECBOOT:RK1:4HYBGAWF2Q3SNKNYLNFI3HD7")
+	c.Check(err, ErrorMatches, "incorrectly formatted: invalid payload length \\(15 bytes\\)")
+}
+
+func (s *recoveryKeyEncodingSuite) TestParseRecoveryKeyURIInvalidChecksum(c *C) {
+	_, err := ParseRecoveryKeyURI("SECBOOT:RK1:4HYBGAWF2Q3SNKNYLNFI3HD7NPNQ")
+	c.Check(err, ErrorMatches, "invalid checksum")
+}
+
+func (s *recoveryKeyEncodingSuite) TestMnemonic(c *C) {
+	var k RecoveryKey
+	copy(k[:], testutil.DecodeHexString(c, "e1f01302c5d43726a9b85b4a8d9c7f6b"))
+	c.Check(k.Mnemonic(), Equals, "silver tiger baker album pillow ribbon chalk bundle napkin oyster ember crown juice lumber hill fossil salmon")
+}
+
+func (s *recoveryKeyEncodingSuite) TestParseRecoveryKeyMnemonic(c *C) {
+	k, err := ParseRecoveryKeyMnemonic("silver tiger baker album pillow ribbon chalk bundle napkin oyster ember crown juice lumber hill fossil salmon")
+	c.Check(err, IsNil)
+	c.Check(k[:], DeepEquals, testutil.DecodeHexString(c, "e1f01302c5d43726a9b85b4a8d9c7f6b"))
+}
+
+func (s *recoveryKeyEncodingSuite) TestParseRecoveryKeyMnemonicAbbreviated(c *C) {
+	k, err := ParseRecoveryKeyMnemonic("SILV-tige-bake-albu-pill-ribb-chal-bund-napk-oyst-embe-crow-juic-lumb-hill-foss-salmo")
+	c.Check(err, IsNil)
+	c.Check(k[:], DeepEquals, testutil.DecodeHexString(c, "e1f01302c5d43726a9b85b4a8d9c7f6b"))
+}
+
+func (s *recoveryKeyEncodingSuite) TestMnemonicRoundTrip(c *C) {
+	k := s.newRecoveryKey()
+	k2, err := ParseRecoveryKeyMnemonic(k.Mnemonic())
+	c.Check(err, IsNil)
+	c.Check(k2, Equals, k)
+}
+
+func (s *recoveryKeyEncodingSuite) TestParseRecoveryKeyMnemonicWrongNumberOfWords(c *C) {
+	_, err := ParseRecoveryKeyMnemonic("silver tiger baker")
+	c.Check(err, ErrorMatches, "incorrectly formatted: expected 17 words \\(got 3\\)")
+}
+
+func (s *recoveryKeyEncodingSuite) TestParseRecoveryKeyMnemonicInvalidWord(c *C) {
+	_, err := ParseRecoveryKeyMnemonic("silver tiger baker album pillow ribbon chalk bundle napkin oyster ember crown juice lumber hill fossil salami")
+	c.Check(err, ErrorMatches, "incorrectly formatted: invalid word \"salami\"")
+}
+
+func (s *recoveryKeyEncodingSuite) TestParseRecoveryKeyMnemonicInvalidChecksum(c *C) {
+	_, err := ParseRecoveryKeyMnemonic("silver tiger baker album pillow ribbon chalk bundle napkin oyster ember crown juice lumber hill fossil acorn")
+	c.Check(err, ErrorMatches, "invalid checksum")
+}
@@ -0,0 +1,154 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/canonical/go-tpm2"
+
+	secboot_efi "github.com/snapcore/secboot/efi"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+// imageLoadEventConfig describes a secboot_efi.ImageLoadEvent.
+type imageLoadEventConfig struct {
+	// Source is the source of the event, either "firmware" or "shim".
+	Source string `json:"source"`
+
+	// Image is the path of the image, relative to the root of the source tree.
+	Image string `json:"image"`
+
+	// Next describes the images that can be loaded by this image.
+	Next []*imageLoadEventConfig `json:"next,omitempty"`
+}
+
+func (c *imageLoadEventConfig) toImageLoadEvent() (*secboot_efi.ImageLoadEvent, error) {
+	var source secboot_efi.ImageLoadEventSource
+	switch c.Source {
+	case "firmware":
+		source = secboot_efi.Firmware
+	case "shim":
+		source = secboot_efi.Shim
+	default:
+		return nil, fmt.Errorf("invalid image load event source \"%s\"", c.Source)
+	}
+
+	event := &secboot_efi.ImageLoadEvent{
+		Source: source,
+		Image:  secboot_efi.FileImage(c.Image)}
+	for _, n := range c.Next {
+		next, err := n.toImageLoadEvent()
+		if err != nil {
+			return nil, err
+		}
+		event.Next = append(event.Next, next)
+	}
+	return event, nil
+}
+
+// config describes the compatibility test data to generate.
+type config struct {
+	// PCRAlgorithm is the PCR bank used for the PCR profile, eg, "sha256" or "sha384".
+	PCRAlgorithm string `json:"pcr-algorithm"`
+
+	// EFIVars is the path of the directory containing the mock EFI variables.
+	EFIVars string `json:"efivars"`
+
+	// EventLog is the path of the mock TCG event log.
+	EventLog string `json:"eventlog"`
+
+	// LoadSequences describes the secure boot policy profile.
+	LoadSequences []*imageLoadEventConfig `json:"load-sequences"`
+
+	// KernelCmdlines are the kernel command lines used for the systemd EFI stub profile.
+	KernelCmdlines []string `json:"kernel-cmdlines"`
+
+	// SnapModelPCR is the PCR used for the systemd EFI stub and snap model profiles.
+	SnapModelPCR int `json:"snap-model-pcr"`
+
+	// Models are the paths of the model assertions used for the snap model profile.
+	Models []string `json:"models"`
+
+	// PCRPolicyCounterHandle is the handle of the PCR policy counter, eg, "0x01801000".
+	// If empty, the key is created without a PCR policy counter.
+	PCRPolicyCounterHandle string `json:"pcr-policy-counter-handle"`
+
+	// LockoutAuth is the authorization value for the lockout hierarchy set during
+	// provisioning.
+	LockoutAuth string `json:"lockout-auth"`
+}
+
+var hashAlgorithms = map[string]tpm2.HashAlgorithmId{
+	"sha1":   tpm2.HashAlgorithmSHA1,
+	"sha256": tpm2.HashAlgorithmSHA256,
+	"sha384": tpm2.HashAlgorithmSHA384,
+	"sha512": tpm2.HashAlgorithmSHA512}
+
+func (c *config) pcrAlgorithm() (tpm2.HashAlgorithmId, error) {
+	alg, ok := hashAlgorithms[strings.ToLower(c.PCRAlgorithm)]
+	if !ok {
+		return tpm2.HashAlgorithmNull, fmt.Errorf("invalid PCR algorithm \"%s\"", c.PCRAlgorithm)
+	}
+	return alg, nil
+}
+
+func (c *config) loadSequences() (out []*secboot_efi.ImageLoadEvent, err error) {
+	for _, s := range c.LoadSequences {
+		event, err := s.toImageLoadEvent()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, event)
+	}
+	return out, nil
+}
+
+func (c *config) pcrPolicyCounterHandle() (tpm2.Handle, error) {
+	if c.PCRPolicyCounterHandle == "" {
+		return secboot_tpm2.NoPCRPolicyCounterHandle, nil
+	}
+	h, err := strconv.ParseUint(c.PCRPolicyCounterHandle, 0, 32)
+	if err != nil {
+		return tpm2.HandleNull, fmt.Errorf("invalid PCR policy counter handle: %v", err)
+	}
+	return tpm2.Handle(h), nil
+}
+
+// readConfig reads the configuration from the JSON file at the specified path.
+func readConfig(path string) (*config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var c config
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
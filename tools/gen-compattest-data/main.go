@@ -24,13 +24,13 @@ import (
 	"crypto/x509"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	mathrand "math/rand"
 	"os"
 	"path/filepath"
 
-	"github.com/canonical/go-efilib"
 	"github.com/canonical/go-tpm2"
-	"github.com/canonical/tcglog-parser"
 	"github.com/snapcore/snapd/asserts"
 
 	"golang.org/x/xerrors"
@@ -39,59 +39,38 @@ import (
 	secboot_efi "github.com/snapcore/secboot/efi"
 	"github.com/snapcore/secboot/internal/testutil"
 	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+	tpm2test "github.com/snapcore/secboot/tpm2/test"
 )
 
 var (
-	outputDir string
+	configPath string
+	outputDir  string
+	seed       int64
 )
 
-type mockEFIEnvironment struct {
-	efivars string
-	log     string
+func init() {
+	flag.StringVar(&configPath, "config", "tools/gen-compattest-data/data/default.json", "Specify the JSON file that describes the data to generate")
+	flag.StringVar(&outputDir, "output", "", "Specify the output directory")
+	flag.Int64Var(&seed, "seed", 0, "Seed the source of randomness used to generate keys, for reproducible output")
 }
 
-func (e *mockEFIEnvironment) ReadVar(name string, guid efi.GUID) ([]byte, efi.VariableAttributes, error) {
-	return testutil.EFIReadVar(e.efivars, name, guid)
-}
+func computePCRProtectionProfile(config *config, env secboot_efi.HostEnvironment) (*secboot_tpm2.PCRProtectionProfile, error) {
+	profile := secboot_tpm2.NewPCRProtectionProfile()
 
-func (e *mockEFIEnvironment) ReadEventLog() (*tcglog.Log, error) {
-	f, err := os.Open(e.log)
+	pcrAlg, err := config.pcrAlgorithm()
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-
-	return tcglog.ReadLog(f, &tcglog.LogOptions{})
-}
-
-func init() {
-	flag.StringVar(&outputDir, "output", "", "Specify the output directory")
-}
 
-func computePCRProtectionProfile(env secboot_efi.HostEnvironment) (*secboot_tpm2.PCRProtectionProfile, error) {
-	profile := secboot_tpm2.NewPCRProtectionProfile()
+	loadSequences, err := config.loadSequences()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot decode load sequences: %w", err)
+	}
 
 	sbpParams := secboot_efi.SecureBootPolicyProfileParams{
-		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
-		LoadSequences: []*secboot_efi.ImageLoadEvent{
-			{
-				Source: secboot_efi.Firmware,
-				Image:  secboot_efi.FileImage("efi/testdata/mockshim1.efi.signed.1"),
-				Next: []*secboot_efi.ImageLoadEvent{
-					{
-						Source: secboot_efi.Shim,
-						Image:  secboot_efi.FileImage("efi/testdata/mockgrub1.efi.signed.shim"),
-						Next: []*secboot_efi.ImageLoadEvent{
-							{
-								Source: secboot_efi.Shim,
-								Image:  secboot_efi.FileImage("efi/testdata/mockkernel1.efi.signed.shim"),
-							},
-						},
-					},
-				},
-			},
-		},
-		Environment: env,
+		PCRAlgorithm:  pcrAlg,
+		LoadSequences: loadSequences,
+		Environment:   env,
 	}
 
 	if err := secboot_efi.AddSecureBootPolicyProfile(profile, &sbpParams); err != nil {
@@ -99,32 +78,33 @@ func computePCRProtectionProfile(env secboot_efi.HostEnvironment) (*secboot_tpm2
 	}
 
 	sdefisParams := secboot_efi.SystemdStubProfileParams{
-		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
-		PCRIndex:     12,
-		KernelCmdlines: []string{
-			"snapd_recovery_mode=run quiet console=tty1 panic=-1",
-			"snapd_recovery_mode=recover quiet console=tty1 panic=-1",
-		},
+		PCRAlgorithm:   pcrAlg,
+		PCRIndex:       config.SnapModelPCR,
+		KernelCmdlines: config.KernelCmdlines,
 	}
 
 	if err := secboot_efi.AddSystemdStubProfile(profile, &sdefisParams); err != nil {
 		return nil, xerrors.Errorf("cannot add systemd EFI stub profile: %w", err)
 	}
 
-	modelData, err := ioutil.ReadFile("tools/gen-compattest-data/data/fake-model")
-	if err != nil {
-		return nil, xerrors.Errorf("cannot read model assertion: %w", err)
-	}
+	var models []secboot.SnapModel
+	for _, path := range config.Models {
+		modelData, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read model assertion: %w", err)
+		}
 
-	model, err := asserts.Decode(modelData)
-	if err != nil {
-		return nil, xerrors.Errorf("cannot decode model assertion: %w", err)
+		model, err := asserts.Decode(modelData)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot decode model assertion: %w", err)
+		}
+		models = append(models, model.(secboot.SnapModel))
 	}
 
 	smParams := secboot_tpm2.SnapModelProfileParams{
-		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
-		PCRIndex:     12,
-		Models:       []secboot.SnapModel{model.(secboot.SnapModel)},
+		PCRAlgorithm: pcrAlg,
+		PCRIndex:     config.SnapModelPCR,
+		Models:       models,
 	}
 
 	if err := secboot_tpm2.AddSnapModelProfile(profile, &smParams); err != nil {
@@ -135,6 +115,18 @@ func computePCRProtectionProfile(env secboot_efi.HostEnvironment) (*secboot_tpm2
 }
 
 func run() int {
+	config, err := readConfig(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot read config: %v\n", err)
+		return 1
+	}
+
+	pcrPolicyCounterHandle, err := config.pcrPolicyCounterHandle()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config: %v\n", err)
+		return 1
+	}
+
 	if outputDir != "" {
 		if err := os.MkdirAll(outputDir, 0755); err != nil {
 			fmt.Fprintf(os.Stderr, "Cannot create output directory: %v\n", err)
@@ -154,7 +146,7 @@ func run() int {
 	})
 	defer restore()
 
-	env := &mockEFIEnvironment{"efi/testdata/efivars2", "efi/testdata/eventlog1.bin"}
+	env := &tpm2test.MockEFIEnvironment{EFIVarsDir: config.EFIVars, EventLogPath: config.EventLog}
 
 	tpm, err := secboot_tpm2.ConnectToDefaultTPM()
 	if err != nil {
@@ -191,23 +183,32 @@ func run() int {
 		return 1
 	}
 
-	if err := tpm.EnsureProvisioned(secboot_tpm2.ProvisionModeFull, []byte("1234")); err != nil {
+	if err := tpm.EnsureProvisioned(secboot_tpm2.ProvisionModeFull, []byte(config.LockoutAuth)); err != nil {
 		fmt.Fprintf(os.Stderr, "Cannot provision TPM: %v\n", err)
 		return 1
 	}
 
-	pcrProfile, err := computePCRProtectionProfile(env)
+	pcrProfile, err := computePCRProtectionProfile(config, env)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Cannot compute PCR profile: %v\n", err)
 		return 1
 	}
 
+	var rng io.Reader = rand.Reader
+	if seed != 0 {
+		rng = mathrand.New(mathrand.NewSource(seed))
+	}
+
 	key := make([]byte, 64)
-	rand.Read(key)
+	if _, err := io.ReadFull(rng, key); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot create key: %v\n", err)
+		return 1
+	}
 
 	params := secboot_tpm2.KeyCreationParams{
 		PCRProfile:             pcrProfile,
-		PCRPolicyCounterHandle: 0x01801000,
+		PCRPolicyCounterHandle: pcrPolicyCounterHandle,
+		Rand:                   rng,
 	}
 
 	keyFile := filepath.Join(outputDir, "key")
@@ -231,34 +232,26 @@ func run() int {
 
 	// Write out PCR event sequences corresponding to the generated profile.
 	// The form is 'PCR Alg Digest'
-	// XXX(chrisccoulson): It would be nice to implement a way to autogenerate these
-	pcrEvents1 := `7 11 ccfc4bb32888a345bc8aeadaba552b627d99348c767681ab3141f5b01e40a40e
-7 11 9af72c68c7de19603879020c14f88c2bfa8d06503153866b9888c48d0c5d2a58
-7 11 b56d4033d9002a59221d3776ab2557fd4ce17c5367943716669118734be66319
-7 11 700e8fb6c9772fad3333dc0e8a654fdde7485de844940cced27c80881cbc3fff
-7 11 1963d580fcc0cede165e23837b55335eebe18750c0b795883386026ea071e3c6
-7 11 df3f619804a92fdb4057192dc43dd748ea778adc52bc498ce80524c014b81119
-7 11 ef6179fc571480150176c28cdea83156d83e44897464c483149a945f5160800e
-7 11 6f39dc51f71a13c734c69cb783a3563ceb5f2da7f6dec1ca1018308b8d9f500e
-12 11 94ae5f11b45bbf919fd1bf52db3e625fb576d21af7150f9bb36b7fe65834ef1a
-12 11 df3f619804a92fdb4057192dc43dd748ea778adc52bc498ce80524c014b81119
-12 11 d64df514d7ac57c1a28c5f2a3abc39340d9b7fe3f76cc3acc991d418f095d5b0
-`
-	pcrEvents2 := `7 11 ccfc4bb32888a345bc8aeadaba552b627d99348c767681ab3141f5b01e40a40e
-7 11 9af72c68c7de19603879020c14f88c2bfa8d06503153866b9888c48d0c5d2a58
-7 11 b56d4033d9002a59221d3776ab2557fd4ce17c5367943716669118734be66319
-7 11 700e8fb6c9772fad3333dc0e8a654fdde7485de844940cced27c80881cbc3fff
-7 11 1963d580fcc0cede165e23837b55335eebe18750c0b795883386026ea071e3c6
-7 11 df3f619804a92fdb4057192dc43dd748ea778adc52bc498ce80524c014b81119
-7 11 ef6179fc571480150176c28cdea83156d83e44897464c483149a945f5160800e
-7 11 6f39dc51f71a13c734c69cb783a3563ceb5f2da7f6dec1ca1018308b8d9f500e
-12 11 7598387669ac1cbad0ea568d9675d8e3a71870a53554bbbe92a6f4d9a8133944
-12 11 df3f619804a92fdb4057192dc43dd748ea778adc52bc498ce80524c014b81119
-12 11 d64df514d7ac57c1a28c5f2a3abc39340d9b7fe3f76cc3acc991d418f095d5b0
-`
-
-	for i, seq := range []string{pcrEvents1, pcrEvents2} {
-		if err := ioutil.WriteFile(filepath.Join(outputDir, fmt.Sprintf("pcrSequence.%d", i+1)), []byte(seq), 0644); err != nil {
+	seqs, err := pcrProfile.ComputePCRExtendSequences()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot compute PCR event sequences: %v\n", err)
+		return 1
+	}
+	var written []string
+Loop:
+	for _, seq := range seqs {
+		var data string
+		for _, e := range seq {
+			data += fmt.Sprintf("%d %d %x\n", e.PCR, e.Alg, e.Digest)
+		}
+		for _, w := range written {
+			if w == data {
+				// Branches that produce the same event sequence only need to be tested once.
+				continue Loop
+			}
+		}
+		written = append(written, data)
+		if err := ioutil.WriteFile(filepath.Join(outputDir, fmt.Sprintf("pcrSequence.%d", len(written))), []byte(data), 0644); err != nil {
 			fmt.Fprintf(os.Stderr, "Cannot write PCR event sequence: %v\n", err)
 			return 1
 		}
@@ -139,6 +139,20 @@ func newGlobalVar(name string, attrs efi.VariableAttributes, payload efiVarPaylo
 		payload}
 }
 
+type shimVar struct {
+	*efiVarHdr
+	efiVarPayload
+}
+
+func newShimVar(name string, payload efiVarPayload) *shimVar {
+	return &shimVar{
+		&efiVarHdr{
+			n: name,
+			g: efi.MakeGUID(0x605dab50, 0xe046, 0x4300, 0xabb6, [...]uint8{0x3d, 0xd8, 0x10, 0xdd, 0x8b, 0x23}),
+			a: efi.AttributeBootserviceAccess | efi.AttributeRuntimeAccess},
+		payload}
+}
+
 type efiVar interface {
 	name() string
 	guid() efi.GUID
@@ -311,6 +325,74 @@ func newEfiVarData(srcDir string) ([]efiVarData, error) {
 				newDbVar("dbx", sigDb{devNullSha256Esl{}}),
 			},
 		},
+		{
+			name: "efivars_mock1_plus_mok",
+			vars: []efiVar{
+				newGlobalVar("SecureBoot", efi.AttributeBootserviceAccess|efi.AttributeRuntimeAccess, bytesPayload([]byte{0x01})),
+				newGlobalVar("PK", efi.AttributeNonVolatile|efi.AttributeBootserviceAccess|efi.AttributeRuntimeAccess|efi.AttributeTimeBasedAuthenticatedWriteAccess,
+					&x509Esl{
+						cert:  certs["PkKek-1-Ubuntu"],
+						owner: efi.MakeGUID(0x4e32566d, 0x8e9e, 0x4f52, 0x81d3, [...]uint8{0x5b, 0xb9, 0x71, 0x5f, 0x97, 0x27}),
+					}),
+				newGlobalVar("KEK", efi.AttributeNonVolatile|efi.AttributeBootserviceAccess|efi.AttributeRuntimeAccess|efi.AttributeTimeBasedAuthenticatedWriteAccess,
+					sigDb{
+						&x509Esl{
+							cert:  certs["TestKek1.1"],
+							owner: efi.MakeGUID(0x03f66fa4, 0x5eee, 0x479c, 0xa408, [...]uint8{0xc4, 0xdc, 0x0a, 0x33, 0xfc, 0xde}),
+						},
+					}),
+				newDbVar("db", sigDb{
+					&x509Esl{
+						cert:  certs["TestUefiCA1.1"],
+						owner: efi.MakeGUID(0x03f66fa4, 0x5eee, 0x479c, 0xa408, [...]uint8{0xc4, 0xdc, 0x0a, 0x33, 0xfc, 0xde}),
+					},
+				}),
+				newDbVar("dbx", sigDb{devNullSha256Esl{}}),
+				newShimVar("MokListRT", sigDb{
+					&x509Esl{
+						cert:  certs["TestShimVendorCA"],
+						owner: efi.MakeGUID(0x605dab50, 0xe046, 0x4300, 0xabb6, [...]uint8{0x3d, 0xd8, 0x10, 0xdd, 0x8b, 0x23}),
+					},
+				}),
+			},
+		},
+		{
+			name: "efivars_mock1_plus_mok_and_moklistx",
+			vars: []efiVar{
+				newGlobalVar("SecureBoot", efi.AttributeBootserviceAccess|efi.AttributeRuntimeAccess, bytesPayload([]byte{0x01})),
+				newGlobalVar("PK", efi.AttributeNonVolatile|efi.AttributeBootserviceAccess|efi.AttributeRuntimeAccess|efi.AttributeTimeBasedAuthenticatedWriteAccess,
+					&x509Esl{
+						cert:  certs["PkKek-1-Ubuntu"],
+						owner: efi.MakeGUID(0x4e32566d, 0x8e9e, 0x4f52, 0x81d3, [...]uint8{0x5b, 0xb9, 0x71, 0x5f, 0x97, 0x27}),
+					}),
+				newGlobalVar("KEK", efi.AttributeNonVolatile|efi.AttributeBootserviceAccess|efi.AttributeRuntimeAccess|efi.AttributeTimeBasedAuthenticatedWriteAccess,
+					sigDb{
+						&x509Esl{
+							cert:  certs["TestKek1.1"],
+							owner: efi.MakeGUID(0x03f66fa4, 0x5eee, 0x479c, 0xa408, [...]uint8{0xc4, 0xdc, 0x0a, 0x33, 0xfc, 0xde}),
+						},
+					}),
+				newDbVar("db", sigDb{
+					&x509Esl{
+						cert:  certs["TestUefiCA1.1"],
+						owner: efi.MakeGUID(0x03f66fa4, 0x5eee, 0x479c, 0xa408, [...]uint8{0xc4, 0xdc, 0x0a, 0x33, 0xfc, 0xde}),
+					},
+				}),
+				newDbVar("dbx", sigDb{devNullSha256Esl{}}),
+				newShimVar("MokListRT", sigDb{
+					&x509Esl{
+						cert:  certs["TestShimVendorCA"],
+						owner: efi.MakeGUID(0x605dab50, 0xe046, 0x4300, 0xabb6, [...]uint8{0x3d, 0xd8, 0x10, 0xdd, 0x8b, 0x23}),
+					},
+				}),
+				newShimVar("MokListXRT", sigDb{
+					&x509Esl{
+						cert:  certs["TestShimVendorCA"],
+						owner: efi.MakeGUID(0x605dab50, 0xe046, 0x4300, 0xabb6, [...]uint8{0x3d, 0xd8, 0x10, 0xdd, 0x8b, 0x23}),
+					},
+				}),
+			},
+		},
 		{
 			name: "efivars_ms_plus_mock1",
 			vars: []efiVar{
@@ -0,0 +1,275 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// ApprovedPCRValues is a set of PCR composites (golden values) that are approved by a policy
+// server, for use with NewPCRProtectionProfileFromApprovedPCRValues.
+type ApprovedPCRValues struct {
+	// Algorithm is the PCR bank that the values correspond to.
+	Algorithm tpm2.HashAlgorithmId
+
+	// Composites is a list of approved PCR composites, each of which maps a PCR index to
+	// its expected value. A PCR policy computed from these values is satisfied if the
+	// PCR values match any one of the composites. Every composite must select the same
+	// set of PCRs.
+	Composites []map[int]tpm2.Digest
+}
+
+// approvedPCRValuesPayload is the JSON representation of ApprovedPCRValues.
+type approvedPCRValuesPayload struct {
+	Algorithm  string              `json:"algorithm"`
+	Composites []map[string]string `json:"composites"`
+}
+
+// signedApprovedPCRValues is the JSON representation of a signed ApprovedPCRValues document.
+// The signature is computed over the SHA-256 digest of the payload, which is the encoded
+// approvedPCRValuesPayload.
+type signedApprovedPCRValues struct {
+	Payload   []byte `json:"payload"`
+	Signature []byte `json:"signature"`
+}
+
+var approvedPCRAlgorithms = map[string]tpm2.HashAlgorithmId{
+	"sha1":   tpm2.HashAlgorithmSHA1,
+	"sha256": tpm2.HashAlgorithmSHA256,
+	"sha384": tpm2.HashAlgorithmSHA384,
+	"sha512": tpm2.HashAlgorithmSHA512,
+}
+
+func approvedPCRAlgorithmName(alg tpm2.HashAlgorithmId) (string, error) {
+	for name, a := range approvedPCRAlgorithms {
+		if a == alg {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported algorithm %v", alg)
+}
+
+func (v *ApprovedPCRValues) check() error {
+	if len(v.Composites) == 0 {
+		return errors.New("no composites")
+	}
+	for i, composite := range v.Composites {
+		if len(composite) == 0 {
+			return fmt.Errorf("composite %d is empty", i)
+		}
+		if len(composite) != len(v.Composites[0]) {
+			return fmt.Errorf("composite %d selects different PCRs to composite 0", i)
+		}
+		for pcr, value := range composite {
+			if pcr < 0 || pcr > 23 {
+				return fmt.Errorf("composite %d has invalid PCR %d", i, pcr)
+			}
+			if len(value) != v.Algorithm.Size() {
+				return fmt.Errorf("composite %d has invalid value length for PCR %d", i, pcr)
+			}
+			if _, ok := v.Composites[0][pcr]; !ok {
+				return fmt.Errorf("composite %d selects different PCRs to composite 0", i)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *approvedPCRValuesPayload) decode() (*ApprovedPCRValues, error) {
+	alg, ok := approvedPCRAlgorithms[p.Algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q", p.Algorithm)
+	}
+
+	values := &ApprovedPCRValues{Algorithm: alg}
+	for i, c := range p.Composites {
+		composite := make(map[int]tpm2.Digest)
+		for k, v := range c {
+			pcr, err := strconv.Atoi(k)
+			if err != nil {
+				return nil, fmt.Errorf("composite %d has invalid PCR %q", i, k)
+			}
+			value, err := hex.DecodeString(v)
+			if err != nil {
+				return nil, xerrors.Errorf("composite %d has invalid value for PCR %d: %w", i, pcr, err)
+			}
+			composite[pcr] = value
+		}
+		values.Composites = append(values.Composites, composite)
+	}
+
+	if err := values.check(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+func verifyApprovedPCRValuesSignature(key crypto.PublicKey, digest, signature []byte) error {
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		var sig ecdsaSignature
+		rest, err := asn1.Unmarshal(signature, &sig)
+		if err != nil || len(rest) > 0 || sig.R == nil || sig.S == nil {
+			return errors.New("invalid signature")
+		}
+		if !ecdsa.Verify(k, digest, sig.R, sig.S) {
+			return errors.New("invalid signature")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPSS(k, crypto.SHA256, digest, signature, nil); err != nil {
+			return errors.New("invalid signature")
+		}
+	default:
+		return errors.New("unsupported key type")
+	}
+	return nil
+}
+
+// ReadSignedApprovedPCRValues decodes a signed document containing approved PCR values, as
+// delivered by a fleet policy server, and verifies its signature with the supplied public key.
+// The document is a JSON object with the following fields:
+//   - "payload": the base64 encoded payload.
+//   - "signature": the base64 encoded signature of the SHA-256 digest of the payload. This is
+//     a RSA-PSS signature for RSA keys, or an ASN.1 encoded ECDSA signature for ECDSA keys.
+//
+// The payload is a JSON object with the following fields:
+//   - "algorithm": the PCR bank, eg, "sha256".
+//   - "composites": a list of objects that map a PCR index to its hex encoded expected value.
+//
+// Supported keys are *rsa.PublicKey and *ecdsa.PublicKey.
+func ReadSignedApprovedPCRValues(document []byte, key crypto.PublicKey) (*ApprovedPCRValues, error) {
+	var signed signedApprovedPCRValues
+	if err := json.Unmarshal(document, &signed); err != nil {
+		return nil, xerrors.Errorf("cannot decode document: %w", err)
+	}
+
+	h := crypto.SHA256.New()
+	h.Write(signed.Payload)
+	if err := verifyApprovedPCRValuesSignature(key, h.Sum(nil), signed.Signature); err != nil {
+		return nil, xerrors.Errorf("cannot verify signature: %w", err)
+	}
+
+	var payload approvedPCRValuesPayload
+	if err := json.Unmarshal(signed.Payload, &payload); err != nil {
+		return nil, xerrors.Errorf("cannot decode payload: %w", err)
+	}
+
+	values, err := payload.decode()
+	if err != nil {
+		return nil, xerrors.Errorf("invalid payload: %w", err)
+	}
+	return values, nil
+}
+
+// Sign encodes these approved PCR values and signs them with the supplied key, producing a
+// document in the format accepted by ReadSignedApprovedPCRValues. This is intended to be used
+// by policy servers and for testing.
+func (v *ApprovedPCRValues) Sign(signer crypto.Signer) ([]byte, error) {
+	if err := v.check(); err != nil {
+		return nil, xerrors.Errorf("invalid values: %w", err)
+	}
+
+	alg, err := approvedPCRAlgorithmName(v.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := approvedPCRValuesPayload{Algorithm: alg}
+	for _, c := range v.Composites {
+		composite := make(map[string]string)
+		for pcr, value := range c {
+			composite[strconv.Itoa(pcr)] = hex.EncodeToString(value)
+		}
+		payload.Composites = append(payload.Composites, composite)
+	}
+
+	signed := signedApprovedPCRValues{}
+	signed.Payload, err = json.Marshal(&payload)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot encode payload: %w", err)
+	}
+
+	h := crypto.SHA256.New()
+	h.Write(signed.Payload)
+
+	var opts crypto.SignerOpts = crypto.SHA256
+	if _, ok := signer.Public().(*rsa.PublicKey); ok {
+		opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+	}
+	signed.Signature, err = signer.Sign(rand.Reader, h.Sum(nil), opts)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot sign payload: %w", err)
+	}
+
+	return json.Marshal(&signed)
+}
+
+// PCRProtectionProfile returns a PCRProtectionProfile that is satisfied by any of the approved
+// PCR composites.
+func (v *ApprovedPCRValues) PCRProtectionProfile() *PCRProtectionProfile {
+	var profiles []*PCRProtectionProfile
+	for _, composite := range v.Composites {
+		var pcrs []int
+		for pcr := range composite {
+			pcrs = append(pcrs, pcr)
+		}
+		sort.Ints(pcrs)
+
+		profile := NewPCRProtectionProfile()
+		for _, pcr := range pcrs {
+			profile.AddPCRValue(v.Algorithm, pcr, composite[pcr])
+		}
+		profiles = append(profiles, profile)
+	}
+
+	return NewPCRProtectionProfile().AddProfileOR(profiles...)
+}
+
+// NewPCRProtectionProfileFromApprovedPCRValues returns a PCRProtectionProfile from a signed
+// document containing approved PCR values delivered by a fleet policy server, after verifying
+// the signature of the document with the supplied public key. This allows PCR policies to be
+// managed centrally. See ReadSignedApprovedPCRValues for a description of the document format.
+func NewPCRProtectionProfileFromApprovedPCRValues(document []byte, key crypto.PublicKey) (*PCRProtectionProfile, error) {
+	values, err := ReadSignedApprovedPCRValues(document, key)
+	if err != nil {
+		return nil, err
+	}
+	return values.PCRProtectionProfile(), nil
+}
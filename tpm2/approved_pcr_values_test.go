@@ -0,0 +1,163 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+
+	"github.com/snapcore/secboot/internal/testutil"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+func newTestApprovedPCRValues(t *testing.T) *ApprovedPCRValues {
+	return &ApprovedPCRValues{
+		Algorithm: tpm2.HashAlgorithmSHA256,
+		Composites: []map[int]tpm2.Digest{
+			{
+				7:  testutil.DecodeHexStringT(t, "3d2c1f4a0e8c3cc2e1e2a5b4b1c9e4f2a5b6c7d8e9f0a1b2c3d4e5f6a7b8c9d0"),
+				12: testutil.DecodeHexStringT(t, "fc433eaf039c6261f496a2a5bf2addfd8ff1104b0fc98af3fe951517e3bde824"),
+			},
+			{
+				7:  testutil.DecodeHexStringT(t, "3d2c1f4a0e8c3cc2e1e2a5b4b1c9e4f2a5b6c7d8e9f0a1b2c3d4e5f6a7b8c9d0"),
+				12: testutil.DecodeHexStringT(t, "b3a29076eeeae197ae721c254da40480b76673038045305cfa78ec87421c4eea"),
+			},
+		}}
+}
+
+func TestSignedApprovedPCRValues(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	rsaKey, err := rsa.GenerateKey(testutil.RandReader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	for _, data := range []struct {
+		desc string
+		key  crypto.Signer
+	}{
+		{desc: "ECDSA", key: ecKey},
+		{desc: "RSA", key: rsaKey},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			values := newTestApprovedPCRValues(t)
+			document, err := values.Sign(data.key)
+			if err != nil {
+				t.Fatalf("Sign failed: %v", err)
+			}
+
+			read, err := ReadSignedApprovedPCRValues(document, data.key.Public())
+			if err != nil {
+				t.Fatalf("ReadSignedApprovedPCRValues failed: %v", err)
+			}
+			if !reflect.DeepEqual(read, values) {
+				t.Errorf("Unexpected values: %v", read)
+			}
+
+			profile, err := NewPCRProtectionProfileFromApprovedPCRValues(document, data.key.Public())
+			if err != nil {
+				t.Fatalf("NewPCRProtectionProfileFromApprovedPCRValues failed: %v", err)
+			}
+
+			expected := NewPCRProtectionProfile().AddProfileOR(
+				NewPCRProtectionProfile().
+					AddPCRValue(tpm2.HashAlgorithmSHA256, 7, values.Composites[0][7]).
+					AddPCRValue(tpm2.HashAlgorithmSHA256, 12, values.Composites[0][12]),
+				NewPCRProtectionProfile().
+					AddPCRValue(tpm2.HashAlgorithmSHA256, 7, values.Composites[1][7]).
+					AddPCRValue(tpm2.HashAlgorithmSHA256, 12, values.Composites[1][12]))
+
+			pcrs, digests, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+			if err != nil {
+				t.Fatalf("ComputePCRDigests failed: %v", err)
+			}
+			expectedPcrs, expectedDigests, err := expected.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+			if err != nil {
+				t.Fatalf("ComputePCRDigests failed: %v", err)
+			}
+			if !pcrs.Equal(expectedPcrs) {
+				t.Errorf("Unexpected PCR selection")
+			}
+			if !reflect.DeepEqual(digests, expectedDigests) {
+				t.Errorf("Unexpected PCR digests")
+			}
+		})
+	}
+}
+
+func TestSignedApprovedPCRValuesErrorHandling(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	document, err := newTestApprovedPCRValues(t).Sign(key)
+	if err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+
+	t.Run("WrongKey", func(t *testing.T) {
+		_, err := ReadSignedApprovedPCRValues(document, otherKey.Public())
+		if err == nil || err.Error() != "cannot verify signature: invalid signature" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ModifiedPayload", func(t *testing.T) {
+		var signed map[string][]byte
+		if err := json.Unmarshal(document, &signed); err != nil {
+			t.Fatalf("Unmarshal failed: %v", err)
+		}
+		signed["payload"] = []byte(`{"algorithm":"sha256","composites":[{"7":"00"}]}`)
+		modified, err := json.Marshal(signed)
+		if err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+
+		_, err = ReadSignedApprovedPCRValues(modified, key.Public())
+		if err == nil || err.Error() != "cannot verify signature: invalid signature" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("InvalidPayload", func(t *testing.T) {
+		values := &ApprovedPCRValues{
+			Algorithm:  tpm2.HashAlgorithmSHA256,
+			Composites: []map[int]tpm2.Digest{{7: make(tpm2.Digest, 32)}, {12: make(tpm2.Digest, 32)}}}
+		_, err := values.Sign(key)
+		if err == nil || err.Error() != "invalid values: composite 1 selects different PCRs to composite 0" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
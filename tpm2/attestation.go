@@ -0,0 +1,303 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/tcg"
+)
+
+// akTemplate is the template for attestation keys, which are restricted ECC NIST-P256 signing keys that use
+// ECDSA with SHA-256. This is based on the AK template in section 2.6.2 of "TCG TPM v2.0 Provisioning Guidance",
+// version 1.0, revision 1.0.
+var akTemplate = tpm2.Public{
+	Type:    tpm2.ObjectTypeECC,
+	NameAlg: tpm2.HashAlgorithmSHA256,
+	Attrs: tpm2.AttrFixedTPM | tpm2.AttrFixedParent | tpm2.AttrSensitiveDataOrigin | tpm2.AttrUserWithAuth | tpm2.AttrNoDA |
+		tpm2.AttrRestricted | tpm2.AttrSign,
+	Params: &tpm2.PublicParamsU{
+		ECCDetail: &tpm2.ECCParams{
+			Symmetric: tpm2.SymDefObject{Algorithm: tpm2.SymObjectAlgorithmNull},
+			Scheme: tpm2.ECCScheme{
+				Scheme:  tpm2.ECCSchemeECDSA,
+				Details: &tpm2.AsymSchemeU{ECDSA: &tpm2.SigSchemeECDSA{HashAlg: tpm2.HashAlgorithmSHA256}}},
+			CurveID: tpm2.ECCCurveNIST_P256,
+			KDF:     tpm2.KDFScheme{Scheme: tpm2.KDFAlgorithmNull}}},
+	Unique: &tpm2.PublicIDU{ECC: &tpm2.ECCPoint{X: make(tpm2.ECCParameter, 32), Y: make(tpm2.ECCParameter, 32)}}}
+
+// AttestationKey corresponds to an attestation key (AK) that is protected by a TPM's endorsement key. It can
+// be used to sign quotes of the TPM's PCR values. The public area should be registered with the party that
+// verifies the quotes.
+type AttestationKey struct {
+	Private tpm2.Private
+	Public  *tpm2.Public
+}
+
+// ReadAttestationKey reads an attestation key previously saved with AttestationKey.Write.
+func ReadAttestationKey(r io.Reader) (*AttestationKey, error) {
+	var k AttestationKey
+	if _, err := mu.UnmarshalFromReader(r, &k.Private, &k.Public); err != nil {
+		return nil, xerrors.Errorf("cannot unmarshal attestation key: %w", err)
+	}
+	return &k, nil
+}
+
+// Write serializes this attestation key to the supplied io.Writer.
+func (k *AttestationKey) Write(w io.Writer) error {
+	if _, err := mu.MarshalToWriter(w, k.Private, k.Public); err != nil {
+		return xerrors.Errorf("cannot marshal attestation key: %w", err)
+	}
+	return nil
+}
+
+// withEndorsementKey runs the supplied function with the endorsement key for the TPM. If there is no persistent
+// EK, a transient one is created. The supplied function is also passed a function that returns a new policy
+// session that satisfies the EK's authorization policy, which must be called for each use of the EK.
+func withEndorsementKey(tpm *Connection, fn func(ek tpm2.ResourceContext, ekSession func() (tpm2.SessionContext, error)) error) error {
+	ek, err := tpm.EndorsementKey()
+	if err != nil {
+		ek, err = createTransientEk(tpm.TPMContext)
+		if err != nil {
+			return xerrors.Errorf("cannot create endorsement key: %w", err)
+		}
+		defer tpm.FlushContext(ek)
+	}
+
+	var sessions []tpm2.SessionContext
+	defer func() {
+		for _, s := range sessions {
+			tpm.FlushContext(s)
+		}
+	}()
+
+	ekSession := func() (tpm2.SessionContext, error) {
+		session, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, tcg.EKTemplate.NameAlg)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot start policy session: %w", err)
+		}
+		sessions = append(sessions, session)
+
+		if _, _, err := tpm.PolicySecret(tpm.EndorsementHandleContext(), session, nil, nil, 0, nil); err != nil {
+			return nil, xerrors.Errorf("cannot execute PolicySecret assertion: %w", err)
+		}
+		return session, nil
+	}
+
+	return fn(ek, ekSession)
+}
+
+// load loads this attestation key in to the TPM. The caller is responsible for flushing it.
+func (k *AttestationKey) load(tpm *Connection, ek tpm2.ResourceContext, ekSession func() (tpm2.SessionContext, error)) (tpm2.ResourceContext, error) {
+	session, err := ekSession()
+	if err != nil {
+		return nil, err
+	}
+	ak, err := tpm.Load(ek, k.Private, k.Public, session)
+	if err != nil {
+		if tpm2.IsTPMParameterError(err, tpm2.AnyErrorCode, tpm2.CommandLoad, tpm2.AnyParameterIndex) {
+			return nil, errors.New("invalid attestation key for this TPM")
+		}
+		return nil, xerrors.Errorf("cannot load attestation key: %w", err)
+	}
+	return ak, nil
+}
+
+// CreateAttestationKey creates a new attestation key that is protected by the TPM's endorsement key. If there is
+// no persistent endorsement key, a transient one is created, which requires knowledge of the endorsement
+// hierarchy authorization value. This is also required to authorize use of the endorsement key.
+func CreateAttestationKey(tpm *Connection) (*AttestationKey, error) {
+	var k *AttestationKey
+	if err := withEndorsementKey(tpm, func(ek tpm2.ResourceContext, ekSession func() (tpm2.SessionContext, error)) error {
+		session, err := ekSession()
+		if err != nil {
+			return err
+		}
+		priv, pub, _, _, _, err := tpm.Create(ek, nil, &akTemplate, nil, nil, session)
+		if err != nil {
+			return xerrors.Errorf("cannot create object: %w", err)
+		}
+		k = &AttestationKey{Private: priv, Public: pub}
+		return nil
+	}); err != nil {
+		return nil, xerrors.Errorf("cannot create attestation key: %w", err)
+	}
+	return k, nil
+}
+
+// Quote contains a TPM2_Quote structure and its signature.
+type Quote struct {
+	Quoted    tpm2.AttestRaw
+	Signature *tpm2.Signature
+}
+
+// Quote uses this attestation key to produce a quote of the PCRs in the supplied selection. The supplied nonce
+// is included in the quote, and should be a fresh value obtained from the verifier in order to prevent replay.
+func (k *AttestationKey) Quote(tpm *Connection, pcrs tpm2.PCRSelectionList, nonce []byte) (*Quote, error) {
+	var quote *Quote
+	if err := withEndorsementKey(tpm, func(ek tpm2.ResourceContext, ekSession func() (tpm2.SessionContext, error)) error {
+		ak, err := k.load(tpm, ek, ekSession)
+		if err != nil {
+			return err
+		}
+		defer tpm.FlushContext(ak)
+
+		quoted, signature, err := tpm.Quote(ak, nonce, nil, pcrs, nil)
+		if err != nil {
+			return err
+		}
+		quote = &Quote{Quoted: quoted, Signature: signature}
+		return nil
+	}); err != nil {
+		return nil, xerrors.Errorf("cannot create quote: %w", err)
+	}
+	return quote, nil
+}
+
+// signatureHashAlg returns the digest algorithm associated with the supplied signature.
+func signatureHashAlg(signature *tpm2.Signature) (tpm2.HashAlgorithmId, error) {
+	switch signature.SigAlg {
+	case tpm2.SigSchemeAlgECDSA:
+		return signature.Signature.ECDSA.Hash, nil
+	case tpm2.SigSchemeAlgRSASSA:
+		return signature.Signature.RSASSA.Hash, nil
+	case tpm2.SigSchemeAlgRSAPSS:
+		return signature.Signature.RSAPSS.Hash, nil
+	default:
+		return tpm2.HashAlgorithmNull, fmt.Errorf("unsupported signature algorithm %v", signature.SigAlg)
+	}
+}
+
+// verifySignature verifies that the supplied signature was created by the key with the supplied public area.
+func verifySignature(public *tpm2.Public, data []byte, signature *tpm2.Signature) error {
+	hashAlg, err := signatureHashAlg(signature)
+	if err != nil {
+		return err
+	}
+	if !hashAlg.Available() {
+		return fmt.Errorf("unsupported signature digest algorithm %v", hashAlg)
+	}
+	h := hashAlg.NewHash()
+	h.Write(data)
+	digest := h.Sum(nil)
+
+	switch public.Type {
+	case tpm2.ObjectTypeECC:
+		if signature.SigAlg != tpm2.SigSchemeAlgECDSA {
+			return errors.New("signature algorithm doesn't match key")
+		}
+		var curve elliptic.Curve
+		switch public.Params.ECCDetail.CurveID {
+		case tpm2.ECCCurveNIST_P256:
+			curve = elliptic.P256()
+		case tpm2.ECCCurveNIST_P384:
+			curve = elliptic.P384()
+		case tpm2.ECCCurveNIST_P521:
+			curve = elliptic.P521()
+		default:
+			return errors.New("unsupported curve")
+		}
+		key := ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(public.Unique.ECC.X),
+			Y:     new(big.Int).SetBytes(public.Unique.ECC.Y)}
+		if !ecdsa.Verify(&key, digest, new(big.Int).SetBytes(signature.Signature.ECDSA.SignatureR),
+			new(big.Int).SetBytes(signature.Signature.ECDSA.SignatureS)) {
+			return errors.New("invalid signature")
+		}
+	case tpm2.ObjectTypeRSA:
+		exp := int(public.Params.RSADetail.Exponent)
+		if exp == 0 {
+			// The default exponent of 2^^16-1 is indicated by the value of 0 in the public area.
+			exp = 65537
+		}
+		key := rsa.PublicKey{N: new(big.Int).SetBytes(public.Unique.RSA), E: exp}
+		switch signature.SigAlg {
+		case tpm2.SigSchemeAlgRSASSA:
+			if err := rsa.VerifyPKCS1v15(&key, hashAlg.GetHash(), digest, signature.Signature.RSASSA.Sig); err != nil {
+				return errors.New("invalid signature")
+			}
+		case tpm2.SigSchemeAlgRSAPSS:
+			if err := rsa.VerifyPSS(&key, hashAlg.GetHash(), digest, signature.Signature.RSAPSS.Sig, nil); err != nil {
+				return errors.New("invalid signature")
+			}
+		default:
+			return errors.New("signature algorithm doesn't match key")
+		}
+	default:
+		return errors.New("unsupported key type")
+	}
+
+	return nil
+}
+
+// VerifyQuote verifies the supplied quote against the public area of the attestation key that was used to
+// create it. It checks that the quote has a valid signature, that it contains the supplied nonce, and that the
+// PCR values that were quoted are consistent with one of the branches of the supplied PCRProtectionProfile.
+//
+// This allows a remote verifier to check the boot state of a device using the same profiles that are used
+// to seal keys on it. The profile must not contain values that are read from a TPM.
+func VerifyQuote(akPublic *tpm2.Public, quote *Quote, nonce []byte, expected *PCRProtectionProfile) error {
+	if akPublic.Attrs&(tpm2.AttrSign|tpm2.AttrRestricted) != tpm2.AttrSign|tpm2.AttrRestricted {
+		return errors.New("key is not a restricted signing key")
+	}
+
+	if err := verifySignature(akPublic, quote.Quoted, quote.Signature); err != nil {
+		return xerrors.Errorf("cannot verify signature: %w", err)
+	}
+
+	attest, err := quote.Quoted.Decode()
+	if err != nil {
+		return xerrors.Errorf("cannot decode quote: %w", err)
+	}
+	if attest.Magic != tpm2.TPMGeneratedValue || attest.Type != tpm2.TagAttestQuote {
+		return errors.New("not a quote")
+	}
+	if !bytes.Equal(attest.ExtraData, nonce) {
+		return errors.New("unexpected nonce")
+	}
+
+	// The PCR digest is computed with the digest algorithm of the signing scheme.
+	hashAlg, _ := signatureHashAlg(quote.Signature)
+	pcrs, digests, err := expected.ComputePCRDigests(nil, hashAlg)
+	if err != nil {
+		return xerrors.Errorf("cannot compute expected PCR digests: %w", err)
+	}
+	if !attest.Attested.Quote.PCRSelect.Equal(pcrs) {
+		return errors.New("unexpected PCR selection")
+	}
+	if !digestListContains(digests, attest.Attested.Quote.PCRDigest) {
+		return errors.New("unexpected PCR values")
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+func TestCreateAttestationKeyAndVerifyQuote(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	ak, err := CreateAttestationKey(tpm)
+	if err != nil {
+		t.Fatalf("CreateAttestationKey failed: %v", err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := ak.Write(buf); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	ak, err = ReadAttestationKey(buf)
+	if err != nil {
+		t.Fatalf("ReadAttestationKey failed: %v", err)
+	}
+
+	if _, err := tpm.PCREvent(tpm.PCRHandleContext(23), []byte("foo"), nil); err != nil {
+		t.Fatalf("PCREvent failed: %v", err)
+	}
+	_, values, err := tpm.PCRRead(tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7, 23}}})
+	if err != nil {
+		t.Fatalf("PCRRead failed: %v", err)
+	}
+
+	nonce := []byte("1234567890abcdef")
+	quote, err := ak.Quote(tpm, tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7, 23}}}, nonce)
+	if err != nil {
+		t.Fatalf("Quote failed: %v", err)
+	}
+
+	profile := NewPCRProtectionProfile().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, values[tpm2.HashAlgorithmSHA256][7]).
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 23, values[tpm2.HashAlgorithmSHA256][23])
+
+	t.Run("Good", func(t *testing.T) {
+		if err := VerifyQuote(ak.Public, quote, nonce, profile); err != nil {
+			t.Errorf("VerifyQuote failed: %v", err)
+		}
+	})
+
+	t.Run("GoodWithOR", func(t *testing.T) {
+		profile := NewPCRProtectionProfile().AddProfileOR(
+			NewPCRProtectionProfile().
+				AddPCRValue(tpm2.HashAlgorithmSHA256, 7, make(tpm2.Digest, 32)).
+				AddPCRValue(tpm2.HashAlgorithmSHA256, 23, make(tpm2.Digest, 32)),
+			profile)
+		if err := VerifyQuote(ak.Public, quote, nonce, profile); err != nil {
+			t.Errorf("VerifyQuote failed: %v", err)
+		}
+	})
+
+	t.Run("WrongNonce", func(t *testing.T) {
+		err := VerifyQuote(ak.Public, quote, []byte("foo"), profile)
+		if err == nil || err.Error() != "unexpected nonce" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("UnexpectedPCRValues", func(t *testing.T) {
+		profile := NewPCRProtectionProfile().
+			AddPCRValue(tpm2.HashAlgorithmSHA256, 7, values[tpm2.HashAlgorithmSHA256][7]).
+			AddPCRValue(tpm2.HashAlgorithmSHA256, 23, make(tpm2.Digest, 32))
+		err := VerifyQuote(ak.Public, quote, nonce, profile)
+		if err == nil || err.Error() != "unexpected PCR values" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("UnexpectedPCRSelection", func(t *testing.T) {
+		profile := NewPCRProtectionProfile().
+			AddPCRValue(tpm2.HashAlgorithmSHA256, 7, values[tpm2.HashAlgorithmSHA256][7])
+		err := VerifyQuote(ak.Public, quote, nonce, profile)
+		if err == nil || err.Error() != "unexpected PCR selection" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("WrongKey", func(t *testing.T) {
+		ak2, err := CreateAttestationKey(tpm)
+		if err != nil {
+			t.Fatalf("CreateAttestationKey failed: %v", err)
+		}
+		err = VerifyQuote(ak2.Public, quote, nonce, profile)
+		if err == nil || err.Error() != "cannot verify signature: invalid signature" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
@@ -0,0 +1,189 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/tcg"
+)
+
+// TPMClearPlanAction describes a step of a TPMClearPlan.
+type TPMClearPlanAction string
+
+const (
+	// TPMClearPlanObtainKey indicates that the key protected by a sealed key object must be obtained before the TPM is
+	// cleared, by unsealing it with SealedKeyObject.UnsealFromTPM. If this isn't possible, the key must be recovered by
+	// other means after the TPM has been cleared, eg, with a recovery key.
+	TPMClearPlanObtainKey TPMClearPlanAction = "obtain-key"
+
+	// TPMClearPlanClearTPM indicates that the TPM should be cleared, eg, with RequestTPMClearUsingPPI.
+	TPMClearPlanClearTPM TPMClearPlanAction = "clear-tpm"
+
+	// TPMClearPlanProvisionTPM indicates that the TPM should be provisioned with Connection.EnsureProvisioned, or with
+	// Connection.EnsureProvisionedWithCustomSRK if the plan's SRK template isn't the default one.
+	TPMClearPlanProvisionTPM TPMClearPlanAction = "provision-tpm"
+
+	// TPMClearPlanCreateStorageKey indicates that the storage key at a non-standard handle must be recreated before any
+	// sealed key objects can be created under it.
+	TPMClearPlanCreateStorageKey TPMClearPlanAction = "create-storage-key"
+
+	// TPMClearPlanResealKey indicates that a sealed key object must be recreated with SealKeyToTPM, using the parameters
+	// described by the corresponding TPMClearKeyPlan.
+	TPMClearPlanResealKey TPMClearPlanAction = "reseal-key"
+)
+
+// TPMClearPlanStep is a single step of a TPMClearPlan.
+type TPMClearPlanStep struct {
+	Action TPMClearPlanAction
+	Path   string      // The path of the sealed key file that this step applies to, if any
+	Handle tpm2.Handle // The handle of the storage key that this step applies to, if any
+}
+
+// TPMClearKeyPlan describes the effect of clearing the TPM on a sealed key object, and the parameters that it should be
+// recreated with if it doesn't survive.
+type TPMClearKeyPlan struct {
+	Path string
+
+	// Survives indicates that the sealed key object can still be unsealed after the TPM is cleared.
+	Survives bool
+
+	// Reasons explains why the sealed key object doesn't survive clearing the TPM.
+	Reasons []string
+
+	// SRKHandle is the handle of the storage key that the sealed key object was created under, or the hierarchy that
+	// its storage key is created in for sealed key objects created with KeyCreationParams.StorageHierarchy.
+	SRKHandle tpm2.Handle
+
+	// PCRSelection is the PCR selection of the sealed key object's current PCR policy. The PCR values are not affected
+	// by clearing the TPM, so the sealed key object can be recreated with the same PCR profile.
+	PCRSelection tpm2.PCRSelectionList
+
+	// These are the handles of the NV indices that the sealed key object depends on. These are all removed by clearing
+	// the TPM, and are recreated by SealKeyToTPM if they are supplied via KeyCreationParams.
+	PCRPolicyCounterHandle tpm2.Handle
+	PINIndexHandle         tpm2.Handle
+	LockIndexHandle        tpm2.Handle
+	RollbackCounterHandle  tpm2.Handle
+}
+
+// TPMClearPlan is a plan for re-enrolling sealed key objects after a planned TPM clear, returned from PlanTPMClear.
+type TPMClearPlan struct {
+	// SRKTemplate is the template that the storage root key at the standard handle was created with, and which
+	// should be used to create it again after the TPM is cleared. The name of the new storage root key can't be
+	// predicted from this, because it also depends on a new seed that the TPM generates when it is cleared.
+	SRKTemplate *tpm2.Public
+
+	// Keys describes the effect of clearing the TPM on each of the sealed key objects supplied to PlanTPMClear.
+	Keys []*TPMClearKeyPlan
+
+	// Steps is the ordered list of actions required to clear the TPM and re-enrol the sealed key objects that
+	// don't survive.
+	Steps []*TPMClearPlanStep
+}
+
+// planForKey determines the effect of clearing the TPM on the supplied sealed key object.
+func planForKey(path string, k *SealedKeyObject) *TPMClearKeyPlan {
+	plan := &TPMClearKeyPlan{
+		Path:                   path,
+		SRKHandle:              k.data.parentHandle(),
+		PCRSelection:           k.PCRSelection(),
+		PCRPolicyCounterHandle: k.PCRPolicyCounterHandle(),
+		PINIndexHandle:         k.PINIndexHandle(),
+		LockIndexHandle:        k.LockIndexHandle(),
+		RollbackCounterHandle:  k.RollbackCounterHandle()}
+
+	switch {
+	case k.data.version == 0:
+		plan.Reasons = append(plan.Reasons, "the sealed key object depends on the legacy lock NV index")
+	case !k.data.parentIsTransient(), k.data.parentHandle() == tpm2.HandleOwner:
+		plan.Reasons = append(plan.Reasons, "the sealed key object was created in the storage hierarchy")
+	}
+	for _, i := range []struct {
+		handle tpm2.Handle
+		desc   string
+	}{
+		{k.PCRPolicyCounterHandle(), "PCR policy counter"},
+		{k.PINIndexHandle(), "PIN index"},
+		{k.LockIndexHandle(), "lock index"},
+		{k.RollbackCounterHandle(), "rollback counter"},
+	} {
+		if i.handle.Type() == tpm2.HandleTypeNVIndex {
+			plan.Reasons = append(plan.Reasons, "the sealed key object depends on a "+i.desc)
+		}
+	}
+
+	plan.Survives = len(plan.Reasons) == 0
+	return plan
+}
+
+// PlanTPMClear determines whether the sealed key objects in the files at the specified paths need to be recreated if the TPM
+// is cleared, and returns a plan for clearing the TPM and re-enrolling them. This is intended to be used by tooling that
+// automates TPM clear and re-enrolment as a maintenance operation.
+//
+// Clearing the TPM replaces the seed of the storage hierarchy and removes all of the NV indices and persistent objects that
+// were created in it. A sealed key object doesn't survive this if it was created under a storage key in the storage hierarchy
+// or depends on any NV index, such as a PCR policy counter. Sealed key objects that were created with
+// KeyCreationParams.StorageHierarchy set to the endorsement or platform hierarchy and that don't depend on any NV index
+// survive, because the seeds of these hierarchies are not changed. Note that the authorization values of the storage and
+// endorsement hierarchies are also reset by clearing the TPM.
+//
+// It isn't possible to predict the name of the new storage root key, as it depends on the new seed of the storage hierarchy,
+// so sealed key objects can't be created for it in advance. Instead, the returned plan records the template that the storage
+// root key was created with, so that it can be recreated with the same template after the TPM is cleared, and the parameters
+// that each sealed key object that doesn't survive should be recreated with.
+//
+// The returned plan doesn't depend on the current PCR values, and this function doesn't require knowledge of any authorization
+// values. If a sealed key file cannot be read, an error is returned.
+func PlanTPMClear(tpm *Connection, paths []string) (*TPMClearPlan, error) {
+	plan := &TPMClearPlan{SRKTemplate: selectSrkTemplate(tpm.TPMContext, tpm.HmacSession())}
+
+	var obtainSteps, storageKeySteps, resealSteps []*TPMClearPlanStep
+	storageKeys := make(map[tpm2.Handle]bool)
+
+	for _, path := range paths {
+		k, err := ReadSealedKeyObject(path)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read sealed key object from %s: %w", path, err)
+		}
+
+		keyPlan := planForKey(path, k)
+		plan.Keys = append(plan.Keys, keyPlan)
+		if keyPlan.Survives {
+			continue
+		}
+
+		obtainSteps = append(obtainSteps, &TPMClearPlanStep{Action: TPMClearPlanObtainKey, Path: path})
+		if h := keyPlan.SRKHandle; h.Type() == tpm2.HandleTypePersistent && h != tcg.SRKHandle && !storageKeys[h] {
+			storageKeys[h] = true
+			storageKeySteps = append(storageKeySteps, &TPMClearPlanStep{Action: TPMClearPlanCreateStorageKey, Handle: h})
+		}
+		resealSteps = append(resealSteps, &TPMClearPlanStep{Action: TPMClearPlanResealKey, Path: path, Handle: keyPlan.SRKHandle})
+	}
+
+	plan.Steps = append(plan.Steps, obtainSteps...)
+	plan.Steps = append(plan.Steps, &TPMClearPlanStep{Action: TPMClearPlanClearTPM}, &TPMClearPlanStep{Action: TPMClearPlanProvisionTPM})
+	plan.Steps = append(plan.Steps, storageKeySteps...)
+	plan.Steps = append(plan.Steps, resealSteps...)
+
+	return plan, nil
+}
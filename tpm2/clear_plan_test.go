@@ -0,0 +1,125 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+
+	"github.com/snapcore/secboot/internal/tcg"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+func TestPlanTPMClear(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestPlanTPMClear_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	storageKeyFile := filepath.Join(tmpDir, "storage")
+	endorsementKeyFile := filepath.Join(tmpDir, "endorsement")
+
+	pcrPolicyCounterHandle := tpm2.Handle(0x01810000)
+
+	if _, err := SealKeyToTPM(tpm, key, storageKeyFile, &KeyCreationParams{
+		PCRProfile:             getTestPCRProfile(),
+		PCRPolicyCounterHandle: pcrPolicyCounterHandle}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer func() {
+		rc, err := tpm.CreateResourceContextFromTPM(pcrPolicyCounterHandle)
+		if err != nil {
+			t.Errorf("CreateResourceContextFromTPM failed: %v", err)
+		}
+		undefineNVSpace(t, tpm, rc, tpm.OwnerHandleContext())
+	}()
+
+	if _, err := SealKeyToTPM(tpm, key, endorsementKeyFile, &KeyCreationParams{
+		PCRProfile:             getTestPCRProfile(),
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		StorageHierarchy:       tpm2.HandleEndorsement}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+
+	plan, err := PlanTPMClear(tpm, []string{storageKeyFile, endorsementKeyFile})
+	if err != nil {
+		t.Fatalf("PlanTPMClear failed: %v", err)
+	}
+
+	if plan.SRKTemplate == nil {
+		t.Errorf("Missing SRK template")
+	}
+
+	if len(plan.Keys) != 2 {
+		t.Fatalf("Unexpected number of keys: %d", len(plan.Keys))
+	}
+
+	storageKey := plan.Keys[0]
+	if storageKey.Path != storageKeyFile {
+		t.Errorf("Unexpected path: %s", storageKey.Path)
+	}
+	if storageKey.Survives {
+		t.Errorf("Key in storage hierarchy should not survive clearing the TPM")
+	}
+	if storageKey.SRKHandle != tcg.SRKHandle {
+		t.Errorf("Unexpected SRK handle: %v", storageKey.SRKHandle)
+	}
+	if storageKey.PCRPolicyCounterHandle != pcrPolicyCounterHandle {
+		t.Errorf("Unexpected PCR policy counter handle: %v", storageKey.PCRPolicyCounterHandle)
+	}
+	if len(storageKey.Reasons) != 2 {
+		t.Errorf("Unexpected reasons: %v", storageKey.Reasons)
+	}
+
+	endorsementKey := plan.Keys[1]
+	if !endorsementKey.Survives {
+		t.Errorf("Key in endorsement hierarchy should survive clearing the TPM: %v", endorsementKey.Reasons)
+	}
+	if endorsementKey.SRKHandle != tpm2.HandleEndorsement {
+		t.Errorf("Unexpected SRK handle: %v", endorsementKey.SRKHandle)
+	}
+
+	expectedSteps := []*TPMClearPlanStep{
+		{Action: TPMClearPlanObtainKey, Path: storageKeyFile},
+		{Action: TPMClearPlanClearTPM},
+		{Action: TPMClearPlanProvisionTPM},
+		{Action: TPMClearPlanResealKey, Path: storageKeyFile, Handle: tcg.SRKHandle},
+	}
+	if !reflect.DeepEqual(plan.Steps, expectedSteps) {
+		t.Errorf("Unexpected steps: %v", plan.Steps)
+	}
+}
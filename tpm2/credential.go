@@ -0,0 +1,177 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"math/big"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+
+	"golang.org/x/xerrors"
+)
+
+// ErrInvalidCredential is returned from ActivateCredential if the supplied credential was not created for
+// the TPM's endorsement key and the supplied attestation key.
+var ErrInvalidCredential = errors.New("the credential was not created for this TPM and attestation key")
+
+// kdfa implements the counter mode KDF described in section 11.4.10.2 of part 1 of the TPM Library
+// Specification.
+func kdfa(hashAlg tpm2.HashAlgorithmId, key []byte, label string, contextU, contextV []byte, sizeInBits int) []byte {
+	size := (sizeInBits + 7) / 8
+	var out []byte
+	for i := uint32(1); len(out) < size; i++ {
+		h := hmac.New(func() hash.Hash { return hashAlg.NewHash() }, key)
+		binary.Write(h, binary.BigEndian, i)
+		h.Write([]byte(label))
+		h.Write([]byte{0})
+		h.Write(contextU)
+		h.Write(contextV)
+		binary.Write(h, binary.BigEndian, uint32(sizeInBits))
+		out = h.Sum(out)
+	}
+	return out[:size]
+}
+
+// MakeCredential protects the supplied secret so that it can only be recovered by ActivateCredential on the
+// TPM with the endorsement key that has the supplied public area, and only if that TPM also has the attestation
+// key with the supplied name. This is the server side of the credential activation protocol described in
+// section 24 of part 1 of the TPM Library Specification, and doesn't require a TPM.
+//
+// The endorsement key must be a restricted RSA decryption key with an AES symmetric algorithm, such as one
+// created from the default EK template, and should be associated with a verified EK certificate. The caller
+// should also check the attributes of the attestation key before computing its name.
+//
+// The secret can be no larger than the digest size of the endorsement key's name algorithm. The returned
+// credential blob and encrypted secret should be passed to ActivateCredential on the client.
+func MakeCredential(ekPublic *tpm2.Public, akName tpm2.Name, secret []byte) (credentialBlob tpm2.IDObjectRaw, encryptedSecret tpm2.EncryptedSecret, err error) {
+	if ekPublic.Type != tpm2.ObjectTypeRSA {
+		return nil, nil, errors.New("unsupported endorsement key type")
+	}
+	if ekPublic.Attrs&(tpm2.AttrRestricted|tpm2.AttrDecrypt) != tpm2.AttrRestricted|tpm2.AttrDecrypt {
+		return nil, nil, errors.New("endorsement key is not a restricted decryption key")
+	}
+	symmetric := ekPublic.Params.RSADetail.Symmetric
+	if symmetric.Algorithm != tpm2.SymObjectAlgorithmAES || symmetric.Mode.Sym != tpm2.SymModeCFB {
+		return nil, nil, errors.New("unsupported endorsement key symmetric algorithm")
+	}
+	nameAlg := ekPublic.NameAlg
+	if !nameAlg.Available() {
+		return nil, nil, errors.New("unsupported endorsement key name algorithm")
+	}
+	if len(secret) > nameAlg.Size() {
+		return nil, nil, errors.New("secret is too large")
+	}
+	if len(akName) == 0 {
+		return nil, nil, errors.New("no attestation key name")
+	}
+
+	// Encrypt a random seed with the endorsement key.
+	seed := make([]byte, nameAlg.Size())
+	if _, err := rand.Read(seed); err != nil {
+		return nil, nil, xerrors.Errorf("cannot obtain seed: %w", err)
+	}
+
+	exp := int(ekPublic.Params.RSADetail.Exponent)
+	if exp == 0 {
+		// The default exponent of 2^^16-1 is indicated by the value of 0 in the public area.
+		exp = 65537
+	}
+	key := rsa.PublicKey{N: new(big.Int).SetBytes(ekPublic.Unique.RSA), E: exp}
+	encryptedSecret, err = rsa.EncryptOAEP(nameAlg.NewHash(), rand.Reader, &key, seed, []byte("IDENTITY\x00"))
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot encrypt seed: %w", err)
+	}
+
+	// Encrypt the secret with a symmetric key derived from the seed and the name of the attestation key.
+	encIdentity, err := mu.MarshalToBytes(tpm2.Digest(secret))
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot marshal secret: %w", err)
+	}
+	symKey := kdfa(nameAlg, seed, "STORAGE", akName, nil, int(symmetric.KeyBits.Sym))
+	block, err := aes.NewCipher(symKey)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot create cipher: %w", err)
+	}
+	cipher.NewCFBEncrypter(block, make([]byte, aes.BlockSize)).XORKeyStream(encIdentity, encIdentity)
+
+	// Compute the outer integrity HMAC.
+	hmacKey := kdfa(nameAlg, seed, "INTEGRITY", nil, nil, nameAlg.Size()*8)
+	h := hmac.New(func() hash.Hash { return nameAlg.NewHash() }, hmacKey)
+	h.Write(encIdentity)
+	h.Write(akName)
+
+	credentialBlob, err = mu.MarshalToBytes(tpm2.Digest(h.Sum(nil)), mu.RawBytes(encIdentity))
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot marshal credential: %w", err)
+	}
+
+	return credentialBlob, encryptedSecret, nil
+}
+
+// ActivateCredential recovers a secret protected by MakeCredential, using the supplied attestation key and the
+// TPM's endorsement key. This is the client side of the credential activation protocol. It will only succeed
+// if the credential was created for this TPM's endorsement key and for the supplied attestation key, which
+// proves to the server that the attestation key is resident on the same TPM as the endorsement key.
+//
+// If there is no persistent endorsement key, a transient one is created. This, and authorizing use of the
+// endorsement key, requires knowledge of the endorsement hierarchy authorization value.
+//
+// If the credential wasn't created for this TPM and attestation key, ErrInvalidCredential is returned.
+func ActivateCredential(tpm *Connection, ak *AttestationKey, credentialBlob tpm2.IDObjectRaw, encryptedSecret tpm2.EncryptedSecret) ([]byte, error) {
+	var secret []byte
+	if err := withEndorsementKey(tpm, func(ek tpm2.ResourceContext, ekSession func() (tpm2.SessionContext, error)) error {
+		akContext, err := ak.load(tpm, ek, ekSession)
+		if err != nil {
+			return err
+		}
+		defer tpm.FlushContext(akContext)
+
+		session, err := ekSession()
+		if err != nil {
+			return err
+		}
+
+		certInfo, err := tpm.ActivateCredential(akContext, ek, credentialBlob, encryptedSecret, nil, session)
+		switch {
+		case tpm2.IsTPMParameterError(err, tpm2.AnyErrorCode, tpm2.CommandActivateCredential, tpm2.AnyParameterIndex):
+			return ErrInvalidCredential
+		case err != nil:
+			return err
+		}
+		secret = certInfo
+		return nil
+	}); err != nil {
+		if err == ErrInvalidCredential {
+			return nil, err
+		}
+		return nil, xerrors.Errorf("cannot activate credential: %w", err)
+	}
+
+	return secret, nil
+}
@@ -0,0 +1,110 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+
+	"github.com/snapcore/secboot/internal/tcg"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+func TestActivateCredential(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	ek, ekPublic, _, _, _, err := tpm.CreatePrimary(tpm.EndorsementHandleContext(), nil, tcg.EKTemplate, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("CreatePrimary failed: %v", err)
+	}
+	flushContext(t, tpm, ek)
+
+	ak, err := CreateAttestationKey(tpm)
+	if err != nil {
+		t.Fatalf("CreateAttestationKey failed: %v", err)
+	}
+	akName, err := ak.Public.Name()
+	if err != nil {
+		t.Fatalf("Name failed: %v", err)
+	}
+
+	secret := []byte("1234567890abcdef")
+
+	t.Run("Good", func(t *testing.T) {
+		credentialBlob, encryptedSecret, err := MakeCredential(ekPublic, akName, secret)
+		if err != nil {
+			t.Fatalf("MakeCredential failed: %v", err)
+		}
+
+		recovered, err := ActivateCredential(tpm, ak, credentialBlob, encryptedSecret)
+		if err != nil {
+			t.Fatalf("ActivateCredential failed: %v", err)
+		}
+		if !bytes.Equal(recovered, secret) {
+			t.Errorf("Unexpected secret")
+		}
+	})
+
+	t.Run("WrongAK", func(t *testing.T) {
+		ak2, err := CreateAttestationKey(tpm)
+		if err != nil {
+			t.Fatalf("CreateAttestationKey failed: %v", err)
+		}
+		ak2Name, err := ak2.Public.Name()
+		if err != nil {
+			t.Fatalf("Name failed: %v", err)
+		}
+
+		credentialBlob, encryptedSecret, err := MakeCredential(ekPublic, ak2Name, secret)
+		if err != nil {
+			t.Fatalf("MakeCredential failed: %v", err)
+		}
+
+		if _, err := ActivateCredential(tpm, ak, credentialBlob, encryptedSecret); err != ErrInvalidCredential {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("SecretTooLarge", func(t *testing.T) {
+		_, _, err := MakeCredential(ekPublic, akName, make([]byte, 33))
+		if err == nil || err.Error() != "secret is too large" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("NotAnEK", func(t *testing.T) {
+		_, _, err := MakeCredential(ak.Public, akName, secret)
+		if err == nil || err.Error() != "unsupported endorsement key type" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
+
+func TestMakeCredentialNonRestrictedKey(t *testing.T) {
+	public := tcg.MakeDefaultEKTemplate()
+	public.Attrs &^= tpm2.AttrRestricted
+	_, _, err := MakeCredential(public, make(tpm2.Name, 34), nil)
+	if err == nil || err.Error() != "endorsement key is not a restricted decryption key" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
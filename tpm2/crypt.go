@@ -21,19 +21,21 @@ package tpm2
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"strings"
+
+	"github.com/canonical/go-tpm2"
 
 	"golang.org/x/xerrors"
 
 	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/keyring"
+	"github.com/snapcore/secboot/internal/logger"
 	"github.com/snapcore/secboot/internal/luks2"
+	"github.com/snapcore/secboot/internal/secmem"
 )
 
 var (
@@ -41,29 +43,6 @@ var (
 	secbootActivateVolumeWithRecoveryKey = secboot.ActivateVolumeWithRecoveryKey
 )
 
-// XXX: This code is duplicated temporarily from github.com/snapcore/secboot:crypt.go
-// It will go away once there is an abstract interface for handling authorization requests,
-// or we figure out a way to do activation with TPM key files using the new API so that
-// this one can be removed.
-func askPassword(sourceDevicePath, msg string) (string, error) {
-	cmd := exec.Command(
-		"systemd-ask-password",
-		"--icon", "drive-harddisk",
-		"--id", filepath.Base(os.Args[0])+":"+sourceDevicePath,
-		msg)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stdin = os.Stdin
-	if err := cmd.Run(); err != nil {
-		return "", err
-	}
-	result, err := out.ReadString('\n')
-	if err != nil {
-		return "", xerrors.Errorf("cannot read result from systemd-ask-password: %w", err)
-	}
-	return strings.TrimRight(result, "\n"), nil
-}
-
 func getPassword(sourceDevicePath, description string, reader io.Reader) (string, error) {
 	if reader != nil {
 		scanner := bufio.NewScanner(reader)
@@ -77,36 +56,82 @@ func getPassword(sourceDevicePath, description string, reader io.Reader) (string
 	return askPassword(sourceDevicePath, "Please enter the "+description+" for disk "+sourceDevicePath+":")
 }
 
-func unsealKeyFromTPM(tpm *Connection, k *SealedKeyObject, pin string) ([]byte, error) {
-	sealedKey, _, err := k.UnsealFromTPM(tpm, pin)
-	if err == ErrTPMProvisioning {
+func unsealKeyFromTPM(tpm *Connection, k *SealedKeyObject, pin string) ([]byte, PolicyAuthKey, error) {
+	sealedKey, authKey, err := k.UnsealFromTPM(tpm, pin)
+	if err == ErrTPMProvisioning || err == ErrNoStorageRootKey {
 		// XXX: We should update this to execute on InvalidKeyFileError as well.
-		// ErrTPMProvisioning in this context might indicate that there isn't a valid persistent SRK. Have a go at creating one now and then
+		// These errors in this context indicate that there isn't a valid persistent SRK. Have a go at creating one now and then
 		// retrying the unseal operation - if the previous SRK was evicted, the TPM owner hasn't changed and the storage hierarchy still
 		// has a null authorization value, then this will allow us to unseal the key without requiring any type of manual recovery. If the
 		// storage hierarchy has a non-null authorization value, ProvisionTPM will fail. If the TPM owner has changed, ProvisionTPM might
 		// succeed, but UnsealFromTPM will fail with InvalidKeyFileError when retried.
 		if pErr := tpm.EnsureProvisioned(ProvisionModeWithoutLockout, nil); pErr == nil || pErr == ErrTPMProvisioningRequiresLockout {
-			sealedKey, _, err = k.UnsealFromTPM(tpm, pin)
+			sealedKey, authKey, err = k.UnsealFromTPM(tpm, pin)
 		}
 	}
-	return sealedKey, err
+	return sealedKey, authKey, err
 }
 
-func unsealKeyFromTPMAndActivate(tpm *Connection, volumeName, sourceDevicePath, keyringPrefix string, k *SealedKeyObject, pin string) error {
-	sealedKey, err := unsealKeyFromTPM(tpm, k, pin)
+func unsealKeyFromTPMAndActivate(tpm *Connection, volumeName, sourceDevicePath string, k *SealedKeyObject, pin string, options *secboot.ActivateVolumeOptions) error {
+	unsealedKey, authKey, err := unsealKeyFromTPM(tpm, k, pin)
+	logger.Debug("tpm2-unseal",
+		logger.F("volume", volumeName),
+		logger.F("device", sourceDevicePath),
+		logger.F("pin", pin != ""),
+		logger.Err(err))
 	if err != nil {
 		return xerrors.Errorf("cannot unseal key: %w", err)
 	}
+	defer secmem.Wipe(authKey)
 
-	if err := luks2Activate(volumeName, sourceDevicePath, sealedKey); err != nil {
+	// Move the unsealed key out of the Go heap for the rest of its lifetime.
+	buf, err := secmem.NewFromBytes(unsealedKey, options.RequireLockedMemory)
+	if err != nil {
+		return xerrors.Errorf("cannot protect unsealed key: %w", err)
+	}
+	defer buf.Destroy()
+	sealedKey := buf.Bytes()
+
+	err = luks2Activate(volumeName, sourceDevicePath, sealedKey)
+	logger.Debug("tpm2-activate",
+		logger.F("volume", volumeName),
+		logger.F("device", sourceDevicePath),
+		logger.Err(err))
+	if err != nil {
 		return xerrors.Errorf("cannot activate volume: %w", err)
 	}
 
+	// Keep the unlock key and the policy auth key in the user keyring so that they can
+	// be retrieved later on with secboot.GetDiskUnlockKeyFromKernel and GetAuthKeyFromKernel,
+	// which permits the PCR policy to be updated without having to unseal the key again.
+	if err := keyring.AddKeyToUserKeyring(sealedKey, sourceDevicePath, keyringPurposeDiskUnlock, keyringPrefixOrDefault(options.KeyringPrefix)); err != nil {
+		fmt.Fprintf(os.Stderr, "secboot: Cannot add key to user keyring: %v\n", err)
+	}
+
+	// Keys whose PCR policies are authorized by an external signer don't have a policy auth key.
+	if len(authKey) > 0 {
+		if err := addAuthKeyToKeyring(options.KeyringPrefix, sourceDevicePath, authKey, options.AuthKeyKeyringOptions); err != nil {
+			fmt.Fprintf(os.Stderr, "secboot: Cannot add key to user keyring: %v\n", err)
+		}
+	}
+
 	return nil
 }
 
-var requiresPinErr = errors.New("no PIN tries permitted when a PIN is required")
+var (
+	requiresPinErr                 = errors.New("no PIN tries permitted when a PIN is required")
+	skippedInLockoutErr            = errors.New("not tried because the TPM is in DA lockout mode")
+	skippedLockUnavailableErr      = errors.New("not tried because keys cannot be held in locked memory")
+	recoveryKeyFallbackDisabledErr = errors.New("fallback to the recovery key is disabled")
+	lockUnavailableErr             = errors.New("not falling back to the recovery key because keys cannot be held in locked memory")
+)
+
+// isLockUnavailableError indicates whether the supplied error means that a key
+// couldn't be held in locked memory when this is required.
+func isLockUnavailableError(err error) bool {
+	var e *secmem.LockUnavailableError
+	return xerrors.As(err, &e)
+}
 
 type activateWithTPMKeyError struct {
 	path string
@@ -134,19 +159,56 @@ func (c *activateTPMKeyContext) Err() *activateWithTPMKeyError {
 	return &activateWithTPMKeyError{path: c.path, err: c.err}
 }
 
-func activateWithTPMKeys(tpm *Connection, volumeName, sourceDevicePath string, keyPaths []string, passphraseReader io.Reader, passphraseTries int, keyringPrefix string) (succeeded bool, errs []*activateWithTPMKeyError) {
+// sealedKeySource describes where a sealed key object used for activation is loaded from.
+type sealedKeySource struct {
+	path string // the path of the key data file, or a name that identifies the NV index
+	read func() (*SealedKeyObject, error)
+}
+
+func sealedKeySourcesFromPaths(keyPaths []string) (sources []*sealedKeySource) {
+	for _, path := range keyPaths {
+		path := path
+		sources = append(sources, &sealedKeySource{
+			path: path,
+			read: func() (*SealedKeyObject, error) { return ReadSealedKeyObject(path) }})
+	}
+	return sources
+}
+
+func activateWithTPMKeys(ctx context.Context, tpm *Connection, volumeName, sourceDevicePath string, sources []*sealedKeySource, passphraseReader io.Reader, options *secboot.ActivateVolumeOptions) (succeeded, lockout, lockUnavailable bool, errs []*activateWithTPMKeyError) {
 	var contexts []*activateTPMKeyContext
+
+	fail := func(c *activateTPMKeyContext, err error) {
+		c.err = err
+		if xerrors.Is(err, ErrTPMLockout) {
+			lockout = true
+		}
+		if isLockUnavailableError(err) {
+			lockUnavailable = true
+		}
+		if options.UnsealErrorHandler != nil {
+			options.UnsealErrorHandler(c.path, err)
+		}
+	}
+
 	// Read key files
-	for _, path := range keyPaths {
-		k, err := ReadSealedKeyObject(path)
+	for _, source := range sources {
+		c := &activateTPMKeyContext{path: source.path}
+		contexts = append(contexts, c)
+
+		k, err := source.read()
 		if err != nil {
-			err = xerrors.Errorf("cannot read sealed key object: %w", err)
+			fail(c, xerrors.Errorf("cannot read sealed key object: %w", err))
+			continue
 		}
-		contexts = append(contexts, &activateTPMKeyContext{path: path, k: k, err: err})
+		c.k = k
 	}
 
 	// Try key files that don't require a passphrase first.
 	for _, c := range contexts {
+		if lockout || lockUnavailable || ctx.Err() != nil {
+			break
+		}
 		if c.err != nil {
 			continue
 		}
@@ -154,56 +216,78 @@ func activateWithTPMKeys(tpm *Connection, volumeName, sourceDevicePath string, k
 			continue
 		}
 
-		if err := unsealKeyFromTPMAndActivate(tpm, volumeName, sourceDevicePath, keyringPrefix, c.k, ""); err != nil {
-			c.err = err
+		if err := unsealKeyFromTPMAndActivate(tpm, volumeName, sourceDevicePath, c.k, "", options); err != nil {
+			fail(c, err)
 			continue
 		}
 
-		return true, nil
+		keyring.AddActivationProtectorToUserKeyring(c.path, volumeName, keyringPrefixOrDefault(options.KeyringPrefix))
+		return true, false, false, nil
 	}
 
 	// Try key files that do require a passhprase last.
 	for _, c := range contexts {
+		if lockout || lockUnavailable || ctx.Err() != nil {
+			break
+		}
 		if c.err != nil {
 			continue
 		}
 		if c.k.AuthMode2F() != secboot.AuthModePassphrase {
 			continue
 		}
-		if passphraseTries == 0 {
-			c.err = requiresPinErr
+		if options.PassphraseTries == 0 {
+			fail(c, requiresPinErr)
 			continue
 		}
 
-		var pin string
-		for i := 0; i < passphraseTries; i++ {
+		for i := 0; i < options.PassphraseTries; i++ {
+			if err := ctx.Err(); err != nil {
+				fail(c, err)
+				break
+			}
+
 			r := passphraseReader
 			passphraseReader = nil
-			var err error
-			pin, err = getPassword(sourceDevicePath, "PIN", r)
+			pin, err := getPassword(sourceDevicePath, "PIN", r)
 			if err != nil {
-				c.err = xerrors.Errorf("cannot obtain PIN: %w", err)
+				fail(c, xerrors.Errorf("cannot obtain PIN: %w", err))
 				break
 			}
-		}
 
-		if c.err != nil {
-			continue
-		}
+			if err := unsealKeyFromTPMAndActivate(tpm, volumeName, sourceDevicePath, c.k, pin, options); err != nil {
+				fail(c, err)
+				if xerrors.Is(err, ErrPINFail) {
+					// Only retry if the PIN was incorrect. Other errors, such as ErrPINAttemptLimitReached
+					// or ErrTPMLockout, won't be resolved by asking again.
+					continue
+				}
+				break
+			}
 
-		if err := unsealKeyFromTPMAndActivate(tpm, volumeName, sourceDevicePath, keyringPrefix, c.k, pin); err != nil {
-			c.err = err
-			continue
+			keyring.AddActivationProtectorToUserKeyring(c.path, volumeName, keyringPrefixOrDefault(options.KeyringPrefix))
+			return true, false, false, nil
 		}
-
-		return true, nil
 	}
 
 	// Activation has failed if we reach this point.
 	for _, c := range contexts {
+		switch {
+		case c.err != nil:
+		case ctx.Err() != nil:
+			// This key wasn't tried because activation was aborted.
+			c.err = ctx.Err()
+		case lockUnavailable:
+			// This key wasn't tried because a previous key couldn't be
+			// held in locked memory.
+			c.err = skippedLockUnavailableErr
+		default:
+			// This key wasn't tried because the TPM entered DA lockout mode.
+			c.err = skippedInLockoutErr
+		}
 		errs = append(errs, c.Err())
 	}
-	return false, errs
+	return false, lockout, lockUnavailable, errs
 
 }
 
@@ -216,12 +300,20 @@ func activateWithTPMKeys(tpm *Connection, volumeName, sourceDevicePath string, k
 // If this function tries a TPM sealed key object that has a user passphrase/PIN defined, then this function will use
 // systemd-ask-password to request it. If passphraseReader is not nil, then an attempt to read the user passphrase/PIN from this
 // will be made instead by reading all characters until the first newline. The PassphraseTries field of options defines how many
-// attempts should be made to obtain the correct passphrase for each TPM sealed key before failing.
+// attempts should be made to obtain the correct passphrase for each TPM sealed key before failing. A passphrase is only requested
+// again if the previous one was incorrect.
+//
+// If the TPM enters dictionary attack lockout mode, no further TPM sealed key objects will be tried.
+//
+// If the UnsealErrorHandler field of options is set, it will be called with the path and error each time that activation with
+// one of the TPM sealed key objects fails, including for each incorrect passphrase.
 //
 // If activation with the TPM sealed key objects fails, this function will attempt to activate it with the fallback recovery key
 // instead. The fallback recovery key will be requested using systemd-ask-password. The RecoveryKeyTries field of options specifies
 // how many attempts should be made to activate the volume with the recovery key before failing. If this is set to 0, then no attempts
-// will be made to activate the encrypted volume with the fallback recovery key.
+// will be made to activate the encrypted volume with the fallback recovery key. No attempts will be made either if the
+// DisableRecoveryKeyFallback field of options is set, or if the TPM is in dictionary attack lockout mode and the LockoutBehavior
+// field of options is secboot.LockoutFail.
 //
 // If either the PassphraseTries or RecoveryKeyTries fields of options are less than zero, an error will be returned.
 //
@@ -231,13 +323,29 @@ func activateWithTPMKeys(tpm *Connection, volumeName, sourceDevicePath string, k
 // recovery key also fails, the RecoveryKeyUsageErr field of the returned error will also contain details of the error encountered
 // during recovery key activation.
 //
+// If the fallback recovery key is used successfully, the errors encountered with the TPM sealed key objects are recorded in
+// the kernel keyring so that they can be retrieved later on with secboot.GetActivationError.
+//
 // If the volume is successfully activated, either with a TPM sealed key or the fallback recovery key, this function returns true.
 // If it is not successfully activated, then this function returns false.
 func ActivateVolumeWithMultipleSealedKeys(tpm *Connection, volumeName, sourceDevicePath string, keyPaths []string, passphraseReader io.Reader, options *secboot.ActivateVolumeOptions) (bool, error) {
+	return ActivateVolumeWithMultipleSealedKeysContext(context.Background(), tpm, volumeName, sourceDevicePath, keyPaths, passphraseReader, options)
+}
+
+// ActivateVolumeWithMultipleSealedKeysContext is the same as ActivateVolumeWithMultipleSealedKeys, but activation is aborted
+// if the supplied context is cancelled or its deadline expires. This is checked before each TPM sealed key object is tried and
+// before each passphrase is requested. A TPM command that is already in progress runs to completion, and any policy sessions
+// are flushed from the TPM. If activation is aborted, the fallback recovery key isn't requested and the RecoveryKeyUsageErr
+// field of the returned error is the context's error.
+func ActivateVolumeWithMultipleSealedKeysContext(ctx context.Context, tpm *Connection, volumeName, sourceDevicePath string, keyPaths []string, passphraseReader io.Reader, options *secboot.ActivateVolumeOptions) (bool, error) {
 	if len(keyPaths) == 0 {
 		return false, errors.New("no key files provided")
 	}
 
+	return activateVolumeWithSealedKeySources(ctx, tpm, volumeName, sourceDevicePath, sealedKeySourcesFromPaths(keyPaths), passphraseReader, options)
+}
+
+func activateVolumeWithSealedKeySources(ctx context.Context, tpm *Connection, volumeName, sourceDevicePath string, sources []*sealedKeySource, passphraseReader io.Reader, options *secboot.ActivateVolumeOptions) (bool, error) {
 	if options.PassphraseTries < 0 {
 		return false, errors.New("invalid PassphraseTries")
 	}
@@ -245,12 +353,28 @@ func ActivateVolumeWithMultipleSealedKeys(tpm *Connection, volumeName, sourceDev
 		return false, errors.New("invalid RecoveryKeyTries")
 	}
 
-	if success, errs := activateWithTPMKeys(tpm, volumeName, sourceDevicePath, keyPaths, passphraseReader, options.PassphraseTries, options.KeyringPrefix); !success {
+	if success, lockout, lockUnavailable, errs := activateWithTPMKeys(ctx, tpm, volumeName, sourceDevicePath, sources, passphraseReader, options); !success {
 		var tpmErrs []error
 		for _, e := range errs {
 			tpmErrs = append(tpmErrs, e)
 		}
-		rErr := secbootActivateVolumeWithRecoveryKey(volumeName, sourceDevicePath, nil, options)
+
+		var rErr error
+		switch {
+		case ctx.Err() != nil:
+			rErr = ctx.Err()
+		case options.DisableRecoveryKeyFallback:
+			rErr = recoveryKeyFallbackDisabledErr
+		case lockout && options.LockoutBehavior == secboot.LockoutFail:
+			rErr = recoveryKeyFallbackDisabledErr
+		case lockUnavailable:
+			rErr = lockUnavailableErr
+		default:
+			rErr = secbootActivateVolumeWithRecoveryKey(volumeName, sourceDevicePath, nil, options)
+		}
+		if rErr == nil {
+			keyring.AddActivationErrorToUserKeyring(tpmErrs, volumeName, keyringPrefixOrDefault(options.KeyringPrefix))
+		}
 		return rErr == nil, &ActivateWithMultipleSealedKeysError{tpmErrs, rErr}
 	}
 
@@ -263,12 +387,17 @@ func ActivateVolumeWithMultipleSealedKeys(tpm *Connection, volumeName, sourceDev
 // If the TPM sealed key object has a user passphrase/PIN defined, then this function will use systemd-ask-password to request
 // it. If passphraseReader is not nil, then an attempt to read the user passphrase/PIN from this will be made instead by reading
 // all characters until the first newline. The PassphraseTries field of options defines how many attempts should be made to
-// obtain the correct passphrase before failing.
+// obtain the correct passphrase before failing. A passphrase is only requested again if the previous one was incorrect.
+//
+// If the UnsealErrorHandler field of options is set, it will be called with keyPath and the error each time that activation with
+// the TPM sealed key object fails, including for each incorrect passphrase.
 //
 // If activation with the TPM sealed key object fails, this function will attempt to activate it with the fallback recovery key
 // instead. The fallback recovery key will be requested using systemd-ask-password. The RecoveryKeyTries field of options specifies
 // how many attempts should be made to activate the volume with the recovery key before failing. If this is set to 0, then no attempts
-// will be made to activate the encrypted volume with the fallback recovery key.
+// will be made to activate the encrypted volume with the fallback recovery key. No attempts will be made either if the
+// DisableRecoveryKeyFallback field of options is set, or if the TPM is in dictionary attack lockout mode and the LockoutBehavior
+// field of options is secboot.LockoutFail.
 //
 // If either the PassphraseTries or RecoveryKeyTries fields of options are less than zero, an error will be returned.
 //
@@ -277,16 +406,43 @@ func ActivateVolumeWithMultipleSealedKeys(tpm *Connection, volumeName, sourceDev
 // TPMErr field will contain the original error. If activation with the fallback recovery key also fails, the RecoveryKeyUsageErr
 // field of the returned error will also contain details of the error encountered during recovery key activation.
 //
+// If the fallback recovery key is used successfully, the errors encountered with the TPM sealed key object are recorded in
+// the kernel keyring so that they can be retrieved later on with secboot.GetActivationError.
+//
 // If the volume is successfully activated, either with the TPM sealed key or the fallback recovery key, this function returns true.
 // If it is not successfully activated, then this function returns false.
 func ActivateVolumeWithSealedKey(tpm *Connection, volumeName, sourceDevicePath, keyPath string, passphraseReader io.Reader, options *secboot.ActivateVolumeOptions) (bool, error) {
-	succeeded, err := ActivateVolumeWithMultipleSealedKeys(tpm, volumeName, sourceDevicePath, []string{keyPath}, passphraseReader, options)
+	return ActivateVolumeWithSealedKeyContext(context.Background(), tpm, volumeName, sourceDevicePath, keyPath, passphraseReader, options)
+}
+
+// ActivateVolumeWithSealedKeyContext is the same as ActivateVolumeWithSealedKey, but activation is aborted if the supplied
+// context is cancelled or its deadline expires. See ActivateVolumeWithMultipleSealedKeysContext for details.
+func ActivateVolumeWithSealedKeyContext(ctx context.Context, tpm *Connection, volumeName, sourceDevicePath, keyPath string, passphraseReader io.Reader, options *secboot.ActivateVolumeOptions) (bool, error) {
+	succeeded, err := ActivateVolumeWithMultipleSealedKeysContext(ctx, tpm, volumeName, sourceDevicePath, []string{keyPath}, passphraseReader, options)
+	return succeeded, makeActivateWithSealedKeyError(err)
+}
+
+// makeActivateWithSealedKeyError converts an error returned from activating a volume with a single
+// sealed key object to the type documented for ActivateVolumeWithSealedKey.
+func makeActivateWithSealedKeyError(err error) error {
 	if e1, ok := err.(*ActivateWithMultipleSealedKeysError); ok {
 		if e2, ok := e1.TPMErrs[0].(*activateWithTPMKeyError); ok {
-			err = &ActivateWithSealedKeyError{e2.err, e1.RecoveryKeyUsageErr}
-		} else {
-			err = &ActivateWithSealedKeyError{e1.TPMErrs[0], e1.RecoveryKeyUsageErr}
+			return &ActivateWithSealedKeyError{e2.err, e1.RecoveryKeyUsageErr}
 		}
+		return &ActivateWithSealedKeyError{e1.TPMErrs[0], e1.RecoveryKeyUsageErr}
 	}
-	return succeeded, err
+	return err
+}
+
+// ActivateVolumeWithSealedKeyNVIndex is the same as ActivateVolumeWithSealedKey, except that the TPM sealed key object is
+// loaded from the NV index at the specified handle rather than from a file. See ReadSealedKeyObjectFromNVIndex.
+//
+// The UnsealErrorHandler field of options is called with a name of the form "tpm2-nv:<handle>" in place of a path, and
+// this is also the name of the protector that is recorded in the kernel keyring on success.
+func ActivateVolumeWithSealedKeyNVIndex(tpm *Connection, volumeName, sourceDevicePath string, handle tpm2.Handle, passphraseReader io.Reader, options *secboot.ActivateVolumeOptions) (bool, error) {
+	source := &sealedKeySource{
+		path: nvKeyDataName(handle),
+		read: func() (*SealedKeyObject, error) { return ReadSealedKeyObjectFromNVIndex(tpm, handle) }}
+	succeeded, err := activateVolumeWithSealedKeySources(context.Background(), tpm, volumeName, sourceDevicePath, []*sealedKeySource{source}, passphraseReader, options)
+	return succeeded, makeActivateWithSealedKeyError(err)
 }
@@ -21,6 +21,7 @@ package tpm2_test
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -254,6 +255,22 @@ func (s *cryptTPMSimulatorSuite) testActivateVolumeWithMultipleSealedKeys(c *C,
 	}
 }
 
+func (s *cryptTPMSimulatorSuite) TestActivateVolumeWithSealedKeyContextCancelled(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	options := secboot.ActivateVolumeOptions{RecoveryKeyTries: 1}
+	success, err := ActivateVolumeWithSealedKeyContext(ctx, s.TPM, "data", "/dev/sda1", s.keyFile, nil, &options)
+	c.Check(success, Equals, false)
+	c.Assert(err, FitsTypeOf, &ActivateWithSealedKeyError{})
+	c.Check(err.(*ActivateWithSealedKeyError).TPMErr, Equals, context.Canceled)
+	c.Check(err.(*ActivateWithSealedKeyError).RecoveryKeyUsageErr, Equals, context.Canceled)
+
+	c.Check(s.mockLUKS2ActivateCalls, HasLen, 0)
+	c.Check(s.mockActivateVolumeWithRecoveryKeyCalls, HasLen, 0)
+	c.Check(s.mockSdAskPassword.Calls(), HasLen, 0)
+}
+
 func (s *cryptTPMSimulatorSuite) TestActivateVolumeWithMultipleSealedKeys1(c *C) {
 	key := make([]byte, 64)
 	rand.Read(key)
@@ -1068,23 +1085,28 @@ func (s *cryptTPMSimulatorSuite) TestActivateVolumeWithSealedKeyAndPINUsingPINRe
 }
 
 type testActivateVolumeWithSealedKeyErrorHandlingData struct {
-	pinTries         int
-	recoveryKeyTries int
-	keyringPrefix    string
-	passphrases      []string
-	activateTries    int
-	success          bool
-	errChecker       Checker
-	errCheckerArgs   []interface{}
+	pinTries                   int
+	recoveryKeyTries           int
+	keyringPrefix              string
+	disableRecoveryKeyFallback bool
+	lockoutBehavior            secboot.LockoutBehavior
+	noRecoveryKeyFallback      bool
+	passphrases                []string
+	activateTries              int
+	success                    bool
+	errChecker                 Checker
+	errCheckerArgs             []interface{}
 }
 
 func (s *cryptTPMSimulatorSuite) testActivateVolumeWithSealedKeyErrorHandling(c *C, data *testActivateVolumeWithSealedKeyErrorHandlingData) {
 	s.addTryPassphrases(c, data.passphrases)
 
 	options := secboot.ActivateVolumeOptions{
-		PassphraseTries:  data.pinTries,
-		RecoveryKeyTries: data.recoveryKeyTries,
-		KeyringPrefix:    data.keyringPrefix}
+		PassphraseTries:            data.pinTries,
+		RecoveryKeyTries:           data.recoveryKeyTries,
+		KeyringPrefix:              data.keyringPrefix,
+		DisableRecoveryKeyFallback: data.disableRecoveryKeyFallback,
+		LockoutBehavior:            data.lockoutBehavior}
 	success, err := ActivateVolumeWithSealedKey(s.TPM, "data", "/dev/sda1", s.keyFile, nil, &options)
 	c.Check(err, data.errChecker, data.errCheckerArgs...)
 	c.Check(success, Equals, data.success)
@@ -1105,7 +1127,7 @@ func (s *cryptTPMSimulatorSuite) testActivateVolumeWithSealedKeyErrorHandling(c
 		c.Check(call.sourceDevicePath, Equals, "/dev/sda1")
 	}
 
-	if data.pinTries >= 0 && data.recoveryKeyTries >= 0 {
+	if data.pinTries >= 0 && data.recoveryKeyTries >= 0 && !data.noRecoveryKeyFallback {
 		c.Check(s.mockActivateVolumeWithRecoveryKeyCalls, DeepEquals, []string{data.keyringPrefix})
 	} else {
 		c.Check(s.mockActivateVolumeWithRecoveryKeyCalls, DeepEquals, []string(nil))
@@ -1297,3 +1319,89 @@ func (s *cryptTPMSimulatorSuite) TestActivateVolumeWithSealedKeyErrorHandling11(
 			"activation with recovery key was successful"},
 	})
 }
+
+func (s *cryptTPMSimulatorSuite) TestActivateVolumeWithSealedKeyErrorHandling12(c *C) {
+	// Test that there is no recovery fallback when it is disabled.
+	_, err := s.TPM.PCREvent(s.TPM.PCRHandleContext(7), []byte("foo"), nil)
+	c.Assert(err, IsNil)
+
+	s.testActivateVolumeWithSealedKeyErrorHandling(c, &testActivateVolumeWithSealedKeyErrorHandlingData{
+		recoveryKeyTries:           1,
+		disableRecoveryKeyFallback: true,
+		noRecoveryKeyFallback:      true,
+		success:                    false,
+		errChecker:                 ErrorMatches,
+		errCheckerArgs: []interface{}{"cannot activate with TPM sealed key \\(cannot unseal key: invalid key data file: cannot complete " +
+			"authorization policy assertions: cannot complete OR assertions: current session digest not found in policy data\\) and " +
+			"activation with recovery key failed \\(fallback to the recovery key is disabled\\)"},
+	})
+}
+
+func (s *cryptTPMSimulatorSuite) TestActivateVolumeWithSealedKeyErrorHandling13(c *C) {
+	// Test that there is no recovery fallback in DA lockout mode when LockoutBehavior is LockoutFail.
+	c.Assert(s.TPM.DictionaryAttackParameters(s.TPM.LockoutHandleContext(), 0, 7200, 86400, nil), IsNil)
+	defer func() {
+		c.Check(s.TPM.EnsureProvisioned(ProvisionModeFull, nil), IsNil)
+	}()
+
+	s.testActivateVolumeWithSealedKeyErrorHandling(c, &testActivateVolumeWithSealedKeyErrorHandlingData{
+		recoveryKeyTries:      1,
+		lockoutBehavior:       secboot.LockoutFail,
+		noRecoveryKeyFallback: true,
+		success:               false,
+		errChecker:            ErrorMatches,
+		errCheckerArgs: []interface{}{"cannot activate with TPM sealed key \\(cannot unseal key: the TPM is in DA lockout mode\\) " +
+			"and activation with recovery key failed \\(fallback to the recovery key is disabled\\)"},
+	})
+}
+
+func (s *cryptTPMSimulatorSuite) TestActivateVolumeWithSealedKeyErrorHandling14(c *C) {
+	// Test that the recovery fallback still works when LockoutBehavior is LockoutFail and the TPM isn't in DA lockout mode.
+	_, err := s.TPM.PCREvent(s.TPM.PCRHandleContext(7), []byte("foo"), nil)
+	c.Assert(err, IsNil)
+
+	s.testActivateVolumeWithSealedKeyErrorHandling(c, &testActivateVolumeWithSealedKeyErrorHandlingData{
+		recoveryKeyTries: 1,
+		lockoutBehavior:  secboot.LockoutFail,
+		passphrases:      []string{s.recoveryKey.String()},
+		activateTries:    1,
+		success:          true,
+		errChecker:       ErrorMatches,
+		errCheckerArgs: []interface{}{"cannot activate with TPM sealed key \\(cannot unseal key: invalid key data file: cannot complete " +
+			"authorization policy assertions: cannot complete OR assertions: current session digest not found in policy data\\) but " +
+			"activation with recovery key was successful"},
+	})
+}
+
+func (s *cryptTPMSimulatorSuite) TestActivateVolumeWithSealedKeyUnsealErrorHandler(c *C) {
+	k, err := ReadSealedKeyObject(s.keyFile)
+	c.Assert(err, IsNil)
+
+	testPIN := "1234"
+	c.Assert(k.ChangePIN(s.TPM, "", testPIN), IsNil)
+	s.addTryPassphrases(c, []string{"", "5678", testPIN})
+
+	type handlerCall struct {
+		path string
+		err  error
+	}
+	var calls []handlerCall
+
+	options := secboot.ActivateVolumeOptions{
+		PassphraseTries: 3,
+		UnsealErrorHandler: func(keyPath string, err error) {
+			calls = append(calls, handlerCall{keyPath, err})
+		}}
+	success, err := ActivateVolumeWithSealedKey(s.TPM, "data", "/dev/sda1", s.keyFile, nil, &options)
+	c.Check(success, Equals, true)
+	c.Check(err, IsNil)
+
+	c.Check(s.mockSdAskPassword.Calls(), HasLen, 3)
+	c.Assert(s.mockLUKS2ActivateCalls, HasLen, 1)
+
+	c.Assert(calls, HasLen, 2)
+	for _, call := range calls {
+		c.Check(call.path, Equals, s.keyFile)
+		c.Check(xerrors.Is(call.err, ErrPINFail), Equals, true)
+	}
+}
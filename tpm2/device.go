@@ -0,0 +1,184 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+var (
+	devPath   = "/dev"
+	sysfsPath = "/sys"
+)
+
+// TPMDeviceType describes how a TPM device is implemented.
+type TPMDeviceType int
+
+const (
+	// TPMDeviceTypeUnknown indicates that the implementation of a TPM device could not be
+	// determined.
+	TPMDeviceTypeUnknown TPMDeviceType = iota
+
+	// TPMDeviceTypeDiscrete indicates that a TPM device is a discrete TPM, connected via
+	// a TIS compatible interface.
+	TPMDeviceTypeDiscrete
+
+	// TPMDeviceTypeFirmware indicates that a TPM device is a firmware TPM, such as Intel PTT,
+	// AMD fTPM or a TPM implemented as a trusted application in a TEE.
+	TPMDeviceTypeFirmware
+)
+
+func (t TPMDeviceType) String() string {
+	switch t {
+	case TPMDeviceTypeDiscrete:
+		return "discrete"
+	case TPMDeviceTypeFirmware:
+		return "firmware"
+	default:
+		return "unknown"
+	}
+}
+
+// firmwareTPMDrivers are the kernel drivers that are used for firmware TPMs. Note that tpm_crb
+// is used for both Intel PTT and AMD fTPM, although it could in theory be used for a discrete
+// TPM as well.
+var firmwareTPMDrivers = map[string]bool{
+	"tpm_crb":      true,
+	"ftpm-tee":     true,
+	"tpm_ftpm_tee": true}
+
+// TPMDeviceOpener is implemented by types that can open a connection to a TPM.
+type TPMDeviceOpener interface {
+	Open() (tpm2.TCTI, error)
+}
+
+// TPMDevice corresponds to a TPM character device.
+type TPMDevice struct {
+	Path                string        // Path of the direct character device, eg, /dev/tpm0
+	ResourceManagerPath string        // Path of the kernel resource manager character device, eg, /dev/tpmrm0. Empty for TPM 1.2 devices.
+	MajorVersion        int           // Major version of the TPM specification that the device implements (1 or 2)
+	Type                TPMDeviceType // How the device is implemented
+}
+
+// Open opens the direct character device for this TPM. An error that wraps ErrNoTPM2Device is
+// returned if this is a TPM 1.2 device.
+func (d *TPMDevice) Open() (tpm2.TCTI, error) {
+	if d.MajorVersion != 2 {
+		return nil, xerrors.Errorf("%s is a TPM %d.x device which is not supported: %w", d.Path, d.MajorVersion, ErrNoTPM2Device)
+	}
+	return tpm2.OpenTPMDevice(d.Path)
+}
+
+// MssimDevice corresponds to a TPM simulator that implements the Microsoft TPM2 simulator
+// interface, such as the IBM or MS reference simulators. It is intended for testing.
+type MssimDevice struct {
+	Host string // The host that the simulator is running on. Empty for localhost.
+	Port uint   // The TPM command port. The platform port is assumed to be Port+1.
+}
+
+// Open opens a connection to the simulator.
+func (d *MssimDevice) Open() (tpm2.TCTI, error) {
+	return tpm2.OpenMssim(d.Host, d.Port, d.Port+1)
+}
+
+func readTPMDeviceMajorVersion(sysfsDir string) (int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(sysfsDir, "tpm_version_major"))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+func readTPMDeviceType(sysfsDir string) TPMDeviceType {
+	driver, err := filepath.EvalSymlinks(filepath.Join(sysfsDir, "device", "driver"))
+	if err != nil {
+		return TPMDeviceTypeUnknown
+	}
+	driver = filepath.Base(driver)
+	switch {
+	case firmwareTPMDrivers[driver]:
+		return TPMDeviceTypeFirmware
+	case strings.HasPrefix(driver, "tpm_tis") || strings.HasPrefix(driver, "tpm_i2c"):
+		return TPMDeviceTypeDiscrete
+	default:
+		return TPMDeviceTypeUnknown
+	}
+}
+
+// ListTPMDevices returns a list of the TPM devices that are present, obtained from sysfs. This
+// includes TPM 1.2 devices, which are not supported by this package but which are included so
+// that callers can report a useful error.
+//
+// The type of each device is determined from the kernel driver that it is bound to, and is
+// TPMDeviceTypeUnknown if it cannot be determined.
+func ListTPMDevices() (out []*TPMDevice, err error) {
+	dirs, err := filepath.Glob(filepath.Join(sysfsPath, "class", "tpm", "tpm[0-9]*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(dirs)
+
+	for _, dir := range dirs {
+		name := filepath.Base(dir)
+		n, err := strconv.Atoi(strings.TrimPrefix(name, "tpm"))
+		if err != nil {
+			continue
+		}
+
+		dev := &TPMDevice{
+			Path: filepath.Join(devPath, name),
+			Type: readTPMDeviceType(dir)}
+
+		rmPath := filepath.Join(devPath, fmt.Sprintf("tpmrm%d", n))
+		_, rmErr := os.Stat(rmPath)
+
+		dev.MajorVersion, err = readTPMDeviceMajorVersion(dir)
+		switch {
+		case err == nil:
+		case os.IsNotExist(err):
+			// Older kernels don't expose tpm_version_major. Only TPM2 devices have a
+			// resource manager.
+			dev.MajorVersion = 1
+			if rmErr == nil {
+				dev.MajorVersion = 2
+			}
+		default:
+			return nil, xerrors.Errorf("cannot determine version of %s: %w", name, err)
+		}
+
+		if dev.MajorVersion == 2 && rmErr == nil {
+			dev.ResourceManagerPath = rmPath
+		}
+
+		out = append(out, dev)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,185 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"crypto"
+	"io/ioutil"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+var machineIDPath = "/etc/machine-id"
+
+// DeviceIdentityBinding specifies whether the identity of the device that a sealed key object is created on is
+// recorded in its metadata, and whether it is enforced when the sealed key object is unsealed.
+type DeviceIdentityBinding uint8
+
+const (
+	// DeviceIdentityBindingNone indicates that the identity of the device is not recorded.
+	DeviceIdentityBindingNone DeviceIdentityBinding = iota
+
+	// DeviceIdentityBindingRecord indicates that the identity of the device is recorded, but is only checked by
+	// SealedKeyObject.CheckDeviceIdentity.
+	DeviceIdentityBindingRecord
+
+	// DeviceIdentityBindingEnforce indicates that the identity of the device is recorded, and that it is checked by
+	// SealedKeyObject.UnsealFromTPM before the sealed key object is loaded in to the TPM.
+	DeviceIdentityBindingEnforce
+)
+
+// deviceIdentity identifies the device that a sealed key object was created on. It consists of a digest of the
+// systemd machine ID and the name of the TPM's endorsement key.
+//
+// A sealed key object can only be loaded by the TPM whose storage hierarchy it was created in, but this doesn't
+// distinguish between devices that were cloned from the same image along with their virtual TPM state. Such
+// devices have the same PCR values, so a key file copied between them would otherwise unseal silently.
+type deviceIdentity struct {
+	binding         DeviceIdentityBinding
+	machineIDDigest tpm2.Digest
+	ekName          tpm2.Name
+}
+
+// deviceIdentityRaw_v0 is version 0 of the on-disk format of deviceIdentity.
+type deviceIdentityRaw_v0 struct {
+	Binding         DeviceIdentityBinding
+	MachineIDDigest tpm2.Digest
+	EKName          tpm2.Name
+}
+
+func (r *deviceIdentityRaw_v0) data() *deviceIdentity {
+	if r.Binding == DeviceIdentityBindingNone {
+		return nil
+	}
+	return &deviceIdentity{
+		binding:         r.Binding,
+		machineIDDigest: r.MachineIDDigest,
+		ekName:          r.EKName}
+}
+
+// makeDeviceIdentityRaw_v0 converts deviceIdentity to version 0 of the on-disk format.
+func makeDeviceIdentityRaw_v0(identity *deviceIdentity) deviceIdentityRaw_v0 {
+	if identity == nil {
+		return deviceIdentityRaw_v0{}
+	}
+	return deviceIdentityRaw_v0{
+		Binding:         identity.binding,
+		MachineIDDigest: identity.machineIDDigest,
+		EKName:          identity.ekName}
+}
+
+// readMachineIDDigest returns the SHA-256 digest of the systemd machine ID. The machine ID itself isn't
+// recorded because it is meant to be kept private to the system.
+func readMachineIDDigest() (tpm2.Digest, error) {
+	id, err := ioutil.ReadFile(machineIDPath)
+	if err != nil {
+		return nil, err
+	}
+	id = bytes.TrimSpace(id)
+	if len(id) == 0 {
+		return nil, xerrors.Errorf("%s is empty", machineIDPath)
+	}
+
+	h := crypto.SHA256.New()
+	h.Write(id)
+	return h.Sum(nil), nil
+}
+
+// readEKName returns the name of the TPM's endorsement key, creating a transient endorsement key from the
+// default template if there isn't a persistent one.
+func readEKName(tpm *Connection) (tpm2.Name, error) {
+	ek, err := tpm.EndorsementKey()
+	if err == nil {
+		return ek.Name(), nil
+	}
+
+	ek, err = createTransientEk(tpm.TPMContext)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create endorsement key: %w", err)
+	}
+	defer tpm.FlushContext(ek)
+	return ek.Name(), nil
+}
+
+// readDeviceIdentity returns the identity of the device that tpm belongs to, or nil if binding is
+// DeviceIdentityBindingNone.
+func readDeviceIdentity(tpm *Connection, binding DeviceIdentityBinding) (*deviceIdentity, error) {
+	switch binding {
+	case DeviceIdentityBindingNone:
+		return nil, nil
+	case DeviceIdentityBindingRecord, DeviceIdentityBindingEnforce:
+	default:
+		return nil, xerrors.Errorf("invalid device identity binding (%d)", binding)
+	}
+
+	machineIDDigest, err := readMachineIDDigest()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read machine ID: %w", err)
+	}
+	ekName, err := readEKName(tpm)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain endorsement key name: %w", err)
+	}
+
+	return &deviceIdentity{
+		binding:         binding,
+		machineIDDigest: machineIDDigest,
+		ekName:          ekName}, nil
+}
+
+// check verifies that the identity of the device that tpm belongs to matches this identity. If it doesn't,
+// ErrWrongDevice is returned.
+func (i *deviceIdentity) check(tpm *Connection) error {
+	current, err := readDeviceIdentity(tpm, i.binding)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(current.machineIDDigest, i.machineIDDigest) || !bytes.Equal(current.ekName, i.ekName) {
+		return ErrWrongDevice
+	}
+	return nil
+}
+
+// DeviceIdentityBinding indicates whether the identity of the device that this sealed key object was created on is
+// recorded in its metadata, and whether it is enforced by UnsealFromTPM. This is always DeviceIdentityBindingNone
+// for sealed key objects with a metadata version earlier than 6.
+func (k *SealedKeyObject) DeviceIdentityBinding() DeviceIdentityBinding {
+	if k.data.deviceIdentity == nil {
+		return DeviceIdentityBindingNone
+	}
+	return k.data.deviceIdentity.binding
+}
+
+// CheckDeviceIdentity verifies that the identity of the device that this sealed key object was created on, if it was
+// recorded, matches the identity of the current device. The identity consists of the systemd machine ID and the name of
+// the endorsement key of the supplied TPM. If the identity doesn't match, a ErrWrongDevice error is returned. If no
+// identity was recorded, this function always succeeds.
+//
+// This can be used to detect a key file that was copied from another device, regardless of whether the identity is
+// enforced by UnsealFromTPM.
+func (k *SealedKeyObject) CheckDeviceIdentity(tpm *Connection) error {
+	if k.data.deviceIdentity == nil {
+		return nil
+	}
+	return k.data.deviceIdentity.check(tpm)
+}
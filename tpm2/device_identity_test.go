@@ -0,0 +1,138 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+func TestSealKeyWithDeviceIdentity(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestSealKeyWithDeviceIdentity_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	machineIDPath := filepath.Join(tmpDir, "machine-id")
+	restore := MockMachineIDPath(machineIDPath)
+	defer restore()
+
+	run := func(t *testing.T, binding DeviceIdentityBinding, sealMachineID, unsealMachineID string) (*SealedKeyObject, error) {
+		keyFile := filepath.Join(tmpDir, "keydata")
+		defer os.Remove(keyFile)
+
+		if err := ioutil.WriteFile(machineIDPath, []byte(sealMachineID+"\n"), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+
+		params := KeyCreationParams{
+			PCRProfile:             getTestPCRProfile(),
+			PCRPolicyCounterHandle: tpm2.HandleNull,
+			DeviceIdentityBinding:  binding}
+		if _, err := SealKeyToTPM(tpm, key, keyFile, &params); err != nil {
+			t.Fatalf("SealKeyToTPM failed: %v", err)
+		}
+
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		if k.DeviceIdentityBinding() != binding {
+			t.Errorf("Unexpected device identity binding: %v", k.DeviceIdentityBinding())
+		}
+
+		if err := ioutil.WriteFile(machineIDPath, []byte(unsealMachineID+"\n"), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+
+		unsealedKey, _, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			return k, err
+		}
+		if !bytes.Equal(unsealedKey, key) {
+			t.Errorf("Unexpected key")
+		}
+		return k, nil
+	}
+
+	t.Run("NoBinding", func(t *testing.T) {
+		k, err := run(t, DeviceIdentityBindingNone, "5c8d3f1ea8b04c6ba2f4f8e3b1d0a9c7", "0f1e2d3c4b5a69788796a5b4c3d2e1f0")
+		if err != nil {
+			t.Errorf("UnsealFromTPM failed: %v", err)
+		}
+		if err := k.CheckDeviceIdentity(tpm); err != nil {
+			t.Errorf("CheckDeviceIdentity failed: %v", err)
+		}
+	})
+
+	t.Run("EnforceSameDevice", func(t *testing.T) {
+		k, err := run(t, DeviceIdentityBindingEnforce, "5c8d3f1ea8b04c6ba2f4f8e3b1d0a9c7", "5c8d3f1ea8b04c6ba2f4f8e3b1d0a9c7")
+		if err != nil {
+			t.Errorf("UnsealFromTPM failed: %v", err)
+		}
+		if err := k.CheckDeviceIdentity(tpm); err != nil {
+			t.Errorf("CheckDeviceIdentity failed: %v", err)
+		}
+	})
+
+	t.Run("EnforceWrongDevice", func(t *testing.T) {
+		k, err := run(t, DeviceIdentityBindingEnforce, "5c8d3f1ea8b04c6ba2f4f8e3b1d0a9c7", "0f1e2d3c4b5a69788796a5b4c3d2e1f0")
+		if err != ErrWrongDevice {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		verdict, err := k.CheckUnsealable(tpm)
+		if err != nil {
+			t.Errorf("CheckUnsealable failed: %v", err)
+		}
+		if verdict != UnsealVerdictWrongDevice {
+			t.Errorf("Unexpected verdict: %v", verdict)
+		}
+	})
+
+	t.Run("RecordWrongDevice", func(t *testing.T) {
+		// The identity is recorded but not enforced, so unsealing succeeds.
+		k, err := run(t, DeviceIdentityBindingRecord, "5c8d3f1ea8b04c6ba2f4f8e3b1d0a9c7", "0f1e2d3c4b5a69788796a5b4c3d2e1f0")
+		if err != nil {
+			t.Errorf("UnsealFromTPM failed: %v", err)
+		}
+		if err := k.CheckDeviceIdentity(tpm); err != ErrWrongDevice {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
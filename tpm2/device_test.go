@@ -0,0 +1,190 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/testutil"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type mockTPMDevice struct {
+	name    string
+	version string
+	driver  string
+	rm      bool
+}
+
+func makeMockTPMDevices(t *testing.T, devices []mockTPMDevice) (dev, sysfs string) {
+	dir, err := ioutil.TempDir("", "_TestListTPMDevices_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	dev = filepath.Join(dir, "dev")
+	sysfs = filepath.Join(dir, "sys")
+
+	for _, d := range devices {
+		devDir := filepath.Join(sysfs, "class", "tpm", d.name)
+		if err := os.MkdirAll(filepath.Join(devDir, "device"), 0755); err != nil {
+			t.Fatalf("MkdirAll failed: %v", err)
+		}
+		if d.version != "" {
+			if err := ioutil.WriteFile(filepath.Join(devDir, "tpm_version_major"), []byte(d.version+"\n"), 0644); err != nil {
+				t.Fatalf("WriteFile failed: %v", err)
+			}
+		}
+		if d.driver != "" {
+			driverDir := filepath.Join(sysfs, "bus", "platform", "drivers", d.driver)
+			if err := os.MkdirAll(driverDir, 0755); err != nil {
+				t.Fatalf("MkdirAll failed: %v", err)
+			}
+			if err := os.Symlink(driverDir, filepath.Join(devDir, "device", "driver")); err != nil {
+				t.Fatalf("Symlink failed: %v", err)
+			}
+		}
+
+		if err := os.MkdirAll(dev, 0755); err != nil {
+			t.Fatalf("MkdirAll failed: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dev, d.name), nil, 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		if d.rm {
+			if err := ioutil.WriteFile(filepath.Join(dev, "tpmrm"+d.name[3:]), nil, 0644); err != nil {
+				t.Fatalf("WriteFile failed: %v", err)
+			}
+		}
+	}
+
+	return dev, sysfs
+}
+
+func TestListTPMDevices(t *testing.T) {
+	for _, data := range []struct {
+		desc     string
+		devices  []mockTPMDevice
+		expected func(dev string) []*TPMDevice
+	}{
+		{
+			desc:     "None",
+			expected: func(string) []*TPMDevice { return nil },
+		},
+		{
+			desc:    "Discrete",
+			devices: []mockTPMDevice{{name: "tpm0", version: "2", driver: "tpm_tis", rm: true}},
+			expected: func(dev string) []*TPMDevice {
+				return []*TPMDevice{
+					{Path: filepath.Join(dev, "tpm0"), ResourceManagerPath: filepath.Join(dev, "tpmrm0"), MajorVersion: 2, Type: TPMDeviceTypeDiscrete}}
+			},
+		},
+		{
+			desc:    "Firmware",
+			devices: []mockTPMDevice{{name: "tpm0", version: "2", driver: "tpm_crb", rm: true}},
+			expected: func(dev string) []*TPMDevice {
+				return []*TPMDevice{
+					{Path: filepath.Join(dev, "tpm0"), ResourceManagerPath: filepath.Join(dev, "tpmrm0"), MajorVersion: 2, Type: TPMDeviceTypeFirmware}}
+			},
+		},
+		{
+			desc:    "TPM12",
+			devices: []mockTPMDevice{{name: "tpm0", version: "1", driver: "tpm_tis"}},
+			expected: func(dev string) []*TPMDevice {
+				return []*TPMDevice{
+					{Path: filepath.Join(dev, "tpm0"), MajorVersion: 1, Type: TPMDeviceTypeDiscrete}}
+			},
+		},
+		{
+			desc: "NoVersionAttr",
+			devices: []mockTPMDevice{
+				{name: "tpm0", driver: "tpm_tis"},
+				{name: "tpm1", driver: "tpm_ftpm_tee", rm: true}},
+			expected: func(dev string) []*TPMDevice {
+				return []*TPMDevice{
+					{Path: filepath.Join(dev, "tpm0"), MajorVersion: 1, Type: TPMDeviceTypeDiscrete},
+					{Path: filepath.Join(dev, "tpm1"), ResourceManagerPath: filepath.Join(dev, "tpmrm1"), MajorVersion: 2, Type: TPMDeviceTypeFirmware}}
+			},
+		},
+		{
+			desc:    "UnknownDriver",
+			devices: []mockTPMDevice{{name: "tpm0", version: "2", rm: true}},
+			expected: func(dev string) []*TPMDevice {
+				return []*TPMDevice{
+					{Path: filepath.Join(dev, "tpm0"), ResourceManagerPath: filepath.Join(dev, "tpmrm0"), MajorVersion: 2, Type: TPMDeviceTypeUnknown}}
+			},
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			dev, sysfs := makeMockTPMDevices(t, data.devices)
+			defer os.RemoveAll(filepath.Dir(dev))
+			restore := MockTPMDevicePaths(dev, sysfs)
+			defer restore()
+
+			devices, err := ListTPMDevices()
+			if err != nil {
+				t.Fatalf("ListTPMDevices failed: %v", err)
+			}
+			if expected := data.expected(dev); !reflect.DeepEqual(devices, expected) {
+				t.Errorf("Unexpected devices: %v", devices)
+			}
+		})
+	}
+}
+
+func TestConnectToTPM12Device(t *testing.T) {
+	device := &TPMDevice{Path: "/dev/tpm0", MajorVersion: 1}
+	tpm, err := ConnectToDefaultTPMWithOptions(&ConnectionOptions{Device: device})
+	if tpm != nil {
+		t.Errorf("ConnectToDefaultTPMWithOptions should have failed")
+	}
+	if !xerrors.Is(err, ErrNoTPM2Device) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestConnectToMssimDevice(t *testing.T) {
+	if !testutil.UseMssim {
+		t.SkipNow()
+	}
+
+	restore := testutil.MockOpenDefaultTctiFn(func() (tpm2.TCTI, error) {
+		t.Errorf("Default TCTI shouldn't be used")
+		return nil, os.ErrNotExist
+	})
+	defer restore()
+
+	tpm, err := ConnectToDefaultTPMWithOptions(&ConnectionOptions{Device: &MssimDevice{Port: testutil.MssimPort}})
+	if err != nil {
+		t.Fatalf("ConnectToDefaultTPMWithOptions failed: %v", err)
+	}
+	defer closeTPM(t, tpm)
+
+	if err := tpm.Ping(); err != nil {
+		t.Errorf("Ping failed: %v", err)
+	}
+}
@@ -44,6 +44,11 @@ var (
 	// incorrect provisioning in all contexts.
 	ErrTPMProvisioning = errors.New("the TPM is not correctly provisioned")
 
+	// ErrNoStorageRootKey is returned from SealedKeyObject.UnsealFromTPM if there is no object at the persistent handle of the
+	// storage key that the sealed key object was created under. Calling Connection.EnsureProvisioned may resolve this if the TPM
+	// owner hasn't changed.
+	ErrNoStorageRootKey = errors.New("the TPM does not have a storage root key")
+
 	// ErrTPMLockout is returned from any function when the TPM is in dictionary-attack lockout mode. Until
 	// the TPM exits lockout mode, the key will need to be recovered via a mechanism that is independent of
 	// the TPM (eg, a recovery key)
@@ -52,8 +57,53 @@ var (
 	// ErrPINFail is returned from SealedKeyObject.UnsealFromTPM if the provided PIN is incorrect.
 	ErrPINFail = errors.New("the provided PIN is incorrect")
 
+	// ErrPINAttemptLimitReached is returned from SealedKeyObject.UnsealFromTPM or SealedKeyObject.ChangePIN if the sealed key
+	// object has a PIN attempt limit and the maximum number of consecutive incorrect PIN attempts has been reached. The
+	// sealed key object can no longer be unsealed, and the associated volume must be recovered by other means.
+	ErrPINAttemptLimitReached = errors.New("the maximum number of incorrect PIN attempts has been reached")
+
+	// ErrPCRPolicyRevoked indicates that the PCR policy of a sealed key object has been revoked by a subsequent PCR policy update.
+	// The InvalidKeyFileError returned from SealedKeyObject.UnsealFromTPM in this case wraps this error, and it can be tested
+	// for with xerrors.Is.
+	ErrPCRPolicyRevoked = errors.New("the PCR policy has been revoked")
+
+	// ErrKeyExpired is returned from SealedKeyObject.UnsealFromTPM if the sealed key object was created with a limited lifetime
+	// (see the ClockLimit and BootLimit fields of KeyCreationParams) and this has been exceeded. The sealed key object can no
+	// longer be unsealed.
+	ErrKeyExpired = errors.New("the sealed key object has expired")
+
+	// ErrLocalityNotPermitted is returned from SealedKeyObject.UnsealFromTPM if the sealed key object was created with a
+	// locality restriction (see the PermittedLocalities field of KeyCreationParams) and the connection to the TPM is not using
+	// one of the permitted localities.
+	ErrLocalityNotPermitted = errors.New("the sealed key object cannot be unsealed from the current locality")
+
+	// ErrSealedKeyAccessLocked is returned from SealedKeyObject.UnsealFromTPM if the sealed key object was created with a lock
+	// index (see the LockIndexHandle field of KeyCreationParams) that has been locked with LockSealedKeyAccess. Access remains
+	// locked until the next TPM reset or restart, or until UnlockSealedKeyAccess is called.
+	ErrSealedKeyAccessLocked = errors.New("access to the sealed key object is locked")
+
+	// ErrKeyVersionRevoked is returned from SealedKeyObject.UnsealFromTPM if the sealed key object was created with a rollback
+	// counter (see the RollbackCounterHandle field of KeyCreationParams) that has since been advanced beyond the version recorded
+	// in it with AdvanceRollbackCounter. The sealed key object can no longer be unsealed.
+	ErrKeyVersionRevoked = errors.New("the version of the sealed key object has been revoked by its rollback counter")
+
+	// ErrWrongDevice is returned from SealedKeyObject.UnsealFromTPM if the sealed key object was created with its device
+	// identity enforced (see the DeviceIdentityBinding field of KeyCreationParams) and the current device has a different
+	// identity, which indicates that the key file has been copied from another device. It is also returned from
+	// SealedKeyObject.CheckDeviceIdentity.
+	ErrWrongDevice = errors.New("the sealed key object was created on a different device")
+
 	// ErrNoTPM2Device is returned from ConnectToDefaultTPM or SecureConnectToDefaultTPM if no TPM2 device is avaiable.
 	ErrNoTPM2Device = errors.New("no TPM2 device is available")
+
+	// ErrNoEncryptedSession is returned from functions that transfer key material to or from the TPM if the
+	// connection was created with the RequireEncryptedSessions option, but the connection doesn't have a
+	// session that is salted with a verified endorsement key.
+	ErrNoEncryptedSession = errors.New("no session that is salted with a verified endorsement key is available")
+
+	// ErrSystemdIncompatiblePolicy is returned from SealedKeyObject.ExportSystemdTPM2Token if the sealed key object has
+	// properties that cannot be represented by a systemd-cryptsetup TPM2 token.
+	ErrSystemdIncompatiblePolicy = errors.New("the sealed key object's policy cannot be represented by systemd-cryptsetup")
 )
 
 // TPMResourceExistsError is returned from any function that creates a persistent TPM resource if a resource already exists
@@ -80,7 +130,7 @@ func (e AuthFailError) Error() string {
 	return fmt.Sprintf("cannot access resource at handle %v because an authorization check failed", e.Handle)
 }
 
-// EKCertVerificationError is returned from SecureConnectToDefaultTPM if verification of the EK certificate against the built-in
+// EKCertVerificationError is returned from SecureConnectToDefaultTPM and VerifyEKCertificate if verification of the EK certificate against the built-in
 // root CA certificates fails, or the EK certificate does not have the correct properties, or the supplied certificate data cannot
 // be unmarshalled correctly because it is invalid.
 type EKCertVerificationError struct {
@@ -97,7 +147,7 @@ func isEKCertVerificationError(err error) bool {
 }
 
 // TPMVerificationError is returned from SecureConnectToDefaultTPM if the TPM cannot prove it is the device for which the verified
-// EK certificate was issued.
+// EK certificate was issued, and from VerifyEKCertificate if the supplied endorsement key doesn't match the certificate.
 type TPMVerificationError struct {
 	msg string
 }
@@ -114,19 +164,73 @@ func isTPMVerificationError(err error) bool {
 // InvalidKeyFileError indicates that the provided key data file is invalid. This error may also be returned in some
 // scenarious where the TPM is incorrectly provisioned, but it isn't possible to determine whether the error is with
 // the provisioning status or because the key data file is invalid.
+//
+// Where the reason is known more precisely, this error wraps a more specific error such as ErrPCRPolicyRevoked or
+// PCRPolicyMismatchError, which can be obtained with xerrors.Is or xerrors.As.
 type InvalidKeyFileError struct {
 	msg string
+	err error
 }
 
 func (e InvalidKeyFileError) Error() string {
 	return fmt.Sprintf("invalid key data file: %s", e.msg)
 }
 
+func (e InvalidKeyFileError) Unwrap() error {
+	return e.err
+}
+
 func isInvalidKeyFileError(err error) bool {
 	var e InvalidKeyFileError
 	return xerrors.As(err, &e)
 }
 
+// PCRPolicyMismatchError indicates that the TPM's current PCR values are not consistent with the PCR policy of a sealed key
+// object. The InvalidKeyFileError returned from SealedKeyObject.UnsealFromTPM in this case wraps this error.
+type PCRPolicyMismatchError struct {
+	// PCRs are the PCRs with current values that aren't permitted by any branch of the PCR policy. If each of the
+	// PCRs has a permitted value but the combination of values isn't permitted, or the permitted values weren't
+	// recorded in the sealed key object, this is the complete PCR selection of the policy.
+	PCRs tpm2.PCRSelectionList
+}
+
+func (e PCRPolicyMismatchError) Error() string {
+	return fmt.Sprintf("the values of PCRs %v are not consistent with the PCR policy", e.PCRs)
+}
+
+// TPMCommunicationError is returned from SealedKeyObject.UnsealFromTPM if a command could not be sent to or a response
+// could not be received from the TPM.
+type TPMCommunicationError struct {
+	err error
+}
+
+func (e TPMCommunicationError) Error() string {
+	return fmt.Sprintf("cannot communicate with the TPM: %v", e.err)
+}
+
+func (e TPMCommunicationError) Unwrap() error {
+	return e.err
+}
+
+// UnsealAuditError is returned from SealedKeyObject.UnsealFromTPMWithAudit if unsealing fails.
+type UnsealAuditError struct {
+	// Err is the error that caused unsealing to fail.
+	Err error
+
+	// AuditInfo is the attestation structure returned from TPM2_GetSessionAuditDigest for the audit session used for
+	// unsealing. The TPM only includes successful commands in the audit digest, so this identifies the sequence of commands
+	// that completed before the one that failed. This will be nil if the audit digest could not be obtained.
+	AuditInfo *tpm2.Attest
+}
+
+func (e *UnsealAuditError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *UnsealAuditError) Unwrap() error {
+	return e.Err
+}
+
 // ActivateWithSealedKeyError is returned from ActivateVolumeWithSealedKey if activation with the TPM protected key failed.
 type ActivateWithSealedKeyError struct {
 	// TPMErr details the error that occurred during activation with the TPM sealed key.
@@ -168,3 +272,20 @@ func (e *ActivateWithMultipleSealedKeysError) Error() string {
 	}
 	return s.String()
 }
+
+// ActivateWithNVKeyError is returned from ActivateVolumeWithNVKey if activation with the key stored in a TPM NV index failed.
+type ActivateWithNVKeyError struct {
+	// NVKeyErr details the error that occurred during activation with the key stored in the TPM NV index.
+	NVKeyErr error
+
+	// RecoveryKeyUsageErr details the error that occurred during activation with the fallback recovery key, if activation with the
+	// recovery key was also unsuccessful.
+	RecoveryKeyUsageErr error
+}
+
+func (e *ActivateWithNVKeyError) Error() string {
+	if e.RecoveryKeyUsageErr != nil {
+		return fmt.Sprintf("cannot activate with TPM NV key (%v) and activation with recovery key failed (%v)", e.NVKeyErr, e.RecoveryKeyUsageErr)
+	}
+	return fmt.Sprintf("cannot activate with TPM NV key (%v) but activation with recovery key was successful", e.NVKeyErr)
+}
@@ -39,6 +39,7 @@ const (
 var (
 	ComputeDynamicPolicy                  = computeDynamicPolicy
 	CreatePcrPolicyCounter                = createPcrPolicyCounter
+	CreatePinIndex                        = createPinIndex
 	ComputePcrPolicyCounterAuthPolicies   = computePcrPolicyCounterAuthPolicies
 	ComputePcrPolicyRefFromCounterContext = computePcrPolicyRefFromCounterContext
 	ComputePcrPolicyRefFromCounterName    = computePcrPolicyRefFromCounterName
@@ -53,6 +54,8 @@ var (
 	LockNVIndex1Attrs                     = lockNVIndex1Attrs
 	PerformPinChange                      = performPinChange
 	ReadPcrPolicyCounter                  = readPcrPolicyCounter
+	SystemdPrimaryTemplate                = &systemdPrimaryTemplate
+	WrapTctiForLogging                    = wrapTctiForLogging
 )
 
 // Alias some unexported types for testing. These are required in order to pass these between functions in tests, or to access
@@ -110,6 +113,25 @@ func MockActivateVolumeWithRecoveryKey(fn func(string, string, io.Reader, *secbo
 	}
 }
 
+func MockTPMDevicePaths(dev, sysfs string) (restore func()) {
+	origDev := devPath
+	origSysfs := sysfsPath
+	devPath = dev
+	sysfsPath = sysfs
+	return func() {
+		devPath = origDev
+		sysfsPath = origSysfs
+	}
+}
+
+func MockMachineIDPath(path string) (restore func()) {
+	orig := machineIDPath
+	machineIDPath = path
+	return func() {
+		machineIDPath = orig
+	}
+}
+
 func MockLUKS2Activate(fn func(string, string, []byte) error) (restore func()) {
 	orig := luks2Activate
 	luks2Activate = fn
@@ -180,7 +202,7 @@ func ValidateKeyDataFile(tpm *tpm2.TPMContext, keyFile string, authPrivateKey Po
 		return err
 	}
 
-	authKey, err := createECDSAPrivateKeyFromTPM(k.data.staticPolicyData.authPublicKey, tpm2.ECCParameter(authPrivateKey))
+	authKey, err := createPolicyAuthKeyFromTPM(k.data.staticPolicyData.authPublicKey, authPrivateKey)
 	if err != nil {
 		return err
 	}
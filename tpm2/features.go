@@ -0,0 +1,171 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// LockoutParameters contains the dictionary attack protection parameters of a TPM.
+type LockoutParameters struct {
+	MaxAuthFail uint32 // The number of authorization failures before the TPM enters lockout mode
+	Counter     uint32 // The current number of authorization failures
+	Interval    uint32 // The number of seconds before the authorization failure count is decremented
+	Recovery    uint32 // The number of seconds after a lockout hierarchy authorization failure before it can be used again
+	InLockout   bool   // Whether the TPM is currently in lockout mode
+}
+
+// FeatureReport describes the capabilities of a TPM device.
+type FeatureReport struct {
+	SpecLevel    uint32 // The level of the TPM library specification that the TPM implements
+	SpecRevision uint32 // The revision of the TPM library specification, multiplied by 100
+	SpecYear     uint32 // The year of the TPM library specification version
+
+	Manufacturer    tpm2.TPMManufacturer
+	VendorString    string
+	FirmwareVersion uint64
+
+	// Algorithms is a list of all of the algorithms supported by the TPM.
+	Algorithms []tpm2.AlgorithmId
+
+	// PCRBanks is a list of the PCR banks that are currently active.
+	PCRBanks []tpm2.HashAlgorithmId
+
+	// The TPM doesn't report how much NV memory remains for defining new indices - the
+	// only way to find out whether an index of a particular size can be defined is to
+	// attempt to define it. These fields describe what it does report.
+	NVIndexMaxSize             uint32 // The maximum size in bytes of a single NV index
+	NVIndicesDefined           uint32 // The number of NV indices that are currently defined
+	NVCountersAvailable        uint32 // An estimate of the number of additional NV counter indices that can be defined
+	PersistentHandlesAvailable uint32 // An estimate of the number of additional persistent objects that can be created
+
+	Lockout LockoutParameters
+
+	// PlatformHierarchyEnabled indicates whether the platform hierarchy is enabled. On
+	// most PC platforms, the platform firmware disables the platform hierarchy before
+	// booting the OS.
+	PlatformHierarchyEnabled bool
+}
+
+// SupportsAlgorithm indicates whether the TPM supports the specified algorithm.
+func (r *FeatureReport) SupportsAlgorithm(alg tpm2.AlgorithmId) bool {
+	for _, a := range r.Algorithms {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPCRBank indicates whether the PCR bank for the specified digest algorithm is active.
+func (r *FeatureReport) HasPCRBank(alg tpm2.HashAlgorithmId) bool {
+	for _, a := range r.PCRBanks {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// getTPMProperties returns the values of the TPM properties in the range [first, first+count) as a map. Properties
+// that aren't returned by the TPM are omitted.
+func getTPMProperties(tpm *Connection, first tpm2.Property, count uint32) (map[tpm2.Property]uint32, error) {
+	props, err := tpm.GetCapabilityTPMProperties(first, count, tpm.HmacSession().IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[tpm2.Property]uint32)
+	for _, p := range props {
+		if p.Property >= first+tpm2.Property(count) {
+			break
+		}
+		out[p.Property] = p.Value
+	}
+	return out, nil
+}
+
+// QueryFeatures returns a report of the capabilities of the supplied TPM, which includes the version of the TPM
+// library specification that it implements, details about the manufacturer and firmware version, the supported
+// algorithms and active PCR banks, the NV limits that the TPM reports, the dictionary attack protection
+// parameters and whether the platform hierarchy is enabled.
+//
+// This is intended to be used by installers to log details about the TPM, and to make decisions such as which
+// PCR bank to use without having to interpret the results of TPM2_GetCapability directly.
+func QueryFeatures(tpm *Connection) (*FeatureReport, error) {
+	fixed, err := getTPMProperties(tpm, tpm2.PropertyLevel, uint32(tpm2.PropertyNVIndexMax-tpm2.PropertyLevel)+1)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain fixed properties: %w", err)
+	}
+
+	vendor := new(bytes.Buffer)
+	for _, p := range []tpm2.Property{tpm2.PropertyVendorString1, tpm2.PropertyVendorString2, tpm2.PropertyVendorString3, tpm2.PropertyVendorString4} {
+		binary.Write(vendor, binary.BigEndian, fixed[p])
+	}
+
+	report := &FeatureReport{
+		SpecLevel:       fixed[tpm2.PropertyLevel],
+		SpecRevision:    fixed[tpm2.PropertyRevision],
+		SpecYear:        fixed[tpm2.PropertyYear],
+		Manufacturer:    tpm2.TPMManufacturer(fixed[tpm2.PropertyManufacturer]),
+		VendorString:    string(bytes.TrimRight(vendor.Bytes(), "\x00 ")),
+		FirmwareVersion: uint64(fixed[tpm2.PropertyFirmwareVersion1])<<32 | uint64(fixed[tpm2.PropertyFirmwareVersion2]),
+		NVIndexMaxSize:  fixed[tpm2.PropertyNVIndexMax]}
+
+	algs, err := tpm.GetCapabilityAlgs(tpm2.AlgorithmFirst, tpm2.CapabilityMaxProperties, tpm.HmacSession().IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain supported algorithms: %w", err)
+	}
+	for _, alg := range algs {
+		report.Algorithms = append(report.Algorithms, alg.Alg)
+	}
+
+	pcrs, err := tpm.GetCapabilityPCRs(tpm.HmacSession().IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain active PCR banks: %w", err)
+	}
+	for _, bank := range pcrs {
+		if len(bank.Select) == 0 {
+			continue
+		}
+		report.PCRBanks = append(report.PCRBanks, bank.Hash)
+	}
+
+	handles, err := getTPMProperties(tpm, tpm2.PropertyHRNVIndex, uint32(tpm2.PropertyNVCountersAvail-tpm2.PropertyHRNVIndex)+1)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain handle properties: %w", err)
+	}
+	report.NVIndicesDefined = handles[tpm2.PropertyHRNVIndex]
+	report.NVCountersAvailable = handles[tpm2.PropertyNVCountersAvail]
+	report.PersistentHandlesAvailable = handles[tpm2.PropertyHRPersistentAvail]
+
+	variable, err := readLockoutProperties(tpm)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain variable properties: %w", err)
+	}
+	report.Lockout = makeLockoutParameters(variable)
+	report.PlatformHierarchyEnabled = tpm2.StartupClearAttributes(variable[tpm2.PropertyStartupClear])&tpm2.AttrPhEnable > 0
+
+	return report, nil
+}
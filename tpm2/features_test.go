@@ -0,0 +1,88 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+func TestQueryFeatures(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	report, err := QueryFeatures(tpm)
+	if err != nil {
+		t.Fatalf("QueryFeatures failed: %v", err)
+	}
+
+	if report.Manufacturer != tpm2.TPMManufacturerIBM {
+		t.Errorf("Unexpected manufacturer: %v", report.Manufacturer)
+	}
+	if report.SpecRevision == 0 {
+		t.Errorf("Unexpected spec revision")
+	}
+	if !report.SupportsAlgorithm(tpm2.AlgorithmSHA256) {
+		t.Errorf("Report doesn't include SHA-256")
+	}
+	if !report.HasPCRBank(tpm2.HashAlgorithmSHA256) {
+		t.Errorf("Report doesn't include the SHA-256 PCR bank")
+	}
+	if report.NVIndexMaxSize == 0 {
+		t.Errorf("Unexpected NV index max size")
+	}
+	if report.NVCountersAvailable == 0 {
+		t.Errorf("Unexpected number of available NV counters")
+	}
+	if !report.PlatformHierarchyEnabled {
+		t.Errorf("Platform hierarchy should be enabled")
+	}
+
+	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyMaxAuthFail, 3)
+	if err != nil {
+		t.Fatalf("GetCapabilityTPMProperties failed: %v", err)
+	}
+	if report.Lockout.MaxAuthFail != props[0].Value || report.Lockout.Interval != props[1].Value || report.Lockout.Recovery != props[2].Value {
+		t.Errorf("Unexpected lockout parameters: %+v", report.Lockout)
+	}
+}
+
+func TestQueryFeaturesPlatformHierarchyDisabled(t *testing.T) {
+	tpm, tcti := openTPMSimulatorForTesting(t)
+	defer func() {
+		tpm, _ = resetTPMSimulator(t, tpm, tcti)
+		closeTPM(t, tpm)
+	}()
+
+	if err := tpm.HierarchyControl(tpm.PlatformHandleContext(), tpm2.HandlePlatform, false, nil); err != nil {
+		t.Fatalf("HierarchyControl failed: %v", err)
+	}
+
+	report, err := QueryFeatures(tpm)
+	if err != nil {
+		t.Fatalf("QueryFeatures failed: %v", err)
+	}
+	if report.PlatformHierarchyEnabled {
+		t.Errorf("Platform hierarchy should be disabled")
+	}
+}
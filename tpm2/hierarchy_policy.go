@@ -0,0 +1,188 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"encoding/binary"
+	"errors"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
+)
+
+// hierarchyAuthPolicyAlg is the digest algorithm used for hierarchy authorization policies.
+const hierarchyAuthPolicyAlg = tpm2.HashAlgorithmSHA256
+
+// HierarchyAuthPolicy corresponds to an authorization policy that can be assigned to the lockout or owner hierarchy with
+// the LockoutAuthPolicy and OwnerAuthPolicy fields of ProvisionOptions. Once assigned, the hierarchy can be authorized with a policy session created by
+// StartHierarchyAuthPolicySession instead of with its authorization value, which means that the authorization value does
+// not need to be stored anywhere.
+type HierarchyAuthPolicy struct {
+	physicalPresence bool
+	authKey          *tpm2.Public
+}
+
+// NewPhysicalPresenceHierarchyAuthPolicy returns a policy that requires the platform to assert physical presence. Note that
+// the TPM only permits this for commands that the platform has configured to require physical presence.
+func NewPhysicalPresenceHierarchyAuthPolicy() *HierarchyAuthPolicy {
+	return &HierarchyAuthPolicy{physicalPresence: true}
+}
+
+// NewSignedHierarchyAuthPolicy returns a policy that requires an authorization signed by the private part of the supplied
+// elliptic curve key.
+func NewSignedHierarchyAuthPolicy(key *ecdsa.PublicKey) *HierarchyAuthPolicy {
+	return &HierarchyAuthPolicy{authKey: createTPMPublicAreaForECDSAKey(key)}
+}
+
+// DeriveHierarchyAuthKey derives the elliptic curve key associated with a hierarchy authorization policy returned from
+// NewRecoveryKeyHierarchyAuthPolicy. The same recovery key always produces the same key, so it doesn't need to be stored.
+func DeriveHierarchyAuthKey(recoveryKey secboot.RecoveryKey) (*ecdsa.PrivateKey, error) {
+	return secboot.DeriveAuthKey(crypto.SHA256, secboot.PrimaryKey(recoveryKey[:]))
+}
+
+// NewRecoveryKeyHierarchyAuthPolicy returns a policy that requires an authorization signed by a key derived from the supplied
+// recovery key. Sessions for this policy can be created by passing the key returned from DeriveHierarchyAuthKey to
+// StartHierarchyAuthPolicySession.
+func NewRecoveryKeyHierarchyAuthPolicy(recoveryKey secboot.RecoveryKey) (*HierarchyAuthPolicy, error) {
+	key, err := DeriveHierarchyAuthKey(recoveryKey)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot derive key: %w", err)
+	}
+	return NewSignedHierarchyAuthPolicy(&key.PublicKey), nil
+}
+
+// digest computes the policy digest for this policy.
+func (p *HierarchyAuthPolicy) digest() (tpm2.Digest, error) {
+	switch {
+	case p.physicalPresence:
+		// TPM2_PolicyPhysicalPresence extends the policy digest with only its
+		// command code.
+		h := hierarchyAuthPolicyAlg.NewHash()
+		h.Write(make([]byte, hierarchyAuthPolicyAlg.Size()))
+		binary.Write(h, binary.BigEndian, tpm2.CommandPolicyPhysicalPresence)
+		return h.Sum(nil), nil
+	case p.authKey != nil:
+		keyName, err := p.authKey.Name()
+		if err != nil {
+			return nil, xerrors.Errorf("cannot compute name of signing key: %w", err)
+		}
+		trial, _ := tpm2.ComputeAuthPolicy(hierarchyAuthPolicyAlg)
+		trial.PolicySigned(keyName, nil)
+		return trial.GetDigest(), nil
+	default:
+		return nil, errors.New("invalid policy")
+	}
+}
+
+// setHierarchyAuthPolicy assigns the supplied policy to the specified hierarchy, which requires knowledge of the hierarchy's
+// authorization value.
+func setHierarchyAuthPolicy(tpm *tpm2.TPMContext, hierarchy tpm2.ResourceContext, policy *HierarchyAuthPolicy, session tpm2.SessionContext) error {
+	digest, err := policy.digest()
+	if err != nil {
+		return xerrors.Errorf("cannot compute policy digest: %w", err)
+	}
+	return tpm.SetPrimaryPolicy(hierarchy, digest, hierarchyAuthPolicyAlg, session)
+}
+
+// StartHierarchyAuthPolicySession begins a policy session and executes the assertions of the supplied policy, so that the
+// returned session can be used to authorize a command for the lockout or owner hierarchy that the policy was assigned to.
+// If the policy was created with NewSignedHierarchyAuthPolicy or NewRecoveryKeyHierarchyAuthPolicy, the private part of the
+// associated key must be supplied via the key argument. It is ignored for other policies.
+//
+// The session is flushed from the TPM once it has been used to authorize a command. The caller should flush it with
+// FlushContext if it isn't used.
+func StartHierarchyAuthPolicySession(tpm *Connection, policy *HierarchyAuthPolicy, key crypto.PrivateKey) (tpm2.SessionContext, error) {
+	if policy == nil {
+		return nil, errors.New("no policy supplied")
+	}
+
+	session, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, hierarchyAuthPolicyAlg)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot begin policy session: %w", err)
+	}
+
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		tpm.FlushContext(session)
+	}()
+
+	switch {
+	case policy.physicalPresence:
+		if err := tpm.PolicyPhysicalPresence(session); err != nil {
+			return nil, xerrors.Errorf("cannot execute assertion: %w", err)
+		}
+	case policy.authKey != nil:
+		if key == nil {
+			return nil, errors.New("no key supplied for signed policy")
+		}
+
+		signature, err := signPolicyAuthorization(key, policy.authKey, session.NonceTPM())
+		if err != nil {
+			return nil, xerrors.Errorf("cannot sign authorization: %w", err)
+		}
+
+		authKey, err := tpm.LoadExternal(nil, policy.authKey, tpm2.HandleOwner)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot load public part of key used to verify authorization signature: %w", err)
+		}
+		defer tpm.FlushContext(authKey)
+
+		if _, _, err := tpm.PolicySigned(authKey, session, true, nil, nil, 0, signature); err != nil {
+			return nil, xerrors.Errorf("cannot execute assertion: %w", err)
+		}
+	default:
+		return nil, errors.New("invalid policy")
+	}
+
+	succeeded = true
+	return session, nil
+}
+
+// ResetLockoutWithAuthPolicy resets the TPM's authorization failure count and takes it out of lockout mode in the same way as
+// ResetLockout, but authorizes the lockout hierarchy with the supplied policy rather than with its authorization value. The
+// policy must have been assigned to the lockout hierarchy with the LockoutAuthPolicy field of ProvisionOptions. See
+// StartHierarchyAuthPolicySession for a description of the key argument.
+func ResetLockoutWithAuthPolicy(tpm *Connection, policy *HierarchyAuthPolicy, key crypto.PrivateKey) error {
+	session, err := StartHierarchyAuthPolicySession(tpm, policy, key)
+	if err != nil {
+		return xerrors.Errorf("cannot create policy session: %w", err)
+	}
+
+	if err := tpm.DictionaryAttackLockReset(tpm.LockoutHandleContext(), session); err != nil {
+		tpm.FlushContext(session)
+		switch {
+		case tpm2.IsTPMSessionError(err, tpm2.ErrorPolicyFail, tpm2.CommandDictionaryAttackLockReset, 1):
+			return AuthFailError{tpm2.HandleLockout}
+		case tpm2.IsTPMWarning(err, tpm2.WarningLockout, tpm2.CommandDictionaryAttackLockReset):
+			return ErrTPMLockout
+		}
+		return xerrors.Errorf("cannot reset dictionary attack lockout: %w", err)
+	}
+
+	return nil
+}
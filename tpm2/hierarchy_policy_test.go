@@ -0,0 +1,167 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+
+	"github.com/snapcore/secboot"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+func TestResetLockoutWithAuthPolicy(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	clearTPMWithPlatformAuth(t, tpm)
+
+	var recoveryKey secboot.RecoveryKey
+	rand.Read(recoveryKey[:])
+
+	policy, err := NewRecoveryKeyHierarchyAuthPolicy(recoveryKey)
+	if err != nil {
+		t.Fatalf("NewRecoveryKeyHierarchyAuthPolicy failed: %v", err)
+	}
+	if err := tpm.EnsureProvisionedWithOptions(ProvisionModeFull, testAuth, &ProvisionOptions{LockoutAuthPolicy: policy}); err != nil {
+		t.Fatalf("EnsureProvisionedWithOptions failed: %v", err)
+	}
+
+	triggerDAFailure(t, tpm)
+
+	key, err := DeriveHierarchyAuthKey(recoveryKey)
+	if err != nil {
+		t.Fatalf("DeriveHierarchyAuthKey failed: %v", err)
+	}
+	if err := ResetLockoutWithAuthPolicy(tpm, policy, key); err != nil {
+		t.Fatalf("ResetLockoutWithAuthPolicy failed: %v", err)
+	}
+
+	status, err := QueryLockoutStatus(tpm)
+	if err != nil {
+		t.Fatalf("QueryLockoutStatus failed: %v", err)
+	}
+	if status.Counter != 0 {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+}
+
+func TestResetLockoutWithAuthPolicyWrongKey(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	clearTPMWithPlatformAuth(t, tpm)
+
+	var recoveryKey secboot.RecoveryKey
+	rand.Read(recoveryKey[:])
+
+	policy, err := NewRecoveryKeyHierarchyAuthPolicy(recoveryKey)
+	if err != nil {
+		t.Fatalf("NewRecoveryKeyHierarchyAuthPolicy failed: %v", err)
+	}
+	if err := tpm.EnsureProvisionedWithOptions(ProvisionModeFull, testAuth, &ProvisionOptions{LockoutAuthPolicy: policy}); err != nil {
+		t.Fatalf("EnsureProvisionedWithOptions failed: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	if err := ResetLockoutWithAuthPolicy(tpm, policy, key); err == nil {
+		t.Errorf("ResetLockoutWithAuthPolicy should have failed")
+	}
+}
+
+func TestProvisionWithOwnerAuthPolicy(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	clearTPMWithPlatformAuth(t, tpm)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	policy := NewSignedHierarchyAuthPolicy(&key.PublicKey)
+
+	if err := tpm.EnsureProvisionedWithOptions(ProvisionModeFull, nil, &ProvisionOptions{OwnerAuthPolicy: policy}); err != nil {
+		t.Fatalf("EnsureProvisionedWithOptions failed: %v", err)
+	}
+
+	// Set an authorization value for the storage hierarchy that we don't supply,
+	// to make sure that the policy is used.
+	setHierarchyAuthForTest(t, tpm, tpm.OwnerHandleContext())
+	tpm.OwnerHandleContext().SetAuthValue(nil)
+
+	session, err := StartHierarchyAuthPolicySession(tpm, policy, key)
+	if err != nil {
+		t.Fatalf("StartHierarchyAuthPolicySession failed: %v", err)
+	}
+
+	public := tpm2.NVPublic{
+		Index:   0x0181fff3,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead),
+		Size:    8}
+	index, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, &public, session)
+	if err != nil {
+		t.Fatalf("NVDefineSpace failed: %v", err)
+	}
+
+	session, err = StartHierarchyAuthPolicySession(tpm, policy, key)
+	if err != nil {
+		t.Fatalf("StartHierarchyAuthPolicySession failed: %v", err)
+	}
+	if err := tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, session); err != nil {
+		t.Errorf("NVUndefineSpace failed: %v", err)
+	}
+}
+
+func TestProvisionWithLockoutAuthPolicyWithoutLockout(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	clearTPMWithPlatformAuth(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, testAuth); err != nil {
+		t.Fatalf("EnsureProvisioned failed: %v", err)
+	}
+
+	err := tpm.EnsureProvisionedWithOptions(ProvisionModeWithoutLockout, nil, &ProvisionOptions{LockoutAuthPolicy: NewPhysicalPresenceHierarchyAuthPolicy()})
+	if err != ErrTPMProvisioningRequiresLockout {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
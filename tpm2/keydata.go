@@ -46,9 +46,10 @@ import (
 )
 
 const (
-	currentMetadataVersion    uint32 = 2
+	currentMetadataVersion    uint32 = 8
 	keyDataHeader             uint32 = 0x55534b24
 	keyPolicyUpdateDataHeader uint32 = 0x55534b50
+	keyDataGenerationMagic    uint32 = 0x55534b47
 )
 
 type authMode uint8
@@ -259,6 +260,82 @@ type keyDataRaw_v2 struct {
 	DynamicPolicyData *dynamicPolicyDataRaw_v0
 }
 
+// keyDataRaw_v3 is version 3 of the on-disk format of keyDataRaw.
+type keyDataRaw_v3 struct {
+	KeyPrivate        tpm2.Private
+	KeyPublic         *tpm2.Public
+	AuthModeHint      authMode
+	ImportSymSeed     tpm2.EncryptedSecret
+	StaticPolicyData  *staticPolicyDataRaw_v1
+	DynamicPolicyData *dynamicPolicyDataRaw_v0
+	SRKHandle         tpm2.Handle
+	SRKPublic         *tpm2.Public
+}
+
+// keyDataRaw_v4 is version 4 of the on-disk format of keyDataRaw.
+type keyDataRaw_v4 struct {
+	KeyPrivate        tpm2.Private
+	KeyPublic         *tpm2.Public
+	AuthModeHint      authMode
+	ImportSymSeed     tpm2.EncryptedSecret
+	StaticPolicyData  *staticPolicyDataRaw_v2
+	DynamicPolicyData *dynamicPolicyDataRaw_v0
+	SRKHandle         tpm2.Handle
+	SRKPublic         *tpm2.Public
+}
+
+// keyDataRaw_v5 is version 5 of the on-disk format of keyDataRaw.
+type keyDataRaw_v5 struct {
+	KeyPrivate        tpm2.Private
+	KeyPublic         *tpm2.Public
+	AuthModeHint      authMode
+	ImportSymSeed     tpm2.EncryptedSecret
+	StaticPolicyData  *staticPolicyDataRaw_v3
+	DynamicPolicyData *dynamicPolicyDataRaw_v0
+	SRKHandle         tpm2.Handle
+	SRKPublic         *tpm2.Public
+}
+
+// keyDataRaw_v6 is version 6 of the on-disk format of keyDataRaw.
+type keyDataRaw_v6 struct {
+	KeyPrivate        tpm2.Private
+	KeyPublic         *tpm2.Public
+	AuthModeHint      authMode
+	ImportSymSeed     tpm2.EncryptedSecret
+	StaticPolicyData  *staticPolicyDataRaw_v3
+	DynamicPolicyData *dynamicPolicyDataRaw_v0
+	SRKHandle         tpm2.Handle
+	SRKPublic         *tpm2.Public
+	DeviceIdentity    deviceIdentityRaw_v0
+}
+
+// keyDataRaw_v7 is version 7 of the on-disk format of keyDataRaw.
+type keyDataRaw_v7 struct {
+	KeyPrivate        tpm2.Private
+	KeyPublic         *tpm2.Public
+	AuthModeHint      authMode
+	ImportSymSeed     tpm2.EncryptedSecret
+	StaticPolicyData  *staticPolicyDataRaw_v4
+	DynamicPolicyData *dynamicPolicyDataRaw_v0
+	SRKHandle         tpm2.Handle
+	SRKPublic         *tpm2.Public
+	DeviceIdentity    deviceIdentityRaw_v0
+}
+
+// keyDataRaw_v8 is version 8 of the on-disk format of keyDataRaw.
+type keyDataRaw_v8 struct {
+	KeyPrivate        tpm2.Private
+	KeyPublic         *tpm2.Public
+	AuthModeHint      authMode
+	ImportSymSeed     tpm2.EncryptedSecret
+	StaticPolicyData  *staticPolicyDataRaw_v4
+	DynamicPolicyData *dynamicPolicyDataRaw_v1
+	SRKHandle         tpm2.Handle
+	SRKPublic         *tpm2.Public
+	DeviceIdentity    deviceIdentityRaw_v0
+	RequiredPCRBanks  []tpm2.HashAlgorithmId
+}
+
 // for executing authorization policy assertions.
 // XXX: This is temporarily named keyData until this code is moved in to secboot/tpm
 type keyData struct {
@@ -269,6 +346,19 @@ type keyData struct {
 	importSymSeed     tpm2.EncryptedSecret
 	staticPolicyData  *staticPolicyData
 	dynamicPolicyData *dynamicPolicyData
+
+	// srkHandle and srkPublic describe the storage key that the sealed key
+	// object was created under. These aren't recorded for versions < 3.
+	srkHandle tpm2.Handle
+	srkPublic *tpm2.Public
+
+	// deviceIdentity is the identity of the device that the sealed key object was created on. This is
+	// only recorded for versions >= 6, and is nil if it wasn't requested.
+	deviceIdentity *deviceIdentity
+
+	// requiredPCRBanks is the set of PCR banks that every PCR policy for the sealed key object must include
+	// values for. This is only recorded for versions >= 8.
+	requiredPCRBanks []tpm2.HashAlgorithmId
 }
 
 func (d keyData) Marshal(w io.Writer) error {
@@ -310,6 +400,136 @@ func (d keyData) Marshal(w io.Writer) error {
 		if _, err := mu.MarshalToWriter(w, makeAfSplitDataRaw(splitData)); err != nil {
 			return xerrors.Errorf("cannot marshal split data: %w", err)
 		}
+	case 3:
+		var tmpW bytes.Buffer
+		raw := keyDataRaw_v3{
+			KeyPrivate:        d.keyPrivate,
+			KeyPublic:         d.keyPublic,
+			AuthModeHint:      d.authModeHint,
+			ImportSymSeed:     d.importSymSeed,
+			StaticPolicyData:  makeStaticPolicyDataRaw_v1(d.staticPolicyData),
+			DynamicPolicyData: makeDynamicPolicyDataRaw_v0(d.dynamicPolicyData),
+			SRKHandle:         d.parentHandle(),
+			SRKPublic:         d.parentTemplate()}
+		if _, err := mu.MarshalToWriter(&tmpW, raw); err != nil {
+			return xerrors.Errorf("cannot marshal raw data: %w", err)
+		}
+		splitData, err := makeAfSplitData(tmpW.Bytes(), 128*1024, tpm2.HashAlgorithmSHA256)
+		if err != nil {
+			return xerrors.Errorf("cannot split data: %w", err)
+		}
+		if _, err := mu.MarshalToWriter(w, makeAfSplitDataRaw(splitData)); err != nil {
+			return xerrors.Errorf("cannot marshal split data: %w", err)
+		}
+	case 4:
+		var tmpW bytes.Buffer
+		raw := keyDataRaw_v4{
+			KeyPrivate:        d.keyPrivate,
+			KeyPublic:         d.keyPublic,
+			AuthModeHint:      d.authModeHint,
+			ImportSymSeed:     d.importSymSeed,
+			StaticPolicyData:  makeStaticPolicyDataRaw_v2(d.staticPolicyData),
+			DynamicPolicyData: makeDynamicPolicyDataRaw_v0(d.dynamicPolicyData),
+			SRKHandle:         d.parentHandle(),
+			SRKPublic:         d.parentTemplate()}
+		if _, err := mu.MarshalToWriter(&tmpW, raw); err != nil {
+			return xerrors.Errorf("cannot marshal raw data: %w", err)
+		}
+		splitData, err := makeAfSplitData(tmpW.Bytes(), 128*1024, tpm2.HashAlgorithmSHA256)
+		if err != nil {
+			return xerrors.Errorf("cannot split data: %w", err)
+		}
+		if _, err := mu.MarshalToWriter(w, makeAfSplitDataRaw(splitData)); err != nil {
+			return xerrors.Errorf("cannot marshal split data: %w", err)
+		}
+	case 5:
+		var tmpW bytes.Buffer
+		raw := keyDataRaw_v5{
+			KeyPrivate:        d.keyPrivate,
+			KeyPublic:         d.keyPublic,
+			AuthModeHint:      d.authModeHint,
+			ImportSymSeed:     d.importSymSeed,
+			StaticPolicyData:  makeStaticPolicyDataRaw_v3(d.staticPolicyData),
+			DynamicPolicyData: makeDynamicPolicyDataRaw_v0(d.dynamicPolicyData),
+			SRKHandle:         d.parentHandle(),
+			SRKPublic:         d.parentTemplate()}
+		if _, err := mu.MarshalToWriter(&tmpW, raw); err != nil {
+			return xerrors.Errorf("cannot marshal raw data: %w", err)
+		}
+		splitData, err := makeAfSplitData(tmpW.Bytes(), 128*1024, tpm2.HashAlgorithmSHA256)
+		if err != nil {
+			return xerrors.Errorf("cannot split data: %w", err)
+		}
+		if _, err := mu.MarshalToWriter(w, makeAfSplitDataRaw(splitData)); err != nil {
+			return xerrors.Errorf("cannot marshal split data: %w", err)
+		}
+	case 6:
+		var tmpW bytes.Buffer
+		raw := keyDataRaw_v6{
+			KeyPrivate:        d.keyPrivate,
+			KeyPublic:         d.keyPublic,
+			AuthModeHint:      d.authModeHint,
+			ImportSymSeed:     d.importSymSeed,
+			StaticPolicyData:  makeStaticPolicyDataRaw_v3(d.staticPolicyData),
+			DynamicPolicyData: makeDynamicPolicyDataRaw_v0(d.dynamicPolicyData),
+			SRKHandle:         d.parentHandle(),
+			SRKPublic:         d.parentTemplate(),
+			DeviceIdentity:    makeDeviceIdentityRaw_v0(d.deviceIdentity)}
+		if _, err := mu.MarshalToWriter(&tmpW, raw); err != nil {
+			return xerrors.Errorf("cannot marshal raw data: %w", err)
+		}
+		splitData, err := makeAfSplitData(tmpW.Bytes(), 128*1024, tpm2.HashAlgorithmSHA256)
+		if err != nil {
+			return xerrors.Errorf("cannot split data: %w", err)
+		}
+		if _, err := mu.MarshalToWriter(w, makeAfSplitDataRaw(splitData)); err != nil {
+			return xerrors.Errorf("cannot marshal split data: %w", err)
+		}
+	case 7:
+		var tmpW bytes.Buffer
+		raw := keyDataRaw_v7{
+			KeyPrivate:        d.keyPrivate,
+			KeyPublic:         d.keyPublic,
+			AuthModeHint:      d.authModeHint,
+			ImportSymSeed:     d.importSymSeed,
+			StaticPolicyData:  makeStaticPolicyDataRaw_v4(d.staticPolicyData),
+			DynamicPolicyData: makeDynamicPolicyDataRaw_v0(d.dynamicPolicyData),
+			SRKHandle:         d.parentHandle(),
+			SRKPublic:         d.parentTemplate(),
+			DeviceIdentity:    makeDeviceIdentityRaw_v0(d.deviceIdentity)}
+		if _, err := mu.MarshalToWriter(&tmpW, raw); err != nil {
+			return xerrors.Errorf("cannot marshal raw data: %w", err)
+		}
+		splitData, err := makeAfSplitData(tmpW.Bytes(), 128*1024, tpm2.HashAlgorithmSHA256)
+		if err != nil {
+			return xerrors.Errorf("cannot split data: %w", err)
+		}
+		if _, err := mu.MarshalToWriter(w, makeAfSplitDataRaw(splitData)); err != nil {
+			return xerrors.Errorf("cannot marshal split data: %w", err)
+		}
+	case 8:
+		var tmpW bytes.Buffer
+		raw := keyDataRaw_v8{
+			KeyPrivate:        d.keyPrivate,
+			KeyPublic:         d.keyPublic,
+			AuthModeHint:      d.authModeHint,
+			ImportSymSeed:     d.importSymSeed,
+			StaticPolicyData:  makeStaticPolicyDataRaw_v4(d.staticPolicyData),
+			DynamicPolicyData: makeDynamicPolicyDataRaw_v1(d.dynamicPolicyData),
+			SRKHandle:         d.parentHandle(),
+			SRKPublic:         d.parentTemplate(),
+			DeviceIdentity:    makeDeviceIdentityRaw_v0(d.deviceIdentity),
+			RequiredPCRBanks:  d.requiredPCRBanks}
+		if _, err := mu.MarshalToWriter(&tmpW, raw); err != nil {
+			return xerrors.Errorf("cannot marshal raw data: %w", err)
+		}
+		splitData, err := makeAfSplitData(tmpW.Bytes(), 128*1024, tpm2.HashAlgorithmSHA256)
+		if err != nil {
+			return xerrors.Errorf("cannot split data: %w", err)
+		}
+		if _, err := mu.MarshalToWriter(w, makeAfSplitDataRaw(splitData)); err != nil {
+			return xerrors.Errorf("cannot marshal split data: %w", err)
+		}
 	default:
 		return fmt.Errorf("unexpected version number (%d)", d.version)
 	}
@@ -380,12 +600,253 @@ func (d *keyData) Unmarshal(r mu.Reader) error {
 			importSymSeed:     raw.ImportSymSeed,
 			staticPolicyData:  raw.StaticPolicyData.data(),
 			dynamicPolicyData: raw.DynamicPolicyData.data()}
+	case 3:
+		var splitData afSplitDataRaw
+		if _, err := mu.UnmarshalFromReader(r, &splitData); err != nil {
+			return xerrors.Errorf("cannot unmarshal split data: %w", err)
+		}
+
+		merged, err := splitData.data().merge()
+		if err != nil {
+			return xerrors.Errorf("cannot merge data: %w", err)
+		}
+
+		var raw keyDataRaw_v3
+		if _, err := mu.UnmarshalFromBytes(merged, &raw); err != nil {
+			return xerrors.Errorf("cannot unmarshal data: %w", err)
+		}
+		*d = keyData{
+			version:           version,
+			keyPrivate:        raw.KeyPrivate,
+			keyPublic:         raw.KeyPublic,
+			authModeHint:      raw.AuthModeHint,
+			importSymSeed:     raw.ImportSymSeed,
+			staticPolicyData:  raw.StaticPolicyData.data(),
+			dynamicPolicyData: raw.DynamicPolicyData.data(),
+			srkHandle:         raw.SRKHandle,
+			srkPublic:         raw.SRKPublic}
+	case 4:
+		var splitData afSplitDataRaw
+		if _, err := mu.UnmarshalFromReader(r, &splitData); err != nil {
+			return xerrors.Errorf("cannot unmarshal split data: %w", err)
+		}
+
+		merged, err := splitData.data().merge()
+		if err != nil {
+			return xerrors.Errorf("cannot merge data: %w", err)
+		}
+
+		var raw keyDataRaw_v4
+		if _, err := mu.UnmarshalFromBytes(merged, &raw); err != nil {
+			return xerrors.Errorf("cannot unmarshal data: %w", err)
+		}
+		*d = keyData{
+			version:           version,
+			keyPrivate:        raw.KeyPrivate,
+			keyPublic:         raw.KeyPublic,
+			authModeHint:      raw.AuthModeHint,
+			importSymSeed:     raw.ImportSymSeed,
+			staticPolicyData:  raw.StaticPolicyData.data(),
+			dynamicPolicyData: raw.DynamicPolicyData.data(),
+			srkHandle:         raw.SRKHandle,
+			srkPublic:         raw.SRKPublic}
+	case 5:
+		var splitData afSplitDataRaw
+		if _, err := mu.UnmarshalFromReader(r, &splitData); err != nil {
+			return xerrors.Errorf("cannot unmarshal split data: %w", err)
+		}
+
+		merged, err := splitData.data().merge()
+		if err != nil {
+			return xerrors.Errorf("cannot merge data: %w", err)
+		}
+
+		var raw keyDataRaw_v5
+		if _, err := mu.UnmarshalFromBytes(merged, &raw); err != nil {
+			return xerrors.Errorf("cannot unmarshal data: %w", err)
+		}
+		*d = keyData{
+			version:           version,
+			keyPrivate:        raw.KeyPrivate,
+			keyPublic:         raw.KeyPublic,
+			authModeHint:      raw.AuthModeHint,
+			importSymSeed:     raw.ImportSymSeed,
+			staticPolicyData:  raw.StaticPolicyData.data(),
+			dynamicPolicyData: raw.DynamicPolicyData.data(),
+			srkHandle:         raw.SRKHandle,
+			srkPublic:         raw.SRKPublic}
+	case 6:
+		var splitData afSplitDataRaw
+		if _, err := mu.UnmarshalFromReader(r, &splitData); err != nil {
+			return xerrors.Errorf("cannot unmarshal split data: %w", err)
+		}
+
+		merged, err := splitData.data().merge()
+		if err != nil {
+			return xerrors.Errorf("cannot merge data: %w", err)
+		}
+
+		var raw keyDataRaw_v6
+		if _, err := mu.UnmarshalFromBytes(merged, &raw); err != nil {
+			return xerrors.Errorf("cannot unmarshal data: %w", err)
+		}
+		*d = keyData{
+			version:           version,
+			keyPrivate:        raw.KeyPrivate,
+			keyPublic:         raw.KeyPublic,
+			authModeHint:      raw.AuthModeHint,
+			importSymSeed:     raw.ImportSymSeed,
+			staticPolicyData:  raw.StaticPolicyData.data(),
+			dynamicPolicyData: raw.DynamicPolicyData.data(),
+			srkHandle:         raw.SRKHandle,
+			srkPublic:         raw.SRKPublic,
+			deviceIdentity:    raw.DeviceIdentity.data()}
+	case 7:
+		var splitData afSplitDataRaw
+		if _, err := mu.UnmarshalFromReader(r, &splitData); err != nil {
+			return xerrors.Errorf("cannot unmarshal split data: %w", err)
+		}
+
+		merged, err := splitData.data().merge()
+		if err != nil {
+			return xerrors.Errorf("cannot merge data: %w", err)
+		}
+
+		var raw keyDataRaw_v7
+		if _, err := mu.UnmarshalFromBytes(merged, &raw); err != nil {
+			return xerrors.Errorf("cannot unmarshal data: %w", err)
+		}
+		*d = keyData{
+			version:           version,
+			keyPrivate:        raw.KeyPrivate,
+			keyPublic:         raw.KeyPublic,
+			authModeHint:      raw.AuthModeHint,
+			importSymSeed:     raw.ImportSymSeed,
+			staticPolicyData:  raw.StaticPolicyData.data(),
+			dynamicPolicyData: raw.DynamicPolicyData.data(),
+			srkHandle:         raw.SRKHandle,
+			srkPublic:         raw.SRKPublic,
+			deviceIdentity:    raw.DeviceIdentity.data()}
+	case 8:
+		var splitData afSplitDataRaw
+		if _, err := mu.UnmarshalFromReader(r, &splitData); err != nil {
+			return xerrors.Errorf("cannot unmarshal split data: %w", err)
+		}
+
+		merged, err := splitData.data().merge()
+		if err != nil {
+			return xerrors.Errorf("cannot merge data: %w", err)
+		}
+
+		var raw keyDataRaw_v8
+		if _, err := mu.UnmarshalFromBytes(merged, &raw); err != nil {
+			return xerrors.Errorf("cannot unmarshal data: %w", err)
+		}
+		*d = keyData{
+			version:           version,
+			keyPrivate:        raw.KeyPrivate,
+			keyPublic:         raw.KeyPublic,
+			authModeHint:      raw.AuthModeHint,
+			importSymSeed:     raw.ImportSymSeed,
+			staticPolicyData:  raw.StaticPolicyData.data(),
+			dynamicPolicyData: raw.DynamicPolicyData.data(),
+			srkHandle:         raw.SRKHandle,
+			srkPublic:         raw.SRKPublic,
+			deviceIdentity:    raw.DeviceIdentity.data(),
+			requiredPCRBanks:  raw.RequiredPCRBanks}
 	default:
 		return fmt.Errorf("unexpected version number (%d)", version)
 	}
 	return nil
 }
 
+// parentHandle returns the handle of the storage key that the sealed key object was created under.
+// This is the standard SRK handle for keys created before this was recorded in the metadata.
+func (d *keyData) parentHandle() tpm2.Handle {
+	if d.srkHandle == 0 {
+		return tcg.SRKHandle
+	}
+	return d.srkHandle
+}
+
+// parentIsTransient indicates whether the storage key that the sealed key object was created under is a
+// transient primary key that is recreated from parentTemplate in the hierarchy at parentHandle each time it is
+// required, rather than a persistent object.
+func (d *keyData) parentIsTransient() bool {
+	return d.parentHandle().Type() == tpm2.HandleTypePermanent
+}
+
+// loadParent returns a context for the storage key that the sealed key object was created under. If this is
+// a transient primary key, it is created by this function and the returned flush function must be called
+// when it is no longer required.
+func (d *keyData) loadParent(tpm *tpm2.TPMContext, session tpm2.SessionContext) (parent tpm2.ResourceContext, flush func(), err error) {
+	if !d.parentIsTransient() {
+		parent, err := tpm.CreateResourceContextFromTPM(d.parentHandle())
+		if err != nil {
+			return nil, nil, xerrors.Errorf("cannot create context for SRK: %w", err)
+		}
+		return parent, func() {}, nil
+	}
+
+	hierarchy := tpm.GetPermanentContext(d.parentHandle())
+	parent, _, _, _, _, err = tpm.CreatePrimary(hierarchy, nil, d.parentTemplate(), nil, nil, session)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot create storage key in hierarchy 0x%08x: %w", d.parentHandle(), err)
+	}
+	return parent, func() { tpm.FlushContext(parent) }, nil
+}
+
+// parentTemplate returns a template that can be passed to isObjectPrimaryKeyWithTemplate in order to check
+// that the object at parentHandle is the storage key that the sealed key object was created under. This is
+// the public area of the storage key recorded in the metadata, or the standard SRK template for keys created
+// before this was recorded.
+func (d *keyData) parentTemplate() *tpm2.Public {
+	if d.srkPublic == nil {
+		return tcg.SRKTemplate
+	}
+	return d.srkPublic
+}
+
+// pinIndexPublic returns the public area of the NV index used to limit PIN attempts for this sealed key object, or nil if
+// there isn't one. A keyFileError is returned if the index is missing or doesn't have the expected attributes and
+// authorization policy.
+func (d *keyData) pinIndexPublic(tpm *tpm2.TPMContext, session tpm2.SessionContext) (*tpm2.NVPublic, error) {
+	handle := d.staticPolicyData.pinIndexHandle
+	if handle == tpm2.HandleNull {
+		return nil, nil
+	}
+	if handle.Type() != tpm2.HandleTypeNVIndex {
+		return nil, keyFileError{errors.New("PIN index handle is invalid")}
+	}
+
+	index, err := tpm.CreateResourceContextFromTPM(handle, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		if tpm2.IsResourceUnavailableError(err, handle) {
+			return nil, keyFileError{errors.New("PIN index is unavailable")}
+		}
+		return nil, xerrors.Errorf("cannot create context for PIN index: %w", err)
+	}
+
+	pub, _, err := tpm.NVReadPublic(index, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read public area of PIN index: %w", err)
+	}
+	if pub.Attrs&^tpm2.AttrNVWritten != pinIndexAttrs {
+		return nil, keyFileError{errors.New("PIN index has unexpected attributes")}
+	}
+	if !pub.NameAlg.Supported() {
+		return nil, keyFileError{errors.New("PIN index has an unsupported name algorithm")}
+	}
+
+	trial, _ := tpm2.ComputeAuthPolicy(pub.NameAlg)
+	trial.PolicyOR(computePinIndexAuthPolicies(pub.NameAlg))
+	if !bytes.Equal(pub.AuthPolicy, trial.GetDigest()) {
+		return nil, keyFileError{errors.New("PIN index has unexpected authorization policy")}
+	}
+
+	return pub, nil
+}
+
 // ensureImported will import the sealed key object into the TPM's storage hierarchy if
 // required, as indicated by an import symmetric seed of non-zero length. The tpmKeyData
 // structure will be updated with the newly imported private area and the import
@@ -395,10 +856,11 @@ func (d *keyData) ensureImported(tpm *tpm2.TPMContext, session tpm2.SessionConte
 		return nil
 	}
 
-	srkContext, err := tpm.CreateResourceContextFromTPM(tcg.SRKHandle)
+	srkContext, flush, err := d.loadParent(tpm, session)
 	if err != nil {
-		return xerrors.Errorf("cannot create context for SRK: %w", err)
+		return err
 	}
+	defer flush()
 
 	priv, err := tpm.Import(srkContext, nil, d.keyPublic, d.keyPrivate, d.importSymSeed, nil, session)
 	if err != nil {
@@ -421,10 +883,11 @@ func (d *keyData) load(tpm *tpm2.TPMContext, session tpm2.SessionContext) (tpm2.
 		return nil, err
 	}
 
-	srkContext, err := tpm.CreateResourceContextFromTPM(tcg.SRKHandle)
+	srkContext, flush, err := d.loadParent(tpm, session)
 	if err != nil {
-		return nil, xerrors.Errorf("cannot create context for SRK: %w", err)
+		return nil, err
 	}
+	defer flush()
 
 	keyContext, err := tpm.Load(srkContext, d.keyPrivate, d.keyPublic, session)
 	if err != nil {
@@ -516,6 +979,12 @@ func (d *keyData) validate(tpm *tpm2.TPMContext, authKey crypto.PrivateKey, sess
 		pcrPolicyRef = computePcrPolicyRefFromCounterContext(pcrPolicyCounter)
 	}
 
+	// Obtain and validate the public area of the PIN index, if there is one.
+	pinIndexPub, err := d.pinIndexPublic(tpm, session)
+	if err != nil {
+		return nil, err
+	}
+
 	// Validate the type and scheme of the dynamic authorization policy signing key.
 	authPublicKey := d.staticPolicyData.authPublicKey
 	authKeyName, err := authPublicKey.Name()
@@ -531,6 +1000,11 @@ func (d *keyData) validate(tpm *tpm2.TPMContext, authKey crypto.PrivateKey, sess
 	default:
 		expectedAuthKeyType = tpm2.ObjectTypeECC
 		expectedAuthKeyScheme = tpm2.AsymSchemeECDSA
+		if authPublicKey.Type == tpm2.ObjectTypeRSA {
+			// Keys created with KeyCreationParams.AuthorizedPolicySigner can have a RSA key.
+			expectedAuthKeyType = tpm2.ObjectTypeRSA
+			expectedAuthKeyScheme = tpm2.AsymSchemeRSAPSS
+		}
 	}
 	if authPublicKey.Type != expectedAuthKeyType {
 		return nil, keyFileError{errors.New("public area of dynamic authorization policy signing key has the wrong type")}
@@ -552,10 +1026,60 @@ func (d *keyData) validate(tpm *tpm2.TPMContext, authKey crypto.PrivateKey, sess
 	}
 
 	trial.PolicyAuthorize(pcrPolicyRef, authKeyName)
-	if d.version == 0 {
+	// v5 metadata and later can have additional restrictions
+	for _, a := range d.staticPolicyData.counterTimerAssertions {
+		trial.PolicyCounterTimer(a.OperandB, a.Offset, a.Operation)
+	}
+	if d.staticPolicyData.locality != 0 {
+		trial.PolicyLocality(d.staticPolicyData.locality)
+	}
+	if d.staticPolicyData.commandCode != 0 {
+		trial.PolicyCommandCode(d.staticPolicyData.commandCode)
+	}
+	if lockIndexHandle := d.staticPolicyData.lockIndexHandle; lockIndexHandle != tpm2.HandleNull {
+		if lockIndexHandle.Type() != tpm2.HandleTypeNVIndex {
+			return nil, keyFileError{errors.New("lock index handle is invalid")}
+		}
+		lockIndexPub, err := readLockIndexPublic(tpm, lockIndexHandle, session)
+		var existsErr TPMResourceExistsError
+		switch {
+		case tpm2.IsResourceUnavailableError(err, lockIndexHandle):
+			return nil, keyFileError{errors.New("no lock index found")}
+		case xerrors.As(err, &existsErr):
+			return nil, keyFileError{errors.New("NV index at lock index handle is not a lock index")}
+		case err != nil:
+			return nil, xerrors.Errorf("cannot obtain lock index: %w", err)
+		}
+		lockIndexName, err := lockIndexPub.Name()
+		if err != nil {
+			return nil, keyFileError{xerrors.Errorf("cannot compute name of lock index: %w", err)}
+		}
+		trial.PolicyNV(lockIndexName, nil, 0, tpm2.OpEq)
+	}
+	if rollbackCounterHandle := d.staticPolicyData.rollbackCounterHandle; rollbackCounterHandle != tpm2.HandleNull {
+		// v7 metadata and later
+		if rollbackCounterHandle.Type() != tpm2.HandleTypeNVIndex {
+			return nil, keyFileError{errors.New("rollback counter handle is invalid")}
+		}
+		rollbackCounterName, err := makeRollbackCounterPublic(rollbackCounterHandle).Name()
+		if err != nil {
+			return nil, keyFileError{xerrors.Errorf("cannot compute name of rollback counter: %w", err)}
+		}
+		trial.PolicyNV(rollbackCounterName, rollbackVersionOperand(d.staticPolicyData.rollbackVersion), 0, tpm2.OpUnsignedLE)
+	}
+	switch {
+	case d.version == 0:
 		trial.PolicySecret(pcrPolicyCounter.Name(), nil)
 		trial.PolicyNV(legacyLockIndexName, nil, 0, tpm2.OpEq)
-	} else {
+	case pinIndexPub != nil:
+		// v4 metadata and later with a PIN index
+		pinIndexName, err := pinIndexPub.Name()
+		if err != nil {
+			return nil, keyFileError{xerrors.Errorf("cannot compute name of PIN index: %w", err)}
+		}
+		trial.PolicySecret(pinIndexName, nil)
+		trial.PolicyAuthValue()
+	default:
 		// v1 metadata and later
 		trial.PolicyAuthValue()
 	}
@@ -604,6 +1128,10 @@ func (d *keyData) validate(tpm *tpm2.TPMContext, authKey crypto.PrivateKey, sess
 		goAuthPublicKey := rsa.PublicKey{
 			N: new(big.Int).SetBytes(authPublicKey.Unique.RSA),
 			E: int(authPublicKey.Params.RSADetail.Exponent)}
+		if goAuthPublicKey.E == 0 {
+			// The default exponent of 2^^16-1 is indicated by the value of 0 in the public area.
+			goAuthPublicKey.E = 65537
+		}
 		if k.E != goAuthPublicKey.E || k.N.Cmp(goAuthPublicKey.N) != 0 {
 			return nil, keyFileError{errors.New("dynamic authorization policy signing private key doesn't match public key")}
 		}
@@ -615,6 +1143,21 @@ func (d *keyData) validate(tpm *tpm2.TPMContext, authKey crypto.PrivateKey, sess
 		if expectedX.Cmp(k.X) != 0 || expectedY.Cmp(k.Y) != 0 {
 			return nil, keyFileError{errors.New("dynamic authorization policy signing private key doesn't match public key")}
 		}
+	case crypto.Signer:
+		if d.version == 0 {
+			return nil, keyFileError{errors.New("unexpected dynamic authorization policy signing private key type")}
+		}
+		signerPublicKey, err := createTPMPublicAreaForPublicKey(k.Public())
+		if err != nil {
+			return nil, keyFileError{xerrors.Errorf("unexpected dynamic authorization policy signer: %w", err)}
+		}
+		signerName, err := signerPublicKey.Name()
+		if err != nil {
+			return nil, xerrors.Errorf("cannot compute name of dynamic authorization policy signer: %w", err)
+		}
+		if !bytes.Equal(signerName, authKeyName) {
+			return nil, keyFileError{errors.New("dynamic authorization policy signer doesn't match public key")}
+		}
 	case nil:
 	default:
 		return nil, keyFileError{errors.New("unexpected dynamic authorization policy signing private key type")}
@@ -650,6 +1193,53 @@ func (d *keyData) writeToFileAtomic(dest string) error {
 	return nil
 }
 
+// writeToFileAtomicWithGeneration serializes keyData followed by a generation trailer with the specified generation,
+// and writes it atomically to the file at the specified path. This is used for key data files that are maintained
+// with a backup copy.
+func (d *keyData) writeToFileAtomicWithGeneration(dest string, generation uint64) error {
+	f, err := osutil.NewAtomicFile(dest, 0600, 0, sys.UserID(osutil.NoChown), sys.GroupID(osutil.NoChown))
+	if err != nil {
+		return xerrors.Errorf("cannot create new atomic file: %w", err)
+	}
+	defer f.Cancel()
+
+	if err := d.write(f); err != nil {
+		return xerrors.Errorf("cannot write to temporary file: %w", err)
+	}
+	if err := writeKeyDataGeneration(f, generation); err != nil {
+		return xerrors.Errorf("cannot write generation to temporary file: %w", err)
+	}
+
+	if err := f.Commit(); err != nil {
+		return xerrors.Errorf("cannot atomically replace file: %w", err)
+	}
+
+	return nil
+}
+
+// writeKeyDataGeneration serializes the generation trailer that follows the key data in a key data file that is
+// maintained with a backup copy.
+func writeKeyDataGeneration(w io.Writer, generation uint64) error {
+	if _, err := mu.MarshalToWriter(w, keyDataGenerationMagic, generation); err != nil {
+		return err
+	}
+	return nil
+}
+
+// decodeKeyDataGeneration decodes the optional generation trailer that follows the key data in a key data file that
+// is maintained with a backup copy. A file without a trailer has a generation of zero.
+func decodeKeyDataGeneration(r io.Reader) uint64 {
+	var magic uint32
+	var generation uint64
+	if _, err := mu.UnmarshalFromReader(r, &magic, &generation); err != nil {
+		return 0
+	}
+	if magic != keyDataGenerationMagic {
+		return 0
+	}
+	return generation
+}
+
 // decodeKeyData deserializes keyData from the provided io.Reader.
 func decodeKeyData(r io.Reader) (*keyData, error) {
 	var header uint32
@@ -689,6 +1279,35 @@ func isKeyFileError(err error) bool {
 type SealedKeyObject struct {
 	path string // XXX: This is here temporarily and will be removed in a future PR
 	data *keyData
+
+	backup     bool   // whether a backup copy of the key data file is maintained
+	generation uint64 // the generation of the most recently read or written copy
+
+	nvIndex tpm2.Handle // the NV index that the key data is stored in, or zero if it is stored in a file
+}
+
+// backupKeyPath returns the path of the backup copy of the key data file at the specified path.
+func backupKeyPath(path string) string {
+	return path + ".backup"
+}
+
+// writeToFile atomically writes this sealed key object to its key data file. If a backup copy is maintained, both
+// copies are written with an incremented generation, the primary copy first. An update that is interrupted after
+// writing the primary copy leaves a backup copy with an older generation, which is ignored by ReadSealedKeyObject.
+func (k *SealedKeyObject) writeToFile() error {
+	if !k.backup {
+		return k.data.writeToFileAtomic(k.path)
+	}
+
+	generation := k.generation + 1
+	for _, path := range []string{k.path, backupKeyPath(k.path)} {
+		if err := k.data.writeToFileAtomicWithGeneration(path, generation); err != nil {
+			return err
+		}
+	}
+
+	k.generation = generation
+	return nil
 }
 
 // Version returns the version number that this sealed key object was created with.
@@ -705,26 +1324,98 @@ func (k *SealedKeyObject) AuthMode2F() secboot.AuthMode {
 }
 
 // PCRPolicyCounterHandle indicates the handle of the NV counter used for PCR policy revocation for this sealed key object (and for
-// PIN integration for version 0 key files).
+// PIN integration for version 0 key files). This is NoPCRPolicyCounterHandle if the sealed key object was created without a
+// PCR policy counter.
 func (k *SealedKeyObject) PCRPolicyCounterHandle() tpm2.Handle {
 	return k.data.staticPolicyData.pcrPolicyCounterHandle
 }
 
-// ReadSealedKeyObject loads a sealed key data file created by SealKeyToTPM from the specified path. If the file cannot be opened,
-// a wrapped *os.PathError error is returned. If the key data file cannot be deserialized successfully, a InvalidKeyFileError error
-// will be returned.
-func ReadSealedKeyObject(path string) (*SealedKeyObject, error) {
+// LockIndexHandle indicates the handle of the NV index used to lock access to this sealed key object. This is tpm2.HandleNull
+// if the sealed key object doesn't have a lock index.
+func (k *SealedKeyObject) LockIndexHandle() tpm2.Handle {
+	return k.data.staticPolicyData.lockIndexHandle
+}
+
+// PINIndexHandle indicates the handle of the NV index used to limit the number of PIN attempts for this sealed key object. This
+// is tpm2.HandleNull if the sealed key object doesn't have a PIN attempt limit.
+func (k *SealedKeyObject) PINIndexHandle() tpm2.Handle {
+	return k.data.staticPolicyData.pinIndexHandle
+}
+
+// PCRSelection returns the PCR selection of the current PCR policy for this sealed key object.
+func (k *SealedKeyObject) PCRSelection() tpm2.PCRSelectionList {
+	return k.data.dynamicPolicyData.pcrSelection
+}
+
+// PCRPolicyCount returns the revocation count of the current PCR policy for this sealed key object. The policy is revoked
+// when the value of the associated PCR policy counter is incremented beyond this.
+func (k *SealedKeyObject) PCRPolicyCount() uint64 {
+	return k.data.dynamicPolicyData.policyCount
+}
+
+// PCRPolicyDigest returns the digest of the current PCR policy for this sealed key object, which is signed by the key used
+// to authorize PCR policy updates.
+func (k *SealedKeyObject) PCRPolicyDigest() tpm2.Digest {
+	return k.data.dynamicPolicyData.authorizedPolicy
+}
+
+// PolicyDigest returns the authorization policy digest of the sealed object, which is fixed for the lifetime of this
+// sealed key object.
+func (k *SealedKeyObject) PolicyDigest() tpm2.Digest {
+	return k.data.keyPublic.AuthPolicy
+}
+
+// readSealedKeyObjectCopy loads a single copy of a sealed key data file from the specified path.
+func readSealedKeyObjectCopy(path string) (*keyData, uint64, error) {
 	// Open the key data file
 	f, err := os.Open(path)
 	if err != nil {
-		return nil, xerrors.Errorf("cannot open key data file: %w", err)
+		return nil, 0, xerrors.Errorf("cannot open key data file: %w", err)
 	}
 	defer f.Close()
 
 	data, err := decodeKeyData(f)
 	if err != nil {
-		return nil, InvalidKeyFileError{err.Error()}
+		return nil, 0, InvalidKeyFileError{msg: err.Error()}
+	}
+
+	return data, decodeKeyDataGeneration(f), nil
+}
+
+// ReadSealedKeyObject loads a sealed key data file created by SealKeyToTPM from the specified path. If the file cannot be opened,
+// a wrapped *os.PathError error is returned. If the key data file cannot be deserialized successfully, a InvalidKeyFileError error
+// will be returned.
+//
+// If the key data file was created with a backup copy (see KeyCreationParams.BackupKeyFile), the copy with the most recent
+// generation that can be deserialized successfully is loaded. A primary copy without a generation was written without
+// updating the backup copy, and always takes precedence over it. An error is only returned if neither copy can be loaded,
+// in which case the error is the one associated with the primary copy.
+func ReadSealedKeyObject(path string) (*SealedKeyObject, error) {
+	data, generation, err := readSealedKeyObjectCopy(path)
+
+	backupData, backupGeneration, backupErr := readSealedKeyObjectCopy(backupKeyPath(path))
+	switch {
+	case xerrors.Is(backupErr, os.ErrNotExist):
+		// No backup copy is maintained for this key.
+		if err != nil {
+			return nil, err
+		}
+		return &SealedKeyObject{path: path, data: data, generation: generation}, nil
+	case err != nil && backupErr != nil:
+		return nil, err
+	case err != nil:
+		data = backupData
+		generation = backupGeneration
+	case generation == 0:
+		// The backup copy is stale. Make sure that the next update writes a generation that is newer
+		// than it.
+		if backupErr == nil {
+			generation = backupGeneration
+		}
+	case backupErr == nil && backupGeneration > generation:
+		data = backupData
+		generation = backupGeneration
 	}
 
-	return &SealedKeyObject{path: path, data: data}, nil
+	return &SealedKeyObject{path: path, data: data, backup: true, generation: generation}, nil
 }
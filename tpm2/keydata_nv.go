@@ -0,0 +1,364 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// keyDataNVIndexAttrs are the attributes for a NV index that stores a sealed key object. The index
+	// can only be written with the storage hierarchy authorization, so the key data can't be replaced
+	// without it, and can only be read using a policy session.
+	keyDataNVIndexAttrs = tpm2.AttrNVOwnerWrite | tpm2.AttrNVPolicyRead | tpm2.AttrNVNoDA
+
+	// keyDataNVIndexSlack is the amount of space reserved in each slot of a NV index that stores a
+	// sealed key object to accommodate the key data growing when the PCR policy is updated.
+	keyDataNVIndexSlack = 512
+)
+
+// computeKeyDataNVIndexAuthPolicy computes the authorization policy for a NV index that stores a
+// sealed key object. The policy only permits the index to be read.
+func computeKeyDataNVIndexAuthPolicy(alg tpm2.HashAlgorithmId) tpm2.Digest {
+	trial, _ := tpm2.ComputeAuthPolicy(alg)
+	trial.PolicyCommandCode(tpm2.CommandNVRead)
+	return trial.GetDigest()
+}
+
+// A NV index that stores a sealed key object is split in to 2 equally sized slots. Each slot contains a
+// generation, the serialized key data and a digest of both. Updates are written to the slot that doesn't
+// contain the most recent generation, so an update that is interrupted (eg, because the write had to be
+// split in to several commands) leaves the previous copy intact. The valid slot with the most recent
+// generation is used when reading the key data.
+
+// computeKeyDataNVSlotDigest computes the digest of a slot in a NV index that stores a sealed key object.
+func computeKeyDataNVSlotDigest(generation uint64, data []byte) tpm2.Digest {
+	h := crypto.SHA256.New()
+	binary.Write(h, binary.BigEndian, generation)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// marshalKeyDataNVSlot serializes keyData in to a slot with the specified generation, suitable for
+// writing to a NV index.
+func marshalKeyDataNVSlot(d *keyData, generation uint64) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := d.write(buf); err != nil {
+		return nil, err
+	}
+	return mu.MarshalToBytes(generation, buf.Bytes(), computeKeyDataNVSlotDigest(generation, buf.Bytes()))
+}
+
+// unmarshalKeyDataNVSlot deserializes the contents of a slot read from a NV index. It returns a
+// generation of zero if the slot doesn't contain valid data.
+func unmarshalKeyDataNVSlot(b []byte) (data []byte, generation uint64) {
+	var digest tpm2.Digest
+	if _, err := mu.UnmarshalFromBytes(b, &generation, &data, &digest); err != nil {
+		return nil, 0
+	}
+	if !bytes.Equal(digest, computeKeyDataNVSlotDigest(generation, data)) {
+		return nil, 0
+	}
+	return data, generation
+}
+
+// defineKeyDataNVIndex defines a NV index at the specified handle that is large enough to store 2
+// copies of the supplied key data, taking in to account that the key data may grow on subsequent
+// updates.
+func defineKeyDataNVIndex(tpm *Connection, handle tpm2.Handle, d *keyData, session tpm2.SessionContext) (*tpm2.NVPublic, error) {
+	data, err := marshalKeyDataNVSlot(d, 0)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot marshal key data: %w", err)
+	}
+
+	props, err := getTPMProperties(tpm, tpm2.PropertyNVIndexMax, 1)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain maximum NV index size: %w", err)
+	}
+	max, ok := props[tpm2.PropertyNVIndexMax]
+	if !ok {
+		return nil, errors.New("cannot obtain maximum NV index size")
+	}
+
+	slotSize := len(data) + keyDataNVIndexSlack
+	if slotSize > int(max)/2 {
+		slotSize = int(max) / 2
+	}
+	if len(data) > slotSize {
+		return nil, fmt.Errorf("key data is too large to store in a NV index (%d bytes, maximum is %d bytes)", len(data), slotSize)
+	}
+
+	public := &tpm2.NVPublic{
+		Index:      handle,
+		NameAlg:    tpm2.HashAlgorithmSHA256,
+		Attrs:      tpm2.NVTypeOrdinary.WithAttrs(keyDataNVIndexAttrs),
+		AuthPolicy: computeKeyDataNVIndexAuthPolicy(tpm2.HashAlgorithmSHA256),
+		Size:       uint16(slotSize * 2)}
+
+	if _, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, public, session); err != nil {
+		switch {
+		case tpm2.IsTPMError(err, tpm2.ErrorNVDefined, tpm2.CommandNVDefineSpace):
+			return nil, TPMResourceExistsError{handle}
+		case isAuthFailError(err, tpm2.CommandNVDefineSpace, 1):
+			return nil, AuthFailError{tpm2.HandleOwner}
+		}
+		return nil, xerrors.Errorf("cannot define NV index: %w", err)
+	}
+
+	return public, nil
+}
+
+// keyDataNVIndex returns a context for the NV index at the specified handle and its public area, after
+// checking that it has the attributes and authorization policy of an index that stores a sealed key object.
+func keyDataNVIndex(tpm *tpm2.TPMContext, handle tpm2.Handle, session tpm2.SessionContext) (tpm2.ResourceContext, *tpm2.NVPublic, error) {
+	index, err := tpm.CreateResourceContextFromTPM(handle)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot create context for NV index: %w", err)
+	}
+
+	pub, _, err := tpm.NVReadPublic(index, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot read public area of NV index: %w", err)
+	}
+	if pub.Attrs&^tpm2.AttrNVWritten != tpm2.NVTypeOrdinary.WithAttrs(keyDataNVIndexAttrs) {
+		return nil, nil, InvalidKeyFileError{msg: "NV index has unexpected attributes"}
+	}
+	if !pub.NameAlg.Available() {
+		return nil, nil, InvalidKeyFileError{msg: "NV index has an unsupported name algorithm"}
+	}
+	if !bytes.Equal(pub.AuthPolicy, computeKeyDataNVIndexAuthPolicy(pub.NameAlg)) {
+		return nil, nil, InvalidKeyFileError{msg: "NV index has an unexpected authorization policy"}
+	}
+
+	return index, pub, nil
+}
+
+// readKeyDataNVSlot reads the contents of the supplied NV index that stores a sealed key object, and
+// returns the serialized key data from the valid slot with the most recent generation, along with that
+// generation and the index of the slot. If the NV index has not been written or neither slot is valid,
+// a slot index of -1 is returned.
+func readKeyDataNVSlot(tpm *tpm2.TPMContext, index tpm2.ResourceContext, pub *tpm2.NVPublic, session tpm2.SessionContext) (data []byte, generation uint64, slot int, err error) {
+	if pub.Attrs&tpm2.AttrNVWritten == 0 {
+		return nil, 0, -1, nil
+	}
+
+	policySession, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, pub.NameAlg)
+	if err != nil {
+		return nil, 0, 0, xerrors.Errorf("cannot start policy session: %w", err)
+	}
+	defer tpm.FlushContext(policySession)
+
+	if err := tpm.PolicyCommandCode(policySession, tpm2.CommandNVRead); err != nil {
+		return nil, 0, 0, xerrors.Errorf("cannot execute command code assertion: %w", err)
+	}
+
+	b, err := tpm.NVRead(index, index, pub.Size, 0, policySession, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, 0, 0, xerrors.Errorf("cannot read NV index: %w", err)
+	}
+
+	slot = -1
+	slotSize := int(pub.Size) / 2
+	for i := 0; i < 2; i++ {
+		d, g := unmarshalKeyDataNVSlot(b[i*slotSize : (i+1)*slotSize])
+		if g == 0 || g <= generation {
+			continue
+		}
+		data = d
+		generation = g
+		slot = i
+	}
+
+	return data, generation, slot, nil
+}
+
+// writeKeyDataToNVIndex serializes keyData and writes it to the NV index at the specified handle. The
+// index must have been created by defineKeyDataNVIndex.
+//
+// The key data is written with a new generation to the slot that doesn't contain the current key data,
+// so that the current key data is preserved if the write is interrupted.
+func writeKeyDataToNVIndex(tpm *tpm2.TPMContext, handle tpm2.Handle, d *keyData, session tpm2.SessionContext) error {
+	index, pub, err := keyDataNVIndex(tpm, handle, session)
+	if err != nil {
+		return err
+	}
+
+	_, generation, slot, err := readKeyDataNVSlot(tpm, index, pub, session)
+	if err != nil {
+		return err
+	}
+	// Write to the other slot, or the first slot if neither is valid.
+	slot = (slot + 1) % 2
+
+	data, err := marshalKeyDataNVSlot(d, generation+1)
+	if err != nil {
+		return xerrors.Errorf("cannot marshal key data: %w", err)
+	}
+	slotSize := int(pub.Size) / 2
+	if len(data) > slotSize {
+		return fmt.Errorf("key data is too large for NV index (%d bytes, maximum is %d bytes)", len(data), slotSize)
+	}
+
+	if err := tpm.NVWrite(tpm.OwnerHandleContext(), index, data, uint16(slot*slotSize), session); err != nil {
+		if isAuthFailError(err, tpm2.CommandNVWrite, 1) {
+			return AuthFailError{tpm2.HandleOwner}
+		}
+		return xerrors.Errorf("cannot write NV index: %w", err)
+	}
+
+	return nil
+}
+
+// readKeyDataFromNVIndex reads and deserializes keyData from the NV index at the specified handle.
+func readKeyDataFromNVIndex(tpm *tpm2.TPMContext, handle tpm2.Handle, session tpm2.SessionContext) (*keyData, error) {
+	index, pub, err := keyDataNVIndex(tpm, handle, session)
+	if err != nil {
+		return nil, err
+	}
+
+	data, _, slot, err := readKeyDataNVSlot(tpm, index, pub, session)
+	switch {
+	case err != nil:
+		return nil, err
+	case slot < 0:
+		return nil, InvalidKeyFileError{msg: "NV index does not contain valid key data"}
+	}
+
+	d, err := decodeKeyData(bytes.NewReader(data))
+	if err != nil {
+		return nil, InvalidKeyFileError{msg: err.Error()}
+	}
+
+	return d, nil
+}
+
+// nvKeyDataName returns the name used to identify a sealed key object stored in the NV index at the
+// specified handle in errors and in the kernel keyring.
+func nvKeyDataName(handle tpm2.Handle) string {
+	return fmt.Sprintf("tpm2-nv:%#08x", uint32(handle))
+}
+
+// NVIndexHandle returns the handle of the NV index that this sealed key object is stored in. This is
+// tpm2.HandleNull if the sealed key object is stored in a file.
+func (k *SealedKeyObject) NVIndexHandle() tpm2.Handle {
+	if k.nvIndex == 0 {
+		return tpm2.HandleNull
+	}
+	return k.nvIndex
+}
+
+// write persists this sealed key object to the NV index or file that it is stored in.
+func (k *SealedKeyObject) write(tpm *tpm2.TPMContext, session tpm2.SessionContext) error {
+	if k.nvIndex == 0 {
+		return k.writeToFile()
+	}
+	return writeKeyDataToNVIndex(tpm, k.nvIndex, k.data, session)
+}
+
+// ReadSealedKeyObjectFromNVIndex loads a sealed key object from the NV index at the specified handle,
+// which must have been created by SealKeyToTPMMultiple with SealKeyRequest.NVIndexHandle or by
+// SealedKeyObject.MigrateToNVIndex.
+//
+// If the NV index doesn't exist, a wrapped tpm2.ResourceUnavailableError error will be returned. If the
+// NV index doesn't look like one that stores a sealed key object or its contents cannot be deserialized
+// successfully, a InvalidKeyFileError error will be returned.
+func ReadSealedKeyObjectFromNVIndex(tpm *Connection, handle tpm2.Handle) (*SealedKeyObject, error) {
+	if handle.Type() != tpm2.HandleTypeNVIndex {
+		return nil, errors.New("invalid handle")
+	}
+
+	data, err := readKeyDataFromNVIndex(tpm.TPMContext, handle, tpm.HmacSession())
+	if err != nil {
+		return nil, err
+	}
+
+	return &SealedKeyObject{data: data, nvIndex: handle}, nil
+}
+
+// MigrateToNVIndex moves this sealed key object from its key data file to a newly defined NV index at
+// the specified handle, and then removes the key data file and any backup copy of it. This is useful on
+// systems where the partition containing the key data file is considered too exposed. The handle must
+// be a valid NV index handle (MSO == 0x01), and it is recommended that it is in the block reserved for
+// owner objects (0x01800000 - 0x01bfffff).
+//
+// The NV index can only be written with the storage hierarchy authorization, and is read with a policy
+// session that only permits TPM2_NV_Read. Subsequent updates to this sealed key object, such as
+// updating the PCR protection policy or changing the PIN, will also require knowledge of the storage
+// hierarchy authorization value.
+//
+// This function requires knowledge of the authorization value for the storage hierarchy, which must be
+// provided by calling Connection.OwnerHandleContext().SetAuthValue() prior to calling this function. If
+// the provided authorization value is incorrect, a AuthFailError error will be returned.
+//
+// If the handle is already in use, a TPMResourceExistsError error will be returned.
+//
+// If any part of this function fails before the key data has been written to the NV index, the NV index
+// will not be created and the key data file is left untouched.
+func (k *SealedKeyObject) MigrateToNVIndex(tpm *Connection, handle tpm2.Handle) error {
+	if k.nvIndex != 0 {
+		return errors.New("sealed key object is already stored in a NV index")
+	}
+	if handle.Type() != tpm2.HandleTypeNVIndex {
+		return errors.New("invalid handle")
+	}
+
+	session := tpm.HmacSession()
+
+	public, err := defineKeyDataNVIndex(tpm, handle, k.data, session)
+	if err != nil {
+		return err
+	}
+
+	if err := writeKeyDataToNVIndex(tpm.TPMContext, handle, k.data, session); err != nil {
+		if index, err := tpm2.CreateNVIndexResourceContextFromPublic(public); err == nil {
+			tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, session)
+		}
+		return err
+	}
+
+	path := k.path
+	backup := k.backup
+
+	k.nvIndex = handle
+	k.path = ""
+	k.backup = false
+	k.generation = 0
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return xerrors.Errorf("cannot remove key data file: %w", err)
+	}
+	if backup {
+		if err := os.Remove(backupKeyPath(path)); err != nil && !os.IsNotExist(err) {
+			return xerrors.Errorf("cannot remove backup key data file: %w", err)
+		}
+	}
+
+	return nil
+}
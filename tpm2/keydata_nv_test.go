@@ -0,0 +1,246 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+const (
+	testKeyDataNVIndexHandle   tpm2.Handle = 0x0181fff2
+	testKeyDataPCRPolicyHandle tpm2.Handle = 0x01810000
+)
+
+func TestSealKeyToNVIndex(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	authKey, err := SealKeyToTPMMultiple(tpm, []*SealKeyRequest{{Key: key, NVIndexHandle: testKeyDataNVIndexHandle}}, &KeyCreationParams{
+		PCRProfile:             getTestPCRProfile(),
+		PCRPolicyCounterHandle: testKeyDataPCRPolicyHandle})
+	if err != nil {
+		t.Fatalf("SealKeyToTPMMultiple failed: %v", err)
+	}
+	defer undefineNVKeyIndex(t, tpm, testKeyDataPCRPolicyHandle)
+	defer undefineNVKeyIndex(t, tpm, testKeyDataNVIndexHandle)
+
+	k, err := ReadSealedKeyObjectFromNVIndex(tpm, testKeyDataNVIndexHandle)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObjectFromNVIndex failed: %v", err)
+	}
+	if k.NVIndexHandle() != testKeyDataNVIndexHandle {
+		t.Errorf("Unexpected NV index handle")
+	}
+
+	if err := k.UpdatePCRProtectionPolicy(tpm, authKey, getTestPCRProfile()); err != nil {
+		t.Fatalf("UpdatePCRProtectionPolicy failed: %v", err)
+	}
+
+	k, err = ReadSealedKeyObjectFromNVIndex(tpm, testKeyDataNVIndexHandle)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObjectFromNVIndex failed: %v", err)
+	}
+	keyUnsealed, authKeyUnsealed, err := k.UnsealFromTPM(tpm, "")
+	if err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(keyUnsealed, key) {
+		t.Errorf("TPM returned the wrong key")
+	}
+	if !bytes.Equal(authKeyUnsealed, authKey) {
+		t.Errorf("TPM returned the wrong auth key")
+	}
+}
+
+func TestMigrateSealedKeyToNVIndex(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestMigrateSealedKeyToNVIndex_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+
+	if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{
+		PCRProfile:             getTestPCRProfile(),
+		PCRPolicyCounterHandle: testKeyDataPCRPolicyHandle,
+		BackupKeyFile:          true}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineNVKeyIndex(t, tpm, testKeyDataPCRPolicyHandle)
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if k.NVIndexHandle() != tpm2.HandleNull {
+		t.Errorf("Unexpected NV index handle")
+	}
+
+	if err := k.MigrateToNVIndex(tpm, testKeyDataNVIndexHandle); err != nil {
+		t.Fatalf("MigrateToNVIndex failed: %v", err)
+	}
+	defer undefineNVKeyIndex(t, tpm, testKeyDataNVIndexHandle)
+
+	for _, path := range []string{keyFile, keyFile + ".backup"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s wasn't removed", path)
+		}
+	}
+	if k.NVIndexHandle() != testKeyDataNVIndexHandle {
+		t.Errorf("Unexpected NV index handle")
+	}
+
+	if err := k.MigrateToNVIndex(tpm, testKeyDataNVIndexHandle); err == nil || err.Error() != "sealed key object is already stored in a NV index" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	k, err = ReadSealedKeyObjectFromNVIndex(tpm, testKeyDataNVIndexHandle)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObjectFromNVIndex failed: %v", err)
+	}
+
+	keyUnsealed, _, err := k.UnsealFromTPM(tpm, "")
+	if err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(keyUnsealed, key) {
+		t.Errorf("TPM returned the wrong key")
+	}
+}
+
+func TestSealedKeyNVIndexInterruptedUpdate(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	authKey, err := SealKeyToTPMMultiple(tpm, []*SealKeyRequest{{Key: key, NVIndexHandle: testKeyDataNVIndexHandle}}, &KeyCreationParams{
+		PCRProfile:             getTestPCRProfile(),
+		PCRPolicyCounterHandle: testKeyDataPCRPolicyHandle})
+	if err != nil {
+		t.Fatalf("SealKeyToTPMMultiple failed: %v", err)
+	}
+	defer undefineNVKeyIndex(t, tpm, testKeyDataPCRPolicyHandle)
+	defer undefineNVKeyIndex(t, tpm, testKeyDataNVIndexHandle)
+
+	k, err := ReadSealedKeyObjectFromNVIndex(tpm, testKeyDataNVIndexHandle)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObjectFromNVIndex failed: %v", err)
+	}
+	count := k.PCRPolicyCount()
+
+	// The update is written to the second slot.
+	if err := k.UpdatePCRProtectionPolicy(tpm, authKey, getTestPCRProfile()); err != nil {
+		t.Fatalf("UpdatePCRProtectionPolicy failed: %v", err)
+	}
+
+	index, err := tpm.CreateResourceContextFromTPM(testKeyDataNVIndexHandle)
+	if err != nil {
+		t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+	}
+	pub, _, err := tpm.NVReadPublic(index)
+	if err != nil {
+		t.Fatalf("NVReadPublic failed: %v", err)
+	}
+
+	// Simulate an update that was interrupted whilst writing the second slot. The previous
+	// copy in the first slot should be used.
+	if err := tpm.NVWrite(tpm.OwnerHandleContext(), index, make([]byte, 64), pub.Size/2+32, nil); err != nil {
+		t.Fatalf("NVWrite failed: %v", err)
+	}
+	k, err = ReadSealedKeyObjectFromNVIndex(tpm, testKeyDataNVIndexHandle)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObjectFromNVIndex failed: %v", err)
+	}
+	if k.PCRPolicyCount() != count {
+		t.Errorf("Unexpected PCR policy count %d (expected %d)", k.PCRPolicyCount(), count)
+	}
+
+	// Corrupt the first slot too.
+	if err := tpm.NVWrite(tpm.OwnerHandleContext(), index, make([]byte, 64), 32, nil); err != nil {
+		t.Fatalf("NVWrite failed: %v", err)
+	}
+	_, err = ReadSealedKeyObjectFromNVIndex(tpm, testKeyDataNVIndexHandle)
+	if _, ok := err.(InvalidKeyFileError); !ok || err.Error() != "invalid key data file: NV index does not contain valid key data" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestReadSealedKeyObjectFromNVIndexErrorHandling(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	t.Run("InvalidHandle", func(t *testing.T) {
+		_, err := ReadSealedKeyObjectFromNVIndex(tpm, 0x81000001)
+		if err == nil || err.Error() != "invalid handle" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("UnexpectedAttributes", func(t *testing.T) {
+		public := tpm2.NVPublic{
+			Index:   testKeyDataNVIndexHandle,
+			NameAlg: tpm2.HashAlgorithmSHA256,
+			Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead),
+			Size:    8}
+		index, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, &public, nil)
+		if err != nil {
+			t.Fatalf("NVDefineSpace failed: %v", err)
+		}
+		defer undefineNVSpace(t, tpm, index, tpm.OwnerHandleContext())
+
+		_, err = ReadSealedKeyObjectFromNVIndex(tpm, testKeyDataNVIndexHandle)
+		if _, ok := err.(InvalidKeyFileError); !ok || err.Error() != "invalid key data file: NV index has unexpected attributes" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
@@ -0,0 +1,121 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/keyring"
+)
+
+const (
+	// keyringPurposeDiskUnlock must match the purpose used by the secboot package
+	// so that keys added by this package can be retrieved with
+	// secboot.GetDiskUnlockKeyFromKernel.
+	keyringPurposeDiskUnlock = "unlock"
+
+	keyringPurposeAuth = "tpm2-auth"
+)
+
+func keyringPrefixOrDefault(prefix string) string {
+	if prefix == "" {
+		return "ubuntu-fde"
+	}
+	return prefix
+}
+
+// GetAuthKeyFromKernel retrieves the private part of the key used for authorizing
+// PCR policy updates associated with the sealed key object that was used to unlock
+// the encrypted container at the specified path. The value of prefix must match
+// the prefix that was supplied via ActivateVolumeOptions during unlocking.
+//
+// The returned key can be passed to SealedKeyObject.UpdatePCRProtectionPolicy in
+// order to update the PCR policy after boot without having to unseal the key again.
+//
+// If remove is true, the key will be removed from the kernel keyring prior
+// to returning.
+//
+// If no key is found, a secboot.ErrKernelKeyNotFound error will be returned.
+func GetAuthKeyFromKernel(prefix, devicePath string, remove bool) (PolicyAuthKey, error) {
+	key, err := keyring.GetKeyFromUserKeyring(devicePath, keyringPurposeAuth, keyringPrefixOrDefault(prefix))
+	if err != nil {
+		var e syscall.Errno
+		if xerrors.As(err, &e) && e == syscall.ENOKEY {
+			return nil, secboot.ErrKernelKeyNotFound
+		}
+		return nil, err
+	}
+
+	if remove {
+		if err := keyring.RemoveKeyFromUserKeyring(devicePath, keyringPurposeAuth, keyringPrefixOrDefault(prefix)); err != nil {
+			fmt.Fprintf(os.Stderr, "secboot: cannot remove key from keyring: %v\n", err)
+		}
+	}
+
+	return key, nil
+}
+
+// addAuthKeyToKeyring adds the supplied key used for authorizing PCR policy updates to the
+// user keyring, using the supplied options.
+func addAuthKeyToKeyring(prefix, devicePath string, key PolicyAuthKey, options *secboot.KeyringKeyOptions) error {
+	if options == nil {
+		options = &secboot.KeyringKeyOptions{}
+	}
+	return keyring.AddKeyToUserKeyringWithOptions(key, devicePath, keyringPurposeAuth, keyringPrefixOrDefault(prefix), options.Permissions, options.Timeout)
+}
+
+// AddAuthKeyToKernel stores the private part of the key used for authorizing PCR policy
+// updates in the kernel's user keyring, associated with the encrypted container at the
+// specified path, so that it can be retrieved later on with GetAuthKeyFromKernel. This
+// happens automatically when activating a volume with ActivateVolumeWithSealedKey, so this
+// is only useful if the key is obtained some other way, eg, via SealedKeyObject.UnsealFromTPM.
+//
+// The options argument can be used to restrict the permissions of the key and to specify
+// a timeout after which the key expires. If nil, the key is stored with the default
+// permissions and no timeout.
+func AddAuthKeyToKernel(prefix, devicePath string, key PolicyAuthKey, options *secboot.KeyringKeyOptions) error {
+	if err := addAuthKeyToKeyring(prefix, devicePath, key, options); err != nil {
+		return xerrors.Errorf("cannot add key to user keyring: %w", err)
+	}
+	return nil
+}
+
+// ScrubAuthKeyFromKernel invalidates the key used for authorizing PCR policy updates that
+// is associated with the encrypted container at the specified path, so that it is no longer
+// available to any process. This should be called once the key is no longer required, eg,
+// once all post-boot PCR policy updates are complete. The value of prefix must match the
+// prefix that was supplied via ActivateVolumeOptions during unlocking.
+//
+// If no key is found, a secboot.ErrKernelKeyNotFound error will be returned.
+func ScrubAuthKeyFromKernel(prefix, devicePath string) error {
+	if err := keyring.InvalidateKeyInUserKeyring(devicePath, keyringPurposeAuth, keyringPrefixOrDefault(prefix)); err != nil {
+		var e syscall.Errno
+		if xerrors.As(err, &e) && e == syscall.ENOKEY {
+			return secboot.ErrKernelKeyNotFound
+		}
+		return xerrors.Errorf("cannot invalidate key: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"math/rand"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/keyring"
+	"github.com/snapcore/secboot/internal/testutil"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type keyringSuite struct {
+	testutil.KeyringTestBase
+}
+
+var _ = Suite(&keyringSuite{})
+
+func (s *keyringSuite) SetUpSuite(c *C) {
+	s.KeyringTestBase.SetUpSuite(c)
+
+	if !s.ProcessPossessesUserKeyringKeys {
+		c.Skip("Test requires the user keyring to be linked from the process's session keyring")
+	}
+}
+
+type testGetAuthKeyFromKernelData struct {
+	key        PolicyAuthKey
+	prefix     string
+	devicePath string
+}
+
+func (s *keyringSuite) testGetAuthKeyFromKernel(c *C, data *testGetAuthKeyFromKernelData) {
+	prefix := data.prefix
+	if prefix == "" {
+		prefix = "ubuntu-fde"
+	}
+	c.Check(keyring.AddKeyToUserKeyring(data.key, data.devicePath, "tpm2-auth", prefix), IsNil)
+
+	key, err := GetAuthKeyFromKernel(data.prefix, data.devicePath, false)
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, data.key)
+}
+
+func (s *keyringSuite) TestGetAuthKeyFromKernel1(c *C) {
+	key := make(PolicyAuthKey, 32)
+	rand.Read(key)
+
+	s.testGetAuthKeyFromKernel(c, &testGetAuthKeyFromKernelData{
+		key:        key,
+		devicePath: "/dev/sda1"})
+}
+
+func (s *keyringSuite) TestGetAuthKeyFromKernel2(c *C) {
+	key := make(PolicyAuthKey, 32)
+	rand.Read(key)
+
+	s.testGetAuthKeyFromKernel(c, &testGetAuthKeyFromKernelData{
+		key:        key,
+		prefix:     "foo",
+		devicePath: "/dev/nvme0n1p2"})
+}
+
+func (s *keyringSuite) TestGetAuthKeyFromKernelNoKey(c *C) {
+	_, err := GetAuthKeyFromKernel("", "/dev/sda1", false)
+	c.Check(err, ErrorMatches, "cannot find key in kernel keyring")
+}
+
+func (s *keyringSuite) TestGetAuthKeyFromKernelAndRemove(c *C) {
+	key := make(PolicyAuthKey, 32)
+	rand.Read(key)
+
+	c.Check(keyring.AddKeyToUserKeyring(key, "/dev/sda1", "tpm2-auth", "ubuntu-fde"), IsNil)
+
+	key2, err := GetAuthKeyFromKernel("", "/dev/sda1", true)
+	c.Check(err, IsNil)
+	c.Check(key2, DeepEquals, key)
+
+	_, err = GetAuthKeyFromKernel("", "/dev/sda1", true)
+	c.Check(err, ErrorMatches, "cannot find key in kernel keyring")
+
+	_, err = keyring.GetKeyFromUserKeyring("/dev/sda1", "tpm2-auth", "ubuntu-fde")
+	c.Check(err, ErrorMatches, "cannot find key: required key not available")
+}
+
+func (s *keyringSuite) TestAddAuthKeyToKernel(c *C) {
+	key := make(PolicyAuthKey, 32)
+	rand.Read(key)
+
+	c.Check(AddAuthKeyToKernel("", "/dev/sda1", key, &secboot.KeyringKeyOptions{Timeout: time.Hour}), IsNil)
+
+	key2, err := GetAuthKeyFromKernel("", "/dev/sda1", false)
+	c.Check(err, IsNil)
+	c.Check(key2, DeepEquals, key)
+}
+
+func (s *keyringSuite) TestAddAuthKeyToKernelNilOptions(c *C) {
+	key := make(PolicyAuthKey, 32)
+	rand.Read(key)
+
+	c.Check(AddAuthKeyToKernel("foo", "/dev/sda1", key, nil), IsNil)
+
+	key2, err := keyring.GetKeyFromUserKeyring("/dev/sda1", "tpm2-auth", "foo")
+	c.Check(err, IsNil)
+	c.Check(key2, DeepEquals, []byte(key))
+}
+
+func (s *keyringSuite) TestScrubAuthKeyFromKernel(c *C) {
+	c.Check(keyring.AddKeyToUserKeyring(make([]byte, 32), "/dev/sda1", "tpm2-auth", "ubuntu-fde"), IsNil)
+
+	c.Check(ScrubAuthKeyFromKernel("", "/dev/sda1"), IsNil)
+
+	_, err := GetAuthKeyFromKernel("", "/dev/sda1", false)
+	c.Check(err, Equals, secboot.ErrKernelKeyNotFound)
+}
+
+func (s *keyringSuite) TestScrubAuthKeyFromKernelNoKey(c *C) {
+	c.Check(ScrubAuthKeyFromKernel("", "/dev/sda1"), Equals, secboot.ErrKernelKeyNotFound)
+}
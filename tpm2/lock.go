@@ -0,0 +1,253 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+
+	"golang.org/x/xerrors"
+)
+
+const lockIndexAttrs = tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA | tpm2.AttrNVReadStClear
+
+// computeLockIndexAuthPolicy computes the authorization policy for a lock NV index, which only permits the index to be written
+// with knowledge of the storage hierarchy's authorization value.
+func computeLockIndexAuthPolicy() tpm2.Digest {
+	trial, _ := tpm2.ComputeAuthPolicy(tpm2.HashAlgorithmSHA256)
+	trial.PolicyCommandCode(tpm2.CommandNVWrite)
+	trial.PolicySecret(mu.MustMarshalToBytes(tpm2.HandleOwner), nil)
+	return trial.GetDigest()
+}
+
+// makeLockIndexPublic returns the public area of an initialized lock NV index at the specified handle with the specified
+// authorization policy. The index has an empty authorization value, so anyone can read-lock it, after which the index can't be
+// used in a TPM2_PolicyNV assertion until the next TPM reset or restart. The contents of the index aren't significant.
+func makeLockIndexPublic(handle tpm2.Handle, authPolicy tpm2.Digest) *tpm2.NVPublic {
+	return &tpm2.NVPublic{
+		Index:      handle,
+		NameAlg:    tpm2.HashAlgorithmSHA256,
+		Attrs:      tpm2.NVTypeOrdinary.WithAttrs(lockIndexAttrs | tpm2.AttrNVWritten),
+		AuthPolicy: authPolicy,
+		Size:       1}
+}
+
+// isLockIndex indicates whether the supplied public area is for a lock NV index created by createLockIndex, ignoring
+// whether it is currently read-locked.
+func isLockIndex(public *tpm2.NVPublic) bool {
+	expected := makeLockIndexPublic(public.Index, nil)
+	return public.NameAlg == expected.NameAlg &&
+		public.Attrs&^tpm2.AttrNVReadLocked == expected.Attrs &&
+		len(public.AuthPolicy) == public.NameAlg.Size() &&
+		public.Size == expected.Size
+}
+
+// createLockIndex creates and initializes a lock NV index at the specified handle. This requires knowledge of the storage
+// hierarchy's authorization value.
+//
+// The index can only be written with knowledge of the storage hierarchy's authorization value. As the index must be written
+// to be used in a TPM2_PolicyNV assertion and its name changes when it is written, an index with the same name can only be
+// recreated after it has been locked with this authorization value, which is how UnlockSealedKeyAccess works.
+func createLockIndex(tpm *tpm2.TPMContext, handle tpm2.Handle, hmacSession tpm2.SessionContext) (*tpm2.NVPublic, error) {
+	public := makeLockIndexPublic(handle, computeLockIndexAuthPolicy())
+	public.Attrs &^= tpm2.AttrNVWritten
+
+	index, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, public, hmacSession)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot define NV space: %w", err)
+	}
+
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, hmacSession)
+	}()
+
+	policySession, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, public.NameAlg)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot start policy session: %w", err)
+	}
+	defer tpm.FlushContext(policySession)
+
+	if err := tpm.PolicyCommandCode(policySession, tpm2.CommandNVWrite); err != nil {
+		return nil, xerrors.Errorf("cannot execute assertion: %w", err)
+	}
+
+	if _, _, err := tpm.PolicySecret(tpm.OwnerHandleContext(), policySession, nil, nil, 0, hmacSession); err != nil {
+		return nil, xerrors.Errorf("cannot execute assertion: %w", err)
+	}
+
+	// The index must be written before it can be used in a TPM2_PolicyNV assertion.
+	if err := tpm.NVWrite(index, index, []byte{0}, 0, policySession, hmacSession.IncludeAttrs(tpm2.AttrAudit)); err != nil {
+		return nil, xerrors.Errorf("cannot initialize NV index: %w", err)
+	}
+
+	succeeded = true
+	public.Attrs |= tpm2.AttrNVWritten
+	return public, nil
+}
+
+// readLockIndexPublic returns the public area of the lock NV index at the specified handle, as it was when it was initialized.
+// If there is no lock NV index at the specified handle, a error is returned.
+func readLockIndexPublic(tpm *tpm2.TPMContext, handle tpm2.Handle, hmacSession tpm2.SessionContext) (*tpm2.NVPublic, error) {
+	index, err := tpm.CreateResourceContextFromTPM(handle, hmacSession.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, err
+	}
+
+	public, _, err := tpm.NVReadPublic(index, hmacSession.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read public area of NV index: %w", err)
+	}
+	if !isLockIndex(public) {
+		return nil, TPMResourceExistsError{handle}
+	}
+
+	// The name of the index used in TPM2_PolicyNV assertions is the name before it is read-locked.
+	public.Attrs &^= tpm2.AttrNVReadLocked
+	return public, nil
+}
+
+// ensureLockIndex returns the public area of the lock NV index at the specified handle, creating it if it doesn't already
+// exist. An existing lock index is shared between sealed key objects. If there is another NV index at the specified handle,
+// a TPMResourceExistsError error is returned.
+func ensureLockIndex(tpm *tpm2.TPMContext, handle tpm2.Handle, hmacSession tpm2.SessionContext) (public *tpm2.NVPublic, created bool, err error) {
+	if handle.Type() != tpm2.HandleTypeNVIndex {
+		return nil, false, errors.New("invalid handle")
+	}
+
+	public, err = readLockIndexPublic(tpm, handle, hmacSession)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, handle):
+		public, err := createLockIndex(tpm, handle, hmacSession)
+		if err != nil {
+			return nil, false, err
+		}
+		return public, true, nil
+	case err != nil:
+		var existsErr TPMResourceExistsError
+		if xerrors.As(err, &existsErr) {
+			return nil, false, existsErr
+		}
+		return nil, false, xerrors.Errorf("cannot obtain lock index: %w", err)
+	}
+
+	return public, false, nil
+}
+
+// lockIndexContext returns a ResourceContext for the lock NV index at the specified handle, checking that it is a lock
+// NV index.
+func lockIndexContext(tpm *Connection, handle tpm2.Handle) (tpm2.ResourceContext, *tpm2.NVPublic, error) {
+	if handle.Type() != tpm2.HandleTypeNVIndex {
+		return nil, nil, errors.New("invalid handle")
+	}
+
+	session := tpm.HmacSession()
+
+	index, err := tpm.CreateResourceContextFromTPM(handle, session.IncludeAttrs(tpm2.AttrAudit))
+	switch {
+	case tpm2.IsResourceUnavailableError(err, handle):
+		return nil, nil, fmt.Errorf("no lock index at handle %v", handle)
+	case err != nil:
+		return nil, nil, xerrors.Errorf("cannot create context for lock index: %w", err)
+	}
+
+	public, _, err := tpm.NVReadPublic(index, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot read public area of lock index: %w", err)
+	}
+	if !isLockIndex(public) {
+		return nil, nil, fmt.Errorf("NV index at handle %v is not a lock index", handle)
+	}
+
+	return index, public, nil
+}
+
+// LockSealedKeyAccess locks access to all sealed key objects that were created with the lock NV index at the specified handle
+// (see the LockIndexHandle field of KeyCreationParams), until the next TPM reset or restart. Unlike BlockPCRProtectionPolicies,
+// this doesn't affect sealed key objects that use a different lock index, so sealed key objects with different roles can be
+// locked independently. Locking an index that is already locked is not an error.
+//
+// Once locked, SealedKeyObject.UnsealFromTPM will return a ErrSealedKeyAccessLocked error for the affected sealed key objects.
+// Access can be restored before the next TPM reset or restart with UnlockSealedKeyAccess, but only with knowledge of the
+// storage hierarchy's authorization value. The lock is therefore only as strong as that authorization value, and it
+// provides no protection against an adversary that can run code on the device if the authorization value is empty.
+func LockSealedKeyAccess(tpm *Connection, lockIndexHandle tpm2.Handle) error {
+	index, public, err := lockIndexContext(tpm, lockIndexHandle)
+	if err != nil {
+		return err
+	}
+	if public.Attrs&tpm2.AttrNVReadLocked != 0 {
+		return nil
+	}
+
+	if err := tpm.NVReadLock(index, index, tpm.HmacSession()); err != nil {
+		return xerrors.Errorf("cannot lock NV index: %w", err)
+	}
+	return nil
+}
+
+// IsSealedKeyAccessLocked indicates whether access to sealed key objects that were created with the lock NV index at the
+// specified handle is currently locked.
+func IsSealedKeyAccessLocked(tpm *Connection, lockIndexHandle tpm2.Handle) (bool, error) {
+	_, public, err := lockIndexContext(tpm, lockIndexHandle)
+	if err != nil {
+		return false, err
+	}
+	return public.Attrs&tpm2.AttrNVReadLocked != 0, nil
+}
+
+// UnlockSealedKeyAccess reverses the effect of LockSealedKeyAccess before the next TPM reset or restart, by undefining the
+// lock NV index at the specified handle and recreating an identical one. This requires knowledge of the authorization value
+// for the storage hierarchy, which must be provided by calling Connection.OwnerHandleContext().SetAuthValue() prior to
+// calling this function. If the provided authorization value is incorrect, a AuthFailError error will be returned.
+// Unlocking an index that isn't locked is not an error.
+func UnlockSealedKeyAccess(tpm *Connection, lockIndexHandle tpm2.Handle) error {
+	index, public, err := lockIndexContext(tpm, lockIndexHandle)
+	if err != nil {
+		return err
+	}
+	if public.Attrs&tpm2.AttrNVReadLocked == 0 {
+		return nil
+	}
+	if !bytes.Equal(public.AuthPolicy, computeLockIndexAuthPolicy()) {
+		return fmt.Errorf("lock index at handle %v cannot be recreated with the same name", lockIndexHandle)
+	}
+
+	session := tpm.HmacSession()
+
+	if err := tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, session); err != nil {
+		if isAuthFailError(err, tpm2.CommandNVUndefineSpace, 1) {
+			return AuthFailError{tpm2.HandleOwner}
+		}
+		return xerrors.Errorf("cannot undefine lock index: %w", err)
+	}
+
+	if _, err := createLockIndex(tpm.TPMContext, lockIndexHandle, session); err != nil {
+		return xerrors.Errorf("cannot recreate lock index: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+func TestLockSealedKeyAccess(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestLockSealedKeyAccess_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	runKeyFile := filepath.Join(tmpDir, "run")
+	runKeyFile2 := filepath.Join(tmpDir, "run2")
+	recoveryKeyFile := filepath.Join(tmpDir, "recovery")
+
+	runLockHandle := tpm2.Handle(0x01810010)
+	recoveryLockHandle := tpm2.Handle(0x01810011)
+
+	defer func() {
+		for _, h := range []tpm2.Handle{runLockHandle, recoveryLockHandle} {
+			rc, err := tpm.CreateResourceContextFromTPM(h)
+			if err != nil {
+				continue
+			}
+			undefineNVSpace(t, tpm, rc, tpm.OwnerHandleContext())
+		}
+	}()
+
+	for _, data := range []struct {
+		path   string
+		handle tpm2.Handle
+	}{
+		{path: runKeyFile, handle: runLockHandle},
+		{path: runKeyFile2, handle: runLockHandle},
+		{path: recoveryKeyFile, handle: recoveryLockHandle},
+	} {
+		if _, err := SealKeyToTPM(tpm, key, data.path, &KeyCreationParams{
+			PCRProfile:             getTestPCRProfile(),
+			PCRPolicyCounterHandle: tpm2.HandleNull,
+			LockIndexHandle:        data.handle}); err != nil {
+			t.Fatalf("SealKeyToTPM failed: %v", err)
+		}
+	}
+
+	unseal := func(t *testing.T, path string) error {
+		k, err := ReadSealedKeyObject(path)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		unsealedKey, _, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(unsealedKey, key) {
+			t.Errorf("Unexpected key")
+		}
+		return nil
+	}
+
+	checkLocked := func(t *testing.T, handle tpm2.Handle, expected bool) {
+		locked, err := IsSealedKeyAccessLocked(tpm, handle)
+		if err != nil {
+			t.Fatalf("IsSealedKeyAccessLocked failed: %v", err)
+		}
+		if locked != expected {
+			t.Errorf("Unexpected lock state for %v: %v", handle, locked)
+		}
+	}
+
+	k, err := ReadSealedKeyObject(runKeyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if k.LockIndexHandle() != runLockHandle {
+		t.Errorf("Unexpected lock index handle: %v", k.LockIndexHandle())
+	}
+
+	for _, path := range []string{runKeyFile, runKeyFile2, recoveryKeyFile} {
+		if err := unseal(t, path); err != nil {
+			t.Errorf("UnsealFromTPM failed: %v", err)
+		}
+	}
+	checkLocked(t, runLockHandle, false)
+	checkLocked(t, recoveryLockHandle, false)
+
+	// Locking the run index should only affect the keys that share it
+	if err := LockSealedKeyAccess(tpm, runLockHandle); err != nil {
+		t.Fatalf("LockSealedKeyAccess failed: %v", err)
+	}
+	checkLocked(t, runLockHandle, true)
+	checkLocked(t, recoveryLockHandle, false)
+
+	for _, path := range []string{runKeyFile, runKeyFile2} {
+		if err := unseal(t, path); err != ErrSealedKeyAccessLocked {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	}
+	if err := unseal(t, recoveryKeyFile); err != nil {
+		t.Errorf("UnsealFromTPM failed: %v", err)
+	}
+
+	// Locking again should be a no-op
+	if err := LockSealedKeyAccess(tpm, runLockHandle); err != nil {
+		t.Errorf("LockSealedKeyAccess failed: %v", err)
+	}
+
+	// Unlocking requires the storage hierarchy's authorization value.
+	testAuth := []byte("1234")
+	if err := tpm.HierarchyChangeAuth(tpm.OwnerHandleContext(), testAuth, nil); err != nil {
+		t.Fatalf("HierarchyChangeAuth failed: %v", err)
+	}
+	defer func() {
+		tpm.OwnerHandleContext().SetAuthValue(testAuth)
+		if err := tpm.HierarchyChangeAuth(tpm.OwnerHandleContext(), nil, nil); err != nil {
+			t.Errorf("HierarchyChangeAuth failed: %v", err)
+		}
+	}()
+
+	tpm.OwnerHandleContext().SetAuthValue([]byte("5678"))
+	if err := UnlockSealedKeyAccess(tpm, runLockHandle); err != (AuthFailError{tpm2.HandleOwner}) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	checkLocked(t, runLockHandle, true)
+
+	tpm.OwnerHandleContext().SetAuthValue(testAuth)
+	if err := UnlockSealedKeyAccess(tpm, runLockHandle); err != nil {
+		t.Fatalf("UnlockSealedKeyAccess failed: %v", err)
+	}
+	checkLocked(t, runLockHandle, false)
+
+	for _, path := range []string{runKeyFile, runKeyFile2, recoveryKeyFile} {
+		if err := unseal(t, path); err != nil {
+			t.Errorf("UnsealFromTPM failed: %v", err)
+		}
+	}
+
+	// Unlocking an index that isn't locked should be a no-op
+	if err := UnlockSealedKeyAccess(tpm, recoveryLockHandle); err != nil {
+		t.Errorf("UnlockSealedKeyAccess failed: %v", err)
+	}
+
+	// Querying a handle without a lock index should fail
+	if _, err := IsSealedKeyAccessLocked(tpm, 0x01810012); err == nil {
+		t.Errorf("IsSealedKeyAccessLocked should have failed")
+	}
+}
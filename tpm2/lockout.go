@@ -0,0 +1,114 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"time"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// DictionaryAttackParameters contains the parameters for the TPM's dictionary attack protection logic.
+type DictionaryAttackParameters struct {
+	MaxTries        uint32 // The number of authorization failures before the TPM enters lockout mode
+	RecoveryTime    uint32 // The number of seconds before the authorization failure count is decremented
+	LockoutRecovery uint32 // The number of seconds after a lockout hierarchy authorization failure before it can be used again
+}
+
+// DefaultDictionaryAttackParameters returns the dictionary attack parameters that are configured by EnsureProvisioned.
+func DefaultDictionaryAttackParameters() *DictionaryAttackParameters {
+	return &DictionaryAttackParameters{
+		MaxTries:        maxTries,
+		RecoveryTime:    recoveryTime,
+		LockoutRecovery: lockoutRecovery}
+}
+
+// LockoutStatus describes the current state of the TPM's dictionary attack protection logic.
+type LockoutStatus struct {
+	LockoutParameters
+
+	// RecoveryTimeRemaining is an estimate of the maximum time before the TPM exits lockout mode
+	// if there are no further authorization failures. This is zero if the TPM is not in lockout
+	// mode, or if the TPM has been configured to not decrement the authorization failure count.
+	RecoveryTimeRemaining time.Duration
+}
+
+// readLockoutProperties returns the TPM properties in the range from PropertyPermanent to PropertyLockoutRecovery,
+// which includes the dictionary attack protection properties.
+func readLockoutProperties(tpm *Connection) (map[tpm2.Property]uint32, error) {
+	return getTPMProperties(tpm, tpm2.PropertyPermanent, uint32(tpm2.PropertyLockoutRecovery-tpm2.PropertyPermanent)+1)
+}
+
+func makeLockoutParameters(props map[tpm2.Property]uint32) LockoutParameters {
+	return LockoutParameters{
+		MaxAuthFail: props[tpm2.PropertyMaxAuthFail],
+		Counter:     props[tpm2.PropertyLockoutCounter],
+		Interval:    props[tpm2.PropertyLockoutInterval],
+		Recovery:    props[tpm2.PropertyLockoutRecovery],
+		InLockout:   tpm2.PermanentAttributes(props[tpm2.PropertyPermanent])&tpm2.AttrInLockout > 0}
+}
+
+// QueryLockoutStatus returns the current state of the TPM's dictionary attack protection logic, which includes whether it is in
+// lockout mode, the current authorization failure count and an estimate of the time remaining before it will exit lockout mode.
+func QueryLockoutStatus(tpm *Connection) (*LockoutStatus, error) {
+	props, err := readLockoutProperties(tpm)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain lockout properties: %w", err)
+	}
+
+	params := makeLockoutParameters(props)
+	status := &LockoutStatus{LockoutParameters: params}
+	if params.InLockout && params.Interval > 0 {
+		// The TPM exits lockout mode once the failure count drops below the maximum
+		// number of failures. We don't know how long it has been since the count was
+		// last decremented, so this is an upper bound.
+		n := uint64(1)
+		if params.Counter >= params.MaxAuthFail {
+			n += uint64(params.Counter - params.MaxAuthFail)
+		}
+		status.RecoveryTimeRemaining = time.Duration(n*uint64(params.Interval)) * time.Second
+	}
+
+	return status, nil
+}
+
+// ResetLockout resets the TPM's authorization failure count and takes it out of lockout mode, using the supplied authorization
+// value for the lockout hierarchy.
+//
+// If the wrong lockout hierarchy authorization value is provided, then a AuthFailError error will be returned. If this happens,
+// the lockout hierarchy will be unavailable until the time configured by the LockoutRecovery field of DictionaryAttackParameters
+// has elapsed, and further calls will result in a ErrTPMLockout error being returned.
+func ResetLockout(tpm *Connection, lockoutAuth []byte) error {
+	tpm.LockoutHandleContext().SetAuthValue(lockoutAuth)
+
+	if err := tpm.DictionaryAttackLockReset(tpm.LockoutHandleContext(), tpm.HmacSession()); err != nil {
+		switch {
+		case isAuthFailError(err, tpm2.CommandDictionaryAttackLockReset, 1):
+			return AuthFailError{tpm2.HandleLockout}
+		case tpm2.IsTPMWarning(err, tpm2.WarningLockout, tpm2.CommandDictionaryAttackLockReset):
+			return ErrTPMLockout
+		}
+		return xerrors.Errorf("cannot reset dictionary attack lockout: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+// triggerDAFailure performs an authorization check with the wrong authorization value
+// against a DA protected resource, in order to increment the TPM's authorization failure
+// count.
+func triggerDAFailure(t *testing.T, tpm *Connection) {
+	public := tpm2.NVPublic{
+		Index:   0x0181fff2,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead),
+		Size:    8}
+	index, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), []byte("foo"), &public, nil)
+	if err != nil {
+		t.Fatalf("NVDefineSpace failed: %v", err)
+	}
+	defer undefineNVSpace(t, tpm, index, tpm.OwnerHandleContext())
+
+	index.SetAuthValue([]byte("bar"))
+	if err := tpm.NVWrite(index, index, make([]byte, 8), 0, nil); !tpm2.IsTPMSessionError(err, tpm2.ErrorAuthFail, tpm2.CommandNVWrite, 1) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestQueryLockoutStatus(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	clearTPMWithPlatformAuth(t, tpm)
+
+	if err := tpm.DictionaryAttackParameters(tpm.LockoutHandleContext(), 1, 10, 20, nil); err != nil {
+		t.Fatalf("DictionaryAttackParameters failed: %v", err)
+	}
+
+	status, err := QueryLockoutStatus(tpm)
+	if err != nil {
+		t.Fatalf("QueryLockoutStatus failed: %v", err)
+	}
+	expected := LockoutStatus{LockoutParameters: LockoutParameters{MaxAuthFail: 1, Interval: 10, Recovery: 20}}
+	if *status != expected {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+
+	triggerDAFailure(t, tpm)
+
+	status, err = QueryLockoutStatus(tpm)
+	if err != nil {
+		t.Fatalf("QueryLockoutStatus failed: %v", err)
+	}
+	expected = LockoutStatus{
+		LockoutParameters:     LockoutParameters{MaxAuthFail: 1, Counter: 1, Interval: 10, Recovery: 20, InLockout: true},
+		RecoveryTimeRemaining: 10 * time.Second}
+	if *status != expected {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+}
+
+func TestResetLockout(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	clearTPMWithPlatformAuth(t, tpm)
+
+	if err := tpm.DictionaryAttackParameters(tpm.LockoutHandleContext(), 1, 10, 20, nil); err != nil {
+		t.Fatalf("DictionaryAttackParameters failed: %v", err)
+	}
+	setHierarchyAuthForTest(t, tpm, tpm.LockoutHandleContext())
+
+	triggerDAFailure(t, tpm)
+
+	if err := ResetLockout(tpm, testAuth); err != nil {
+		t.Fatalf("ResetLockout failed: %v", err)
+	}
+
+	status, err := QueryLockoutStatus(tpm)
+	if err != nil {
+		t.Fatalf("QueryLockoutStatus failed: %v", err)
+	}
+	if status.InLockout || status.Counter != 0 {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+}
+
+func TestResetLockoutWrongAuth(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	clearTPMWithPlatformAuth(t, tpm)
+	setHierarchyAuthForTest(t, tpm, tpm.LockoutHandleContext())
+
+	err := ResetLockout(tpm, []byte("5678"))
+	if e, ok := err.(AuthFailError); !ok || e.Handle != tpm2.HandleLockout {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if err := ResetLockout(tpm, testAuth); err != ErrTPMLockout {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
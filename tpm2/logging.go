@@ -0,0 +1,56 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"encoding/binary"
+
+	"github.com/canonical/go-tpm2"
+
+	"github.com/snapcore/secboot/internal/logger"
+)
+
+// loggingTcti wraps a tpm2.TCTI and emits a debug event for each command that is
+// submitted to the TPM whilst a logger is set. The logger is checked for each command,
+// so that a logger set after the connection was opened still receives events.
+type loggingTcti struct {
+	tpm2.TCTI
+}
+
+func (t *loggingTcti) Write(data []byte) (int, error) {
+	n, err := t.TCTI.Write(data)
+
+	// The command header is the tag (2 bytes), the command size (4 bytes) and the
+	// command code (4 bytes).
+	if logger.Enabled() && len(data) >= 10 {
+		logger.Debug("tpm2-command",
+			logger.F("command", tpm2.CommandCode(binary.BigEndian.Uint32(data[6:10]))),
+			logger.F("size", len(data)),
+			logger.Err(err))
+	}
+
+	return n, err
+}
+
+// wrapTctiForLogging returns a TCTI that emits a debug event for each command whilst a
+// logger is set.
+func wrapTctiForLogging(tcti tpm2.TCTI) tpm2.TCTI {
+	return &loggingTcti{tcti}
+}
@@ -0,0 +1,67 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+
+	"github.com/snapcore/secboot/internal/logger"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type mockTcti struct {
+	tpm2.TCTI
+}
+
+func (t *mockTcti) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+type mockLogger struct {
+	events []string
+}
+
+func (l *mockLogger) Debug(event string, fields ...logger.Field) {
+	l.events = append(l.events, event)
+}
+
+func TestLoggingTctiLoggerSetAfterWrapping(t *testing.T) {
+	tcti := WrapTctiForLogging(new(mockTcti))
+
+	// TPM2_GetCapability command header.
+	cmd := []byte{0x80, 0x01, 0x00, 0x00, 0x00, 0x0a, 0x00, 0x00, 0x01, 0x7a}
+
+	if _, err := tcti.Write(cmd); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	l := new(mockLogger)
+	logger.Set(l)
+	defer logger.Set(nil)
+
+	if _, err := tcti.Write(cmd); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if len(l.events) != 1 || l.events[0] != "tpm2-command" {
+		t.Errorf("Unexpected events: %v", l.events)
+	}
+}
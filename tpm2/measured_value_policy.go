@@ -0,0 +1,64 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"errors"
+
+	"github.com/canonical/go-tpm2"
+)
+
+func computeMeasuredValueDigest(alg tpm2.HashAlgorithmId, value []byte) tpm2.Digest {
+	h := alg.NewHash()
+	h.Write(value)
+	return h.Sum(nil)
+}
+
+// AddMeasuredValueProfile adds a profile to the PCR protection profile for an arbitrary value that is measured to the specified
+// PCR with MeasureValueToTPM, such as the boot mode or some other string or boolean state that snap-bootstrap measures. The
+// digest of each value is computed as (where H is the digest algorithm supplied via alg):
+//  digest = H(value)
+//
+// The values argument is the set of permitted values, each of which is added as an alternative branch to the profile. At least
+// one value must be supplied.
+func AddMeasuredValueProfile(profile *PCRProtectionProfile, pcr int, alg tpm2.HashAlgorithmId, values [][]byte) error {
+	if pcr < 0 {
+		return errors.New("invalid PCR index")
+	}
+	if len(values) == 0 {
+		return errors.New("no values provided")
+	}
+
+	var subProfiles []*PCRProtectionProfile
+	for _, value := range values {
+		subProfiles = append(subProfiles, NewPCRProtectionProfile().ExtendPCR(alg, pcr, computeMeasuredValueDigest(alg, value)))
+	}
+
+	profile.AddProfileOR(subProfiles...)
+	return nil
+}
+
+// MeasureValueToTPM measures a digest of the supplied value to the specified PCR for all supported PCR banks. See the
+// documentation for AddMeasuredValueProfile for details of how the digest is computed.
+func MeasureValueToTPM(tpm *Connection, pcr int, value []byte) error {
+	return measureSnapPropertyToTPM(tpm, pcr, func(alg tpm2.HashAlgorithmId) (tpm2.Digest, error) {
+		return computeMeasuredValueDigest(alg, value), nil
+	})
+}
@@ -0,0 +1,80 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"github.com/canonical/go-tpm2"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot/internal/testutil"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type measuredValueProfileSuite struct{}
+
+var _ = Suite(&measuredValueProfileSuite{})
+
+func (s *measuredValueProfileSuite) TestAddMeasuredValueProfile(c *C) {
+	profile := NewPCRProtectionProfile()
+	c.Check(AddMeasuredValueProfile(profile, 12, tpm2.HashAlgorithmSHA256, [][]byte{[]byte("run"), []byte("recover")}), IsNil)
+
+	values, err := profile.ComputePCRValues(nil)
+	c.Assert(err, IsNil)
+	c.Check(values, DeepEquals, []tpm2.PCRValues{
+		{
+			tpm2.HashAlgorithmSHA256: {
+				12: testutil.DecodeHexString(c, "f633a2792d0aec4aedeb687beba39194a08d2ae4a05336deb9d8269ff78620db"),
+			},
+		},
+		{
+			tpm2.HashAlgorithmSHA256: {
+				12: testutil.DecodeHexString(c, "b7e935a380bacf86495c05753c043c0b4420099194955e8e9519966e730f66b5"),
+			},
+		},
+	})
+}
+
+func (s *measuredValueProfileSuite) TestAddMeasuredValueProfileNoValues(c *C) {
+	c.Check(AddMeasuredValueProfile(NewPCRProtectionProfile(), 12, tpm2.HashAlgorithmSHA256, nil), ErrorMatches, "no values provided")
+}
+
+func (s *measuredValueProfileSuite) TestAddMeasuredValueProfileInvalidPCR(c *C) {
+	c.Check(AddMeasuredValueProfile(NewPCRProtectionProfile(), -1, tpm2.HashAlgorithmSHA256, [][]byte{[]byte("run")}), ErrorMatches, "invalid PCR index")
+}
+
+type measuredValueMeasureSuite struct {
+	testutil.TPMSimulatorTestBase
+}
+
+var _ = Suite(&measuredValueMeasureSuite{})
+
+func (s *measuredValueMeasureSuite) SetUpTest(c *C) {
+	s.TPMSimulatorTestBase.SetUpTest(c)
+	s.ResetTPMSimulator(c)
+}
+
+func (s *measuredValueMeasureSuite) TestMeasureValueToTPM(c *C) {
+	c.Check(MeasureValueToTPM(s.TPM, 12, []byte("recover")), IsNil)
+
+	_, pcrValues, err := s.TPM.PCRRead(tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{12}}})
+	c.Assert(err, IsNil)
+	c.Check(pcrValues[tpm2.HashAlgorithmSHA256][12], DeepEquals, tpm2.Digest(testutil.DecodeHexString(c, "b7e935a380bacf86495c05753c043c0b4420099194955e8e9519966e730f66b5")))
+}
@@ -0,0 +1,211 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"crypto/rand"
+	"errors"
+	"os"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/tcg"
+)
+
+// ExportForMigration exports this sealed key object to a file at the specified path, so that it can be moved to a new
+// storage root key created from the supplied template without having to re-enrol from the plaintext key. This is useful
+// for changing the algorithm of the storage root key.
+//
+// The exported file contains a duplication object that is wrapped to the storage root key that the TPM will create from
+// srkTemplate. Its authorization policy and PCR policy are the same as those of this sealed key object. It can be
+// unwrapped later on by RewrapSealedKeyObject, once the storage root key has been replaced.
+//
+// Migration across a TPM clear is not supported. As the new storage root key is derived from the TPM's current storage
+// primary seed, the exported file can only be imported by the same TPM whilst the seed remains unchanged, so the storage
+// root key must be replaced by evicting the existing one. Wrapping the exported file to a key that survives a clear, such
+// as the endorsement key, wouldn't help because clearing the TPM also removes any PCR policy counter that the
+// authorization policy of this sealed key object depends on. After a clear, the key must be re-enrolled from the
+// plaintext key.
+//
+// This function requires knowledge of the authorization value for the storage hierarchy, which must be provided by calling
+// Connection.OwnerHandleContext().SetAuthValue() prior to calling this function. If the provided authorization value is
+// incorrect, a AuthFailError error will be returned.
+//
+// The sealed key is unsealed as part of the export, so the current PCR values must satisfy its PCR policy and the correct
+// PIN must be supplied if one is set. The errors returned by SealedKeyObject.UnsealFromTPM are returned in this case.
+//
+// This function expects there to be no file at the specified path. If path references a file that already exists, a wrapped
+// *os.PathError error will be returned with an underlying error of syscall.EEXIST.
+//
+// Version 0 key data files cannot be exported.
+//
+// This function is subject to ConnectionOptions.RequireEncryptedSessions.
+func (k *SealedKeyObject) ExportForMigration(tpm *Connection, pin string, srkTemplate *tpm2.Public, path string) error {
+	if k.data.version == 0 {
+		return errors.New("cannot export version 0 key data files")
+	}
+	if err := tpm.checkEncryptedSessionsAvailable(); err != nil {
+		return err
+	}
+	if srkTemplate == nil || !srkTemplate.IsParent() {
+		return errors.New("supplied SRK template is not valid for a parent key")
+	}
+
+	session := tpm.HmacSession()
+
+	// Obtain the public area of the storage root key that will be created from srkTemplate.
+	srk, srkPublic, _, _, _, err := tpm.CreatePrimary(tpm.OwnerHandleContext(), nil, srkTemplate, nil, nil, session)
+	switch {
+	case isAuthFailError(err, tpm2.CommandCreatePrimary, 1):
+		return AuthFailError{tpm2.HandleOwner}
+	case err != nil:
+		return xerrors.Errorf("cannot create new storage root key: %w", err)
+	}
+	tpm.FlushContext(srk)
+
+	key, authKey, err := k.UnsealFromTPM(tpm, pin)
+	if err != nil {
+		return err
+	}
+
+	// The auth value of the sealed object is the PIN.
+	authValue := tpm2.Auth(pin)
+
+	pub := makeImportableSealedKeyTemplate()
+	pub.AuthPolicy = k.data.keyPublic.AuthPolicy
+
+	priv, importSymSeed, err := createImportableSealedKeyObject(rand.Reader, pub, key, authKey, authValue, srkPublic)
+	if err != nil {
+		return err
+	}
+
+	// The SRK handle and public area were only recorded from version 3.
+	version := k.data.version
+	if version < 3 {
+		version = 3
+	}
+
+	data := keyData{
+		version:           version,
+		keyPrivate:        priv,
+		keyPublic:         pub,
+		authModeHint:      k.data.authModeHint,
+		importSymSeed:     importSymSeed,
+		staticPolicyData:  k.data.staticPolicyData,
+		dynamicPolicyData: k.data.dynamicPolicyData,
+		srkHandle:         tcg.SRKHandle,
+		srkPublic:         srkTemplate,
+		deviceIdentity:    k.data.deviceIdentity,
+		requiredPCRBanks:  k.data.requiredPCRBanks}
+
+	succeeded := false
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return xerrors.Errorf("cannot create key data file: %w", err)
+	}
+	defer func() {
+		f.Close()
+		if !succeeded {
+			os.Remove(path)
+		}
+	}()
+
+	if err := data.write(f); err != nil {
+		return xerrors.Errorf("cannot write key data file: %w", err)
+	}
+
+	succeeded = true
+	return nil
+}
+
+// RewrapSealedKeyObject imports the sealed key object exported to the file at blobPath by
+// SealedKeyObject.ExportForMigration in to the storage hierarchy of the TPM with TPM2_Import, and atomically writes the
+// resulting sealed key object to the file at keyPath.
+//
+// The sealed key object is imported under the storage root key at the standard handle, which must have been created from the
+// template supplied to SealedKeyObject.ExportForMigration. If there is no object at this handle, a new storage root key will
+// be created from this template and persisted. If the object at this handle was created from a different template, a
+// TPMResourceExistsError error will be returned - in this case, the old storage root key must be evicted first.
+//
+// The TPM must not have been cleared since the sealed key object was exported. If it has, the import will fail and a
+// InvalidKeyFileError error will be returned.
+//
+// This function requires knowledge of the authorization value for the storage hierarchy, which must be provided by calling
+// Connection.OwnerHandleContext().SetAuthValue() prior to calling this function. If the provided authorization value is
+// incorrect, a AuthFailError error will be returned.
+//
+// If the file at blobPath is not a valid exported sealed key object or it cannot be imported, a InvalidKeyFileError error
+// will be returned.
+//
+// This function is subject to ConnectionOptions.RequireEncryptedSessions.
+func RewrapSealedKeyObject(tpm *Connection, blobPath, keyPath string) error {
+	if err := tpm.checkEncryptedSessionsAvailable(); err != nil {
+		return err
+	}
+
+	k, err := ReadSealedKeyObject(blobPath)
+	if err != nil {
+		return err
+	}
+	if len(k.data.importSymSeed) == 0 {
+		return InvalidKeyFileError{msg: "sealed key object has already been imported"}
+	}
+
+	session := tpm.HmacSession()
+
+	_, err = ensureStoragePrimaryKey(tpm.TPMContext, k.data.parentTemplate(), session)
+	var existsErr TPMResourceExistsError
+	switch {
+	case xerrors.As(err, &existsErr):
+		return existsErr
+	case isAuthFailError(err, tpm2.AnyCommandCode, 1):
+		return AuthFailError{tpm2.HandleOwner}
+	case err != nil:
+		return xerrors.Errorf("cannot provision storage root key: %w", err)
+	}
+
+	if _, err := k.data.validate(tpm.TPMContext, nil, session); err != nil {
+		if isKeyFileError(err) {
+			return InvalidKeyFileError{msg: err.Error()}
+		}
+		return xerrors.Errorf("cannot validate key data: %w", err)
+	}
+
+	if err := k.data.ensureImported(tpm.TPMContext, session); err != nil {
+		if isKeyFileError(err) {
+			return InvalidKeyFileError{msg: err.Error()}
+		}
+		return xerrors.Errorf("cannot import sealed key object: %w", err)
+	}
+
+	// Preserve any backup copy of an existing key data file at keyPath so that it is updated as well.
+	dest := &SealedKeyObject{path: keyPath, data: k.data}
+	if existing, err := ReadSealedKeyObject(keyPath); err == nil {
+		dest.backup = existing.backup
+		dest.generation = existing.generation
+	}
+	if err := dest.writeToFile(); err != nil {
+		return xerrors.Errorf("cannot write key data file: %w", err)
+	}
+
+	return nil
+}
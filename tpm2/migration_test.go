@@ -0,0 +1,238 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+
+	"github.com/snapcore/secboot/internal/tcg"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+func TestMigrateSealedKeyToNewSRK(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	clearTPMWithPlatformAuth(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestMigrateSealedKeyToNewSRK_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+	blobFile := filepath.Join(tmpDir, "blob")
+
+	authKey, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810000})
+	if err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if err := k.ExportForMigration(tpm, "", &testCustomSRKTemplate, blobFile); err != nil {
+		t.Fatalf("ExportForMigration failed: %v", err)
+	}
+
+	// Rewrapping should fail whilst the old SRK is still present
+	if err := RewrapSealedKeyObject(tpm, blobFile, keyFile); err == nil {
+		t.Errorf("RewrapSealedKeyObject should have failed")
+	} else if e, ok := err.(TPMResourceExistsError); !ok || e.Handle != tcg.SRKHandle {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// Evict the old SRK and rewrap the key under a new one
+	srk, err := tpm.CreateResourceContextFromTPM(tcg.SRKHandle)
+	if err != nil {
+		t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+	}
+	if _, err := tpm.EvictControl(tpm.OwnerHandleContext(), srk, srk.Handle(), nil); err != nil {
+		t.Fatalf("EvictControl failed: %v", err)
+	}
+
+	if err := RewrapSealedKeyObject(tpm, blobFile, keyFile); err != nil {
+		t.Fatalf("RewrapSealedKeyObject failed: %v", err)
+	}
+
+	validatePrimaryKeyAgainstTemplate(t, tpm.TPMContext, tpm2.HandleOwner, tcg.SRKHandle, &testCustomSRKTemplate)
+
+	// The rewrapped key file should contain an imported object
+	if err := RewrapSealedKeyObject(tpm, keyFile, keyFile); err == nil {
+		t.Errorf("RewrapSealedKeyObject should have failed")
+	} else if _, ok := err.(InvalidKeyFileError); !ok || err.Error() != "invalid key data file: sealed key object has already been imported" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	k, err = ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	keyUnsealed, authKeyUnsealed, err := k.UnsealFromTPM(tpm, "")
+	if err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(key, keyUnsealed) {
+		t.Errorf("TPM returned the wrong key")
+	}
+	if !bytes.Equal(authKey, authKeyUnsealed) {
+		t.Errorf("TPM returned the wrong auth key")
+	}
+
+	// The PCR policy can still be updated with the original auth key
+	if err := k.UpdatePCRProtectionPolicy(tpm, authKey, getTestPCRProfile()); err != nil {
+		t.Errorf("UpdatePCRProtectionPolicy failed: %v", err)
+	}
+}
+
+func TestExportForMigrationErrorHandling(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestExportForMigrationErrorHandling_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+	blobFile := filepath.Join(tmpDir, "blob")
+
+	if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: tpm2.HandleNull}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	t.Run("InvalidTemplate", func(t *testing.T) {
+		if err := k.ExportForMigration(tpm, "", &tpm2.Public{Type: tpm2.ObjectTypeKeyedHash, NameAlg: tpm2.HashAlgorithmSHA256}, blobFile); err == nil ||
+			err.Error() != "supplied SRK template is not valid for a parent key" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("OwnerAuthFail", func(t *testing.T) {
+		setHierarchyAuthForTest(t, tpm, tpm.OwnerHandleContext())
+		tpm.OwnerHandleContext().SetAuthValue(nil)
+
+		defer func() {
+			tpm.OwnerHandleContext().SetAuthValue(testAuth)
+			resetHierarchyAuth(t, tpm, tpm.OwnerHandleContext())
+		}()
+
+		err := k.ExportForMigration(tpm, "", &testCustomSRKTemplate, blobFile)
+		if e, ok := err.(AuthFailError); !ok || e.Handle != tpm2.HandleOwner {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if _, err := os.Stat(blobFile); !os.IsNotExist(err) {
+			t.Errorf("Blob file shouldn't exist")
+		}
+	})
+
+	t.Run("UnexpectedPCRValues", func(t *testing.T) {
+		if _, err := tpm.PCREvent(tpm.PCRHandleContext(7), []byte("foo"), nil); err != nil {
+			t.Errorf("PCREvent failed: %v", err)
+		}
+		err := k.ExportForMigration(tpm, "", &testCustomSRKTemplate, blobFile)
+		if _, ok := err.(InvalidKeyFileError); !ok {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if _, err := os.Stat(blobFile); !os.IsNotExist(err) {
+			t.Errorf("Blob file shouldn't exist")
+		}
+	})
+}
+
+func TestRewrapSealedKeyObjectAfterClear(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	clearTPMWithPlatformAuth(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestRewrapSealedKeyObjectAfterClear_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+	blobFile := filepath.Join(tmpDir, "blob")
+
+	if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: tpm2.HandleNull}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if err := k.ExportForMigration(tpm, "", &testCustomSRKTemplate, blobFile); err != nil {
+		t.Fatalf("ExportForMigration failed: %v", err)
+	}
+
+	// Clearing the TPM changes the storage primary seed, so the exported object can't be imported any more.
+	clearTPMWithPlatformAuth(t, tpm)
+
+	if err := RewrapSealedKeyObject(tpm, blobFile, keyFile); err == nil {
+		t.Errorf("RewrapSealedKeyObject should have failed")
+	} else if _, ok := err.(InvalidKeyFileError); !ok {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
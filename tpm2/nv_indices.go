@@ -0,0 +1,249 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// SecbootNVIndexType describes the purpose of a NV index that was created by this package.
+type SecbootNVIndexType int
+
+const (
+	// SecbootNVIndexPCRPolicyCounter corresponds to a NV counter used for PCR policy revocation,
+	// created by SealKeyToTPMMultiple.
+	SecbootNVIndexPCRPolicyCounter SecbootNVIndexType = iota + 1
+
+	// SecbootNVIndexPIN corresponds to a NV index used to limit the number of PIN attempts,
+	// created by SealKeyToTPMMultiple.
+	SecbootNVIndexPIN
+
+	// SecbootNVIndexLock corresponds to a NV index used to lock access to sealed key objects,
+	// created by SealKeyToTPMMultiple.
+	SecbootNVIndexLock
+
+	// SecbootNVIndexKeyData corresponds to a NV index that stores a sealed key object.
+	SecbootNVIndexKeyData
+
+	// SecbootNVIndexRollbackCounter corresponds to a NV counter used to revoke sealed key objects
+	// created for superseded boot chains, created by SealKeyToTPMMultiple.
+	SecbootNVIndexRollbackCounter
+)
+
+func (t SecbootNVIndexType) String() string {
+	switch t {
+	case SecbootNVIndexPCRPolicyCounter:
+		return "pcr-policy-counter"
+	case SecbootNVIndexPIN:
+		return "pin"
+	case SecbootNVIndexLock:
+		return "lock"
+	case SecbootNVIndexKeyData:
+		return "key-data"
+	case SecbootNVIndexRollbackCounter:
+		return "rollback-counter"
+	default:
+		return "unknown"
+	}
+}
+
+// SecbootNVIndex corresponds to a NV index that was created by this package.
+type SecbootNVIndex struct {
+	Handle tpm2.Handle
+	Type   SecbootNVIndexType
+}
+
+// classifySecbootNVIndex determines whether the supplied public area belongs to a NV index that was
+// created by this package, based on its attributes and authorization policy.
+func classifySecbootNVIndex(public *tpm2.NVPublic) (SecbootNVIndexType, bool) {
+	switch {
+	case isLockIndex(public):
+		return SecbootNVIndexLock, true
+	case isRollbackCounter(public):
+		return SecbootNVIndexRollbackCounter, true
+	case public.Attrs&^tpm2.AttrNVWritten == pinIndexAttrs:
+		if !public.NameAlg.Available() {
+			return 0, false
+		}
+		trial, _ := tpm2.ComputeAuthPolicy(public.NameAlg)
+		trial.PolicyOR(computePinIndexAuthPolicies(public.NameAlg))
+		if !bytes.Equal(public.AuthPolicy, trial.GetDigest()) {
+			return 0, false
+		}
+		return SecbootNVIndexPIN, true
+	case public.Attrs&^tpm2.AttrNVWritten == tpm2.NVTypeOrdinary.WithAttrs(keyDataNVIndexAttrs):
+		if !public.NameAlg.Available() || !bytes.Equal(public.AuthPolicy, computeKeyDataNVIndexAuthPolicy(public.NameAlg)) {
+			return 0, false
+		}
+		return SecbootNVIndexKeyData, true
+	}
+
+	// The authorization policy of a PCR policy counter depends on the key used to authorize PCR
+	// policy updates, so only the other fields of the public area can be checked.
+	expected, _ := computePcrPolicyCounterPublic(public.Index, nil)
+	if public.Attrs&^tpm2.AttrNVWritten == expected.Attrs &&
+		public.NameAlg == expected.NameAlg &&
+		len(public.AuthPolicy) == expected.NameAlg.Size() &&
+		public.Size == expected.Size {
+		return SecbootNVIndexPCRPolicyCounter, true
+	}
+
+	return 0, false
+}
+
+// ListSecbootNVIndices returns the NV indices defined on the TPM that look like they were created by
+// this package, which is determined from their attributes and authorization policies. This is intended
+// for auditing the NV space used on a device.
+//
+// Note that a NV index defined by other software could be misidentified if it has the same attributes. This is
+// particularly likely for rollback counters, which have the attributes of a generic NV counter.
+func ListSecbootNVIndices(tpm *Connection) ([]*SecbootNVIndex, error) {
+	session := tpm.HmacSession()
+
+	handles, err := tpm.GetCapabilityHandles(tpm2.HandleTypeNVIndex.BaseHandle(), tpm2.CapabilityMaxProperties, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain defined NV indices: %w", err)
+	}
+
+	var out []*SecbootNVIndex
+	for _, handle := range handles {
+		if handle.Type() != tpm2.HandleTypeNVIndex {
+			break
+		}
+
+		index, err := tpm.CreateResourceContextFromTPM(handle, session.IncludeAttrs(tpm2.AttrAudit))
+		switch {
+		case tpm2.IsResourceUnavailableError(err, handle):
+			// The index was undefined in the meantime.
+			continue
+		case err != nil:
+			return nil, xerrors.Errorf("cannot create context for NV index %v: %w", handle, err)
+		}
+
+		public, _, err := tpm.NVReadPublic(index, session.IncludeAttrs(tpm2.AttrAudit))
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read public area of NV index %v: %w", handle, err)
+		}
+
+		t, ok := classifySecbootNVIndex(public)
+		if !ok {
+			continue
+		}
+		out = append(out, &SecbootNVIndex{Handle: handle, Type: t})
+	}
+
+	return out, nil
+}
+
+// CleanupOrphanedCountersParams provides arguments for CleanupOrphanedCounters.
+type CleanupOrphanedCountersParams struct {
+	// CandidateHandles are the handles of the NV indices that may be undefined, such as the handles that were referenced by
+	// sealed key objects that have since been deleted. NV indices at other handles are never undefined, as NV indices
+	// created by other software can't be reliably distinguished from those created by this package.
+	CandidateHandles []tpm2.Handle
+
+	// InUseHandles are the handles of all of the NV indices that are still in use by sealed key objects on the device,
+	// which can be obtained with SealedKeyObject.ReferencedNVIndexHandles. These are never undefined, even if they appear
+	// in CandidateHandles.
+	InUseHandles []tpm2.Handle
+
+	// Remove indicates that the orphaned NV indices should be undefined. If this is false, the handles of the NV indices
+	// that would be undefined are returned without modifying the TPM.
+	Remove bool
+}
+
+// CleanupOrphanedCounters determines which of the candidate NV indices supplied via params are PCR policy counters, PIN
+// indices or lock indices created by this package that aren't in use, and returns their handles. If params.Remove is set,
+// these indices are also undefined. This is intended to be used on long-lived devices in order to reclaim NV space that
+// was used by sealed key objects that have since been deleted, eg, after re-enrolment.
+//
+// Any sealed key object that references an index that is undefined by this function can no longer be unsealed. NV indices
+// that store sealed key objects are never undefined. Rollback counters are also never undefined, as they are shared between
+// sealed key objects for different boot chains, and have the attributes of a generic NV counter with no authorization policy,
+// so they can't be distinguished from counters created by other software.
+//
+// If params.Remove is set, this function requires knowledge of the authorization value for the storage hierarchy, which
+// must be provided by calling Connection.OwnerHandleContext().SetAuthValue() prior to calling this function. If the
+// provided authorization value is incorrect, a AuthFailError error will be returned.
+func CleanupOrphanedCounters(tpm *Connection, params *CleanupOrphanedCountersParams) (orphaned []tpm2.Handle, err error) {
+	if params == nil {
+		return nil, errors.New("no parameters supplied")
+	}
+
+	inUse := make(map[tpm2.Handle]bool)
+	for _, h := range params.InUseHandles {
+		inUse[h] = true
+	}
+
+	session := tpm.HmacSession()
+
+	for _, handle := range params.CandidateHandles {
+		if handle.Type() != tpm2.HandleTypeNVIndex || inUse[handle] {
+			continue
+		}
+
+		index, err := tpm.CreateResourceContextFromTPM(handle, session.IncludeAttrs(tpm2.AttrAudit))
+		switch {
+		case tpm2.IsResourceUnavailableError(err, handle):
+			continue
+		case err != nil:
+			return orphaned, xerrors.Errorf("cannot create context for NV index %v: %w", handle, err)
+		}
+
+		public, _, err := tpm.NVReadPublic(index, session.IncludeAttrs(tpm2.AttrAudit))
+		if err != nil {
+			return orphaned, xerrors.Errorf("cannot read public area of NV index %v: %w", handle, err)
+		}
+		t, ok := classifySecbootNVIndex(public)
+		if !ok || t == SecbootNVIndexKeyData || t == SecbootNVIndexRollbackCounter {
+			continue
+		}
+
+		if params.Remove {
+			if err := tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, session); err != nil {
+				if isAuthFailError(err, tpm2.CommandNVUndefineSpace, 1) {
+					return orphaned, AuthFailError{tpm2.HandleOwner}
+				}
+				return orphaned, xerrors.Errorf("cannot undefine NV index %v: %w", handle, err)
+			}
+		}
+		orphaned = append(orphaned, handle)
+	}
+
+	return orphaned, nil
+}
+
+// ReferencedNVIndexHandles returns the handles of all of the NV indices that this sealed key object depends on,
+// which includes the PCR policy counter, PIN index, lock index and rollback counter if they are used, and the NV index that the
+// sealed key object is stored in if it isn't stored in a file.
+func (k *SealedKeyObject) ReferencedNVIndexHandles() (handles []tpm2.Handle) {
+	for _, h := range []tpm2.Handle{k.PCRPolicyCounterHandle(), k.PINIndexHandle(), k.LockIndexHandle(), k.RollbackCounterHandle(), k.NVIndexHandle()} {
+		if h.Type() != tpm2.HandleTypeNVIndex {
+			continue
+		}
+		handles = append(handles, h)
+	}
+	return handles
+}
@@ -0,0 +1,159 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+func TestListAndCleanupSecbootNVIndices(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestListAndCleanupSecbootNVIndices_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// A NV index that wasn't created by secboot.
+	public := tpm2.NVPublic{
+		Index:   0x01810100,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead),
+		Size:    8}
+	other, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, &public, nil)
+	if err != nil {
+		t.Fatalf("NVDefineSpace failed: %v", err)
+	}
+	defer undefineNVSpace(t, tpm, other, tpm.OwnerHandleContext())
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+	if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{
+		PCRProfile:             getTestPCRProfile(),
+		PCRPolicyCounterHandle: 0x01810000}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	// Create a key that is deleted without cleaning up its NV indices.
+	staleKeyFile := filepath.Join(tmpDir, "keydata.stale")
+	if _, err := SealKeyToTPM(tpm, key, staleKeyFile, &KeyCreationParams{
+		PCRProfile:             getTestPCRProfile(),
+		PCRPolicyCounterHandle: 0x01810002,
+		PINAttemptLimit:        5,
+		PINIndexHandle:         0x01810003,
+		LockIndexHandle:        0x01810004}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	if err := os.Remove(staleKeyFile); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+
+	indices, err := ListSecbootNVIndices(tpm)
+	if err != nil {
+		t.Fatalf("ListSecbootNVIndices failed: %v", err)
+	}
+	expected := []*SecbootNVIndex{
+		{Handle: 0x01810000, Type: SecbootNVIndexPCRPolicyCounter},
+		{Handle: 0x01810002, Type: SecbootNVIndexPCRPolicyCounter},
+		{Handle: 0x01810003, Type: SecbootNVIndexPIN},
+		{Handle: 0x01810004, Type: SecbootNVIndexLock}}
+	var found []*SecbootNVIndex
+	for _, i := range indices {
+		if i.Handle >= 0x01810000 && i.Handle <= 0x018100ff {
+			found = append(found, i)
+		}
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("Unexpected indices: %v", found)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	inUse := k.ReferencedNVIndexHandles()
+	if !reflect.DeepEqual(inUse, []tpm2.Handle{0x01810000}) {
+		t.Errorf("Unexpected referenced handles: %v", inUse)
+	}
+
+	params := &CleanupOrphanedCountersParams{
+		CandidateHandles: []tpm2.Handle{0x01810000, 0x01810002, 0x01810003, 0x01810004, 0x01810100},
+		InUseHandles:     inUse}
+
+	// The default is a dry run.
+	orphaned, err := CleanupOrphanedCounters(tpm, params)
+	if err != nil {
+		t.Fatalf("CleanupOrphanedCounters failed: %v", err)
+	}
+	if !reflect.DeepEqual(orphaned, []tpm2.Handle{0x01810002, 0x01810003, 0x01810004}) {
+		t.Errorf("Unexpected orphaned handles: %v", orphaned)
+	}
+	for _, h := range orphaned {
+		if _, err := tpm.CreateResourceContextFromTPM(h); err != nil {
+			t.Errorf("NV index %v was removed during a dry run: %v", h, err)
+		}
+	}
+
+	// Only candidate handles are removed.
+	params.CandidateHandles = []tpm2.Handle{0x01810000, 0x01810002, 0x01810003, 0x01810100}
+	params.Remove = true
+	removed, err := CleanupOrphanedCounters(tpm, params)
+	if err != nil {
+		t.Fatalf("CleanupOrphanedCounters failed: %v", err)
+	}
+	if !reflect.DeepEqual(removed, []tpm2.Handle{0x01810002, 0x01810003}) {
+		t.Errorf("Unexpected removed handles: %v", removed)
+	}
+	defer func() {
+		rc, err := tpm.CreateResourceContextFromTPM(0x01810004)
+		if err != nil {
+			return
+		}
+		undefineNVSpace(t, tpm, rc, tpm.OwnerHandleContext())
+	}()
+
+	for _, h := range []tpm2.Handle{0x01810000, 0x01810004, 0x01810100} {
+		if _, err := tpm.CreateResourceContextFromTPM(h); err != nil {
+			t.Errorf("NV index %v was removed: %v", h, err)
+		}
+	}
+
+	if _, _, err := k.UnsealFromTPM(tpm, ""); err != nil {
+		t.Errorf("UnsealFromTPM failed: %v", err)
+	}
+}
@@ -0,0 +1,596 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/osutil/sys"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/keyring"
+	"github.com/snapcore/secboot/internal/secmem"
+)
+
+const (
+	nvKeyDataHeader uint32 = 0x55534b4e
+
+	// nvKeyIndexAttrs are the attributes for a NV index created by CreateNVKey. The index can
+	// only be written once after it is defined, and can only be read using a policy session. It
+	// can be read locked until the next TPM reset or restart.
+	nvKeyIndexAttrs = tpm2.AttrNVAuthWrite | tpm2.AttrNVWriteDefine | tpm2.AttrNVPolicyRead | tpm2.AttrNVNoDA | tpm2.AttrNVReadStClear
+)
+
+// nvKeyData is the metadata required in order to read a key from a NV index created by
+// CreateNVKey.
+type nvKeyData struct {
+	Public       *tpm2.NVPublic
+	PCRSelection tpm2.PCRSelectionList
+	PCROrData    policyOrDataTree
+}
+
+// write serializes nvKeyData in to the provided io.Writer.
+func (d *nvKeyData) write(w io.Writer) error {
+	if _, err := mu.MarshalToWriter(w, nvKeyDataHeader, d); err != nil {
+		return err
+	}
+	return nil
+}
+
+// writeToFileAtomic serializes nvKeyData and writes it atomically to the file at the specified path.
+func (d *nvKeyData) writeToFileAtomic(dest string) error {
+	f, err := osutil.NewAtomicFile(dest, 0600, 0, sys.UserID(osutil.NoChown), sys.GroupID(osutil.NoChown))
+	if err != nil {
+		return xerrors.Errorf("cannot create new atomic file: %w", err)
+	}
+	defer f.Cancel()
+
+	if err := d.write(f); err != nil {
+		return xerrors.Errorf("cannot write to temporary file: %w", err)
+	}
+
+	if err := f.Commit(); err != nil {
+		return xerrors.Errorf("cannot atomically replace file: %w", err)
+	}
+
+	return nil
+}
+
+// decodeNVKeyData deserializes nvKeyData from the provided io.Reader.
+func decodeNVKeyData(r io.Reader) (*nvKeyData, error) {
+	var header uint32
+	if _, err := mu.UnmarshalFromReader(r, &header); err != nil {
+		return nil, xerrors.Errorf("cannot unmarshal header: %w", err)
+	}
+	if header != nvKeyDataHeader {
+		return nil, fmt.Errorf("unexpected header (%d)", header)
+	}
+
+	var d nvKeyData
+	if _, err := mu.UnmarshalFromReader(r, &d); err != nil {
+		return nil, xerrors.Errorf("cannot unmarshal data: %w", err)
+	}
+	if d.Public == nil {
+		return nil, errors.New("no NV index public area")
+	}
+
+	return &d, nil
+}
+
+// computeNVKeyAuthPolicy computes the authorization policy for a NV index created by CreateNVKey
+// from the supplied PCR profile. The policy asserts that the selected PCRs contain one of the sets
+// of permitted values. It doesn't restrict the command so that the same policy can be used to read
+// lock the index once the key has been used. As the index doesn't have the TPMA_NV_POLICYWRITE
+// attribute, the policy can't be used to write to the index.
+func computeNVKeyAuthPolicy(tpm *tpm2.TPMContext, alg tpm2.HashAlgorithmId, pcrProfile *PCRProtectionProfile) (tpm2.PCRSelectionList, policyOrDataTree, tpm2.Digest, error) {
+	pcrs, pcrDigests, err := pcrProfile.ComputePCRDigests(tpm, alg)
+	if err != nil {
+		return nil, nil, nil, xerrors.Errorf("cannot compute PCR digests from protection profile: %w", err)
+	}
+	if len(pcrDigests) == 0 {
+		return nil, nil, nil, errors.New("no PCR digests specified")
+	}
+
+	var pcrOrDigests tpm2.DigestList
+	for _, d := range pcrDigests {
+		trial, _ := tpm2.ComputeAuthPolicy(alg)
+		trial.PolicyPCR(d, pcrs)
+		pcrOrDigests = append(pcrOrDigests, trial.GetDigest())
+	}
+
+	trial, _ := tpm2.ComputeAuthPolicy(alg)
+	pcrOrData := computePolicyORData(alg, trial, pcrOrDigests)
+
+	return pcrs, pcrOrData, trial.GetDigest(), nil
+}
+
+// defineNVKeyIndex defines a NV index at the specified handle with the supplied authorization
+// policy, writes the supplied key to it and then write locks it. The returned public area has
+// the attributes that the TPM sets on the index after it is written and locked.
+func defineNVKeyIndex(tpm *tpm2.TPMContext, handle tpm2.Handle, key []byte, authPolicy tpm2.Digest, session tpm2.SessionContext) (*tpm2.NVPublic, error) {
+	public := &tpm2.NVPublic{
+		Index:      handle,
+		NameAlg:    tpm2.HashAlgorithmSHA256,
+		Attrs:      tpm2.NVTypeOrdinary.WithAttrs(nvKeyIndexAttrs),
+		AuthPolicy: authPolicy,
+		Size:       uint16(len(key))}
+
+	index, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, public, session)
+	switch {
+	case tpm2.IsTPMError(err, tpm2.ErrorNVDefined, tpm2.CommandNVDefineSpace):
+		return nil, TPMResourceExistsError{handle}
+	case isAuthFailError(err, tpm2.CommandNVDefineSpace, 1):
+		return nil, AuthFailError{tpm2.HandleOwner}
+	case err != nil:
+		return nil, xerrors.Errorf("cannot define NV index: %w", err)
+	}
+
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, session)
+	}()
+
+	// The key is written with command parameter encryption so that it isn't exposed on the bus.
+	if err := tpm.NVWrite(index, index, key, 0, session.IncludeAttrs(tpm2.AttrCommandEncrypt)); err != nil {
+		return nil, xerrors.Errorf("cannot write NV index: %w", err)
+	}
+
+	if err := tpm.NVWriteLock(index, index, session); err != nil {
+		return nil, xerrors.Errorf("cannot write lock NV index: %w", err)
+	}
+
+	public.Attrs |= tpm2.AttrNVWritten | tpm2.AttrNVWriteLocked
+
+	succeeded = true
+	return public, nil
+}
+
+// NVKeyCreationParams provides arguments for CreateNVKey.
+type NVKeyCreationParams struct {
+	// PCRProfile defines the profile used to generate the PCR policy that gates access to the NV index.
+	PCRProfile *PCRProtectionProfile
+
+	// Handle is the handle at which to create the NV index containing the key. It must be a valid NV index
+	// handle (MSO == 0x01). The choice of handle should take in to consideration the reserved indices from the
+	// "Registry of reserved TPM 2.0 handles and localities" specification. It is recommended that the handle is in
+	// the block reserved for owner objects (0x01800000 - 0x01bfffff). Note that NVKeyObject.UpdatePCRProtectionProfile and
+	// NVKeyObject.RotateKey recreate the NV index at a free handle between 0x01900000 and 0x0190ffff, so the current handle
+	// should be obtained with NVKeyObject.Handle.
+	Handle tpm2.Handle
+}
+
+// NVKeyObject corresponds to the metadata file for a key stored in a TPM NV index with CreateNVKey.
+type NVKeyObject struct {
+	path string
+	data *nvKeyData
+}
+
+// Handle returns the handle of the NV index that contains the key associated with this object.
+func (k *NVKeyObject) Handle() tpm2.Handle {
+	return k.data.Public.Index
+}
+
+// ReadNVKeyObject loads a NV key metadata file created by CreateNVKey from the specified path. If the file cannot
+// be opened, a wrapped *os.PathError error is returned. If the metadata file cannot be deserialized successfully, a
+// InvalidKeyFileError error will be returned.
+func ReadNVKeyObject(path string) (*NVKeyObject, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot open key data file: %w", err)
+	}
+	defer f.Close()
+
+	data, err := decodeNVKeyData(f)
+	if err != nil {
+		return nil, InvalidKeyFileError{msg: err.Error()}
+	}
+
+	return &NVKeyObject{path: path, data: data}, nil
+}
+
+// CreateNVKey stores the supplied disk encryption key directly in a NV index on the TPM at the handle specified by the
+// Handle field of the params argument, and writes the metadata required to read it back during early boot to a file at
+// the path specified by keyPath. This is a lightweight alternative to SealKeyToTPM for systems that cannot afford the
+// overhead of a sealed key object, storage root key and PCR policy counter. It doesn't support PINs, and updating the PCR
+// policy requires the NV index to be recreated.
+//
+// The NV index is write locked once the key has been written, and can only be read with a policy session that satisfies
+// a PCR policy computed from the PCRProtectionProfile supplied via the PCRProfile field of the params argument.
+//
+// This function requires knowledge of the authorization value for the storage hierarchy, which must be provided by calling
+// Connection.OwnerHandleContext().SetAuthValue() prior to calling this function. If the provided authorization value is
+// incorrect, a AuthFailError error will be returned.
+//
+// If the handle is already in use, a TPMResourceExistsError error will be returned.
+//
+// This function expects there to be no file at the specified path. If keyPath references a file that already exists, a
+// wrapped *os.PathError error will be returned with an underlying error of syscall.EEXIST.
+//
+// If any part of this function fails, the NV index will not be created.
+//
+// This function is subject to ConnectionOptions.RequireEncryptedSessions.
+func CreateNVKey(tpm *Connection, key []byte, keyPath string, params *NVKeyCreationParams) (err error) {
+	if err := tpm.checkEncryptedSessionsAvailable(); err != nil {
+		return err
+	}
+	if params == nil {
+		return errors.New("no NVKeyCreationParams provided")
+	}
+	if len(key) == 0 {
+		return errors.New("no key provided")
+	}
+	if params.Handle.Type() != tpm2.HandleTypeNVIndex {
+		return errors.New("invalid handle")
+	}
+
+	session := tpm.HmacSession()
+
+	pcrProfile := params.PCRProfile
+	if pcrProfile == nil {
+		pcrProfile = &PCRProtectionProfile{}
+	}
+	pcrs, pcrOrData, authPolicy, err := computeNVKeyAuthPolicy(tpm.TPMContext, tpm2.HashAlgorithmSHA256, pcrProfile)
+	if err != nil {
+		return xerrors.Errorf("cannot compute authorization policy: %w", err)
+	}
+
+	f, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return xerrors.Errorf("cannot create key data file: %w", err)
+	}
+	defer f.Close()
+
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		os.Remove(keyPath)
+	}()
+
+	public, err := defineNVKeyIndex(tpm.TPMContext, params.Handle, key, authPolicy, session)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if succeeded {
+			return
+		}
+		index, err := tpm2.CreateNVIndexResourceContextFromPublic(public)
+		if err != nil {
+			return
+		}
+		tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, session)
+	}()
+
+	data := nvKeyData{
+		Public:       public,
+		PCRSelection: pcrs,
+		PCROrData:    pcrOrData}
+	if err := data.write(f); err != nil {
+		return xerrors.Errorf("cannot write key data file: %w", err)
+	}
+
+	succeeded = true
+	return nil
+}
+
+// index returns a context for the NV index associated with this object, after verifying that the
+// public area of the index on the TPM matches the one recorded in the metadata.
+func (k *NVKeyObject) index(tpm *Connection) (tpm2.ResourceContext, error) {
+	index, err := tpm.CreateResourceContextFromTPM(k.data.Public.Index)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, k.data.Public.Index):
+		return nil, InvalidKeyFileError{msg: "NV index is not present"}
+	case err != nil:
+		return nil, xerrors.Errorf("cannot create context for NV index: %w", err)
+	}
+
+	expectedName, err := k.data.Public.Name()
+	if err != nil {
+		return nil, InvalidKeyFileError{msg: fmt.Sprintf("cannot compute name of NV index: %v", err)}
+	}
+	if !bytes.Equal(index.Name(), expectedName) {
+		return nil, InvalidKeyFileError{msg: "NV index has an unexpected name"}
+	}
+
+	return index, nil
+}
+
+// startPolicySession starts a policy session and executes the assertions required to satisfy the
+// authorization policy of the NV index associated with this object.
+func (k *NVKeyObject) startPolicySession(tpm *Connection) (tpm2.SessionContext, error) {
+	policySession, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, k.data.Public.NameAlg)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot start policy session: %w", err)
+	}
+
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		tpm.FlushContext(policySession)
+	}()
+
+	if err := tpm.PolicyPCR(policySession, nil, k.data.PCRSelection); err != nil {
+		return nil, xerrors.Errorf("cannot execute PCR assertion: %w", err)
+	}
+	if err := executePolicyORAssertions(tpm.TPMContext, policySession, k.data.PCROrData); err != nil {
+		switch {
+		case tpm2.IsTPMError(err, tpm2.AnyErrorCode, tpm2.CommandPolicyGetDigest):
+			return nil, xerrors.Errorf("cannot execute OR assertions: %w", err)
+		case tpm2.IsTPMParameterError(err, tpm2.ErrorValue, tpm2.CommandPolicyOR, 1):
+			return nil, InvalidKeyFileError{msg: "cannot complete OR assertions: invalid data"}
+		}
+		return nil, InvalidKeyFileError{msg: fmt.Sprintf("cannot complete OR assertions: %v", err)}
+	}
+
+	succeeded = true
+	return policySession, nil
+}
+
+// ReadFromTPM reads the key from the NV index associated with this object.
+//
+// If the NV index has been read locked with LockAccessToKey, an error will be returned.
+//
+// If the NV index is missing or has a public area that is inconsistent with the metadata, a InvalidKeyFileError error will
+// be returned.
+//
+// If the TPM's current PCR values are not consistent with the PCR protection policy for this key, a InvalidKeyFileError error
+// will be returned.
+//
+// This function is subject to ConnectionOptions.RequireEncryptedSessions.
+func (k *NVKeyObject) ReadFromTPM(tpm *Connection) ([]byte, error) {
+	if err := tpm.checkEncryptedSessionsAvailable(); err != nil {
+		return nil, err
+	}
+
+	index, err := k.index(tpm)
+	if err != nil {
+		return nil, err
+	}
+
+	hmacSession := tpm.HmacSession()
+
+	policySession, err := k.startPolicySession(tpm)
+	if err != nil {
+		return nil, err
+	}
+	defer tpm.FlushContext(policySession)
+
+	key, err := tpm.NVRead(index, index, k.data.Public.Size, 0, policySession, hmacSession.IncludeAttrs(tpm2.AttrResponseEncrypt))
+	switch {
+	case tpm2.IsTPMSessionError(err, tpm2.ErrorPolicyFail, tpm2.CommandNVRead, 1):
+		return nil, InvalidKeyFileError{msg: "the authorization policy check failed during reading"}
+	case err != nil:
+		return nil, xerrors.Errorf("cannot read NV index: %w", err)
+	}
+
+	return key, nil
+}
+
+// LockAccessToKey read locks the NV index associated with this object so that the key cannot be read from it again
+// until the next TPM reset or restart. This should be called once the key has been used, so that it isn't available
+// to code that runs later on during boot. The TPM's current PCR values must be consistent with the PCR protection
+// policy for this key.
+//
+// If the NV index is missing or has a public area that is inconsistent with the metadata, a InvalidKeyFileError error will
+// be returned.
+func (k *NVKeyObject) LockAccessToKey(tpm *Connection) error {
+	index, err := k.index(tpm)
+	if err != nil {
+		return err
+	}
+
+	policySession, err := k.startPolicySession(tpm)
+	if err != nil {
+		return err
+	}
+	defer tpm.FlushContext(policySession)
+
+	if err := tpm.NVReadLock(index, index, policySession); err != nil {
+		return xerrors.Errorf("cannot read lock NV index: %w", err)
+	}
+
+	return nil
+}
+
+const (
+	// nvKeyHandleRangeStart and nvKeyHandleRangeEnd define the range of NV index handles from which the
+	// handle of a replacement NV index is selected when the NV index associated with a NVKeyObject is
+	// recreated. This is a subset of the block reserved for owner objects.
+	nvKeyHandleRangeStart tpm2.Handle = 0x01900000
+	nvKeyHandleRangeEnd   tpm2.Handle = 0x0190ffff
+)
+
+// redefine replaces the NV index associated with this object with a new one that contains the supplied key
+// and PCR profile. The new NV index is defined at a free handle and the metadata file is atomically updated
+// to refer to it before the old NV index is undefined, so that the metadata file always refers to a NV index
+// that contains the key.
+func (k *NVKeyObject) redefine(tpm *Connection, key []byte, pcrs tpm2.PCRSelectionList, pcrOrData policyOrDataTree, authPolicy tpm2.Digest) error {
+	index, err := k.index(tpm)
+	if err != nil {
+		return err
+	}
+
+	session := tpm.HmacSession()
+
+	handle, err := findFreeNVIndexHandle(tpm.TPMContext, nvKeyHandleRangeStart, nvKeyHandleRangeEnd, session)
+	if err != nil {
+		return xerrors.Errorf("cannot select handle for new NV index: %w", err)
+	}
+
+	public, err := defineNVKeyIndex(tpm.TPMContext, handle, key, authPolicy, session)
+	if err != nil {
+		return xerrors.Errorf("cannot create new NV index: %w", err)
+	}
+
+	data := &nvKeyData{
+		Public:       public,
+		PCRSelection: pcrs,
+		PCROrData:    pcrOrData}
+	if err := data.writeToFileAtomic(k.path); err != nil {
+		if newIndex, err := tpm2.CreateNVIndexResourceContextFromPublic(public); err == nil {
+			tpm.NVUndefineSpace(tpm.OwnerHandleContext(), newIndex, session)
+		}
+		return xerrors.Errorf("cannot write key data file: %w", err)
+	}
+
+	k.data = data
+
+	if err := tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, session); err != nil {
+		// The new NV index is already in use, so just leak the old one.
+		fmt.Fprintf(os.Stderr, "secboot: Cannot undefine previous NV index %v: %v\n", index.Handle(), err)
+	}
+
+	return nil
+}
+
+// UpdatePCRProtectionProfile updates the PCR policy for the NV index associated with this object to the profile
+// defined by the pcrProfile argument. As the authorization policy of a NV index cannot be changed, this creates a new
+// NV index containing the key supplied via the key argument, which must be the key that is currently stored in the NV
+// index. As the NV index is normally read locked after activation, the key can't be read back from it, so it should be
+// obtained from the kernel keyring with secboot.GetDiskUnlockKeyFromKernel, where it is stored by
+// ActivateVolumeWithNVKey. If the NV index can still be read, the supplied key is checked against it.
+//
+// The new NV index is created at a different handle, which is recorded in the metadata file. The old NV index is only
+// undefined once the metadata file has been updated, so an interruption doesn't result in the key being lost.
+//
+// This function requires knowledge of the authorization value for the storage hierarchy, which must be provided by calling
+// Connection.OwnerHandleContext().SetAuthValue() prior to calling this function.
+func (k *NVKeyObject) UpdatePCRProtectionProfile(tpm *Connection, key []byte, pcrProfile *PCRProtectionProfile) error {
+	if len(key) == 0 {
+		return errors.New("no key provided")
+	}
+	if current, err := k.ReadFromTPM(tpm); err == nil && !bytes.Equal(current, key) {
+		return errors.New("the supplied key doesn't match the key stored in the NV index")
+	}
+
+	if pcrProfile == nil {
+		pcrProfile = &PCRProtectionProfile{}
+	}
+	pcrs, pcrOrData, authPolicy, err := computeNVKeyAuthPolicy(tpm.TPMContext, k.data.Public.NameAlg, pcrProfile)
+	if err != nil {
+		return xerrors.Errorf("cannot compute authorization policy: %w", err)
+	}
+
+	return k.redefine(tpm, key, pcrs, pcrOrData, authPolicy)
+}
+
+// RotateKey replaces the key stored in the NV index associated with this object with the supplied key, retaining
+// the existing PCR policy. The caller is responsible for updating the keyslot of the associated encrypted volume.
+//
+// The new NV index is created at a different handle in the same way as UpdatePCRProtectionProfile.
+//
+// This function requires knowledge of the authorization value for the storage hierarchy, which must be provided by calling
+// Connection.OwnerHandleContext().SetAuthValue() prior to calling this function.
+//
+// This function is subject to ConnectionOptions.RequireEncryptedSessions.
+func (k *NVKeyObject) RotateKey(tpm *Connection, key []byte) error {
+	if err := tpm.checkEncryptedSessionsAvailable(); err != nil {
+		return err
+	}
+	if len(key) == 0 {
+		return errors.New("no key provided")
+	}
+	return k.redefine(tpm, key, k.data.PCRSelection, k.data.PCROrData, k.data.Public.AuthPolicy)
+}
+
+// ActivateVolumeWithNVKey attempts to activate the LUKS encrypted volume at sourceDevicePath and create a mapping with
+// the name volumeName, using the key stored in the TPM NV index associated with the metadata file at keyPath. This makes
+// use of systemd-cryptsetup.
+//
+// If activation with the NV key fails, this function will attempt to activate it with the fallback recovery key instead.
+// The fallback recovery key will be requested using systemd-ask-password. The RecoveryKeyTries field of options specifies
+// how many attempts should be made to activate the volume with the recovery key before failing. If this is set to 0, then
+// no attempts will be made to activate the encrypted volume with the fallback recovery key.
+//
+// If activation with the NV key fails, a *ActivateWithNVKeyError error will be returned, even if the subsequent fallback
+// recovery activation is successful. In this case, the RecoveryKeyUsageErr field of the returned error will be nil.
+//
+// If activation with the NV key succeeds, the NV index is read locked with NVKeyObject.LockAccessToKey so that the key
+// cannot be read again until the next TPM reset or restart. If this fails, an error is returned even though the volume
+// was activated. The key is added to the kernel keyring so that it can be retrieved later on with
+// secboot.GetDiskUnlockKeyFromKernel, which is required in order to update the PCR policy with
+// NVKeyObject.UpdatePCRProtectionProfile.
+//
+// If the volume is successfully activated, either with the NV key or the fallback recovery key, this function returns true.
+// If it is not successfully activated, then this function returns false.
+func ActivateVolumeWithNVKey(tpm *Connection, volumeName, sourceDevicePath, keyPath string, options *secboot.ActivateVolumeOptions) (bool, error) {
+	if options.RecoveryKeyTries < 0 {
+		return false, errors.New("invalid RecoveryKeyTries")
+	}
+
+	var k *NVKeyObject
+	err := func() (err error) {
+		k, err = ReadNVKeyObject(keyPath)
+		if err != nil {
+			return xerrors.Errorf("cannot read NV key object: %w", err)
+		}
+
+		key, err := k.ReadFromTPM(tpm)
+		if err != nil {
+			return xerrors.Errorf("cannot read key from TPM: %w", err)
+		}
+
+		// Move the key out of the Go heap for the rest of its lifetime.
+		buf, err := secmem.NewFromBytes(key, options.RequireLockedMemory)
+		if err != nil {
+			return xerrors.Errorf("cannot protect key: %w", err)
+		}
+		defer buf.Destroy()
+
+		if err := luks2Activate(volumeName, sourceDevicePath, buf.Bytes()); err != nil {
+			return xerrors.Errorf("cannot activate volume: %w", err)
+		}
+
+		if err := keyring.AddKeyToUserKeyring(buf.Bytes(), sourceDevicePath, keyringPurposeDiskUnlock, keyringPrefixOrDefault(options.KeyringPrefix)); err != nil {
+			fmt.Fprintf(os.Stderr, "secboot: Cannot add key to user keyring: %v\n", err)
+		}
+
+		return nil
+	}()
+	if err == nil {
+		if err := k.LockAccessToKey(tpm); err != nil {
+			return true, xerrors.Errorf("cannot lock access to key: %w", err)
+		}
+		return true, nil
+	}
+
+	if isLockUnavailableError(err) {
+		return false, &ActivateWithNVKeyError{err, lockUnavailableErr}
+	}
+
+	rErr := secbootActivateVolumeWithRecoveryKey(volumeName, sourceDevicePath, nil, options)
+	return rErr == nil, &ActivateWithNVKeyError{err, rErr}
+}
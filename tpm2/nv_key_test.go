@@ -0,0 +1,406 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+const testNVKeyHandle tpm2.Handle = 0x0181fff1
+
+func undefineNVKeyIndex(t *testing.T, tpm *Connection, handle tpm2.Handle) {
+	rc, err := tpm.CreateResourceContextFromTPM(handle)
+	if tpm2.IsResourceUnavailableError(err, handle) {
+		return
+	}
+	if err != nil {
+		t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+	}
+	undefineNVSpace(t, tpm, rc, tpm.OwnerHandleContext())
+}
+
+func TestCreateAndReadNVKey(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	run := func(t *testing.T, params *NVKeyCreationParams) {
+		tmpDir, err := ioutil.TempDir("", "_TestCreateAndReadNVKey_")
+		if err != nil {
+			t.Fatalf("Creating temporary directory failed: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		keyFile := filepath.Join(tmpDir, "keydata")
+
+		if err := CreateNVKey(tpm, key, keyFile, params); err != nil {
+			t.Fatalf("CreateNVKey failed: %v", err)
+		}
+		defer undefineNVKeyIndex(t, tpm, params.Handle)
+
+		k, err := ReadNVKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadNVKeyObject failed: %v", err)
+		}
+		if k.Handle() != params.Handle {
+			t.Errorf("Unexpected handle")
+		}
+
+		keyRead, err := k.ReadFromTPM(tpm)
+		if err != nil {
+			t.Fatalf("ReadFromTPM failed: %v", err)
+		}
+		if !bytes.Equal(keyRead, key) {
+			t.Errorf("TPM returned the wrong key")
+		}
+	}
+
+	t.Run("SimplePCRProfile", func(t *testing.T) {
+		run(t, &NVKeyCreationParams{PCRProfile: getTestPCRProfile(), Handle: testNVKeyHandle})
+	})
+
+	t.Run("NilPCRProfile", func(t *testing.T) {
+		run(t, &NVKeyCreationParams{Handle: testNVKeyHandle})
+	})
+}
+
+func TestCreateNVKeyErrorHandling(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestCreateNVKeyErrorHandling_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+
+	t.Run("InvalidHandle", func(t *testing.T) {
+		err := CreateNVKey(tpm, key, keyFile, &NVKeyCreationParams{Handle: 0x81000001})
+		if err == nil || err.Error() != "invalid handle" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("HandleExists", func(t *testing.T) {
+		public := tpm2.NVPublic{
+			Index:   testNVKeyHandle,
+			NameAlg: tpm2.HashAlgorithmSHA256,
+			Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead),
+			Size:    8}
+		index, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, &public, nil)
+		if err != nil {
+			t.Fatalf("NVDefineSpace failed: %v", err)
+		}
+		defer undefineNVSpace(t, tpm, index, tpm.OwnerHandleContext())
+
+		err = CreateNVKey(tpm, key, keyFile, &NVKeyCreationParams{Handle: testNVKeyHandle})
+		if e, ok := err.(TPMResourceExistsError); !ok || e.Handle != testNVKeyHandle {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if _, err := os.Stat(keyFile); !os.IsNotExist(err) {
+			t.Errorf("Key file wasn't removed")
+		}
+	})
+}
+
+func TestReadNVKeyWithUnexpectedPCRValues(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestReadNVKeyWithUnexpectedPCRValues_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+
+	profile := NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 23)
+	if err := CreateNVKey(tpm, key, keyFile, &NVKeyCreationParams{PCRProfile: profile, Handle: testNVKeyHandle}); err != nil {
+		t.Fatalf("CreateNVKey failed: %v", err)
+	}
+	defer undefineNVKeyIndex(t, tpm, testNVKeyHandle)
+
+	if _, err := tpm.PCREvent(tpm.PCRHandleContext(23), []byte("foo"), nil); err != nil {
+		t.Fatalf("PCREvent failed: %v", err)
+	}
+
+	k, err := ReadNVKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadNVKeyObject failed: %v", err)
+	}
+
+	_, err = k.ReadFromTPM(tpm)
+	if _, ok := err.(InvalidKeyFileError); !ok {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestUpdateNVKeyPCRProtectionProfile(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUpdateNVKeyPCRProtectionProfile_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+
+	profile := NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 23)
+	if err := CreateNVKey(tpm, key, keyFile, &NVKeyCreationParams{PCRProfile: profile, Handle: testNVKeyHandle}); err != nil {
+		t.Fatalf("CreateNVKey failed: %v", err)
+	}
+	defer undefineNVKeyIndex(t, tpm, testNVKeyHandle)
+
+	k, err := ReadNVKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadNVKeyObject failed: %v", err)
+	}
+
+	profile = NewPCRProtectionProfile().
+		AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 23).
+		ExtendPCR(tpm2.HashAlgorithmSHA256, 23, make(tpm2.Digest, 32))
+	if err := k.UpdatePCRProtectionProfile(tpm, key, profile); err != nil {
+		t.Fatalf("UpdatePCRProtectionProfile failed: %v", err)
+	}
+	defer undefineNVKeyIndex(t, tpm, k.Handle())
+
+	// The old NV index should have been replaced.
+	if k.Handle() == testNVKeyHandle {
+		t.Errorf("Unexpected handle")
+	}
+	if _, err := tpm.CreateResourceContextFromTPM(testNVKeyHandle); !tpm2.IsResourceUnavailableError(err, testNVKeyHandle) {
+		t.Errorf("Old NV index should have been undefined: %v", err)
+	}
+
+	if _, err := k.ReadFromTPM(tpm); err == nil {
+		t.Errorf("ReadFromTPM should have failed")
+	}
+
+	if err := tpm.PCRExtend(tpm.PCRHandleContext(23), tpm2.TaggedHashList{{HashAlg: tpm2.HashAlgorithmSHA256, Digest: make(tpm2.Digest, 32)}}, nil); err != nil {
+		t.Fatalf("PCRExtend failed: %v", err)
+	}
+
+	k, err = ReadNVKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadNVKeyObject failed: %v", err)
+	}
+
+	keyRead, err := k.ReadFromTPM(tpm)
+	if err != nil {
+		t.Fatalf("ReadFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(keyRead, key) {
+		t.Errorf("TPM returned the wrong key")
+	}
+}
+
+func TestUpdateNVKeyPCRProtectionProfileAfterLock(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUpdateNVKeyPCRProtectionProfileAfterLock_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+
+	if err := CreateNVKey(tpm, key, keyFile, &NVKeyCreationParams{PCRProfile: getTestPCRProfile(), Handle: testNVKeyHandle}); err != nil {
+		t.Fatalf("CreateNVKey failed: %v", err)
+	}
+	defer undefineNVKeyIndex(t, tpm, testNVKeyHandle)
+
+	k, err := ReadNVKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadNVKeyObject failed: %v", err)
+	}
+
+	// The index is read locked after activation, so the key has to be supplied by the caller.
+	if err := k.LockAccessToKey(tpm); err != nil {
+		t.Fatalf("LockAccessToKey failed: %v", err)
+	}
+
+	if err := k.UpdatePCRProtectionProfile(tpm, key, getTestPCRProfile()); err != nil {
+		t.Fatalf("UpdatePCRProtectionProfile failed: %v", err)
+	}
+	defer undefineNVKeyIndex(t, tpm, k.Handle())
+
+	k, err = ReadNVKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadNVKeyObject failed: %v", err)
+	}
+
+	keyRead, err := k.ReadFromTPM(tpm)
+	if err != nil {
+		t.Fatalf("ReadFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(keyRead, key) {
+		t.Errorf("TPM returned the wrong key")
+	}
+}
+
+func TestUpdateNVKeyPCRProtectionProfileWrongKey(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUpdateNVKeyPCRProtectionProfileWrongKey_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+
+	if err := CreateNVKey(tpm, key, keyFile, &NVKeyCreationParams{PCRProfile: getTestPCRProfile(), Handle: testNVKeyHandle}); err != nil {
+		t.Fatalf("CreateNVKey failed: %v", err)
+	}
+	defer undefineNVKeyIndex(t, tpm, testNVKeyHandle)
+
+	k, err := ReadNVKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadNVKeyObject failed: %v", err)
+	}
+
+	err = k.UpdatePCRProtectionProfile(tpm, make([]byte, 32), getTestPCRProfile())
+	if err == nil || err.Error() != "the supplied key doesn't match the key stored in the NV index" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if k.Handle() != testNVKeyHandle {
+		t.Errorf("Unexpected handle")
+	}
+}
+
+func TestRotateNVKey(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestRotateNVKey_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+
+	if err := CreateNVKey(tpm, key, keyFile, &NVKeyCreationParams{PCRProfile: getTestPCRProfile(), Handle: testNVKeyHandle}); err != nil {
+		t.Fatalf("CreateNVKey failed: %v", err)
+	}
+	defer undefineNVKeyIndex(t, tpm, testNVKeyHandle)
+
+	k, err := ReadNVKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadNVKeyObject failed: %v", err)
+	}
+
+	newKey := make([]byte, 64)
+	rand.Read(newKey)
+
+	if err := k.RotateKey(tpm, newKey); err != nil {
+		t.Fatalf("RotateKey failed: %v", err)
+	}
+	defer undefineNVKeyIndex(t, tpm, k.Handle())
+
+	k, err = ReadNVKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadNVKeyObject failed: %v", err)
+	}
+
+	keyRead, err := k.ReadFromTPM(tpm)
+	if err != nil {
+		t.Fatalf("ReadFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(keyRead, newKey) {
+		t.Errorf("TPM returned the wrong key")
+	}
+}
+
+func TestLockAccessToNVKey(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestLockAccessToNVKey_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+
+	if err := CreateNVKey(tpm, key, keyFile, &NVKeyCreationParams{PCRProfile: getTestPCRProfile(), Handle: testNVKeyHandle}); err != nil {
+		t.Fatalf("CreateNVKey failed: %v", err)
+	}
+	defer undefineNVKeyIndex(t, tpm, testNVKeyHandle)
+
+	k, err := ReadNVKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadNVKeyObject failed: %v", err)
+	}
+
+	if _, err := k.ReadFromTPM(tpm); err != nil {
+		t.Fatalf("ReadFromTPM failed: %v", err)
+	}
+
+	if err := k.LockAccessToKey(tpm); err != nil {
+		t.Fatalf("LockAccessToKey failed: %v", err)
+	}
+
+	_, err = k.ReadFromTPM(tpm)
+	if !tpm2.IsTPMError(err, tpm2.ErrorNVLocked, tpm2.CommandNVRead) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
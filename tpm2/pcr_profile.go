@@ -27,6 +27,8 @@ import (
 	"github.com/canonical/go-tpm2"
 
 	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/parallel"
 )
 
 // pcrValuesList is a list of PCR value combinations computed from PCRProtectionProfile.
@@ -145,6 +147,55 @@ func (p *PCRProtectionProfile) AddProfileOR(profiles ...*PCRProtectionProfile) *
 	return p
 }
 
+// AddProfileAND adds one or more sub-profiles that must all be satisfied. This is equivalent to adding each sub-profile with
+// AddProfileOR in turn, and is intended for combining profiles that define values for different PCR banks (eg, one for SHA-256
+// and one for SHA-384), so that the resulting PCR policy requires the values in all of these banks. This means that the policy
+// remains secure if a bank on a buggy firmware is found to be extendable out-of-band. When computing the PCR values for this
+// profile, each branch of a sub-profile is combined with each branch of the others, so the number of PCR digests in the
+// resulting policy is the product of the number of branches in each sub-profile. The function returns the same
+// PCRProtectionProfile so that calls may be chained.
+func (p *PCRProtectionProfile) AddProfileAND(profiles ...*PCRProtectionProfile) *PCRProtectionProfile {
+	for _, profile := range profiles {
+		p.instrs = append(p.instrs, &pcrProtectionProfileAddProfileORInstr{profiles: []*PCRProtectionProfile{profile}})
+	}
+	return p
+}
+
+// checkPCRSelectionBanks checks that the supplied PCR selection selects the same set of PCRs in each of the specified banks.
+func checkPCRSelectionBanks(pcrs tpm2.PCRSelectionList, banks []tpm2.HashAlgorithmId) error {
+	if len(banks) == 0 {
+		return nil
+	}
+
+	selected := make(map[tpm2.HashAlgorithmId]map[int]bool)
+	for _, s := range pcrs {
+		if _, ok := selected[s.Hash]; !ok {
+			selected[s.Hash] = make(map[int]bool)
+		}
+		for _, pcr := range s.Select {
+			selected[s.Hash][pcr] = true
+		}
+	}
+
+	for _, bank := range banks {
+		if len(selected[bank]) == 0 {
+			return fmt.Errorf("PCR protection profile doesn't contain any values for the %v bank", bank)
+		}
+	}
+	for _, bank := range banks[1:] {
+		if len(selected[bank]) != len(selected[banks[0]]) {
+			return fmt.Errorf("PCR protection profile contains values for different PCRs in the %v and %v banks", banks[0], bank)
+		}
+		for pcr := range selected[banks[0]] {
+			if !selected[bank][pcr] {
+				return fmt.Errorf("PCR protection profile doesn't contain a value for PCR %d in the %v bank", pcr, bank)
+			}
+		}
+	}
+
+	return nil
+}
+
 // pcrProtectionProfileIterator provides a mechanism to perform a depth first traversal of instructions in a PCRProtectionProfile.
 type pcrProtectionProfileIterator struct {
 	instrs [][]pcrProtectionProfileInstr
@@ -349,6 +400,138 @@ func (p *PCRProtectionProfile) ComputePCRValues(tpm *tpm2.TPMContext) ([]tpm2.PC
 	}
 }
 
+// pcrProtectionProfileStreamContext records state used when computing PCR digests for a PCRProtectionProfile one branch at
+// a time.
+type pcrProtectionProfileStreamContext struct {
+	tpm       *tpm2.TPMContext
+	tpmValues tpm2.PCRValues // values read from the TPM, so that they are only read once
+}
+
+func (c *pcrProtectionProfileStreamContext) readPCR(alg tpm2.HashAlgorithmId, pcr int) (tpm2.Digest, error) {
+	if v, ok := c.tpmValues[alg][pcr]; ok {
+		return v, nil
+	}
+	if c.tpm == nil {
+		return nil, fmt.Errorf("cannot read current value of PCR %d from bank %v: no TPM context", pcr, alg)
+	}
+	_, v, err := c.tpm.PCRRead(tpm2.PCRSelectionList{{Hash: alg, Select: []int{pcr}}})
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read current value of PCR %d from bank %v: %w", pcr, alg, err)
+	}
+	c.tpmValues.SetValue(alg, pcr, v[alg][pcr])
+	return v[alg][pcr], nil
+}
+
+// forEachBranch applies the supplied instructions to values, which must contain a single set of PCR values, and calls fn
+// with the PCR values for each complete branch. Only the values for the branches on the current path through the profile
+// are retained. When a AddProfileOR instruction is encountered, each sub-branch is processed in turn with a copy of the
+// current values, and the remaining instructions are applied to the values produced by each of them.
+func (c *pcrProtectionProfileStreamContext) forEachBranch(instrs []pcrProtectionProfileInstr, values pcrValuesList, fn func(tpm2.PCRValues) error) error {
+	for n, instr := range instrs {
+		switch i := instr.(type) {
+		case *pcrProtectionProfileAddPCRValueInstr:
+			values.setValue(i.alg, i.pcr, i.value)
+		case *pcrProtectionProfileAddPCRValueFromTPMInstr:
+			v, err := c.readPCR(i.alg, i.pcr)
+			if err != nil {
+				return err
+			}
+			values.setValue(i.alg, i.pcr, v)
+		case *pcrProtectionProfileExtendPCRInstr:
+			values.extendValue(i.alg, i.pcr, i.value)
+		case *pcrProtectionProfileAddProfileORInstr:
+			rest := instrs[n+1:]
+			for _, sub := range i.profiles {
+				if err := c.forEachBranch(sub.instrs, values.copy(), func(v tpm2.PCRValues) error {
+					return c.forEachBranch(rest, pcrValuesList{v}, fn)
+				}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	return fn(values[0])
+}
+
+// PCRExtend corresponds to a single extend of a PCR with the specified digest.
+type PCRExtend struct {
+	PCR    int
+	Alg    tpm2.HashAlgorithmId
+	Digest tpm2.Digest
+}
+
+// pcrExtendSequences is a list of PCR extend sequences computed from PCRProtectionProfile, one for each branch.
+type pcrExtendSequences [][]PCRExtend
+
+// reset discards the extends for the specified PCR from all branches.
+func (s pcrExtendSequences) reset(alg tpm2.HashAlgorithmId, pcr int) {
+	for i, seq := range s {
+		var out []PCRExtend
+		for _, e := range seq {
+			if e.PCR == pcr && e.Alg == alg {
+				continue
+			}
+			out = append(out, e)
+		}
+		s[i] = out
+	}
+}
+
+// extend appends an extend of the specified PCR with the supplied digest to all branches.
+func (s pcrExtendSequences) extend(alg tpm2.HashAlgorithmId, pcr int, digest tpm2.Digest) {
+	for i, seq := range s {
+		s[i] = append(seq[:len(seq):len(seq)], PCRExtend{PCR: pcr, Alg: alg, Digest: digest})
+	}
+}
+
+func (s pcrExtendSequences) copy() (out pcrExtendSequences) {
+	for _, seq := range s {
+		out = append(out, append([]PCRExtend(nil), seq...))
+	}
+	return
+}
+
+func (p *PCRProtectionProfile) computePCRExtendSequences(seqs pcrExtendSequences) (pcrExtendSequences, error) {
+	for _, instr := range p.instrs {
+		switch i := instr.(type) {
+		case *pcrProtectionProfileAddPCRValueInstr:
+			if !bytes.Equal(i.value, make(tpm2.Digest, i.alg.Size())) {
+				return nil, fmt.Errorf("cannot compute extend sequence for PCR %d from bank %v: value is not the reset value", i.pcr, i.alg)
+			}
+			seqs.reset(i.alg, i.pcr)
+		case *pcrProtectionProfileAddPCRValueFromTPMInstr:
+			return nil, fmt.Errorf("cannot compute extend sequence for PCR %d from bank %v: value is read from the TPM", i.pcr, i.alg)
+		case *pcrProtectionProfileExtendPCRInstr:
+			seqs.extend(i.alg, i.pcr, i.value)
+		case *pcrProtectionProfileAddProfileORInstr:
+			var out pcrExtendSequences
+			for _, sub := range i.profiles {
+				s, err := sub.computePCRExtendSequences(seqs.copy())
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, s...)
+			}
+			seqs = out
+		}
+	}
+	return seqs, nil
+}
+
+// ComputePCRExtendSequences computes the sequences of PCR extends that produce the PCR values for this
+// PCRProtectionProfile when replayed against PCRs in their reset state, returning one sequence for each
+// complete branch. This is useful for generating test data that is consistent with a profile. An error
+// is returned if the profile sets a PCR to a value other than its reset value (all zeroes) or reads the
+// current value of a PCR from the TPM. The returned list of sequences is not de-duplicated.
+func (p *PCRProtectionProfile) ComputePCRExtendSequences() ([][]PCRExtend, error) {
+	seqs, err := p.computePCRExtendSequences(pcrExtendSequences{nil})
+	if err != nil {
+		return nil, err
+	}
+	return [][]PCRExtend(seqs), nil
+}
+
 // ComputePCRDigests computes a PCR selection and a list of composite PCR digests from this PCRProtectionProfile (one composite digest per
 // complete branch). The returned list of PCR digests is de-duplicated.
 func (p *PCRProtectionProfile) ComputePCRDigests(tpm *tpm2.TPMContext, alg tpm2.HashAlgorithmId) (tpm2.PCRSelectionList, tpm2.DigestList, error) {
@@ -361,30 +544,149 @@ func (p *PCRProtectionProfile) ComputePCRDigests(tpm *tpm2.TPMContext, alg tpm2.
 	// Compute the PCR selection for this profile from the first branch.
 	pcrs := values[0].SelectionList()
 
-	// Compute the PCR digests for all branches, making sure that they all contain values for the same sets of PCRs.
-	var pcrDigests tpm2.DigestList
-	for _, v := range values {
-		p, digest, _ := tpm2.ComputePCRDigestSimple(alg, v)
+	// Compute the PCR digests for all branches concurrently, making sure that they all contain values for the same sets of PCRs.
+	pcrDigests := make(tpm2.DigestList, len(values))
+	if err := parallel.ForEach(len(values), 0, func(i int) error {
+		p, digest, _ := tpm2.ComputePCRDigestSimple(alg, values[i])
 		if !p.Equal(pcrs) {
-			return nil, nil, errors.New("not all branches contain values for the same sets of PCRs")
+			return errors.New("not all branches contain values for the same sets of PCRs")
 		}
-		pcrDigests = append(pcrDigests, digest)
+		pcrDigests[i] = digest
+		return nil
+	}); err != nil {
+		return nil, nil, err
 	}
 
 	var uniquePcrDigests tpm2.DigestList
+	seen := make(map[string]bool)
 	for _, d := range pcrDigests {
-		found := false
-		for _, f := range uniquePcrDigests {
-			if bytes.Equal(d, f) {
-				found = true
-				break
-			}
-		}
-		if found {
+		if seen[string(d)] {
 			continue
 		}
+		seen[string(d)] = true
 		uniquePcrDigests = append(uniquePcrDigests, d)
 	}
 
 	return pcrs, uniquePcrDigests, nil
 }
+
+// ComputePCRDigestsStreaming computes a PCR selection and a list of composite PCR digests from this PCRProtectionProfile in the
+// same way as ComputePCRDigests. Rather than computing the PCR values for every branch before computing the composite digests,
+// this computes the composite digest for each complete branch as the profile is traversed, so that only the PCR values for the
+// branch being processed and the de-duplicated digests are retained. This bounds the memory used for profiles with a very large
+// number of branches. The returned digests are the same as those returned from ComputePCRDigests, but may be in a different
+// order.
+func (p *PCRProtectionProfile) ComputePCRDigestsStreaming(tpm *tpm2.TPMContext, alg tpm2.HashAlgorithmId) (tpm2.PCRSelectionList, tpm2.DigestList, error) {
+	c := &pcrProtectionProfileStreamContext{tpm: tpm, tpmValues: make(tpm2.PCRValues)}
+
+	var pcrs tpm2.PCRSelectionList
+	var digests tpm2.DigestList
+	first := true
+	seen := make(map[string]bool)
+
+	if err := c.forEachBranch(p.instrs, pcrValuesList{make(tpm2.PCRValues)}, func(values tpm2.PCRValues) error {
+		// Compute the PCR selection for this profile from the first branch, and make sure that all other branches contain values
+		// for the same sets of PCRs.
+		branchPcrs, digest, _ := tpm2.ComputePCRDigestSimple(alg, values)
+		if first {
+			pcrs = branchPcrs
+			first = false
+		} else if !branchPcrs.Equal(pcrs) {
+			return errors.New("not all branches contain values for the same sets of PCRs")
+		}
+
+		if seen[string(digest)] {
+			return nil
+		}
+		seen[string(digest)] = true
+		digests = append(digests, digest)
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	return pcrs, digests, nil
+}
+
+// PCRMismatch describes a PCR whose current value differs from the value expected by a branch of a PCRProtectionProfile.
+type PCRMismatch struct {
+	Alg      tpm2.HashAlgorithmId
+	PCR      int
+	Expected tpm2.Digest // The value expected by the branch
+	Current  tpm2.Digest // The current value of the PCR
+}
+
+// PCRProfileMatch is returned from PCRProtectionProfile.CheckMatch.
+type PCRProfileMatch struct {
+	// Matched indicates whether the current PCR values match one of the branches of the profile.
+	Matched bool
+
+	// Branch is the index of the matching branch if Matched is true. If Matched is false, this is the index of the branch
+	// with the fewest PCRs that differ from their current values.
+	Branch int
+
+	// Mismatches is the list of PCRs that differ from their current values for the branch indicated by Branch, ordered by
+	// PCR bank and then by PCR index. This is empty if Matched is true.
+	Mismatches []PCRMismatch
+}
+
+// CheckMatch computes the PCR values for every branch of this PCRProtectionProfile and compares them with the current PCR
+// values from the TPM, in order to determine whether a key sealed with this profile can be unsealed in the current boot. The
+// composite digest of the current PCR values is computed with the specified algorithm and is compared against the composite
+// digest of each branch.
+//
+// If one of the branches matches, the returned PCRProfileMatch identifies the matching branch. If none of them match, it
+// identifies the branch that is closest to the current PCR values along with a per-PCR list of differences. The index of a
+// branch corresponds to the order of the PCR values returned from ComputePCRValues.
+func (p *PCRProtectionProfile) CheckMatch(tpm *tpm2.TPMContext, alg tpm2.HashAlgorithmId) (*PCRProfileMatch, error) {
+	if tpm == nil {
+		return nil, errors.New("no TPM context")
+	}
+
+	values, err := p.ComputePCRValues(tpm)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute PCR values: %w", err)
+	}
+
+	pcrs := values[0].SelectionList()
+	for _, v := range values[1:] {
+		if !v.SelectionList().Equal(pcrs) {
+			return nil, errors.New("not all branches contain values for the same sets of PCRs")
+		}
+	}
+
+	_, current, err := tpm.PCRRead(pcrs)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read current PCR values: %w", err)
+	}
+	currentDigest, err := tpm2.ComputePCRDigest(alg, pcrs, current)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute current PCR digest: %w", err)
+	}
+
+	var closest *PCRProfileMatch
+	for i, v := range values {
+		digest, err := tpm2.ComputePCRDigest(alg, pcrs, v)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot compute PCR digest for branch %d: %w", i, err)
+		}
+		if bytes.Equal(digest, currentDigest) {
+			return &PCRProfileMatch{Matched: true, Branch: i}, nil
+		}
+
+		var mismatches []PCRMismatch
+		for _, s := range pcrs {
+			for _, pcr := range s.Select {
+				if bytes.Equal(v[s.Hash][pcr], current[s.Hash][pcr]) {
+					continue
+				}
+				mismatches = append(mismatches, PCRMismatch{Alg: s.Hash, PCR: pcr, Expected: v[s.Hash][pcr], Current: current[s.Hash][pcr]})
+			}
+		}
+		if closest == nil || len(mismatches) < len(closest.Mismatches) {
+			closest = &PCRProfileMatch{Branch: i, Mismatches: mismatches}
+		}
+	}
+
+	return closest, nil
+}
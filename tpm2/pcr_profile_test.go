@@ -304,6 +304,36 @@ func TestPCRProtectionProfile(t *testing.T) {
 				},
 			},
 		},
+		{
+			// Verify that (A1 || A2) && B produces 2 outcomes when A and B are for different PCR banks
+			desc: "AND/1",
+			alg:  tpm2.HashAlgorithmSHA256,
+			profile: func() *PCRProtectionProfile {
+				return NewPCRProtectionProfile().AddProfileAND(
+					NewPCRProtectionProfile().AddProfileOR(
+						NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo")),
+						NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo2"))),
+					NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA384, 7, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA384, "foo")))
+			}(),
+			values: []tpm2.PCRValues{
+				{
+					tpm2.HashAlgorithmSHA256: {
+						7: testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo"),
+					},
+					tpm2.HashAlgorithmSHA384: {
+						7: testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA384, "foo"),
+					},
+				},
+				{
+					tpm2.HashAlgorithmSHA256: {
+						7: testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo2"),
+					},
+					tpm2.HashAlgorithmSHA384: {
+						7: testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA384, "foo"),
+					},
+				},
+			},
+		},
 		{
 			desc: "EmptyProfileOR",
 			alg:  tpm2.HashAlgorithmSHA256,
@@ -385,6 +415,89 @@ func TestPCRProtectionProfileString(t *testing.T) {
 	}
 }
 
+func TestPCRProtectionProfileComputePCRExtendSequences(t *testing.T) {
+	foo := testutil.MakePCREventDigest(tpm2.HashAlgorithmSHA256, "foo")
+	bar := testutil.MakePCREventDigest(tpm2.HashAlgorithmSHA256, "bar")
+	end := testutil.MakePCREventDigest(tpm2.HashAlgorithmSHA256, "end")
+
+	profile := NewPCRProtectionProfile().
+		ExtendPCR(tpm2.HashAlgorithmSHA256, 7, bar).
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, make([]byte, tpm2.HashAlgorithmSHA256.Size())).
+		AddProfileOR(
+			NewPCRProtectionProfile().
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 7, foo).
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 8, bar),
+			NewPCRProtectionProfile().
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 7, bar).
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 8, foo)).
+		ExtendPCR(tpm2.HashAlgorithmSHA256, 12, end)
+
+	seqs, err := profile.ComputePCRExtendSequences()
+	if err != nil {
+		t.Fatalf("ComputePCRExtendSequences failed: %v", err)
+	}
+
+	expected := [][]PCRExtend{
+		{
+			{PCR: 7, Alg: tpm2.HashAlgorithmSHA256, Digest: foo},
+			{PCR: 8, Alg: tpm2.HashAlgorithmSHA256, Digest: bar},
+			{PCR: 12, Alg: tpm2.HashAlgorithmSHA256, Digest: end},
+		},
+		{
+			{PCR: 7, Alg: tpm2.HashAlgorithmSHA256, Digest: bar},
+			{PCR: 8, Alg: tpm2.HashAlgorithmSHA256, Digest: foo},
+			{PCR: 12, Alg: tpm2.HashAlgorithmSHA256, Digest: end},
+		},
+	}
+	if !reflect.DeepEqual(seqs, expected) {
+		t.Errorf("ComputePCRExtendSequences returned unexpected sequences: %v", seqs)
+	}
+
+	// Replaying each sequence should produce the PCR values computed from the profile.
+	values, err := profile.ComputePCRValues(nil)
+	if err != nil {
+		t.Fatalf("ComputePCRValues failed: %v", err)
+	}
+	for i, seq := range seqs {
+		v := make(tpm2.PCRValues)
+		for _, e := range seq {
+			if _, ok := v[e.Alg]; !ok {
+				v[e.Alg] = make(map[int]tpm2.Digest)
+			}
+			if _, ok := v[e.Alg][e.PCR]; !ok {
+				v[e.Alg][e.PCR] = make(tpm2.Digest, e.Alg.Size())
+			}
+			h := e.Alg.NewHash()
+			h.Write(v[e.Alg][e.PCR])
+			h.Write(e.Digest)
+			v[e.Alg][e.PCR] = h.Sum(nil)
+		}
+		if !reflect.DeepEqual(v, values[i]) {
+			t.Errorf("Unexpected values from replaying sequence %d", i)
+		}
+	}
+}
+
+func TestPCRProtectionProfileComputePCRExtendSequencesErrors(t *testing.T) {
+	t.Run("NonResetValue", func(t *testing.T) {
+		profile := NewPCRProtectionProfile().
+			AddPCRValue(tpm2.HashAlgorithmSHA256, 7, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo"))
+		_, err := profile.ComputePCRExtendSequences()
+		if err == nil || err.Error() != "cannot compute extend sequence for PCR 7 from bank TPM_ALG_SHA256: value is not the reset value" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ValueFromTPM", func(t *testing.T) {
+		profile := NewPCRProtectionProfile().
+			AddProfileOR(NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7))
+		_, err := profile.ComputePCRExtendSequences()
+		if err == nil || err.Error() != "cannot compute extend sequence for PCR 7 from bank TPM_ALG_SHA256: value is read from the TPM" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
+
 func TestPCRProtectionProfileAddValueFromTPM(t *testing.T) {
 	tpm, _ := openTPMSimulatorForTesting(t)
 	defer closeTPM(t, tpm)
@@ -414,3 +527,188 @@ func TestPCRProtectionProfileAddValueFromTPM(t *testing.T) {
 		t.Errorf("ComputePCRDigests returned unexpected values")
 	}
 }
+
+// makeLargePCRProtectionProfile returns a profile with n*n branches, half of which are duplicates.
+func makeLargePCRProtectionProfile(n int) *PCRProtectionProfile {
+	var pcr4Profiles []*PCRProtectionProfile
+	var pcr12Profiles []*PCRProtectionProfile
+	for i := 0; i < n; i++ {
+		pcr4Profiles = append(pcr4Profiles, NewPCRProtectionProfile().
+			ExtendPCR(tpm2.HashAlgorithmSHA256, 4, testutil.MakePCREventDigest(tpm2.HashAlgorithmSHA256, fmt.Sprintf("event%d", i%(n/2)))))
+		pcr12Profiles = append(pcr12Profiles, NewPCRProtectionProfile().
+			ExtendPCR(tpm2.HashAlgorithmSHA256, 12, testutil.MakePCREventDigest(tpm2.HashAlgorithmSHA256, fmt.Sprintf("event%d", i))))
+	}
+	return NewPCRProtectionProfile().AddProfileOR(pcr4Profiles...).AddProfileOR(pcr12Profiles...)
+}
+
+func TestPCRProtectionProfileDeduplicatesLargeProfile(t *testing.T) {
+	_, digests, err := makeLargePCRProtectionProfile(64).ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	if err != nil {
+		t.Fatalf("ComputePCRDigests failed: %v", err)
+	}
+	if len(digests) != 2048 {
+		t.Errorf("ComputePCRDigests returned the wrong number of digests (%d)", len(digests))
+	}
+}
+
+func BenchmarkComputePCRDigests(b *testing.B) {
+	profile := makeLargePCRProtectionProfile(64)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, _, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256); err != nil {
+			b.Fatalf("ComputePCRDigests failed: %v", err)
+		}
+	}
+}
+
+func TestPCRProtectionProfileComputePCRDigestsStreaming(t *testing.T) {
+	for _, data := range []struct {
+		desc    string
+		profile *PCRProtectionProfile
+	}{
+		{
+			desc:    "Large",
+			profile: makeLargePCRProtectionProfile(16),
+		},
+		{
+			desc: "Nested",
+			profile: NewPCRProtectionProfile().
+				AddPCRValue(tpm2.HashAlgorithmSHA256, 7, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo")).
+				AddProfileOR(
+					NewPCRProtectionProfile().
+						ExtendPCR(tpm2.HashAlgorithmSHA256, 4, testutil.MakePCREventDigest(tpm2.HashAlgorithmSHA256, "bar1")).
+						AddProfileOR(
+							NewPCRProtectionProfile().ExtendPCR(tpm2.HashAlgorithmSHA256, 12, testutil.MakePCREventDigest(tpm2.HashAlgorithmSHA256, "baz1")),
+							NewPCRProtectionProfile().ExtendPCR(tpm2.HashAlgorithmSHA256, 12, testutil.MakePCREventDigest(tpm2.HashAlgorithmSHA256, "baz2"))),
+					NewPCRProtectionProfile().
+						ExtendPCR(tpm2.HashAlgorithmSHA256, 4, testutil.MakePCREventDigest(tpm2.HashAlgorithmSHA256, "bar2")).
+						ExtendPCR(tpm2.HashAlgorithmSHA256, 12, testutil.MakePCREventDigest(tpm2.HashAlgorithmSHA256, "baz3"))).
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 12, testutil.MakePCREventDigest(tpm2.HashAlgorithmSHA256, "end")),
+		},
+		{
+			desc: "SetAfterOR",
+			profile: NewPCRProtectionProfile().
+				AddProfileOR(
+					NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo")),
+					NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "bar"))).
+				AddPCRValue(tpm2.HashAlgorithmSHA256, 7, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "baz")),
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			expectedPcrs, expectedDigests, err := data.profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+			if err != nil {
+				t.Fatalf("ComputePCRDigests failed: %v", err)
+			}
+
+			pcrs, digests, err := data.profile.ComputePCRDigestsStreaming(nil, tpm2.HashAlgorithmSHA256)
+			if err != nil {
+				t.Fatalf("ComputePCRDigestsStreaming failed: %v", err)
+			}
+
+			if !pcrs.Equal(expectedPcrs) {
+				t.Errorf("ComputePCRDigestsStreaming returned the wrong selection")
+			}
+			if len(digests) != len(expectedDigests) {
+				t.Fatalf("ComputePCRDigestsStreaming returned the wrong number of digests (%d)", len(digests))
+			}
+			expected := make(map[string]bool)
+			for _, d := range expectedDigests {
+				expected[string(d)] = true
+			}
+			for _, d := range digests {
+				if !expected[string(d)] {
+					t.Errorf("ComputePCRDigestsStreaming returned an unexpected digest %x", d)
+				}
+			}
+		})
+	}
+}
+
+func TestPCRProtectionProfileComputePCRDigestsStreamingMismatchedBranches(t *testing.T) {
+	profile := NewPCRProtectionProfile().AddProfileOR(
+		NewPCRProtectionProfile().ExtendPCR(tpm2.HashAlgorithmSHA256, 4, testutil.MakePCREventDigest(tpm2.HashAlgorithmSHA256, "foo")),
+		NewPCRProtectionProfile().ExtendPCR(tpm2.HashAlgorithmSHA256, 12, testutil.MakePCREventDigest(tpm2.HashAlgorithmSHA256, "bar")))
+	_, _, err := profile.ComputePCRDigestsStreaming(nil, tpm2.HashAlgorithmSHA256)
+	if err == nil || err.Error() != "not all branches contain values for the same sets of PCRs" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func BenchmarkComputePCRDigestsStreaming(b *testing.B) {
+	profile := makeLargePCRProtectionProfile(64)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, _, err := profile.ComputePCRDigestsStreaming(nil, tpm2.HashAlgorithmSHA256); err != nil {
+			b.Fatalf("ComputePCRDigestsStreaming failed: %v", err)
+		}
+	}
+}
+
+func TestPCRProtectionProfileCheckMatch(t *testing.T) {
+	tpm, tcti := openTPMSimulatorForTesting(t)
+	defer func() { closeTPM(t, tpm) }()
+	tpm, tcti = resetTPMSimulator(t, tpm, tcti)
+
+	for _, e := range []string{"foo", "bar"} {
+		if _, err := tpm.PCREvent(tpm.PCRHandleContext(7), []byte(e), nil); err != nil {
+			t.Fatalf("PCREvent failed: %v", err)
+		}
+	}
+	if _, err := tpm.PCREvent(tpm.PCRHandleContext(12), []byte("baz"), nil); err != nil {
+		t.Fatalf("PCREvent failed: %v", err)
+	}
+
+	t.Run("Match", func(t *testing.T) {
+		profile := NewPCRProtectionProfile().
+			AddPCRValue(tpm2.HashAlgorithmSHA256, 7, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo", "bar")).
+			AddProfileOR(
+				NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 12, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "abc")),
+				NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 12, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "baz")))
+		match, err := profile.CheckMatch(tpm.TPMContext, tpm2.HashAlgorithmSHA256)
+		if err != nil {
+			t.Fatalf("CheckMatch failed: %v", err)
+		}
+		if !match.Matched {
+			t.Errorf("Expected a match")
+		}
+		if match.Branch != 1 {
+			t.Errorf("Unexpected branch %d", match.Branch)
+		}
+		if len(match.Mismatches) != 0 {
+			t.Errorf("Unexpected mismatches")
+		}
+	})
+
+	t.Run("NoMatch", func(t *testing.T) {
+		profile := NewPCRProtectionProfile().AddProfileOR(
+			NewPCRProtectionProfile().
+				AddPCRValue(tpm2.HashAlgorithmSHA256, 7, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo")).
+				AddPCRValue(tpm2.HashAlgorithmSHA256, 12, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "abc")),
+			NewPCRProtectionProfile().
+				AddPCRValue(tpm2.HashAlgorithmSHA256, 7, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "foo", "bar")).
+				AddPCRValue(tpm2.HashAlgorithmSHA256, 12, testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "abc")))
+		match, err := profile.CheckMatch(tpm.TPMContext, tpm2.HashAlgorithmSHA256)
+		if err != nil {
+			t.Fatalf("CheckMatch failed: %v", err)
+		}
+		if match.Matched {
+			t.Errorf("Unexpected match")
+		}
+		if match.Branch != 1 {
+			t.Errorf("Unexpected closest branch %d", match.Branch)
+		}
+		expected := []PCRMismatch{
+			{
+				Alg:      tpm2.HashAlgorithmSHA256,
+				PCR:      12,
+				Expected: testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "abc"),
+				Current:  testutil.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "baz"),
+			},
+		}
+		if !reflect.DeepEqual(match.Mismatches, expected) {
+			t.Errorf("Unexpected mismatches: %v", match.Mismatches)
+		}
+	})
+}
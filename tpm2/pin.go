@@ -20,13 +20,24 @@
 package tpm2
 
 import (
+	"errors"
+
 	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
 
 	"golang.org/x/xerrors"
-
-	"github.com/snapcore/secboot/internal/tcg"
 )
 
+// pinIndexAttrs are the attributes for a NV index used to limit the number of PIN attempts for a sealed key object.
+// PIN failures for these indices don't affect the TPM's dictionary attack counter.
+var pinIndexAttrs = tpm2.NVTypePinFail.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVPolicyRead | tpm2.AttrNVNoDA)
+
+// pinIndexParams corresponds to the contents of a PIN fail NV index (TPMS_NV_PIN_COUNTER_PARAMETERS).
+type pinIndexParams struct {
+	PinCount uint32 // The number of consecutive authorization failures
+	PinLimit uint32 // The number of authorization failures permitted
+}
+
 // computeV0PinNVIndexPostInitAuthPolicies computes the authorization policy digests associated with the post-initialization
 // actions on a NV index created with the removed createPinNVIndex for version 0 key files. These are:
 // - A policy for updating the index to revoke old dynamic authorization policies, requiring an assertion signed by the key
@@ -75,13 +86,14 @@ func computeV0PinNVIndexPostInitAuthPolicies(alg tpm2.HashAlgorithmId, updateKey
 	return out, nil
 }
 
-// performPinChangeV0 changes the authorization value of the dynamic authorization policy counter associated with the public
-// argument, for PIN integration in version 0 key files. This requires the authorization policy digests initially returned from
-// (the now removed) createPinNVIndex function in order to execute the policy session required to change the authorization value.
-// The current authorization value must be provided via the oldAuth argument.
+// performNVIndexPinChange changes the authorization value of the NV index associated with the public argument, for PIN integration
+// in version 0 key files (where the dynamic authorization policy counter is used) and for key files with a PIN index. This requires
+// the authorization policy digests initially returned from (the now removed) createPinNVIndex function or from
+// computePinIndexAuthPolicies in order to execute the policy session required to change the authorization value. The current
+// authorization value must be provided via the oldAuth argument.
 //
-// On success, the authorization value of the counter will be changed to newAuth.
-func performPinChangeV0(tpm *tpm2.TPMContext, public *tpm2.NVPublic, authPolicies tpm2.DigestList, oldAuth, newAuth string, hmacSession tpm2.SessionContext) error {
+// On success, the authorization value of the NV index will be changed to newAuth.
+func performNVIndexPinChange(tpm *tpm2.TPMContext, public *tpm2.NVPublic, authPolicies tpm2.DigestList, oldAuth, newAuth string, hmacSession tpm2.SessionContext) error {
 	index, err := tpm2.CreateNVIndexResourceContextFromPublic(public)
 	if err != nil {
 		return xerrors.Errorf("cannot create resource context for NV index: %w", err)
@@ -111,17 +123,162 @@ func performPinChangeV0(tpm *tpm2.TPMContext, public *tpm2.NVPublic, authPolicie
 	return nil
 }
 
-// performPinChange changes the authorization value of the sealed key object associated with keyPrivate and keyPublic, for PIN
-// integration in current key files. The sealed key file must be created without the AttrAdminWithPolicy attribute. The current
-// authorization value must be provided via the oldAuth argument.
+// computePinIndexAuthPolicies computes the authorization policy digests passed to TPM2_PolicyOR for a PIN index. These are:
+// - A policy for writing the index in order to reset the failure count, requiring knowledge of the authorization value (PIN).
+// - A policy for updating the authorization value (PIN), requiring knowledge of the current authorization value.
+// - A policy for reading the failure count and limit without knowing the authorization value.
+func computePinIndexAuthPolicies(alg tpm2.HashAlgorithmId) tpm2.DigestList {
+	var out tpm2.DigestList
+
+	trial, _ := tpm2.ComputeAuthPolicy(alg)
+	trial.PolicyCommandCode(tpm2.CommandNVWrite)
+	trial.PolicyAuthValue()
+	out = append(out, trial.GetDigest())
+
+	trial, _ = tpm2.ComputeAuthPolicy(alg)
+	trial.PolicyCommandCode(tpm2.CommandNVChangeAuth)
+	trial.PolicyAuthValue()
+	out = append(out, trial.GetDigest())
+
+	trial, _ = tpm2.ComputeAuthPolicy(alg)
+	trial.PolicyCommandCode(tpm2.CommandNVRead)
+	out = append(out, trial.GetDigest())
+
+	return out
+}
+
+// writePinIndex sets the failure count of the PIN index associated with the public argument to zero and its limit to the
+// specified value. The current authorization value of the index must be supplied via the pin argument.
+func writePinIndex(tpm *tpm2.TPMContext, public *tpm2.NVPublic, pin string, limit uint32, hmacSession tpm2.SessionContext) error {
+	index, err := tpm2.CreateNVIndexResourceContextFromPublic(public)
+	if err != nil {
+		return xerrors.Errorf("cannot create resource context for NV index: %w", err)
+	}
+	index.SetAuthValue([]byte(pin))
+
+	policySession, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, public.NameAlg)
+	if err != nil {
+		return xerrors.Errorf("cannot start policy session: %w", err)
+	}
+	defer tpm.FlushContext(policySession)
+
+	if err := tpm.PolicyCommandCode(policySession, tpm2.CommandNVWrite); err != nil {
+		return xerrors.Errorf("cannot execute assertion: %w", err)
+	}
+	if err := tpm.PolicyAuthValue(policySession); err != nil {
+		return xerrors.Errorf("cannot execute assertion: %w", err)
+	}
+	if err := tpm.PolicyOR(policySession, computePinIndexAuthPolicies(public.NameAlg)); err != nil {
+		return xerrors.Errorf("cannot execute assertion: %w", err)
+	}
+
+	data, err := mu.MarshalToBytes(pinIndexParams{PinLimit: limit})
+	if err != nil {
+		return xerrors.Errorf("cannot marshal index data: %w", err)
+	}
+
+	if err := tpm.NVWrite(index, index, data, 0, policySession, hmacSession.IncludeAttrs(tpm2.AttrAudit)); err != nil {
+		return xerrors.Errorf("cannot write NV index: %w", err)
+	}
+
+	return nil
+}
+
+// readPinIndex returns the failure count and limit of the PIN index associated with the public argument. This doesn't require
+// knowledge of the authorization value.
+func readPinIndex(tpm *tpm2.TPMContext, public *tpm2.NVPublic, hmacSession tpm2.SessionContext) (*pinIndexParams, error) {
+	index, err := tpm2.CreateNVIndexResourceContextFromPublic(public)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create resource context for NV index: %w", err)
+	}
+
+	policySession, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, public.NameAlg)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot start policy session: %w", err)
+	}
+	defer tpm.FlushContext(policySession)
+
+	if err := tpm.PolicyCommandCode(policySession, tpm2.CommandNVRead); err != nil {
+		return nil, xerrors.Errorf("cannot execute assertion: %w", err)
+	}
+	if err := tpm.PolicyOR(policySession, computePinIndexAuthPolicies(public.NameAlg)); err != nil {
+		return nil, xerrors.Errorf("cannot execute assertion: %w", err)
+	}
+
+	data, err := tpm.NVRead(index, index, public.Size, 0, policySession, hmacSession.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read NV index: %w", err)
+	}
+
+	var params pinIndexParams
+	if _, err := mu.UnmarshalFromBytes(data, &params); err != nil {
+		return nil, xerrors.Errorf("cannot unmarshal index data: %w", err)
+	}
+
+	return &params, nil
+}
+
+// createPinIndex creates and initializes a PIN fail NV index that is associated with a sealed key object, and is used to limit
+// the number of consecutive incorrect PIN attempts to the specified limit. The sealed key object's authorization policy
+// requires knowledge of the authorization value of this index before that of the sealed key object itself, so each
+// incorrect PIN increments the failure count of the index, and the TPM refuses further attempts once the limit is reached.
+// The index is initialized with an empty authorization value.
 //
-// On success, a new private area will be returned for the sealed key object, containing the new PIN.
-func performPinChange(tpm *tpm2.TPMContext, keyPrivate tpm2.Private, keyPublic *tpm2.Public, oldPIN, newPIN string, session tpm2.SessionContext) (tpm2.Private, error) {
-	srk, err := tpm.CreateResourceContextFromTPM(tcg.SRKHandle)
+// The index can be undefined and recreated by anyone with knowledge of the storage hierarchy's authorization value, so it
+// only enforces the attempt limit. The PIN remains the authorization value of the sealed key object, which is still protected
+// by the TPM's dictionary attack logic if the index is replaced.
+//
+// The NV index will be created with an authorization policy that permits anyone to read the failure count, and permits the
+// failure count to be reset and the authorization value to be changed with knowledge of the authorization value.
+func createPinIndex(tpm *tpm2.TPMContext, handle tpm2.Handle, limit uint32, hmacSession tpm2.SessionContext) (*tpm2.NVPublic, error) {
+	if handle.Type() != tpm2.HandleTypeNVIndex {
+		return nil, errors.New("invalid handle")
+	}
+
+	nameAlg := tpm2.HashAlgorithmSHA256
+
+	trial, _ := tpm2.ComputeAuthPolicy(nameAlg)
+	trial.PolicyOR(computePinIndexAuthPolicies(nameAlg))
+
+	public := &tpm2.NVPublic{
+		Index:      handle,
+		NameAlg:    nameAlg,
+		Attrs:      pinIndexAttrs,
+		AuthPolicy: trial.GetDigest(),
+		Size:       8}
+
+	index, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, public, hmacSession)
 	if err != nil {
-		return nil, xerrors.Errorf("cannot create context for SRK: %w", err)
+		return nil, xerrors.Errorf("cannot define NV space: %w", err)
+	}
+
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, hmacSession)
+	}()
+
+	if err := writePinIndex(tpm, public, "", limit, hmacSession); err != nil {
+		return nil, xerrors.Errorf("cannot initialize NV index: %w", err)
 	}
 
+	// The index has a different name now that it has been written, so update the public area we return so that it can be used
+	// to construct an authorization policy.
+	public.Attrs |= tpm2.AttrNVWritten
+
+	succeeded = true
+	return public, nil
+}
+
+// performPinChange changes the authorization value of the sealed key object associated with keyPrivate and keyPublic, which
+// is a child of the supplied storage key, for PIN integration in current key files. The sealed key file must be created without the AttrAdminWithPolicy attribute. The current
+// authorization value must be provided via the oldAuth argument.
+//
+// On success, a new private area will be returned for the sealed key object, containing the new PIN.
+func performPinChange(tpm *tpm2.TPMContext, srk tpm2.ResourceContext, keyPrivate tpm2.Private, keyPublic *tpm2.Public, oldPIN, newPIN string, session tpm2.SessionContext) (tpm2.Private, error) {
+
 	key, err := tpm.Load(srk, keyPrivate, keyPublic, session)
 	if err != nil {
 		return nil, xerrors.Errorf("cannot load sealed key object in to TPM: %w", err)
@@ -146,7 +303,16 @@ func performPinChange(tpm *tpm2.TPMContext, keyPrivate tpm2.Private, keyPublic *
 // If validation of the sealed key object fails, an InvalidKeyFileError error will be returned.
 //
 // If oldPIN is incorrect, then a ErrPINFail error will be returned and the TPM's dictionary attack counter will be incremented.
+//
+// If the sealed key object has a PIN attempt limit, then an incorrect oldPIN increments the failure count of the associated PIN
+// index instead, and a ErrPINAttemptLimitReached error will be returned once the limit has been reached.
+//
+// This function is subject to ConnectionOptions.RequireEncryptedSessions.
 func (k *SealedKeyObject) ChangePIN(tpm *Connection, oldPIN, newPIN string) error {
+	if err := tpm.checkEncryptedSessionsAvailable(); err != nil {
+		return err
+	}
+
 	// Check if the TPM is in lockout mode
 	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1)
 	if err != nil {
@@ -161,21 +327,59 @@ func (k *SealedKeyObject) ChangePIN(tpm *Connection, oldPIN, newPIN string) erro
 	pcrPolicyCounterPub, err := k.data.validate(tpm.TPMContext, nil, tpm.HmacSession())
 	if err != nil {
 		if isKeyFileError(err) {
-			return InvalidKeyFileError{err.Error()}
+			return InvalidKeyFileError{msg: err.Error()}
 		}
 		return xerrors.Errorf("cannot validate key data: %w", err)
 	}
 
 	// Change the PIN
 	if k.data.version == 0 {
-		if err := performPinChangeV0(tpm.TPMContext, pcrPolicyCounterPub, k.data.staticPolicyData.v0PinIndexAuthPolicies, oldPIN, newPIN, tpm.HmacSession()); err != nil {
+		if err := performNVIndexPinChange(tpm.TPMContext, pcrPolicyCounterPub, k.data.staticPolicyData.v0PinIndexAuthPolicies, oldPIN, newPIN, tpm.HmacSession()); err != nil {
+			if isAuthFailError(err, tpm2.CommandNVChangeAuth, 1) {
+				return ErrPINFail
+			}
+			return err
+		}
+	} else if k.data.staticPolicyData.pinIndexHandle != tpm2.HandleNull {
+		pinIndexPub, err := k.data.pinIndexPublic(tpm.TPMContext, tpm.HmacSession())
+		if err != nil {
+			if isKeyFileError(err) {
+				return InvalidKeyFileError{msg: err.Error()}
+			}
+			return xerrors.Errorf("cannot obtain PIN index: %w", err)
+		}
+		if err := performNVIndexPinChange(tpm.TPMContext, pinIndexPub, computePinIndexAuthPolicies(pinIndexPub.NameAlg), oldPIN, newPIN, tpm.HmacSession()); err != nil {
+			if k.pinAttemptLimitReached(tpm) {
+				return ErrPINAttemptLimitReached
+			}
 			if isAuthFailError(err, tpm2.CommandNVChangeAuth, 1) {
 				return ErrPINFail
 			}
 			return err
 		}
+
+		// The PIN is also the authorization value of the sealed key object.
+		srk, flush, err := k.data.loadParent(tpm.TPMContext, tpm.HmacSession())
+		if err != nil {
+			return err
+		}
+		defer flush()
+
+		newKeyPrivate, err := performPinChange(tpm.TPMContext, srk, k.data.keyPrivate, k.data.keyPublic, oldPIN, newPIN, tpm.HmacSession())
+		if err != nil {
+			// Try to restore the original PIN on the PIN index so that it stays consistent with the sealed key object.
+			performNVIndexPinChange(tpm.TPMContext, pinIndexPub, computePinIndexAuthPolicies(pinIndexPub.NameAlg), newPIN, oldPIN, tpm.HmacSession())
+			return err
+		}
+		k.data.keyPrivate = newKeyPrivate
 	} else {
-		newKeyPrivate, err := performPinChange(tpm.TPMContext, k.data.keyPrivate, k.data.keyPublic, oldPIN, newPIN, tpm.HmacSession())
+		srk, flush, err := k.data.loadParent(tpm.TPMContext, tpm.HmacSession())
+		if err != nil {
+			return err
+		}
+		defer flush()
+
+		newKeyPrivate, err := performPinChange(tpm.TPMContext, srk, k.data.keyPrivate, k.data.keyPublic, oldPIN, newPIN, tpm.HmacSession())
 		if err != nil {
 			if isAuthFailError(err, tpm2.CommandObjectChangeAuth, 1) {
 				return ErrPINFail
@@ -197,8 +401,8 @@ func (k *SealedKeyObject) ChangePIN(tpm *Connection, oldPIN, newPIN string) erro
 		return nil
 	}
 
-	if err := k.data.writeToFileAtomic(k.path); err != nil {
-		return xerrors.Errorf("cannot write key data file: %v", err)
+	if err := k.write(tpm.TPMContext, tpm.HmacSession()); err != nil {
+		return xerrors.Errorf("cannot write key data: %v", err)
 	}
 
 	return nil
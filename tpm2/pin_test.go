@@ -67,7 +67,7 @@ func TestPerformPinChange(t *testing.T) {
 
 	pin := "1234"
 
-	newPriv, err := PerformPinChange(tpm.TPMContext, priv, pub, "", pin, tpm.HmacSession())
+	newPriv, err := PerformPinChange(tpm.TPMContext, srk, priv, pub, "", pin, tpm.HmacSession())
 	if err != nil {
 		t.Fatalf("PerformPinChange failed: %v", err)
 	}
@@ -179,3 +179,111 @@ func (s *pinSuite) TestChangePINErrorHandling2(c *C) {
 		errCheckerArgs: []interface{}{ErrPINFail},
 	})
 }
+
+func (s *pinSuite) sealKeyWithPINAttemptLimit(c *C, limit uint32) (keyFile string) {
+	keyFile = c.MkDir() + "/keydata-limit"
+	pinIndexHandle := tpm2.Handle(0x0181fff4)
+
+	_, err := SealKeyToTPM(s.TPM, s.key, keyFile, &KeyCreationParams{
+		PCRProfile:             getTestPCRProfile(),
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		PINAttemptLimit:        limit,
+		PINIndexHandle:         pinIndexHandle})
+	c.Assert(err, IsNil)
+	pinIndex, err := s.TPM.CreateResourceContextFromTPM(pinIndexHandle)
+	c.Assert(err, IsNil)
+	s.AddCleanupNVSpace(c, s.TPM.OwnerHandleContext(), pinIndex)
+
+	k, err := ReadSealedKeyObject(keyFile)
+	c.Assert(err, IsNil)
+	c.Check(k.PINIndexHandle(), Equals, pinIndexHandle)
+	c.Check(k.ChangePIN(s.TPM, "", "1234"), IsNil)
+
+	return keyFile
+}
+
+func (s *pinSuite) TestPINAttemptLimit(c *C) {
+	keyFile := s.sealKeyWithPINAttemptLimit(c, 3)
+
+	k, err := ReadSealedKeyObject(keyFile)
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 2; i++ {
+		_, _, err = k.UnsealFromTPM(s.TPM, "5678")
+		c.Check(err, Equals, ErrPINFail)
+	}
+
+	// The correct PIN resets the failure count.
+	key, _, err := k.UnsealFromTPM(s.TPM, "1234")
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, s.key)
+
+	for i := 0; i < 2; i++ {
+		_, _, err = k.UnsealFromTPM(s.TPM, "5678")
+		c.Check(err, Equals, ErrPINFail)
+	}
+	_, _, err = k.UnsealFromTPM(s.TPM, "5678")
+	c.Check(err, Equals, ErrPINAttemptLimitReached)
+
+	// The correct PIN doesn't work once the limit is reached.
+	_, _, err = k.UnsealFromTPM(s.TPM, "1234")
+	c.Check(err, Equals, ErrPINAttemptLimitReached)
+
+	// PIN failures for this key don't affect the TPM's dictionary attack counter.
+	props, err := s.TPM.GetCapabilityTPMProperties(tpm2.PropertyLockoutCounter, 1)
+	c.Assert(err, IsNil)
+	c.Check(props[0].Value, Equals, uint32(0))
+}
+
+func (s *pinSuite) TestChangePINWithPINAttemptLimit(c *C) {
+	keyFile := s.sealKeyWithPINAttemptLimit(c, 1)
+
+	k, err := ReadSealedKeyObject(keyFile)
+	c.Assert(err, IsNil)
+	c.Check(k.ChangePIN(s.TPM, "1234", "5678"), IsNil)
+
+	key, _, err := k.UnsealFromTPM(s.TPM, "5678")
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, s.key)
+
+	c.Check(k.ChangePIN(s.TPM, "1234", "0000"), Equals, ErrPINAttemptLimitReached)
+}
+
+func (s *pinSuite) TestPINAttemptLimitWithRedefinedIndex(c *C) {
+	keyFile := s.sealKeyWithPINAttemptLimit(c, 3)
+
+	k, err := ReadSealedKeyObject(keyFile)
+	c.Assert(err, IsNil)
+
+	// Replace the PIN index with one that has the same public area and an empty authorization value, which
+	// only requires knowledge of the storage hierarchy's authorization value.
+	pinIndex, err := s.TPM.CreateResourceContextFromTPM(k.PINIndexHandle())
+	c.Assert(err, IsNil)
+	c.Assert(s.TPM.NVUndefineSpace(s.TPM.OwnerHandleContext(), pinIndex, nil), IsNil)
+	pub, err := CreatePinIndex(s.TPM.TPMContext, k.PINIndexHandle(), 3, s.TPM.HmacSession())
+	c.Assert(err, IsNil)
+	name, err := pub.Name()
+	c.Assert(err, IsNil)
+	c.Check(name, DeepEquals, pinIndex.Name())
+
+	// The PIN is still required, as it is also the authorization value of the sealed key object.
+	_, _, err = k.UnsealFromTPM(s.TPM, "")
+	c.Check(err, Equals, ErrPINFail)
+}
+
+func (s *pinSuite) TestValidateWithPINIndex(c *C) {
+	keyFile := c.MkDir() + "/keydata-limit"
+	pinIndexHandle := tpm2.Handle(0x0181fff4)
+
+	authPrivateKey, err := SealKeyToTPM(s.TPM, s.key, keyFile, &KeyCreationParams{
+		PCRProfile:             getTestPCRProfile(),
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		PINAttemptLimit:        3,
+		PINIndexHandle:         pinIndexHandle})
+	c.Assert(err, IsNil)
+	pinIndex, err := s.TPM.CreateResourceContextFromTPM(pinIndexHandle)
+	c.Assert(err, IsNil)
+	s.AddCleanupNVSpace(c, s.TPM.OwnerHandleContext(), pinIndex)
+
+	c.Check(ValidateKeyDataFile(s.TPM.TPMContext, keyFile, authPrivateKey, s.TPM.HmacSession()), IsNil)
+}
@@ -24,8 +24,10 @@ import (
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
+	"encoding/asn1"
 	"encoding/binary"
 	"errors"
+	"math/big"
 
 	"github.com/canonical/go-tpm2"
 
@@ -66,6 +68,18 @@ type dynamicPolicyData struct {
 	policyCount               uint64
 	authorizedPolicy          tpm2.Digest
 	authorizedPolicySignature *tpm2.Signature
+
+	// pcrValues contains the values permitted for each PCR in pcrSelection by the branches of the PCR policy.
+	// This is only used to determine which PCRs are responsible for a PCR policy mismatch, and is nil if it
+	// wasn't recorded.
+	pcrValues []pcrPermittedValues
+}
+
+// pcrPermittedValues describes the values of a single PCR that are permitted by at least one branch of a PCR policy.
+type pcrPermittedValues struct {
+	Hash   tpm2.HashAlgorithmId
+	PCR    uint32
+	Values tpm2.DigestList
 }
 
 // dynamicPolicyDataRaw_v0 is version 0 of the on-disk format of dynamicPolicyData.
@@ -96,10 +110,79 @@ func makeDynamicPolicyDataRaw_v0(data *dynamicPolicyData) *dynamicPolicyDataRaw_
 		AuthorizedPolicySignature: data.authorizedPolicySignature}
 }
 
+// dynamicPolicyDataRaw_v1 is version 1 of the on-disk format of dynamicPolicyData.
+type dynamicPolicyDataRaw_v1 struct {
+	PCRSelection              tpm2.PCRSelectionList
+	PCROrData                 policyOrDataTree
+	PolicyCount               uint64
+	AuthorizedPolicy          tpm2.Digest
+	AuthorizedPolicySignature *tpm2.Signature
+	PCRValues                 []pcrPermittedValues
+}
+
+func (d *dynamicPolicyDataRaw_v1) data() *dynamicPolicyData {
+	return &dynamicPolicyData{
+		pcrSelection:              d.PCRSelection,
+		pcrOrData:                 d.PCROrData,
+		policyCount:               d.PolicyCount,
+		authorizedPolicy:          d.AuthorizedPolicy,
+		authorizedPolicySignature: d.AuthorizedPolicySignature,
+		pcrValues:                 d.PCRValues}
+}
+
+// makeDynamicPolicyDataRaw_v1 converts dynamicPolicyData to version 1 of the on-disk format.
+func makeDynamicPolicyDataRaw_v1(data *dynamicPolicyData) *dynamicPolicyDataRaw_v1 {
+	return &dynamicPolicyDataRaw_v1{
+		PCRSelection:              data.pcrSelection,
+		PCROrData:                 data.pcrOrData,
+		PolicyCount:               data.policyCount,
+		AuthorizedPolicy:          data.authorizedPolicy,
+		AuthorizedPolicySignature: data.authorizedPolicySignature,
+		PCRValues:                 data.pcrValues}
+}
+
+// computePCRPermittedValues computes the values permitted for each PCR in the supplied selection by the supplied
+// branches of a PCR policy.
+func computePCRPermittedValues(pcrs tpm2.PCRSelectionList, branches []tpm2.PCRValues) []pcrPermittedValues {
+	var out []pcrPermittedValues
+	for _, s := range pcrs {
+		for _, pcr := range s.Select {
+			v := pcrPermittedValues{Hash: s.Hash, PCR: uint32(pcr)}
+			seen := make(map[string]bool)
+			for _, branch := range branches {
+				d, ok := branch[s.Hash][pcr]
+				if !ok || seen[string(d)] {
+					continue
+				}
+				seen[string(d)] = true
+				v.Values = append(v.Values, d)
+			}
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
 // staticPolicyComputeParams provides the parameters to computeStaticPolicy.
 type staticPolicyComputeParams struct {
 	key                 *tpm2.Public   // Public part of key used to authorize a dynamic authorization policy
 	pcrPolicyCounterPub *tpm2.NVPublic // Public area of the NV counter used for revoking PCR policies
+	pinIndexPub         *tpm2.NVPublic // Public area of the NV index used for limiting PIN attempts
+
+	counterTimerAssertions []policyCounterTimerAssertion // Assertions that limit the lifetime of the sealed key object
+	locality               tpm2.Locality                 // Localities from which the sealed key object can be used, or zero
+	commandCode            tpm2.CommandCode              // The only command that the policy can authorize, or zero
+	lockIndexPub           *tpm2.NVPublic                // Public area of the NV index used for locking access to the sealed key object
+	rollbackCounterPub     *tpm2.NVPublic                // Public area of the NV counter used for rollback protection
+	rollbackVersion        uint64                        // The version compared against the rollback counter
+}
+
+// policyCounterTimerAssertion describes a TPM2_PolicyCounterTimer assertion that compares operandB with the value at the
+// specified offset of the TPMS_TIME_INFO structure returned from TPM2_ReadClock.
+type policyCounterTimerAssertion struct {
+	OperandB  tpm2.Operand
+	Offset    uint16
+	Operation tpm2.ArithmeticOp
 }
 
 // staticPolicyData is an output of computeStaticPolicy and provides metadata for executing a policy session.
@@ -107,6 +190,13 @@ type staticPolicyData struct {
 	authPublicKey          *tpm2.Public
 	pcrPolicyCounterHandle tpm2.Handle
 	v0PinIndexAuthPolicies tpm2.DigestList
+	pinIndexHandle         tpm2.Handle
+	counterTimerAssertions []policyCounterTimerAssertion
+	locality               tpm2.Locality
+	commandCode            tpm2.CommandCode
+	lockIndexHandle        tpm2.Handle
+	rollbackCounterHandle  tpm2.Handle
+	rollbackVersion        uint64
 }
 
 // staticPolicyDataRaw_v0 is version 0 of the on-disk format of staticPolicyData.
@@ -120,7 +210,10 @@ func (d *staticPolicyDataRaw_v0) data() *staticPolicyData {
 	return &staticPolicyData{
 		authPublicKey:          d.AuthPublicKey,
 		pcrPolicyCounterHandle: d.PinIndexHandle,
-		v0PinIndexAuthPolicies: d.PinIndexAuthPolicies}
+		v0PinIndexAuthPolicies: d.PinIndexAuthPolicies,
+		pinIndexHandle:         tpm2.HandleNull,
+		lockIndexHandle:        tpm2.HandleNull,
+		rollbackCounterHandle:  tpm2.HandleNull}
 }
 
 // makeStaticPolicyDataRaw_v0 converts staticPolicyData to version 0 of the on-disk format.
@@ -141,7 +234,10 @@ type staticPolicyDataRaw_v1 struct {
 func (d *staticPolicyDataRaw_v1) data() *staticPolicyData {
 	return &staticPolicyData{
 		authPublicKey:          d.AuthPublicKey,
-		pcrPolicyCounterHandle: d.PCRPolicyCounterHandle}
+		pcrPolicyCounterHandle: d.PCRPolicyCounterHandle,
+		pinIndexHandle:         tpm2.HandleNull,
+		lockIndexHandle:        tpm2.HandleNull,
+		rollbackCounterHandle:  tpm2.HandleNull}
 }
 
 // makeStaticPolicyDataRaw_v1 converts staticPolicyData to version 1 of the on-disk format.
@@ -151,6 +247,105 @@ func makeStaticPolicyDataRaw_v1(data *staticPolicyData) *staticPolicyDataRaw_v1
 		PCRPolicyCounterHandle: data.pcrPolicyCounterHandle}
 }
 
+// staticPolicyDataRaw_v2 is version 2 of the on-disk format of staticPolicyData.
+type staticPolicyDataRaw_v2 struct {
+	AuthPublicKey          *tpm2.Public
+	PCRPolicyCounterHandle tpm2.Handle
+	PINIndexHandle         tpm2.Handle
+}
+
+func (d *staticPolicyDataRaw_v2) data() *staticPolicyData {
+	return &staticPolicyData{
+		authPublicKey:          d.AuthPublicKey,
+		pcrPolicyCounterHandle: d.PCRPolicyCounterHandle,
+		pinIndexHandle:         d.PINIndexHandle,
+		lockIndexHandle:        tpm2.HandleNull,
+		rollbackCounterHandle:  tpm2.HandleNull}
+}
+
+// makeStaticPolicyDataRaw_v2 converts staticPolicyData to version 2 of the on-disk format.
+func makeStaticPolicyDataRaw_v2(data *staticPolicyData) *staticPolicyDataRaw_v2 {
+	return &staticPolicyDataRaw_v2{
+		AuthPublicKey:          data.authPublicKey,
+		PCRPolicyCounterHandle: data.pcrPolicyCounterHandle,
+		PINIndexHandle:         data.pinIndexHandle}
+}
+
+// staticPolicyDataRaw_v3 is version 3 of the on-disk format of staticPolicyData.
+type staticPolicyDataRaw_v3 struct {
+	AuthPublicKey          *tpm2.Public
+	PCRPolicyCounterHandle tpm2.Handle
+	PINIndexHandle         tpm2.Handle
+	CounterTimerAssertions []policyCounterTimerAssertion
+	Locality               tpm2.Locality
+	CommandCode            tpm2.CommandCode
+	LockIndexHandle        tpm2.Handle
+}
+
+func (d *staticPolicyDataRaw_v3) data() *staticPolicyData {
+	return &staticPolicyData{
+		authPublicKey:          d.AuthPublicKey,
+		pcrPolicyCounterHandle: d.PCRPolicyCounterHandle,
+		pinIndexHandle:         d.PINIndexHandle,
+		counterTimerAssertions: d.CounterTimerAssertions,
+		locality:               d.Locality,
+		commandCode:            d.CommandCode,
+		lockIndexHandle:        d.LockIndexHandle,
+		rollbackCounterHandle:  tpm2.HandleNull}
+}
+
+// makeStaticPolicyDataRaw_v3 converts staticPolicyData to version 3 of the on-disk format.
+func makeStaticPolicyDataRaw_v3(data *staticPolicyData) *staticPolicyDataRaw_v3 {
+	return &staticPolicyDataRaw_v3{
+		AuthPublicKey:          data.authPublicKey,
+		PCRPolicyCounterHandle: data.pcrPolicyCounterHandle,
+		PINIndexHandle:         data.pinIndexHandle,
+		CounterTimerAssertions: data.counterTimerAssertions,
+		Locality:               data.locality,
+		CommandCode:            data.commandCode,
+		LockIndexHandle:        data.lockIndexHandle}
+}
+
+// staticPolicyDataRaw_v4 is version 4 of the on-disk format of staticPolicyData.
+type staticPolicyDataRaw_v4 struct {
+	AuthPublicKey          *tpm2.Public
+	PCRPolicyCounterHandle tpm2.Handle
+	PINIndexHandle         tpm2.Handle
+	CounterTimerAssertions []policyCounterTimerAssertion
+	Locality               tpm2.Locality
+	CommandCode            tpm2.CommandCode
+	LockIndexHandle        tpm2.Handle
+	RollbackCounterHandle  tpm2.Handle
+	RollbackVersion        uint64
+}
+
+func (d *staticPolicyDataRaw_v4) data() *staticPolicyData {
+	return &staticPolicyData{
+		authPublicKey:          d.AuthPublicKey,
+		pcrPolicyCounterHandle: d.PCRPolicyCounterHandle,
+		pinIndexHandle:         d.PINIndexHandle,
+		counterTimerAssertions: d.CounterTimerAssertions,
+		locality:               d.Locality,
+		commandCode:            d.CommandCode,
+		lockIndexHandle:        d.LockIndexHandle,
+		rollbackCounterHandle:  d.RollbackCounterHandle,
+		rollbackVersion:        d.RollbackVersion}
+}
+
+// makeStaticPolicyDataRaw_v4 converts staticPolicyData to version 4 of the on-disk format.
+func makeStaticPolicyDataRaw_v4(data *staticPolicyData) *staticPolicyDataRaw_v4 {
+	return &staticPolicyDataRaw_v4{
+		AuthPublicKey:          data.authPublicKey,
+		PCRPolicyCounterHandle: data.pcrPolicyCounterHandle,
+		PINIndexHandle:         data.pinIndexHandle,
+		CounterTimerAssertions: data.counterTimerAssertions,
+		Locality:               data.locality,
+		CommandCode:            data.commandCode,
+		LockIndexHandle:        data.lockIndexHandle,
+		RollbackCounterHandle:  data.rollbackCounterHandle,
+		RollbackVersion:        data.rollbackVersion}
+}
+
 // computePcrPolicyCounterAuthPolicies computes the authorization policy digests passed to TPM2_PolicyOR for a PCR
 // policy counter that can be updated with the key associated with updateKeyName.
 func computePcrPolicyCounterAuthPolicies(alg tpm2.HashAlgorithmId, updateKeyName tpm2.Name) (tpm2.DigestList, error) {
@@ -178,6 +373,94 @@ func computePcrPolicyCounterAuthPolicies(alg tpm2.HashAlgorithmId, updateKeyName
 	return authPolicies, nil
 }
 
+// signPolicyAuthorization signs a TPM2_PolicySigned authorization for the policy session with the supplied nonceTPM,
+// using the supplied private key. The authorization has no expiration, cpHash or policyRef. The keyPublic argument is the
+// public part of the key, and is used to determine the signature scheme.
+func signPolicyAuthorization(key crypto.PrivateKey, keyPublic *tpm2.Public, nonceTPM tpm2.Nonce) (*tpm2.Signature, error) {
+	// Compute a digest for signing
+	signDigest := tpm2.HashAlgorithmNull
+	keyScheme := keyPublic.Params.AsymDetail().Scheme
+	if keyScheme.Scheme != tpm2.AsymSchemeNull {
+		signDigest = keyScheme.Details.Any().HashAlg
+	}
+	if signDigest == tpm2.HashAlgorithmNull {
+		signDigest = tpm2.HashAlgorithmSHA256
+	}
+	h := signDigest.NewHash()
+	h.Write(nonceTPM)
+	binary.Write(h, binary.BigEndian, int32(0)) // expiration
+
+	return signWithKey(key, signDigest, h.Sum(nil))
+}
+
+// signWithKey signs the supplied digest with the supplied key, which must be a *rsa.PrivateKey, a *ecdsa.PrivateKey, or a
+// crypto.Signer with a RSA or ECDSA public key. RSA keys produce RSASSA-PSS signatures.
+func signWithKey(key crypto.PrivateKey, hashAlg tpm2.HashAlgorithmId, digest []byte) (*tpm2.Signature, error) {
+	pssOpts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: hashAlg.GetHash()}
+
+	var signature *tpm2.Signature
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err := rsa.SignPSS(rand.Reader, k, hashAlg.GetHash(), digest, pssOpts)
+		if err != nil {
+			return nil, err
+		}
+		signature = makeRSAPSSSignature(hashAlg, sig)
+	case *ecdsa.PrivateKey:
+		sigR, sigS, err := ecdsa.Sign(rand.Reader, k, digest)
+		if err != nil {
+			return nil, err
+		}
+		signature = makeECDSASignature(hashAlg, sigR, sigS)
+	case crypto.Signer:
+		switch k.Public().(type) {
+		case *rsa.PublicKey:
+			sig, err := k.Sign(rand.Reader, digest, pssOpts)
+			if err != nil {
+				return nil, err
+			}
+			signature = makeRSAPSSSignature(hashAlg, sig)
+		case *ecdsa.PublicKey:
+			sig, err := k.Sign(rand.Reader, digest, hashAlg.GetHash())
+			if err != nil {
+				return nil, err
+			}
+			var ecdsaSig struct {
+				R, S *big.Int
+			}
+			if rest, err := asn1.Unmarshal(sig, &ecdsaSig); err != nil || len(rest) > 0 {
+				return nil, errors.New("signer returned an invalid ECDSA signature")
+			}
+			signature = makeECDSASignature(hashAlg, ecdsaSig.R, ecdsaSig.S)
+		default:
+			return nil, errors.New("unsupported signer public key type")
+		}
+	default:
+		return nil, errors.New("unsupported private key type")
+	}
+
+	return signature, nil
+}
+
+func makeRSAPSSSignature(hashAlg tpm2.HashAlgorithmId, sig []byte) *tpm2.Signature {
+	return &tpm2.Signature{
+		SigAlg: tpm2.SigSchemeAlgRSAPSS,
+		Signature: &tpm2.SignatureU{
+			RSAPSS: &tpm2.SignatureRSAPSS{
+				Hash: hashAlg,
+				Sig:  tpm2.PublicKeyRSA(sig)}}}
+}
+
+func makeECDSASignature(hashAlg tpm2.HashAlgorithmId, r, s *big.Int) *tpm2.Signature {
+	return &tpm2.Signature{
+		SigAlg: tpm2.SigSchemeAlgECDSA,
+		Signature: &tpm2.SignatureU{
+			ECDSA: &tpm2.SignatureECDSA{
+				Hash:       hashAlg,
+				SignatureR: r.Bytes(),
+				SignatureS: s.Bytes()}}}
+}
+
 // incrementPcrPolicyCounter will increment the NV counter index associated with nvPublic. This is designed to operate on a
 // NV index created by createPcrPolicyCounter (for current key files) or on a NV index created by (the now deleted)
 // createPinNVINdex for version 0 key files.
@@ -199,47 +482,10 @@ func incrementPcrPolicyCounter(tpm *tpm2.TPMContext, version uint32, nvPublic *t
 	}
 	defer tpm.FlushContext(policySession)
 
-	// Compute a digest for signing with the update key
-	signDigest := tpm2.HashAlgorithmNull
-	keyScheme := keyPublic.Params.AsymDetail().Scheme
-	if keyScheme.Scheme != tpm2.AsymSchemeNull {
-		signDigest = keyScheme.Details.Any().HashAlg
-	}
-	if signDigest == tpm2.HashAlgorithmNull {
-		signDigest = tpm2.HashAlgorithmSHA256
-	}
-	h := signDigest.NewHash()
-	h.Write(policySession.NonceTPM())
-	binary.Write(h, binary.BigEndian, int32(0)) // expiration
-
-	// Sign the digest
-	var signature tpm2.Signature
-	switch k := key.(type) {
-	case *rsa.PrivateKey:
-		sig, err := rsa.SignPSS(rand.Reader, k, signDigest.GetHash(), h.Sum(nil), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
-		if err != nil {
-			return xerrors.Errorf("cannot sign authorization: %w", err)
-		}
-		signature = tpm2.Signature{
-			SigAlg: tpm2.SigSchemeAlgRSAPSS,
-			Signature: &tpm2.SignatureU{
-				RSAPSS: &tpm2.SignatureRSAPSS{
-					Hash: signDigest,
-					Sig:  tpm2.PublicKeyRSA(sig)}}}
-	case *ecdsa.PrivateKey:
-		sigR, sigS, err := ecdsa.Sign(rand.Reader, k, h.Sum(nil))
-		if err != nil {
-			return xerrors.Errorf("cannot sign authorization: %w", err)
-		}
-		signature = tpm2.Signature{
-			SigAlg: tpm2.SigSchemeAlgECDSA,
-			Signature: &tpm2.SignatureU{
-				ECDSA: &tpm2.SignatureECDSA{
-					Hash:       signDigest,
-					SignatureR: sigR.Bytes(),
-					SignatureS: sigS.Bytes()}}}
-	default:
-		panic("invalid private key type")
+	// Sign the policy authorization with the update key
+	signature, err := signPolicyAuthorization(key, keyPublic, policySession.NonceTPM())
+	if err != nil {
+		return xerrors.Errorf("cannot sign authorization: %w", err)
 	}
 
 	// Load the public part of the key in to the TPM. There's no integrity protection for this command as if it's altered in
@@ -268,7 +514,7 @@ func incrementPcrPolicyCounter(tpm *tpm2.TPMContext, version uint32, nvPublic *t
 		}
 	}
 
-	if _, _, err := tpm.PolicySigned(keyLoaded, policySession, true, nil, nil, 0, &signature); err != nil {
+	if _, _, err := tpm.PolicySigned(keyLoaded, policySession, true, nil, nil, 0, signature); err != nil {
 		return xerrors.Errorf("cannot execute assertion to increment counter: %w", err)
 	}
 	if err := tpm.PolicyOR(policySession, nvAuthPolicies); err != nil {
@@ -325,12 +571,9 @@ func readPcrPolicyCounter(tpm *tpm2.TPMContext, version uint32, nvPublic *tpm2.N
 	return c, nil
 }
 
-// createPcrPolicyCounter creates and initializes a NV counter that is associated with a sealed key object and is used for
-// implementing dynamic authorization policy revocation.
-//
-// The NV index will be created with attributes that allow anyone to read the index, and an authorization policy that permits
-// TPM2_NV_Increment with a signed authorization policy.
-func createPcrPolicyCounter(tpm *tpm2.TPMContext, handle tpm2.Handle, updateKeyName tpm2.Name, hmacSession tpm2.SessionContext) (*tpm2.NVPublic, error) {
+// computePcrPolicyCounterPublic computes the public area of a NV counter created by createPcrPolicyCounter before it
+// has been initialized, along with the authorization policy digests required to increment it.
+func computePcrPolicyCounterPublic(handle tpm2.Handle, updateKeyName tpm2.Name) (*tpm2.NVPublic, tpm2.DigestList) {
 	nameAlg := tpm2.HashAlgorithmSHA256
 
 	authPolicies, _ := computePcrPolicyCounterAuthPolicies(nameAlg, updateKeyName)
@@ -338,14 +581,25 @@ func createPcrPolicyCounter(tpm *tpm2.TPMContext, handle tpm2.Handle, updateKeyN
 	trial, _ := tpm2.ComputeAuthPolicy(nameAlg)
 	trial.PolicyOR(authPolicies)
 
-	// Define the NV index
 	public := &tpm2.NVPublic{
 		Index:      handle,
 		NameAlg:    nameAlg,
 		Attrs:      tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA),
 		AuthPolicy: trial.GetDigest(),
 		Size:       8}
+	return public, authPolicies
+}
 
+// createPcrPolicyCounter creates and initializes a NV counter that is associated with a sealed key object and is used for
+// implementing dynamic authorization policy revocation.
+//
+// The NV index will be created with attributes that allow anyone to read the index, and an authorization policy that permits
+// TPM2_NV_Increment with a signed authorization policy.
+func createPcrPolicyCounter(tpm *tpm2.TPMContext, handle tpm2.Handle, updateKeyName tpm2.Name, hmacSession tpm2.SessionContext) (*tpm2.NVPublic, error) {
+	public, authPolicies := computePcrPolicyCounterPublic(handle, updateKeyName)
+	nameAlg := public.NameAlg
+
+	// Define the NV index
 	index, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, public, hmacSession)
 	if err != nil {
 		return nil, xerrors.Errorf("cannot define NV space: %w", err)
@@ -390,6 +644,69 @@ func createPcrPolicyCounter(tpm *tpm2.TPMContext, handle tpm2.Handle, updateKeyN
 	return public, nil
 }
 
+const (
+	// pcrPolicyCounterHandleRangeStart and pcrPolicyCounterHandleRangeEnd define the range of NV index
+	// handles from which PCR policy counter handles are allocated automatically. This is a subset of the
+	// block reserved for owner objects.
+	pcrPolicyCounterHandleRangeStart tpm2.Handle = 0x01810000
+	pcrPolicyCounterHandleRangeEnd   tpm2.Handle = 0x018fffff
+
+	// pcrPolicyCounterAllocationAttempts is the number of times that createPcrPolicyCounterAtFreeHandle
+	// will try to create a counter, in case another NV consumer defines an index at the selected handle
+	// between it being selected and the counter being created.
+	pcrPolicyCounterAllocationAttempts = 3
+)
+
+// findFreeNVIndexHandle returns the lowest handle in the range defined by start and end (inclusive) that isn't
+// currently used by a NV index.
+func findFreeNVIndexHandle(tpm *tpm2.TPMContext, start, end tpm2.Handle, session tpm2.SessionContext) (tpm2.Handle, error) {
+	handles, err := tpm.GetCapabilityHandles(start, tpm2.CapabilityMaxProperties, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return tpm2.HandleNull, xerrors.Errorf("cannot obtain defined NV indices: %w", err)
+	}
+
+	candidate := start
+	for _, h := range handles {
+		if h != candidate {
+			break
+		}
+		candidate++
+	}
+	if candidate > end {
+		return tpm2.HandleNull, errors.New("no free NV index handles")
+	}
+
+	return candidate, nil
+}
+
+// findFreePcrPolicyCounterHandle returns the lowest handle in the range reserved for automatically allocated
+// PCR policy counters that isn't currently used by a NV index.
+func findFreePcrPolicyCounterHandle(tpm *tpm2.TPMContext, session tpm2.SessionContext) (tpm2.Handle, error) {
+	return findFreeNVIndexHandle(tpm, pcrPolicyCounterHandleRangeStart, pcrPolicyCounterHandleRangeEnd, session)
+}
+
+// createPcrPolicyCounterAtFreeHandle creates and initializes a PCR policy counter in the same way as
+// createPcrPolicyCounter, at a handle that is selected automatically. The last selected handle is returned
+// along with any error.
+func createPcrPolicyCounterAtFreeHandle(tpm *tpm2.TPMContext, updateKeyName tpm2.Name, hmacSession tpm2.SessionContext) (public *tpm2.NVPublic, handle tpm2.Handle, err error) {
+	handle = tpm2.HandleNull
+	for i := 0; i < pcrPolicyCounterAllocationAttempts; i++ {
+		handle, err = findFreePcrPolicyCounterHandle(tpm, hmacSession)
+		if err != nil {
+			return nil, tpm2.HandleNull, xerrors.Errorf("cannot select handle: %w", err)
+		}
+
+		public, err = createPcrPolicyCounter(tpm, handle, updateKeyName, hmacSession)
+		if tpm2.IsTPMError(err, tpm2.ErrorNVDefined, tpm2.CommandNVDefineSpace) {
+			// Another NV consumer defined an index at this handle in the meantime.
+			continue
+		}
+		return public, handle, err
+	}
+
+	return nil, handle, err
+}
+
 // ensureSufficientORDigests turns a single digest in to a pair of identical digests. This is because TPM2_PolicyOR assertions
 // require more than one digest. This avoids having a separate policy sequence when there is only a single digest, without having
 // to store duplicate digests on disk.
@@ -433,9 +750,18 @@ func computePcrPolicyRefFromCounterContext(context tpm2.ResourceContext) tpm2.No
 // static policy asserts that the following are true:
 // - The signed PCR policy created by computeDynamicPolicy is valid and has been satisfied (by way of a PolicyAuthorize assertion,
 //   which allows the PCR policy to be updated without creating a new sealed key object).
+// - The sealed key object hasn't expired, if it was created with a limited lifetime. This is done with PolicyCounterTimer
+//   assertions against the TPM's clock or reset count.
+// - The sealed key object is being used from a permitted locality and for a permitted command, if it was created with these
+//   restrictions. This is done with PolicyLocality and PolicyCommandCode assertions.
+// - Access to the sealed key object hasn't been locked, if it was created with a lock index. This is done with a PolicyNV
+//   assertion that fails once the lock index has been read-locked.
+// - The boot chain that the sealed key object was created for hasn't been superseded, if it was created with a rollback
+//   counter. This is done with a PolicyNV assertion that the counter is not greater than the recorded version.
 // - Knowledge of the the authorization value for the entity on which the policy session is used has been demonstrated by the
 //   caller (in SealedKeyObject.UnsealFromTPM where the policy session is used for authorizing unsealing the sealed key object,
-//   this means that the PIN / passhphrase has been provided).
+//   this means that the PIN / passhphrase has been provided). If a PIN index is supplied, knowledge of the authorization value
+//   for the PIN index is asserted instead, so that incorrect PIN attempts are counted and limited by the PIN index.
 func computeStaticPolicy(alg tpm2.HashAlgorithmId, input *staticPolicyComputeParams) (*staticPolicyData, tpm2.Digest, error) {
 	keyName, err := input.key.Name()
 	if err != nil {
@@ -454,11 +780,61 @@ func computeStaticPolicy(alg tpm2.HashAlgorithmId, input *staticPolicyComputePar
 
 	trial, _ := tpm2.ComputeAuthPolicy(alg)
 	trial.PolicyAuthorize(computePcrPolicyRefFromCounterName(pcrPolicyCounterName), keyName)
+
+	for _, a := range input.counterTimerAssertions {
+		trial.PolicyCounterTimer(a.OperandB, a.Offset, a.Operation)
+	}
+	if input.locality != 0 {
+		trial.PolicyLocality(input.locality)
+	}
+	if input.commandCode != 0 {
+		trial.PolicyCommandCode(input.commandCode)
+	}
+
+	lockIndexHandle := tpm2.HandleNull
+	if input.lockIndexPub != nil {
+		lockIndexHandle = input.lockIndexPub.Index
+		lockIndexName, err := input.lockIndexPub.Name()
+		if err != nil {
+			return nil, nil, xerrors.Errorf("cannot compute name of lock index: %w", err)
+		}
+		trial.PolicyNV(lockIndexName, nil, 0, tpm2.OpEq)
+	}
+
+	rollbackCounterHandle := tpm2.HandleNull
+	if input.rollbackCounterPub != nil {
+		rollbackCounterHandle = input.rollbackCounterPub.Index
+		rollbackCounterName, err := input.rollbackCounterPub.Name()
+		if err != nil {
+			return nil, nil, xerrors.Errorf("cannot compute name of rollback counter: %w", err)
+		}
+		trial.PolicyNV(rollbackCounterName, rollbackVersionOperand(input.rollbackVersion), 0, tpm2.OpUnsignedLE)
+	}
+
+	pinIndexHandle := tpm2.HandleNull
+	if input.pinIndexPub != nil {
+		pinIndexHandle = input.pinIndexPub.Index
+		pinIndexName, err := input.pinIndexPub.Name()
+		if err != nil {
+			return nil, nil, xerrors.Errorf("cannot compute name of PIN index: %w", err)
+		}
+		trial.PolicySecret(pinIndexName, nil)
+	}
+	// The PIN is always the authorization value of the sealed key object, even if there is a PIN index. The PIN
+	// index can be undefined and redefined with a known authorization value by anyone with knowledge of the storage
+	// hierarchy authorization value, so it only enforces the attempt limit and isn't sufficient to protect the key.
 	trial.PolicyAuthValue()
 
 	return &staticPolicyData{
 		authPublicKey:          input.key,
-		pcrPolicyCounterHandle: pcrPolicyCounterHandle}, trial.GetDigest(), nil
+		pcrPolicyCounterHandle: pcrPolicyCounterHandle,
+		pinIndexHandle:         pinIndexHandle,
+		counterTimerAssertions: input.counterTimerAssertions,
+		locality:               input.locality,
+		commandCode:            input.commandCode,
+		lockIndexHandle:        lockIndexHandle,
+		rollbackCounterHandle:  rollbackCounterHandle,
+		rollbackVersion:        input.rollbackVersion}, trial.GetDigest(), nil
 }
 
 // computePolicyORData computes data required to perform a sequence of TPM2_PolicyOR assertions in order to support compound
@@ -561,33 +937,9 @@ func computeDynamicPolicy(version uint32, alg tpm2.HashAlgorithmId, input *dynam
 	}
 
 	// Sign the digest
-	var signature tpm2.Signature
-	if version == 0 {
-		sig, err := rsa.SignPSS(rand.Reader, input.key.(*rsa.PrivateKey), input.signAlg.GetHash(), h.Sum(nil),
-			&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
-		if err != nil {
-			return nil, xerrors.Errorf("cannot provide signature for initializing NV index: %w", err)
-		}
-
-		signature = tpm2.Signature{
-			SigAlg: tpm2.SigSchemeAlgRSAPSS,
-			Signature: &tpm2.SignatureU{
-				RSAPSS: &tpm2.SignatureRSAPSS{
-					Hash: input.signAlg,
-					Sig:  tpm2.PublicKeyRSA(sig)}}}
-	} else {
-		sigR, sigS, err := ecdsa.Sign(rand.Reader, input.key.(*ecdsa.PrivateKey), h.Sum(nil))
-		if err != nil {
-			return nil, xerrors.Errorf("cannot provide signature for initializing NV index: %w", err)
-		}
-
-		signature = tpm2.Signature{
-			SigAlg: tpm2.SigSchemeAlgECDSA,
-			Signature: &tpm2.SignatureU{
-				ECDSA: &tpm2.SignatureECDSA{
-					Hash:       input.signAlg,
-					SignatureR: sigR.Bytes(),
-					SignatureS: sigS.Bytes()}}}
+	signature, err := signWithKey(input.key, input.signAlg, h.Sum(nil))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot provide signature for initializing NV index: %w", err)
 	}
 
 	return &dynamicPolicyData{
@@ -595,7 +947,7 @@ func computeDynamicPolicy(version uint32, alg tpm2.HashAlgorithmId, input *dynam
 		pcrOrData:                 pcrOrData,
 		policyCount:               input.policyCount,
 		authorizedPolicy:          authorizedPolicy,
-		authorizedPolicySignature: &signature}, nil
+		authorizedPolicySignature: signature}, nil
 }
 
 type staticPolicyDataError struct {
@@ -632,6 +984,10 @@ func isDynamicPolicyDataError(err error) bool {
 	return xerrors.As(err, &e)
 }
 
+// errSessionDigestNotFound is returned from executePolicyORAssertions if the current session digest doesn't match
+// any of the leaf digests, which normally means that the PCR values don't match the policy.
+var errSessionDigestNotFound = errors.New("current session digest not found in policy data")
+
 // executePolicyORAssertions takes the data produced by computePolicyORData and executes a sequence of TPM2_PolicyOR assertions, in
 // order to support compound policies with more than 8 conditions.
 func executePolicyORAssertions(tpm *tpm2.TPMContext, session tpm2.SessionContext, data policyOrDataTree) error {
@@ -660,7 +1016,7 @@ func executePolicyORAssertions(tpm *tpm2.TPMContext, session tpm2.SessionContext
 		}
 	}
 	if index == -1 {
-		return errors.New("current session digest not found in policy data")
+		return errSessionDigestNotFound
 	}
 
 	// Execute a TPM2_PolicyOR assertion on the digests in the leaf node and then traverse up the tree to the root node, executing
@@ -682,24 +1038,36 @@ func executePolicyORAssertions(tpm *tpm2.TPMContext, session tpm2.SessionContext
 // session can be used for authorization.
 func executePolicySession(tpm *tpm2.TPMContext, policySession tpm2.SessionContext, version uint32, staticInput *staticPolicyData,
 	dynamicInput *dynamicPolicyData, pin string, hmacSession tpm2.SessionContext) error {
+	policyCounter, err := executePolicySessionExceptPIN(tpm, policySession, version, staticInput, dynamicInput)
+	if err != nil {
+		return err
+	}
+	return executePolicySessionPIN(tpm, policySession, version, staticInput, policyCounter, pin, hmacSession)
+}
+
+// executePolicySessionExceptPIN executes every assertion in an authorization policy session that comes before the assertion
+// for the PIN, using the supplied metadata. These are the assertions that can be checked without knowing the PIN. It returns
+// the context for the PCR policy counter if there is one, which is required by executePolicySessionPIN for v0 metadata.
+func executePolicySessionExceptPIN(tpm *tpm2.TPMContext, policySession tpm2.SessionContext, version uint32, staticInput *staticPolicyData,
+	dynamicInput *dynamicPolicyData) (tpm2.ResourceContext, error) {
 	if err := tpm.PolicyPCR(policySession, nil, dynamicInput.pcrSelection); err != nil {
-		return xerrors.Errorf("cannot execute PCR assertion: %w", err)
+		return nil, xerrors.Errorf("cannot execute PCR assertion: %w", err)
 	}
 
 	if err := executePolicyORAssertions(tpm, policySession, dynamicInput.pcrOrData); err != nil {
 		switch {
 		case tpm2.IsTPMError(err, tpm2.AnyErrorCode, tpm2.CommandPolicyGetDigest):
-			return xerrors.Errorf("cannot execute OR assertions: %w", err)
+			return nil, xerrors.Errorf("cannot execute OR assertions: %w", err)
 		case tpm2.IsTPMParameterError(err, tpm2.ErrorValue, tpm2.CommandPolicyOR, 1):
 			// The dynamic authorization policy data is invalid.
-			return dynamicPolicyDataError{errors.New("cannot complete OR assertions: invalid data")}
+			return nil, dynamicPolicyDataError{errors.New("cannot complete OR assertions: invalid data")}
 		}
-		return dynamicPolicyDataError{xerrors.Errorf("cannot complete OR assertions: %w", err)}
+		return nil, dynamicPolicyDataError{xerrors.Errorf("cannot complete OR assertions: %w", err)}
 	}
 
 	pcrPolicyCounterHandle := staticInput.pcrPolicyCounterHandle
 	if (pcrPolicyCounterHandle != tpm2.HandleNull || version == 0) && pcrPolicyCounterHandle.Type() != tpm2.HandleTypeNVIndex {
-		return staticPolicyDataError{errors.New("invalid handle for PCR policy counter")}
+		return nil, staticPolicyDataError{errors.New("invalid handle for PCR policy counter")}
 	}
 
 	var policyCounter tpm2.ResourceContext
@@ -709,25 +1077,25 @@ func executePolicySession(tpm *tpm2.TPMContext, policySession tpm2.SessionContex
 		switch {
 		case tpm2.IsResourceUnavailableError(err, pcrPolicyCounterHandle):
 			// If there is no NV index at the expected handle then the key file is invalid and must be recreated.
-			return staticPolicyDataError{errors.New("no PCR policy counter found")}
+			return nil, staticPolicyDataError{errors.New("no PCR policy counter found")}
 		case err != nil:
-			return xerrors.Errorf("cannot obtain context for PCR policy counter: %w", err)
+			return nil, xerrors.Errorf("cannot obtain context for PCR policy counter: %w", err)
 		}
 
 		var revocationCheckSession tpm2.SessionContext
 		if version == 0 {
 			policyCounterPub, _, err := tpm.NVReadPublic(policyCounter)
 			if err != nil {
-				return xerrors.Errorf("cannot read public area for PCR policy counter: %w", err)
+				return nil, xerrors.Errorf("cannot read public area for PCR policy counter: %w", err)
 			}
 			if !policyCounterPub.NameAlg.Supported() {
 				//If the NV index has an unsupported name algorithm, then this key file is invalid and must be recreated.
-				return staticPolicyDataError{errors.New("PCR policy counter has an unsupported name algorithm")}
+				return nil, staticPolicyDataError{errors.New("PCR policy counter has an unsupported name algorithm")}
 			}
 
 			revocationCheckSession, err = tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, policyCounterPub.NameAlg)
 			if err != nil {
-				return xerrors.Errorf("cannot create session for PCR policy revocation check: %w", err)
+				return nil, xerrors.Errorf("cannot create session for PCR policy revocation check: %w", err)
 			}
 			defer tpm.FlushContext(revocationCheckSession)
 
@@ -735,14 +1103,14 @@ func executePolicySession(tpm *tpm2.TPMContext, policySession tpm2.SessionContex
 			// for the v0 NV index. Because the v0 NV index was also used for the PIN, it needed an authorization policy to
 			// permit using the counter value in an assertion without knowing the authorization value of the index.
 			if err := tpm.PolicyCommandCode(revocationCheckSession, tpm2.CommandPolicyNV); err != nil {
-				return xerrors.Errorf("cannot execute assertion for PCR policy revocation check: %w", err)
+				return nil, xerrors.Errorf("cannot execute assertion for PCR policy revocation check: %w", err)
 			}
 			if err := tpm.PolicyOR(revocationCheckSession, staticInput.v0PinIndexAuthPolicies); err != nil {
 				if tpm2.IsTPMParameterError(err, tpm2.ErrorValue, tpm2.CommandPolicyOR, 1) {
 					// staticInput.v0PinIndexAuthPolicies is invalid.
-					return staticPolicyDataError{errors.New("authorization policy metadata for PCR policy counter is invalid")}
+					return nil, staticPolicyDataError{errors.New("authorization policy metadata for PCR policy counter is invalid")}
 				}
-				return xerrors.Errorf("cannot execute assertion for PCR policy revocation check: %w", err)
+				return nil, xerrors.Errorf("cannot execute assertion for PCR policy revocation check: %w", err)
 			}
 		}
 
@@ -752,26 +1120,26 @@ func executePolicySession(tpm *tpm2.TPMContext, policySession tpm2.SessionContex
 			switch {
 			case tpm2.IsTPMError(err, tpm2.ErrorPolicy, tpm2.CommandPolicyNV):
 				// The PCR policy has been revoked.
-				return dynamicPolicyDataError{errors.New("the PCR policy has been revoked")}
+				return nil, dynamicPolicyDataError{ErrPCRPolicyRevoked}
 			case tpm2.IsTPMSessionError(err, tpm2.ErrorPolicyFail, tpm2.CommandPolicyNV, 1):
 				// Either staticInput.v0PinIndexAuthPolicies is invalid or the NV index isn't what's expected, so the key file is invalid.
-				return staticPolicyDataError{errors.New("invalid PCR policy counter or associated authorization policy metadata")}
+				return nil, staticPolicyDataError{errors.New("invalid PCR policy counter or associated authorization policy metadata")}
 			}
-			return xerrors.Errorf("PCR policy revocation check failed: %w", err)
+			return nil, xerrors.Errorf("PCR policy revocation check failed: %w", err)
 		}
 	}
 
 	authPublicKey := staticInput.authPublicKey
 	if !authPublicKey.NameAlg.Supported() {
-		return staticPolicyDataError{errors.New("public area of dynamic authorization policy signing key has an unsupported name algorithm")}
+		return nil, staticPolicyDataError{errors.New("public area of dynamic authorization policy signing key has an unsupported name algorithm")}
 	}
 	authorizeKey, err := tpm.LoadExternal(nil, authPublicKey, tpm2.HandleOwner)
 	if err != nil {
 		if tpm2.IsTPMParameterError(err, tpm2.AnyErrorCode, tpm2.CommandLoadExternal, 2) {
 			// staticInput.AuthPublicKey is invalid
-			return staticPolicyDataError{errors.New("public area of dynamic authorization policy signing key is invalid")}
+			return nil, staticPolicyDataError{errors.New("public area of dynamic authorization policy signing key is invalid")}
 		}
-		return xerrors.Errorf("cannot load public area for dynamic authorization policy signing key: %w", err)
+		return nil, xerrors.Errorf("cannot load public area for dynamic authorization policy signing key: %w", err)
 	}
 	defer tpm.FlushContext(authorizeKey)
 
@@ -793,19 +1161,91 @@ func executePolicySession(tpm *tpm2.TPMContext, policySession tpm2.SessionContex
 			// dynamicInput.AuthorizedPolicySignature or the computed policy ref is invalid.
 			// XXX: It's not possible to determine whether this is broken dynamic or static metadata -
 			//  we should just do away with the distinction here tbh
-			return dynamicPolicyDataError{errors.New("cannot verify PCR policy signature")}
+			return nil, dynamicPolicyDataError{errors.New("cannot verify PCR policy signature")}
 		}
-		return xerrors.Errorf("cannot verify PCR policy signature: %w", err)
+		return nil, xerrors.Errorf("cannot verify PCR policy signature: %w", err)
 	}
 
 	if err := tpm.PolicyAuthorize(policySession, dynamicInput.authorizedPolicy, pcrPolicyRef, authorizeKey.Name(), authorizeTicket); err != nil {
 		if tpm2.IsTPMParameterError(err, tpm2.ErrorValue, tpm2.CommandPolicyAuthorize, 1) {
 			// dynamicInput.AuthorizedPolicy is invalid.
-			return dynamicPolicyDataError{errors.New("the PCR policy is invalid")}
+			return nil, dynamicPolicyDataError{errors.New("the PCR policy is invalid")}
+		}
+		return nil, xerrors.Errorf("PCR policy check failed: %w", err)
+	}
+
+	for _, a := range staticInput.counterTimerAssertions {
+		if err := tpm.PolicyCounterTimer(policySession, a.OperandB, a.Offset, a.Operation); err != nil {
+			if tpm2.IsTPMError(err, tpm2.ErrorPolicy, tpm2.CommandPolicyCounterTimer) {
+				return nil, ErrKeyExpired
+			}
+			return nil, xerrors.Errorf("cannot execute PolicyCounterTimer assertion: %w", err)
+		}
+	}
+
+	if staticInput.locality != 0 {
+		if err := tpm.PolicyLocality(policySession, staticInput.locality); err != nil {
+			if tpm2.IsTPMParameterError(err, tpm2.AnyErrorCode, tpm2.CommandPolicyLocality, 1) {
+				return nil, staticPolicyDataError{errors.New("invalid locality")}
+			}
+			return nil, xerrors.Errorf("cannot execute PolicyLocality assertion: %w", err)
+		}
+	}
+	if staticInput.commandCode != 0 {
+		if err := tpm.PolicyCommandCode(policySession, staticInput.commandCode); err != nil {
+			if tpm2.IsTPMParameterError(err, tpm2.AnyErrorCode, tpm2.CommandPolicyCommandCode, 1) {
+				return nil, staticPolicyDataError{errors.New("invalid command code")}
+			}
+			return nil, xerrors.Errorf("cannot execute PolicyCommandCode assertion: %w", err)
 		}
-		return xerrors.Errorf("PCR policy check failed: %w", err)
 	}
 
+	if lockIndexHandle := staticInput.lockIndexHandle; lockIndexHandle != tpm2.HandleNull {
+		if lockIndexHandle.Type() != tpm2.HandleTypeNVIndex {
+			return nil, staticPolicyDataError{errors.New("invalid handle for lock index")}
+		}
+		index, err := tpm.CreateResourceContextFromTPM(lockIndexHandle)
+		switch {
+		case tpm2.IsResourceUnavailableError(err, lockIndexHandle):
+			return nil, staticPolicyDataError{errors.New("no lock index found")}
+		case err != nil:
+			return nil, xerrors.Errorf("cannot obtain context for lock index: %w", err)
+		}
+		if err := tpm.PolicyNV(index, index, policySession, nil, 0, tpm2.OpEq, nil); err != nil {
+			if tpm2.IsTPMError(err, tpm2.ErrorNVLocked, tpm2.CommandPolicyNV) {
+				return nil, ErrSealedKeyAccessLocked
+			}
+			return nil, xerrors.Errorf("lock index check failed: %w", err)
+		}
+	}
+
+	if rollbackCounterHandle := staticInput.rollbackCounterHandle; rollbackCounterHandle != tpm2.HandleNull {
+		if rollbackCounterHandle.Type() != tpm2.HandleTypeNVIndex {
+			return nil, staticPolicyDataError{errors.New("invalid handle for rollback counter")}
+		}
+		index, err := tpm.CreateResourceContextFromTPM(rollbackCounterHandle)
+		switch {
+		case tpm2.IsResourceUnavailableError(err, rollbackCounterHandle):
+			return nil, staticPolicyDataError{errors.New("no rollback counter found")}
+		case err != nil:
+			return nil, xerrors.Errorf("cannot obtain context for rollback counter: %w", err)
+		}
+		operandB := rollbackVersionOperand(staticInput.rollbackVersion)
+		if err := tpm.PolicyNV(index, index, policySession, operandB, 0, tpm2.OpUnsignedLE, nil); err != nil {
+			if tpm2.IsTPMError(err, tpm2.ErrorPolicy, tpm2.CommandPolicyNV) {
+				return nil, ErrKeyVersionRevoked
+			}
+			return nil, xerrors.Errorf("rollback counter check failed: %w", err)
+		}
+	}
+
+	return policyCounter, nil
+}
+
+// executePolicySessionPIN executes the assertion for the PIN in an authorization policy session, and any assertions that
+// follow it, using the supplied metadata. It must be called after executePolicySessionExceptPIN.
+func executePolicySessionPIN(tpm *tpm2.TPMContext, policySession tpm2.SessionContext, version uint32, staticInput *staticPolicyData,
+	policyCounter tpm2.ResourceContext, pin string, hmacSession tpm2.SessionContext) error {
 	if version == 0 {
 		// For metadata version 0, PIN support is implemented by asserting knowlege of the authorization value
 		// for the PCR policy counter.
@@ -813,9 +1253,28 @@ func executePolicySession(tpm *tpm2.TPMContext, policySession tpm2.SessionContex
 		if _, _, err := tpm.PolicySecret(policyCounter, policySession, nil, nil, 0, hmacSession); err != nil {
 			return xerrors.Errorf("cannot execute PolicySecret assertion: %w", err)
 		}
-	} else {
+	} else if pinIndexHandle := staticInput.pinIndexHandle; pinIndexHandle != tpm2.HandleNull {
+		// If there is a PIN index, PIN support is implemented by asserting knowledge of the authorization value
+		// for the PIN index, which counts incorrect attempts.
+		if pinIndexHandle.Type() != tpm2.HandleTypeNVIndex {
+			return staticPolicyDataError{errors.New("invalid handle for PIN index")}
+		}
+		pinIndex, err := tpm.CreateResourceContextFromTPM(pinIndexHandle)
+		switch {
+		case tpm2.IsResourceUnavailableError(err, pinIndexHandle):
+			return staticPolicyDataError{errors.New("no PIN index found")}
+		case err != nil:
+			return xerrors.Errorf("cannot obtain context for PIN index: %w", err)
+		}
+		pinIndex.SetAuthValue([]byte(pin))
+		if _, _, err := tpm.PolicySecret(pinIndex, policySession, nil, nil, 0, hmacSession); err != nil {
+			return xerrors.Errorf("cannot execute PolicySecret assertion: %w", err)
+		}
+	}
+	if version > 0 {
 		// For metadata versions > 0, PIN support is implemented by requiring knowlege of the authorization value for
-		// the sealed key object when this policy session is used to unseal it.
+		// the sealed key object when this policy session is used to unseal it. This is also required if there is a
+		// PIN index, as the PIN index alone doesn't protect the key.
 		if err := tpm.PolicyAuthValue(policySession); err != nil {
 			return xerrors.Errorf("cannot execute PolicyAuthValue assertion: %w", err)
 		}
@@ -0,0 +1,291 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	authorizedPolicyUpdateHeader  uint32 = 0x55534b55
+	authorizedPolicyUpdateVersion uint32 = 0
+)
+
+// authorizedPolicyUpdateRaw is the serialized form of an authorized PCR policy update.
+type authorizedPolicyUpdateRaw struct {
+	Version           uint32
+	NameAlg           tpm2.HashAlgorithmId
+	DynamicPolicyData *dynamicPolicyDataRaw_v0
+}
+
+// CreateAuthorizedPolicyUpdate computes a PCR policy from the supplied profile and signs it with the supplied signer,
+// returning a serialized update that can be applied to sealed key objects with ApplyAuthorizedPolicyUpdate. It is
+// intended to be run offline, for example by a vendor tool after a firmware update, so the update can be distributed
+// to devices that don't need to compute the PCR profile themselves.
+//
+// The update is only valid for sealed key objects that were created with a KeyCreationParams.AuthorizedPolicySigner
+// that has the same public key as signer, and with a PCR policy counter at the handle specified by
+// pcrPolicyCounterHandle (which may be NoPCRPolicyCounterHandle).
+//
+// The PCR policy is only valid whilst the value of the PCR policy counter on a device is not greater than policyCount.
+// As the value of the counter on each device isn't known, policyCount should be chosen so that it is not less than the
+// value of the counter on any device that the update is intended for. Applying an update does not revoke older PCR
+// policies.
+//
+// The update is not bound to a specific device or sealed key object - it is accepted by any sealed key object with the
+// same signer and PCR policy counter handle. If the sealed key objects were created with AutoPCRPolicyCounterHandle,
+// the handle is allocated on each device, so the handle to use for a device must be obtained from
+// SealedKeyObject.PCRPolicyCounterHandle. When there is a PCR policy counter, policyCount is included in the signed
+// policy and an update will not be applied if its policy count is older than that of the sealed key object's current
+// PCR policy. If pcrPolicyCounterHandle is NoPCRPolicyCounterHandle, there is no protection against an older update
+// being applied again.
+//
+// The profile must not contain values that are read from a TPM.
+func CreateAuthorizedPolicyUpdate(signer crypto.Signer, pcrPolicyCounterHandle tpm2.Handle, policyCount uint64, pcrProfile *PCRProtectionProfile) ([]byte, error) {
+	if signer == nil {
+		return nil, errors.New("no signer provided")
+	}
+	if pcrPolicyCounterHandle != tpm2.HandleNull && pcrPolicyCounterHandle.Type() != tpm2.HandleTypeNVIndex {
+		return nil, errors.New("invalid PCR policy counter handle")
+	}
+	if pcrProfile == nil {
+		pcrProfile = &PCRProtectionProfile{}
+	}
+
+	authPublicKey, err := createTPMPublicAreaForPublicKey(signer.Public())
+	if err != nil {
+		return nil, xerrors.Errorf("unsupported signer: %w", err)
+	}
+
+	counterName, err := computePcrPolicyCounterName(pcrPolicyCounterHandle, authPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// The sealed key objects created by this package always use SHA-256 for their name algorithm.
+	nameAlg := tpm2.HashAlgorithmSHA256
+
+	pcrs, pcrDigests, err := pcrProfile.ComputePCRDigests(nil, nameAlg)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute PCR digests from protection profile: %w", err)
+	}
+
+	policyData, err := computeDynamicPolicy(currentMetadataVersion, nameAlg, &dynamicPolicyComputeParams{
+		key:               signer,
+		signAlg:           authPublicKey.NameAlg,
+		pcrs:              pcrs,
+		pcrDigests:        pcrDigests,
+		policyCounterName: counterName,
+		policyCount:       policyCount})
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute dynamic authorization policy: %w", err)
+	}
+
+	b, err := mu.MarshalToBytes(authorizedPolicyUpdateHeader, &authorizedPolicyUpdateRaw{
+		Version:           authorizedPolicyUpdateVersion,
+		NameAlg:           nameAlg,
+		DynamicPolicyData: makeDynamicPolicyDataRaw_v0(policyData)})
+	if err != nil {
+		return nil, xerrors.Errorf("cannot serialize update: %w", err)
+	}
+	return b, nil
+}
+
+// computePcrPolicyCounterName computes the name of the initialized PCR policy counter at the supplied handle for a
+// sealed key object with the supplied dynamic authorization policy key. This doesn't work for version 0 sealed key
+// objects. If handle is tpm2.HandleNull, an empty name is returned.
+func computePcrPolicyCounterName(handle tpm2.Handle, authPublicKey *tpm2.Public) (tpm2.Name, error) {
+	if handle == tpm2.HandleNull {
+		return nil, nil
+	}
+
+	authKeyName, err := authPublicKey.Name()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute name of dynamic authorization policy key: %w", err)
+	}
+
+	public, _ := computePcrPolicyCounterPublic(handle, authKeyName)
+	public.Attrs |= tpm2.AttrNVWritten
+
+	name, err := public.Name()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute name of PCR policy counter: %w", err)
+	}
+	return name, nil
+}
+
+// decodeAuthorizedPolicyUpdate deserializes an update created by CreateAuthorizedPolicyUpdate.
+func decodeAuthorizedPolicyUpdate(data []byte) (*authorizedPolicyUpdateRaw, error) {
+	var header uint32
+	var raw authorizedPolicyUpdateRaw
+	if _, err := mu.UnmarshalFromBytes(data, &header, &raw); err != nil {
+		return nil, xerrors.Errorf("cannot unmarshal update: %w", err)
+	}
+	if header != authorizedPolicyUpdateHeader {
+		return nil, fmt.Errorf("unexpected header (%d)", header)
+	}
+	if raw.Version != authorizedPolicyUpdateVersion {
+		return nil, fmt.Errorf("unexpected version (%d)", raw.Version)
+	}
+	if raw.DynamicPolicyData == nil {
+		return nil, errors.New("no policy data")
+	}
+	return &raw, nil
+}
+
+// ApplyAuthorizedPolicyUpdate replaces the PCR policy of the sealed key object at the specified path with the one
+// contained in the supplied update, which must have been created by CreateAuthorizedPolicyUpdate with a signer
+// that has the same public key as the KeyCreationParams.AuthorizedPolicySigner used to create the sealed key
+// object. This doesn't require access to the TPM. Use SealedKeyObject.ApplyAuthorizedPolicyUpdate for sealed key
+// objects that are stored in a NV index.
+//
+// The signature of the update is verified before the sealed key data file is modified. If the sealed key data file
+// is invalid or the update isn't valid for it, a InvalidKeyFileError error will be returned. An error will also be
+// returned if the update is malformed or its signature is invalid.
+//
+// If the sealed key object has a PCR policy counter, an update with a policy count that is older than that of the
+// current PCR policy is rejected. Sealed key objects without a PCR policy counter have no protection against an
+// older update being applied again.
+//
+// On success, the sealed key data file is updated atomically. Note that this can't check whether the PCR policy
+// contained in the update has already been revoked on this device, in which case the key will fail to unseal.
+func ApplyAuthorizedPolicyUpdate(keyFile string, updateBlob []byte) error {
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		return err
+	}
+
+	policyData, err := k.verifyAuthorizedPolicyUpdate(updateBlob)
+	if err != nil {
+		return err
+	}
+
+	k.data.dynamicPolicyData = policyData
+	if err := k.writeToFile(); err != nil {
+		return xerrors.Errorf("cannot write key data file: %w", err)
+	}
+
+	return nil
+}
+
+// ApplyAuthorizedPolicyUpdate replaces the PCR policy of this sealed key object with the one contained in the
+// supplied update, in the same way as the ApplyAuthorizedPolicyUpdate function, and then writes the sealed key
+// object back to the key data file or NV index that it was loaded from.
+//
+// If the sealed key object is stored in a NV index, this function requires knowledge of the authorization value
+// for the storage hierarchy, which must be provided by calling Connection.OwnerHandleContext().SetAuthValue()
+// prior to calling this function. If the provided authorization value is incorrect, a AuthFailError error will be
+// returned.
+func (k *SealedKeyObject) ApplyAuthorizedPolicyUpdate(tpm *Connection, updateBlob []byte) error {
+	policyData, err := k.verifyAuthorizedPolicyUpdate(updateBlob)
+	if err != nil {
+		return err
+	}
+
+	orig := k.data.dynamicPolicyData
+	k.data.dynamicPolicyData = policyData
+	if err := k.write(tpm.TPMContext, tpm.HmacSession()); err != nil {
+		k.data.dynamicPolicyData = orig
+		return xerrors.Errorf("cannot write key data: %w", err)
+	}
+
+	return nil
+}
+
+// verifyAuthorizedPolicyUpdate decodes the supplied update and verifies that it is valid for this sealed key object,
+// returning the PCR policy data that it contains.
+func (k *SealedKeyObject) verifyAuthorizedPolicyUpdate(updateBlob []byte) (*dynamicPolicyData, error) {
+	data := k.data
+
+	if data.version == 0 {
+		return nil, InvalidKeyFileError{msg: "unsupported metadata version"}
+	}
+
+	update, err := decodeAuthorizedPolicyUpdate(updateBlob)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot decode update: %w", err)
+	}
+	policyData := update.DynamicPolicyData.data()
+
+	if update.NameAlg != data.keyPublic.NameAlg {
+		return nil, InvalidKeyFileError{msg: "update has the wrong digest algorithm"}
+	}
+
+	authPublicKey := data.staticPolicyData.authPublicKey
+	counterName, err := computePcrPolicyCounterName(data.staticPolicyData.pcrPolicyCounterHandle, authPublicKey)
+	if err != nil {
+		return nil, InvalidKeyFileError{msg: err.Error()}
+	}
+
+	// Make sure that the authorized policy digest is consistent with the rest of the policy data
+	if len(policyData.pcrOrData) == 0 {
+		return nil, errors.New("invalid update: no PCR policy")
+	}
+	if err := checkPCRSelectionBanks(policyData.pcrSelection, data.requiredPCRBanks); err != nil {
+		return nil, xerrors.Errorf("invalid update: %w", err)
+	}
+	trial, _ := tpm2.ComputeAuthPolicy(update.NameAlg)
+	trial.PolicyOR(ensureSufficientORDigests(policyData.pcrOrData[len(policyData.pcrOrData)-1].Digests))
+	if len(counterName) > 0 {
+		operandB := make([]byte, 8)
+		binary.BigEndian.PutUint64(operandB, policyData.policyCount)
+		trial.PolicyNV(counterName, operandB, 0, tpm2.OpUnsignedLE)
+	}
+	if !bytes.Equal(trial.GetDigest(), policyData.authorizedPolicy) {
+		return nil, InvalidKeyFileError{msg: "update is not valid for this key"}
+	}
+
+	// Verify the signature of the authorized policy digest in the same way that the TPM does when executing the
+	// TPM2_PolicyAuthorize assertion.
+	if policyData.authorizedPolicySignature == nil {
+		return nil, errors.New("invalid update: no signature")
+	}
+	sigHashAlg, err := signatureHashAlg(policyData.authorizedPolicySignature)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid update: %w", err)
+	}
+	if sigHashAlg != authPublicKey.NameAlg {
+		return nil, errors.New("invalid update: unexpected signature digest algorithm")
+	}
+	signed := make([]byte, 0, len(policyData.authorizedPolicy)+sigHashAlg.Size())
+	signed = append(signed, policyData.authorizedPolicy...)
+	signed = append(signed, computePcrPolicyRefFromCounterName(counterName)...)
+	if err := verifySignature(authPublicKey, signed, policyData.authorizedPolicySignature); err != nil {
+		return nil, InvalidKeyFileError{msg: fmt.Sprintf("cannot verify update signature: %v", err)}
+	}
+
+	// The policy count is covered by the signature when there is a PCR policy counter, so reject updates that would
+	// downgrade the PCR policy to an older one.
+	if len(counterName) > 0 && policyData.policyCount < data.dynamicPolicyData.policyCount {
+		return nil, fmt.Errorf("invalid update: PCR policy count (%d) is older than the current one (%d)",
+			policyData.policyCount, data.dynamicPolicyData.policyCount)
+	}
+
+	return policyData, nil
+}
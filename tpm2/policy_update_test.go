@@ -0,0 +1,291 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+
+	"github.com/snapcore/secboot/internal/testutil"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+func TestApplyAuthorizedPolicyUpdate(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	_, values, err := tpm.PCRRead(tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}})
+	if err != nil {
+		t.Fatalf("PCRRead failed: %v", err)
+	}
+	goodProfile := NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, values[tpm2.HashAlgorithmSHA256][7])
+	badProfile := NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, make(tpm2.Digest, 32))
+
+	checkUnseal := func(t *testing.T, keyFile string) error {
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		unsealedKey, _, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(unsealedKey, key) {
+			t.Errorf("Unexpected key")
+		}
+		return nil
+	}
+
+	run := func(t *testing.T, signer crypto.Signer, pcrPolicyCounterHandle tpm2.Handle) {
+		tmpDir, err := ioutil.TempDir("", "_TestApplyAuthorizedPolicyUpdate_")
+		if err != nil {
+			t.Fatalf("Creating temporary directory failed: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		keyFile := filepath.Join(tmpDir, "keydata")
+
+		if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{
+			PCRProfile:             badProfile,
+			PCRPolicyCounterHandle: pcrPolicyCounterHandle,
+			AuthorizedPolicySigner: signer}); err != nil {
+			t.Fatalf("SealKeyToTPM failed: %v", err)
+		}
+		defer undefineKeyNVSpace(t, tpm, keyFile)
+
+		if err := checkUnseal(t, keyFile); err == nil {
+			t.Fatalf("UnsealFromTPM should have failed")
+		}
+
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+
+		update, err := CreateAuthorizedPolicyUpdate(signer, pcrPolicyCounterHandle, k.PCRPolicyCount(), goodProfile)
+		if err != nil {
+			t.Fatalf("CreateAuthorizedPolicyUpdate failed: %v", err)
+		}
+		if err := ApplyAuthorizedPolicyUpdate(keyFile, update); err != nil {
+			t.Fatalf("ApplyAuthorizedPolicyUpdate failed: %v", err)
+		}
+
+		if err := checkUnseal(t, keyFile); err != nil {
+			t.Errorf("UnsealFromTPM failed: %v", err)
+		}
+	}
+
+	t.Run("ECDSAWithPCRPolicyCounter", func(t *testing.T) {
+		signer, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+		if err != nil {
+			t.Fatalf("GenerateKey failed: %v", err)
+		}
+		run(t, signer, 0x01810000)
+	})
+
+	t.Run("ECDSAWithoutPCRPolicyCounter", func(t *testing.T) {
+		signer, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+		if err != nil {
+			t.Fatalf("GenerateKey failed: %v", err)
+		}
+		run(t, signer, tpm2.HandleNull)
+	})
+
+	t.Run("RSAWithPCRPolicyCounter", func(t *testing.T) {
+		signer, err := rsa.GenerateKey(testutil.RandReader, 2048)
+		if err != nil {
+			t.Fatalf("GenerateKey failed: %v", err)
+		}
+		run(t, signer, 0x01810000)
+	})
+
+	t.Run("NVIndex", func(t *testing.T) {
+		signer, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+		if err != nil {
+			t.Fatalf("GenerateKey failed: %v", err)
+		}
+
+		if _, err := SealKeyToTPMMultiple(tpm, []*SealKeyRequest{{Key: key, NVIndexHandle: testKeyDataNVIndexHandle}}, &KeyCreationParams{
+			PCRProfile:             badProfile,
+			PCRPolicyCounterHandle: testKeyDataPCRPolicyHandle,
+			AuthorizedPolicySigner: signer}); err != nil {
+			t.Fatalf("SealKeyToTPMMultiple failed: %v", err)
+		}
+		defer undefineNVKeyIndex(t, tpm, testKeyDataPCRPolicyHandle)
+		defer undefineNVKeyIndex(t, tpm, testKeyDataNVIndexHandle)
+
+		k, err := ReadSealedKeyObjectFromNVIndex(tpm, testKeyDataNVIndexHandle)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObjectFromNVIndex failed: %v", err)
+		}
+
+		update, err := CreateAuthorizedPolicyUpdate(signer, testKeyDataPCRPolicyHandle, k.PCRPolicyCount(), goodProfile)
+		if err != nil {
+			t.Fatalf("CreateAuthorizedPolicyUpdate failed: %v", err)
+		}
+		if err := k.ApplyAuthorizedPolicyUpdate(tpm, update); err != nil {
+			t.Fatalf("ApplyAuthorizedPolicyUpdate failed: %v", err)
+		}
+
+		k, err = ReadSealedKeyObjectFromNVIndex(tpm, testKeyDataNVIndexHandle)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObjectFromNVIndex failed: %v", err)
+		}
+		unsealedKey, _, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			t.Fatalf("UnsealFromTPM failed: %v", err)
+		}
+		if !bytes.Equal(unsealedKey, key) {
+			t.Errorf("Unexpected key")
+		}
+	})
+
+	t.Run("WrongSigner", func(t *testing.T) {
+		signer, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+		if err != nil {
+			t.Fatalf("GenerateKey failed: %v", err)
+		}
+		otherSigner, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+		if err != nil {
+			t.Fatalf("GenerateKey failed: %v", err)
+		}
+
+		tmpDir, err := ioutil.TempDir("", "_TestApplyAuthorizedPolicyUpdate_")
+		if err != nil {
+			t.Fatalf("Creating temporary directory failed: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		keyFile := filepath.Join(tmpDir, "keydata")
+
+		if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{
+			PCRProfile:             goodProfile,
+			PCRPolicyCounterHandle: tpm2.HandleNull,
+			AuthorizedPolicySigner: signer}); err != nil {
+			t.Fatalf("SealKeyToTPM failed: %v", err)
+		}
+
+		update, err := CreateAuthorizedPolicyUpdate(otherSigner, tpm2.HandleNull, 0, badProfile)
+		if err != nil {
+			t.Fatalf("CreateAuthorizedPolicyUpdate failed: %v", err)
+		}
+		err = ApplyAuthorizedPolicyUpdate(keyFile, update)
+		if _, ok := err.(InvalidKeyFileError); !ok {
+			t.Errorf("Unexpected error: %v", err)
+		}
+
+		// The key data file should not have been modified
+		if err := checkUnseal(t, keyFile); err != nil {
+			t.Errorf("UnsealFromTPM failed: %v", err)
+		}
+	})
+
+	t.Run("Downgrade", func(t *testing.T) {
+		signer, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+		if err != nil {
+			t.Fatalf("GenerateKey failed: %v", err)
+		}
+
+		tmpDir, err := ioutil.TempDir("", "_TestApplyAuthorizedPolicyUpdate_")
+		if err != nil {
+			t.Fatalf("Creating temporary directory failed: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		keyFile := filepath.Join(tmpDir, "keydata")
+
+		if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{
+			PCRProfile:             badProfile,
+			PCRPolicyCounterHandle: 0x01810000,
+			AuthorizedPolicySigner: signer}); err != nil {
+			t.Fatalf("SealKeyToTPM failed: %v", err)
+		}
+		defer undefineKeyNVSpace(t, tpm, keyFile)
+
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		count := k.PCRPolicyCount()
+
+		oldUpdate, err := CreateAuthorizedPolicyUpdate(signer, 0x01810000, count, badProfile)
+		if err != nil {
+			t.Fatalf("CreateAuthorizedPolicyUpdate failed: %v", err)
+		}
+		newUpdate, err := CreateAuthorizedPolicyUpdate(signer, 0x01810000, count+1, goodProfile)
+		if err != nil {
+			t.Fatalf("CreateAuthorizedPolicyUpdate failed: %v", err)
+		}
+		if err := ApplyAuthorizedPolicyUpdate(keyFile, newUpdate); err != nil {
+			t.Fatalf("ApplyAuthorizedPolicyUpdate failed: %v", err)
+		}
+
+		if err := ApplyAuthorizedPolicyUpdate(keyFile, oldUpdate); err == nil {
+			t.Errorf("ApplyAuthorizedPolicyUpdate should have failed")
+		}
+
+		// The key data file should not have been modified
+		if err := checkUnseal(t, keyFile); err != nil {
+			t.Errorf("UnsealFromTPM failed: %v", err)
+		}
+	})
+
+	t.Run("InvalidUpdate", func(t *testing.T) {
+		tmpDir, err := ioutil.TempDir("", "_TestApplyAuthorizedPolicyUpdate_")
+		if err != nil {
+			t.Fatalf("Creating temporary directory failed: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		keyFile := filepath.Join(tmpDir, "keydata")
+
+		signer, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+		if err != nil {
+			t.Fatalf("GenerateKey failed: %v", err)
+		}
+		if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{
+			PCRProfile:             goodProfile,
+			PCRPolicyCounterHandle: tpm2.HandleNull,
+			AuthorizedPolicySigner: signer}); err != nil {
+			t.Fatalf("SealKeyToTPM failed: %v", err)
+		}
+
+		if err := ApplyAuthorizedPolicyUpdate(keyFile, []byte("foo")); err == nil {
+			t.Errorf("ApplyAuthorizedPolicyUpdate should have failed")
+		}
+	})
+}
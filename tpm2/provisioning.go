@@ -67,6 +67,13 @@ const (
 	// ProvisionModeClear specifies that the TPM should be fully provisioned after clearing it. This requires use of the lockout
 	// hierarchy.
 	ProvisionModeClear
+
+	// ProvisionModePreserveOwner specifies that only the objects required by secboot should be created, and that any existing
+	// objects and hierarchy configuration should be preserved. This is intended for systems where the storage hierarchy is
+	// shared with other software. In this mode, an existing storage root key is reused if it is compatible, the endorsement
+	// key is not reprovisioned, and the TPM is never cleared. No hierarchy authorization values or dictionary attack
+	// parameters are changed, and the lockout hierarchy is not used.
+	ProvisionModePreserveOwner
 )
 
 func provisionPrimaryKey(tpm *tpm2.TPMContext, hierarchy tpm2.ResourceContext, template *tpm2.Public, handle tpm2.Handle, session tpm2.SessionContext) (tpm2.ResourceContext, error) {
@@ -130,6 +137,68 @@ func provisionStoragePrimaryKey(tpm *tpm2.TPMContext, session tpm2.SessionContex
 	return provisionPrimaryKey(tpm, tpm.OwnerHandleContext(), selectSrkTemplate(tpm, session), tcg.SRKHandle, session)
 }
 
+// ensureStoragePrimaryKey returns the storage primary key at the standard handle if it was created with the supplied
+// template, or creates and persists a new one if there isn't an existing object at this handle. An existing object is
+// never evicted - if it doesn't match the supplied template, a TPMResourceExistsError error is returned.
+func ensureStoragePrimaryKey(tpm *tpm2.TPMContext, template *tpm2.Public, session tpm2.SessionContext) (tpm2.ResourceContext, error) {
+	srk, err := tpm.CreateResourceContextFromTPM(tcg.SRKHandle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, tcg.SRKHandle):
+		return provisionPrimaryKey(tpm, tpm.OwnerHandleContext(), template, tcg.SRKHandle, session)
+	case err != nil:
+		return nil, xerrors.Errorf("cannot create context for existing storage root key: %w", err)
+	}
+
+	ok, err := isObjectPrimaryKeyWithTemplate(tpm, tpm.OwnerHandleContext(), srk, template, session)
+	switch {
+	case err != nil:
+		return nil, xerrors.Errorf("cannot determine if existing object is a primary key in the storage hierarchy: %w", err)
+	case !ok:
+		return nil, TPMResourceExistsError{tcg.SRKHandle}
+	}
+
+	return srk, nil
+}
+
+// existingStorageKey returns a context for the existing persistent object at the specified handle, after checking that it
+// is a primary key in the storage hierarchy that is suitable for use as a parent. If template is supplied, the object must
+// also have been created with it. If there is no object at the specified handle, ErrTPMProvisioning is returned.
+func existingStorageKey(tpm *tpm2.TPMContext, handle tpm2.Handle, template *tpm2.Public, session tpm2.SessionContext) (tpm2.ResourceContext, error) {
+	if handle.Type() != tpm2.HandleTypePersistent {
+		return nil, errors.New("invalid handle")
+	}
+
+	key, err := tpm.CreateResourceContextFromTPM(handle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, handle):
+		return nil, ErrTPMProvisioning
+	case err != nil:
+		return nil, xerrors.Errorf("cannot create context for storage key: %w", err)
+	}
+
+	if template == nil {
+		// Use the object's own public area as the template, which only checks
+		// that it is a primary key.
+		template, _, _, err = tpm.ReadPublic(key, session.IncludeAttrs(tpm2.AttrAudit))
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read public area of storage key: %w", err)
+		}
+	}
+	if !template.IsParent() {
+		return nil, fmt.Errorf("object at 0x%08x is not a storage key", handle)
+	}
+
+	ok, err := isObjectPrimaryKeyWithTemplate(tpm, tpm.OwnerHandleContext(), key, template, session)
+	switch {
+	case err != nil:
+		return nil, xerrors.Errorf("cannot determine if object at 0x%08x is a primary key in the storage hierarchy: %w", handle, err)
+	case !ok:
+		return nil, fmt.Errorf("object at 0x%08x is not a primary key in the storage hierarchy with the expected template", handle)
+	}
+
+	return key, nil
+}
+
 func storeSrkTemplate(tpm *tpm2.TPMContext, template *tpm2.Public, session tpm2.SessionContext) error {
 	tmplB, err := mu.MarshalToBytes(template)
 	if err != nil {
@@ -175,7 +244,67 @@ func removeStoredSrkTemplate(tpm *tpm2.TPMContext, session tpm2.SessionContext)
 	return nil
 }
 
-func (t *Connection) ensureProvisionedInternal(mode ProvisionMode, newLockoutAuth []byte, srkTemplate *tpm2.Public, useExistingSrkTemplate bool) error {
+// ProvisionOptions contains optional parameters for EnsureProvisionedWithOptions.
+type ProvisionOptions struct {
+	// DAParameters, if not nil, are the parameters used to configure the TPM's
+	// dictionary attack protection logic instead of the ones returned from
+	// DefaultDictionaryAttackParameters. If mode is ProvisionModeWithoutLockout,
+	// the parameters aren't changed, but a ErrTPMProvisioningRequiresLockout error
+	// will be returned if the current parameters are less strict than these ones.
+	DAParameters *DictionaryAttackParameters
+
+	// LockoutAuthPolicy and OwnerAuthPolicy, if not nil, are the authorization
+	// policies assigned to the lockout and storage hierarchies respectively. Once a
+	// policy has been assigned, the hierarchy can be authorized with a session created
+	// by StartHierarchyAuthPolicySession, so that its authorization value does not
+	// need to be stored. Policies are removed when the TPM is cleared.
+	//
+	// Setting the lockout hierarchy authorization policy requires the use of the
+	// lockout hierarchy. If mode is ProvisionModeWithoutLockout and LockoutAuthPolicy
+	// is supplied, a ErrTPMProvisioningRequiresLockout error will be returned after
+	// the storage hierarchy authorization policy has been set. Neither policy can be
+	// set if mode is ProvisionModePreserveOwner.
+	LockoutAuthPolicy *HierarchyAuthPolicy
+	OwnerAuthPolicy   *HierarchyAuthPolicy
+
+	// SRKHandle, if not zero, is the handle of an existing storage key that has been
+	// persisted (eg, by the platform or by other software that shares the storage
+	// hierarchy) and which is used as the storage root key instead of one at the
+	// standard handle. This is useful on platforms that ship with a pre-provisioned
+	// storage key that was created with a non-default template. The object must be a
+	// primary key in the storage hierarchy that is suitable for use as a parent. It is
+	// never evicted or recreated, and a ErrTPMProvisioning error will be returned if
+	// there is no object at this handle. As clearing the TPM would remove the existing
+	// storage key, an error is returned if mode is ProvisionModeClear.
+	//
+	// Keys sealed with SealKeyToTPM or SealKeyToTPMMultiple using the same Connection
+	// will be created under this storage key, and its handle and public area will be
+	// recorded in the sealed key metadata so that it is used and validated when
+	// unsealing.
+	SRKHandle tpm2.Handle
+}
+
+func (t *Connection) ensureProvisionedInternal(mode ProvisionMode, newLockoutAuth []byte, srkTemplate *tpm2.Public, useExistingSrkTemplate bool, opts *ProvisionOptions) error {
+	if opts == nil {
+		opts = &ProvisionOptions{}
+	}
+	if mode == ProvisionModePreserveOwner && (opts.LockoutAuthPolicy != nil || opts.OwnerAuthPolicy != nil) {
+		return errors.New("cannot set hierarchy authorization policies with ProvisionModePreserveOwner")
+	}
+
+	srkHandle := tcg.SRKHandle
+	if opts.SRKHandle != 0 {
+		srkHandle = opts.SRKHandle
+	}
+	if mode == ProvisionModeClear && srkHandle != tcg.SRKHandle {
+		// Clearing the TPM would evict the existing storage key, which we never recreate.
+		return errors.New("cannot clear the TPM when using an existing storage key at a non-standard handle")
+	}
+	daParams := opts.DAParameters
+	if daParams == nil {
+		daParams = DefaultDictionaryAttackParameters()
+	}
+
 	session := t.HmacSession()
 
 	props, err := t.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1, session.IncludeAttrs(tpm2.AttrAudit))
@@ -201,28 +330,30 @@ func (t *Connection) ensureProvisionedInternal(mode ProvisionMode, newLockoutAut
 		}
 	}
 
-	// Provision an endorsement key
-	if _, err := provisionPrimaryKey(t.TPMContext, t.EndorsementHandleContext(), tcg.EKTemplate, tcg.EKHandle, session); err != nil {
-		switch {
-		case isAuthFailError(err, tpm2.CommandEvictControl, 1):
-			return AuthFailError{tpm2.HandleOwner}
-		case isAuthFailError(err, tpm2.AnyCommandCode, 1):
-			return AuthFailError{tpm2.HandleEndorsement}
-		default:
-			return xerrors.Errorf("cannot provision endorsement key: %w", err)
+	if mode != ProvisionModePreserveOwner {
+		// Provision an endorsement key
+		if _, err := provisionPrimaryKey(t.TPMContext, t.EndorsementHandleContext(), tcg.EKTemplate, tcg.EKHandle, session); err != nil {
+			switch {
+			case isAuthFailError(err, tpm2.CommandEvictControl, 1):
+				return AuthFailError{tpm2.HandleOwner}
+			case isAuthFailError(err, tpm2.AnyCommandCode, 1):
+				return AuthFailError{tpm2.HandleEndorsement}
+			default:
+				return xerrors.Errorf("cannot provision endorsement key: %w", err)
+			}
 		}
-	}
 
-	// Reinitialize the connection, which creates a new session that's salted with a value protected with the newly provisioned EK.
-	// This will have a symmetric algorithm for parameter encryption during HierarchyChangeAuth.
-	if err := t.init(); err != nil {
-		var verifyErr verificationError
-		if xerrors.As(err, &verifyErr) {
-			return TPMVerificationError{fmt.Sprintf("cannot reinitialize TPM connection after provisioning endorsement key: %v", err)}
+		// Reinitialize the connection, which creates a new session that's salted with a value protected with the newly provisioned EK.
+		// This will have a symmetric algorithm for parameter encryption during HierarchyChangeAuth.
+		if err := t.init(); err != nil {
+			var verifyErr verificationError
+			if xerrors.As(err, &verifyErr) {
+				return TPMVerificationError{fmt.Sprintf("cannot reinitialize TPM connection after provisioning endorsement key: %v", err)}
+			}
+			return xerrors.Errorf("cannot reinitialize TPM connection after provisioning endorsement key: %w", err)
 		}
-		return xerrors.Errorf("cannot reinitialize TPM connection after provisioning endorsement key: %w", err)
+		session = t.HmacSession()
 	}
-	session = t.HmacSession()
 
 	// Provision a storage root key
 	if !useExistingSrkTemplate && mode != ProvisionModeClear {
@@ -240,9 +371,22 @@ func (t *Connection) ensureProvisionedInternal(mode ProvisionMode, newLockoutAut
 		}
 	}
 
-	srk, err := provisionStoragePrimaryKey(t.TPMContext, session)
+	var srk tpm2.ResourceContext
+	switch {
+	case srkHandle != tcg.SRKHandle:
+		srk, err = existingStorageKey(t.TPMContext, srkHandle, nil, session)
+	case mode == ProvisionModePreserveOwner:
+		srk, err = ensureStoragePrimaryKey(t.TPMContext, selectSrkTemplate(t.TPMContext, session), session)
+	default:
+		srk, err = provisionStoragePrimaryKey(t.TPMContext, session)
+	}
 	if err != nil {
+		var existsErr TPMResourceExistsError
 		switch {
+		case err == ErrTPMProvisioning:
+			return err
+		case xerrors.As(err, &existsErr):
+			return existsErr
 		case isAuthFailError(err, tpm2.AnyCommandCode, 1):
 			return AuthFailError{tpm2.HandleOwner}
 		default:
@@ -251,6 +395,21 @@ func (t *Connection) ensureProvisionedInternal(mode ProvisionMode, newLockoutAut
 	}
 	t.provisionedSrk = srk
 
+	if mode == ProvisionModePreserveOwner {
+		// The legacy lock NV index is not required by keys created with this version
+		// of secboot, so there is nothing else to do.
+		return nil
+	}
+
+	if opts.OwnerAuthPolicy != nil {
+		if err := setHierarchyAuthPolicy(t.TPMContext, t.OwnerHandleContext(), opts.OwnerAuthPolicy, session); err != nil {
+			if isAuthFailError(err, tpm2.CommandSetPrimaryPolicy, 1) {
+				return AuthFailError{tpm2.HandleOwner}
+			}
+			return xerrors.Errorf("cannot set the storage hierarchy authorization policy: %w", err)
+		}
+	}
+
 	if mode == ProvisionModeWithoutLockout {
 		props, err := t.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1, session.IncludeAttrs(tpm2.AttrAudit))
 		if err != nil {
@@ -271,7 +430,13 @@ func (t *Connection) ensureProvisionedInternal(mode ProvisionMode, newLockoutAut
 		if props[0].Property != tpm2.PropertyMaxAuthFail || props[1].Property != tpm2.PropertyLockoutInterval || props[2].Property != tpm2.PropertyLockoutRecovery {
 			return errors.New("TPM returned values for the wrong properties")
 		}
-		if props[0].Value > maxTries || props[1].Value < recoveryTime || props[2].Value < lockoutRecovery {
+		if props[0].Value > daParams.MaxTries || props[1].Value < daParams.RecoveryTime || props[2].Value < daParams.LockoutRecovery {
+			return ErrTPMProvisioningRequiresLockout
+		}
+
+		if opts.LockoutAuthPolicy != nil {
+			// We can't set the lockout hierarchy authorization policy without
+			// using the lockout hierarchy.
 			return ErrTPMProvisioningRequiresLockout
 		}
 
@@ -281,7 +446,7 @@ func (t *Connection) ensureProvisionedInternal(mode ProvisionMode, newLockoutAut
 	// Perform actions that require the lockout hierarchy authorization.
 
 	// Set the DA parameters.
-	if err := t.DictionaryAttackParameters(t.LockoutHandleContext(), maxTries, recoveryTime, lockoutRecovery, session); err != nil {
+	if err := t.DictionaryAttackParameters(t.LockoutHandleContext(), daParams.MaxTries, daParams.RecoveryTime, daParams.LockoutRecovery, session); err != nil {
 		switch {
 		case isAuthFailError(err, tpm2.CommandDictionaryAttackParameters, 1):
 			return AuthFailError{tpm2.HandleLockout}
@@ -297,6 +462,12 @@ func (t *Connection) ensureProvisionedInternal(mode ProvisionMode, newLockoutAut
 		return xerrors.Errorf("cannot disable owner clear: %w", err)
 	}
 
+	if opts.LockoutAuthPolicy != nil {
+		if err := setHierarchyAuthPolicy(t.TPMContext, t.LockoutHandleContext(), opts.LockoutAuthPolicy, session); err != nil {
+			return xerrors.Errorf("cannot set the lockout hierarchy authorization policy: %w", err)
+		}
+	}
+
 	// Set the lockout hierarchy authorization.
 	if err := t.HierarchyChangeAuth(t.LockoutHandleContext(), newLockoutAuth, session.IncludeAttrs(tpm2.AttrCommandEncrypt)); err != nil {
 		return xerrors.Errorf("cannot set the lockout hierarchy authorization value: %w", err)
@@ -356,12 +527,18 @@ func (t *Connection) ensureProvisionedInternal(mode ProvisionMode, newLockoutAut
 // ErrTPMProvisioningRequiresLockout error will be returned. In this scenario, the function will complete all operations that can be
 // completed without using the lockout hierarchy, but the function should be called again either with mode set to ProvisionModeFull
 // (if the authorization value for the lockout hierarchy is known), or ProvisionModeClear.
+//
+// If mode is ProvisionModePreserveOwner, this function only ensures that a storage root key exists at the standard handle,
+// creating one if necessary. An existing storage root key is reused if it was created with the expected template, otherwise a
+// TPMResourceExistsError error is returned and the existing object is not evicted. The endorsement key is not reprovisioned,
+// the TPM is not cleared and no hierarchy authorization values or dictionary attack parameters are changed. This mode is
+// suitable for systems where the storage hierarchy is shared with other software.
 func (t *Connection) EnsureProvisionedWithCustomSRK(mode ProvisionMode, newLockoutAuth []byte, srkTemplate *tpm2.Public) error {
 	if srkTemplate != nil && !srkTemplate.IsParent() {
 		return errors.New("supplied SRK template is not valid for a parent key")
 	}
 
-	return t.ensureProvisionedInternal(mode, newLockoutAuth, srkTemplate, false)
+	return t.ensureProvisionedInternal(mode, newLockoutAuth, srkTemplate, false, nil)
 }
 
 // EnsureProvisioned prepares the TPM for full disk encryption. The mode parameter specifies the behaviour of this function.
@@ -409,8 +586,20 @@ func (t *Connection) EnsureProvisionedWithCustomSRK(mode ProvisionMode, newLocko
 // ErrTPMProvisioningRequiresLockout error will be returned. In this scenario, the function will complete all operations that can be
 // completed without using the lockout hierarchy, but the function should be called again either with mode set to ProvisionModeFull
 // (if the authorization value for the lockout hierarchy is known), or ProvisionModeClear.
+//
+// If mode is ProvisionModePreserveOwner, this function only ensures that a storage root key exists at the standard handle,
+// creating one if necessary. An existing storage root key is reused if it was created with the expected template, otherwise a
+// TPMResourceExistsError error is returned and the existing object is not evicted. The endorsement key is not reprovisioned,
+// the TPM is not cleared and no hierarchy authorization values or dictionary attack parameters are changed. This mode is
+// suitable for systems where the storage hierarchy is shared with other software.
 func (t *Connection) EnsureProvisioned(mode ProvisionMode, newLockoutAuth []byte) error {
-	return t.ensureProvisionedInternal(mode, newLockoutAuth, nil, true)
+	return t.ensureProvisionedInternal(mode, newLockoutAuth, nil, true, nil)
+}
+
+// EnsureProvisionedWithOptions prepares the TPM for full disk encryption in the same way as EnsureProvisioned, with the
+// behaviour customized by the supplied options. If opts is nil, this is equivalent to EnsureProvisioned.
+func (t *Connection) EnsureProvisionedWithOptions(mode ProvisionMode, newLockoutAuth []byte, opts *ProvisionOptions) error {
+	return t.ensureProvisionedInternal(mode, newLockoutAuth, nil, true, opts)
 }
 
 // RequestTPMClearUsingPPI submits a request to the firmware to clear the TPM on the next reboot. This is the only way to clear
@@ -60,6 +60,37 @@ func validateEK(t *testing.T, tpm *tpm2.TPMContext) {
 	validatePrimaryKeyAgainstTemplate(t, tpm, tpm2.HandleEndorsement, tcg.EKHandle, tcg.EKTemplate)
 }
 
+// testCustomSRKTemplate is a valid storage key template that differs from the standard SRK template.
+var testCustomSRKTemplate = tpm2.Public{
+	Type:    tpm2.ObjectTypeRSA,
+	NameAlg: tpm2.HashAlgorithmSHA256,
+	Attrs:   tpm2.AttrFixedTPM | tpm2.AttrFixedParent | tpm2.AttrSensitiveDataOrigin | tpm2.AttrUserWithAuth | tpm2.AttrRestricted | tpm2.AttrDecrypt,
+	Params: &tpm2.PublicParamsU{
+		RSADetail: &tpm2.RSAParams{
+			Symmetric: tpm2.SymDefObject{
+				Algorithm: tpm2.SymObjectAlgorithmAES,
+				KeyBits:   &tpm2.SymKeyBitsU{Sym: 128},
+				Mode:      &tpm2.SymModeU{Sym: tpm2.SymModeCFB}},
+			Scheme:   tpm2.RSAScheme{Scheme: tpm2.RSASchemeNull},
+			KeyBits:  2048,
+			Exponent: 0}}}
+
+// createPersistentStorageKey creates a primary key in the storage hierarchy with the supplied template and persists it at the
+// specified handle. Fatal on failure.
+func createPersistentStorageKey(t *testing.T, tpm *Connection, handle tpm2.Handle, template *tpm2.Public) tpm2.ResourceContext {
+	transient, _, _, _, _, err := tpm.CreatePrimary(tpm.OwnerHandleContext(), nil, template, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("CreatePrimary failed: %v", err)
+	}
+	defer flushContext(t, tpm, transient)
+
+	key, err := tpm.EvictControl(tpm.OwnerHandleContext(), transient, handle, nil)
+	if err != nil {
+		t.Fatalf("EvictControl failed: %v", err)
+	}
+	return key
+}
+
 func TestProvisionNewTPM(t *testing.T) {
 	tpm, _ := openTPMSimulatorForTesting(t)
 	defer closeTPM(t, tpm)
@@ -486,6 +517,203 @@ func TestProvisionWithOwnerAuth(t *testing.T) {
 	validateSRK(t, tpm.TPMContext)
 }
 
+func TestProvisionPreserveOwner(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	clearTPMWithPlatformAuth(t, tpm)
+
+	testAuth := []byte("1234")
+
+	if err := tpm.HierarchyChangeAuth(tpm.OwnerHandleContext(), testAuth, nil); err != nil {
+		t.Fatalf("HierarchyChangeAuth failed: %v", err)
+	}
+
+	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyMaxAuthFail, 3)
+	if err != nil {
+		t.Fatalf("GetCapability failed: %v", err)
+	}
+	origDAParams := props
+
+	for i := 0; i < 2; i++ {
+		// Run twice to make sure that an existing SRK is reused.
+		if err := tpm.EnsureProvisioned(ProvisionModePreserveOwner, []byte("5678")); err != nil {
+			t.Fatalf("EnsureProvisioned failed: %v", err)
+		}
+		validateSRK(t, tpm.TPMContext)
+	}
+
+	// Verify that the EK wasn't provisioned
+	if _, err := tpm.CreateResourceContextFromTPM(tcg.EKHandle); !tpm2.IsResourceUnavailableError(err, tcg.EKHandle) {
+		t.Errorf("EnsureProvisioned shouldn't have provisioned an EK (err: %v)", err)
+	}
+
+	// Verify that the hierarchy configuration wasn't changed
+	props, err = tpm.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1)
+	if err != nil {
+		t.Fatalf("GetCapability failed: %v", err)
+	}
+	if tpm2.PermanentAttributes(props[0].Value)&tpm2.AttrOwnerAuthSet == 0 {
+		t.Errorf("EnsureProvisioned changed the owner hierarchy auth")
+	}
+	if tpm2.PermanentAttributes(props[0].Value)&(tpm2.AttrLockoutAuthSet|tpm2.AttrDisableClear) > 0 {
+		t.Errorf("EnsureProvisioned used the lockout hierarchy")
+	}
+
+	props, err = tpm.GetCapabilityTPMProperties(tpm2.PropertyMaxAuthFail, 3)
+	if err != nil {
+		t.Fatalf("GetCapability failed: %v", err)
+	}
+	for i := range props {
+		if props[i].Value != origDAParams[i].Value {
+			t.Errorf("EnsureProvisioned changed the DA parameters")
+		}
+	}
+}
+
+func TestProvisionPreserveOwnerIncompatibleSRK(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	clearTPMWithPlatformAuth(t, tpm)
+
+	// Persist an object at the SRK handle that wasn't created with the SRK template.
+	transient, _, _, _, _, err := tpm.CreatePrimary(tpm.OwnerHandleContext(), nil, tcg.EKTemplate, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("CreatePrimary failed: %v", err)
+	}
+	defer flushContext(t, tpm, transient)
+	obj, err := tpm.EvictControl(tpm.OwnerHandleContext(), transient, tcg.SRKHandle, nil)
+	if err != nil {
+		t.Fatalf("EvictControl failed: %v", err)
+	}
+
+	err = tpm.EnsureProvisioned(ProvisionModePreserveOwner, nil)
+	if e, ok := err.(TPMResourceExistsError); !ok || e.Handle != tcg.SRKHandle {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// Verify that the existing object wasn't evicted
+	srk, err := tpm.CreateResourceContextFromTPM(tcg.SRKHandle)
+	if err != nil {
+		t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(srk.Name(), obj.Name()) {
+		t.Errorf("EnsureProvisioned evicted the existing object")
+	}
+}
+
+func TestProvisionWithExistingSRK(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	clearTPMWithPlatformAuth(t, tpm)
+
+	srk := createPersistentStorageKey(t, tpm, 0x81000002, &testCustomSRKTemplate)
+
+	if err := tpm.EnsureProvisionedWithOptions(ProvisionModeFull, nil, &ProvisionOptions{SRKHandle: 0x81000002}); err != nil {
+		t.Fatalf("EnsureProvisionedWithOptions failed: %v", err)
+	}
+
+	validateEK(t, tpm.TPMContext)
+
+	// Verify that the existing key wasn't touched and no SRK was created at the standard handle
+	validatePrimaryKeyAgainstTemplate(t, tpm.TPMContext, tpm2.HandleOwner, 0x81000002, &testCustomSRKTemplate)
+	key, err := tpm.CreateResourceContextFromTPM(0x81000002)
+	if err != nil {
+		t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(key.Name(), srk.Name()) {
+		t.Errorf("EnsureProvisionedWithOptions replaced the existing key")
+	}
+	if _, err := tpm.CreateResourceContextFromTPM(tcg.SRKHandle); !tpm2.IsResourceUnavailableError(err, tcg.SRKHandle) {
+		t.Errorf("EnsureProvisionedWithOptions shouldn't have created a SRK at the standard handle (err: %v)", err)
+	}
+}
+
+func TestProvisionWithExistingSRKMissing(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	clearTPMWithPlatformAuth(t, tpm)
+
+	if err := tpm.EnsureProvisionedWithOptions(ProvisionModeFull, nil, &ProvisionOptions{SRKHandle: 0x81000002}); err != ErrTPMProvisioning {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestProvisionWithExistingSRKAndClear(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	clearTPMWithPlatformAuth(t, tpm)
+
+	srk := createPersistentStorageKey(t, tpm, 0x81000002, &testCustomSRKTemplate)
+
+	err := tpm.EnsureProvisionedWithOptions(ProvisionModeClear, nil, &ProvisionOptions{SRKHandle: 0x81000002})
+	if err == nil || err.Error() != "cannot clear the TPM when using an existing storage key at a non-standard handle" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// Verify that the TPM wasn't cleared
+	key, err := tpm.CreateResourceContextFromTPM(0x81000002)
+	if err != nil {
+		t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(key.Name(), srk.Name()) {
+		t.Errorf("EnsureProvisionedWithOptions replaced the existing key")
+	}
+}
+
+func TestProvisionWithDAParameters(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	clearTPMWithPlatformAuth(t, tpm)
+
+	params := &DictionaryAttackParameters{MaxTries: 10, RecoveryTime: 3600, LockoutRecovery: 7200}
+	if err := tpm.EnsureProvisionedWithOptions(ProvisionModeFull, nil, &ProvisionOptions{DAParameters: params}); err != nil {
+		t.Fatalf("EnsureProvisionedWithOptions failed: %v", err)
+	}
+
+	validateEK(t, tpm.TPMContext)
+	validateSRK(t, tpm.TPMContext)
+
+	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyMaxAuthFail, 3)
+	if err != nil {
+		t.Fatalf("GetCapability failed: %v", err)
+	}
+	if props[0].Value != uint32(10) || props[1].Value != uint32(3600) || props[2].Value != uint32(7200) {
+		t.Errorf("EnsureProvisionedWithOptions didn't set the DA parameters correctly")
+	}
+
+	// The current parameters are less strict than the defaults.
+	if err := tpm.EnsureProvisioned(ProvisionModeWithoutLockout, nil); err != ErrTPMProvisioningRequiresLockout {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := tpm.EnsureProvisionedWithOptions(ProvisionModeWithoutLockout, nil, &ProvisionOptions{DAParameters: params}); err != nil {
+		t.Errorf("EnsureProvisionedWithOptions failed: %v", err)
+	}
+}
+
 func TestProvisionWithInvalidEkCert(t *testing.T) {
 	tpm, _ := openTPMSimulatorForTesting(t)
 	defer func() {
@@ -0,0 +1,44 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"github.com/canonical/go-tpm2"
+)
+
+// AddMeasurementToPreventReuseProfile adds an instruction to the PCR protection profile that extends the specified PCR with a
+// digest of eventData, as measured by ExtendMeasurementToPreventReuse. This should be added to the profile for keys that are
+// intended to be unsealed after the measurement has been made, in the same order as the measurements are made. The measured
+// digest is the digest of eventData computed with the algorithm specified by alg.
+func AddMeasurementToPreventReuseProfile(profile *PCRProtectionProfile, alg tpm2.HashAlgorithmId, pcr int, eventData []byte) {
+	profile.ExtendPCR(alg, pcr, computeMeasuredValueDigest(alg, eventData))
+}
+
+// ExtendMeasurementToPreventReuse measures a digest of the supplied event data to the specified PCR for all supported PCR
+// banks. If the PCR is included in the PCR policy for a sealed key, this prevents that key from being unsealed again for the
+// rest of the current boot, and is a simpler alternative to using a lock index (see LockSealedKeyAccess) for preventing a
+// key from being reused after it has been unsealed. The event data should be a fixed, caller-defined string, such as
+// "secboot-key-unsealed".
+//
+// Keys that should be unsealed after this measurement has been made should have a corresponding instruction added to their
+// PCR protection profile with AddMeasurementToPreventReuseProfile.
+func ExtendMeasurementToPreventReuse(tpm *Connection, pcr int, eventData []byte) error {
+	return MeasureValueToTPM(tpm, pcr, eventData)
+}
@@ -0,0 +1,97 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"math/rand"
+	"path/filepath"
+
+	"github.com/canonical/go-tpm2"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot/internal/testutil"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type reusePreventionSuite struct {
+	testutil.TPMSimulatorTestBase
+}
+
+var _ = Suite(&reusePreventionSuite{})
+
+func (s *reusePreventionSuite) SetUpTest(c *C) {
+	s.TPMSimulatorTestBase.SetUpTest(c)
+	s.ResetTPMSimulator(c)
+}
+
+func (s *reusePreventionSuite) testExtendMeasurementToPreventReuse(c *C, pcr int, events [][]byte) {
+	profile := NewPCRProtectionProfile()
+	for _, e := range events {
+		c.Check(ExtendMeasurementToPreventReuse(s.TPM, pcr, e), IsNil)
+		AddMeasurementToPreventReuseProfile(profile, tpm2.HashAlgorithmSHA256, pcr, e)
+	}
+
+	expected, err := profile.ComputePCRValues(nil)
+	c.Assert(err, IsNil)
+	c.Assert(expected, HasLen, 1)
+
+	_, pcrValues, err := s.TPM.PCRRead(tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{pcr}}})
+	c.Assert(err, IsNil)
+	c.Check(pcrValues, DeepEquals, expected[0])
+}
+
+func (s *reusePreventionSuite) TestExtendMeasurementToPreventReuse1(c *C) {
+	s.testExtendMeasurementToPreventReuse(c, 12, [][]byte{[]byte("secboot-key-unsealed")})
+}
+
+func (s *reusePreventionSuite) TestExtendMeasurementToPreventReuse2(c *C) {
+	// Test with a different PCR.
+	s.testExtendMeasurementToPreventReuse(c, 8, [][]byte{[]byte("secboot-key-unsealed")})
+}
+
+func (s *reusePreventionSuite) TestExtendMeasurementToPreventReuse3(c *C) {
+	// Test with multiple measurements.
+	s.testExtendMeasurementToPreventReuse(c, 12, [][]byte{[]byte("run-key-unsealed"), []byte("save-key-unsealed")})
+}
+
+func (s *reusePreventionSuite) TestPreventsReuseOfSealedKey(c *C) {
+	// Seal a key bound to PCR 12 and check that it can't be unsealed again after the
+	// measurement is made.
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	keyFile := filepath.Join(c.MkDir(), "keydata")
+
+	profile := NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 12)
+	_, err := SealKeyToTPM(s.TPM, key, keyFile, &KeyCreationParams{PCRProfile: profile, PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Assert(err, IsNil)
+
+	k, err := ReadSealedKeyObject(keyFile)
+	c.Assert(err, IsNil)
+
+	_, _, err = k.UnsealFromTPM(s.TPM, "")
+	c.Check(err, IsNil)
+
+	c.Check(ExtendMeasurementToPreventReuse(s.TPM, 12, []byte("secboot-key-unsealed")), IsNil)
+
+	_, _, err = k.UnsealFromTPM(s.TPM, "")
+	c.Check(err, ErrorMatches, "invalid key data file: cannot complete authorization policy assertions: cannot complete OR assertions: current session digest not found in policy data")
+}
@@ -0,0 +1,231 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	rollbackCounterAttrs = tpm2.AttrNVOwnerWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA
+
+	// maxRollbackCounterAdvance is the maximum amount that AdvanceRollbackCounter will advance a
+	// rollback counter by in a single call. Each step is a separate TPM2_NV_Increment command.
+	maxRollbackCounterAdvance = 1024
+)
+
+// makeRollbackCounterPublic returns the public area of an initialized rollback counter at the specified handle. The
+// counter has an empty authorization value and no authorization policy, so anyone can read it, but it can only be
+// incremented with knowledge of the authorization value for the storage hierarchy.
+func makeRollbackCounterPublic(handle tpm2.Handle) *tpm2.NVPublic {
+	return &tpm2.NVPublic{
+		Index:   handle,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeCounter.WithAttrs(rollbackCounterAttrs | tpm2.AttrNVWritten),
+		Size:    8}
+}
+
+// isRollbackCounter indicates whether the supplied public area is for a rollback counter created by
+// createRollbackCounter.
+func isRollbackCounter(public *tpm2.NVPublic) bool {
+	expected := makeRollbackCounterPublic(public.Index)
+	return public.NameAlg == expected.NameAlg &&
+		public.Attrs == expected.Attrs &&
+		len(public.AuthPolicy) == 0 &&
+		public.Size == expected.Size
+}
+
+// rollbackVersionOperand returns the operand used in the TPM2_PolicyNV assertion for the supplied version.
+func rollbackVersionOperand(version uint64) tpm2.Operand {
+	operand := make(tpm2.Operand, 8)
+	binary.BigEndian.PutUint64(operand, version)
+	return operand
+}
+
+// createRollbackCounter creates and initializes a rollback counter at the specified handle. Note that the TPM
+// initializes a NV counter to the highest value of any counter that has existed on it, so the initial value
+// is not zero.
+func createRollbackCounter(tpm *tpm2.TPMContext, handle tpm2.Handle, hmacSession tpm2.SessionContext) (*tpm2.NVPublic, error) {
+	public := makeRollbackCounterPublic(handle)
+	public.Attrs &^= tpm2.AttrNVWritten
+
+	index, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, public, hmacSession)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot define NV space: %w", err)
+	}
+
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, hmacSession)
+	}()
+
+	// The counter must be incremented before it can be read or used in a TPM2_PolicyNV assertion.
+	if err := tpm.NVIncrement(tpm.OwnerHandleContext(), index, hmacSession); err != nil {
+		return nil, xerrors.Errorf("cannot initialize NV counter: %w", err)
+	}
+
+	succeeded = true
+	return makeRollbackCounterPublic(handle), nil
+}
+
+// ensureRollbackCounter returns the public area of the rollback counter at the specified handle, creating it if it
+// doesn't already exist. An existing rollback counter is shared between sealed key objects. If there is another NV
+// index at the specified handle, a TPMResourceExistsError error is returned.
+func ensureRollbackCounter(tpm *tpm2.TPMContext, handle tpm2.Handle, hmacSession tpm2.SessionContext) (public *tpm2.NVPublic, created bool, err error) {
+	if handle.Type() != tpm2.HandleTypeNVIndex {
+		return nil, false, errors.New("invalid handle")
+	}
+
+	index, err := tpm.CreateResourceContextFromTPM(handle, hmacSession.IncludeAttrs(tpm2.AttrAudit))
+	switch {
+	case tpm2.IsResourceUnavailableError(err, handle):
+		public, err := createRollbackCounter(tpm, handle, hmacSession)
+		if err != nil {
+			return nil, false, err
+		}
+		return public, true, nil
+	case err != nil:
+		return nil, false, xerrors.Errorf("cannot create context for NV index: %w", err)
+	}
+
+	public, _, err = tpm.NVReadPublic(index, hmacSession.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, false, xerrors.Errorf("cannot read public area of NV index: %w", err)
+	}
+	if !isRollbackCounter(public) {
+		return nil, false, TPMResourceExistsError{handle}
+	}
+
+	return makeRollbackCounterPublic(handle), false, nil
+}
+
+// rollbackCounterContext returns a ResourceContext for the rollback counter at the specified handle, checking that it
+// is a rollback counter.
+func rollbackCounterContext(tpm *Connection, handle tpm2.Handle) (tpm2.ResourceContext, error) {
+	if handle.Type() != tpm2.HandleTypeNVIndex {
+		return nil, errors.New("invalid handle")
+	}
+
+	session := tpm.HmacSession()
+
+	index, err := tpm.CreateResourceContextFromTPM(handle, session.IncludeAttrs(tpm2.AttrAudit))
+	switch {
+	case tpm2.IsResourceUnavailableError(err, handle):
+		return nil, fmt.Errorf("no rollback counter at handle %v", handle)
+	case err != nil:
+		return nil, xerrors.Errorf("cannot create context for rollback counter: %w", err)
+	}
+
+	public, _, err := tpm.NVReadPublic(index, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read public area of rollback counter: %w", err)
+	}
+	if !isRollbackCounter(public) {
+		return nil, fmt.Errorf("NV index at handle %v is not a rollback counter", handle)
+	}
+
+	return index, nil
+}
+
+// readRollbackCounter returns the current value of the supplied rollback counter.
+func readRollbackCounter(tpm *tpm2.TPMContext, index tpm2.ResourceContext, hmacSession tpm2.SessionContext) (uint64, error) {
+	return tpm.NVReadCounter(index, index, hmacSession)
+}
+
+// ReadRollbackCounter returns the current value of the rollback counter at the specified handle (see the
+// RollbackCounterHandle field of KeyCreationParams). Sealed key objects that were created with this counter and a
+// RollbackVersion lower than this value can no longer be unsealed.
+func ReadRollbackCounter(tpm *Connection, rollbackCounterHandle tpm2.Handle) (uint64, error) {
+	index, err := rollbackCounterContext(tpm, rollbackCounterHandle)
+	if err != nil {
+		return 0, err
+	}
+	value, err := readRollbackCounter(tpm.TPMContext, index, tpm.HmacSession())
+	if err != nil {
+		return 0, xerrors.Errorf("cannot read rollback counter: %w", err)
+	}
+	return value, nil
+}
+
+// AdvanceRollbackCounter advances the rollback counter at the specified handle (see the RollbackCounterHandle field of
+// KeyCreationParams) so that its value is at least the supplied version. Once this succeeds, sealed key objects that
+// were created with this counter and a lower RollbackVersion can no longer be unsealed, and SealedKeyObject.UnsealFromTPM
+// will return a ErrKeyVersionRevoked error for them.
+//
+// This is intended to be called after a successful update of the boot chain, once the sealed key objects have been
+// recreated with the new version. The counter can never be decremented, so booting a previous boot chain will not make
+// the sealed key objects created for it usable again, even if the PCR policy of these still authorizes it. Advancing
+// the counter to a value that it has already reached is not an error, so this can be safely retried. The counter can
+// only be advanced by up to 1024 in a single call.
+//
+// This function requires knowledge of the authorization value for the storage hierarchy, which must be provided by
+// calling Connection.OwnerHandleContext().SetAuthValue() prior to calling this function. If the provided authorization
+// value is incorrect, a AuthFailError error will be returned.
+func AdvanceRollbackCounter(tpm *Connection, rollbackCounterHandle tpm2.Handle, version uint64) error {
+	index, err := rollbackCounterContext(tpm, rollbackCounterHandle)
+	if err != nil {
+		return err
+	}
+
+	session := tpm.HmacSession()
+
+	current, err := readRollbackCounter(tpm.TPMContext, index, session)
+	if err != nil {
+		return xerrors.Errorf("cannot read rollback counter: %w", err)
+	}
+	if current >= version {
+		return nil
+	}
+	if version-current > maxRollbackCounterAdvance {
+		return fmt.Errorf("cannot advance rollback counter by more than %d (current value: %d)", maxRollbackCounterAdvance, current)
+	}
+
+	for ; current < version; current++ {
+		if err := tpm.NVIncrement(tpm.OwnerHandleContext(), index, session); err != nil {
+			if isAuthFailError(err, tpm2.CommandNVIncrement, 1) {
+				return AuthFailError{tpm2.HandleOwner}
+			}
+			return xerrors.Errorf("cannot increment rollback counter: %w", err)
+		}
+	}
+	return nil
+}
+
+// RollbackCounterHandle indicates the handle of the NV counter used to prevent this sealed key object from being
+// unsealed once the boot chain it was created for has been superseded. This is tpm2.HandleNull if the sealed key
+// object doesn't have a rollback counter.
+func (k *SealedKeyObject) RollbackCounterHandle() tpm2.Handle {
+	return k.data.staticPolicyData.rollbackCounterHandle
+}
+
+// RollbackVersion indicates the version recorded in this sealed key object for comparison with its rollback counter.
+// The sealed key object can only be unsealed whilst the value of the rollback counter is not greater than this.
+func (k *SealedKeyObject) RollbackVersion() uint64 {
+	return k.data.staticPolicyData.rollbackVersion
+}
@@ -0,0 +1,167 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+func TestRollbackCounter(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestRollbackCounter_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	oldKeyFile := filepath.Join(tmpDir, "old")
+	newKeyFile := filepath.Join(tmpDir, "new")
+
+	rollbackCounterHandle := tpm2.Handle(0x01810020)
+
+	defer func() {
+		rc, err := tpm.CreateResourceContextFromTPM(rollbackCounterHandle)
+		if err != nil {
+			return
+		}
+		undefineNVSpace(t, tpm, rc, tpm.OwnerHandleContext())
+	}()
+
+	seal := func(path string, version uint64) error {
+		_, err := SealKeyToTPM(tpm, key, path, &KeyCreationParams{
+			PCRProfile:             getTestPCRProfile(),
+			PCRPolicyCounterHandle: tpm2.HandleNull,
+			RollbackCounterHandle:  rollbackCounterHandle,
+			RollbackVersion:        version})
+		return err
+	}
+
+	unseal := func(t *testing.T, path string) error {
+		k, err := ReadSealedKeyObject(path)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		unsealedKey, _, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(unsealedKey, key) {
+			t.Errorf("Unexpected key")
+		}
+		return nil
+	}
+
+	// Seal a key for the current version of the counter, which creates it.
+	if err := seal(oldKeyFile, 0); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+
+	current, err := ReadRollbackCounter(tpm, rollbackCounterHandle)
+	if err != nil {
+		t.Fatalf("ReadRollbackCounter failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(oldKeyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if k.RollbackCounterHandle() != rollbackCounterHandle {
+		t.Errorf("Unexpected rollback counter handle: %v", k.RollbackCounterHandle())
+	}
+	if k.RollbackVersion() != current {
+		t.Errorf("Unexpected rollback version: %d", k.RollbackVersion())
+	}
+
+	// Seal a key for the next version, which shares the existing counter.
+	if err := seal(newKeyFile, current+1); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+
+	for _, path := range []string{oldKeyFile, newKeyFile} {
+		if err := unseal(t, path); err != nil {
+			t.Errorf("UnsealFromTPM failed: %v", err)
+		}
+	}
+
+	// Advancing the counter should revoke the key for the old version only.
+	if err := AdvanceRollbackCounter(tpm, rollbackCounterHandle, current+1); err != nil {
+		t.Fatalf("AdvanceRollbackCounter failed: %v", err)
+	}
+	if err := unseal(t, oldKeyFile); err != ErrKeyVersionRevoked {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := unseal(t, newKeyFile); err != nil {
+		t.Errorf("UnsealFromTPM failed: %v", err)
+	}
+
+	verdict, err := k.CheckUnsealable(tpm)
+	if err != nil {
+		t.Errorf("CheckUnsealable failed: %v", err)
+	}
+	if verdict != UnsealVerdictVersionRevoked {
+		t.Errorf("Unexpected verdict: %v", verdict)
+	}
+
+	// The counter can't be moved backwards.
+	if err := AdvanceRollbackCounter(tpm, rollbackCounterHandle, current); err != nil {
+		t.Errorf("AdvanceRollbackCounter failed: %v", err)
+	}
+	value, err := ReadRollbackCounter(tpm, rollbackCounterHandle)
+	if err != nil {
+		t.Fatalf("ReadRollbackCounter failed: %v", err)
+	}
+	if value != current+1 {
+		t.Errorf("Unexpected counter value: %d", value)
+	}
+
+	// Keys can't be sealed for versions that have already been revoked.
+	if err := seal(filepath.Join(tmpDir, "revoked"), current); err == nil {
+		t.Errorf("SealKeyToTPM should have failed")
+	}
+
+	// Rollback counters are never cleaned up automatically, even if they aren't in use.
+	removed, err := CleanupOrphanedCounters(tpm, &CleanupOrphanedCountersParams{
+		CandidateHandles: []tpm2.Handle{rollbackCounterHandle},
+		Remove:           true})
+	if err != nil {
+		t.Errorf("CleanupOrphanedCounters failed: %v", err)
+	}
+	if len(removed) > 0 {
+		t.Errorf("Unexpected removed handles: %v", removed)
+	}
+}
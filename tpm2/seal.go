@@ -21,19 +21,28 @@ package tpm2
 
 import (
 	"bytes"
+	"context"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"time"
 
 	"github.com/canonical/go-tpm2"
 	"github.com/canonical/go-tpm2/mu"
 
 	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/ecdsautil"
+	"github.com/snapcore/secboot/internal/logger"
+	"github.com/snapcore/secboot/internal/tcg"
 )
 
 func makeSealedKeyTemplate() *tpm2.Public {
@@ -142,27 +151,399 @@ func computeSealedKeyDynamicAuthPolicy(tpm *tpm2.TPMContext, version uint32, alg
 		return nil, xerrors.Errorf("cannot compute dynamic authorization policy: %w", err)
 	}
 
+	// Record the values permitted for each PCR so that the cause of a PCR policy mismatch can be diagnosed.
+	pcrValues, err := pcrProfile.ComputePCRValues(tpm)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute PCR values from protection profile: %w", err)
+	}
+	policyData.pcrValues = computePCRPermittedValues(pcrs, pcrValues)
+
+	logger.Debug("tpm2-compute-pcr-policy",
+		logger.F("pcrs", pcrs),
+		logger.F("branches", len(pcrDigests)),
+		logger.F("policy-count", nextPolicyCount),
+		logger.F("authorized-policy", policyData.authorizedPolicy))
+
 	return policyData, nil
 }
 
+// PolicyAuthKeyAlgorithm specifies the algorithm of a key generated for authorizing PCR policy updates.
+type PolicyAuthKeyAlgorithm int
+
+const (
+	// PolicyAuthKeyECDSAP256 corresponds to a ECDSA key on the NIST P-256 curve.
+	PolicyAuthKeyECDSAP256 PolicyAuthKeyAlgorithm = iota
+
+	// PolicyAuthKeyECDSAP384 corresponds to a ECDSA key on the NIST P-384 curve.
+	PolicyAuthKeyECDSAP384
+
+	// PolicyAuthKeyRSA2048 corresponds to a 2048-bit RSA key, used with the RSASSA-PSS scheme.
+	PolicyAuthKeyRSA2048
+)
+
+const (
+	// NoPCRPolicyCounterHandle can be supplied via KeyCreationParams.PCRPolicyCounterHandle in order to create sealed key
+	// objects that don't have a PCR policy counter. These don't consume any NV space, but old PCR policies cannot be revoked.
+	NoPCRPolicyCounterHandle = tpm2.HandleNull
+
+	// AutoPCRPolicyCounterHandle can be supplied via KeyCreationParams.PCRPolicyCounterHandle in order to have a handle
+	// for the PCR policy counter selected automatically. This is not a valid TPM handle.
+	AutoPCRPolicyCounterHandle tpm2.Handle = 0xffffffff
+)
+
 // KeyCreationParams provides arguments for SealKeyToTPM.
 type KeyCreationParams struct {
 	// PCRProfile defines the profile used to generate a PCR protection policy for the newly created sealed key file.
 	PCRProfile *PCRProtectionProfile
 
+	// RequiredPCRBanks is an optional list of PCR banks that PCRProfile must define values for. If this is set, PCRProfile must
+	// select the same set of PCRs in each of these banks, else an error is returned. The resulting PCR policy requires the values
+	// in all of the banks, so that it remains secure if one of them can be extended by other means, eg, because of a firmware
+	// bug. PCR profiles for multiple banks can be combined with PCRProtectionProfile.AddProfileAND. This is recorded in the
+	// sealed key objects, and the same requirement applies to PCR profiles supplied when the PCR policy is updated later on.
+	RequiredPCRBanks []tpm2.HashAlgorithmId
+
 	// PCRPolicyCounterHandle is the handle at which to create a NV index for dynamic authorization poliy revocation support. The handle
-	// must either be tpm2.HandleNull (in which case, no NV index will be created and the sealed key will not benefit from dynamic
-	// authorization policy revocation support), or it must be a valid NV index handle (MSO == 0x01). The choice of handle should take
-	// in to consideration the reserved indices from the "Registry of reserved TPM 2.0 handles and localities" specification. It is
-	// recommended that the handle is in the block reserved for owner objects (0x01800000 - 0x01bfffff).
+	// must either be NoPCRPolicyCounterHandle (tpm2.HandleNull), AutoPCRPolicyCounterHandle, or it must be a valid NV index handle
+	// (MSO == 0x01). The zero value is not a valid NV index handle and is rejected. The choice of
+	// handle should take in to consideration the reserved indices from the "Registry of reserved TPM 2.0 handles and localities"
+	// specification. It is recommended that the handle is in the block reserved for owner objects (0x01800000 - 0x01bfffff).
+	//
+	// If this is NoPCRPolicyCounterHandle, no NV index will be created and the sealed key will not benefit from dynamic
+	// authorization policy revocation support. This is suitable for cases where revocation isn't required, such as ephemeral
+	// instances, or where NV space is scarce. The PCR policy of such a key omits the counter assertion entirely, PCR policy
+	// updates succeed without revoking previous policies, and SealedKeyObject.RevokeOldPCRProtectionPolicies does nothing.
+	//
+	// If this is AutoPCRPolicyCounterHandle, the NV index will be created at the lowest handle between 0x01810000 and
+	// 0x018fffff that isn't already in use by another NV index. This avoids collisions with other software that defines NV
+	// indices. The selected handle is recorded in the key data and can be obtained with SealedKeyObject.PCRPolicyCounterHandle.
 	PCRPolicyCounterHandle tpm2.Handle
 
 	// AuthKey can be set to chose an auhorisation key whose
 	// private part will be used for authorizing PCR policy
 	// updates with SealedKeyObject.UpdatePCRProtectionPolicy
-	// If set a key from elliptic.P256 must be used,
-	// if not set one is generated.
+	// If set a key from elliptic.P256 or elliptic.P384 must be used,
+	// if not set one is generated. A key derived from a
+	// primary key with secboot.DeriveAuthKey can be used
+	// so that it is shared by all keys sealed for an install.
 	AuthKey *ecdsa.PrivateKey
+
+	// AuthKeyAlgorithm specifies the algorithm of the key that is generated for authorizing PCR policy updates
+	// when AuthKey and AuthorizedPolicySigner are not set. The default is PolicyAuthKeyECDSAP256. The algorithm
+	// is recorded in the public area of the key that is stored in the key data, and is used for subsequent policy
+	// updates. RSA keys might be preferable on TPMs with slow or missing ECC support.
+	AuthKeyAlgorithm PolicyAuthKeyAlgorithm
+
+	// SRKHandle is the handle of an existing persistent storage key that sealed key objects should be created under, instead of the
+	// storage root key at the standard handle. This is useful on platforms that ship with a pre-provisioned storage key that was
+	// created with a non-default template. If this is zero, the storage root key at the standard handle is used.
+	SRKHandle tpm2.Handle
+
+	// SRKTemplate is the template that the storage key was created with. If SRKHandle is set to a non-standard handle, the existing
+	// object must have been created with this template. If SRKHandle is not set, the storage root key at the standard handle is
+	// checked against this template rather than being recreated, and is created with this template if it doesn't already exist.
+	SRKTemplate *tpm2.Public
+
+	// StorageHierarchy specifies the hierarchy that the storage key for the sealed key objects is created in. If this is
+	// zero or tpm2.HandleOwner, the storage key is a persistent object in the storage hierarchy as described above. It can be
+	// set to tpm2.HandleEndorsement or tpm2.HandlePlatform on platforms where the storage hierarchy is reserved for other
+	// software. In this case, the storage key is a transient primary key created from SRKTemplate (or the standard SRK
+	// template if that isn't set), and the hierarchy is recorded in the key data so that the same storage key is recreated
+	// each time it is required. An ECC template is recommended because of this. SRKHandle must not be set.
+	//
+	// The authorization value for the selected hierarchy must be provided by calling SetAuthValue on the context returned
+	// from Connection.EndorsementHandleContext() or Connection.PlatformHandleContext(), and is also required when unsealing.
+	// Note that creating the PCR policy counter, PIN index and lock index still requires the authorization value for the
+	// storage hierarchy, so these features should be disabled if that isn't available.
+	StorageHierarchy tpm2.Handle
+
+	// PINAttemptLimit is the maximum number of consecutive incorrect PIN attempts that are permitted before the sealed key
+	// objects can no longer be unsealed. This limit is enforced by the TPM for each sealed key file, independently of the TPM's
+	// dictionary attack protection, so it still applies if throttling in the OS is bypassed. If this is zero, there is no
+	// limit other than that imposed by the TPM's dictionary attack protection.
+	PINAttemptLimit uint32
+
+	// PINIndexHandle is the handle at which to create a NV index for counting incorrect PIN attempts if PINAttemptLimit is
+	// not zero. It must be a valid NV index handle (MSO == 0x01), and the same considerations apply to the choice of handle
+	// as for PCRPolicyCounterHandle.
+	PINIndexHandle tpm2.Handle
+
+	// AuthorizedPolicySigner can be set to use an external key for authorizing PCR policies, instead of a key that is
+	// generated locally or supplied via AuthKey. This permits the private part of the key to be held offline or in a HSM,
+	// so that new PCR policies can be authorized without any secret on the device. The public key must be a RSA key or an
+	// ECDSA key. When this is set, AuthKey must not be set and SealKeyToTPM doesn't return a key, and PCR policies must be
+	// updated with SealedKeyObject.UpdatePCRProtectionPolicyWithSigner.
+	AuthorizedPolicySigner crypto.Signer
+
+	// ClockLimit, if not zero, limits the lifetime of the sealed key objects so that they can only be unsealed until the
+	// TPM's clock has advanced by this amount from when they were created. The TPM's clock only advances whilst the TPM
+	// is powered on. This is intended for keys that must expire, such as those used during factory provisioning.
+	ClockLimit time.Duration
+
+	// BootLimit, if not zero, limits the number of boots in which the sealed key objects can be unsealed, including the
+	// current one. A value of 1 means that they can only be unsealed until the next TPM reset. This is measured with the
+	// TPM's reset count, which is reset when the TPM is cleared.
+	BootLimit uint32
+
+	// PermittedLocalities, if not zero, restricts the localities from which the sealed key objects can be unsealed. This is
+	// a TPMA_LOCALITY value, so it is either a bitmask of localities 0 to 4 or a single extended locality. This can be used
+	// to ensure that keys can only be unsealed by a component that has access to a locality that isn't available to
+	// user-space.
+	PermittedLocalities tpm2.Locality
+
+	// UnsealOnly restricts the authorization policy of the sealed key objects so that it can only be used to authorize
+	// TPM2_Unseal. Without this, the policy can also be used for other commands that require the USER or DUP role, such as
+	// TPM2_Duplicate for sealed key objects created with SealKeyToExternalTPMStorageKey.
+	UnsealOnly bool
+
+	// LockIndexHandle, if not zero or tpm2.HandleNull, is the handle of a NV index that can be used to lock access to the
+	// sealed key objects until the next TPM reset or restart with LockSealedKeyAccess. If there isn't a NV index at this
+	// handle, one is created. If there is already a lock index at this handle, it is shared with the new sealed key objects.
+	// Sealed key objects with different roles can use different lock indices so that they can be locked independently. It
+	// must be a valid NV index handle (MSO == 0x01), and the same considerations apply to the choice of handle as for
+	// PCRPolicyCounterHandle.
+	LockIndexHandle tpm2.Handle
+
+	// RollbackCounterHandle, if not zero or tpm2.HandleNull, is the handle of a NV counter that is used to prevent the sealed
+	// key objects from being unsealed once the boot chain that they were created for has been superseded by an update. If
+	// there isn't a NV index at this handle, one is created. If there is already a rollback counter at this handle, it is
+	// shared with the new sealed key objects. It must be a valid NV index handle (MSO == 0x01), and the same considerations
+	// apply to the choice of handle as for PCRPolicyCounterHandle.
+	//
+	// The sealed key objects can only be unsealed whilst the value of the counter is not greater than RollbackVersion. The
+	// counter can be advanced with AdvanceRollbackCounter once the update has completed successfully, after which the sealed
+	// key objects created for earlier versions can't be unsealed, even if their PCR policy still authorizes the previous
+	// boot chain.
+	RollbackCounterHandle tpm2.Handle
+
+	// RollbackVersion is the version that is recorded in the sealed key objects for comparison with the rollback counter if
+	// RollbackCounterHandle is set. If this is zero, the current value of the counter is used. It must not be lower than the
+	// current value of the counter. Note that the TPM doesn't initialize a new NV counter to zero, so versions should be
+	// derived from the value returned by ReadRollbackCounter.
+	RollbackVersion uint64
+
+	// BackupKeyFile indicates that a backup copy of each key data file should be maintained alongside it, at the same path
+	// with a ".backup" suffix. Subsequent updates to the sealed key objects write both copies with an incrementing generation
+	// number, alternating which copy is written first, so that an interrupted update never leaves the system without a
+	// loadable sealed key object. ReadSealedKeyObject detects the backup copy and loads the most recent valid copy.
+	BackupKeyFile bool
+
+	// DeviceIdentityBinding specifies whether the identity of this device is recorded in the metadata of the sealed key
+	// objects. The identity consists of a digest of the systemd machine ID and the name of the TPM's endorsement key. If this
+	// is DeviceIdentityBindingEnforce, SealedKeyObject.UnsealFromTPM returns a ErrWrongDevice error without unsealing if the
+	// identity of the current device is different, so that a key file copied to a clone of this device with the same PCR
+	// values isn't unsealed silently. This requires the machine ID to be readable when unsealing.
+	DeviceIdentityBinding DeviceIdentityBinding
+
+	// Rand is the source of randomness used to generate the key for authorizing PCR policy updates if AuthKey is not set, and
+	// the seed value of importable sealed key objects. If this is nil, crypto/rand.Reader is used. This exists so that tests and
+	// test data generators can produce reproducible output, and should not be set otherwise. If this is set, ECDSA keys are
+	// generated with a method that always produces the same key for the same input. RSA keys (PolicyAuthKeyRSA2048) are
+	// still generated with crypto/rsa, which isn't guaranteed to produce the same key for the same input, so the output is
+	// not reproducible when AuthKeyAlgorithm selects RSA. Note that it has no effect on values generated inside the TPM, or
+	// on the encrypted seed of the duplication objects created by SealKeyToExternalTPMStorageKey, which always uses
+	// crypto/rand, so the output of that function is not reproducible.
+	Rand io.Reader
+}
+
+func (p *KeyCreationParams) rand() io.Reader {
+	if p.Rand == nil {
+		return rand.Reader
+	}
+	return p.Rand
+}
+
+// counterTimerAssertions returns the TPM2_PolicyCounterTimer assertions required to enforce ClockLimit and BootLimit,
+// relative to the TPM's current clock and reset count.
+func (p *KeyCreationParams) counterTimerAssertions(tpm *tpm2.TPMContext, session tpm2.SessionContext) ([]policyCounterTimerAssertion, error) {
+	if p.ClockLimit < 0 {
+		return nil, errors.New("invalid ClockLimit")
+	}
+	if p.ClockLimit == 0 && p.BootLimit == 0 {
+		return nil, nil
+	}
+
+	timeInfo, err := tpm.ReadClock(session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read clock: %w", err)
+	}
+
+	var assertions []policyCounterTimerAssertion
+
+	if p.ClockLimit > 0 {
+		limit := timeInfo.ClockInfo.Clock + uint64(p.ClockLimit/time.Millisecond)
+		if limit < timeInfo.ClockInfo.Clock {
+			return nil, errors.New("ClockLimit is too large")
+		}
+		operandB := make(tpm2.Operand, 8)
+		binary.BigEndian.PutUint64(operandB, limit)
+		// The clock is at offset 8 of TPMS_TIME_INFO.
+		assertions = append(assertions, policyCounterTimerAssertion{OperandB: operandB, Offset: 8, Operation: tpm2.OpUnsignedLT})
+	}
+
+	if p.BootLimit > 0 {
+		limit := timeInfo.ClockInfo.ResetCount + p.BootLimit - 1
+		if limit < timeInfo.ClockInfo.ResetCount {
+			return nil, errors.New("BootLimit is too large")
+		}
+		operandB := make(tpm2.Operand, 4)
+		binary.BigEndian.PutUint32(operandB, limit)
+		// The reset count is at offset 16 of TPMS_TIME_INFO.
+		assertions = append(assertions, policyCounterTimerAssertion{OperandB: operandB, Offset: 16, Operation: tpm2.OpUnsignedLE})
+	}
+
+	return assertions, nil
+}
+
+// commandCode returns the command code for the PolicyCommandCode assertion in the static authorization policy, or zero
+// if there shouldn't be one.
+func (p *KeyCreationParams) commandCode() tpm2.CommandCode {
+	if !p.UnsealOnly {
+		return 0
+	}
+	return tpm2.CommandUnseal
+}
+
+// policyAuthKey returns the key used to sign PCR policies and authorize PCR policy revocations for a new sealed
+// key object and its public area. If AuthorizedPolicySigner isn't set, it also returns the private part of the key,
+// which is stored inside the sealed key object.
+func (p *KeyCreationParams) policyAuthKey() (key crypto.PrivateKey, public *tpm2.Public, private PolicyAuthKey, err error) {
+	if p.AuthorizedPolicySigner != nil {
+		public, err = createTPMPublicAreaForPublicKey(p.AuthorizedPolicySigner.Public())
+		if err != nil {
+			return nil, nil, nil, xerrors.Errorf("unsupported AuthorizedPolicySigner: %w", err)
+		}
+		return p.AuthorizedPolicySigner, public, nil, nil
+	}
+
+	// Use the provided authorization key,
+	// otherwise create an asymmetric key for signing
+	// authorization policy updates, and authorizing dynamic
+	// authorization policy revocations.
+	if p.AuthKey != nil {
+		return p.AuthKey, createTPMPublicAreaForECDSAKey(&p.AuthKey.PublicKey), p.AuthKey.D.Bytes(), nil
+	}
+
+	var curve elliptic.Curve
+	switch p.AuthKeyAlgorithm {
+	case PolicyAuthKeyECDSAP256:
+		curve = elliptic.P256()
+	case PolicyAuthKeyECDSAP384:
+		curve = elliptic.P384()
+	case PolicyAuthKeyRSA2048:
+		// rsa.GenerateKey doesn't produce the same key for the same input, even if Rand is set.
+		rsaKey, err := rsa.GenerateKey(p.rand(), 2048)
+		if err != nil {
+			return nil, nil, nil, xerrors.Errorf("cannot generate key for signing dynamic authorization policies: %w", err)
+		}
+		rsaPublic, err := createTPMPublicAreaForPublicKey(&rsaKey.PublicKey)
+		if err != nil {
+			return nil, nil, nil, xerrors.Errorf("cannot create public area for key for signing dynamic authorization policies: %w", err)
+		}
+		return rsaKey, rsaPublic, rsaKey.Primes[0].Bytes(), nil
+	default:
+		return nil, nil, nil, errors.New("invalid AuthKeyAlgorithm")
+	}
+
+	var authKey *ecdsa.PrivateKey
+	if p.Rand != nil {
+		// ecdsa.GenerateKey isn't guaranteed to produce the same key for the same input, so
+		// use a method that does when a deterministic source of randomness is supplied.
+		authKey, err = ecdsautil.GenerateKeyFromReader(curve, p.Rand)
+	} else {
+		authKey, err = ecdsa.GenerateKey(curve, rand.Reader)
+	}
+	if err != nil {
+		return nil, nil, nil, xerrors.Errorf("cannot generate key for signing dynamic authorization policies: %w", err)
+	}
+	return authKey, createTPMPublicAreaForECDSAKey(&authKey.PublicKey), authKey.D.Bytes(), nil
+}
+
+// storageHierarchy returns the hierarchy that the storage key for new sealed key objects is in.
+func (p *KeyCreationParams) storageHierarchy() tpm2.Handle {
+	if p.StorageHierarchy == 0 {
+		return tpm2.HandleOwner
+	}
+	return p.StorageHierarchy
+}
+
+// selectSealingParent returns the storage key that new sealed key objects should be created under. If the storage key
+// is in a hierarchy other than the storage hierarchy, it is a transient object that must be flushed by the caller.
+func (t *Connection) selectSealingParent(params *KeyCreationParams, session tpm2.SessionContext) (tpm2.ResourceContext, error) {
+	switch {
+	case params.storageHierarchy() != tpm2.HandleOwner:
+		switch params.StorageHierarchy {
+		case tpm2.HandleEndorsement, tpm2.HandlePlatform:
+		default:
+			return nil, errors.New("invalid StorageHierarchy")
+		}
+		if params.SRKHandle != 0 {
+			return nil, errors.New("SRKHandle cannot be set with StorageHierarchy")
+		}
+		template := params.SRKTemplate
+		if template == nil {
+			template = tcg.SRKTemplate
+		}
+		if !template.IsParent() {
+			return nil, errors.New("supplied SRK template is not valid for a parent key")
+		}
+		srk, _, _, _, _, err := t.CreatePrimary(t.GetPermanentContext(params.StorageHierarchy), nil, template, nil, nil, session)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot create storage key: %w", err)
+		}
+		return srk, nil
+	case params.SRKHandle != 0 && params.SRKHandle != tcg.SRKHandle:
+		return existingStorageKey(t.TPMContext, params.SRKHandle, params.SRKTemplate, session)
+	case params.SRKTemplate != nil:
+		if !params.SRKTemplate.IsParent() {
+			return nil, errors.New("supplied SRK template is not valid for a parent key")
+		}
+		return ensureStoragePrimaryKey(t.TPMContext, params.SRKTemplate, session)
+	case t.provisionedSrk != nil:
+		// If we're called immediately after EnsureProvisioned without closing the Connection, we use the context cached by
+		// EnsureProvisioned, which corresponds to the object provisioned.
+		return t.provisionedSrk, nil
+	default:
+		// We just unconditionally provision a new SRK as this function requires knowledge of the owner hierarchy authorization
+		// anyway. This way, we know that the primary key we seal to is good and future calls to EnsureProvisioned won't provision
+		// an object that cannot unseal the key we protect.
+		return provisionStoragePrimaryKey(t.TPMContext, session)
+	}
+}
+
+// createImportableSealedKeyObject creates a duplication object containing the supplied key and authorization key, which
+// can be imported in to a TPM under the storage key associated with the supplied public parent. The unique field of pub
+// is updated by this function.
+func createImportableSealedKeyObject(rand io.Reader, pub *tpm2.Public, key []byte, authKey PolicyAuthKey, authValue tpm2.Auth, parent *tpm2.Public) (tpm2.Private, tpm2.EncryptedSecret, error) {
+	// Create the sensitive data
+	sealedData, err := mu.MarshalToBytes(sealedData{Key: key, AuthPrivateKey: authKey})
+	if err != nil {
+		panic(fmt.Sprintf("cannot marshal sensitive data: %v", err))
+	}
+	// Define the actual sensitive area. Note that tpm2.CreateDuplicationObjectFromSensitive
+	// pads the auth value to the length of the name algorithm for us.
+	sensitive := tpm2.Sensitive{
+		Type:      pub.Type,
+		AuthValue: authValue,
+		SeedValue: make(tpm2.Digest, pub.NameAlg.Size()),
+		Sensitive: &tpm2.SensitiveCompositeU{Bits: sealedData}}
+	if _, err := io.ReadFull(rand, sensitive.SeedValue); err != nil {
+		return nil, nil, xerrors.Errorf("cannot create seed value: %w", err)
+	}
+
+	// Compute the public ID
+	h := pub.NameAlg.NewHash()
+	h.Write(sensitive.SeedValue)
+	h.Write(sensitive.Sensitive.Bits)
+	pub.Unique = &tpm2.PublicIDU{KeyedHash: h.Sum(nil)}
+
+	// Now create the importable sealed key object (duplication object).
+	_, priv, importSymSeed, err := tpm2.CreateDuplicationObjectFromSensitive(&sensitive, pub, parent, nil, nil)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot create duplication object: %w", err)
+	}
+
+	return priv, importSymSeed, nil
 }
 
 // SealKeyToExternalTPMStorageKey seals the supplied disk encryption key to the TPM storage key associated with the supplied public
@@ -171,7 +552,8 @@ type KeyCreationParams struct {
 // during early boot in order to unseal the key again and unlock the associated encrypted volume is written to a file at the path
 // specified by keyPath.
 //
-// The tpmKey argument must correspond to the storage primary key on the target TPM, persisted at the standard handle.
+// The tpmKey argument must correspond to the storage primary key on the target TPM, persisted at the standard handle or at the
+// handle specified by the SRKHandle field of the params argument.
 //
 // This function expects there to be no file at the specified path. If keyPath references a file that already exists, a wrapped
 // *os.PathError error will be returned with an underlying error of syscall.EEXIST. A wrapped *os.PathError error will be returned if
@@ -197,38 +579,60 @@ func SealKeyToExternalTPMStorageKey(tpmKey *tpm2.Public, key []byte, keyPath str
 	}
 
 	// Perform some sanity checks on params.
-	if params.AuthKey != nil && params.AuthKey.Curve != elliptic.P256() {
-		return nil, errors.New("provided AuthKey must be from elliptic.P256, no other curve is supported")
+	if params.AuthKey != nil && params.AuthKey.Curve != elliptic.P256() && params.AuthKey.Curve != elliptic.P384() {
+		return nil, errors.New("provided AuthKey must be from elliptic.P256 or elliptic.P384, no other curve is supported")
+	}
+	if params.AuthKey != nil && params.AuthorizedPolicySigner != nil {
+		return nil, errors.New("AuthKey and AuthorizedPolicySigner cannot both be provided")
 	}
 
 	if params.PCRPolicyCounterHandle != tpm2.HandleNull {
 		return nil, errors.New("PCRPolicyCounter must be tpm2.HandleNull when creating an importable sealed key")
 	}
 
+	if params.PINAttemptLimit != 0 {
+		return nil, errors.New("PINAttemptLimit must be zero when creating an importable sealed key")
+	}
+	if params.ClockLimit != 0 || params.BootLimit != 0 {
+		return nil, errors.New("ClockLimit and BootLimit must be zero when creating an importable sealed key")
+	}
+	if params.LockIndexHandle != 0 && params.LockIndexHandle != tpm2.HandleNull {
+		return nil, errors.New("LockIndexHandle must be tpm2.HandleNull when creating an importable sealed key")
+	}
+	if params.RollbackCounterHandle != 0 && params.RollbackCounterHandle != tpm2.HandleNull {
+		return nil, errors.New("RollbackCounterHandle must be tpm2.HandleNull when creating an importable sealed key")
+	}
+	if params.storageHierarchy() != tpm2.HandleOwner {
+		return nil, errors.New("StorageHierarchy must not be set when creating an importable sealed key")
+	}
+	if params.DeviceIdentityBinding != DeviceIdentityBindingNone {
+		return nil, errors.New("DeviceIdentityBinding must not be set when creating an importable sealed key")
+	}
+
+	srkHandle := tcg.SRKHandle
+	if params.SRKHandle != 0 {
+		if params.SRKHandle.Type() != tpm2.HandleTypePersistent {
+			return nil, errors.New("invalid SRK handle")
+		}
+		srkHandle = params.SRKHandle
+	}
+
 	succeeded := false
 
 	// Compute metadata.
 
-	var goAuthKey *ecdsa.PrivateKey
-	// Use the provided authorization key,
-	// otherwise create an asymmetric key for signing
-	// authorization policy updates, and authorizing dynamic
-	// authorization policy revocations.
-	if params.AuthKey != nil {
-		goAuthKey = params.AuthKey
-	} else {
-		goAuthKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-		if err != nil {
-			return nil, xerrors.Errorf("cannot generate key for signing dynamic authorization policies: %w", err)
-		}
+	policyKey, authPublicKey, authKey, err := params.policyAuthKey()
+	if err != nil {
+		return nil, err
 	}
-	authPublicKey := createTPMPublicAreaForECDSAKey(&goAuthKey.PublicKey)
-	authKey = goAuthKey.D.Bytes()
 
 	pub := makeImportableSealedKeyTemplate()
 
 	// Compute the static policy - this never changes for the lifetime of this key file
-	staticPolicyData, authPolicy, err := computeStaticPolicy(pub.NameAlg, &staticPolicyComputeParams{key: authPublicKey})
+	staticPolicyData, authPolicy, err := computeStaticPolicy(pub.NameAlg, &staticPolicyComputeParams{
+		key:         authPublicKey,
+		locality:    params.PermittedLocalities,
+		commandCode: params.commandCode()})
 	if err != nil {
 		return nil, xerrors.Errorf("cannot compute static authorization policy: %w", err)
 	}
@@ -241,10 +645,13 @@ func SealKeyToExternalTPMStorageKey(tpmKey *tpm2.Public, key []byte, keyPath str
 		pcrProfile = &PCRProtectionProfile{}
 	}
 	dynamicPolicyData, err := computeSealedKeyDynamicAuthPolicy(nil, currentMetadataVersion, pub.NameAlg, authPublicKey.NameAlg,
-		goAuthKey, nil, nil, pcrProfile, nil)
+		policyKey, nil, nil, pcrProfile, nil)
 	if err != nil {
 		return nil, xerrors.Errorf("cannot compute dynamic authorization policy: %w", err)
 	}
+	if err := checkPCRSelectionBanks(dynamicPolicyData.pcrSelection, params.RequiredPCRBanks); err != nil {
+		return nil, err
+	}
 
 	// Clean up files on failure.
 	defer func() {
@@ -252,6 +659,9 @@ func SealKeyToExternalTPMStorageKey(tpmKey *tpm2.Public, key []byte, keyPath str
 			return
 		}
 		os.Remove(keyPath)
+		if params.BackupKeyFile {
+			os.Remove(backupKeyPath(keyPath))
+		}
 	}()
 
 	// Seal key
@@ -263,32 +673,10 @@ func SealKeyToExternalTPMStorageKey(tpmKey *tpm2.Public, key []byte, keyPath str
 	}
 	defer f.Close()
 
-	// Create the sensitive data
-	sealedData, err := mu.MarshalToBytes(sealedData{Key: key, AuthPrivateKey: authKey})
+	// Create the importable sealed key object (duplication object). The initial auth value is empty.
+	priv, importSymSeed, err := createImportableSealedKeyObject(params.rand(), pub, key, authKey, nil, tpmKey)
 	if err != nil {
-		panic(fmt.Sprintf("cannot marshal sensitive data: %v", err))
-	}
-	// Define the actual sensitive area. The initial auth value is empty - note
-	// that tpm2.CreateDuplicationObjectFromSensitive pads this to the length of
-	// the name algorithm for us so we don't define it here.
-	sensitive := tpm2.Sensitive{
-		Type:      pub.Type,
-		SeedValue: make(tpm2.Digest, pub.NameAlg.Size()),
-		Sensitive: &tpm2.SensitiveCompositeU{Bits: sealedData}}
-	if _, err := io.ReadFull(rand.Reader, sensitive.SeedValue); err != nil {
-		return nil, xerrors.Errorf("cannot create seed value: %w", err)
-	}
-
-	// Compute the public ID
-	h := pub.NameAlg.NewHash()
-	h.Write(sensitive.SeedValue)
-	h.Write(sensitive.Sensitive.Bits)
-	pub.Unique = &tpm2.PublicIDU{KeyedHash: h.Sum(nil)}
-
-	// Now create the importable sealed key object (duplication object).
-	_, priv, importSymSeed, err := tpm2.CreateDuplicationObjectFromSensitive(&sensitive, pub, tpmKey, nil, nil)
-	if err != nil {
-		return nil, xerrors.Errorf("cannot create duplication object: %w", err)
+		return nil, err
 	}
 
 	// Marshal the entire object (sealed key object and auxiliary data) to disk
@@ -299,11 +687,22 @@ func SealKeyToExternalTPMStorageKey(tpmKey *tpm2.Public, key []byte, keyPath str
 		authModeHint:      authModeNone,
 		importSymSeed:     importSymSeed,
 		staticPolicyData:  staticPolicyData,
-		dynamicPolicyData: dynamicPolicyData}
+		dynamicPolicyData: dynamicPolicyData,
+		srkHandle:         srkHandle,
+		srkPublic:         tpmKey,
+		requiredPCRBanks:  params.RequiredPCRBanks}
 
 	if err := data.write(f); err != nil {
 		return nil, xerrors.Errorf("cannot write key data file: %w", err)
 	}
+	if params.BackupKeyFile {
+		if err := writeKeyDataGeneration(f, 1); err != nil {
+			return nil, xerrors.Errorf("cannot write key data file: %w", err)
+		}
+		if err := data.writeToFileAtomicWithGeneration(backupKeyPath(keyPath), 1); err != nil {
+			return nil, xerrors.Errorf("cannot write backup key data file: %w", err)
+		}
+	}
 
 	succeeded = true
 	return authKey, nil
@@ -314,6 +713,12 @@ func SealKeyToExternalTPMStorageKey(tpmKey *tpm2.Public, key []byte, keyPath str
 type SealKeyRequest struct {
 	Key  []byte
 	Path string
+
+	// NVIndexHandle optionally specifies the handle of a NV index in which to store the
+	// sealed key object instead of a file, in which case Path is ignored. The index is
+	// defined by SealKeyToTPMMultiple. See SealedKeyObject.MigrateToNVIndex for details of
+	// the protections it has. It is not used if this is zero.
+	NVIndexHandle tpm2.Handle
 }
 
 // SealKeyToTPMMultiple seals the supplied disk encryption keys to the storage hierarchy of the TPM. The keys are specified by
@@ -339,6 +744,38 @@ type SealKeyRequest struct {
 // All keys will be created with the same authorization policy, and will be protected with a PCR policy computed from the
 // PCRProtectionProfile supplied via the PCRProfile field of the params argument.
 //
+// If the PINAttemptLimit field of the params argument is not zero, this function will also create a NV index at the handle
+// specified by the PINIndexHandle field of the params argument, which is used to limit the number of incorrect PIN attempts.
+// If the handle is already in use, a TPMResourceExistsError error will be returned. All keys share this index, so incorrect
+// PIN attempts against any of them count towards the same limit.
+//
+// If the ClockLimit or BootLimit fields of the params argument are not zero, the keys can only be unsealed until the TPM's clock
+// has advanced by the specified amount or until the specified number of boots have occurred. After this, SealedKeyObject.UnsealFromTPM
+// will return a ErrKeyExpired error. These limits are part of the static authorization policy and cannot be changed later.
+//
+// If the LockIndexHandle field of the params argument is set, this function will create a NV index at that handle which can be
+// used to lock access to the keys with LockSealedKeyAccess, or use the existing lock index at that handle. If there is a
+// different NV index at that handle, a TPMResourceExistsError error will be returned.
+//
+// If the RollbackCounterHandle field of the params argument is set, this function will create a NV counter at that handle, or
+// use the existing rollback counter at that handle, and the keys can only be unsealed until the counter is advanced beyond the
+// version specified by the RollbackVersion field with AdvanceRollbackCounter. If there is a different NV index at that handle,
+// a TPMResourceExistsError error will be returned.
+//
+// If the DeviceIdentityBinding field of the params argument is set, the identity of this device is recorded in the metadata of
+// each sealed key file and can be checked later with SealedKeyObject.CheckDeviceIdentity. This requires the systemd machine ID to
+// be readable.
+//
+// If the NVIndexHandle field of a key request is set, the sealed key object for that key is stored in a NV index defined at that
+// handle instead of a file, and can be loaded with ReadSealedKeyObjectFromNVIndex. If the handle is already in use, a
+// TPMResourceExistsError error will be returned.
+//
+// The keys will be created under the storage key specified by the SRKHandle and SRKTemplate fields of the params argument, or the
+// storage root key at the standard handle if these aren't set. The handle and public area of this storage key are recorded in the
+// metadata of each sealed key file so that the correct parent is used and validated during unsealing. If SRKHandle is a
+// non-standard handle and there is no object at this handle, a ErrTPMProvisioning error will be returned. If SRKTemplate is set
+// and there is an object at the standard handle that wasn't created with it, a TPMResourceExistsError error will be returned.
+//
 // If any part of this function fails, no sealed keys will be created.
 //
 // On success, this function returns the private part of the key used for authorizing PCR policy updates with
@@ -348,7 +785,24 @@ type SealKeyRequest struct {
 //
 // The authorization key can also be chosen and provided by setting
 // AuthKey in the params argument.
+//
+// This function is subject to ConnectionOptions.RequireEncryptedSessions.
 func SealKeyToTPMMultiple(tpm *Connection, keys []*SealKeyRequest, params *KeyCreationParams) (authKey PolicyAuthKey, err error) {
+	return SealKeyToTPMMultipleContext(context.Background(), tpm, keys, params)
+}
+
+// SealKeyToTPMMultipleContext is the same as SealKeyToTPMMultiple, but the operation is aborted if the supplied context is
+// cancelled or its deadline expires. This is checked between each of the TPM operations performed by this function - a TPM
+// command that is already in progress runs to completion. If the operation is aborted, any NV indices and files that were
+// created are removed and the context's error is returned.
+func SealKeyToTPMMultipleContext(ctx context.Context, tpm *Connection, keys []*SealKeyRequest, params *KeyCreationParams) (authKey PolicyAuthKey, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := tpm.checkEncryptedSessionsAvailable(); err != nil {
+		return nil, err
+	}
+
 	// params is mandatory.
 	if params == nil {
 		return nil, errors.New("no KeyCreationParams provided")
@@ -356,28 +810,56 @@ func SealKeyToTPMMultiple(tpm *Connection, keys []*SealKeyRequest, params *KeyCr
 	if len(keys) == 0 {
 		return nil, errors.New("no keys provided")
 	}
+	for _, key := range keys {
+		if key.NVIndexHandle != 0 && key.NVIndexHandle.Type() != tpm2.HandleTypeNVIndex {
+			return nil, errors.New("invalid NVIndexHandle")
+		}
+	}
 
 	// Perform some sanity checks on params.
-	if params.AuthKey != nil && params.AuthKey.Curve != elliptic.P256() {
-		return nil, errors.New("provided AuthKey must be from elliptic.P256, no other curve is supported")
+	switch h := params.PCRPolicyCounterHandle; {
+	case h == NoPCRPolicyCounterHandle, h == AutoPCRPolicyCounterHandle:
+	case h.Type() != tpm2.HandleTypeNVIndex:
+		return nil, errors.New("invalid PCRPolicyCounterHandle")
+	}
+	if params.AuthKey != nil && params.AuthKey.Curve != elliptic.P256() && params.AuthKey.Curve != elliptic.P384() {
+		return nil, errors.New("provided AuthKey must be from elliptic.P256 or elliptic.P384, no other curve is supported")
+	}
+	if params.AuthKey != nil && params.AuthorizedPolicySigner != nil {
+		return nil, errors.New("AuthKey and AuthorizedPolicySigner cannot both be provided")
 	}
 
 	// Use the HMAC session created when the connection was opened rather than creating a new one.
 	session := tpm.HmacSession()
 
-	// Obtain a context for the SRK now. If we're called immediately after ProvisionTPM without closing the Connection, we use the
-	// context cached by ProvisionTPM, which corresponds to the object provisioned. If not, we just unconditionally provision a new
-	// SRK as this function requires knowledge of the owner hierarchy authorization anyway. This way, we know that the primary key we
-	// seal to is good and future calls to ProvisionTPM won't provision an object that cannot unseal the key we protect.
-	srk := tpm.provisionedSrk
-	if srk == nil {
-		var err error
-		srk, err = provisionStoragePrimaryKey(tpm.TPMContext, session)
-		switch {
-		case isAuthFailError(err, tpm2.AnyCommandCode, 1):
-			return nil, AuthFailError{tpm2.HandleOwner}
-		case err != nil:
-			return nil, xerrors.Errorf("cannot provision storage root key: %w", err)
+	// Obtain a context for the SRK now.
+	srk, err := tpm.selectSealingParent(params, session)
+	var existsErr TPMResourceExistsError
+	switch {
+	case err == ErrTPMProvisioning:
+		return nil, err
+	case xerrors.As(err, &existsErr):
+		return nil, existsErr
+	case isAuthFailError(err, tpm2.AnyCommandCode, 1):
+		return nil, AuthFailError{params.storageHierarchy()}
+	case err != nil:
+		return nil, xerrors.Errorf("cannot provision storage root key: %w", err)
+	}
+
+	// Record the public area of the SRK in the metadata so that it can be validated during unsealing.
+	srkHandle := srk.Handle()
+	srkPublic, _, _, err := tpm.ReadPublic(srk, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read public area of storage root key: %w", err)
+	}
+	if srkHandle.Type() == tpm2.HandleTypeTransient {
+		// The storage key is recreated in the selected hierarchy each time it is
+		// required, so record the hierarchy and the template it was created from.
+		defer tpm.FlushContext(srk)
+		srkHandle = params.StorageHierarchy
+		srkPublic = params.SRKTemplate
+		if srkPublic == nil {
+			srkPublic = tcg.SRKTemplate
 		}
 	}
 
@@ -385,33 +867,27 @@ func SealKeyToTPMMultiple(tpm *Connection, keys []*SealKeyRequest, params *KeyCr
 
 	// Compute metadata.
 
-	var goAuthKey *ecdsa.PrivateKey
-	// Use the provided authorization key,
-	// otherwise create an asymmetric key for signing
-	// authorization policy updates, and authorizing dynamic
-	// authorization policy revocations.
-	if params.AuthKey != nil {
-		goAuthKey = params.AuthKey
-	} else {
-		goAuthKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-		if err != nil {
-			return nil, xerrors.Errorf("cannot generate key for signing dynamic authorization policies: %w", err)
-		}
+	policyKey, authPublicKey, authKey, err := params.policyAuthKey()
+	if err != nil {
+		return nil, err
 	}
-	authPublicKey := createTPMPublicAreaForECDSAKey(&goAuthKey.PublicKey)
 	authKeyName, err := authPublicKey.Name()
 	if err != nil {
 		return nil, xerrors.Errorf("cannot compute name of signing key for dynamic policy authorization: %w", err)
 	}
-	authKey = goAuthKey.D.Bytes()
 
 	// Create PCR policy counter, if requested.
 	var pcrPolicyCounterPub *tpm2.NVPublic
 	if params.PCRPolicyCounterHandle != tpm2.HandleNull {
-		pcrPolicyCounterPub, err = createPcrPolicyCounter(tpm.TPMContext, params.PCRPolicyCounterHandle, authKeyName, session)
+		handle := params.PCRPolicyCounterHandle
+		if handle == AutoPCRPolicyCounterHandle {
+			pcrPolicyCounterPub, handle, err = createPcrPolicyCounterAtFreeHandle(tpm.TPMContext, authKeyName, session)
+		} else {
+			pcrPolicyCounterPub, err = createPcrPolicyCounter(tpm.TPMContext, handle, authKeyName, session)
+		}
 		switch {
 		case tpm2.IsTPMError(err, tpm2.ErrorNVDefined, tpm2.CommandNVDefineSpace):
-			return nil, TPMResourceExistsError{params.PCRPolicyCounterHandle}
+			return nil, TPMResourceExistsError{handle}
 		case isAuthFailError(err, tpm2.CommandNVDefineSpace, 1):
 			return nil, AuthFailError{tpm2.HandleOwner}
 		case err != nil:
@@ -429,16 +905,135 @@ func SealKeyToTPMMultiple(tpm *Connection, keys []*SealKeyRequest, params *KeyCr
 		}()
 	}
 
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Create PIN index, if requested.
+	var pinIndexPub *tpm2.NVPublic
+	if params.PINAttemptLimit != 0 {
+		pinIndexPub, err = createPinIndex(tpm.TPMContext, params.PINIndexHandle, params.PINAttemptLimit, session)
+		switch {
+		case tpm2.IsTPMError(err, tpm2.ErrorNVDefined, tpm2.CommandNVDefineSpace):
+			return nil, TPMResourceExistsError{params.PINIndexHandle}
+		case isAuthFailError(err, tpm2.CommandNVDefineSpace, 1):
+			return nil, AuthFailError{tpm2.HandleOwner}
+		case err != nil:
+			return nil, xerrors.Errorf("cannot create new PIN index: %w", err)
+		}
+		defer func() {
+			if succeeded {
+				return
+			}
+			index, err := tpm2.CreateNVIndexResourceContextFromPublic(pinIndexPub)
+			if err != nil {
+				return
+			}
+			tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, session)
+		}()
+	}
+
+	// Create or obtain the lock index, if requested.
+	var lockIndexPub *tpm2.NVPublic
+	if params.LockIndexHandle != 0 && params.LockIndexHandle != tpm2.HandleNull {
+		var created bool
+		lockIndexPub, created, err = ensureLockIndex(tpm.TPMContext, params.LockIndexHandle, session)
+		switch {
+		case xerrors.As(err, &existsErr):
+			return nil, existsErr
+		case isAuthFailError(err, tpm2.CommandNVDefineSpace, 1):
+			return nil, AuthFailError{tpm2.HandleOwner}
+		case err != nil:
+			return nil, xerrors.Errorf("cannot create lock index: %w", err)
+		}
+		if created {
+			defer func() {
+				if succeeded {
+					return
+				}
+				index, err := tpm2.CreateNVIndexResourceContextFromPublic(lockIndexPub)
+				if err != nil {
+					return
+				}
+				tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, session)
+			}()
+		}
+	}
+
+	// Create or obtain the rollback counter, if requested.
+	var rollbackCounterPub *tpm2.NVPublic
+	rollbackVersion := params.RollbackVersion
+	if params.RollbackCounterHandle != 0 && params.RollbackCounterHandle != tpm2.HandleNull {
+		var created bool
+		rollbackCounterPub, created, err = ensureRollbackCounter(tpm.TPMContext, params.RollbackCounterHandle, session)
+		switch {
+		case xerrors.As(err, &existsErr):
+			return nil, existsErr
+		case isAuthFailError(err, tpm2.CommandNVDefineSpace, 1):
+			return nil, AuthFailError{tpm2.HandleOwner}
+		case err != nil:
+			return nil, xerrors.Errorf("cannot create rollback counter: %w", err)
+		}
+		if created {
+			defer func() {
+				if succeeded {
+					return
+				}
+				index, err := tpm2.CreateNVIndexResourceContextFromPublic(rollbackCounterPub)
+				if err != nil {
+					return
+				}
+				tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, session)
+			}()
+		}
+
+		index, err := tpm2.CreateNVIndexResourceContextFromPublic(rollbackCounterPub)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot create context for rollback counter: %w", err)
+		}
+		current, err := readRollbackCounter(tpm.TPMContext, index, session)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read rollback counter: %w", err)
+		}
+		switch {
+		case rollbackVersion == 0:
+			rollbackVersion = current
+		case rollbackVersion < current:
+			return nil, fmt.Errorf("RollbackVersion (%d) is lower than the current value of the rollback counter (%d)", rollbackVersion, current)
+		}
+	}
+
+	// Compute the assertions used to limit the lifetime of the keys, if requested.
+	counterTimerAssertions, err := params.counterTimerAssertions(tpm.TPMContext, session)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute lifetime limits: %w", err)
+	}
+
+	// Record the identity of this device, if requested.
+	identity, err := readDeviceIdentity(tpm, params.DeviceIdentityBinding)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot determine device identity: %w", err)
+	}
+
 	template := makeSealedKeyTemplate()
 
 	// Compute the static policy - this never changes for the lifetime of this key file
 	staticPolicyData, authPolicy, err := computeStaticPolicy(template.NameAlg, &staticPolicyComputeParams{
-		key:                 authPublicKey,
-		pcrPolicyCounterPub: pcrPolicyCounterPub})
+		key:                    authPublicKey,
+		pcrPolicyCounterPub:    pcrPolicyCounterPub,
+		pinIndexPub:            pinIndexPub,
+		counterTimerAssertions: counterTimerAssertions,
+		locality:               params.PermittedLocalities,
+		commandCode:            params.commandCode(),
+		lockIndexPub:           lockIndexPub,
+		rollbackCounterPub:     rollbackCounterPub,
+		rollbackVersion:        rollbackVersion})
 	if err != nil {
 		return nil, xerrors.Errorf("cannot compute static authorization policy: %w", err)
 	}
 
+	logger.Debug("tpm2-compute-static-policy", logger.F("auth-policy", authPolicy))
+
 	// Define the template for the sealed key object, using the computed policy digest
 	template.AuthPolicy = authPolicy
 
@@ -448,10 +1043,13 @@ func SealKeyToTPMMultiple(tpm *Connection, keys []*SealKeyRequest, params *KeyCr
 		pcrProfile = &PCRProtectionProfile{}
 	}
 	dynamicPolicyData, err := computeSealedKeyDynamicAuthPolicy(tpm.TPMContext, currentMetadataVersion, template.NameAlg,
-		authPublicKey.NameAlg, goAuthKey, pcrPolicyCounterPub, nil, pcrProfile, session)
+		authPublicKey.NameAlg, policyKey, pcrPolicyCounterPub, nil, pcrProfile, session)
 	if err != nil {
 		return nil, xerrors.Errorf("cannot compute dynamic authorization policy: %w", err)
 	}
+	if err := checkPCRSelectionBanks(dynamicPolicyData.pcrSelection, params.RequiredPCRBanks); err != nil {
+		return nil, err
+	}
 
 	// Clean up files on failure.
 	defer func() {
@@ -459,20 +1057,33 @@ func SealKeyToTPMMultiple(tpm *Connection, keys []*SealKeyRequest, params *KeyCr
 			return
 		}
 		for _, key := range keys {
+			if key.NVIndexHandle != 0 {
+				continue
+			}
 			os.Remove(key.Path)
+			if params.BackupKeyFile {
+				os.Remove(backupKeyPath(key.Path))
+			}
 		}
 	}()
 
 	// Seal each key.
 	for _, key := range keys {
-		// Create the destination file
-		f, err := os.OpenFile(key.Path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
-		if err != nil {
-			return nil, xerrors.Errorf("cannot create key data file %s: %w", key.Path, err)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		// Create the destination file, unless the key data is being stored in a NV index
+		var f *os.File
+		if key.NVIndexHandle == 0 {
+			f, err = os.OpenFile(key.Path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				return nil, xerrors.Errorf("cannot create key data file %s: %w", key.Path, err)
+			}
+			// We'll close this at the end of this loop, but make sure it is closed if the function
+			// returns early
+			defer f.Close()
 		}
-		// We'll close this at the end of this loop, but make sure it is closed if the function
-		// returns early
-		defer f.Close()
 
 		// Create the sensitive data
 		sealedData, err := mu.MarshalToBytes(sealedData{Key: key.Key, AuthPrivateKey: authKey})
@@ -496,18 +1107,55 @@ func SealKeyToTPMMultiple(tpm *Connection, keys []*SealKeyRequest, params *KeyCr
 			keyPublic:         pub,
 			authModeHint:      authModeNone,
 			staticPolicyData:  staticPolicyData,
-			dynamicPolicyData: dynamicPolicyData}
+			dynamicPolicyData: dynamicPolicyData,
+			srkHandle:         srkHandle,
+			srkPublic:         srkPublic,
+			deviceIdentity:    identity,
+			requiredPCRBanks:  params.RequiredPCRBanks}
+
+		if f == nil {
+			nvPub, err := defineKeyDataNVIndex(tpm, key.NVIndexHandle, &data, session)
+			if err != nil {
+				return nil, err
+			}
+			defer func() {
+				if succeeded {
+					return
+				}
+				index, err := tpm2.CreateNVIndexResourceContextFromPublic(nvPub)
+				if err != nil {
+					return
+				}
+				tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, session)
+			}()
+			if err := writeKeyDataToNVIndex(tpm.TPMContext, key.NVIndexHandle, &data, session); err != nil {
+				return nil, xerrors.Errorf("cannot write key data to NV index: %w", err)
+			}
+			continue
+		}
 
 		if err := data.write(f); err != nil {
 			return nil, xerrors.Errorf("cannot write key data file: %w", err)
 		}
+		if params.BackupKeyFile {
+			if err := writeKeyDataGeneration(f, 1); err != nil {
+				return nil, xerrors.Errorf("cannot write key data file: %w", err)
+			}
+			if err := data.writeToFileAtomicWithGeneration(backupKeyPath(key.Path), 1); err != nil {
+				return nil, xerrors.Errorf("cannot write backup key data file %s: %w", key.Path, err)
+			}
+		}
 
 		f.Close()
 	}
 
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	// Increment the PCR policy counter for the first time.
 	if pcrPolicyCounterPub != nil {
-		if err := incrementPcrPolicyCounter(tpm.TPMContext, currentMetadataVersion, pcrPolicyCounterPub, nil, goAuthKey, authPublicKey,
+		if err := incrementPcrPolicyCounter(tpm.TPMContext, currentMetadataVersion, pcrPolicyCounterPub, nil, policyKey, authPublicKey,
 			session); err != nil {
 			return nil, xerrors.Errorf("cannot increment PCR policy counter: %w", err)
 		}
@@ -517,6 +1165,29 @@ func SealKeyToTPMMultiple(tpm *Connection, keys []*SealKeyRequest, params *KeyCr
 	return authKey, nil
 }
 
+// sealKeyEstimatedDuration is an estimate of the time taken by SealKeyToTPMMultiple on slow
+// hardware, used for reporting the progress of an enrollment.
+const sealKeyEstimatedDuration = 2 * time.Second
+
+// NewSealKeyToTPMMultipleStep returns a secboot.EnrollmentStep that calls SealKeyToTPMMultiple with the
+// supplied arguments, for use with secboot.Enrollment. On success, the private part of the key used for
+// authorizing PCR policy updates is passed to the supplied callback if it isn't nil.
+func NewSealKeyToTPMMultipleStep(tpm *Connection, keys []*SealKeyRequest, params *KeyCreationParams, done func(PolicyAuthKey)) *secboot.EnrollmentStep {
+	return &secboot.EnrollmentStep{
+		Description:       "Sealing keys to the TPM",
+		EstimatedDuration: sealKeyEstimatedDuration,
+		Run: func() error {
+			authKey, err := SealKeyToTPMMultiple(tpm, keys, params)
+			if err != nil {
+				return err
+			}
+			if done != nil {
+				done(authKey)
+			}
+			return nil
+		}}
+}
+
 // SealKeyToTPM seals the supplied disk encryption key to the storage hierarchy of the TPM. The sealed key object and associated
 // metadata that is required during early boot in order to unseal the key again and unlock the associated encrypted volume is written
 // to a file at the path specified by keyPath.
@@ -542,6 +1213,9 @@ func SealKeyToTPMMultiple(tpm *Connection, keys []*SealKeyRequest, params *KeyCr
 // The key will be protected with a PCR policy computed from the PCRProtectionProfile supplied via the PCRProfile field of the params
 // argument.
 //
+// The key will be created under the storage key specified by the SRKHandle and SRKTemplate fields of the params argument - see the
+// documentation for SealKeyToTPMMultiple for details.
+//
 // On success, this function returns the private part of the key used for authorizing PCR policy updates with
 // UpdateKeyPCRProtectionPolicy. This key doesn't need to be stored anywhere, and certainly mustn't be stored outside of the encrypted
 // volume protected with this sealed key file. The key is stored encrypted inside this sealed key file and returned from future calls
@@ -549,18 +1223,26 @@ func SealKeyToTPMMultiple(tpm *Connection, keys []*SealKeyRequest, params *KeyCr
 //
 // The authorization key can also be chosen and provided by setting
 // AuthKey in the params argument.
+//
+// This function is subject to ConnectionOptions.RequireEncryptedSessions.
 func SealKeyToTPM(tpm *Connection, key []byte, keyPath string, params *KeyCreationParams) (authKey PolicyAuthKey, err error) {
 	return SealKeyToTPMMultiple(tpm, []*SealKeyRequest{{Key: key, Path: keyPath}}, params)
 }
 
-func updateKeyPCRProtectionPolicyCommon(tpm *tpm2.TPMContext, keys []*SealedKeyObject, authKey crypto.PrivateKey, pcrProfile *PCRProtectionProfile, session tpm2.SessionContext) error {
+// SealKeyToTPMContext is the same as SealKeyToTPM, but the operation is aborted if the supplied context is cancelled or its
+// deadline expires. See SealKeyToTPMMultipleContext for details.
+func SealKeyToTPMContext(ctx context.Context, tpm *Connection, key []byte, keyPath string, params *KeyCreationParams) (authKey PolicyAuthKey, err error) {
+	return SealKeyToTPMMultipleContext(ctx, tpm, []*SealKeyRequest{{Key: key, Path: keyPath}}, params)
+}
+
+func updateKeyPCRProtectionPolicyCommon(tpm *tpm2.TPMContext, keys []*SealedKeyObject, authKey crypto.PrivateKey, pcrProfile *PCRProtectionProfile, revoke bool, session tpm2.SessionContext) error {
 	primaryData := keys[0].data
 
 	// Validate the primary key object
 	pcrPolicyCounterPub, err := primaryData.validate(tpm, authKey, session)
 	if err != nil {
 		if isKeyFileError(err) {
-			return InvalidKeyFileError{err.Error()}
+			return InvalidKeyFileError{msg: err.Error()}
 		}
 		// FIXME: Turn the missing lock NV index in to ErrTPMProvisioning
 		return xerrors.Errorf("cannot validate key data: %w", err)
@@ -570,7 +1252,7 @@ func updateKeyPCRProtectionPolicyCommon(tpm *tpm2.TPMContext, keys []*SealedKeyO
 	for i, k := range keys[1:] {
 		if _, err := k.data.validate(tpm, nil, session); err != nil {
 			if isKeyFileError(err) {
-				return InvalidKeyFileError{fmt.Sprintf("%v (%d)", err.Error(), i)}
+				return InvalidKeyFileError{msg: fmt.Sprintf("%v (%d)", err.Error(), i)}
 			}
 			// FIXME: Turn the missing lock NV index in to ErrTPMProvisioning
 			return xerrors.Errorf("cannot validate related key data: %w", err)
@@ -581,7 +1263,7 @@ func updateKeyPCRProtectionPolicyCommon(tpm *tpm2.TPMContext, keys []*SealedKeyO
 		// and dynamic authorization policy signing key, so this is the only check required to determine
 		// if 2 keys are related.
 		if !bytes.Equal(k.data.keyPublic.AuthPolicy, primaryData.keyPublic.AuthPolicy) {
-			return InvalidKeyFileError{fmt.Sprintf("key data at index %d is not related to the primary key data", i)}
+			return InvalidKeyFileError{msg: fmt.Sprintf("key data at index %d is not related to the primary key data", i)}
 		}
 	}
 
@@ -597,17 +1279,20 @@ func updateKeyPCRProtectionPolicyCommon(tpm *tpm2.TPMContext, keys []*SealedKeyO
 	if err != nil {
 		return xerrors.Errorf("cannot compute dynamic authorization policy: %w", err)
 	}
+	if err := checkPCRSelectionBanks(policyData.pcrSelection, primaryData.requiredPCRBanks); err != nil {
+		return err
+	}
 
 	// Atomically update the key data files
 	for _, k := range keys {
 		k.data.dynamicPolicyData = policyData
 
-		if err := k.data.writeToFileAtomic(k.path); err != nil {
-			return xerrors.Errorf("cannot write key data file: %v", err)
+		if err := k.write(tpm, session); err != nil {
+			return xerrors.Errorf("cannot write key data: %v", err)
 		}
 	}
 
-	if pcrPolicyCounterPub == nil {
+	if pcrPolicyCounterPub == nil || !revoke {
 		return nil
 	}
 
@@ -637,13 +1322,13 @@ func (k *SealedKeyObject) UpdatePCRProtectionPolicyV0(tpm *Connection, policyUpd
 
 	policyUpdateData, err := decodeKeyPolicyUpdateData(policyUpdateFile)
 	if err != nil {
-		return InvalidKeyFileError{fmt.Sprintf("cannot read dynamic policy update data: %v", err)}
+		return InvalidKeyFileError{msg: fmt.Sprintf("cannot read dynamic policy update data: %v", err)}
 	}
 	if policyUpdateData.version != k.data.version {
-		return InvalidKeyFileError{"mismatched metadata versions"}
+		return InvalidKeyFileError{msg: "mismatched metadata versions"}
 	}
 
-	return updateKeyPCRProtectionPolicyCommon(tpm.TPMContext, []*SealedKeyObject{k}, policyUpdateData.authKey, pcrProfile, tpm.HmacSession())
+	return updateKeyPCRProtectionPolicyCommon(tpm.TPMContext, []*SealedKeyObject{k}, policyUpdateData.authKey, pcrProfile, true, tpm.HmacSession())
 }
 
 // UpdatePCRProtectionPolicy updates the PCR protection policy for this sealed key object to the profile defined by the
@@ -654,13 +1339,97 @@ func (k *SealedKeyObject) UpdatePCRProtectionPolicyV0(tpm *Connection, policyUpd
 //
 // On success, the sealed key data file is updated atomically with an updated authorization policy that includes a PCR policy
 // computed from the supplied PCRProtectionProfile. If the sealed key data file was created with a PCR policy counter, the
-// previous PCR policy will be revoked.
+// previous PCR policy will be revoked. Use UpdatePCRProtectionPolicyNoRevoke to defer revocation.
 func (k *SealedKeyObject) UpdatePCRProtectionPolicy(tpm *Connection, authKey PolicyAuthKey, pcrProfile *PCRProtectionProfile) error {
-	ecdsaAuthKey, err := createECDSAPrivateKeyFromTPM(k.data.staticPolicyData.authPublicKey, tpm2.ECCParameter(authKey))
+	policyAuthKey, err := createPolicyAuthKeyFromTPM(k.data.staticPolicyData.authPublicKey, authKey)
+	if err != nil {
+		return InvalidKeyFileError{msg: fmt.Sprintf("cannot create auth key: %v", err)}
+	}
+	return updateKeyPCRProtectionPolicyCommon(tpm.TPMContext, []*SealedKeyObject{k}, policyAuthKey, pcrProfile, true, tpm.HmacSession())
+}
+
+// UpdatePCRProtectionPolicyNoRevoke behaves like UpdatePCRProtectionPolicy, except that the previous PCR policy is not
+// revoked. This permits a new PCR policy to be staged before a system update whilst the current one remains valid, so
+// that it is still possible to boot the current system if the update fails. Once the system has booted successfully
+// with the new PCR policy, the previous one should be revoked by calling SealedKeyObject.RevokeOldPCRProtectionPolicies.
+func (k *SealedKeyObject) UpdatePCRProtectionPolicyNoRevoke(tpm *Connection, authKey PolicyAuthKey, pcrProfile *PCRProtectionProfile) error {
+	policyAuthKey, err := createPolicyAuthKeyFromTPM(k.data.staticPolicyData.authPublicKey, authKey)
+	if err != nil {
+		return InvalidKeyFileError{msg: fmt.Sprintf("cannot create auth key: %v", err)}
+	}
+	return updateKeyPCRProtectionPolicyCommon(tpm.TPMContext, []*SealedKeyObject{k}, policyAuthKey, pcrProfile, false, tpm.HmacSession())
+}
+
+// UpdatePCRProtectionPolicyWithSigner updates the PCR protection policy for this sealed key object to the profile
+// defined by the pcrProfile argument, using the supplied signer to authorize the new policy. This must be used for
+// sealed key objects that were created with KeyCreationParams.AuthorizedPolicySigner, and the signer must have the
+// same public key.
+//
+// If validation of the sealed key data fails, a InvalidKeyFileError error will be returned.
+//
+// On success, the sealed key data file is updated atomically with an updated authorization policy that includes a PCR
+// policy computed from the supplied PCRProtectionProfile. If the sealed key data file was created with a PCR policy
+// counter, the previous PCR policy will be revoked, which requires the signer to authorize incrementing the counter.
+func (k *SealedKeyObject) UpdatePCRProtectionPolicyWithSigner(tpm *Connection, signer crypto.Signer, pcrProfile *PCRProtectionProfile) error {
+	if signer == nil {
+		return errors.New("no signer provided")
+	}
+	return updateKeyPCRProtectionPolicyCommon(tpm.TPMContext, []*SealedKeyObject{k}, signer, pcrProfile, true, tpm.HmacSession())
+}
+
+// RevokeOldPCRProtectionPolicies revokes PCR policies associated with this sealed key object that are older than the
+// current one, by advancing the PCR policy counter. In order to do this, the caller must also specify the private part
+// of the authorization key that was either returned by SealKeyToTPM or SealedKeyObject.UnsealFromTPM.
+//
+// Any sealed key object that is related to this one and which has a PCR policy that is older than the one associated
+// with this object will no longer be unsealable once this function completes successfully.
+//
+// If the sealed key data file was not created with a PCR policy counter, this function does nothing.
+//
+// If validation of the sealed key data fails, a InvalidKeyFileError error will be returned. A InvalidKeyFileError error
+// will also be returned if the PCR policy associated with this sealed key object has already been revoked.
+func (k *SealedKeyObject) RevokeOldPCRProtectionPolicies(tpm *Connection, authKey PolicyAuthKey) error {
+	policyAuthKey, err := createPolicyAuthKeyFromTPM(k.data.staticPolicyData.authPublicKey, authKey)
 	if err != nil {
-		return InvalidKeyFileError{fmt.Sprintf("cannot create auth key: %v", err)}
+		return InvalidKeyFileError{msg: fmt.Sprintf("cannot create auth key: %v", err)}
+	}
+
+	session := tpm.HmacSession()
+
+	pcrPolicyCounterPub, err := k.data.validate(tpm.TPMContext, policyAuthKey, session)
+	if err != nil {
+		if isKeyFileError(err) {
+			return InvalidKeyFileError{msg: err.Error()}
+		}
+		return xerrors.Errorf("cannot validate key data: %w", err)
+	}
+
+	if pcrPolicyCounterPub == nil {
+		return nil
+	}
+
+	authPublicKey := k.data.staticPolicyData.authPublicKey
+	v0PinIndexAuthPolicies := k.data.staticPolicyData.v0PinIndexAuthPolicies
+	target := k.data.dynamicPolicyData.policyCount
+
+	for {
+		current, err := readPcrPolicyCounter(tpm.TPMContext, k.data.version, pcrPolicyCounterPub, v0PinIndexAuthPolicies, session)
+		if err != nil {
+			return xerrors.Errorf("cannot read PCR policy counter: %w", err)
+		}
+		if current > target {
+			return InvalidKeyFileError{msg: "the PCR policy has already been revoked"}
+		}
+		if current == target {
+			break
+		}
+
+		if err := incrementPcrPolicyCounter(tpm.TPMContext, k.data.version, pcrPolicyCounterPub, v0PinIndexAuthPolicies, policyAuthKey, authPublicKey, session); err != nil {
+			return xerrors.Errorf("cannot revoke old PCR policies: %w", err)
+		}
 	}
-	return updateKeyPCRProtectionPolicyCommon(tpm.TPMContext, []*SealedKeyObject{k}, ecdsaAuthKey, pcrProfile, tpm.HmacSession())
+
+	return nil
 }
 
 // UpdateKeyPCRProtectionPolicyMultiple updates the PCR protection policy for the supplied sealed key objects to the
@@ -679,10 +1448,26 @@ func UpdateKeyPCRProtectionPolicyMultiple(tpm *Connection, keys []*SealedKeyObje
 		return errors.New("no sealed keys supplied")
 	}
 
-	ecdsaAuthKey, err := createECDSAPrivateKeyFromTPM(keys[0].data.staticPolicyData.authPublicKey, tpm2.ECCParameter(authKey))
+	policyAuthKey, err := createPolicyAuthKeyFromTPM(keys[0].data.staticPolicyData.authPublicKey, authKey)
+	if err != nil {
+		return InvalidKeyFileError{msg: fmt.Sprintf("cannot create auth key: %v", err)}
+	}
+
+	return updateKeyPCRProtectionPolicyCommon(tpm.TPMContext, keys, policyAuthKey, pcrProfile, true, tpm.HmacSession())
+}
+
+// UpdateKeyPCRProtectionPolicyMultipleNoRevoke behaves like UpdateKeyPCRProtectionPolicyMultiple, except that the
+// previous PCR policy is not revoked. Once the system has booted successfully with the new PCR policy, the previous
+// one can be revoked by calling SealedKeyObject.RevokeOldPCRProtectionPolicies on any of the supplied keys.
+func UpdateKeyPCRProtectionPolicyMultipleNoRevoke(tpm *Connection, keys []*SealedKeyObject, authKey PolicyAuthKey, pcrProfile *PCRProtectionProfile) error {
+	if len(keys) == 0 {
+		return errors.New("no sealed keys supplied")
+	}
+
+	policyAuthKey, err := createPolicyAuthKeyFromTPM(keys[0].data.staticPolicyData.authPublicKey, authKey)
 	if err != nil {
-		return InvalidKeyFileError{fmt.Sprintf("cannot create auth key: %v", err)}
+		return InvalidKeyFileError{msg: fmt.Sprintf("cannot create auth key: %v", err)}
 	}
 
-	return updateKeyPCRProtectionPolicyCommon(tpm.TPMContext, keys, ecdsaAuthKey, pcrProfile, tpm.HmacSession())
+	return updateKeyPCRProtectionPolicyCommon(tpm.TPMContext, keys, policyAuthKey, pcrProfile, false, tpm.HmacSession())
 }
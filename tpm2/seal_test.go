@@ -21,22 +21,30 @@ package tpm2_test
 
 import (
 	"bytes"
+	"context"
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/binary"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"syscall"
 	"testing"
+	"time"
 
 	"golang.org/x/xerrors"
 
 	"github.com/canonical/go-tpm2"
 	"github.com/canonical/go-tpm2/mu"
 
+	"github.com/snapcore/secboot"
 	"github.com/snapcore/secboot/internal/tcg"
 	"github.com/snapcore/secboot/internal/testutil"
 	. "github.com/snapcore/secboot/tpm2"
@@ -258,6 +266,36 @@ func TestSealKeyToTPM(t *testing.T) {
 	})
 }
 
+func TestSealKeyToTPMContextCancelled(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	tmpDir, err := ioutil.TempDir("", "_TestSealKeyToTPMContextCancelled_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = SealKeyToTPMContext(ctx, tpm, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810000})
+	if err != context.Canceled {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := os.Stat(keyFile); !os.IsNotExist(err) {
+		t.Errorf("Key file shouldn't exist")
+	}
+	if _, err := tpm.CreateResourceContextFromTPM(0x01810000); !tpm2.IsResourceUnavailableError(err, 0x01810000) {
+		t.Errorf("PCR policy counter shouldn't exist")
+	}
+}
+
 func TestSealKeyToTPMMultiple(t *testing.T) {
 	func() {
 		tpm := openTPMForTesting(t)
@@ -367,6 +405,44 @@ func TestSealKeyToTPMMultiple(t *testing.T) {
 	})
 }
 
+func TestSealKeyToTPMMultipleStep(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestSealKeyToTPMMultipleStep_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keys := []*SealKeyRequest{{Key: key, Path: filepath.Join(tmpDir, "keydata")}}
+
+	var authPrivateKey PolicyAuthKey
+	var e secboot.Enrollment
+	e.AddStep(NewSealKeyToTPMMultipleStep(tpm, keys, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810000},
+		func(authKey PolicyAuthKey) { authPrivateKey = authKey }))
+
+	var lastPercent int
+	if err := e.Run(func(_ string, percent int) { lastPercent = percent }); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keys[0].Path)
+
+	if lastPercent != 100 {
+		t.Errorf("Unexpected final progress: %d", lastPercent)
+	}
+	if err := ValidateKeyDataFile(tpm.TPMContext, keys[0].Path, authPrivateKey, tpm.HmacSession()); err != nil {
+		t.Errorf("ValidateKeyDataFile failed: %v", err)
+	}
+}
+
 func TestSealKeyToTPMErrorHandling(t *testing.T) {
 	tpm := openTPMForTesting(t)
 	defer closeTPM(t, tpm)
@@ -468,6 +544,16 @@ func TestSealKeyToTPMErrorHandling(t *testing.T) {
 		}
 	})
 
+	t.Run("ZeroPCRPolicyCounterHandle", func(t *testing.T) {
+		err := run(t, "", &KeyCreationParams{PCRProfile: getTestPCRProfile()})
+		if err == nil {
+			t.Fatalf("Expected an error")
+		}
+		if err.Error() != "invalid PCRPolicyCounterHandle" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
 	t.Run("InvalidPCRProfile", func(t *testing.T) {
 		pcrProfile := NewPCRProtectionProfile().
 			AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7).
@@ -496,7 +582,7 @@ func TestSealKeyToTPMErrorHandling(t *testing.T) {
 	})
 
 	t.Run("WrongCurve", func(t *testing.T) {
-		authKey, err := ecdsa.GenerateKey(elliptic.P384(), testutil.RandReader)
+		authKey, err := ecdsa.GenerateKey(elliptic.P224(), testutil.RandReader)
 		if err != nil {
 			t.Fatalf("GenerateKey failed: %v", err)
 		}
@@ -504,7 +590,7 @@ func TestSealKeyToTPMErrorHandling(t *testing.T) {
 		if err == nil {
 			t.Fatalf("Expected an error")
 		}
-		if err.Error() != "provided AuthKey must be from elliptic.P256, no other curve is supported" {
+		if err.Error() != "provided AuthKey must be from elliptic.P256 or elliptic.P384, no other curve is supported" {
 			t.Errorf("Unexpected error: %v", err)
 		}
 	})
@@ -581,6 +667,14 @@ func TestSealKeyToExternalTPMStorageKey(t *testing.T) {
 			t.Fatalf("AuthKey private part bytes do not match provided one")
 		}
 	})
+
+	t.Run("WithRand", func(t *testing.T) {
+		pkb1 := run(t, &KeyCreationParams{PCRProfile: pcrProfile(), PCRPolicyCounterHandle: tpm2.HandleNull, Rand: rand.New(rand.NewSource(1))})
+		pkb2 := run(t, &KeyCreationParams{PCRProfile: pcrProfile(), PCRPolicyCounterHandle: tpm2.HandleNull, Rand: rand.New(rand.NewSource(1))})
+		if !bytes.Equal(pkb1, pkb2) {
+			t.Errorf("AuthKey private part is not reproducible with the same source of randomness")
+		}
+	})
 }
 
 func TestSealKeyToExternalTPMStorageKeyErrorHandling(t *testing.T) {
@@ -681,7 +775,7 @@ func TestSealKeyToExternalTPMStorageKeyErrorHandling(t *testing.T) {
 	})
 
 	t.Run("WrongCurve", func(t *testing.T) {
-		authKey, err := ecdsa.GenerateKey(elliptic.P384(), testutil.RandReader)
+		authKey, err := ecdsa.GenerateKey(elliptic.P224(), testutil.RandReader)
 		if err != nil {
 			t.Fatalf("GenerateKey failed: %v", err)
 		}
@@ -689,7 +783,7 @@ func TestSealKeyToExternalTPMStorageKeyErrorHandling(t *testing.T) {
 		if err == nil {
 			t.Fatalf("Expected an error")
 		}
-		if err.Error() != "provided AuthKey must be from elliptic.P256, no other curve is supported" {
+		if err.Error() != "provided AuthKey must be from elliptic.P256 or elliptic.P384, no other curve is supported" {
 			t.Errorf("Unexpected error: %v", err)
 		}
 	})
@@ -834,7 +928,7 @@ func TestUpdateKeyPCRProtectionPolicy(t *testing.T) {
 	})
 }
 
-func TestUpdateKeyPCRProtectionPolicyMultiple(t *testing.T) {
+func TestSealKeyWithAuthorizedPolicySigner(t *testing.T) {
 	tpm, _ := openTPMSimulatorForTesting(t)
 	defer closeTPM(t, tpm)
 
@@ -845,162 +939,222 @@ func TestUpdateKeyPCRProtectionPolicyMultiple(t *testing.T) {
 	key := make([]byte, 64)
 	rand.Read(key)
 
-	prepare := func(t *testing.T, n int, params *KeyCreationParams) (paths []string, authKey PolicyAuthKey, cleanup func()) {
-		tmpDir, err := ioutil.TempDir("", "_TestUpdateKeyPCRProtectionPolicyMultiple_")
+	run := func(t *testing.T, signer crypto.Signer) {
+		tmpDir, err := ioutil.TempDir("", "_TestSealKeyWithAuthorizedPolicySigner_")
 		if err != nil {
 			t.Fatalf("Creating temporary directory failed: %v", err)
 		}
+		defer os.RemoveAll(tmpDir)
 
-		var keys []*SealKeyRequest
-		for i := 0; i < n; i++ {
-			keys = append(keys, &SealKeyRequest{Key: key, Path: filepath.Join(tmpDir, fmt.Sprintf("keydata%d", i))})
+		keyFile := filepath.Join(tmpDir, "keydata")
+
+		authKey, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{
+			PCRProfile:             getTestPCRProfile(),
+			PCRPolicyCounterHandle: 0x01810000,
+			AuthorizedPolicySigner: signer})
+		if err != nil {
+			t.Fatalf("SealKeyToTPM failed: %v", err)
 		}
+		defer undefineKeyNVSpace(t, tpm, keyFile)
 
-		authPrivateKey, err := SealKeyToTPMMultiple(tpm, keys, params)
+		if len(authKey) != 0 {
+			t.Errorf("Unexpected auth key")
+		}
+
+		k, err := ReadSealedKeyObject(keyFile)
 		if err != nil {
-			t.Errorf("SealKeyToTPMMultiple failed: %v", err)
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
 		}
 
-		for _, k := range keys {
-			paths = append(paths, k.Path)
+		unsealedKey, _, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			t.Fatalf("UnsealFromTPM failed: %v", err)
+		}
+		if !bytes.Equal(unsealedKey, key) {
+			t.Errorf("Unexpected key")
 		}
 
-		return paths, authPrivateKey, func() {
-			undefineKeyNVSpace(t, tpm, keys[0].Path)
-			os.RemoveAll(tmpDir)
+		// Update the policy with a profile that can't be satisfied
+		profile := NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, make(tpm2.Digest, 32))
+		if err := k.UpdatePCRProtectionPolicyWithSigner(tpm, signer, profile); err != nil {
+			t.Fatalf("UpdatePCRProtectionPolicyWithSigner failed: %v", err)
+		}
+		if _, _, err := k.UnsealFromTPM(tpm, ""); err == nil {
+			t.Errorf("UnsealFromTPM should have failed")
+		}
+
+		// Restore the original policy
+		if err := k.UpdatePCRProtectionPolicyWithSigner(tpm, signer, getTestPCRProfile()); err != nil {
+			t.Fatalf("UpdatePCRProtectionPolicyWithSigner failed: %v", err)
+		}
+		unsealedKey, _, err = k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			t.Fatalf("UnsealFromTPM failed: %v", err)
+		}
+		if !bytes.Equal(unsealedKey, key) {
+			t.Errorf("Unexpected key")
+		}
+
+		// Updating with a different signer should fail
+		otherSigner, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+		if err != nil {
+			t.Fatalf("GenerateKey failed: %v", err)
+		}
+		err = k.UpdatePCRProtectionPolicyWithSigner(tpm, otherSigner, getTestPCRProfile())
+		if _, ok := err.(InvalidKeyFileError); !ok {
+			t.Errorf("Unexpected error: %v", err)
 		}
 	}
 
-	update := func(t *testing.T, keyFiles []string, authKey PolicyAuthKey, profile *PCRProtectionProfile) {
-		var keys []*SealedKeyObject
-		for _, p := range keyFiles {
-			k, err := ReadSealedKeyObject(p)
-			if err != nil {
-				t.Fatalf("ReadSealedKeyObject failed: %v", err)
-			}
-			keys = append(keys, k)
+	t.Run("ECDSA", func(t *testing.T) {
+		signer, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+		if err != nil {
+			t.Fatalf("GenerateKey failed: %v", err)
 		}
-		if err := UpdateKeyPCRProtectionPolicyMultiple(tpm, keys, authKey, profile); err != nil {
-			t.Errorf("UpdateKeyPCRProtectionPolicy failed: %v", err)
+		run(t, signer)
+	})
+
+	t.Run("RSA", func(t *testing.T) {
+		signer, err := rsa.GenerateKey(testutil.RandReader, 2048)
+		if err != nil {
+			t.Fatalf("GenerateKey failed: %v", err)
+		}
+		run(t, signer)
+	})
+
+	t.Run("WithAuthKey", func(t *testing.T) {
+		signer, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+		if err != nil {
+			t.Fatalf("GenerateKey failed: %v", err)
+		}
+		authKey, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+		if err != nil {
+			t.Fatalf("GenerateKey failed: %v", err)
+		}
+
+		tmpDir, err := ioutil.TempDir("", "_TestSealKeyWithAuthorizedPolicySigner_")
+		if err != nil {
+			t.Fatalf("Creating temporary directory failed: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		_, err = SealKeyToTPM(tpm, key, filepath.Join(tmpDir, "keydata"), &KeyCreationParams{
+			PCRProfile:             getTestPCRProfile(),
+			PCRPolicyCounterHandle: tpm2.HandleNull,
+			AuthKey:                authKey,
+			AuthorizedPolicySigner: signer})
+		if err == nil || err.Error() != "AuthKey and AuthorizedPolicySigner cannot both be provided" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
+
+func TestSealKeyWithLifetimeLimits(t *testing.T) {
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	seal := func(t *testing.T, tpm *Connection, params *KeyCreationParams) (keyFile string, cleanup func()) {
+		tmpDir, err := ioutil.TempDir("", "_TestSealKeyWithLifetimeLimits_")
+		if err != nil {
+			t.Fatalf("Creating temporary directory failed: %v", err)
+		}
+
+		keyFile = filepath.Join(tmpDir, "keydata")
+
+		if _, err := SealKeyToTPM(tpm, key, keyFile, params); err != nil {
+			t.Fatalf("SealKeyToTPM failed: %v", err)
 		}
+		return keyFile, func() { os.RemoveAll(tmpDir) }
 	}
 
-	checkUnseal := func(t *testing.T, keyFile string) {
+	unseal := func(t *testing.T, tpm *Connection, keyFile string) error {
 		k, err := ReadSealedKeyObject(keyFile)
 		if err != nil {
 			t.Fatalf("ReadSealedKeyObject failed: %v", err)
 		}
-
 		unsealedKey, _, err := k.UnsealFromTPM(tpm, "")
 		if err != nil {
-			t.Errorf("Unseal failed: %v", err)
+			return err
 		}
-
 		if !bytes.Equal(unsealedKey, key) {
 			t.Errorf("Unexpected key")
 		}
+		return nil
 	}
 
-	t.Run("WithPCRPolicyCounter", func(t *testing.T) {
-		// Create initial keyfiles
-		keyFiles, authKey, cleanup := prepare(t, 2, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810000})
-		defer cleanup()
+	t.Run("BootLimit", func(t *testing.T) {
+		tpm, tcti := openTPMSimulatorForTesting(t)
+		defer func() { closeTPM(t, tpm) }()
 
-		// Create a copy of initial files
-		var backups []string
-		for _, kf := range keyFiles {
-			bf := kf + ".bak"
-			if err := testutil.CopyFile(bf, kf, 0600); err != nil {
-				t.Errorf("CopyFile failed: %v", err)
-			}
-			backups = append(backups, bf)
+		if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+			t.Errorf("Failed to provision TPM for test: %v", err)
 		}
 
-		// Update policy with 2 branches
-		newProfile := NewPCRProtectionProfile().AddProfileOR(
-			NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7),
-			NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7).
-				ExtendPCR(tpm2.HashAlgorithmSHA256, 7, testutil.MakePCREventDigest(tpm2.HashAlgorithmSHA256, "foo")))
-		update(t, keyFiles, authKey, newProfile)
-
-		// Check that unseal fails with the backup files
-		for _, bf := range backups {
-			k, err := ReadSealedKeyObject(bf)
-			if err != nil {
-				t.Fatalf("ReadSealedKeyObject failed: %v", err)
-			}
-
-			if _, _, err := k.UnsealFromTPM(tpm, ""); err == nil ||
-				err.Error() != "invalid key data file: cannot complete authorization policy assertions: the PCR policy has been revoked" {
-				t.Errorf("Unexpected error: %v", err)
-			}
-		}
+		keyFile, cleanup := seal(t, tpm, &KeyCreationParams{
+			PCRProfile:             getTestPCRProfile(),
+			PCRPolicyCounterHandle: tpm2.HandleNull,
+			BootLimit:              2})
+		defer cleanup()
 
-		// Check that the keys unseal with the first branch
-		for _, k := range keyFiles {
-			checkUnseal(t, k)
+		if err := unseal(t, tpm, keyFile); err != nil {
+			t.Errorf("UnsealFromTPM failed: %v", err)
 		}
 
-		// Modify the PCR state to match the second branch
-		if _, err := tpm.PCREvent(tpm.PCRHandleContext(7), []byte("foo"), nil); err != nil {
-			t.Errorf("PCREvent failed: %v", err)
+		tpm, tcti = resetTPMSimulator(t, tpm, tcti)
+		if err := unseal(t, tpm, keyFile); err != nil {
+			t.Errorf("UnsealFromTPM failed: %v", err)
 		}
 
-		// Check that the keys unseal with the second branch
-		for _, k := range keyFiles {
-			checkUnseal(t, k)
+		tpm, _ = resetTPMSimulator(t, tpm, tcti)
+		if err := unseal(t, tpm, keyFile); err != ErrKeyExpired {
+			t.Errorf("Unexpected error: %v", err)
 		}
 	})
 
-	t.Run("WithoutPCRPolicyCounter", func(t *testing.T) {
-		// Create initial keyfile
-		keyFiles, authKey, cleanup := prepare(t, 2, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: tpm2.HandleNull})
-		defer cleanup()
+	t.Run("ClockLimit", func(t *testing.T) {
+		tpm, _ := openTPMSimulatorForTesting(t)
+		defer closeTPM(t, tpm)
 
-		// Create a copy of initial files
-		var backups []string
-		for _, kf := range keyFiles {
-			bf := kf + ".bak"
-			if err := testutil.CopyFile(bf, kf, 0600); err != nil {
-				t.Errorf("CopyFile failed: %v", err)
-			}
-			backups = append(backups, bf)
+		if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+			t.Errorf("Failed to provision TPM for test: %v", err)
 		}
 
-		// Update policy with 2 branches
-		newProfile := NewPCRProtectionProfile().AddProfileOR(
-			NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7),
-			NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7).
-				ExtendPCR(tpm2.HashAlgorithmSHA256, 7, testutil.MakePCREventDigest(tpm2.HashAlgorithmSHA256, "foo")))
-		update(t, keyFiles, authKey, newProfile)
+		keyFile, cleanup := seal(t, tpm, &KeyCreationParams{
+			PCRProfile:             getTestPCRProfile(),
+			PCRPolicyCounterHandle: tpm2.HandleNull,
+			ClockLimit:             time.Hour})
+		defer cleanup()
 
-		// Check that unseal still succeeds with the backup files
-		for _, bf := range backups {
-			checkUnseal(t, bf)
+		if err := unseal(t, tpm, keyFile); err != nil {
+			t.Errorf("UnsealFromTPM failed: %v", err)
 		}
 
-		// Check that the keys unseal with the first branch
-		for _, k := range keyFiles {
-			checkUnseal(t, k)
+		timeInfo, err := tpm.ReadClock()
+		if err != nil {
+			t.Fatalf("ReadClock failed: %v", err)
+		}
+		if err := tpm.ClockSet(tpm.OwnerHandleContext(), timeInfo.ClockInfo.Clock+uint64(2*time.Hour/time.Millisecond), nil); err != nil {
+			t.Fatalf("ClockSet failed: %v", err)
 		}
 
-		// Modify the PCR state to match the second branch
-		if _, err := tpm.PCREvent(tpm.PCRHandleContext(7), []byte("foo"), nil); err != nil {
-			t.Errorf("PCREvent failed: %v", err)
+		if err := unseal(t, tpm, keyFile); err != ErrKeyExpired {
+			t.Errorf("Unexpected error: %v", err)
 		}
+	})
 
-		// Check that the keys unseal with the second branch
-		for _, k := range keyFiles {
-			checkUnseal(t, k)
+	t.Run("Importable", func(t *testing.T) {
+		_, err := SealKeyToExternalTPMStorageKey(nil, key, "", &KeyCreationParams{
+			PCRProfile:             getTestPCRProfile(),
+			PCRPolicyCounterHandle: tpm2.HandleNull,
+			BootLimit:              1})
+		if err == nil || err.Error() != "ClockLimit and BootLimit must be zero when creating an importable sealed key" {
+			t.Errorf("Unexpected error: %v", err)
 		}
 	})
 }
 
-func TestUpdateKeyPCRProtectionPolicyMultipleUnrelated1(t *testing.T) {
-	// Test that UpdateKeyPCRProtectionPolicyMultiple rejects keys that have the
-	// same auth key, but different policies because they use independent PCR policy
-	// counters.
-	tpm := openTPMForTesting(t)
+func TestSealKeyWithPolicyRestrictions(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
 	defer closeTPM(t, tpm)
 
 	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
@@ -1010,45 +1164,155 @@ func TestUpdateKeyPCRProtectionPolicyMultipleUnrelated1(t *testing.T) {
 	key := make([]byte, 64)
 	rand.Read(key)
 
-	tmpDir, err := ioutil.TempDir("", "_TestUpdateKeyPCRProtectionPolicyMultiple1_")
-	if err != nil {
-		t.Fatalf("Creating temporary directory failed: %v", err)
-	}
-	defer os.RemoveAll(tmpDir)
+	run := func(t *testing.T, params *KeyCreationParams) error {
+		tmpDir, err := ioutil.TempDir("", "_TestSealKeyWithPolicyRestrictions_")
+		if err != nil {
+			t.Fatalf("Creating temporary directory failed: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
 
-	authKey, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
-	if err != nil {
-		t.Fatalf("GenerateKey failed: %v", err)
-	}
+		keyFile := filepath.Join(tmpDir, "keydata")
 
-	var keys []*SealedKeyObject
-	for i := 0; i < 3; i++ {
-		keyFile := filepath.Join(tmpDir, fmt.Sprintf("keydata%d", i))
-		if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{
-			PCRProfile:             getTestPCRProfile(),
-			PCRPolicyCounterHandle: 0x01810000 + tpm2.Handle(i),
-			AuthKey:                authKey}); err != nil {
+		params.PCRProfile = getTestPCRProfile()
+		params.PCRPolicyCounterHandle = tpm2.HandleNull
+		if _, err := SealKeyToTPM(tpm, key, keyFile, params); err != nil {
 			t.Fatalf("SealKeyToTPM failed: %v", err)
 		}
-		defer undefineKeyNVSpace(t, tpm, keyFile)
 
 		k, err := ReadSealedKeyObject(keyFile)
 		if err != nil {
 			t.Fatalf("ReadSealedKeyObject failed: %v", err)
 		}
-		keys = append(keys, k)
+		unsealedKey, _, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(unsealedKey, key) {
+			t.Errorf("Unexpected key")
+		}
+		return nil
 	}
 
-	if err := UpdateKeyPCRProtectionPolicyMultiple(tpm, keys, authKey.D.Bytes(), nil); err == nil ||
-		!strings.HasSuffix(err.Error(), "key data at index 0 is not related to the primary key data") {
+	t.Run("PermittedLocality", func(t *testing.T) {
+		if err := run(t, &KeyCreationParams{PermittedLocalities: tpm2.Locality(1 << 0)}); err != nil {
+			t.Errorf("UnsealFromTPM failed: %v", err)
+		}
+	})
+
+	t.Run("NotPermittedLocality", func(t *testing.T) {
+		if err := run(t, &KeyCreationParams{PermittedLocalities: tpm2.Locality(1 << 3)}); err != ErrLocalityNotPermitted {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("UnsealOnly", func(t *testing.T) {
+		if err := run(t, &KeyCreationParams{UnsealOnly: true}); err != nil {
+			t.Errorf("UnsealFromTPM failed: %v", err)
+		}
+	})
+
+	t.Run("UnsealOnlyWithPermittedLocality", func(t *testing.T) {
+		if err := run(t, &KeyCreationParams{PermittedLocalities: tpm2.Locality(1 << 0), UnsealOnly: true}); err != nil {
+			t.Errorf("UnsealFromTPM failed: %v", err)
+		}
+	})
+}
+
+func TestRevokeOldPCRProtectionPolicies(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestRevokeOldPCRProtectionPolicies_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+
+	authKey, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810000})
+	if err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	// Create a copy of the initial file
+	keyFile2 := filepath.Join(tmpDir, "keydata2")
+	if err := testutil.CopyFile(keyFile2, keyFile, 0600); err != nil {
+		t.Errorf("CopyFile failed: %v", err)
+	}
+
+	checkUnseal := func(t *testing.T, path string) error {
+		k, err := ReadSealedKeyObject(path)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		unsealedKey, _, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(unsealedKey, key) {
+			t.Errorf("Unexpected key")
+		}
+		return nil
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if err := k.UpdatePCRProtectionPolicyNoRevoke(tpm, authKey, getTestPCRProfile()); err != nil {
+		t.Fatalf("UpdatePCRProtectionPolicyNoRevoke failed: %v", err)
+	}
+
+	// Both the old and new policies should be valid until the old one is revoked
+	if err := checkUnseal(t, keyFile); err != nil {
+		t.Errorf("Unseal failed: %v", err)
+	}
+	if err := checkUnseal(t, keyFile2); err != nil {
+		t.Errorf("Unseal failed: %v", err)
+	}
+
+	if err := k.RevokeOldPCRProtectionPolicies(tpm, authKey); err != nil {
+		t.Fatalf("RevokeOldPCRProtectionPolicies failed: %v", err)
+	}
+
+	if err := checkUnseal(t, keyFile); err != nil {
+		t.Errorf("Unseal failed: %v", err)
+	}
+	if err := checkUnseal(t, keyFile2); err == nil ||
+		err.Error() != "invalid key data file: cannot complete authorization policy assertions: the PCR policy has been revoked" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// Revoking again should be a no-op
+	if err := k.RevokeOldPCRProtectionPolicies(tpm, authKey); err != nil {
+		t.Errorf("RevokeOldPCRProtectionPolicies failed: %v", err)
+	}
+	if err := checkUnseal(t, keyFile); err != nil {
+		t.Errorf("Unseal failed: %v", err)
+	}
+
+	// Revoking with the old key data should fail
+	k2, err := ReadSealedKeyObject(keyFile2)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if err := k2.RevokeOldPCRProtectionPolicies(tpm, authKey); err == nil ||
+		err.Error() != "invalid key data file: the PCR policy has already been revoked" {
 		t.Errorf("Unexpected error: %v", err)
 	}
 }
 
-func TestUpdateKeyPCRProtectionPolicyMultipleUnrelated2(t *testing.T) {
-	// Test that UpdateKeyPCRProtectionPolicyMultiple rejects keys that use different
-	// auth keys.
-	tpm := openTPMForTesting(t)
+func TestSealKeyWithoutPCRPolicyCounter(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
 	defer closeTPM(t, tpm)
 
 	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
@@ -1058,44 +1322,839 @@ func TestUpdateKeyPCRProtectionPolicyMultipleUnrelated2(t *testing.T) {
 	key := make([]byte, 64)
 	rand.Read(key)
 
-	tmpDir, err := ioutil.TempDir("", "_TestUpdateKeyPCRProtectionPolicyMultiple12_")
+	tmpDir, err := ioutil.TempDir("", "_TestSealKeyWithoutPCRPolicyCounter_")
 	if err != nil {
 		t.Fatalf("Creating temporary directory failed: %v", err)
 	}
 	defer os.RemoveAll(tmpDir)
 
-	var keys []*SealedKeyObject
+	keyFile := filepath.Join(tmpDir, "keydata")
 
-	keyFile := filepath.Join(tmpDir, "keyfile0")
-	authKey, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{
-		PCRProfile:             getTestPCRProfile(),
-		PCRPolicyCounterHandle: tpm2.HandleNull})
+	nvIndices := func() tpm2.HandleList {
+		handles, err := tpm.GetCapabilityHandles(tpm2.HandleTypeNVIndex.BaseHandle(), tpm2.CapabilityMaxProperties)
+		if err != nil {
+			t.Fatalf("GetCapability failed: %v", err)
+		}
+		return handles
+	}
+	origIndices := nvIndices()
+
+	authKey, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: NoPCRPolicyCounterHandle})
 	if err != nil {
 		t.Fatalf("SealKeyToTPM failed: %v", err)
 	}
+
+	if !reflect.DeepEqual(nvIndices(), origIndices) {
+		t.Errorf("SealKeyToTPM shouldn't have defined any NV indices")
+	}
+
 	k, err := ReadSealedKeyObject(keyFile)
 	if err != nil {
 		t.Fatalf("ReadSealedKeyObject failed: %v", err)
 	}
-	keys = append(keys, k)
+	if k.PCRPolicyCounterHandle() != NoPCRPolicyCounterHandle {
+		t.Errorf("Unexpected PCR policy counter handle: %v", k.PCRPolicyCounterHandle())
+	}
 
-	for i := 1; i < 3; i++ {
-		keyFile := filepath.Join(tmpDir, fmt.Sprintf("keydata%d", i))
-		if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{
-			PCRProfile:             getTestPCRProfile(),
-			PCRPolicyCounterHandle: tpm2.HandleNull}); err != nil {
-			t.Fatalf("SealKeyToTPM failed: %v", err)
+	checkUnseal := func(t *testing.T, path string) error {
+		k, err := ReadSealedKeyObject(path)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		unsealedKey, _, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(unsealedKey, key) {
+			t.Errorf("Unexpected key")
+		}
+		return nil
+	}
+
+	if err := checkUnseal(t, keyFile); err != nil {
+		t.Errorf("Unseal failed: %v", err)
+	}
+
+	// Create a copy of the initial file
+	keyFile2 := filepath.Join(tmpDir, "keydata2")
+	if err := testutil.CopyFile(keyFile2, keyFile, 0600); err != nil {
+		t.Errorf("CopyFile failed: %v", err)
+	}
+
+	// Update the policy to one that is only satisfied after extending PCR 7
+	profile := NewPCRProtectionProfile().
+		AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7).
+		ExtendPCR(tpm2.HashAlgorithmSHA256, 7, testutil.MakePCREventDigest(tpm2.HashAlgorithmSHA256, "foo"))
+	if err := k.UpdatePCRProtectionPolicy(tpm, authKey, profile); err != nil {
+		t.Fatalf("UpdatePCRProtectionPolicy failed: %v", err)
+	}
+	if err := k.RevokeOldPCRProtectionPolicies(tpm, authKey); err != nil {
+		t.Errorf("RevokeOldPCRProtectionPolicies failed: %v", err)
+	}
+
+	if !reflect.DeepEqual(nvIndices(), origIndices) {
+		t.Errorf("Updating the PCR policy shouldn't have defined any NV indices")
+	}
+
+	if err := checkUnseal(t, keyFile); err == nil ||
+		err.Error() != "invalid key data file: cannot complete authorization policy assertions: cannot complete OR assertions: current session digest not found in policy data" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// The old policy can't be revoked without a PCR policy counter
+	if err := checkUnseal(t, keyFile2); err != nil {
+		t.Errorf("Unseal failed: %v", err)
+	}
+
+	if _, err := tpm.PCREvent(tpm.PCRHandleContext(7), []byte("foo"), nil); err != nil {
+		t.Errorf("PCREvent failed: %v", err)
+	}
+
+	if err := checkUnseal(t, keyFile); err != nil {
+		t.Errorf("Unseal failed: %v", err)
+	}
+}
+
+func TestUpdateKeyPCRProtectionPolicyMultiple(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	prepare := func(t *testing.T, n int, params *KeyCreationParams) (paths []string, authKey PolicyAuthKey, cleanup func()) {
+		tmpDir, err := ioutil.TempDir("", "_TestUpdateKeyPCRProtectionPolicyMultiple_")
+		if err != nil {
+			t.Fatalf("Creating temporary directory failed: %v", err)
+		}
+
+		var keys []*SealKeyRequest
+		for i := 0; i < n; i++ {
+			keys = append(keys, &SealKeyRequest{Key: key, Path: filepath.Join(tmpDir, fmt.Sprintf("keydata%d", i))})
+		}
+
+		authPrivateKey, err := SealKeyToTPMMultiple(tpm, keys, params)
+		if err != nil {
+			t.Errorf("SealKeyToTPMMultiple failed: %v", err)
+		}
+
+		for _, k := range keys {
+			paths = append(paths, k.Path)
+		}
+
+		return paths, authPrivateKey, func() {
+			undefineKeyNVSpace(t, tpm, keys[0].Path)
+			os.RemoveAll(tmpDir)
+		}
+	}
+
+	update := func(t *testing.T, keyFiles []string, authKey PolicyAuthKey, profile *PCRProtectionProfile) {
+		var keys []*SealedKeyObject
+		for _, p := range keyFiles {
+			k, err := ReadSealedKeyObject(p)
+			if err != nil {
+				t.Fatalf("ReadSealedKeyObject failed: %v", err)
+			}
+			keys = append(keys, k)
+		}
+		if err := UpdateKeyPCRProtectionPolicyMultiple(tpm, keys, authKey, profile); err != nil {
+			t.Errorf("UpdateKeyPCRProtectionPolicy failed: %v", err)
 		}
+	}
 
+	checkUnseal := func(t *testing.T, keyFile string) {
 		k, err := ReadSealedKeyObject(keyFile)
 		if err != nil {
 			t.Fatalf("ReadSealedKeyObject failed: %v", err)
 		}
-		keys = append(keys, k)
-	}
 
-	if err := UpdateKeyPCRProtectionPolicyMultiple(tpm, keys, authKey, nil); err == nil ||
-		!strings.HasSuffix(err.Error(), "key data at index 0 is not related to the primary key data") {
-		t.Errorf("Unexpected error: %v", err)
+		unsealedKey, _, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			t.Errorf("Unseal failed: %v", err)
+		}
+
+		if !bytes.Equal(unsealedKey, key) {
+			t.Errorf("Unexpected key")
+		}
 	}
+
+	t.Run("WithPCRPolicyCounter", func(t *testing.T) {
+		// Create initial keyfiles
+		keyFiles, authKey, cleanup := prepare(t, 2, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810000})
+		defer cleanup()
+
+		// Create a copy of initial files
+		var backups []string
+		for _, kf := range keyFiles {
+			bf := kf + ".bak"
+			if err := testutil.CopyFile(bf, kf, 0600); err != nil {
+				t.Errorf("CopyFile failed: %v", err)
+			}
+			backups = append(backups, bf)
+		}
+
+		// Update policy with 2 branches
+		newProfile := NewPCRProtectionProfile().AddProfileOR(
+			NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7),
+			NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7).
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 7, testutil.MakePCREventDigest(tpm2.HashAlgorithmSHA256, "foo")))
+		update(t, keyFiles, authKey, newProfile)
+
+		// Check that unseal fails with the backup files
+		for _, bf := range backups {
+			k, err := ReadSealedKeyObject(bf)
+			if err != nil {
+				t.Fatalf("ReadSealedKeyObject failed: %v", err)
+			}
+
+			if _, _, err := k.UnsealFromTPM(tpm, ""); err == nil ||
+				err.Error() != "invalid key data file: cannot complete authorization policy assertions: the PCR policy has been revoked" {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		}
+
+		// Check that the keys unseal with the first branch
+		for _, k := range keyFiles {
+			checkUnseal(t, k)
+		}
+
+		// Modify the PCR state to match the second branch
+		if _, err := tpm.PCREvent(tpm.PCRHandleContext(7), []byte("foo"), nil); err != nil {
+			t.Errorf("PCREvent failed: %v", err)
+		}
+
+		// Check that the keys unseal with the second branch
+		for _, k := range keyFiles {
+			checkUnseal(t, k)
+		}
+	})
+
+	t.Run("WithoutPCRPolicyCounter", func(t *testing.T) {
+		// Create initial keyfile
+		keyFiles, authKey, cleanup := prepare(t, 2, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: tpm2.HandleNull})
+		defer cleanup()
+
+		// Create a copy of initial files
+		var backups []string
+		for _, kf := range keyFiles {
+			bf := kf + ".bak"
+			if err := testutil.CopyFile(bf, kf, 0600); err != nil {
+				t.Errorf("CopyFile failed: %v", err)
+			}
+			backups = append(backups, bf)
+		}
+
+		// Update policy with 2 branches
+		newProfile := NewPCRProtectionProfile().AddProfileOR(
+			NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7),
+			NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7).
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 7, testutil.MakePCREventDigest(tpm2.HashAlgorithmSHA256, "foo")))
+		update(t, keyFiles, authKey, newProfile)
+
+		// Check that unseal still succeeds with the backup files
+		for _, bf := range backups {
+			checkUnseal(t, bf)
+		}
+
+		// Check that the keys unseal with the first branch
+		for _, k := range keyFiles {
+			checkUnseal(t, k)
+		}
+
+		// Modify the PCR state to match the second branch
+		if _, err := tpm.PCREvent(tpm.PCRHandleContext(7), []byte("foo"), nil); err != nil {
+			t.Errorf("PCREvent failed: %v", err)
+		}
+
+		// Check that the keys unseal with the second branch
+		for _, k := range keyFiles {
+			checkUnseal(t, k)
+		}
+	})
+}
+
+func TestUpdateKeyPCRProtectionPolicyMultipleUnrelated1(t *testing.T) {
+	// Test that UpdateKeyPCRProtectionPolicyMultiple rejects keys that have the
+	// same auth key, but different policies because they use independent PCR policy
+	// counters.
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUpdateKeyPCRProtectionPolicyMultiple1_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	authKey, err := ecdsa.GenerateKey(elliptic.P256(), testutil.RandReader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	var keys []*SealedKeyObject
+	for i := 0; i < 3; i++ {
+		keyFile := filepath.Join(tmpDir, fmt.Sprintf("keydata%d", i))
+		if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{
+			PCRProfile:             getTestPCRProfile(),
+			PCRPolicyCounterHandle: 0x01810000 + tpm2.Handle(i),
+			AuthKey:                authKey}); err != nil {
+			t.Fatalf("SealKeyToTPM failed: %v", err)
+		}
+		defer undefineKeyNVSpace(t, tpm, keyFile)
+
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		keys = append(keys, k)
+	}
+
+	if err := UpdateKeyPCRProtectionPolicyMultiple(tpm, keys, authKey.D.Bytes(), nil); err == nil ||
+		!strings.HasSuffix(err.Error(), "key data at index 0 is not related to the primary key data") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestUpdateKeyPCRProtectionPolicyMultipleUnrelated2(t *testing.T) {
+	// Test that UpdateKeyPCRProtectionPolicyMultiple rejects keys that use different
+	// auth keys.
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUpdateKeyPCRProtectionPolicyMultiple12_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var keys []*SealedKeyObject
+
+	keyFile := filepath.Join(tmpDir, "keyfile0")
+	authKey, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{
+		PCRProfile:             getTestPCRProfile(),
+		PCRPolicyCounterHandle: tpm2.HandleNull})
+	if err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	keys = append(keys, k)
+
+	for i := 1; i < 3; i++ {
+		keyFile := filepath.Join(tmpDir, fmt.Sprintf("keydata%d", i))
+		if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{
+			PCRProfile:             getTestPCRProfile(),
+			PCRPolicyCounterHandle: tpm2.HandleNull}); err != nil {
+			t.Fatalf("SealKeyToTPM failed: %v", err)
+		}
+
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		keys = append(keys, k)
+	}
+
+	if err := UpdateKeyPCRProtectionPolicyMultiple(tpm, keys, authKey, nil); err == nil ||
+		!strings.HasSuffix(err.Error(), "key data at index 0 is not related to the primary key data") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestSealKeyWithBackupKeyFile(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestSealKeyWithBackupKeyFile_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+	backupKeyFile := keyFile + ".backup"
+
+	authKey, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x01810000, BackupKeyFile: true})
+	if err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	if _, err := os.Stat(backupKeyFile); err != nil {
+		t.Fatalf("No backup key data file: %v", err)
+	}
+
+	checkUnseal := func(t *testing.T) {
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+
+		unsealedKey, _, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			t.Errorf("Unseal failed: %v", err)
+		}
+		if !bytes.Equal(unsealedKey, key) {
+			t.Errorf("Unexpected key")
+		}
+	}
+
+	update := func(t *testing.T) {
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		if err := k.UpdatePCRProtectionPolicy(tpm, authKey, getTestPCRProfile()); err != nil {
+			t.Fatalf("UpdatePCRProtectionPolicy failed: %v", err)
+		}
+	}
+
+	t.Run("Initial", func(t *testing.T) {
+		checkUnseal(t)
+	})
+
+	t.Run("CorruptPrimary", func(t *testing.T) {
+		update(t)
+
+		primary, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		defer ioutil.WriteFile(keyFile, primary, 0600)
+
+		if err := ioutil.WriteFile(keyFile, []byte("foo"), 0600); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		checkUnseal(t)
+	})
+
+	t.Run("MissingPrimary", func(t *testing.T) {
+		update(t)
+
+		if err := os.Remove(keyFile); err != nil {
+			t.Fatalf("Remove failed: %v", err)
+		}
+		if err := testutil.CopyFile(keyFile, backupKeyFile, 0600); err != nil {
+			t.Fatalf("CopyFile failed: %v", err)
+		}
+		checkUnseal(t)
+	})
+
+	t.Run("StaleBackup", func(t *testing.T) {
+		// Simulate an update that was interrupted after writing only one copy: the copy with the
+		// newest generation should be used, and the PCR policy associated with the stale copy is
+		// revoked.
+		stale, err := ioutil.ReadFile(backupKeyFile)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+
+		update(t)
+		update(t)
+
+		if err := ioutil.WriteFile(backupKeyFile, stale, 0600); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		checkUnseal(t)
+	})
+
+	t.Run("PrimaryWithoutGeneration", func(t *testing.T) {
+		// Simulate a primary copy that was written without a generation trailer, alongside a
+		// stale backup copy with a newer generation. The primary copy should take precedence.
+		stale, err := ioutil.ReadFile(backupKeyFile)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+
+		update(t)
+
+		primary, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		if err := ioutil.WriteFile(keyFile, primary[:len(primary)-12], 0600); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		binary.BigEndian.PutUint64(stale[len(stale)-8:], math.MaxUint32)
+		if err := ioutil.WriteFile(backupKeyFile, stale, 0600); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		checkUnseal(t)
+
+		// The next update should write both copies with a generation that is newer than the
+		// stale backup copy.
+		update(t)
+		if err := os.Remove(keyFile); err != nil {
+			t.Fatalf("Remove failed: %v", err)
+		}
+		if err := testutil.CopyFile(keyFile, backupKeyFile, 0600); err != nil {
+			t.Fatalf("CopyFile failed: %v", err)
+		}
+		checkUnseal(t)
+	})
+
+	t.Run("BothCorrupt", func(t *testing.T) {
+		for _, path := range []string{keyFile, backupKeyFile} {
+			if err := ioutil.WriteFile(path, []byte("foo"), 0600); err != nil {
+				t.Fatalf("WriteFile failed: %v", err)
+			}
+		}
+		_, err := ReadSealedKeyObject(keyFile)
+		var e InvalidKeyFileError
+		if !xerrors.As(err, &e) {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
+
+func TestSealKeyWithAuthKeyAlgorithm(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	run := func(t *testing.T, alg PolicyAuthKeyAlgorithm) {
+		tmpDir, err := ioutil.TempDir("", "_TestSealKeyWithAuthKeyAlgorithm_")
+		if err != nil {
+			t.Fatalf("Creating temporary directory failed: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		keyFile := filepath.Join(tmpDir, "keydata")
+
+		authKey, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{
+			PCRProfile:             getTestPCRProfile(),
+			PCRPolicyCounterHandle: 0x01810000,
+			AuthKeyAlgorithm:       alg})
+		if err != nil {
+			t.Fatalf("SealKeyToTPM failed: %v", err)
+		}
+		defer undefineKeyNVSpace(t, tpm, keyFile)
+
+		if err := ValidateKeyDataFile(tpm.TPMContext, keyFile, authKey, tpm.HmacSession()); err != nil {
+			t.Errorf("ValidateKeyDataFile failed: %v", err)
+		}
+
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		if err := k.UpdatePCRProtectionPolicy(tpm, authKey, getTestPCRProfile()); err != nil {
+			t.Errorf("UpdatePCRProtectionPolicy failed: %v", err)
+		}
+
+		unsealedKey, unsealedAuthKey, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			t.Fatalf("UnsealFromTPM failed: %v", err)
+		}
+		if !bytes.Equal(unsealedKey, key) {
+			t.Errorf("Unexpected key")
+		}
+		if !bytes.Equal(unsealedAuthKey, authKey) {
+			t.Errorf("Unexpected auth key")
+		}
+	}
+
+	t.Run("ECDSAP256", func(t *testing.T) {
+		run(t, PolicyAuthKeyECDSAP256)
+	})
+
+	t.Run("ECDSAP384", func(t *testing.T) {
+		run(t, PolicyAuthKeyECDSAP384)
+	})
+
+	t.Run("RSA2048", func(t *testing.T) {
+		run(t, PolicyAuthKeyRSA2048)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		tmpDir, err := ioutil.TempDir("", "_TestSealKeyWithAuthKeyAlgorithm_")
+		if err != nil {
+			t.Fatalf("Creating temporary directory failed: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		_, err = SealKeyToTPM(tpm, key, filepath.Join(tmpDir, "keydata"), &KeyCreationParams{
+			PCRProfile:             getTestPCRProfile(),
+			PCRPolicyCounterHandle: tpm2.HandleNull,
+			AuthKeyAlgorithm:       PolicyAuthKeyAlgorithm(10)})
+		if err == nil {
+			t.Fatalf("Expected an error")
+		}
+		if err.Error() != "invalid AuthKeyAlgorithm" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
+
+func TestSealKeyWithStorageHierarchy(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	run := func(t *testing.T, hierarchy tpm2.Handle) {
+		tmpDir, err := ioutil.TempDir("", "_TestSealKeyWithStorageHierarchy_")
+		if err != nil {
+			t.Fatalf("Creating temporary directory failed: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		keyFile := filepath.Join(tmpDir, "keydata")
+
+		if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{
+			PCRProfile:             getTestPCRProfile(),
+			PCRPolicyCounterHandle: tpm2.HandleNull,
+			StorageHierarchy:       hierarchy}); err != nil {
+			t.Fatalf("SealKeyToTPM failed: %v", err)
+		}
+
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+
+		if err := k.ChangePIN(tpm, "", "1234"); err != nil {
+			t.Fatalf("ChangePIN failed: %v", err)
+		}
+
+		unsealedKey, _, err := k.UnsealFromTPM(tpm, "1234")
+		if err != nil {
+			t.Fatalf("UnsealFromTPM failed: %v", err)
+		}
+		if !bytes.Equal(unsealedKey, key) {
+			t.Errorf("TPM returned the wrong key")
+		}
+	}
+
+	t.Run("Endorsement", func(t *testing.T) {
+		run(t, tpm2.HandleEndorsement)
+	})
+
+	t.Run("Platform", func(t *testing.T) {
+		run(t, tpm2.HandlePlatform)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		tmpDir, err := ioutil.TempDir("", "_TestSealKeyWithStorageHierarchy_")
+		if err != nil {
+			t.Fatalf("Creating temporary directory failed: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		_, err = SealKeyToTPM(tpm, key, filepath.Join(tmpDir, "keydata"), &KeyCreationParams{
+			PCRProfile:             getTestPCRProfile(),
+			PCRPolicyCounterHandle: tpm2.HandleNull,
+			StorageHierarchy:       tpm2.HandleNull})
+		if err == nil || err.Error() != "cannot provision storage root key: invalid StorageHierarchy" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
+
+func TestSealKeyWithAutoPCRPolicyCounterHandle(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	// Occupy the first handle in the range used for automatic allocation.
+	public := tpm2.NVPublic{
+		Index:   0x01810000,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead),
+		Size:    8}
+	index, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, &public, nil)
+	if err != nil {
+		t.Fatalf("NVDefineSpace failed: %v", err)
+	}
+	defer undefineNVSpace(t, tpm, index, tpm.OwnerHandleContext())
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestSealKeyWithAutoPCRPolicyCounterHandle_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var handles []tpm2.Handle
+	for _, name := range []string{"keydata1", "keydata2"} {
+		keyFile := filepath.Join(tmpDir, name)
+
+		if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{
+			PCRProfile:             getTestPCRProfile(),
+			PCRPolicyCounterHandle: AutoPCRPolicyCounterHandle}); err != nil {
+			t.Fatalf("SealKeyToTPM failed: %v", err)
+		}
+		defer undefineKeyNVSpace(t, tpm, keyFile)
+
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		handles = append(handles, k.PCRPolicyCounterHandle())
+
+		if _, _, err := k.UnsealFromTPM(tpm, ""); err != nil {
+			t.Errorf("UnsealFromTPM failed: %v", err)
+		}
+	}
+
+	if handles[0] != 0x01810001 {
+		t.Errorf("Unexpected handle for first key: %v", handles[0])
+	}
+	if handles[1] != 0x01810002 {
+		t.Errorf("Unexpected handle for second key: %v", handles[1])
+	}
+}
+
+func TestSealKeyWithRequiredPCRBanks(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	run := func(t *testing.T, profile *PCRProtectionProfile) error {
+		tmpDir, err := ioutil.TempDir("", "_TestSealKeyWithRequiredPCRBanks_")
+		if err != nil {
+			t.Fatalf("Creating temporary directory failed: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		keyFile := filepath.Join(tmpDir, "keydata")
+
+		if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{
+			PCRProfile:             profile,
+			RequiredPCRBanks:       []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256, tpm2.HashAlgorithmSHA1},
+			PCRPolicyCounterHandle: tpm2.HandleNull}); err != nil {
+			if _, err := os.Stat(keyFile); err == nil {
+				t.Errorf("SealKeyToTPM failed but left a key file behind")
+			}
+			return err
+		}
+
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		unsealedKey, _, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			t.Fatalf("UnsealFromTPM failed: %v", err)
+		}
+		if !bytes.Equal(unsealedKey, key) {
+			t.Errorf("Unexpected key")
+		}
+		return nil
+	}
+
+	t.Run("AllBanks", func(t *testing.T) {
+		profile := NewPCRProtectionProfile().AddProfileAND(
+			NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7),
+			NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA1, 7))
+		if err := run(t, profile); err != nil {
+			t.Errorf("SealKeyToTPM failed: %v", err)
+		}
+	})
+
+	t.Run("MissingBank", func(t *testing.T) {
+		err := run(t, getTestPCRProfile())
+		if err == nil || err.Error() != "PCR protection profile doesn't contain any values for the TPM_ALG_SHA1 bank" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("DifferentPCRs", func(t *testing.T) {
+		profile := NewPCRProtectionProfile().AddProfileAND(
+			NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7),
+			NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA1, 8))
+		err := run(t, profile)
+		if err == nil || err.Error() != "PCR protection profile doesn't contain a value for PCR 7 in the TPM_ALG_SHA1 bank" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		tmpDir, err := ioutil.TempDir("", "_TestSealKeyWithRequiredPCRBanks_")
+		if err != nil {
+			t.Fatalf("Creating temporary directory failed: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		keyFile := filepath.Join(tmpDir, "keydata")
+
+		profile := NewPCRProtectionProfile().AddProfileAND(
+			NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7),
+			NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA1, 7))
+		authKey, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{
+			PCRProfile:             profile,
+			RequiredPCRBanks:       []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256, tpm2.HashAlgorithmSHA1},
+			PCRPolicyCounterHandle: tpm2.HandleNull})
+		if err != nil {
+			t.Fatalf("SealKeyToTPM failed: %v", err)
+		}
+
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+
+		err = k.UpdatePCRProtectionPolicy(tpm, authKey, getTestPCRProfile())
+		if err == nil || err.Error() != "PCR protection profile doesn't contain any values for the TPM_ALG_SHA1 bank" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+
+		if err := k.UpdatePCRProtectionPolicy(tpm, authKey, profile); err != nil {
+			t.Errorf("UpdatePCRProtectionPolicy failed: %v", err)
+		}
+
+		k, err = ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		err = k.UpdatePCRProtectionPolicy(tpm, authKey, getTestPCRProfile())
+		if err == nil || err.Error() != "PCR protection profile doesn't contain any values for the TPM_ALG_SHA1 bank" {
+			t.Errorf("Unexpected error after reloading the key data file: %v", err)
+		}
+	})
 }
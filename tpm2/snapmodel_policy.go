@@ -23,6 +23,7 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
+	"fmt"
 
 	"github.com/canonical/go-tpm2"
 
@@ -33,6 +34,19 @@ import (
 
 const zeroSnapSystemEpoch uint32 = 0
 
+// SnapModelMeasurementScheme describes how snap-bootstrap measures a model assertion.
+type SnapModelMeasurementScheme int
+
+const (
+	// SnapModelMeasurementSchemeCombined indicates that the signing key, brand-id, model,
+	// series and grade are measured together in a single digest. This is the default.
+	SnapModelMeasurementSchemeCombined SnapModelMeasurementScheme = iota
+
+	// SnapModelMeasurementSchemeSeparate indicates that the signing key and grade are
+	// measured separately from the brand-id, model and series.
+	SnapModelMeasurementSchemeSeparate
+)
+
 func computeSnapSystemEpochDigest(alg tpm2.HashAlgorithmId, epoch uint32) tpm2.Digest {
 	h := alg.NewHash()
 	binary.Write(h, binary.LittleEndian, epoch)
@@ -64,6 +78,51 @@ func computeSnapModelDigest(alg tpm2.HashAlgorithmId, model secboot.SnapModel) (
 	return h.Sum(nil), nil
 }
 
+// computeSnapModelDigests computes the sequence of digests that snap-bootstrap measures for
+// the supplied model using the specified measurement scheme.
+func computeSnapModelDigests(alg tpm2.HashAlgorithmId, model secboot.SnapModel, scheme SnapModelMeasurementScheme) (tpm2.DigestList, error) {
+	switch scheme {
+	case SnapModelMeasurementSchemeCombined:
+		digest, err := computeSnapModelDigest(alg, model)
+		if err != nil {
+			return nil, err
+		}
+		return tpm2.DigestList{digest}, nil
+	case SnapModelMeasurementSchemeSeparate:
+		signKeyId, err := base64.RawURLEncoding.DecodeString(model.SignKeyID())
+		if err != nil {
+			return nil, xerrors.Errorf("cannot decode signing key ID: %w", err)
+		}
+
+		h := alg.NewHash()
+		binary.Write(h, binary.LittleEndian, uint16(tpm2.HashAlgorithmSHA384))
+		h.Write(signKeyId)
+		signKeyDigest := h.Sum(nil)
+
+		h = alg.NewHash()
+		h.Write([]byte(model.BrandID()))
+		digest := h.Sum(nil)
+
+		h = alg.NewHash()
+		h.Write(digest)
+		h.Write([]byte(model.Model()))
+		digest = h.Sum(nil)
+
+		h = alg.NewHash()
+		h.Write(digest)
+		h.Write([]byte(model.Series()))
+		modelDigest := h.Sum(nil)
+
+		h = alg.NewHash()
+		binary.Write(h, binary.LittleEndian, model.Grade().Code())
+		gradeDigest := h.Sum(nil)
+
+		return tpm2.DigestList{signKeyDigest, modelDigest, gradeDigest}, nil
+	default:
+		return nil, errors.New("invalid model measurement scheme")
+	}
+}
+
 // SnapModelProfileParams provides the parameters to AddSnapModelProfile.
 type SnapModelProfileParams struct {
 	// PCRAlgorithm is the algorithm for which to compute PCR digests for. TPMs compliant with the "TCG PC Client Platform TPM Profile
@@ -76,6 +135,18 @@ type SnapModelProfileParams struct {
 
 	// Models is the set of models to add to the PCR profile.
 	Models []secboot.SnapModel
+
+	// PendingModels is an optional set of models that the device is being remodeled to. These
+	// are added to the PCR profile as a separate branch from Models, so that the device can boot
+	// with either the current or the new model whilst the remodel is in progress. Models that also
+	// appear in Models are ignored. Once the remodel is complete, the profile should be recomputed
+	// without PendingModels so that the old models are no longer permitted.
+	PendingModels []secboot.SnapModel
+
+	// MeasurementScheme specifies how snap-bootstrap measures each model. This must match the
+	// scheme used by the component that performs the measurements, such as
+	// MeasureSnapModelToTPMWithScheme.
+	MeasurementScheme SnapModelMeasurementScheme
 }
 
 // AddSnapModelProfile adds the snap model profile to the PCR protection profile, as measured by snap-bootstrap, in order to generate
@@ -91,7 +162,8 @@ type SnapModelProfileParams struct {
 //
 // A future version of this package may allow another epoch to be supplied.
 //
-// digestModel is computed as follows (where H is the digest algorithm supplied via params.PCRAlgorithm):
+// If params.MeasurementScheme is SnapModelMeasurementSchemeCombined, digestModel is computed as follows (where H is the digest
+// algorithm supplied via params.PCRAlgorithm):
 //  digest1 = H(tpm2.HashAlgorithmSHA384 || sign-key-sha3-384 || brand-id)
 //  digest2 = H(digest1 || model)
 //  digestModel = H(digest2 || series || grade)
@@ -101,9 +173,28 @@ type SnapModelProfileParams struct {
 //
 // Separate extend operations are used because brand-id, model and series are variable length.
 //
+// If params.MeasurementScheme is SnapModelMeasurementSchemeSeparate, digestModel is replaced by 3 measurements:
+//  digestSignKey
+//  digestModel
+//  digestGrade
+// These are computed as follows:
+//  digestSignKey = H(tpm2.HashAlgorithmSHA384 || sign-key-sha3-384)
+//  digest1 = H(brand-id)
+//  digest2 = H(digest1 || model)
+//  digestModel = H(digest2 || series)
+//  digestGrade = H(grade)
+// The fields are encoded in the same way as for SnapModelMeasurementSchemeCombined. This scheme allows a policy to be
+// evaluated against the signing key and grade independently of the brand-id, model and series. It is only useful if the
+// component that measures the model uses the same scheme.
+//
 // The PCR index that snap-bootstrap measures the model to can be specified via the PCRIndex field of params.
 //
-// The set of models to add to the PCRProtectionProfile is specified via the Models field of params.
+// The set of models to add to the PCRProtectionProfile is specified via the Models field of params. If the device is being
+// remodeled, the models that it is being remodeled to can be specified via the PendingModels field of params. The profile then
+// consists of one branch for the current models and one branch for the pending models.
+//
+// The corresponding measurements can be made with MeasureSnapSystemEpochToTPM and MeasureSnapModelToTPMWithScheme, which use the
+// same code to compute the digests as this function.
 func AddSnapModelProfile(profile *PCRProtectionProfile, params *SnapModelProfileParams) error {
 	if params.PCRIndex < 0 {
 		return errors.New("invalid PCR index")
@@ -114,30 +205,80 @@ func AddSnapModelProfile(profile *PCRProtectionProfile, params *SnapModelProfile
 
 	profile.ExtendPCR(params.PCRAlgorithm, params.PCRIndex, computeSnapSystemEpochDigest(params.PCRAlgorithm, zeroSnapSystemEpoch))
 
+	seen := make(map[string]bool)
+	currentBranch, err := computeSnapModelsProfile(params, params.Models, seen)
+	if err != nil {
+		return err
+	}
+	pendingBranch, err := computeSnapModelsProfile(params, params.PendingModels, seen)
+	if err != nil {
+		return xerrors.Errorf("cannot compute profile for pending models: %w", err)
+	}
+
+	if pendingBranch == nil {
+		profile.AddProfileOR(currentBranch)
+	} else {
+		profile.AddProfileOR(currentBranch, pendingBranch)
+	}
+	return nil
+}
+
+// computeSnapModelsProfile computes a profile containing a branch for each of the supplied models. Models with measurements that
+// are already in seen are skipped, and the measurements of the other models are added to it. If there are no models left, nil is
+// returned.
+func computeSnapModelsProfile(params *SnapModelProfileParams, models []secboot.SnapModel, seen map[string]bool) (*PCRProtectionProfile, error) {
 	var subProfiles []*PCRProtectionProfile
-	for _, model := range params.Models {
+	for _, model := range models {
 		if model == nil {
-			return errors.New("nil model")
+			return nil, errors.New("nil model")
 		}
 
-		digest, err := computeSnapModelDigest(params.PCRAlgorithm, model)
+		digests, err := computeSnapModelDigests(params.PCRAlgorithm, model, params.MeasurementScheme)
 		if err != nil {
-			return err
+			return nil, err
+		}
+
+		var key []byte
+		for _, digest := range digests {
+			key = append(key, digest...)
+		}
+		if seen[string(key)] {
+			continue
 		}
-		subProfiles = append(subProfiles, NewPCRProtectionProfile().ExtendPCR(params.PCRAlgorithm, params.PCRIndex, digest))
+		seen[string(key)] = true
+
+		subProfile := NewPCRProtectionProfile()
+		for _, digest := range digests {
+			subProfile.ExtendPCR(params.PCRAlgorithm, params.PCRIndex, digest)
+		}
+		subProfiles = append(subProfiles, subProfile)
 	}
 
-	profile.AddProfileOR(subProfiles...)
-	return nil
+	if len(subProfiles) == 0 {
+		return nil, nil
+	}
+	return NewPCRProtectionProfile().AddProfileOR(subProfiles...), nil
 }
 
 func measureSnapPropertyToTPM(tpm *Connection, pcrIndex int, computeDigest func(tpm2.HashAlgorithmId) (tpm2.Digest, error)) error {
+	return measureSnapPropertiesToTPM(tpm, pcrIndex, 1, func(alg tpm2.HashAlgorithmId) (tpm2.DigestList, error) {
+		digest, err := computeDigest(alg)
+		if err != nil {
+			return nil, err
+		}
+		return tpm2.DigestList{digest}, nil
+	})
+}
+
+// measureSnapPropertiesToTPM extends n digests to the specified PCR for all supported PCR banks. The digests for every bank are
+// computed before the first extend, so that an error computing them doesn't result in a partial measurement.
+func measureSnapPropertiesToTPM(tpm *Connection, pcrIndex int, n int, computeDigests func(tpm2.HashAlgorithmId) (tpm2.DigestList, error)) error {
 	pcrSelection, err := tpm.GetCapabilityPCRs(tpm.HmacSession().IncludeAttrs(tpm2.AttrAudit))
 	if err != nil {
 		return xerrors.Errorf("cannot determine supported PCR banks: %w", err)
 	}
 
-	var digests tpm2.TaggedHashList
+	measurements := make([]tpm2.TaggedHashList, n)
 	for _, s := range pcrSelection {
 		if !s.Hash.Supported() {
 			// We can't compute a digest for this algorithm, which is unfortunate. It's unlikely that we'll come across a TPM that supports a
@@ -146,15 +287,25 @@ func measureSnapPropertyToTPM(tpm *Connection, pcrIndex int, computeDigest func(
 			continue
 		}
 
-		digest, err := computeDigest(s.Hash)
+		digests, err := computeDigests(s.Hash)
 		if err != nil {
 			return xerrors.Errorf("cannot compute digest for algorithm %v: %w", s.Hash, err)
 		}
+		if len(digests) != n {
+			return fmt.Errorf("unexpected number of digests for algorithm %v", s.Hash)
+		}
 
-		digests = append(digests, tpm2.TaggedHash{HashAlg: s.Hash, Digest: digest})
+		for i, digest := range digests {
+			measurements[i] = append(measurements[i], tpm2.TaggedHash{HashAlg: s.Hash, Digest: digest})
+		}
 	}
 
-	return tpm.PCRExtend(tpm.PCRHandleContext(pcrIndex), digests, tpm.HmacSession())
+	for _, digests := range measurements {
+		if err := tpm.PCRExtend(tpm.PCRHandleContext(pcrIndex), digests, tpm.HmacSession()); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // MeasureSnapSystemEpochToTPM measures a digest of uint32(0) to the specified PCR for all supported PCR banks. See the documentation
@@ -168,7 +319,25 @@ func MeasureSnapSystemEpochToTPM(tpm *Connection, pcrIndex int) error {
 // MeasureSnapModelToTPM measures a digest of the supplied model assertion to the specified PCR for all supported PCR banks.
 // See the documentation for AddSnapModelProfile for details of how the digest of the model is computed.
 func MeasureSnapModelToTPM(tpm *Connection, pcrIndex int, model secboot.SnapModel) error {
-	return measureSnapPropertyToTPM(tpm, pcrIndex, func(alg tpm2.HashAlgorithmId) (tpm2.Digest, error) {
-		return computeSnapModelDigest(alg, model)
+	return MeasureSnapModelToTPMWithScheme(tpm, pcrIndex, model, SnapModelMeasurementSchemeCombined)
+}
+
+// MeasureSnapModelToTPMWithScheme measures the supplied model assertion to the specified PCR for all supported PCR banks, using
+// the specified measurement scheme. See the documentation for AddSnapModelProfile for details of the measurements made by each
+// scheme.
+//
+// SnapModelMeasurementSchemeSeparate requires more than one extend operation, which the TPM can't perform atomically. All of the
+// digests are computed before the first extend, but if one of the extend operations fails, the PCR is left with a value that
+// doesn't correspond to any branch of a profile created with AddSnapModelProfile, so keys bound to it will fail to unseal for the
+// rest of the boot.
+func MeasureSnapModelToTPMWithScheme(tpm *Connection, pcrIndex int, model secboot.SnapModel, scheme SnapModelMeasurementScheme) error {
+	// The number of measurements only depends on the scheme, so use any algorithm to determine it.
+	digests, err := computeSnapModelDigests(tpm2.HashAlgorithmSHA256, model, scheme)
+	if err != nil {
+		return err
+	}
+
+	return measureSnapPropertiesToTPM(tpm, pcrIndex, len(digests), func(alg tpm2.HashAlgorithmId) (tpm2.DigestList, error) {
+		return computeSnapModelDigests(alg, model, scheme)
 	})
 }
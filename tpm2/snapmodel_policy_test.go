@@ -380,6 +380,133 @@ func (s *snapModelProfileSuite) TestAddSnapModelProfile11(c *C) {
 	})
 }
 
+func (s *snapModelProfileSuite) TestAddSnapModelProfileWithPendingModels(c *C) {
+	// Test that pending models are added as alternative branches for remodeling.
+	s.testAddSnapModelProfile(c, &testAddSnapModelProfileData{
+		params: &SnapModelProfileParams{
+			PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+			PCRIndex:     12,
+			Models: []secboot.SnapModel{
+				testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+					"authority-id": "fake-brand",
+					"series":       "16",
+					"brand-id":     "fake-brand",
+					"model":        "fake-model",
+					"grade":        "secured",
+				}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij"),
+			},
+			PendingModels: []secboot.SnapModel{
+				testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+					"authority-id": "fake-brand",
+					"series":       "16",
+					"brand-id":     "fake-brand",
+					"model":        "other-model",
+					"grade":        "secured",
+				}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij"),
+			},
+		},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					12: testutil.DecodeHexString(c, "bd7851fd994a7f899364dbc96a95dffeaa250cd7ea33b4b6c313866169e779bc"),
+				},
+			},
+			{
+				tpm2.HashAlgorithmSHA256: {
+					12: testutil.DecodeHexString(c, "7135fd41c92f097075cc21eefd6797498544fd329b3bf996654885ebf83bb2de"),
+				},
+			},
+		},
+	})
+}
+
+func (s *snapModelProfileSuite) TestAddSnapModelProfileWithDuplicatePendingModel(c *C) {
+	// Test that a pending model that is also a current model doesn't create another branch.
+	model := testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+		"authority-id": "fake-brand",
+		"series":       "16",
+		"brand-id":     "fake-brand",
+		"model":        "fake-model",
+		"grade":        "secured",
+	}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")
+
+	s.testAddSnapModelProfile(c, &testAddSnapModelProfileData{
+		params: &SnapModelProfileParams{
+			PCRAlgorithm:  tpm2.HashAlgorithmSHA256,
+			PCRIndex:      12,
+			Models:        []secboot.SnapModel{model},
+			PendingModels: []secboot.SnapModel{model},
+		},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					12: testutil.DecodeHexString(c, "bd7851fd994a7f899364dbc96a95dffeaa250cd7ea33b4b6c313866169e779bc"),
+				},
+			},
+		},
+	})
+}
+
+func (s *snapModelProfileSuite) TestAddSnapModelProfileWithNilPendingModel(c *C) {
+	c.Check(AddSnapModelProfile(NewPCRProtectionProfile(), &SnapModelProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		PCRIndex:     12,
+		Models: []secboot.SnapModel{
+			testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+				"authority-id": "fake-brand",
+				"series":       "16",
+				"brand-id":     "fake-brand",
+				"model":        "fake-model",
+				"grade":        "secured",
+			}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij"),
+		},
+		PendingModels: []secboot.SnapModel{nil},
+	}), ErrorMatches, "cannot compute profile for pending models: nil model")
+}
+
+func (s *snapModelProfileSuite) TestAddSnapModelProfileWithSeparateMeasurementScheme(c *C) {
+	s.testAddSnapModelProfile(c, &testAddSnapModelProfileData{
+		params: &SnapModelProfileParams{
+			PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+			PCRIndex:     12,
+			Models: []secboot.SnapModel{
+				testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+					"authority-id": "fake-brand",
+					"series":       "16",
+					"brand-id":     "fake-brand",
+					"model":        "fake-model",
+					"grade":        "secured",
+				}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij"),
+			},
+			MeasurementScheme: SnapModelMeasurementSchemeSeparate,
+		},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					12: testutil.DecodeHexString(c, "34c63843b7a0054ebeb3911bc1a348e1ca33ecee1f6e1b9678825106e223d4b0"),
+				},
+			},
+		},
+	})
+}
+
+func (s *snapModelProfileSuite) TestAddSnapModelProfileInvalidMeasurementScheme(c *C) {
+	c.Check(AddSnapModelProfile(NewPCRProtectionProfile(), &SnapModelProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		PCRIndex:     12,
+		Models: []secboot.SnapModel{
+			testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+				"authority-id": "fake-brand",
+				"series":       "16",
+				"brand-id":     "fake-brand",
+				"model":        "fake-model",
+				"grade":        "secured",
+			}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij"),
+		},
+		MeasurementScheme: 5,
+	}), ErrorMatches, "invalid model measurement scheme")
+}
+
 type snapModelMeasureSuite struct {
 	testutil.TPMSimulatorTestBase
 }
@@ -532,6 +659,24 @@ func (s *snapModelMeasureSuite) TestMeasureSnapModelToTPMTest7(c *C) {
 	})
 }
 
+func (s *snapModelMeasureSuite) TestMeasureSnapModelToTPMWithSeparateScheme(c *C) {
+	// Test that the measurements made match the digest predicted by AddSnapModelProfile.
+	model := testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+		"authority-id": "fake-brand",
+		"series":       "16",
+		"brand-id":     "fake-brand",
+		"model":        "fake-model",
+		"grade":        "secured",
+	}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")
+
+	c.Check(MeasureSnapSystemEpochToTPM(s.TPM, 12), IsNil)
+	c.Check(MeasureSnapModelToTPMWithScheme(s.TPM, 12, model, SnapModelMeasurementSchemeSeparate), IsNil)
+
+	_, pcrValues, err := s.TPM.PCRRead(tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{12}}})
+	c.Assert(err, IsNil)
+	c.Check(pcrValues[tpm2.HashAlgorithmSHA256][12], DeepEquals, tpm2.Digest(testutil.DecodeHexString(c, "34c63843b7a0054ebeb3911bc1a348e1ca33ecee1f6e1b9678825106e223d4b0")))
+}
+
 func (s *snapModelMeasureSuite) testMeasureSnapSystemEpochToTPM(c *C, pcrIndex int) {
 	pcrSelection, err := s.TPM.GetCapabilityPCRs()
 	c.Assert(err, IsNil)
@@ -580,3 +725,44 @@ func (s *snapModelMeasureSuite) TestMeasureSnapSystemEpochToTPM1(c *C) {
 func (s *snapModelMeasureSuite) TestMeasureSnapSystemEpochToTPM2(c *C) {
 	s.testMeasureSnapSystemEpochToTPM(c, 14)
 }
+
+func (s *snapModelMeasureSuite) testMeasurementsMatchProfile(c *C, scheme SnapModelMeasurementScheme) {
+	model := testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+		"authority-id": "fake-brand",
+		"series":       "16",
+		"brand-id":     "fake-brand",
+		"model":        "fake-model",
+		"grade":        "signed",
+	}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")
+
+	pcrSelection, err := s.TPM.GetCapabilityPCRs()
+	c.Assert(err, IsNil)
+
+	c.Check(MeasureSnapSystemEpochToTPM(s.TPM, 12), IsNil)
+	c.Check(MeasureSnapModelToTPMWithScheme(s.TPM, 12, model, scheme), IsNil)
+
+	for _, selection := range pcrSelection {
+		profile := NewPCRProtectionProfile()
+		c.Check(AddSnapModelProfile(profile, &SnapModelProfileParams{
+			PCRAlgorithm:      selection.Hash,
+			PCRIndex:          12,
+			Models:            []secboot.SnapModel{model},
+			MeasurementScheme: scheme}), IsNil)
+
+		expected, err := profile.ComputePCRValues(nil)
+		c.Assert(err, IsNil)
+		c.Assert(expected, HasLen, 1)
+
+		_, pcrValues, err := s.TPM.PCRRead(tpm2.PCRSelectionList{{Hash: selection.Hash, Select: []int{12}}})
+		c.Assert(err, IsNil)
+		c.Check(pcrValues, DeepEquals, expected[0])
+	}
+}
+
+func (s *snapModelMeasureSuite) TestMeasurementsMatchProfileCombined(c *C) {
+	s.testMeasurementsMatchProfile(c, SnapModelMeasurementSchemeCombined)
+}
+
+func (s *snapModelMeasureSuite) TestMeasurementsMatchProfileSeparate(c *C) {
+	s.testMeasurementsMatchProfile(c, SnapModelMeasurementSchemeSeparate)
+}
@@ -0,0 +1,215 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/secmem"
+)
+
+// systemdPrimaryTemplate is the template for the ECC primary key that systemd-cryptsetup creates in the storage
+// hierarchy to act as the parent of its sealed objects. Sealed objects exported for systemd-cryptsetup must be
+// created under a key with this template.
+var systemdPrimaryTemplate = tpm2.Public{
+	Type:    tpm2.ObjectTypeECC,
+	NameAlg: tpm2.HashAlgorithmSHA256,
+	Attrs: tpm2.AttrFixedTPM | tpm2.AttrFixedParent | tpm2.AttrSensitiveDataOrigin | tpm2.AttrUserWithAuth |
+		tpm2.AttrRestricted | tpm2.AttrDecrypt,
+	Params: &tpm2.PublicParamsU{
+		ECCDetail: &tpm2.ECCParams{
+			Symmetric: tpm2.SymDefObject{
+				Algorithm: tpm2.SymObjectAlgorithmAES,
+				KeyBits:   &tpm2.SymKeyBitsU{Sym: 128},
+				Mode:      &tpm2.SymModeU{Sym: tpm2.SymModeCFB}},
+			Scheme:  tpm2.ECCScheme{Scheme: tpm2.ECCSchemeNull},
+			CurveID: tpm2.ECCCurveNIST_P256,
+			KDF:     tpm2.KDFScheme{Scheme: tpm2.KDFAlgorithmNull}}},
+	Unique: &tpm2.PublicIDU{ECC: &tpm2.ECCPoint{}}}
+
+// SystemdTPM2Token corresponds to a LUKS2 token of the type "systemd-tpm2", which is the format used by
+// systemd-cryptenroll and systemd-cryptsetup for TPM2 enrollments.
+type SystemdTPM2Token struct {
+	Keyslots   []int                // The keyslots that this token unlocks
+	Blob       []byte               // The private and public areas of the sealed object
+	PCRs       []int                // The PCRs that the sealed object is bound to
+	PCRBank    tpm2.HashAlgorithmId // The PCR bank that the sealed object is bound to
+	PolicyHash tpm2.Digest          // The authorization policy digest of the sealed object
+}
+
+func (t *SystemdTPM2Token) MarshalJSON() ([]byte, error) {
+	keyslots := make([]string, 0, len(t.Keyslots))
+	for _, s := range t.Keyslots {
+		keyslots = append(keyslots, strconv.Itoa(s))
+	}
+
+	var bank string
+	switch t.PCRBank {
+	case tpm2.HashAlgorithmSHA1:
+		bank = "sha1"
+	case tpm2.HashAlgorithmSHA256:
+		bank = "sha256"
+	default:
+		return nil, xerrors.Errorf("unsupported PCR bank %v", t.PCRBank)
+	}
+
+	pcrs := t.PCRs
+	if pcrs == nil {
+		pcrs = []int{}
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"type":             "systemd-tpm2",
+		"keyslots":         keyslots,
+		"tpm2-blob":        base64.StdEncoding.EncodeToString(t.Blob),
+		"tpm2-pcrs":        pcrs,
+		"tpm2-pcr-bank":    bank,
+		"tpm2-primary-alg": "ecc",
+		"tpm2-policy-hash": hex.EncodeToString(t.PolicyHash),
+		"tpm2-pin":         false})
+}
+
+// ExportSystemdTPM2Token creates a sealed object in a format that can be unlocked by systemd-cryptsetup, so that a
+// volume enrolled with this package can still be unlocked in a rescue environment that only has systemd's tooling.
+//
+// systemd-cryptsetup can only satisfy a policy that binds a sealed object to a single set of values for PCRs in a
+// single bank, which can't be revoked. The key protected by this sealed key object is therefore never exported.
+// Instead, a new random passphrase is sealed to the current values of the PCRs selected by this sealed key object,
+// for use with a separate keyslot. The current PCR values must satisfy the PCR policy of this sealed key object.
+// The exported object is not affected when the PCR policy of this sealed key object is updated or revoked, so access
+// can only be revoked by removing the associated keyslot, and it must be re-exported after the PCR values change.
+//
+// If this sealed key object has a PIN, a lock index, a rollback counter, a lifetime limit, a locality restriction or
+// a command code restriction, a wrapped ErrSystemdIncompatiblePolicy error will be returned, because
+// systemd-cryptsetup cannot enforce these.
+//
+// This function requires knowledge of the authorization value for the storage hierarchy, which must be provided by
+// calling Connection.OwnerHandleContext().SetAuthValue() prior to calling this function. If the provided
+// authorization value is incorrect, a AuthFailError error will be returned.
+//
+// On success, this returns the token and the passphrase that systemd-cryptsetup will use to unlock the volume with
+// it. The caller must add the passphrase to a new keyslot and set the token's Keyslots field before importing the
+// token in to the LUKS2 header.
+//
+// This function is subject to ConnectionOptions.RequireEncryptedSessions.
+func (k *SealedKeyObject) ExportSystemdTPM2Token(tpm *Connection) (token *SystemdTPM2Token, passphrase []byte, err error) {
+	if err := tpm.checkEncryptedSessionsAvailable(); err != nil {
+		return nil, nil, err
+	}
+
+	switch {
+	case k.data.version == 0:
+		return nil, nil, xerrors.Errorf("version 0 key data files are not supported: %w", ErrSystemdIncompatiblePolicy)
+	case k.data.authModeHint == authModePIN:
+		return nil, nil, xerrors.Errorf("the key has a PIN: %w", ErrSystemdIncompatiblePolicy)
+	case k.data.staticPolicyData.lockIndexHandle != tpm2.HandleNull:
+		return nil, nil, xerrors.Errorf("the key has a lock index: %w", ErrSystemdIncompatiblePolicy)
+	case k.data.staticPolicyData.rollbackCounterHandle != tpm2.HandleNull:
+		return nil, nil, xerrors.Errorf("the key has a rollback counter: %w", ErrSystemdIncompatiblePolicy)
+	case len(k.data.staticPolicyData.counterTimerAssertions) > 0:
+		return nil, nil, xerrors.Errorf("the key has a limited lifetime: %w", ErrSystemdIncompatiblePolicy)
+	case k.data.staticPolicyData.locality != 0:
+		return nil, nil, xerrors.Errorf("the key has a locality restriction: %w", ErrSystemdIncompatiblePolicy)
+	case k.data.staticPolicyData.commandCode != 0:
+		return nil, nil, xerrors.Errorf("the key has a command code restriction: %w", ErrSystemdIncompatiblePolicy)
+	}
+
+	pcrs := k.data.dynamicPolicyData.pcrSelection
+	if len(pcrs) != 1 || len(pcrs[0].Select) == 0 {
+		return nil, nil, xerrors.Errorf("the key is not bound to PCRs in a single bank: %w", ErrSystemdIncompatiblePolicy)
+	}
+	switch pcrs[0].Hash {
+	case tpm2.HashAlgorithmSHA1, tpm2.HashAlgorithmSHA256:
+	default:
+		return nil, nil, xerrors.Errorf("the key is bound to an unsupported PCR bank: %w", ErrSystemdIncompatiblePolicy)
+	}
+
+	// Check that the current PCR values satisfy the PCR policy of this sealed key object.
+	key, _, err := k.UnsealFromTPM(tpm, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	secmem.Wipe(key)
+
+	// systemd-cryptsetup computes the policy digest with SHA-256 regardless of the PCR bank.
+	_, values, err := tpm.PCRRead(pcrs)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot read current PCR values: %w", err)
+	}
+	pcrDigest, err := tpm2.ComputePCRDigest(tpm2.HashAlgorithmSHA256, pcrs, values)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot compute PCR digest: %w", err)
+	}
+	trial, _ := tpm2.ComputeAuthPolicy(tpm2.HashAlgorithmSHA256)
+	trial.PolicyPCR(pcrDigest, pcrs)
+	policy := trial.GetDigest()
+
+	session := tpm.HmacSession()
+
+	primary, _, _, _, _, err := tpm.CreatePrimary(tpm.OwnerHandleContext(), nil, &systemdPrimaryTemplate, nil, nil, session)
+	switch {
+	case isAuthFailError(err, tpm2.CommandCreatePrimary, 1):
+		return nil, nil, AuthFailError{tpm2.HandleOwner}
+	case err != nil:
+		return nil, nil, xerrors.Errorf("cannot create primary key: %w", err)
+	}
+	defer tpm.FlushContext(primary)
+
+	// systemd-cryptsetup uses the base64 encoding of the unsealed secret as the passphrase.
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, nil, xerrors.Errorf("cannot obtain secret for sealed object: %w", err)
+	}
+	defer secmem.Wipe(secret)
+	passphrase = []byte(base64.StdEncoding.EncodeToString(secret))
+
+	template := makeSealedKeyTemplate()
+	template.AuthPolicy = policy
+	sensitive := tpm2.SensitiveCreate{Data: secret}
+	priv, pub, _, _, _, err := tpm.Create(primary, &sensitive, template, nil, nil, session.IncludeAttrs(tpm2.AttrCommandEncrypt))
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot create sealed object: %w", err)
+	}
+
+	blob, err := mu.MarshalToBytes(priv, pub)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot marshal sealed object: %w", err)
+	}
+
+	var selected []int
+	selected = append(selected, pcrs[0].Select...)
+	sort.Ints(selected)
+
+	return &SystemdTPM2Token{
+		Blob:       blob,
+		PCRs:       selected,
+		PCRBank:    pcrs[0].Hash,
+		PolicyHash: policy}, passphrase, nil
+}
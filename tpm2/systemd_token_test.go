@@ -0,0 +1,195 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/canonical/go-tpm2/mu"
+
+	"golang.org/x/xerrors"
+
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+func TestExportSystemdTPM2Token(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestExportSystemdTPM2Token_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+	if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: NoPCRPolicyCounterHandle}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	token, passphrase, err := k.ExportSystemdTPM2Token(tpm)
+	if err != nil {
+		t.Fatalf("ExportSystemdTPM2Token failed: %v", err)
+	}
+	if len(passphrase) == 0 || bytes.Equal(passphrase, []byte(base64.StdEncoding.EncodeToString(key))) {
+		t.Errorf("The passphrase should not be derived from the key")
+	}
+	if !reflect.DeepEqual(token.PCRs, []int{7}) {
+		t.Errorf("Unexpected PCRs: %v", token.PCRs)
+	}
+	if token.PCRBank != tpm2.HashAlgorithmSHA256 {
+		t.Errorf("Unexpected PCR bank: %v", token.PCRBank)
+	}
+
+	token.Keyslots = []int{2}
+	b, err := json.Marshal(token)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if m["type"] != "systemd-tpm2" {
+		t.Errorf("Unexpected type: %v", m["type"])
+	}
+	if !reflect.DeepEqual(m["keyslots"], []interface{}{"2"}) {
+		t.Errorf("Unexpected keyslots: %v", m["keyslots"])
+	}
+	if m["tpm2-pcr-bank"] != "sha256" {
+		t.Errorf("Unexpected PCR bank: %v", m["tpm2-pcr-bank"])
+	}
+
+	// Unseal the exported object in the same way as systemd-cryptsetup.
+	var priv tpm2.Private
+	var pub *tpm2.Public
+	if _, err := mu.UnmarshalFromBytes(token.Blob, &priv, &pub); err != nil {
+		t.Fatalf("UnmarshalFromBytes failed: %v", err)
+	}
+	if !bytes.Equal(pub.AuthPolicy, token.PolicyHash) {
+		t.Errorf("Unexpected policy hash")
+	}
+
+	primary, _, _, _, _, err := tpm.CreatePrimary(tpm.OwnerHandleContext(), nil, SystemdPrimaryTemplate, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("CreatePrimary failed: %v", err)
+	}
+	defer flushContext(t, tpm, primary)
+
+	object, err := tpm.Load(primary, priv, pub, nil)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	defer flushContext(t, tpm, object)
+
+	session, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, tpm2.HashAlgorithmSHA256)
+	if err != nil {
+		t.Fatalf("StartAuthSession failed: %v", err)
+	}
+	defer flushContext(t, tpm, session)
+
+	if err := tpm.PolicyPCR(session, nil, tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}}); err != nil {
+		t.Fatalf("PolicyPCR failed: %v", err)
+	}
+
+	unsealed, err := tpm.Unseal(object, session)
+	if err != nil {
+		t.Fatalf("Unseal failed: %v", err)
+	}
+	if !bytes.Equal([]byte(base64.StdEncoding.EncodeToString(unsealed)), passphrase) {
+		t.Errorf("Unexpected unsealed secret")
+	}
+}
+
+func TestExportSystemdTPM2TokenIncompatible(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestExportSystemdTPM2TokenIncompatible_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, data := range []struct {
+		desc   string
+		params *KeyCreationParams
+	}{
+		{
+			desc: "Locality",
+			params: &KeyCreationParams{
+				PCRProfile:             getTestPCRProfile(),
+				PCRPolicyCounterHandle: NoPCRPolicyCounterHandle,
+				PermittedLocalities:    tpm2.Locality(1 << 0)},
+		},
+		{
+			desc: "UnsealOnly",
+			params: &KeyCreationParams{
+				PCRProfile:             getTestPCRProfile(),
+				PCRPolicyCounterHandle: NoPCRPolicyCounterHandle,
+				UnsealOnly:             true},
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			keyFile := filepath.Join(tmpDir, data.desc)
+			if _, err := SealKeyToTPM(tpm, key, keyFile, data.params); err != nil {
+				t.Fatalf("SealKeyToTPM failed: %v", err)
+			}
+
+			k, err := ReadSealedKeyObject(keyFile)
+			if err != nil {
+				t.Fatalf("ReadSealedKeyObject failed: %v", err)
+			}
+
+			_, _, err = k.ExportSystemdTPM2Token(tpm)
+			if !xerrors.Is(err, ErrSystemdIncompatiblePolicy) {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/canonical/go-efilib"
+	"github.com/canonical/tcglog-parser"
+)
+
+// ReadEFIVar reads the EFI variable with the specified name and GUID from the supplied directory.
+// Each variable is stored in a file named "<name>-<guid>", with the same format as efivarfs:
+// a 32-bit little-endian attributes field followed by the variable data.
+func ReadEFIVar(dir, name string, guid efi.GUID) ([]byte, efi.VariableAttributes, error) {
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s", name, guid))
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, efi.ErrVariableNotFound
+		}
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	var attrs efi.VariableAttributes
+	if err := binary.Read(f, binary.LittleEndian, &attrs); err != nil {
+		return nil, 0, err
+	}
+
+	val, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return val, attrs, nil
+}
+
+// MockEFIEnvironment is a mock EFI environment that implements the HostEnvironment interface
+// from github.com/snapcore/secboot/efi, for use with the PCR profile generation functions
+// in that package.
+type MockEFIEnvironment struct {
+	// EFIVarsDir is the directory containing EFI variables, in the format read by ReadEFIVar.
+	EFIVarsDir string
+
+	// EventLogPath is the path of a TCG event log, in the format exposed by the kernel in
+	// securityfs.
+	EventLogPath string
+}
+
+// ReadVar reads the EFI variable with the specified name and GUID from EFIVarsDir.
+func (e *MockEFIEnvironment) ReadVar(name string, guid efi.GUID) ([]byte, efi.VariableAttributes, error) {
+	return ReadEFIVar(e.EFIVarsDir, name, guid)
+}
+
+// ReadEventLog reads the TCG event log from EventLogPath.
+func (e *MockEFIEnvironment) ReadEventLog() (*tcglog.Log, error) {
+	f, err := os.Open(e.EventLogPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return tcglog.ReadLog(f, &tcglog.LogOptions{})
+}
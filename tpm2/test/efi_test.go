@@ -0,0 +1,65 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2test_test
+
+import (
+	"testing"
+
+	"github.com/canonical/go-efilib"
+
+	. "gopkg.in/check.v1"
+
+	secboot_efi "github.com/snapcore/secboot/efi"
+	. "github.com/snapcore/secboot/tpm2/test"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type efiSuite struct{}
+
+var _ = Suite(&efiSuite{})
+
+var _ secboot_efi.HostEnvironment = (*MockEFIEnvironment)(nil)
+
+func (s *efiSuite) TestReadEFIVar(c *C) {
+	data, attrs, err := ReadEFIVar("../../efi/testdata/efivars_ms", "SecureBoot", efi.GlobalVariable)
+	c.Check(err, IsNil)
+	c.Check(data, DeepEquals, []byte{1})
+	c.Check(attrs, Equals, efi.AttributeBootserviceAccess|efi.AttributeRuntimeAccess)
+}
+
+func (s *efiSuite) TestReadEFIVarNotFound(c *C) {
+	_, _, err := ReadEFIVar("../../efi/testdata/efivars_ms", "MokListRT", efi.MakeGUID(0x605dab50, 0xe046, 0x4300, 0xabb6, [...]uint8{0x3d, 0xd8, 0x10, 0xdd, 0x8b, 0x23}))
+	c.Check(err, Equals, efi.ErrVariableNotFound)
+}
+
+func (s *efiSuite) TestMockEFIEnvironment(c *C) {
+	env := &MockEFIEnvironment{
+		EFIVarsDir:   "../../efi/testdata/efivars_ms",
+		EventLogPath: "../../efi/testdata/eventlog_sb.bin"}
+
+	data, _, err := env.ReadVar("SecureBoot", efi.GlobalVariable)
+	c.Check(err, IsNil)
+	c.Check(data, DeepEquals, []byte{1})
+
+	log, err := env.ReadEventLog()
+	c.Assert(err, IsNil)
+	c.Check(log.Events, Not(HasLen), 0)
+}
@@ -0,0 +1,333 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package tpm2test provides helpers for writing integration tests against secboot's TPM
+// functionality using the TPM2 simulator. It can be used to launch and stop a simulator,
+// connect to it, certify it with a fabricated endorsement key certificate and mock the
+// EFI environment of the host.
+//
+// This package is imported as github.com/snapcore/secboot/tpm2/test.
+package tpm2test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/osutil/sys"
+	"github.com/snapcore/snapd/snap"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot/internal/tcti"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+// DefaultSimulatorPort is the default TPM command port of the simulator.
+const DefaultSimulatorPort uint = 2321
+
+// SimulatorOptions provide the options to LaunchSimulator.
+type SimulatorOptions struct {
+	SourceDir      string // Source directory for the persistent data file
+	Manufacture    bool   // Indicates that the simulator should be executed in re-manufacture mode
+	SavePersistent bool   // Saves the persistent data file back to SourceDir on exit
+	Port           uint   // The TPM command port of the simulator. The platform port is Port+1. Defaults to DefaultSimulatorPort
+}
+
+// LaunchSimulator launches a TPM simulator. A new temporary directory will be created in which the
+// simulator will store its persistent data, which will be cleaned up on exit. If opts.SourceDir is
+// provided, a pre-existing persistent data file will be copied from this directory to the temporary
+// directory. If opts.SavePersistent is set, the persistent data file will be copied back from the
+// temporary directory to the source directory on exit.
+//
+// On success, it returns a function that can be used to stop the simulator and clean up its temporary
+// directory.
+func LaunchSimulator(opts *SimulatorOptions) (func(), error) {
+	// Pick sensible defaults
+	if opts == nil {
+		opts = &SimulatorOptions{Manufacture: true}
+	}
+	port := opts.Port
+	if port == 0 {
+		port = DefaultSimulatorPort
+	}
+	if opts.SourceDir == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return nil, xerrors.Errorf("cannot determine cwd: %w", err)
+		}
+		opts.SourceDir = wd
+	}
+
+	// Search for a TPM simulator binary
+	mssimPath := ""
+	for _, p := range []string{"tpm2-simulator", "tpm2-simulator-chrisccoulson.tpm2-simulator"} {
+		var err error
+		mssimPath, err = exec.LookPath(p)
+		if err == nil {
+			break
+		}
+	}
+	if mssimPath == "" {
+		return nil, errors.New("cannot find a simulator binary")
+	}
+
+	// The TPM simulator creates its persistent storage in its current directory. Ideally, we would create
+	// a unique temporary directory for it, but this doesn't work with the snap because it has its own private
+	// tmpdir. Detect whether the chosen TPM simulator is a snap, determine which snap it belongs to and create
+	// a temporary directory inside its common data directory instead.
+	mssimSnapName := ""
+	for currentPath, lastPath := mssimPath, ""; currentPath != ""; {
+		dest, err := os.Readlink(currentPath)
+		switch {
+		case err != nil:
+			if filepath.Base(currentPath) == "snap" {
+				mssimSnapName, _ = snap.SplitSnapApp(filepath.Base(lastPath))
+			}
+			currentPath = ""
+		default:
+			if !filepath.IsAbs(dest) {
+				dest = filepath.Join(filepath.Dir(currentPath), dest)
+			}
+			lastPath = currentPath
+			currentPath = dest
+		}
+	}
+
+	// Create the temporary directory.
+	tmpRoot := ""
+	if mssimSnapName != "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			return nil, errors.New("cannot determine home directory")
+		}
+		tmpRoot = snap.UserCommonDataDir(home, mssimSnapName)
+		if err := os.MkdirAll(tmpRoot, 0755); err != nil {
+			return nil, xerrors.Errorf("cannot create snap common data dir: %w", err)
+		}
+	}
+
+	mssimTmpDir, err := ioutil.TempDir(tmpRoot, "secboot.mssim")
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create temporary directory for simulator: %w", err)
+	}
+
+	var cmd *exec.Cmd
+
+	// At this point, we have stuff to clean up on early failure.
+	cleanup := func() {
+		// Defer saving the persistent data and removing the temporary directory
+		defer func() {
+			// Defer removal of the temporary directory
+			defer os.RemoveAll(mssimTmpDir)
+
+			if !opts.SavePersistent {
+				// Nothing else to do
+				return
+			}
+
+			// Open the updated persistent storage
+			src, err := os.Open(filepath.Join(mssimTmpDir, "NVChip"))
+			switch {
+			case os.IsNotExist(err):
+				// No storage - this means we failed before the simulator started
+				return
+			case err != nil:
+				fmt.Fprintf(os.Stderr, "Cannot open TPM simulator persistent data: %v\n", err)
+				return
+			}
+			defer src.Close()
+
+			// Atomically write to the source directory
+			dest, err := osutil.NewAtomicFile(filepath.Join(opts.SourceDir, "NVChip"), 0644, 0, sys.UserID(osutil.NoChown), sys.GroupID(osutil.NoChown))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Cannot create new atomic file for saving TPM simulator persistent data: %v\n", err)
+				return
+			}
+			defer dest.Cancel()
+
+			if _, err := io.Copy(dest, src); err != nil {
+				fmt.Fprintf(os.Stderr, "Cannot copy TPM simulator persistent data: %v\n", err)
+				return
+			}
+
+			if err := dest.Commit(); err != nil {
+				fmt.Fprintf(os.Stderr, "Cannot commit TPM simulator persistent data: %v\n", err)
+			}
+		}()
+
+		if cmd != nil && cmd.Process != nil {
+			// If we've called exec.Cmd.Start, attempt to stop the simulator.
+			cleanShutdown := false
+			// Defer the call to exec.Cmd.Wait or os.Process.Kill until after we've initiated the shutdown.
+			defer func() {
+				if cleanShutdown {
+					if err := cmd.Wait(); err != nil {
+						fmt.Fprintf(os.Stderr, "TPM simulator finished with an error: %v", err)
+					}
+				} else {
+					fmt.Fprintf(os.Stderr, "Killing TPM simulator\n")
+					if err := cmd.Process.Kill(); err != nil {
+						fmt.Fprintf(os.Stderr, "Cannot send signal to TPM simulator: %v\n", err)
+					}
+				}
+			}()
+
+			tcti, err := tpm2.OpenMssim("", port, port+1)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Cannot open TPM simulator connection for shutdown: %v\n", err)
+				return
+			}
+
+			tpm, _ := tpm2.NewTPMContext(tcti)
+			if err := tpm.Shutdown(tpm2.StartupClear); err != nil {
+				fmt.Fprintf(os.Stderr, "TPM simulator shutdown failed: %v\n", err)
+			}
+			if err := tcti.Stop(); err != nil {
+				fmt.Fprintf(os.Stderr, "TPM simulator stop failed: %v\n", err)
+				return
+			}
+			if err := tpm.Close(); err != nil {
+				fmt.Fprintf(os.Stderr, "TPM simulator connection close failed: %v\n", err)
+				return
+			}
+			cleanShutdown = true
+		}
+	}
+
+	succeeded := false
+	// Defer cleanup on failure
+	defer func() {
+		if succeeded {
+			return
+		}
+		cleanup()
+	}()
+
+	// Copy any pre-existing persistent data in to the temporary directory
+	source, err := os.Open(filepath.Join(opts.SourceDir, "NVChip"))
+	switch {
+	case err != nil && !os.IsNotExist(err):
+		return nil, xerrors.Errorf("cannot open source persistent storage: %w", err)
+	case err != nil:
+		// Nothing to do
+	default:
+		defer source.Close()
+		dest, err := os.Create(filepath.Join(mssimTmpDir, "NVChip"))
+		if err != nil {
+			return nil, xerrors.Errorf("cannot create temporary storage for simulator: %w", err)
+		}
+		defer dest.Close()
+		if _, err := io.Copy(dest, source); err != nil {
+			return nil, xerrors.Errorf("cannot copy persistent storage to temporary location for simulator: %w", err)
+		}
+	}
+
+	var args []string
+	if opts.Manufacture {
+		args = append(args, "-m")
+	}
+	args = append(args, strconv.FormatUint(uint64(port), 10))
+
+	cmd = exec.Command(mssimPath, args...)
+	cmd.Dir = mssimTmpDir // Run from the temporary directory we created
+	// The tpm2-simulator-chrisccoulson snap originally had a patch to chdir in to the root of the snap's common data directory,
+	// where it would store its persistent data. We don't want this behaviour now. This environment variable exists until all
+	// secboot and go-tpm2 branches have been fixed to not depend on this behaviour.
+	cmd.Env = append(cmd.Env, "TPM2SIM_DONT_CD_TO_HOME=1")
+
+	if err := cmd.Start(); err != nil {
+		return nil, xerrors.Errorf("cannot start simulator: %w", err)
+	}
+
+	var tcti *tpm2.TctiMssim
+	// Give the simulator 5 seconds to start up
+Loop:
+	for i := 0; ; i++ {
+		var err error
+		tcti, err = tpm2.OpenMssim("", port, port+1)
+		switch {
+		case err != nil && i == 4:
+			return nil, xerrors.Errorf("cannot open simulator connection: %w", err)
+		case err != nil:
+			time.Sleep(time.Second)
+		default:
+			break Loop
+		}
+	}
+
+	tpm, _ := tpm2.NewTPMContext(tcti)
+	defer tpm.Close()
+
+	if err := tpm.Startup(tpm2.StartupClear); err != nil {
+		return nil, xerrors.Errorf("simulator startup failed: %w", err)
+	}
+
+	succeeded = true
+	return cleanup, nil
+}
+
+// OpenSimulatorConnection opens a connection to the TPM simulator listening on the specified
+// command port, using secboot_tpm2.ConnectToDefaultTPM. The returned *tpm2.TctiMssim can be
+// used to control the simulator, eg, with ResetSimulator.
+func OpenSimulatorConnection(port uint) (*secboot_tpm2.Connection, *tpm2.TctiMssim, error) {
+	var mssim *tpm2.TctiMssim
+
+	origOpenDefault := tcti.OpenDefault
+	tcti.OpenDefault = func() (tpm2.TCTI, error) {
+		var err error
+		mssim, err = tpm2.OpenMssim("", port, port+1)
+		return mssim, err
+	}
+	defer func() { tcti.OpenDefault = origOpenDefault }()
+
+	tpm, err := secboot_tpm2.ConnectToDefaultTPM()
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot connect to simulator: %w", err)
+	}
+
+	return tpm, mssim, nil
+}
+
+// ResetSimulator issues a Shutdown -> Reset -> Startup cycle of the TPM simulator associated
+// with the supplied connection, which is closed. A new connection is returned.
+func ResetSimulator(tpm *secboot_tpm2.Connection, mssim *tpm2.TctiMssim, port uint) (*secboot_tpm2.Connection, *tpm2.TctiMssim, error) {
+	if err := tpm.Shutdown(tpm2.StartupClear); err != nil {
+		return nil, nil, xerrors.Errorf("cannot shutdown simulator: %w", err)
+	}
+	if err := mssim.Reset(); err != nil {
+		return nil, nil, xerrors.Errorf("cannot reset simulator: %w", err)
+	}
+	if err := tpm.Startup(tpm2.StartupClear); err != nil {
+		return nil, nil, xerrors.Errorf("cannot startup simulator: %w", err)
+	}
+	if err := tpm.Close(); err != nil {
+		return nil, nil, xerrors.Errorf("cannot close existing connection: %w", err)
+	}
+
+	return OpenSimulatorConnection(port)
+}
@@ -0,0 +1,299 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2test
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+// SwtpmMode describes how swtpm exposes its TPM interface.
+type SwtpmMode int
+
+const (
+	// SwtpmModeSocket exposes the TPM via a TCP socket that implements the same command
+	// protocol as the Microsoft TPM2 simulator. This doesn't require any privileges.
+	SwtpmModeSocket SwtpmMode = iota
+
+	// SwtpmModeChardev exposes the TPM as a kernel character device via the vTPM proxy
+	// driver (tpm_vtpm_proxy). This requires root privileges and the driver to be loaded,
+	// but allows testing code that opens TPM character devices directly.
+	SwtpmModeChardev
+)
+
+// swtpmStartTimeout is the time to wait for swtpm to become ready.
+var swtpmStartTimeout = 5 * time.Second
+
+// swtpmStateFile is the name of the file in which swtpm stores the permanent state of a TPM2.
+const swtpmStateFile = "tpm2-00.permall"
+
+// SwtpmOptions provide the options to LaunchSwtpm.
+type SwtpmOptions struct {
+	Mode SwtpmMode
+
+	// StateDir is the directory in which swtpm stores its state. If empty, a temporary
+	// directory is created and removed when swtpm is stopped. If the directory doesn't
+	// contain any state, it is initialized with swtpm_setup.
+	StateDir string
+
+	// Manufacture indicates that the state in StateDir should be discarded and initialized
+	// again with swtpm_setup.
+	Manufacture bool
+
+	// PCRBanks is the list of PCR banks to enable when the state is initialized. If empty,
+	// the swtpm_setup default is used.
+	PCRBanks []tpm2.HashAlgorithmId
+
+	// Port is the TPM command port when Mode is SwtpmModeSocket. The control port is
+	// Port+1. Defaults to DefaultSimulatorPort.
+	Port uint
+}
+
+// Swtpm corresponds to a running instance of swtpm.
+type Swtpm struct {
+	cmd    *exec.Cmd
+	device secboot_tpm2.TPMDeviceOpener
+}
+
+// Device returns a secboot_tpm2.TPMDeviceOpener for connecting to this instance, which can be
+// supplied via the Device field of secboot_tpm2.ConnectionOptions.
+func (s *Swtpm) Device() secboot_tpm2.TPMDeviceOpener {
+	return s.device
+}
+
+// Connect opens a new connection to this instance.
+func (s *Swtpm) Connect() (*secboot_tpm2.Connection, error) {
+	return secboot_tpm2.ConnectToDefaultTPMWithOptions(&secboot_tpm2.ConnectionOptions{Device: s.device})
+}
+
+var swtpmPCRBankNames = map[tpm2.HashAlgorithmId]string{
+	tpm2.HashAlgorithmSHA1:   "sha1",
+	tpm2.HashAlgorithmSHA256: "sha256",
+	tpm2.HashAlgorithmSHA384: "sha384",
+	tpm2.HashAlgorithmSHA512: "sha512",
+}
+
+func setupSwtpmState(stateDir string, banks []tpm2.HashAlgorithmId) error {
+	swtpmSetup, err := exec.LookPath("swtpm_setup")
+	if err != nil {
+		return xerrors.Errorf("cannot find swtpm_setup: %w", err)
+	}
+
+	args := []string{"--tpm2", "--tpmstate", stateDir, "--overwrite"}
+	if len(banks) > 0 {
+		var names []string
+		for _, alg := range banks {
+			name, ok := swtpmPCRBankNames[alg]
+			if !ok {
+				return fmt.Errorf("unsupported PCR bank %v", alg)
+			}
+			names = append(names, name)
+		}
+		args = append(args, "--pcr-banks", strings.Join(names, ","))
+	}
+
+	if out, err := exec.Command(swtpmSetup, args...).CombinedOutput(); err != nil {
+		return xerrors.Errorf("swtpm_setup failed: %w (output: %s)", err, string(out))
+	}
+	return nil
+}
+
+// swtpmChardevRE matches the line printed by swtpm when it has created a vTPM proxy device.
+var swtpmChardevRE = regexp.MustCompile(`^New TPM device: (/dev/tpm[0-9]+)`)
+
+// LaunchSwtpm launches swtpm with the supplied options. The state is initialized with swtpm_setup
+// if necessary, and the TPM is started up with TPM2_Startup(TPM_SU_CLEAR) before it becomes
+// available.
+//
+// Unlike with LaunchSimulator, the platform interface of the Microsoft TPM2 simulator isn't
+// available, so ResetSimulator cannot be used with swtpm.
+//
+// On success, it returns the running instance and a function that stops it and removes any
+// temporary state directory.
+func LaunchSwtpm(opts *SwtpmOptions) (*Swtpm, func(), error) {
+	if opts == nil {
+		opts = &SwtpmOptions{}
+	}
+
+	swtpmPath, err := exec.LookPath("swtpm")
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot find swtpm: %w", err)
+	}
+
+	stateDir := opts.StateDir
+	removeStateDir := false
+	if stateDir == "" {
+		stateDir, err = ioutil.TempDir("", "secboot.swtpm")
+		if err != nil {
+			return nil, nil, xerrors.Errorf("cannot create temporary state directory: %w", err)
+		}
+		removeStateDir = true
+	}
+
+	s := new(Swtpm)
+
+	cleanup := func() {
+		if removeStateDir {
+			defer os.RemoveAll(stateDir)
+		}
+		if s.cmd == nil || s.cmd.Process == nil {
+			return
+		}
+
+		// swtpm writes its state as it changes, so it can just be terminated.
+		done := make(chan error, 1)
+		go func() { done <- s.cmd.Wait() }()
+		if err := s.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot send signal to swtpm: %v\n", err)
+		}
+		select {
+		case <-done:
+		case <-time.After(swtpmStartTimeout):
+			fmt.Fprintf(os.Stderr, "Killing swtpm\n")
+			s.cmd.Process.Kill()
+			<-done
+		}
+	}
+
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		cleanup()
+	}()
+
+	_, err = os.Stat(filepath.Join(stateDir, swtpmStateFile))
+	switch {
+	case opts.Manufacture || os.IsNotExist(err):
+		if err := setupSwtpmState(stateDir, opts.PCRBanks); err != nil {
+			return nil, nil, xerrors.Errorf("cannot initialize state: %w", err)
+		}
+	case err != nil:
+		return nil, nil, xerrors.Errorf("cannot determine if state exists: %w", err)
+	}
+
+	var args []string
+	var stdout io.ReadCloser
+
+	switch opts.Mode {
+	case SwtpmModeSocket:
+		port := opts.Port
+		if port == 0 {
+			port = DefaultSimulatorPort
+		}
+		args = []string{"socket", "--tpm2",
+			"--server", "type=tcp,port=" + strconv.FormatUint(uint64(port), 10),
+			"--ctrl", "type=tcp,port=" + strconv.FormatUint(uint64(port+1), 10),
+			"--tpmstate", "dir=" + stateDir,
+			"--flags", "not-need-init,startup-clear"}
+		s.device = &secboot_tpm2.MssimDevice{Port: port}
+		s.cmd = exec.Command(swtpmPath, args...)
+	case SwtpmModeChardev:
+		args = []string{"chardev", "--tpm2", "--vtpm-proxy",
+			"--tpmstate", "dir=" + stateDir,
+			"--flags", "startup-clear"}
+		s.cmd = exec.Command(swtpmPath, args...)
+		stdout, err = s.cmd.StdoutPipe()
+		if err != nil {
+			return nil, nil, xerrors.Errorf("cannot create stdout pipe: %w", err)
+		}
+	default:
+		return nil, nil, errors.New("invalid mode")
+	}
+
+	if err := s.cmd.Start(); err != nil {
+		return nil, nil, xerrors.Errorf("cannot start swtpm: %w", err)
+	}
+
+	switch opts.Mode {
+	case SwtpmModeSocket:
+		if err := waitForSwtpmSocket(s.device); err != nil {
+			return nil, nil, err
+		}
+	case SwtpmModeChardev:
+		path, err := waitForSwtpmChardev(stdout)
+		if err != nil {
+			return nil, nil, err
+		}
+		s.device = &secboot_tpm2.TPMDevice{Path: path, MajorVersion: 2}
+	}
+
+	succeeded = true
+	return s, cleanup, nil
+}
+
+func waitForSwtpmSocket(device secboot_tpm2.TPMDeviceOpener) error {
+	deadline := time.Now().Add(swtpmStartTimeout)
+	for {
+		tcti, err := device.Open()
+		if err == nil {
+			tcti.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return xerrors.Errorf("cannot open swtpm connection: %w", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func waitForSwtpmChardev(stdout io.Reader) (string, error) {
+	found := make(chan string, 1)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			if m := swtpmChardevRE.FindStringSubmatch(scanner.Text()); m != nil {
+				found <- m[1]
+				break
+			}
+		}
+		// Keep draining stdout so that swtpm doesn't block.
+		io.Copy(ioutil.Discard, stdout)
+		close(found)
+	}()
+
+	select {
+	case path, ok := <-found:
+		if !ok {
+			return "", errors.New("swtpm exited without creating a TPM device")
+		}
+		return path, nil
+	case <-time.After(swtpmStartTimeout):
+		return "", errors.New("timeout waiting for swtpm to create a TPM device")
+	}
+}
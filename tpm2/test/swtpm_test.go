@@ -0,0 +1,79 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2test_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/canonical/go-tpm2"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/tpm2/test"
+)
+
+type swtpmSuite struct{}
+
+var _ = Suite(&swtpmSuite{})
+
+func (s *swtpmSuite) SetUpTest(c *C) {
+	for _, name := range []string{"swtpm", "swtpm_setup"} {
+		if _, err := exec.LookPath(name); err != nil {
+			c.Skip(name + " not available")
+		}
+	}
+}
+
+func (s *swtpmSuite) TestLaunchSwtpmSocket(c *C) {
+	swtpm, cleanup, err := LaunchSwtpm(&SwtpmOptions{Port: 2341, PCRBanks: []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA256}})
+	c.Assert(err, IsNil)
+	defer cleanup()
+
+	tpm, err := swtpm.Connect()
+	c.Assert(err, IsNil)
+	defer tpm.Close()
+
+	pcrs, err := tpm.GetCapabilityPCRs()
+	c.Assert(err, IsNil)
+	for _, s := range pcrs {
+		if s.Hash == tpm2.HashAlgorithmSHA256 {
+			c.Check(s.Select, Not(HasLen), 0)
+		} else {
+			c.Check(s.Select, HasLen, 0)
+		}
+	}
+}
+
+func (s *swtpmSuite) TestLaunchSwtpmPersistentState(c *C) {
+	dir, err := ioutil.TempDir("", "secboot.swtpm-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	_, cleanup, err := LaunchSwtpm(&SwtpmOptions{StateDir: dir, Port: 2341})
+	c.Assert(err, IsNil)
+	cleanup()
+
+	// The state directory supplied by the caller must not be removed.
+	_, err = os.Stat(filepath.Join(dir, "tpm2-00.permall"))
+	c.Check(err, IsNil)
+}
@@ -34,6 +34,7 @@ import (
 	"io"
 	"io/ioutil"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/canonical/go-tpm2"
@@ -56,9 +57,44 @@ type DeviceAttributes struct {
 	FirmwareVersion uint32
 }
 
+// ConnectionOptions provides options for a Connection.
+type ConnectionOptions struct {
+	// RequireEncryptedSessions requires that commands that transfer key material to or from the TPM are
+	// executed with a session that is salted with the verified endorsement key and used for parameter
+	// encryption. This protects the key material from an attacker who is able to interpose the
+	// communication between the host CPU and the TPM. This applies to sealing, exporting, importing
+	// and unsealing sealed key objects, changing their PIN, exporting systemd-cryptsetup tokens, and
+	// creating, reading and rotating NV keys.
+	//
+	// This can only be satisfied by a connection created with SecureConnectToDefaultTPMWithOptions.
+	// Other connections will return ErrNoEncryptedSession from these functions without communicating
+	// with the TPM, rather than falling back to a session that isn't bound to a verified endorsement key.
+	RequireEncryptedSessions bool
+
+	// OpenRetryTimeout is the maximum amount of time to spend retrying if the TPM device is busy when
+	// opening it, eg, because it is in use by another process. Retries are performed with an
+	// exponential backoff. If zero, opening the TPM device is not retried.
+	OpenRetryTimeout time.Duration
+
+	// MaxCommandSubmissions is the maximum number of times that a command is submitted to the TPM if it
+	// responds with TPM_RC_RETRY, TPM_RC_YIELDED or TPM_RC_TESTING. If zero, the go-tpm2 default is used.
+	MaxCommandSubmissions uint
+
+	// Device specifies the TPM to connect to. This can be a *TPMDevice returned from ListTPMDevices
+	// or a *MssimDevice for connecting to a simulator. If nil, the default TPM device is used.
+	Device TPMDeviceOpener
+}
+
+const (
+	minOpenRetryDelay = 10 * time.Millisecond
+	maxOpenRetryDelay = 1 * time.Second
+)
+
 // Connection corresponds to a connection to a TPM device, and is a wrapper around *tpm2.TPMContext.
 type Connection struct {
 	*tpm2.TPMContext
+	options                  ConnectionOptions
+	initialTransientHandles  []tpm2.Handle
 	verifiedEkCertChain      []*x509.Certificate
 	verifiedDeviceAttributes *DeviceAttributes
 	ek                       tpm2.ResourceContext
@@ -114,11 +150,103 @@ func (t *Connection) HmacSession() tpm2.SessionContext {
 	return t.hmacSession.WithAttrs(tpm2.AttrContinueSession)
 }
 
+// encryptedSession returns the session that should be used for parameter encryption of commands that
+// transfer key material. If the RequireEncryptedSessions option is set, this returns ErrNoEncryptedSession
+// if the connection doesn't have a session that is salted with a verified endorsement key.
+func (t *Connection) encryptedSession() (tpm2.SessionContext, error) {
+	if err := t.checkEncryptedSessionsAvailable(); err != nil {
+		return nil, err
+	}
+	return t.HmacSession(), nil
+}
+
+// checkEncryptedSessionsAvailable returns ErrNoEncryptedSession if the RequireEncryptedSessions option is
+// set and sessions created by this connection cannot be salted with a verified endorsement key.
+func (t *Connection) checkEncryptedSessionsAvailable() error {
+	if !t.options.RequireEncryptedSessions {
+		return nil
+	}
+	if len(t.verifiedEkCertChain) == 0 || t.hmacSession == nil {
+		return ErrNoEncryptedSession
+	}
+	return nil
+}
+
+// startAuditSession starts a new HMAC session that can be used for command auditing and parameter encryption. The session
+// is salted with the endorsement key if there is one associated with this connection.
+func (t *Connection) startAuditSession() (tpm2.SessionContext, error) {
+	if err := t.checkEncryptedSessionsAvailable(); err != nil {
+		return nil, err
+	}
+	if t.options.RequireEncryptedSessions && t.ek == nil {
+		// The session would not be salted.
+		return nil, ErrNoEncryptedSession
+	}
+	symmetric := tpm2.SymDef{
+		Algorithm: tpm2.SymAlgorithmAES,
+		KeyBits:   &tpm2.SymKeyBitsU{Sym: 128},
+		Mode:      &tpm2.SymModeU{Sym: tpm2.SymModeCFB}}
+	return t.StartAuthSession(t.ek, nil, tpm2.SessionTypeHMAC, &symmetric, defaultSessionHashAlgorithm)
+}
+
+// Ping checks that the TPM is still responding to commands, which is useful for checking the health of a
+// long-lived connection.
+func (t *Connection) Ping() error {
+	if _, err := t.GetCapabilityTPMProperties(tpm2.PropertyManufacturer, 1); err != nil {
+		var e *tpm2.TctiError
+		if xerrors.As(err, &e) {
+			return TPMCommunicationError{err}
+		}
+		return xerrors.Errorf("cannot execute command: %w", err)
+	}
+	return nil
+}
+
+// transientHandles returns the handles of all of the transient objects that are currently loaded in the
+// TPM and visible to this connection.
+func (t *Connection) transientHandles() []tpm2.Handle {
+	handles, err := t.GetCapabilityHandles(tpm2.HandleTypeTransient.BaseHandle(), tpm2.CapabilityMaxProperties)
+	if err != nil {
+		return nil
+	}
+	return handles
+}
+
+// flushLeakedObjects flushes any transient objects that were loaded in to the TPM during the lifetime of
+// this connection and not flushed. When connected to the TPM without a resource manager, these would
+// otherwise occupy object slots after the connection is closed.
+func (t *Connection) flushLeakedObjects() {
+Outer:
+	for _, h := range t.transientHandles() {
+		for _, ih := range t.initialTransientHandles {
+			if h == ih {
+				continue Outer
+			}
+		}
+		rc, err := t.CreateResourceContextFromTPM(h)
+		if err != nil {
+			continue
+		}
+		t.FlushContext(rc)
+	}
+}
+
 func (t *Connection) Close() error {
 	t.FlushContext(t.hmacSession)
+	t.flushLeakedObjects()
 	return t.TPMContext.Close()
 }
 
+// newConnection creates a new Connection from the supplied TPMContext.
+func newConnection(tpm *tpm2.TPMContext, options *ConnectionOptions) *Connection {
+	if options.MaxCommandSubmissions > 0 {
+		tpm.SetMaxSubmissions(options.MaxCommandSubmissions)
+	}
+	t := &Connection{TPMContext: tpm, options: *options}
+	t.initialTransientHandles = t.transientHandles()
+	return t
+}
+
 // createTransientEk creates a new primary key in the endorsement hierarchy using the default RSA2048 EK template.
 func createTransientEk(tpm *tpm2.TPMContext) (tpm2.ResourceContext, error) {
 	session, err := tpm.StartAuthSession(nil, tpm.EndorsementHandleContext(), tpm2.SessionTypeHMAC, nil, tpm2.HashAlgorithmSHA256)
@@ -340,17 +468,44 @@ func readEkCertFromTPM(tpm *tpm2.TPMContext) ([]byte, error) {
 	return cert, nil
 }
 
-// connectToDefaultTPM opens a connection to the default TPM device.
-func connectToDefaultTPM() (*tpm2.TPMContext, error) {
-	tcti, err := tcti.OpenDefault()
+// openTcti opens the TPM device specified by the supplied options, or the default TPM device if
+// none is specified. If the device is busy, it retries with an exponential backoff until the
+// configured timeout expires.
+func openTcti(options *ConnectionOptions) (tpm2.TCTI, error) {
+	open := tcti.OpenDefault
+	if options.Device != nil {
+		open = options.Device.Open
+	}
+
+	deadline := time.Now().Add(options.OpenRetryTimeout)
+	delay := minOpenRetryDelay
+	for {
+		tcti, err := open()
+		if err == nil || !xerrors.Is(err, syscall.EBUSY) || time.Now().Add(delay).After(deadline) {
+			return tcti, err
+		}
+		time.Sleep(delay)
+		delay *= 2
+		if delay > maxOpenRetryDelay {
+			delay = maxOpenRetryDelay
+		}
+	}
+}
+
+// connectToDefaultTPM opens a connection to the TPM device specified by the supplied options.
+func connectToDefaultTPM(options *ConnectionOptions) (*tpm2.TPMContext, error) {
+	tcti, err := openTcti(options)
 	if err != nil {
+		if xerrors.Is(err, syscall.EBUSY) {
+			return nil, xerrors.Errorf("cannot open TPM device: %w", err)
+		}
 		if isPathError(err) {
 			return nil, ErrNoTPM2Device
 		}
 		return nil, xerrors.Errorf("cannot open TPM device: %w", err)
 	}
 
-	tpm, _ := tpm2.NewTPMContext(tcti)
+	tpm, _ := tpm2.NewTPMContext(wrapTctiForLogging(tcti))
 	isTpm2, err := tpm.IsTPM2()
 	if err != nil {
 		tpm.Close()
@@ -544,12 +699,12 @@ type ekCertData struct {
 	Parents [][]byte
 }
 
-// verifyEkCertificate verifies the provided certificate and intermediate certificates against the built-in roots, and verifies
-// that the certificate is a valid EK certificate, according to the "TCG EK Credential Profile" specification.
+// verifyEkCertificate verifies the provided certificate and intermediate certificates against the built-in roots and any
+// additional roots supplied via extraRoots, and verifies that the certificate is a valid EK certificate, according to the "TCG
+// EK Credential Profile" specification.
 //
-// On success, it returns a verified certificate chain. This function will also return success if there is no certificate and
-// it is executed inside a guest VM, in order to support fallback to a non-secure connection when using swtpm in a guest VM.
-func verifyEkCertificate(data *ekCertData) ([]*x509.Certificate, *DeviceAttributes, error) {
+// On success, it returns a verified certificate chain.
+func verifyEkCertificate(data *ekCertData, extraRoots []*x509.Certificate) ([]*x509.Certificate, *DeviceAttributes, error) {
 	// Parse EK cert
 	cert, err := x509.ParseCertificate(data.Cert)
 	if err != nil {
@@ -558,6 +713,9 @@ func verifyEkCertificate(data *ekCertData) ([]*x509.Certificate, *DeviceAttribut
 
 	// Parse other certs, building root and intermediates store
 	roots := x509.NewCertPool()
+	for _, c := range extraRoots {
+		roots.AddCert(c)
+	}
 	intermediates := x509.NewCertPool()
 	for _, d := range data.Parents {
 		c, err := x509.ParseCertificate(d)
@@ -825,6 +983,74 @@ func EncodeEKCertificateChain(ekCert *x509.Certificate, parents []*x509.Certific
 	return nil
 }
 
+// VerifyEKCertificateOptions provides options to VerifyEKCertificate.
+type VerifyEKCertificateOptions struct {
+	// Parents contains the intermediate certificates required to build a chain
+	// from the EK certificate to a trusted root, and may also contain the root
+	// certificate. Root certificates are only trusted if they are one of the
+	// built-in TPM manufacturer roots or are supplied via Roots.
+	Parents []*x509.Certificate
+
+	// Roots contains additional root CA certificates to trust, which supplements
+	// the built-in TPM manufacturer roots. This can be used to trust a TPM
+	// manufacturer that this package doesn't know about yet.
+	Roots []*x509.Certificate
+
+	// EK is an optional context for the endorsement key object. If supplied, its
+	// public area is checked against the public key in the certificate.
+	EK tpm2.ResourceContext
+}
+
+// EKCertificateInfo contains information about a verified EK certificate.
+type EKCertificateInfo struct {
+	// Chain is the verified certificate chain, starting with the EK certificate
+	// and ending with the trusted root.
+	Chain []*x509.Certificate
+
+	// DeviceAttributes contains the TPM manufacturer, model and firmware version
+	// obtained from the certificate.
+	DeviceAttributes *DeviceAttributes
+}
+
+// VerifyEKCertificate verifies the supplied endorsement key certificate, without requiring a connection to the TPM for which
+// it was issued. The certificate must chain to one of the built-in TPM manufacturer root CA certificates or to one of the roots
+// supplied via the Roots field of options, and it must have the properties required by the "TCG EK Credential Profile"
+// specification. If the EK field of options is set, this also checks that the public area of that object is the one that the
+// certificate was issued for.
+//
+// This is intended to be used to decide whether to trust a TPM before enrolling it. Note that success does not prove that the
+// EK object is resident on a genuine TPM - that requires a proof of ownership, such as the one performed by
+// SecureConnectToDefaultTPM.
+//
+// If verification of the certificate fails, a EKCertVerificationError error will be returned. If the public area of the supplied
+// EK object doesn't match the certificate, a TPMVerificationError error will be returned.
+func VerifyEKCertificate(cert *x509.Certificate, options *VerifyEKCertificateOptions) (*EKCertificateInfo, error) {
+	if cert == nil {
+		return nil, errors.New("no certificate")
+	}
+	if options == nil {
+		options = &VerifyEKCertificateOptions{}
+	}
+
+	data := ekCertData{Cert: cert.Raw}
+	for _, c := range options.Parents {
+		data.Parents = append(data.Parents, c.Raw)
+	}
+
+	chain, attrs, err := verifyEkCertificate(&data, options.Roots)
+	if err != nil {
+		return nil, EKCertVerificationError{err.Error()}
+	}
+
+	if options.EK != nil {
+		if err := verifyEk(chain[0], options.EK); err != nil {
+			return nil, TPMVerificationError{err.Error()}
+		}
+	}
+
+	return &EKCertificateInfo{Chain: chain, DeviceAttributes: attrs}, nil
+}
+
 // ConnectToDefaultTPM will attempt to connect to the default TPM. It makes no attempt to verify the authenticity of the TPM. This
 // function is useful for connecting to a device that isn't correctly provisioned and for which the endorsement hierarchy
 // authorization value is unknown (so that it can be cleared), or for connecting to a device in order to execute
@@ -832,12 +1058,22 @@ func EncodeEKCertificateChain(ekCert *x509.Certificate, parents []*x509.Certific
 //
 // If no TPM2 device is available, then a ErrNoTPM2Device error will be returned.
 func ConnectToDefaultTPM() (*Connection, error) {
-	tpm, err := connectToDefaultTPM()
+	return ConnectToDefaultTPMWithOptions(nil)
+}
+
+// ConnectToDefaultTPMWithOptions behaves like ConnectToDefaultTPM, but permits the caller to supply options for
+// the connection. Note that RequireEncryptedSessions cannot be satisfied by a connection created by this function.
+func ConnectToDefaultTPMWithOptions(options *ConnectionOptions) (*Connection, error) {
+	if options == nil {
+		options = &ConnectionOptions{}
+	}
+
+	tpm, err := connectToDefaultTPM(options)
 	if err != nil {
 		return nil, err
 	}
 
-	t := &Connection{TPMContext: tpm}
+	t := newConnection(tpm, options)
 
 	succeeded := false
 	defer func() {
@@ -888,11 +1124,20 @@ func ConnectToDefaultTPM() (*Connection, error) {
 //
 // If no TPM2 device is available, then a ErrNoTPM2Device error will be returned.
 func SecureConnectToDefaultTPM(ekCertDataReader io.Reader, endorsementAuth []byte) (*Connection, error) {
+	return SecureConnectToDefaultTPMWithOptions(ekCertDataReader, endorsementAuth, nil)
+}
+
+// SecureConnectToDefaultTPMWithOptions behaves like SecureConnectToDefaultTPM, but permits the caller to supply
+// options for the connection.
+func SecureConnectToDefaultTPMWithOptions(ekCertDataReader io.Reader, endorsementAuth []byte, options *ConnectionOptions) (*Connection, error) {
+	if options == nil {
+		options = &ConnectionOptions{}
+	}
 	if ekCertDataReader == nil {
 		return nil, errors.New("no EK certificate data was provided")
 	}
 
-	tpm, err := connectToDefaultTPM()
+	tpm, err := connectToDefaultTPM(options)
 	if err != nil {
 		return nil, err
 	}
@@ -906,7 +1151,7 @@ func SecureConnectToDefaultTPM(ekCertDataReader io.Reader, endorsementAuth []byt
 		tpm.Close()
 	}()
 
-	t := &Connection{TPMContext: tpm}
+	t := newConnection(tpm, options)
 
 	var certData *ekCertData
 	// Unmarshal supplied EK cert data
@@ -922,7 +1167,7 @@ func SecureConnectToDefaultTPM(ekCertDataReader io.Reader, endorsementAuth []byt
 		}
 	}
 
-	chain, attrs, err := verifyEkCertificate(certData)
+	chain, attrs, err := verifyEkCertificate(certData, nil)
 	if err != nil {
 		return nil, EKCertVerificationError{err.Error()}
 	}
@@ -940,7 +1185,6 @@ func SecureConnectToDefaultTPM(ekCertDataReader io.Reader, endorsementAuth []byt
 		}
 		return nil, xerrors.Errorf("cannot initialize TPM connection: %w", err)
 	}
-
 	succeeded = true
 	return t, nil
 }
@@ -27,6 +27,7 @@ import (
 	"os"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/canonical/go-tpm2"
 
@@ -208,6 +209,96 @@ func TestConnectToDefaultTPMNoTPM(t *testing.T) {
 	}
 }
 
+func TestConnectToDefaultTPMBusy(t *testing.T) {
+	restore := testutil.MockOpenDefaultTctiFn(func() (tpm2.TCTI, error) {
+		return nil, &os.PathError{Op: "open", Path: "/dev/tpm0", Err: syscall.EBUSY}
+	})
+	defer restore()
+
+	tpm, err := ConnectToDefaultTPM()
+	if tpm != nil {
+		t.Errorf("ConnectToDefaultTPM should have failed")
+	}
+	if err == nil || err.Error() != "cannot open TPM device: open /dev/tpm0: device or resource busy" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestConnectToDefaultTPMWithOpenRetry(t *testing.T) {
+	if !testutil.UseMssim {
+		t.SkipNow()
+	}
+
+	attempts := 0
+	restore := testutil.MockOpenDefaultTctiFn(func() (tpm2.TCTI, error) {
+		attempts++
+		if attempts < 3 {
+			return nil, &os.PathError{Op: "open", Path: "/dev/tpm0", Err: syscall.EBUSY}
+		}
+		return tpm2.OpenMssim("", testutil.MssimPort, testutil.MssimPort+1)
+	})
+	defer restore()
+
+	tpm, err := ConnectToDefaultTPMWithOptions(&ConnectionOptions{OpenRetryTimeout: 10 * time.Second})
+	if err != nil {
+		t.Fatalf("ConnectToDefaultTPMWithOptions failed: %v", err)
+	}
+	defer closeTPM(t, tpm)
+
+	if attempts != 3 {
+		t.Errorf("Unexpected number of attempts: %d", attempts)
+	}
+	if err := tpm.Ping(); err != nil {
+		t.Errorf("Ping failed: %v", err)
+	}
+}
+
+func TestConnectionCloseFlushesLeakedObjects(t *testing.T) {
+	if !testutil.UseMssim {
+		t.SkipNow()
+	}
+
+	restore := testutil.MockOpenDefaultTctiFn(func() (tpm2.TCTI, error) {
+		return tpm2.OpenMssim("", testutil.MssimPort, testutil.MssimPort+1)
+	})
+	defer restore()
+
+	tpm, err := ConnectToDefaultTPM()
+	if err != nil {
+		t.Fatalf("ConnectToDefaultTPM failed: %v", err)
+	}
+
+	template := tpm2.Public{
+		Type:    tpm2.ObjectTypeRSA,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.AttrFixedTPM | tpm2.AttrFixedParent | tpm2.AttrSensitiveDataOrigin | tpm2.AttrUserWithAuth | tpm2.AttrRestricted | tpm2.AttrDecrypt,
+		Params: &tpm2.PublicParamsU{
+			RSADetail: &tpm2.RSAParams{
+				Symmetric: tpm2.SymDefObject{
+					Algorithm: tpm2.SymObjectAlgorithmAES,
+					KeyBits:   &tpm2.SymKeyBitsU{Sym: 128},
+					Mode:      &tpm2.SymModeU{Sym: tpm2.SymModeCFB}},
+				Scheme:   tpm2.RSAScheme{Scheme: tpm2.RSASchemeNull},
+				KeyBits:  2048,
+				Exponent: 0}}}
+	object, _, _, _, _, err := tpm.CreatePrimary(tpm.OwnerHandleContext(), nil, &template, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("CreatePrimary failed: %v", err)
+	}
+	handle := object.Handle()
+
+	if err := tpm.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+
+	tpm, _ = openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if _, err := tpm.CreateResourceContextFromTPM(handle); !tpm2.IsResourceUnavailableError(err, handle) {
+		t.Errorf("Object wasn't flushed: %v", err)
+	}
+}
+
 func TestSecureConnectToDefaultTPM(t *testing.T) {
 	if !testutil.UseMssim {
 		t.SkipNow()
@@ -525,3 +616,95 @@ func TestSecureConnectToDefaultTPM(t *testing.T) {
 		}
 	})
 }
+
+func TestVerifyEKCertificate(t *testing.T) {
+	if !testutil.UseMssim {
+		t.SkipNow()
+	}
+
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+	clearTPMWithPlatformAuth(t, tpm)
+
+	cert, _ := x509.ParseCertificate(testEkCert)
+	caCert, _ := x509.ParseCertificate(testCACert)
+
+	t.Run("Good", func(t *testing.T) {
+		ek, _, _, _, _, err := tpm.CreatePrimary(tpm.EndorsementHandleContext(), nil, tcg.EKTemplate, nil, nil, nil)
+		if err != nil {
+			t.Fatalf("CreatePrimary failed: %v", err)
+		}
+		defer flushContext(t, tpm, ek)
+
+		info, err := VerifyEKCertificate(cert, &VerifyEKCertificateOptions{Parents: []*x509.Certificate{caCert}, EK: ek})
+		if err != nil {
+			t.Fatalf("VerifyEKCertificate failed: %v", err)
+		}
+		if len(info.Chain) != 2 {
+			t.Fatalf("Unexpected number of certificates in chain")
+		}
+		if !bytes.Equal(info.Chain[0].Raw, testEkCert) {
+			t.Errorf("Unexpected leaf certificate")
+		}
+		if !bytes.Equal(info.Chain[1].Raw, testCACert) {
+			t.Errorf("Unexpected root certificate")
+		}
+		if info.DeviceAttributes.Manufacturer != tpm2.TPMManufacturerIBM {
+			t.Errorf("Unexpected manufacturer")
+		}
+		if info.DeviceAttributes.Model != "FakeTPM" {
+			t.Errorf("Unexpected model")
+		}
+		if info.DeviceAttributes.FirmwareVersion != binary.BigEndian.Uint32([]byte{0x00, 0x01, 0x00, 0x02}) {
+			t.Errorf("Unexpected firmware version")
+		}
+	})
+
+	t.Run("NoEK", func(t *testing.T) {
+		if _, err := VerifyEKCertificate(cert, &VerifyEKCertificateOptions{Parents: []*x509.Certificate{caCert}}); err != nil {
+			t.Errorf("VerifyEKCertificate failed: %v", err)
+		}
+	})
+
+	t.Run("MissingParents", func(t *testing.T) {
+		_, err := VerifyEKCertificate(cert, nil)
+		if _, ok := err.(EKCertVerificationError); !ok {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ExtraRoot", func(t *testing.T) {
+		caCertRaw, caKey, err := testutil.CreateTestCA()
+		if err != nil {
+			t.Fatalf("CreateTestCA failed: %v", err)
+		}
+		certRaw, err := testutil.CreateTestEKCert(tpm.TPMContext, caCertRaw, caKey)
+		if err != nil {
+			t.Fatalf("CreateTestEKCert failed: %v", err)
+		}
+		cert, _ := x509.ParseCertificate(certRaw)
+		caCert, _ := x509.ParseCertificate(caCertRaw)
+
+		_, err = VerifyEKCertificate(cert, &VerifyEKCertificateOptions{Parents: []*x509.Certificate{caCert}})
+		if _, ok := err.(EKCertVerificationError); !ok {
+			t.Errorf("Unexpected error: %v", err)
+		}
+
+		if _, err := VerifyEKCertificate(cert, &VerifyEKCertificateOptions{Roots: []*x509.Certificate{caCert}}); err != nil {
+			t.Errorf("VerifyEKCertificate failed: %v", err)
+		}
+	})
+
+	t.Run("WrongEK", func(t *testing.T) {
+		srk, _, _, _, _, err := tpm.CreatePrimary(tpm.OwnerHandleContext(), nil, tcg.SRKTemplate, nil, nil, nil)
+		if err != nil {
+			t.Fatalf("CreatePrimary failed: %v", err)
+		}
+		defer flushContext(t, tpm, srk)
+
+		_, err = VerifyEKCertificate(cert, &VerifyEKCertificateOptions{Parents: []*x509.Certificate{caCert}, EK: srk})
+		if _, ok := err.(TPMVerificationError); !ok {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
@@ -20,12 +20,14 @@
 package tpm2
 
 import (
+	"bytes"
+
 	"github.com/canonical/go-tpm2"
 	"github.com/canonical/go-tpm2/mu"
 
 	"golang.org/x/xerrors"
 
-	"github.com/snapcore/secboot/internal/tcg"
+	"github.com/snapcore/secboot/internal/secmem"
 )
 
 // UnsealFromTPM will load the TPM sealed object in to the TPM and attempt to unseal it, returning the cleartext key on success.
@@ -34,8 +36,11 @@ import (
 //
 // If the TPM's dictionary attack logic has been triggered, a ErrTPMLockout error will be returned.
 //
-// If the TPM is not provisioned correctly, then a ErrTPMProvisioning error will be returned. In this case, ProvisionTPM should be
-// called to attempt to resolve this.
+// If a command cannot be sent to the TPM or a response cannot be received from it, a TPMCommunicationError error will be
+// returned.
+//
+// If the TPM is not provisioned correctly, then a ErrTPMProvisioning error will be returned. If there is no storage root key,
+// then a ErrNoStorageRootKey error will be returned. In either case, ProvisionTPM should be called to attempt to resolve this.
 //
 // If the TPM sealed object cannot be loaded in to the TPM for reasons other than the lack of a storage root key, then a
 // InvalidKeyFileError error will be returned. This could be caused because the sealed object data is invalid in some way, or because
@@ -45,14 +50,29 @@ import (
 // provisioned TPM, but it isn't possible to detect this. A subsequent call to SealKeyToTPM or ProvisionTPM will rectify this.
 //
 // If the TPM's current PCR values are not consistent with the PCR protection policy for this key file, a InvalidKeyFileError error
-// will be returned.
+// will be returned. This wraps a PCRPolicyMismatchError error that describes which PCRs are responsible for the mismatch.
 //
 // If any of the metadata in this key file is invalid, a InvalidKeyFileError error will be returned.
 //
 // If the TPM is missing any persistent resources associated with this key file, then a InvalidKeyFileError error will be returned.
 //
 // If the key file has been superceded (eg, by a call to SealedKeyObject.UpdatePCRProtectionPolicy), then a InvalidKeyFileError error
-// will be returned.
+// will be returned. This wraps ErrPCRPolicyRevoked.
+//
+// If the sealed key object was created with a limited lifetime (see the ClockLimit and BootLimit fields of KeyCreationParams) which
+// has been exceeded, a ErrKeyExpired error will be returned.
+//
+// If the sealed key object was created with a locality restriction (see the PermittedLocalities field of KeyCreationParams) and
+// the TPM connection isn't using one of the permitted localities, a ErrLocalityNotPermitted error will be returned.
+//
+// If the sealed key object was created with a rollback counter (see the RollbackCounterHandle field of KeyCreationParams) that
+// has since been advanced beyond the version recorded in it, a ErrKeyVersionRevoked error will be returned.
+//
+// If the sealed key object was created with its device identity enforced (see the DeviceIdentityBinding field of
+// KeyCreationParams) and the identity of the current device is different, a ErrWrongDevice error will be returned.
+//
+// If the sealed key object was created with a lock index (see the LockIndexHandle field of KeyCreationParams) and access has
+// been locked with LockSealedKeyAccess, a ErrSealedKeyAccessLocked error will be returned.
 //
 // If the signature of the updatable part of the key file's authorization policy is invalid, then a InvalidKeyFileError error will
 // be returned.
@@ -63,15 +83,64 @@ import (
 // If the provided PIN is incorrect, then a ErrPINFail error will be returned and the TPM's dictionary attack counter will be
 // incremented.
 //
+// If the sealed key object was created with a PIN attempt limit (see the PINAttemptLimit field of KeyCreationParams), then an
+// incorrect PIN increments the failure count of the associated PIN index rather than the TPM's dictionary attack counter. Once the
+// limit has been reached, a ErrPINAttemptLimitReached error will be returned. The failure count is reset when the correct PIN is
+// provided.
+//
 // If the authorization policy check fails during unsealing, then a InvalidKeyFileError error will be returned. Note that this
 // condition can also occur as the result of an incorrectly provisioned TPM, which will be detected during a subsequent call to
 // SealKeyToTPM.
 //
+// This function is subject to ConnectionOptions.RequireEncryptedSessions.
+//
 // On success, the unsealed cleartext key is returned as the first return value, and the private part of the key used for
 // authorizing PCR policy updates with UpdateKeyPCRProtectionPolicy is returned as the second return value.
 func (k *SealedKeyObject) UnsealFromTPM(tpm *Connection, pin string) (key []byte, authKey PolicyAuthKey, err error) {
+	// Use the HMAC session created when the connection was opened for parameter encryption rather than creating a new one.
+	session, err := tpm.encryptedSession()
+	if err != nil {
+		return nil, nil, err
+	}
+	return k.unsealFromTPM(tpm, pin, session)
+}
+
+// UnsealFromTPMWithAudit behaves like UnsealFromTPM, except that every TPM command executed during unsealing is audited
+// using a new audit session. This is useful for diagnosing unsealing failures in the field, as it provides evidence from
+// the TPM of which commands completed successfully before the failure.
+//
+// If unsealing fails, the returned error is a *UnsealAuditError, which wraps the error that would have been returned from
+// UnsealFromTPM and contains the session audit digest obtained from the TPM. Obtaining the audit digest requires knowledge
+// of the authorization value for the endorsement hierarchy, which must be provided by calling
+// Connection.EndorsementHandleContext().SetAuthValue() prior to calling this function.
+func (k *SealedKeyObject) UnsealFromTPMWithAudit(tpm *Connection, pin string) (key []byte, authKey PolicyAuthKey, err error) {
+	session, err := tpm.startAuditSession()
+	switch {
+	case err == ErrNoEncryptedSession:
+		return nil, nil, err
+	case err != nil:
+		return nil, nil, xerrors.Errorf("cannot start audit session: %w", err)
+	}
+	defer tpm.FlushContext(session)
+
+	key, authKey, err = k.unsealFromTPM(tpm, pin, session.WithAttrs(tpm2.AttrContinueSession|tpm2.AttrAudit))
+	if err == nil {
+		return key, authKey, nil
+	}
+
+	auditInfo, _, err2 := tpm.GetSessionAuditDigest(tpm.EndorsementHandleContext(), nil, session.WithAttrs(tpm2.AttrContinueSession), nil, nil, nil, nil)
+	if err2 != nil {
+		auditInfo = nil
+	}
+	return nil, nil, &UnsealAuditError{Err: err, AuditInfo: auditInfo}
+}
+
+// prepareUnseal checks that the TPM isn't in lockout mode, loads the sealed key object in to the TPM and executes the policy
+// session for it. If skipPIN is true, the assertion for the PIN is not executed and the returned policy session can't be used
+// to unseal the object. On success, the caller is responsible for flushing the returned contexts.
+func (k *SealedKeyObject) prepareUnseal(tpm *Connection, pin string, skipPIN bool, hmacSession tpm2.SessionContext) (keyObject tpm2.ResourceContext, policySession tpm2.SessionContext, err error) {
 	// Check if the TPM is in lockout mode
-	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1)
+	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1, hmacSession.IncludeAttrs(tpm2.AttrAudit))
 	if err != nil {
 		return nil, nil, xerrors.Errorf("cannot fetch properties from TPM: %w", err)
 	}
@@ -80,64 +149,122 @@ func (k *SealedKeyObject) UnsealFromTPM(tpm *Connection, pin string) (key []byte
 		return nil, nil, ErrTPMLockout
 	}
 
-	// Use the HMAC session created when the connection was opened for parameter encryption rather than creating a new one.
-	hmacSession := tpm.HmacSession()
+	// Check that the key file hasn't been copied from another device, if this is enforced.
+	if k.data.deviceIdentity != nil && k.data.deviceIdentity.binding == DeviceIdentityBindingEnforce {
+		switch err := k.data.deviceIdentity.check(tpm); {
+		case err == ErrWrongDevice:
+			return nil, nil, err
+		case err != nil:
+			return nil, nil, xerrors.Errorf("cannot check device identity: %w", err)
+		}
+	}
 
 	// Load the key data
-	keyObject, err := k.data.load(tpm.TPMContext, hmacSession)
+	keyObject, err = k.data.load(tpm.TPMContext, hmacSession)
 	switch {
+	case isKeyFileError(err) && k.data.parentIsTransient():
+		// The storage key is recreated from the template recorded in the key data, so this
+		// can't be a provisioning error.
+		return nil, nil, InvalidKeyFileError{msg: err.Error()}
 	case isKeyFileError(err):
-		// A keyFileError can be as a result of an improperly provisioned TPM - detect if the object at tcg.SRKHandle is a valid primary key
-		// with the correct attributes. If it's not, then it's definitely a provisioning error. If it is, then it could still be a
-		// provisioning error because we don't know if the object was created with the same template that ProvisionTPM uses. In that case,
-		// we'll just assume an invalid key file
-		srk, err2 := tpm.CreateResourceContextFromTPM(tcg.SRKHandle)
+		// A keyFileError can be as a result of an improperly provisioned TPM - detect if the object at the parent handle is a valid
+		// primary key with the attributes recorded in the key data. If it's not, then it's definitely a provisioning error. If it is,
+		// then it could still be a provisioning error because we don't know if the object was created with the same template. In that
+		// case, we'll just assume an invalid key file
+		srkHandle := k.data.parentHandle()
+		srk, err2 := tpm.CreateResourceContextFromTPM(srkHandle)
 		switch {
-		case tpm2.IsResourceUnavailableError(err2, tcg.SRKHandle):
-			return nil, nil, ErrTPMProvisioning
+		case tpm2.IsResourceUnavailableError(err2, srkHandle):
+			return nil, nil, ErrNoStorageRootKey
 		case err2 != nil:
 			return nil, nil, xerrors.Errorf("cannot create context for SRK: %w", err2)
 		}
-		ok, err2 := isObjectPrimaryKeyWithTemplate(tpm.TPMContext, tpm.OwnerHandleContext(), srk, tcg.SRKTemplate, tpm.HmacSession())
+		ok, err2 := isObjectPrimaryKeyWithTemplate(tpm.TPMContext, tpm.OwnerHandleContext(), srk, k.data.parentTemplate(), hmacSession)
 		switch {
 		case err2 != nil:
-			return nil, nil, xerrors.Errorf("cannot determine if object at 0x%08x is a primary key in the storage hierarchy: %w", tcg.SRKHandle, err2)
+			return nil, nil, xerrors.Errorf("cannot determine if object at 0x%08x is a primary key in the storage hierarchy: %w", srkHandle, err2)
 		case !ok:
 			return nil, nil, ErrTPMProvisioning
 		}
 		// This is probably a broken key file, but it could still be a provisioning error because we don't know if the SRK object was
 		// created with the same template that ProvisionTPM uses.
-		return nil, nil, InvalidKeyFileError{err.Error()}
-	case tpm2.IsResourceUnavailableError(err, tcg.SRKHandle):
-		return nil, nil, ErrTPMProvisioning
+		return nil, nil, InvalidKeyFileError{msg: err.Error()}
+	case tpm2.IsResourceUnavailableError(err, k.data.parentHandle()):
+		return nil, nil, ErrNoStorageRootKey
 	case err != nil:
 		return nil, nil, err
 	}
-	defer tpm.FlushContext(keyObject)
+	defer func() {
+		if err != nil {
+			tpm.FlushContext(keyObject)
+		}
+	}()
 
 	// Begin and execute policy session
-	policySession, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, k.data.keyPublic.NameAlg)
+	policySession, err = tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, k.data.keyPublic.NameAlg)
 	if err != nil {
 		return nil, nil, xerrors.Errorf("cannot start policy session: %w", err)
 	}
-	defer tpm.FlushContext(policySession)
+	defer func() {
+		if err != nil {
+			tpm.FlushContext(policySession)
+		}
+	}()
 
-	if err := executePolicySession(tpm.TPMContext, policySession, k.data.version, k.data.staticPolicyData, k.data.dynamicPolicyData, pin, hmacSession); err != nil {
-		err = xerrors.Errorf("cannot complete authorization policy assertions: %w", err)
+	var policyErr error
+	if skipPIN {
+		_, policyErr = executePolicySessionExceptPIN(tpm.TPMContext, policySession, k.data.version, k.data.staticPolicyData, k.data.dynamicPolicyData)
+	} else {
+		policyErr = executePolicySession(tpm.TPMContext, policySession, k.data.version, k.data.staticPolicyData, k.data.dynamicPolicyData, pin, hmacSession)
+	}
+	if policyErr != nil {
+		err := xerrors.Errorf("cannot complete authorization policy assertions: %w", policyErr)
 		switch {
+		case isDynamicPolicyDataError(err) && xerrors.Is(err, errSessionDigestNotFound):
+			return nil, nil, InvalidKeyFileError{msg: err.Error(), err: k.newPCRPolicyMismatchError(tpm.TPMContext)}
 		case isDynamicPolicyDataError(err):
-			// TODO: Add a separate error for this
-			return nil, nil, InvalidKeyFileError{err.Error()}
+			return nil, nil, InvalidKeyFileError{msg: err.Error(), err: err}
+		case tpm2.IsTPMWarning(err, tpm2.WarningLockout, tpm2.AnyCommandCode):
+			return nil, nil, ErrTPMLockout
+		case xerrors.Is(err, ErrKeyExpired):
+			return nil, nil, ErrKeyExpired
+		case xerrors.Is(err, ErrSealedKeyAccessLocked):
+			return nil, nil, ErrSealedKeyAccessLocked
+		case xerrors.Is(err, ErrKeyVersionRevoked):
+			return nil, nil, ErrKeyVersionRevoked
 		case isStaticPolicyDataError(err):
-			return nil, nil, InvalidKeyFileError{err.Error()}
+			return nil, nil, InvalidKeyFileError{msg: err.Error()}
 		case isAuthFailError(err, tpm2.CommandPolicySecret, 1):
+			if k.pinAttemptLimitReached(tpm) {
+				return nil, nil, ErrPINAttemptLimitReached
+			}
 			return nil, nil, ErrPINFail
+		case k.data.staticPolicyData.pinIndexHandle != tpm2.HandleNull && k.pinAttemptLimitReached(tpm):
+			return nil, nil, ErrPINAttemptLimitReached
 		case tpm2.IsResourceUnavailableError(err, lockNVHandle):
-			return nil, nil, InvalidKeyFileError{"required legacy lock NV index is not present"}
+			return nil, nil, InvalidKeyFileError{msg: "required legacy lock NV index is not present"}
 		}
 		return nil, nil, err
 	}
 
+	return keyObject, policySession, nil
+}
+
+func (k *SealedKeyObject) unsealFromTPM(tpm *Connection, pin string, hmacSession tpm2.SessionContext) (key []byte, authKey PolicyAuthKey, err error) {
+	defer func() {
+		var e *tpm2.TctiError
+		if xerrors.As(err, &e) {
+			err = TPMCommunicationError{err}
+		}
+	}()
+
+	keyObject, policySession, err := k.prepareUnseal(tpm, pin, false, hmacSession)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tpm.FlushContext(keyObject)
+	defer tpm.FlushContext(policySession)
+
 	// For metadata version > 0, the PIN is the auth value for the sealed key object, and the authorization
 	// policy asserts that this value is known when the policy session is used.
 	keyObject.SetAuthValue([]byte(pin))
@@ -146,9 +273,13 @@ func (k *SealedKeyObject) UnsealFromTPM(tpm *Connection, pin string) (key []byte
 	keyData, err := tpm.Unseal(keyObject, policySession, hmacSession.IncludeAttrs(tpm2.AttrResponseEncrypt))
 	switch {
 	case tpm2.IsTPMSessionError(err, tpm2.ErrorPolicyFail, tpm2.CommandUnseal, 1):
-		return nil, nil, InvalidKeyFileError{"the authorization policy check failed during unsealing"}
+		return nil, nil, InvalidKeyFileError{msg: "the authorization policy check failed during unsealing"}
 	case isAuthFailError(err, tpm2.CommandUnseal, 1):
 		return nil, nil, ErrPINFail
+	case tpm2.IsTPMWarning(err, tpm2.WarningLockout, tpm2.CommandUnseal):
+		return nil, nil, ErrTPMLockout
+	case tpm2.IsTPMWarning(err, tpm2.WarningLocality, tpm2.CommandUnseal):
+		return nil, nil, ErrLocalityNotPermitted
 	case err != nil:
 		return nil, nil, xerrors.Errorf("cannot unseal key: %w", err)
 	}
@@ -157,10 +288,254 @@ func (k *SealedKeyObject) UnsealFromTPM(tpm *Connection, pin string) (key []byte
 		return keyData, nil, nil
 	}
 
+	// Reset the failure count of the PIN index, if there is one, now that the correct PIN has been supplied. This is
+	// best effort - failing to reset the count only reduces the number of remaining attempts, and shouldn't prevent
+	// the key from being used.
+	k.resetPINAttempts(tpm, pin)
+
+	// The unmarshalled keys are copies, so don't leave the original data lying around.
+	defer secmem.Wipe(keyData)
+
 	var sealedData sealedData
 	if _, err := mu.UnmarshalFromBytes(keyData, &sealedData); err != nil {
-		return nil, nil, InvalidKeyFileError{err.Error()}
+		return nil, nil, InvalidKeyFileError{msg: err.Error()}
 	}
 
 	return sealedData.Key, sealedData.AuthPrivateKey, nil
 }
+
+// newPCRPolicyMismatchError returns a PCRPolicyMismatchError containing the PCRs with current values that aren't permitted by any
+// branch of the PCR policy of this sealed key object. If these can't be determined, the error contains the complete PCR selection
+// of the policy.
+func (k *SealedKeyObject) newPCRPolicyMismatchError(tpm *tpm2.TPMContext) PCRPolicyMismatchError {
+	pcrSelection := k.data.dynamicPolicyData.pcrSelection
+	permitted := k.data.dynamicPolicyData.pcrValues
+	if len(permitted) == 0 {
+		return PCRPolicyMismatchError{PCRs: pcrSelection}
+	}
+
+	_, current, err := tpm.PCRRead(pcrSelection)
+	if err != nil {
+		return PCRPolicyMismatchError{PCRs: pcrSelection}
+	}
+
+	mismatched := make(tpm2.PCRValues)
+	for _, p := range permitted {
+		value, ok := current[p.Hash][int(p.PCR)]
+		if !ok {
+			continue
+		}
+		found := false
+		for _, v := range p.Values {
+			if bytes.Equal(v, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			mismatched.SetValue(p.Hash, int(p.PCR), value)
+		}
+	}
+	if len(mismatched) == 0 {
+		return PCRPolicyMismatchError{PCRs: pcrSelection}
+	}
+	return PCRPolicyMismatchError{PCRs: mismatched.SelectionList()}
+}
+
+// CheckPCRPolicy determines whether the TPM's current PCR values are consistent with the PCR policy of this sealed key
+// object, without loading or unsealing the sealed object. This doesn't check whether the PCR policy has been revoked or
+// whether its signature is valid, so a successful check doesn't guarantee that UnsealFromTPM will succeed.
+//
+// If the current PCR values are not consistent with the PCR policy, a PCRPolicyMismatchError error will be returned.
+//
+// If a command cannot be sent to the TPM or a response cannot be received from it, a TPMCommunicationError error will be
+// returned.
+func (k *SealedKeyObject) CheckPCRPolicy(tpm *Connection) (err error) {
+	defer func() {
+		var e *tpm2.TctiError
+		if xerrors.As(err, &e) {
+			err = TPMCommunicationError{err}
+		}
+	}()
+
+	session, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypeTrial, nil, k.data.keyPublic.NameAlg)
+	if err != nil {
+		return xerrors.Errorf("cannot start trial session: %w", err)
+	}
+	defer tpm.FlushContext(session)
+
+	if err := tpm.PolicyPCR(session, nil, k.data.dynamicPolicyData.pcrSelection); err != nil {
+		return xerrors.Errorf("cannot execute PCR assertion: %w", err)
+	}
+
+	switch err := executePolicyORAssertions(tpm.TPMContext, session, k.data.dynamicPolicyData.pcrOrData); {
+	case err == errSessionDigestNotFound:
+		return k.newPCRPolicyMismatchError(tpm.TPMContext)
+	case err != nil:
+		return xerrors.Errorf("cannot execute OR assertions: %w", err)
+	}
+
+	return nil
+}
+
+// UnsealVerdict is the result of SealedKeyObject.CheckUnsealable.
+type UnsealVerdict int
+
+const (
+	// UnsealVerdictUnknown indicates that the check could not be completed.
+	UnsealVerdictUnknown UnsealVerdict = iota
+
+	// UnsealVerdictOK indicates that the sealed key object can currently be unsealed, as long as the correct PIN is
+	// supplied if one is set.
+	UnsealVerdictOK
+
+	// UnsealVerdictTPMLockout indicates that the TPM's dictionary attack protection has been triggered.
+	UnsealVerdictTPMLockout
+
+	// UnsealVerdictTPMProvisioningError indicates that the TPM is not correctly provisioned.
+	UnsealVerdictTPMProvisioningError
+
+	// UnsealVerdictInvalidKeyFile indicates that the sealed key object is invalid or is associated with another TPM owner.
+	UnsealVerdictInvalidKeyFile
+
+	// UnsealVerdictPCRPolicyMismatch indicates that the current PCR values are not consistent with the PCR policy.
+	UnsealVerdictPCRPolicyMismatch
+
+	// UnsealVerdictPCRPolicyRevoked indicates that the PCR policy has been revoked by a later policy update.
+	UnsealVerdictPCRPolicyRevoked
+
+	// UnsealVerdictKeyExpired indicates that the lifetime of the sealed key object has been exceeded.
+	UnsealVerdictKeyExpired
+
+	// UnsealVerdictAccessLocked indicates that access to the sealed key object has been locked with
+	// LockSealedKeyAccess.
+	UnsealVerdictAccessLocked
+
+	// UnsealVerdictPINAttemptLimitReached indicates that the PIN attempt limit has been reached.
+	UnsealVerdictPINAttemptLimitReached
+
+	// UnsealVerdictWrongDevice indicates that the sealed key object enforces the identity of the device it was created
+	// on, and the current device has a different identity.
+	UnsealVerdictWrongDevice
+
+	// UnsealVerdictVersionRevoked indicates that the rollback counter has been advanced beyond the version recorded in
+	// the sealed key object.
+	UnsealVerdictVersionRevoked
+)
+
+func (v UnsealVerdict) String() string {
+	switch v {
+	case UnsealVerdictOK:
+		return "ok"
+	case UnsealVerdictTPMLockout:
+		return "TPM lockout"
+	case UnsealVerdictTPMProvisioningError:
+		return "TPM provisioning error"
+	case UnsealVerdictInvalidKeyFile:
+		return "invalid key file"
+	case UnsealVerdictPCRPolicyMismatch:
+		return "PCR policy mismatch"
+	case UnsealVerdictPCRPolicyRevoked:
+		return "PCR policy revoked"
+	case UnsealVerdictKeyExpired:
+		return "key expired"
+	case UnsealVerdictAccessLocked:
+		return "access locked"
+	case UnsealVerdictPINAttemptLimitReached:
+		return "PIN attempt limit reached"
+	case UnsealVerdictWrongDevice:
+		return "wrong device"
+	case UnsealVerdictVersionRevoked:
+		return "version revoked"
+	default:
+		return "unknown"
+	}
+}
+
+// CheckUnsealable determines whether this sealed key object can be unsealed with the TPM's current state, without
+// unsealing it. It loads the sealed object and executes the authorization policy session in the same way as UnsealFromTPM,
+// which checks the TPM's dictionary attack state, the PCR values, the PCR policy counter, the lifetime of the key and the
+// lock index, but it stops before the PIN assertion and the final unseal operation. This means that it doesn't check the PIN
+// and doesn't affect the TPM's dictionary attack counter or the failure count of a PIN index. It is intended to be used by
+// a service that periodically checks the health of sealed keys, so that a problem can be reported before the next boot fails.
+//
+// Restrictions on the locality or command that the sealed key object can be used with aren't checked, because these are
+// enforced when the object is unsealed.
+//
+// On success, the verdict is returned. If the check could not be completed, UnsealVerdictUnknown is returned along with an
+// error. If a command cannot be sent to the TPM or a response cannot be received from it, a TPMCommunicationError error will
+// be returned.
+func (k *SealedKeyObject) CheckUnsealable(tpm *Connection) (verdict UnsealVerdict, err error) {
+	defer func() {
+		var e *tpm2.TctiError
+		if xerrors.As(err, &e) {
+			err = TPMCommunicationError{err}
+		}
+	}()
+
+	keyObject, policySession, err := k.prepareUnseal(tpm, "", true, tpm.HmacSession())
+	if err == nil {
+		tpm.FlushContext(keyObject)
+		tpm.FlushContext(policySession)
+
+		if k.data.staticPolicyData.pinIndexHandle != tpm2.HandleNull && k.pinAttemptLimitReached(tpm) {
+			return UnsealVerdictPINAttemptLimitReached, nil
+		}
+		return UnsealVerdictOK, nil
+	}
+
+	var pcrErr PCRPolicyMismatchError
+	var keyFileErr InvalidKeyFileError
+	switch {
+	case err == ErrTPMLockout:
+		return UnsealVerdictTPMLockout, nil
+	case err == ErrTPMProvisioning || err == ErrNoStorageRootKey:
+		return UnsealVerdictTPMProvisioningError, nil
+	case err == ErrKeyExpired:
+		return UnsealVerdictKeyExpired, nil
+	case err == ErrSealedKeyAccessLocked:
+		return UnsealVerdictAccessLocked, nil
+	case err == ErrPINAttemptLimitReached:
+		return UnsealVerdictPINAttemptLimitReached, nil
+	case err == ErrWrongDevice:
+		return UnsealVerdictWrongDevice, nil
+	case err == ErrKeyVersionRevoked:
+		return UnsealVerdictVersionRevoked, nil
+	case xerrors.As(err, &pcrErr):
+		return UnsealVerdictPCRPolicyMismatch, nil
+	case xerrors.Is(err, ErrPCRPolicyRevoked):
+		return UnsealVerdictPCRPolicyRevoked, nil
+	case xerrors.As(err, &keyFileErr):
+		return UnsealVerdictInvalidKeyFile, nil
+	}
+	return UnsealVerdictUnknown, err
+}
+
+// pinAttemptLimitReached indicates whether this sealed key object has a PIN attempt limit that has been reached.
+func (k *SealedKeyObject) pinAttemptLimitReached(tpm *Connection) bool {
+	pub, err := k.data.pinIndexPublic(tpm.TPMContext, tpm.HmacSession())
+	if err != nil || pub == nil {
+		return false
+	}
+	params, err := readPinIndex(tpm.TPMContext, pub, tpm.HmacSession())
+	if err != nil {
+		return false
+	}
+	return params.PinCount >= params.PinLimit
+}
+
+// resetPINAttempts resets the failure count of the PIN index associated with this sealed key object, if there is one.
+func (k *SealedKeyObject) resetPINAttempts(tpm *Connection, pin string) error {
+	pub, err := k.data.pinIndexPublic(tpm.TPMContext, tpm.HmacSession())
+	if err != nil || pub == nil {
+		return err
+	}
+	params, err := readPinIndex(tpm.TPMContext, pub, tpm.HmacSession())
+	if err != nil {
+		return xerrors.Errorf("cannot read PIN index: %w", err)
+	}
+	if params.PinCount == 0 {
+		return nil
+	}
+	return writePinIndex(tpm.TPMContext, pub, pin, params.PinLimit, tpm.HmacSession())
+}
@@ -26,11 +26,15 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 
 	"github.com/canonical/go-tpm2"
 
+	"golang.org/x/xerrors"
+
 	"github.com/snapcore/secboot/internal/tcg"
+	"github.com/snapcore/secboot/internal/testutil"
 	. "github.com/snapcore/secboot/tpm2"
 )
 
@@ -91,6 +95,72 @@ func TestUnsealWithNo2FA(t *testing.T) {
 	})
 }
 
+func TestUnsealWithExistingSRK(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	clearTPMWithPlatformAuth(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	srk := createPersistentStorageKey(t, tpm, 0x81000002, &testCustomSRKTemplate)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUnsealWithExistingSRK_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+
+	authKey, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{
+		PCRProfile:             getTestPCRProfile(),
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		SRKHandle:              0x81000002,
+		SRKTemplate:            &testCustomSRKTemplate})
+	if err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if k.Version() != CurrentMetadataVersion {
+		t.Errorf("Unexpected version: %d", k.Version())
+	}
+
+	keyUnsealed, authKeyUnsealed, err := k.UnsealFromTPM(tpm, "")
+	if err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(key, keyUnsealed) {
+		t.Errorf("TPM returned the wrong key")
+	}
+	if !bytes.Equal(authKey, authKeyUnsealed) {
+		t.Errorf("TPM returned the wrong auth key")
+	}
+
+	// Replace the storage key with one created from a different template, and make sure that this
+	// is detected as a provisioning error.
+	if _, err := tpm.EvictControl(tpm.OwnerHandleContext(), srk, srk.Handle(), nil); err != nil {
+		t.Fatalf("EvictControl failed: %v", err)
+	}
+	createPersistentStorageKey(t, tpm, 0x81000002, tcg.SRKTemplate)
+
+	if _, _, err := k.UnsealFromTPM(tpm, ""); err != ErrTPMProvisioning {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
 func TestUnsealImportable(t *testing.T) {
 	tpm := openTPMForTesting(t)
 	defer closeTPM(t, tpm)
@@ -314,7 +384,7 @@ func TestUnsealErrorHandling(t *testing.T) {
 				t.Errorf("EvictControl failed: %v", err)
 			}
 		})
-		if err != ErrTPMProvisioning {
+		if err != ErrNoStorageRootKey {
 			t.Errorf("Unexpected error: %v", err)
 		}
 	})
@@ -358,6 +428,12 @@ func TestUnsealErrorHandling(t *testing.T) {
 			"assertions: cannot complete OR assertions: current session digest not found in policy data" {
 			t.Errorf("Unexpected error: %v", err)
 		}
+		var e PCRPolicyMismatchError
+		if !xerrors.As(err, &e) {
+			t.Errorf("Expected a PCRPolicyMismatchError")
+		} else if !reflect.DeepEqual(e.PCRs, tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}}) {
+			t.Errorf("Unexpected PCR selection: %v", e.PCRs)
+		}
 	})
 
 	t.Run("RevokedPolicy", func(t *testing.T) {
@@ -390,6 +466,9 @@ func TestUnsealErrorHandling(t *testing.T) {
 			"assertions: the PCR policy has been revoked" {
 			t.Errorf("Unexpected error: %v", err)
 		}
+		if !xerrors.Is(err, ErrPCRPolicyRevoked) {
+			t.Errorf("Expected ErrPCRPolicyRevoked")
+		}
 	})
 
 	t.Run("SealedKeyAccessLocked", func(t *testing.T) {
@@ -420,3 +499,344 @@ func TestUnsealErrorHandling(t *testing.T) {
 		}
 	})
 }
+
+func TestUnsealFromTPMWithAudit(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUnsealFromTPMWithAudit_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+
+	if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: tpm2.HandleNull}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	keyUnsealed, _, err := k.UnsealFromTPMWithAudit(tpm, "")
+	if err != nil {
+		t.Fatalf("UnsealFromTPMWithAudit failed: %v", err)
+	}
+	if !bytes.Equal(key, keyUnsealed) {
+		t.Errorf("TPM returned the wrong key")
+	}
+
+	if _, err := tpm.PCREvent(tpm.PCRHandleContext(7), tpm2.Event("foo"), nil); err != nil {
+		t.Errorf("PCREvent failed: %v", err)
+	}
+
+	_, _, err = k.UnsealFromTPMWithAudit(tpm, "")
+	e, ok := err.(*UnsealAuditError)
+	if !ok {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := e.Err.(InvalidKeyFileError); !ok {
+		t.Errorf("Unexpected error: %v", e.Err)
+	}
+	var pcrErr PCRPolicyMismatchError
+	if !xerrors.As(err, &pcrErr) {
+		t.Errorf("Expected a PCRPolicyMismatchError")
+	}
+	if e.AuditInfo == nil {
+		t.Fatalf("Missing audit info")
+	}
+	if e.AuditInfo.Type != tpm2.TagAttestSessionAudit {
+		t.Errorf("Unexpected attestation type: %v", e.AuditInfo.Type)
+	}
+	if len(e.AuditInfo.Attested.SessionAudit.SessionDigest) != 32 {
+		t.Errorf("Unexpected session digest")
+	}
+}
+
+func TestUnsealRequireEncryptedSessions(t *testing.T) {
+	if !testutil.UseMssim {
+		t.SkipNow()
+	}
+
+	restore := testutil.MockOpenDefaultTctiFn(func() (tpm2.TCTI, error) {
+		return tpm2.OpenMssim("", testutil.MssimPort, testutil.MssimPort+1)
+	})
+	defer restore()
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUnsealRequireEncryptedSessions_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+
+	func() {
+		tpm, _ := openTPMSimulatorForTesting(t)
+		defer closeTPM(t, tpm)
+
+		clearTPMWithPlatformAuth(t, tpm)
+		if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+			t.Fatalf("Failed to provision TPM for test: %v", err)
+		}
+
+		if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: tpm2.HandleNull}); err != nil {
+			t.Fatalf("SealKeyToTPM failed: %v", err)
+		}
+	}()
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	t.Run("VerifiedConnection", func(t *testing.T) {
+		tpm, err := SecureConnectToDefaultTPMWithOptions(bytes.NewReader(testutil.EncodedTPMSimulatorEKCertChain), nil,
+			&ConnectionOptions{RequireEncryptedSessions: true})
+		if err != nil {
+			t.Fatalf("SecureConnectToDefaultTPMWithOptions failed: %v", err)
+		}
+		defer closeTPM(t, tpm)
+
+		keyUnsealed, _, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			t.Fatalf("UnsealFromTPM failed: %v", err)
+		}
+		if !bytes.Equal(key, keyUnsealed) {
+			t.Errorf("TPM returned the wrong key")
+		}
+	})
+
+	t.Run("UnverifiedConnection", func(t *testing.T) {
+		tpm, err := ConnectToDefaultTPMWithOptions(&ConnectionOptions{RequireEncryptedSessions: true})
+		if err != nil {
+			t.Fatalf("ConnectToDefaultTPMWithOptions failed: %v", err)
+		}
+		defer closeTPM(t, tpm)
+
+		if _, _, err := k.UnsealFromTPM(tpm, ""); err != ErrNoEncryptedSession {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if _, _, err := k.UnsealFromTPMWithAudit(tpm, ""); err != ErrNoEncryptedSession {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if err := k.ChangePIN(tpm, "", "1234"); err != ErrNoEncryptedSession {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if _, err := SealKeyToTPM(tpm, key, tmpDir+"/keydata2", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: tpm2.HandleNull}); err != ErrNoEncryptedSession {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if err := RewrapSealedKeyObject(tpm, keyFile, tmpDir+"/keydata3"); err != ErrNoEncryptedSession {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("UnverifiedConnectionNotRequired", func(t *testing.T) {
+		tpm, err := ConnectToDefaultTPMWithOptions(nil)
+		if err != nil {
+			t.Fatalf("ConnectToDefaultTPMWithOptions failed: %v", err)
+		}
+		defer closeTPM(t, tpm)
+
+		if _, _, err := k.UnsealFromTPM(tpm, ""); err != nil {
+			t.Errorf("UnsealFromTPM failed: %v", err)
+		}
+	})
+}
+
+func TestCheckPCRPolicy(t *testing.T) {
+	tpm, tcti := openTPMSimulatorForTesting(t)
+	defer func() {
+		tpm, _ = resetTPMSimulator(t, tpm, tcti)
+		closeTPM(t, tpm)
+	}()
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestCheckPCRPolicy_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+
+	if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PCRPolicyCounterHandle: 0x0181fff0}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	expectedPCRs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}}
+	if !k.PCRSelection().Equal(expectedPCRs) {
+		t.Errorf("Unexpected PCR selection: %v", k.PCRSelection())
+	}
+	if len(k.PCRPolicyDigest()) != tpm2.HashAlgorithmSHA256.Size() {
+		t.Errorf("Unexpected PCR policy digest: %x", k.PCRPolicyDigest())
+	}
+	if len(k.PolicyDigest()) != tpm2.HashAlgorithmSHA256.Size() {
+		t.Errorf("Unexpected policy digest: %x", k.PolicyDigest())
+	}
+
+	if err := k.CheckPCRPolicy(tpm); err != nil {
+		t.Errorf("CheckPCRPolicy failed: %v", err)
+	}
+
+	if _, err := tpm.PCREvent(tpm.PCRHandleContext(7), []byte("foo"), nil); err != nil {
+		t.Fatalf("PCREvent failed: %v", err)
+	}
+
+	var e PCRPolicyMismatchError
+	if err := k.CheckPCRPolicy(tpm); !xerrors.As(err, &e) || !e.PCRs.Equal(expectedPCRs) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// The sealed object should not have been unsealed or affected by the check.
+	if _, _, err := k.UnsealFromTPM(tpm, ""); !xerrors.As(err, &e) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestCheckPCRPolicyReportsMismatchedPCRs(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestCheckPCRPolicyReportsMismatchedPCRs_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+
+	profile := NewPCRProtectionProfile().
+		AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7).
+		AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 8)
+	if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{PCRProfile: profile, PCRPolicyCounterHandle: tpm2.HandleNull}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	if _, err := tpm.PCREvent(tpm.PCRHandleContext(8), []byte("foo"), nil); err != nil {
+		t.Fatalf("PCREvent failed: %v", err)
+	}
+
+	expectedPCRs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{8}}}
+
+	var e PCRPolicyMismatchError
+	if err := k.CheckPCRPolicy(tpm); !xerrors.As(err, &e) || !e.PCRs.Equal(expectedPCRs) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, _, err := k.UnsealFromTPM(tpm, ""); !xerrors.As(err, &e) || !e.PCRs.Equal(expectedPCRs) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestCheckUnsealable(t *testing.T) {
+	tpm, tcti := openTPMSimulatorForTesting(t)
+	defer func() {
+		tpm, _ = resetTPMSimulator(t, tpm, tcti)
+		closeTPM(t, tpm)
+	}()
+
+	if err := tpm.EnsureProvisioned(ProvisionModeFull, nil); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestCheckUnsealable_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+	lockIndexHandle := tpm2.Handle(0x01810020)
+
+	if _, err := SealKeyToTPM(tpm, key, keyFile, &KeyCreationParams{
+		PCRProfile:             getTestPCRProfile(),
+		PCRPolicyCounterHandle: 0x0181fff0,
+		LockIndexHandle:        lockIndexHandle}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+	defer func() {
+		rc, err := tpm.CreateResourceContextFromTPM(lockIndexHandle)
+		if err != nil {
+			t.Errorf("CreateResourceContextFromTPM failed: %v", err)
+			return
+		}
+		undefineNVSpace(t, tpm, rc, tpm.OwnerHandleContext())
+	}()
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	check := func(t *testing.T, expected UnsealVerdict) {
+		verdict, err := k.CheckUnsealable(tpm)
+		if err != nil {
+			t.Fatalf("CheckUnsealable failed: %v", err)
+		}
+		if verdict != expected {
+			t.Errorf("Unexpected verdict: %v", verdict)
+		}
+	}
+
+	// Setting a PIN shouldn't affect the check, because the PIN isn't verified.
+	if err := k.ChangePIN(tpm, "", "1234"); err != nil {
+		t.Fatalf("ChangePIN failed: %v", err)
+	}
+	check(t, UnsealVerdictOK)
+
+	// The check shouldn't consume the key.
+	if _, _, err := k.UnsealFromTPM(tpm, "1234"); err != nil {
+		t.Errorf("UnsealFromTPM failed: %v", err)
+	}
+
+	if err := LockSealedKeyAccess(tpm, lockIndexHandle); err != nil {
+		t.Fatalf("LockSealedKeyAccess failed: %v", err)
+	}
+	check(t, UnsealVerdictAccessLocked)
+
+	if _, err := tpm.PCREvent(tpm.PCRHandleContext(7), []byte("foo"), nil); err != nil {
+		t.Fatalf("PCREvent failed: %v", err)
+	}
+	check(t, UnsealVerdictPCRPolicyMismatch)
+}
@@ -21,8 +21,10 @@ package tpm2
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/rsa"
 	"errors"
 	"fmt"
 	"math/big"
@@ -167,6 +169,41 @@ func createTPMPublicAreaForECDSAKey(key *ecdsa.PublicKey) *tpm2.Public {
 				Y: bigIntToBytesZeroExtended(key.Y, key.Params().BitSize/8)}}}
 }
 
+// createTPMPublicAreaForPublicKey creates a *tpm2.Public from a go *rsa.PublicKey or *ecdsa.PublicKey, which is suitable
+// for loading in to a TPM with TPMContext.LoadExternal. RSA keys are created with the RSASSA-PSS scheme.
+func createTPMPublicAreaForPublicKey(key crypto.PublicKey) (*tpm2.Public, error) {
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P224(), elliptic.P256(), elliptic.P384(), elliptic.P521():
+		default:
+			return nil, errors.New("unsupported curve")
+		}
+		return createTPMPublicAreaForECDSAKey(k), nil
+	case *rsa.PublicKey:
+		exp := uint32(k.E)
+		if exp == 65537 {
+			// The default exponent of 2^^16-1 is indicated by the value of 0 in the public area.
+			exp = 0
+		}
+		return &tpm2.Public{
+			Type:    tpm2.ObjectTypeRSA,
+			NameAlg: tpm2.HashAlgorithmSHA256,
+			Attrs:   tpm2.AttrSensitiveDataOrigin | tpm2.AttrUserWithAuth | tpm2.AttrSign,
+			Params: &tpm2.PublicParamsU{
+				RSADetail: &tpm2.RSAParams{
+					Symmetric: tpm2.SymDefObject{Algorithm: tpm2.SymObjectAlgorithmNull},
+					Scheme: tpm2.RSAScheme{
+						Scheme:  tpm2.RSASchemeRSAPSS,
+						Details: &tpm2.AsymSchemeU{RSAPSS: &tpm2.SigSchemeRSAPSS{HashAlg: tpm2.HashAlgorithmSHA256}}},
+					KeyBits:  uint16(k.N.BitLen()),
+					Exponent: exp}},
+			Unique: &tpm2.PublicIDU{RSA: k.N.Bytes()}}, nil
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+}
+
 func createECDSAPrivateKeyFromTPM(public *tpm2.Public, private tpm2.ECCParameter) (*ecdsa.PrivateKey, error) {
 	if public.Type != tpm2.ObjectTypeECC {
 		return nil, errors.New("unsupported type")
@@ -194,6 +231,60 @@ func createECDSAPrivateKeyFromTPM(public *tpm2.Public, private tpm2.ECCParameter
 		D: new(big.Int).SetBytes(private)}, nil
 }
 
+func createRSAPrivateKeyFromTPM(public *tpm2.Public, private []byte) (*rsa.PrivateKey, error) {
+	if public.Type != tpm2.ObjectTypeRSA {
+		return nil, errors.New("unsupported type")
+	}
+
+	exp := int(public.Params.RSADetail.Exponent)
+	if exp == 0 {
+		// The default exponent of 2^^16-1 is indicated by the value of 0 in the public area.
+		exp = 65537
+	}
+
+	// The private part of a RSA key in the TPM is one of the primes.
+	n := new(big.Int).SetBytes(public.Unique.RSA)
+	p := new(big.Int).SetBytes(private)
+	if p.Sign() == 0 {
+		return nil, errors.New("invalid prime")
+	}
+	q, r := new(big.Int).QuoRem(n, p, new(big.Int))
+	if r.Sign() != 0 {
+		return nil, errors.New("prime is not a factor of the modulus")
+	}
+
+	one := big.NewInt(1)
+	phi := new(big.Int).Mul(new(big.Int).Sub(p, one), new(big.Int).Sub(q, one))
+	d := new(big.Int).ModInverse(big.NewInt(int64(exp)), phi)
+	if d == nil {
+		return nil, errors.New("invalid exponent")
+	}
+
+	key := &rsa.PrivateKey{
+		PublicKey: rsa.PublicKey{N: n, E: exp},
+		D:         d,
+		Primes:    []*big.Int{p, q}}
+	if err := key.Validate(); err != nil {
+		return nil, err
+	}
+	key.Precompute()
+	return key, nil
+}
+
+// createPolicyAuthKeyFromTPM recreates the key used to authorize PCR policy updates from the supplied public area
+// and the private part that is stored inside a sealed key object, which is the private scalar for ECDSA keys or
+// one of the primes for RSA keys.
+func createPolicyAuthKeyFromTPM(public *tpm2.Public, private PolicyAuthKey) (crypto.PrivateKey, error) {
+	switch public.Type {
+	case tpm2.ObjectTypeECC:
+		return createECDSAPrivateKeyFromTPM(public, tpm2.ECCParameter(private))
+	case tpm2.ObjectTypeRSA:
+		return createRSAPrivateKeyFromTPM(public, private)
+	default:
+		return nil, errors.New("unsupported type")
+	}
+}
+
 // digestListContains indicates whether the specified digest is present in the list of digests.
 func digestListContains(list tpm2.DigestList, digest tpm2.Digest) bool {
 	for _, d := range list {